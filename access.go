@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+
+	"vault-docker-proxy/pkg/config"
+	"vault-docker-proxy/pkg/registry"
+)
+
+// groupRules converts the configured group access rules
+func groupRules(cfg config.AccessConfig) []registry.GroupRule {
+	var rules []registry.GroupRule
+	for _, rule := range cfg.Groups {
+		rules = append(rules, registry.GroupRule{Group: rule.Group, Registries: rule.Registries, Repositories: rule.Repositories})
+	}
+	return rules
+}
+
+// accessPolicies converts the configured access policies and environments
+func accessPolicies(cfg config.AccessConfig) ([]registry.AccessPolicy, []registry.Environment, error) {
+	var environments []registry.Environment
+	for _, envConfig := range cfg.Environments {
+		env, err := registry.ParseEnvironment(envConfig.Name, envConfig.Networks)
+		if err != nil {
+			return nil, nil, fmt.Errorf("environment %s: %v", envConfig.Name, err)
+		}
+		environments = append(environments, env)
+	}
+
+	var policies []registry.AccessPolicy
+	for _, policyConfig := range cfg.Policies {
+		policy := registry.AccessPolicy{
+			Name:         policyConfig.Name,
+			Registries:   policyConfig.Registries,
+			Repositories: policyConfig.Repositories,
+			Actions:      policyConfig.Actions,
+			Environments: policyConfig.Environments,
+		}
+		for i, windowConfig := range policyConfig.Windows {
+			window, err := registry.ParseTimeWindow(windowConfig.Days, windowConfig.Start, windowConfig.End, windowConfig.Timezone)
+			if err != nil {
+				return nil, nil, fmt.Errorf("policy %s: windows[%d]: %v", policyConfig.Name, i, err)
+			}
+			policy.Windows = append(policy.Windows, window)
+		}
+		policies = append(policies, policy)
+	}
+
+	return policies, environments, nil
+}
+
+// clientIdentities converts the configured client certificate identities
+func clientIdentities(cfg config.ClientAuthConfig) []registry.ClientIdentity {
+	var identities []registry.ClientIdentity
+	for _, identity := range cfg.Identities {
+		identities = append(identities, registry.ClientIdentity{Names: identity.Names, VaultPaths: identity.VaultPaths, Registries: identity.Registries})
+	}
+	return identities
+}
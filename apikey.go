@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"vault-docker-proxy/pkg/auth"
+)
+
+// runAPIKey implements the "apikey" subcommand, which generates an API key and prints the Vault
+// command that stores its hash. The key itself is only shown once.
+func runAPIKey(args []string) int {
+	fs := flag.NewFlagSet("apikey", flag.ContinueOnError)
+	registry := fs.String("registry", "", "proxy-style username the key maps to: <registry_type>;<vault_path>;<registry_url>")
+	permissions := fs.String("permissions", auth.ActionPull, "comma-separated actions granted: pull, push, delete or *")
+	name := fs.String("name", "", "label shown in logs and errors")
+	mount := fs.String("mount", "secret", "KV v2 mount holding API keys (auth.api_keys.mount)")
+	keyPath := fs.String("path", "", "path under the mount holding API keys (auth.api_keys.path)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if *registry == "" || *keyPath == "" {
+		fmt.Fprintln(os.Stderr, "apikey: -registry and -path are required")
+		fs.Usage()
+		return 2
+	}
+	if _, err := auth.ParseUsername(*registry); err != nil {
+		fmt.Fprintf(os.Stderr, "apikey: -registry: %v\n", err)
+		return 2
+	}
+	for _, permission := range strings.Split(*permissions, ",") {
+		switch strings.TrimSpace(permission) {
+		case auth.ActionPull, auth.ActionPush, auth.ActionDelete, "*":
+		default:
+			fmt.Fprintf(os.Stderr, "apikey: unknown permission %q\n", permission)
+			return 2
+		}
+	}
+
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		fmt.Fprintf(os.Stderr, "apikey: %v\n", err)
+		return 1
+	}
+	key := auth.APIKeyPrefix + base64.RawURLEncoding.EncodeToString(random)
+
+	command := fmt.Sprintf("vault kv put -mount=%s %s registry='%s' permissions='%s'",
+		*mount, path.Join(*keyPath, auth.HashAPIKey(key)), *registry, *permissions)
+	if *name != "" {
+		command += fmt.Sprintf(" name='%s'", *name)
+	}
+
+	fmt.Printf("API key (store it now, it cannot be recovered):\n  %s\n\n", key)
+	fmt.Printf("Store its hash in Vault with:\n  %s\n", command)
+	return 0
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"vault-docker-proxy/pkg/registry"
+)
+
+// benchSample is the outcome of a single request issued by the bench subcommand
+type benchSample struct {
+	kind     string
+	duration time.Duration
+	bytes    int64
+	err      error
+}
+
+// runBench implements the "bench" subcommand, which drives concurrent pulls through a running
+// proxy and reports latency percentiles together with the proxy's cache and Vault counters
+func runBench(args []string) int {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	target := fs.String("target", "http://localhost:8080", "base URL of the proxy")
+	username := fs.String("username", "", "proxy-style username: <registry_type>;<vault_path>;<registry_url>")
+	token := fs.String("token", os.Getenv("VAULT_TOKEN"), "Vault token (defaults to $VAULT_TOKEN)")
+	image := fs.String("image", "", "repository[:tag|@digest] to pull, e.g. library/alpine:latest")
+	concurrency := fs.Int("concurrency", 10, "number of concurrent workers")
+	iterations := fs.Int("n", 100, "total number of image pulls")
+	blobs := fs.Bool("blobs", false, "also download every blob referenced by the manifest")
+	adminURL := fs.String("admin-url", "", "admin listener URL used to read cache and Vault counters, e.g. http://localhost:9090")
+	adminToken := fs.String("admin-token", os.Getenv("ADMIN_TOKEN"), "admin listener token (defaults to $ADMIN_TOKEN)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *username == "" || *token == "" || *image == "" {
+		fmt.Fprintln(os.Stderr, "bench: -username, -token (or VAULT_TOKEN) and -image are required")
+		fs.Usage()
+		return 2
+	}
+	if *concurrency < 1 || *iterations < 1 {
+		fmt.Fprintln(os.Stderr, "bench: -concurrency and -n must be positive")
+		return 2
+	}
+
+	repo, reference := splitImageReference(*image)
+	baseURL := strings.TrimSuffix(*target, "/")
+	manifestURL := fmt.Sprintf("%s/v2/%s/manifests/%s", baseURL, repo, reference)
+	client := &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: *concurrency}}
+
+	get := func(kind, url, accept string) benchSample {
+		start := time.Now()
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			return benchSample{kind: kind, err: err}
+		}
+		req.SetBasicAuth(*username, *token)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return benchSample{kind: kind, duration: time.Since(start), err: err}
+		}
+		defer resp.Body.Close()
+		n, err := io.Copy(io.Discard, resp.Body)
+		if err == nil && resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf("HTTP %d", resp.StatusCode)
+		}
+		return benchSample{kind: kind, duration: time.Since(start), bytes: n, err: err}
+	}
+
+	var blobDigests []string
+	if *blobs {
+		digests, err := benchBlobDigests(client, manifestURL, *username, *token)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "bench: failed to read manifest: %v\n", err)
+			return 1
+		}
+		blobDigests = digests
+	}
+
+	before, statsErr := fetchProxyStats(*adminURL, *adminToken)
+
+	var (
+		mu      sync.Mutex
+		samples []benchSample
+		next    atomic.Int64
+		wg      sync.WaitGroup
+	)
+	start := time.Now()
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for next.Add(1) <= int64(*iterations) {
+				pulled := []benchSample{get("manifest", manifestURL, manifestAcceptHeader)}
+				for _, digest := range blobDigests {
+					pulled = append(pulled, get("blob", fmt.Sprintf("%s/v2/%s/blobs/%s", baseURL, repo, digest), ""))
+				}
+				mu.Lock()
+				samples = append(samples, pulled...)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	fmt.Printf("Pulled %s %d time(s) with %d worker(s) in %s (%.1f pulls/s)\n",
+		*image, *iterations, *concurrency, elapsed.Round(time.Millisecond), float64(*iterations)/elapsed.Seconds())
+	printBenchLatencies(samples)
+
+	if *adminURL != "" {
+		after, err := fetchProxyStats(*adminURL, *adminToken)
+		if statsErr == nil {
+			statsErr = err
+		}
+		if statsErr != nil {
+			fmt.Printf("Proxy counters unavailable: %v\n", statsErr)
+		} else {
+			hits := after.CacheHits - before.CacheHits
+			misses := after.CacheMisses - before.CacheMisses
+			hitRate := 0.0
+			if hits+misses > 0 {
+				hitRate = float64(hits) / float64(hits+misses) * 100
+			}
+			fmt.Printf("Credential cache: %d hit(s), %d miss(es), %.1f%% hit rate\n", hits, misses, hitRate)
+			fmt.Printf("Vault calls: %d (%d error(s))\n", after.VaultCalls-before.VaultCalls, after.VaultErrors-before.VaultErrors)
+		}
+	}
+
+	for _, sample := range samples {
+		if sample.err != nil {
+			return 1
+		}
+	}
+	return 0
+}
+
+// benchBlobDigests fetches the manifest once and returns the config and layer digests
+func benchBlobDigests(client *http.Client, manifestURL, username, token string) ([]string, error) {
+	req, err := http.NewRequest(http.MethodGet, manifestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(username, token)
+	req.Header.Set("Accept", manifestAcceptHeader)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+
+	var manifest struct {
+		Config struct {
+			Digest string `json:"digest"`
+		} `json:"config"`
+		Layers []struct {
+			Digest string `json:"digest"`
+		} `json:"layers"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&manifest); err != nil {
+		return nil, err
+	}
+	if manifest.Config.Digest == "" {
+		return nil, fmt.Errorf("manifest has no config blob; use a single-platform manifest")
+	}
+
+	digests := []string{manifest.Config.Digest}
+	for _, layer := range manifest.Layers {
+		digests = append(digests, layer.Digest)
+	}
+	return digests, nil
+}
+
+// fetchProxyStats reads the proxy counters from the admin listener
+func fetchProxyStats(adminURL, adminToken string) (registry.ProxyStats, error) {
+	var stats registry.ProxyStats
+	if adminURL == "" {
+		return stats, nil
+	}
+
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(adminURL, "/")+"/admin/stats", nil)
+	if err != nil {
+		return stats, err
+	}
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return stats, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return stats, fmt.Errorf("admin listener returned HTTP %d", resp.StatusCode)
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&stats)
+	return stats, err
+}
+
+// printBenchLatencies prints request counts and latency percentiles per request kind
+func printBenchLatencies(samples []benchSample) {
+	byKind := make(map[string][]benchSample)
+	for _, sample := range samples {
+		byKind[sample.kind] = append(byKind[sample.kind], sample)
+	}
+
+	fmt.Printf("%-9s %7s %7s %10s %10s %10s %10s %10s\n", "kind", "count", "errors", "p50", "p90", "p99", "max", "bytes")
+	for _, kind := range []string{"manifest", "blob"} {
+		kindSamples := byKind[kind]
+		if len(kindSamples) == 0 {
+			continue
+		}
+
+		durations := make([]time.Duration, 0, len(kindSamples))
+		errors := 0
+		var bytes int64
+		for _, sample := range kindSamples {
+			durations = append(durations, sample.duration)
+			bytes += sample.bytes
+			if sample.err != nil {
+				errors++
+			}
+		}
+		sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+
+		percentile := func(p float64) time.Duration {
+			return durations[int(p*float64(len(durations)-1))].Round(time.Microsecond)
+		}
+		fmt.Printf("%-9s %7d %7d %10s %10s %10s %10s %10d\n", kind, len(kindSamples), errors,
+			percentile(0.50), percentile(0.90), percentile(0.99), durations[len(durations)-1].Round(time.Microsecond), bytes)
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"vault-docker-proxy/pkg/auth"
+	"vault-docker-proxy/pkg/config"
+	"vault-docker-proxy/pkg/provider"
+	"vault-docker-proxy/pkg/vault"
+)
+
+// manifestAcceptHeader lists the manifest media types accepted by the check manifest HEAD
+var manifestAcceptHeader = strings.Join([]string{
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.oci.image.index.v1+json",
+}, ", ")
+
+// CheckStep represents the outcome of a single connectivity check step
+type CheckStep struct {
+	Name     string `json:"name"`
+	Passed   bool   `json:"passed"`
+	Skipped  bool   `json:"skipped,omitempty"`
+	Detail   string `json:"detail,omitempty"`
+	Duration string `json:"duration"`
+}
+
+// CheckReport is the structured result of the check subcommand
+type CheckReport struct {
+	Username string      `json:"username"`
+	Registry string      `json:"registry,omitempty"`
+	Image    string      `json:"image,omitempty"`
+	Passed   bool        `json:"passed"`
+	Steps    []CheckStep `json:"steps"`
+}
+
+// runCheck implements the "check" subcommand, which performs an end-to-end connectivity test
+// from the Vault secret through to a manifest HEAD against the target registry
+func runCheck(args []string) int {
+	fs := flag.NewFlagSet("check", flag.ContinueOnError)
+	username := fs.String("username", "", "proxy-style username: <registry_type>;<vault_path>;<registry_url>")
+	token := fs.String("token", os.Getenv("VAULT_TOKEN"), "Vault token (defaults to $VAULT_TOKEN)")
+	vaultAddr := fs.String("vault-addr", envOrDefault("VAULT_ADDR", DefaultVaultAddr), "Vault server address")
+	image := fs.String("image", "", "repository[:tag|@digest] to HEAD on the target registry, e.g. library/alpine:latest")
+	timeout := fs.Duration("timeout", 30*time.Second, "overall timeout for the check")
+	jsonOutput := fs.Bool("json", false, "print the report as JSON")
+	configPath := fs.String("config", os.Getenv("CONFIG_FILE"), "YAML configuration file whose upstream settings (proxies, pins, allowlist, retries) the check uses")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if *username == "" || *token == "" {
+		fmt.Fprintln(os.Stderr, "check: -username and -token (or VAULT_TOKEN) are required")
+		fs.Usage()
+		return 2
+	}
+
+	// Registry requests go through the same transports as the server's, Bearer token exchange
+	// included
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "check: failed to load configuration: %v\n", err)
+		return 2
+	}
+	upstream, err := newUpstreamClient(cfg, nil, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "check: %v\n", err)
+		return 2
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	report := performCheck(ctx, upstream.Client, *vaultAddr, *username, *token, *image)
+
+	if *jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+	} else {
+		printCheckReport(os.Stdout, report)
+	}
+
+	if !report.Passed {
+		return 1
+	}
+	return 0
+}
+
+// performCheck runs every check step in order, skipping the remaining steps after the first failure
+func performCheck(ctx context.Context, client *http.Client, vaultAddr, username, token, image string) *CheckReport {
+	report := &CheckReport{Username: username, Image: image, Passed: true}
+
+	var (
+		registryConfig   *auth.RegistryConfig
+		registryProvider provider.Provider
+		vaultClient      *vault.Client
+		credentials      *auth.Credentials
+		registryURL      string
+	)
+	defer func() { credentials.Wipe() }()
+
+	steps := []struct {
+		name string
+		run  func() (string, error)
+	}{
+		{"parse username", func() (string, error) {
+			cfg, err := auth.ParseUsername(username)
+			if err != nil {
+				return "", err
+			}
+			registryConfig = cfg
+			report.Registry = cfg.RegistryURL
+			return fmt.Sprintf("type=%s vault_path=%s registry=%s", cfg.Type, cfg.VaultPath, cfg.RegistryURL), nil
+		}},
+		{"vault token", func() (string, error) {
+			client, err := vault.NewClient(vaultAddr)
+			if err != nil {
+				return "", err
+			}
+			client.SetToken(token)
+			if err := client.ValidateToken(ctx); err != nil {
+				return "", err
+			}
+			vaultClient = client
+			return "token is valid at " + vaultAddr, nil
+		}},
+		{"vault secret", func() (string, error) {
+			var err error
+			registryProvider, err = provider.Lookup(registryConfig.Type)
+			if err != nil {
+				return "", err
+			}
+			secret, err := vaultClient.GetSecret(vault.WithNamespace(ctx, registryConfig.Namespace), registryConfig.VaultPath)
+			if err != nil {
+				return "", err
+			}
+			creds, err := registryProvider.Credentials(ctx, registryConfig, secret)
+			if err != nil {
+				return "", err
+			}
+			credentials = creds
+			return fmt.Sprintf("read credentials for registry user %q", creds.Username), nil
+		}},
+		{"registry auth", func() (string, error) {
+			registryURL = registryProvider.BaseURL(registryConfig.RegistryURL)
+			resp, err := checkRequest(ctx, client, http.MethodGet, registryURL+"/v2/", registryProvider, credentials, "")
+			if err != nil {
+				return "", err
+			}
+			return describeCheckResponse(resp)
+		}},
+		{"manifest HEAD", func() (string, error) {
+			repo, reference := splitImageReference(image)
+			resp, err := checkRequest(ctx, client, http.MethodHead, fmt.Sprintf("%s/v2/%s/manifests/%s", registryURL, repo, reference), registryProvider, credentials, manifestAcceptHeader)
+			if err != nil {
+				return "", err
+			}
+			detail, err := describeCheckResponse(resp)
+			if err != nil {
+				return "", err
+			}
+			if digest := resp.Header.Get("Docker-Content-Digest"); digest != "" {
+				detail += ", digest " + digest
+			}
+			return detail, nil
+		}},
+	}
+
+	for _, step := range steps {
+		if !report.Passed || (step.name == "manifest HEAD" && image == "") {
+			report.Steps = append(report.Steps, CheckStep{Name: step.name, Skipped: true, Duration: "0s"})
+			continue
+		}
+
+		start := time.Now()
+		detail, err := step.run()
+		result := CheckStep{Name: step.name, Passed: err == nil, Detail: detail, Duration: time.Since(start).Round(time.Millisecond).String()}
+		if err != nil {
+			result.Detail = err.Error()
+			report.Passed = false
+		}
+		report.Steps = append(report.Steps, result)
+	}
+
+	return report
+}
+
+// checkRequest issues a request to the registry using the Vault-sourced credentials, which the
+// client's token transport exchanges for a token when the registry answers with a Bearer
+// challenge
+func checkRequest(ctx context.Context, client *http.Client, method, url string, registryProvider provider.Provider, credentials *auth.Credentials, accept string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+	registryProvider.Authorize(req, credentials)
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("request failed: %v", err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return resp, nil
+}
+
+// describeCheckResponse turns a registry response into a step detail, failing on non-2xx statuses
+func describeCheckResponse(resp *http.Response) (string, error) {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return fmt.Sprintf("HTTP %d", resp.StatusCode), nil
+	}
+
+	detail := fmt.Sprintf("registry returned HTTP %d", resp.StatusCode)
+	if challenge := resp.Header.Get("WWW-Authenticate"); challenge != "" {
+		detail += fmt.Sprintf(" (challenge: %s)", challenge)
+	}
+	return "", fmt.Errorf("%s", detail)
+}
+
+// splitImageReference splits repository[:tag|@digest] into repository and reference, defaulting to "latest"
+func splitImageReference(image string) (string, string) {
+	if i := strings.Index(image, "@"); i != -1 {
+		return image[:i], image[i+1:]
+	}
+	if i := strings.LastIndex(image, ":"); i != -1 && !strings.Contains(image[i:], "/") {
+		return image[:i], image[i+1:]
+	}
+	return image, "latest"
+}
+
+// printCheckReport writes a human readable pass/fail report
+func printCheckReport(w io.Writer, report *CheckReport) {
+	fmt.Fprintf(w, "Checking %s\n", report.Username)
+	for _, step := range report.Steps {
+		status := "PASS"
+		switch {
+		case step.Skipped:
+			status = "SKIP"
+		case !step.Passed:
+			status = "FAIL"
+		}
+		fmt.Fprintf(w, "  [%s] %-15s %-8s %s\n", status, step.Name, step.Duration, step.Detail)
+	}
+
+	if report.Passed {
+		fmt.Fprintln(w, "Result: PASS")
+	} else {
+		fmt.Fprintln(w, "Result: FAIL")
+	}
+}
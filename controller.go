@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"vault-docker-proxy/pkg/auth"
+	"vault-docker-proxy/pkg/config"
+	"vault-docker-proxy/pkg/controller"
+	"vault-docker-proxy/pkg/registry"
+)
+
+// startController watches RegistryConfig resources in the background and applies them on top
+// of the configured group access rules
+func startController(ctx context.Context, cfg *config.Config, proxyServer *registry.ProxyServer) error {
+	client, err := controller.NewInClusterClient(cfg.Controller.Namespace)
+	if err != nil {
+		return err
+	}
+
+	staticRules := groupRules(cfg.Access)
+	ttl := cfg.Access.GroupCacheTTL.Duration()
+	c := controller.NewController(client, func(resources []controller.RegistryConfig) {
+		applyRegistryConfigs(proxyServer, resources, staticRules, ttl)
+	})
+	go c.Run(ctx)
+
+	slog.Info("Controller mode: watching resources", "resource", controller.Resource+"."+controller.Group, "namespace", client.Namespace())
+	return nil
+}
+
+// applyRegistryConfigs replaces the registry aliases and group access rules with those declared
+// by the resources. Group access stays disabled while no rule exists at all.
+func applyRegistryConfigs(proxyServer *registry.ProxyServer, resources []controller.RegistryConfig, staticRules []registry.GroupRule, ttl time.Duration) {
+	aliases := make(map[string]string)
+	rules := append([]registry.GroupRule(nil), staticRules...)
+	for _, resource := range resources {
+		for _, alias := range resource.Spec.Aliases {
+			aliases[alias] = resource.Spec.Registry
+		}
+		for _, group := range resource.Spec.Groups {
+			rules = append(rules, registry.GroupRule{
+				Group:        group.Group,
+				Registries:   []string{resource.Spec.Registry},
+				Repositories: group.Repositories,
+			})
+		}
+	}
+
+	auth.SetRegistryAliases(aliases)
+	if err := proxyServer.SetGroupAccess(rules, ttl); err != nil {
+		// Keep the previous rules rather than opening or closing access on a bad resource
+		slog.Error("Controller: not applying group access rules", "error", err)
+		return
+	}
+	slog.Info("Controller: applied RegistryConfigs", "resources", len(resources), "aliases", len(aliases), "group_rules", len(rules))
+}
@@ -1,73 +1,1118 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/http/pprof"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/hashicorp/vault/api"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"gopkg.in/yaml.v3"
 
+	"vault-docker-proxy/pkg/admin"
+	"vault-docker-proxy/pkg/audit"
 	"vault-docker-proxy/pkg/auth"
+	"vault-docker-proxy/pkg/blobcache"
+	"vault-docker-proxy/pkg/cache"
+	"vault-docker-proxy/pkg/cachecontrol"
+	"vault-docker-proxy/pkg/capture"
+	"vault-docker-proxy/pkg/chaos"
+	"vault-docker-proxy/pkg/config"
+	"vault-docker-proxy/pkg/controlplane"
+	"vault-docker-proxy/pkg/devmode"
+	"vault-docker-proxy/pkg/diagnostics"
+	"vault-docker-proxy/pkg/imagepolicy"
+	"vault-docker-proxy/pkg/logging"
+	"vault-docker-proxy/pkg/metrics"
+	"vault-docker-proxy/pkg/notation"
+	"vault-docker-proxy/pkg/ocilayout"
+	"vault-docker-proxy/pkg/provider"
+	"vault-docker-proxy/pkg/pullstats"
+	"vault-docker-proxy/pkg/recorder"
 	"vault-docker-proxy/pkg/registry"
+	"vault-docker-proxy/pkg/tlscert"
+	"vault-docker-proxy/pkg/token"
+	"vault-docker-proxy/pkg/transport"
 	"vault-docker-proxy/pkg/vault"
 )
 
 const (
-	DefaultPort      = "8080"
-	DefaultVaultAddr = "http://localhost:8200"
-	DefaultRealm     = "https://auth.docker.io/token"
-	DefaultService   = "registry.docker.io"
+	DefaultPort      = config.DefaultPort
+	DefaultVaultAddr = config.DefaultVaultAddr
+	DefaultRealm     = config.DefaultRealm
+	DefaultService   = config.DefaultService
+	ShutdownTimeout  = 30 * time.Second
 )
 
 func main() {
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = DefaultPort
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "check":
+			os.Exit(runCheck(os.Args[2:]))
+		case "validate-config":
+			os.Exit(runValidateConfig(os.Args[2:]))
+		case "replay":
+			os.Exit(runReplay(os.Args[2:]))
+		case "bench":
+			os.Exit(runBench(os.Args[2:]))
+		case "service":
+			os.Exit(runService(os.Args[2:]))
+		case "apikey":
+			os.Exit(runAPIKey(os.Args[2:]))
+		}
 	}
 
-	vaultAddr := os.Getenv("VAULT_ADDR")
-	if vaultAddr == "" {
-		vaultAddr = DefaultVaultAddr
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := runServer(ctx, os.Args[1:]); err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+}
+
+// runServer parses the server flags, starts the proxy and blocks until ctx is cancelled or a
+// listener fails
+func runServer(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("vault-docker-proxy", flag.ExitOnError)
+	configPath := fs.String("config", os.Getenv("CONFIG_FILE"), "path to the YAML configuration file")
+	devMode := fs.Bool("dev", false, "run with an embedded in-memory Vault and registry for local testing")
+	tlsEnabled := fs.Bool("tls", false, "serve HTTPS (dev mode generates a self-signed certificate when none is configured)")
+	devFixture := fs.String("dev-fixture", "", "YAML fixture used to seed dev mode (defaults to the built-in fixture)")
+	dryRun := fs.Bool("dry-run", false, "resolve auth and routing but explain requests instead of contacting upstream registries")
+	fs.Parse(args)
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %v", err)
+	}
+	if *devMode {
+		cfg.Dev.Enabled = true
+	}
+	if *devFixture != "" {
+		cfg.Dev.Fixture = *devFixture
+	}
+	if *dryRun {
+		cfg.DryRun = true
+	}
+	if *tlsEnabled {
+		cfg.TLS.Enabled = true
+	}
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	startedAt := time.Now()
+
+	// Recent failures are kept for diagnostics bundles
+	output := log.Writer()
+	var errorLog *diagnostics.ErrorLog
+	if cfg.Admin.Port != "" {
+		errorLog = diagnostics.NewErrorLog(diagnostics.DefaultErrorLogSize)
+		output = io.MultiWriter(output, errorLog)
+	}
+	if err := logging.Setup(output, cfg.Log.Level, cfg.Log.Format); err != nil {
+		return err
+	}
+
+	port := cfg.Listen.Port
+	vaultAddr := cfg.Vault.Address
+	realm := cfg.Auth.Realm
+	if cfg.Auth.TokenServer && realm == DefaultRealm {
+		// Send clients to the proxy's own token endpoint
+		realm = registry.TokenPath
+	}
+	authMiddleware := auth.NewMiddleware(realm, cfg.Auth.Service)
+	if cfg.Auth.Challenge == "basic" {
+		authMiddleware = auth.NewBasicMiddleware(cfg.Auth.Realm)
+	}
+
+	var devTransport func(http.RoundTripper) http.RoundTripper
+	if cfg.Dev.Enabled {
+		devEnv, err := startDevMode(cfg.Dev.Fixture, port)
+		if err != nil {
+			return fmt.Errorf("failed to start dev mode: %v", err)
+		}
+		defer devEnv.Close()
+
+		vaultAddr = devEnv.VaultAddr
+		devTransport = devEnv.Transport
+		if !cfg.Auth.TokenServer {
+			authMiddleware = auth.NewBasicMiddleware("vault-docker-proxy-dev")
+		}
+		if len(cfg.Upstream.AllowedHosts) > 0 {
+			cfg.Upstream.AllowedHosts = append(cfg.Upstream.AllowedHosts, devEnv.RegistryHost)
+		}
+	}
+
+	upstream, err := newUpstreamClient(cfg, devTransport, slog.Default())
+	if err != nil {
+		return err
+	}
+	httpClient, upstreamMetrics, upstreamRetries, egress := upstream.Client, upstream.metrics, upstream.retries, upstream.egress
+
+	if cfg.ECR.DefaultCredentials {
+		provider.SetECRDefaultCredentials(true)
+		slog.Info("ECR registries without access keys in their secret use the proxy's own AWS credentials")
+	}
+	if cfg.Exec.Command != "" {
+		provider.Register(provider.NewExec(cfg.Exec.Command, cfg.Exec.Args, cfg.Exec.Timeout.Duration()))
+		slog.Info("Registry type enabled", "type", provider.ExecType, "command", cfg.Exec.Command)
 	}
 
-	log.Printf("Starting vault-docker-proxy on port %s", port)
-	log.Printf("Vault address: %s", vaultAddr)
+	slog.Info("Starting vault-docker-proxy", "port", port, "vault_address", vaultAddr)
 
 	// Create Vault client
 	vaultClient, err := vault.NewClient(vaultAddr)
 	if err != nil {
-		log.Fatalf("Failed to create Vault client: %v", err)
+		return fmt.Errorf("failed to create Vault client: %v", err)
+	}
+
+	if cfg.Vault.Namespace != "" {
+		vaultClient.SetNamespace(cfg.Vault.Namespace)
+	}
+	kvVersion := vault.KVv2
+	switch cfg.Vault.KV.Version {
+	case "1":
+		kvVersion = vault.KVv1
+	case "auto":
+		kvVersion = vault.KVAuto
+	}
+	vaultClient.SetKV(cfg.Vault.KV.Mount, kvVersion)
+
+	tokenFile := cfg.Vault.Auth.TokenFile
+	if method, mount := vaultLogin(cfg.Vault.Auth); method != nil {
+		lease, err := vaultClient.Login(ctx, method)
+		if err != nil {
+			return err
+		}
+		// Without renewal the token is replaced by logging in again
+		lease.Renewable = lease.Renewable && cfg.Vault.Auth.Renew
+		go vaultClient.RunTokenRenewal(ctx, method, lease)
+		slog.Info("Logged in to Vault", "method", cfg.Vault.Auth.Method, "mount", "auth/"+mount)
+	} else if tokenFile != "" {
+		// Vault Agent may not have written the file yet, it is picked up once it does
+		if err := vaultClient.LoadTokenFile(tokenFile); err != nil {
+			slog.Warn("Vault token file not readable yet, waiting for it", "error", err)
+		}
+		go vaultClient.RunTokenFile(ctx, tokenFile)
+		slog.Info("Reading the Vault token from a file", "file", tokenFile)
+	} else if vaultClient.Token() != "" && cfg.Vault.Auth.Renew {
+		// VAULT_TOKEN is renewed up to its max TTL
+		if lease, err := vaultClient.LookupLease(ctx); err != nil {
+			slog.Warn("Not renewing the Vault token", "error", err)
+		} else {
+			go vaultClient.RunTokenRenewal(ctx, nil, lease)
+		}
+	}
+
+	// The proxy's own token (VAULT_TOKEN) is optional, clients bring theirs
+	if interval := cfg.Vault.TokenCheckInterval.Duration(); interval > 0 && (vaultClient.Token() != "" || tokenFile != "") {
+		go vaultClient.RunTokenMonitor(ctx, interval)
+	}
+	if alerts := cfg.Vault.Alerts; alerts.WebhookURL != "" {
+		window := alerts.Window.Duration()
+		alert := vault.NewErrorRateAlert(vaultClient, alerts.WebhookURL, alerts.ErrorRate, window, uint64(alerts.MinCalls))
+		go alert.Run(ctx, max(window/10, time.Second))
+		slog.Info("Alerting on Vault error rates", "error_rate", alerts.ErrorRate, "window", window)
 	}
 
 	// Create proxy server
-	proxyServer := registry.NewProxyServer(vaultClient)
+	proxyServer := registry.NewProxyServerWithClient(vaultClient, httpClient)
+	credentialCache, err := newCredentialCache(ctx, cfg.Cache)
+	if err != nil {
+		return err
+	}
+	proxyServer.SetCredentialCache(credentialCache)
+	proxyServer.SetNegativeCache(cfg.Cache.NegativeTTL.Duration())
+	if err := proxyServer.SetCredentialTTLs(cacheTTLRules(cfg.Cache)); err != nil {
+		return fmt.Errorf("invalid cache TTL rules: %v", err)
+	}
+	if cfg.Cache.RefreshBefore > 0 {
+		proxyServer.SetCredentialRefresh(cfg.Cache.RefreshBefore.Duration(), cfg.Cache.RefreshIdle.Duration())
+		go proxyServer.RunCredentialRefresh(ctx, refreshInterval(cfg.Cache.RefreshBefore.Duration()))
+	}
+	if probe := cfg.Upstream.Probe; probe.Interval > 0 && !cfg.DryRun {
+		targets, err := probeTargets(probe)
+		if err != nil {
+			return fmt.Errorf("invalid upstream probe registries: %v", err)
+		}
+		proxyServer.SetUpstreamProbe(targets, probe.Timeout.Duration())
+		go proxyServer.RunUpstreamProbe(ctx, probe.Interval.Duration())
+		slog.Info("Probing upstream registries", "interval", probe.Interval.Duration())
+	}
+	proxyServer.SetDryRun(cfg.DryRun)
+	proxyServer.SetFlushInterval(cfg.Upstream.FlushInterval.Duration())
+	proxyServer.SetLoginSecretCheck(cfg.Auth.LoginCheckSecret)
+	if cfg.Auth.LoginCheck {
+		authMiddleware.SetLoginValidator(proxyServer)
+	}
+	if appRole := cfg.Vault.Auth.AppRole; appRole.ClientLogins {
+		proxyServer.SetAppRoleLogins(vault.NewAppRoleLogins(vaultClient, appRole.Mount))
+		slog.Info("Accepting AppRole credentials as password", "mount", "auth/"+appRole.Mount)
+	}
+	if cfg.Vault.Auth.WrappedTokens {
+		proxyServer.SetWrappedTokens(vault.NewWrappedTokens(vaultClient))
+	}
+	if cfg.Vault.Auth.SharedToken {
+		proxyServer.SetSharedToken(true)
+		slog.Info("Requests with an empty password use the proxy's own Vault token")
+	}
+	if cfg.Auth.APIKeys.Enabled() {
+		apiKeys := cfg.Auth.APIKeys
+		authMiddleware.SetAPIKeyResolver(vault.NewAPIKeyStore(vaultClient, apiKeys.Mount, apiKeys.Path, apiKeys.CacheTTL.Duration()))
+		slog.Info("API keys enabled", "vault_path", apiKeys.Mount+"/"+apiKeys.Path)
+	}
+	if cfg.Upstream.BlobRedirects == "client" {
+		proxyServer.SetClientBlobRedirects(true)
+		slog.Info("Upstream blob redirects are returned to clients")
+	}
+	if cfg.DryRun {
+		slog.Warn("DRY RUN: requests will be explained instead of forwarded to upstream registries")
+	}
 
 	// Setup routes with middleware
-	router := setupRoutes(proxyServer)
+	var middlewares []mux.MiddlewareFunc
+	if cfg.TLS.ClientAuth.CAFile != "" {
+		if err := proxyServer.SetClientIdentities(clientIdentities(cfg.TLS.ClientAuth)); err != nil {
+			return fmt.Errorf("invalid client certificate identities: %v", err)
+		}
+		slog.Info("Client certificates required on TLS listeners", "ca_file", cfg.TLS.ClientAuth.CAFile, "identities", len(cfg.TLS.ClientAuth.Identities))
+		middlewares = append(middlewares, proxyServer.ClientCertificateMiddleware)
+	}
+	if egress != nil {
+		proxyServer.SetEgressAllowlist(egress)
+		middlewares = append(middlewares, proxyServer.EgressMiddleware)
+	}
+	if len(cfg.Access.Groups) > 0 {
+		rules := groupRules(cfg.Access)
+		if err := proxyServer.SetGroupAccess(rules, cfg.Access.GroupCacheTTL.Duration()); err != nil {
+			return fmt.Errorf("invalid group access rules: %v", err)
+		}
+		slog.Info("Group access enabled", "rules", len(rules))
+	}
+	if len(cfg.Access.Groups) > 0 || cfg.Controller.Enabled {
+		// The controller may enable group access later
+		middlewares = append(middlewares, proxyServer.GroupAccessMiddleware)
+	}
+	if len(cfg.Access.Policies) > 0 {
+		policies, environments, err := accessPolicies(cfg.Access)
+		if err == nil {
+			err = proxyServer.SetAccessPolicies(policies, environments)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid access policies: %v", err)
+		}
+		slog.Info("Access policies enabled", "rules", len(policies))
+		middlewares = append(middlewares, proxyServer.AccessPolicyMiddleware)
+	}
+	var imagePolicy *imagepolicy.Reloader
+	if cfg.ImagePolicy.File != "" {
+		var err error
+		if imagePolicy, err = imagepolicy.NewReloader(cfg.ImagePolicy.File); err != nil {
+			return err
+		}
+		go imagePolicy.Run(ctx)
+		proxyServer.SetImagePolicy(imagePolicy)
+		slog.Info("Image policy enabled", "file", cfg.ImagePolicy.File, "rules", imagePolicy.Policy().Rules())
+		middlewares = append(middlewares, proxyServer.ImagePolicyMiddleware)
+	}
+	if cfg.Audit.File != "" || cfg.Audit.Syslog != "" {
+		auditLog, err := audit.Open(cfg.Audit.File, cfg.Audit.Syslog)
+		if err != nil {
+			return err
+		}
+		defer auditLog.Close()
+		proxyServer.SetAuditLog(auditLog)
+		slog.Info("Auditing credential resolutions", "file", cfg.Audit.File, "syslog", cfg.Audit.Syslog)
+	}
+	var pullStats *pullstats.Store
+	if cfg.PullStats.File != "" && !cfg.DryRun {
+		pullStats, err = pullstats.Open(cfg.PullStats.File)
+		if err != nil {
+			return err
+		}
+		defer pullStats.Close()
+		go pullStats.Run(ctx, cfg.PullStats.FlushInterval.Duration())
+		proxyServer.SetPullStats(pullStats)
+		slog.Info("Recording pull statistics", "file", cfg.PullStats.File)
+		middlewares = append(middlewares, proxyServer.PullStatsMiddleware)
+	}
+	if cfg.BlobCache.Enabled() && !cfg.DryRun {
+		blobStore, err := newBlobStore(cfg.BlobCache)
+		if err != nil {
+			return fmt.Errorf("failed to open blob cache: %v", err)
+		}
+		proxyServer.SetBlobCache(blobStore)
+	}
+	if cfg.ManifestCache.Enabled && !cfg.DryRun {
+		proxyServer.SetManifestCache(int64(cfg.ManifestCache.MaxSize), cfg.ManifestCache.TagTTL.Duration())
+		slog.Info("Caching manifests in memory", "max_size", cfg.ManifestCache.MaxSize, "tag_ttl", cfg.ManifestCache.TagTTL.Duration())
+	}
+	if notationCfg := cfg.Notation; notationCfg.TrustPolicy != "" {
+		trustStore := notationCfg.TrustStore
+		if trustStore == "" {
+			trustStore = filepath.Join(filepath.Dir(notationCfg.TrustPolicy), "truststore")
+		}
+		verifier, err := notation.LoadTrustPolicy(notationCfg.TrustPolicy, trustStore)
+		if err != nil {
+			return fmt.Errorf("invalid Notation trust policy: %v", err)
+		}
+		proxyServer.SetSignatureVerification(verifier, notationCfg.CacheTTL.Duration())
+		slog.Info("Verifying Notation signatures of pulled manifests", "trust_policy", notationCfg.TrustPolicy, "trust_store", trustStore)
+	}
+	if limits := cfg.SizeLimits; (limits.MaxBlobSize > 0 || limits.MaxImageSize > 0) && !cfg.DryRun {
+		proxyServer.SetSizeLimits(registry.SizeLimits{MaxBlobSize: int64(limits.MaxBlobSize), MaxImageSize: int64(limits.MaxImageSize)})
+		slog.Info("Size limits enabled", "max_blob_size", sizeLimit(limits.MaxBlobSize), "max_image_size", sizeLimit(limits.MaxImageSize))
+		middlewares = append(middlewares, proxyServer.SizeLimitMiddleware)
+	}
+	if len(cfg.CacheControl.Rules) > 0 && !cfg.DryRun {
+		slog.Info("Setting caching headers on registry responses", "rules", len(cfg.CacheControl.Rules))
+		middlewares = append(middlewares, cachecontrol.NewPolicy(cfg.CacheControl.Rules).Middleware)
+	}
+	if cfg.Chaos.Enabled {
+		slog.Warn("CHAOS: fault injection enabled", "rules", len(cfg.Chaos.Rules))
+		middlewares = append(middlewares, chaos.NewInjector(cfg.Chaos.Rules).Middleware)
+	}
+	router := setupRoutes(proxyServer, authMiddleware, middlewares...)
 
-	server := &http.Server{
-		Addr:    ":" + port,
-		Handler: router,
+	if cfg.Controller.Enabled {
+		if err := startController(ctx, cfg, proxyServer); err != nil {
+			return fmt.Errorf("failed to start controller: %v", err)
+		}
 	}
 
-	log.Fatal(server.ListenAndServe())
+	var tokenManager *token.Manager
+	if cfg.Token.Signing.Enabled() {
+		tokenManager, err = newTokenManager(ctx, cfg, vaultClient)
+		if err != nil {
+			return fmt.Errorf("failed to load token signing keys: %v", err)
+		}
+		go tokenManager.Run(ctx, cfg.Token.Signing.ReloadInterval.Duration())
+		proxyServer.SetTokenService(tokenManager, token.NewRefreshStore(), cfg.Token.AccessTTL.Duration(), cfg.Token.RefreshTTL.Duration())
+		router.HandleFunc("/.well-known/jwks.json", tokenManager.JWKSHandler).Methods("GET")
+		router.HandleFunc("/ext/token/access", proxyServer.ExchangeRefreshToken).Methods("POST")
+		if cfg.Auth.TokenServer {
+			proxyServer.SetTokenServer(cfg.Auth.Service)
+			authMiddleware.SetRegistryTokenVerifier(proxyServer)
+			router.HandleFunc(registry.TokenPath, proxyServer.ServeToken).Methods("GET")
+			slog.Info("Issuing registry tokens", "service", cfg.Auth.Service, "path", registry.TokenPath)
+		}
+	}
+
+	var handler http.Handler = router
+	if cfg.Record.File != "" {
+		rec, err := recorder.NewRecorder(cfg.Record.File, cfg.Record.Bodies)
+		if err != nil {
+			return fmt.Errorf("failed to start request recorder: %v", err)
+		}
+		defer rec.Close()
+		slog.Info("Recording sanitized requests", "file", cfg.Record.File)
+		handler = rec.Middleware(router)
+	}
+
+	// Capture tokens are issued on the admin listener, so capture is available whenever it is
+	var capturer *capture.Capturer
+	if cfg.Admin.Port != "" || len(cfg.Debug.Repositories) > 0 {
+		capturer, err = capture.NewCapturer(cfg.Debug.Repositories, cfg.Debug.MaxBodySize)
+		if err != nil {
+			return err
+		}
+		if len(cfg.Debug.Repositories) > 0 {
+			slog.Warn("DEBUG: logging full exchanges", "repositories", cfg.Debug.Repositories)
+		}
+		handler = capturer.Middleware(handler)
+	}
+
+	var requestMetrics *metrics.Requests
+	if cfg.Metrics.Port != "" {
+		requestMetrics = metrics.NewRequests("vdp_http_request_duration_seconds", "Latency of the requests served on the data-plane listeners, by endpoint, method and status code.", metricsEndpoint)
+		handler = requestMetrics.Middleware(handler)
+	}
+	if cfg.Log.Access {
+		handler = logging.AccessLog(handler)
+	}
+	handler = logging.Middleware(handler)
+
+	// Bind every data-plane listener before serving, so a taken address fails the start
+	listeners := cfg.Listeners()
+	netListeners := make([]net.Listener, 0, len(listeners))
+	for _, listener := range listeners {
+		netListener, err := listen(listener)
+		if err != nil {
+			return fmt.Errorf("failed to start listener on %s: %v", listener.Addr(), err)
+		}
+		defer netListener.Close()
+		netListeners = append(netListeners, netListener)
+	}
+
+	var servers []*http.Server
+	errCh := make(chan error, len(listeners)+5)
+
+	if cfg.Admin.Port != "" {
+		adminHandler := setupAdminRoutes(proxyServer, vaultClient, authMiddleware, cfg.Admin.Token, middlewares...)
+		if tokenManager != nil {
+			adminHandler.Router().HandleFunc("/admin/token/rotate", tokenManager.RotateHandler).Methods("POST")
+			adminHandler.Router().HandleFunc("/admin/token/refresh", proxyServer.ListRefreshTokens).Methods("GET")
+			adminHandler.Router().HandleFunc("/admin/token/refresh/{id}", proxyServer.RevokeRefreshToken).Methods("DELETE")
+		}
+		adminHandler.Router().HandleFunc("/admin/debug/capture", capturer.TokenHandler).Methods("POST")
+		if pullStats != nil {
+			adminHandler.Router().HandleFunc("/admin/pulls", pullStats.Handler).Methods("GET")
+		}
+		if imagePolicy != nil {
+			adminHandler.Router().HandleFunc("/admin/image-policy/reload", imagePolicy.ReloadHandler).Methods("POST")
+		}
+		adminHandler.Router().HandleFunc("/admin/diagnostics", diagnosticsBundle(cfg, proxyServer, vaultClient, errorLog, startedAt)).Methods("GET")
+		var adminHTTPHandler http.Handler = adminHandler
+		if cfg.Log.Access {
+			adminHTTPHandler = logging.AccessLog(adminHTTPHandler)
+		}
+		adminServer := &http.Server{
+			Addr:    net.JoinHostPort(cfg.Admin.Address, cfg.Admin.Port),
+			Handler: logging.Middleware(adminHTTPHandler),
+		}
+		servers = append(servers, adminServer)
+		go func() {
+			slog.Info("Starting admin listener", "address", adminServer.Addr)
+			errCh <- adminServer.ListenAndServe()
+		}()
+	}
+
+	if cfg.Metrics.Port != "" {
+		router := mux.NewRouter()
+		router.Handle("/metrics", metrics.Handler(requestMetrics, upstreamMetrics, retryMetrics(upstreamRetries), proxyMetrics(proxyServer), vaultClientMetrics(vaultClient))).Methods("GET")
+		metricsServer := &http.Server{
+			Addr:    net.JoinHostPort(cfg.Metrics.Address, cfg.Metrics.Port),
+			Handler: router,
+		}
+		servers = append(servers, metricsServer)
+		go func() {
+			slog.Info("Starting metrics listener", "address", metricsServer.Addr)
+			errCh <- metricsServer.ListenAndServe()
+		}()
+	}
+
+	if cfg.Pprof.Port != "" {
+		pprofServer := &http.Server{
+			Addr:    net.JoinHostPort(cfg.Pprof.Address, cfg.Pprof.Port),
+			Handler: pprofHandler(),
+		}
+		servers = append(servers, pprofServer)
+		go func() {
+			slog.Info("Starting pprof listener", "address", pprofServer.Addr)
+			errCh <- pprofServer.ListenAndServe()
+		}()
+	}
+
+	if cfg.Admin.GRPCPort != "" {
+		listener, err := net.Listen("tcp", net.JoinHostPort(cfg.Admin.Address, cfg.Admin.GRPCPort))
+		if err != nil {
+			return fmt.Errorf("failed to start gRPC control-plane listener: %v", err)
+		}
+		grpcServer := controlplane.NewGRPCServer(controlplane.NewServer(proxyServer, cfg), cfg.Admin.Token)
+		defer grpcServer.Stop()
+		go func() {
+			slog.Info("Starting gRPC control-plane listener", "address", listener.Addr().String())
+			errCh <- grpcServer.Serve(listener)
+		}()
+	}
+
+	var tlsConfig *tls.Config
+	for _, listener := range listeners {
+		if !listener.TLS || tlsConfig != nil {
+			continue
+		}
+		if acmeConfig := cfg.TLS.ACME; acmeConfig.Enabled() {
+			manager := tlscert.NewACMEManager(acmeConfig.Hosts, acmeConfig.Email, acmeConfig.CacheDir, acmeConfig.DirectoryURL)
+			tlsConfig = manager.TLSConfig()
+			slog.Info("Obtaining TLS certificates through ACME", "hosts", acmeConfig.Hosts, "cache_dir", acmeConfig.CacheDir)
+			if acmeConfig.HTTPPort != "" {
+				// Answers HTTP-01 challenges and redirects anything else to HTTPS
+				challengeServer := &http.Server{
+					Addr:    net.JoinHostPort(cfg.Listen.Address, acmeConfig.HTTPPort),
+					Handler: manager.HTTPHandler(nil),
+				}
+				servers = append(servers, challengeServer)
+				go func() {
+					slog.Info("Starting ACME HTTP challenge listener", "address", challengeServer.Addr)
+					errCh <- challengeServer.ListenAndServe()
+				}()
+			}
+			continue
+		}
+		if cfg.TLS.CertFile != "" {
+			certificates, err := tlscert.NewReloader(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+			if err != nil {
+				return err
+			}
+			go certificates.Run(ctx)
+			tlsConfig = &tls.Config{GetCertificate: certificates.GetCertificate}
+			continue
+		}
+		certificate, caPEM, err := devmode.GenerateCertificate([]string{"localhost", "127.0.0.1", "::1"})
+		if err != nil {
+			return fmt.Errorf("failed to generate dev certificate: %v", err)
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{certificate}}
+		slog.Info("DEV MODE: serving HTTPS with a generated certificate. Trust this CA, e.g. in /etc/docker/certs.d/localhost:"+listener.Port+"/ca.crt", "ca", string(caPEM))
+	}
+
+	if tlsConfig != nil && cfg.TLS.ClientAuth.CAFile != "" {
+		clientCAs, err := tlscert.LoadCertPool(cfg.TLS.ClientAuth.CAFile)
+		if err != nil {
+			return err
+		}
+		// Certificates are verified during the handshake but only required by
+		// ClientCertificateMiddleware, so clients without one get a registry error and ACME
+		// challenges still complete
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		tlsConfig.ClientCAs = clientCAs
+	}
+	if tlsConfig != nil && !cfg.Listen.HTTP2 {
+		tlsConfig.NextProtos = slices.DeleteFunc(tlsConfig.NextProtos, func(proto string) bool { return proto == "h2" })
+	}
+
+	for i, listener := range listeners {
+		server := &http.Server{
+			Handler:           handler,
+			TLSConfig:         tlsConfig,
+			ReadHeaderTimeout: cfg.Listen.Timeouts.ReadHeader.Duration(),
+			ReadTimeout:       cfg.Listen.Timeouts.Read.Duration(),
+			WriteTimeout:      cfg.Listen.Timeouts.Write.Duration(),
+			IdleTimeout:       cfg.Listen.Timeouts.Idle.Duration(),
+		}
+		if !cfg.Listen.HTTP2 {
+			// A non-nil map keeps ServeTLS from enabling HTTP/2
+			server.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+		}
+		if !listener.TLS && cfg.Listen.H2C {
+			server.Handler = h2c.NewHandler(handler, &http2.Server{})
+		}
+		servers = append(servers, server)
+		go func(listener config.ListenerConfig, netListener net.Listener) {
+			if listener.TLS {
+				slog.Info("Serving HTTPS", "address", netListener.Addr().String(), "http2", cfg.Listen.HTTP2)
+				errCh <- server.ServeTLS(netListener, "", "")
+				return
+			}
+			slog.Info("Serving HTTP", "address", netListener.Addr().String(), "h2c", cfg.Listen.H2C)
+			errCh <- server.Serve(netListener)
+		}(listener, netListeners[i])
+	}
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+
+	slog.Info("Shutting down vault-docker-proxy")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancel()
+	for _, srv := range servers {
+		srv.Shutdown(shutdownCtx)
+	}
+	return nil
 }
 
-func setupRoutes(proxyServer *registry.ProxyServer) *mux.Router {
+// setupRoutes creates the data-plane router. Extra middlewares run after authentication.
+func setupRoutes(proxyServer *registry.ProxyServer, authMiddleware *auth.Middleware, middlewares ...mux.MiddlewareFunc) *mux.Router {
 	r := mux.NewRouter()
 
-	// Create authentication middleware
-	authMiddleware := auth.NewMiddleware(DefaultRealm, DefaultService)
+	// Unauthenticated liveness/readiness endpoint
+	r.HandleFunc("/healthz", healthz).Methods("GET")
+
+	// Apply authentication to the registry API
+	v2 := r.NewRoute().Subrouter()
+	v2.Use(registry.LoggingMiddleware, authMiddleware.DockerRegistryAuth)
+	v2.Use(middlewares...)
+	registerRegistryRoutes(v2, proxyServer)
+
+	return r
+}
+
+// healthz reports that the process is serving requests
+func healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte("ok\n"))
+}
+
+// setupAdminRoutes creates the admin listener handler. The middlewares of the data-plane registry
+// API also run on its mirror on the admin listener.
+func setupAdminRoutes(proxyServer *registry.ProxyServer, vaultClient *vault.Client, authMiddleware *auth.Middleware, token string, middlewares ...mux.MiddlewareFunc) *admin.Server {
+	adminServer := admin.NewServer(token)
+	adminServer.Router().HandleFunc("/admin/stats", proxyServer.StatsHandler).Methods("GET")
+	adminServer.Router().HandleFunc("/admin/inventory", proxyServer.InventoryHandler).Methods("GET")
+	adminServer.Router().HandleFunc("/admin/cache", proxyServer.InvalidateCacheHandler).Methods("DELETE")
+	adminServer.Router().HandleFunc("/admin/status", proxyServer.StatusHandler).Methods("GET")
+	adminServer.Router().HandleFunc("/admin/vault", vaultMetrics(vaultClient)).Methods("GET")
+	adminServer.Router().HandleFunc("/admin/copy", proxyServer.CopyImage).Methods("POST")
+	adminServer.Router().HandleFunc("/admin/metadata/repositories", proxyServer.MetadataRepositories).Methods("GET")
+	adminServer.Router().HandleFunc("/admin/metadata/tags", proxyServer.MetadataTags).Methods("GET")
+
+	// The registry API is mirrored on the admin listener so operators can request dry runs
+	// with the X-Dry-Run header. Registry credentials travel in X-Registry-Authorization because
+	// Authorization carries the admin token. Requests without X-Dry-Run reach the registry, so the
+	// same access checks apply as on the data-plane listeners.
+	v2 := adminServer.Router().NewRoute().Subrouter()
+	v2.Use(registry.LoggingMiddleware, registry.DryRunMiddleware, registryAuthorizationMiddleware, authMiddleware.DockerRegistryAuth)
+	v2.Use(middlewares...)
+	registerRegistryRoutes(v2, proxyServer)
 
-	// Apply middleware to all routes
-	r.Use(authMiddleware.DockerRegistryAuth)
+	return adminServer
+}
 
+// listen binds a data-plane listener. A unix socket left behind by a previous run is replaced
+// unless a process still accepts connections on it, and gets the configured permissions.
+func listen(listener config.ListenerConfig) (net.Listener, error) {
+	if !listener.Unix() {
+		return net.Listen(listener.Network, listener.Addr())
+	}
+	if conn, err := net.Dial("unix", listener.Address); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("socket %s is in use", listener.Address)
+	}
+	if info, err := os.Lstat(listener.Address); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(listener.Address)
+	}
+	netListener, err := net.Listen("unix", listener.Address)
+	if err != nil {
+		return nil, err
+	}
+	mode, err := config.ParseSocketMode(listener.SocketMode)
+	if err == nil {
+		err = os.Chmod(listener.Address, mode)
+	}
+	if err != nil {
+		netListener.Close()
+		return nil, fmt.Errorf("failed to set the permissions of socket %s: %v", listener.Address, err)
+	}
+	return netListener, nil
+}
+
+// pprofHandler serves the net/http/pprof profiles under /debug/pprof/
+func pprofHandler() http.Handler {
+	router := mux.NewRouter()
+	router.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	router.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	router.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	router.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	router.PathPrefix("/debug/pprof/").HandlerFunc(pprof.Index)
+	return router
+}
+
+// vaultMetrics serves GET /admin/vault: the calls made to Vault by operation and error type, and
+// the status of the proxy's own token
+func vaultMetrics(vaultClient *vault.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		admin.WriteJSON(w, http.StatusOK, vaultClient.Metrics())
+	}
+}
+
+// diagnosticsBundle serves GET /admin/diagnostics: a tar.gz bundle with the redacted effective
+// configuration, the status of components, recent errors, cache statistics, a goroutine dump and
+// version information, to attach to support requests
+func diagnosticsBundle(cfg *config.Config, proxyServer *registry.ProxyServer, vaultClient *vault.Client, errorLog *diagnostics.ErrorLog, startedAt time.Time) http.HandlerFunc {
+	return diagnostics.Handler([]diagnostics.File{
+		diagnostics.VersionFile(),
+		{Name: "config.yaml", Write: func(w io.Writer) error {
+			return yaml.NewEncoder(w).Encode(cfg.Redacted())
+		}},
+		diagnostics.JSONFile("status.json", func() interface{} {
+			return map[string]interface{}{
+				"started_at":     startedAt.UTC(),
+				"uptime_seconds": int64(time.Since(startedAt).Seconds()),
+				"dev_mode":       cfg.Dev.Enabled,
+				"dry_run":        cfg.DryRun,
+				"upstreams":      proxyServer.UpstreamStatus(),
+				"vault":          vaultClient.Metrics(),
+			}
+		}),
+		diagnostics.JSONFile("stats.json", func() interface{} {
+			return map[string]interface{}{
+				"proxy":                    proxyServer.Stats(),
+				"credential_cache_entries": len(proxyServer.Inventory().CredentialCache),
+			}
+		}),
+		diagnostics.JSONFile("inventory.json", func() interface{} {
+			return proxyServer.Inventory()
+		}),
+		errorLog.File(),
+		diagnostics.GoroutinesFile(),
+	})
+}
+
+// registryAuthorizationMiddleware moves X-Registry-Authorization into Authorization for the
+// registry routes mirrored on the admin listener
+func registryAuthorizationMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Del("Authorization")
+		if registryAuth := r.Header.Get("X-Registry-Authorization"); registryAuth != "" {
+			r.Header.Set("Authorization", registryAuth)
+			r.Header.Del("X-Registry-Authorization")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// registerRegistryRoutes registers the Docker Registry v2 API endpoints on r
+func registerRegistryRoutes(r *mux.Router, proxyServer *registry.ProxyServer) {
 	// Docker Registry v2 API endpoints
-	r.HandleFunc("/v2/", proxyServer.APIVersionCheck).Methods("GET")
+	r.HandleFunc("/v2/", proxyServer.APIVersionCheck).Methods("GET", "HEAD")
 	r.HandleFunc("/v2/_catalog", proxyServer.GetCatalog).Methods("GET")
 	r.HandleFunc("/v2/{name:.*}/tags/list", proxyServer.GetTags).Methods("GET")
-	r.HandleFunc("/v2/{name:.*}/manifests/{reference}", proxyServer.GetManifest).Methods("GET")
-	r.HandleFunc("/v2/{name:.*}/blobs/{digest}", proxyServer.GetBlob).Methods("GET")
+	r.HandleFunc("/v2/{name:.*}/manifests/{reference}", proxyServer.GetManifest).Methods("GET", "HEAD")
+	r.HandleFunc("/v2/{name:.*}/manifests/{reference}", proxyServer.PutManifest).Methods("PUT")
+	r.HandleFunc("/v2/{name:.*}/blobs/uploads/", proxyServer.BlobUpload).Methods("POST")
+	r.HandleFunc("/v2/{name:.*}/blobs/uploads/{uuid}", proxyServer.BlobUpload).Methods("GET", "PATCH", "PUT", "DELETE")
+	r.HandleFunc("/v2/{name:.*}/blobs/{digest}", proxyServer.GetBlob).Methods("GET", "HEAD")
 
-	return r
-}
\ No newline at end of file
+	// Proxy extension endpoints
+	r.HandleFunc("/ext/export/{image:.*}", proxyServer.ExportImage).Methods("GET")
+	r.HandleFunc("/ext/search", proxyServer.Search).Methods("GET")
+	r.HandleFunc("/ext/inspect/{image:.*}", proxyServer.InspectImage).Methods("GET")
+	r.HandleFunc("/ext/lookup/{image:.*}", proxyServer.LookupDigestTags).Methods("GET")
+	r.HandleFunc("/ext/token/refresh", proxyServer.IssueRefreshToken).Methods("POST")
+}
+
+// newCredentialCache creates the credential cache with the configured backend: memory only, or
+// Redis, checked at startup so a misconfigured server is reported instead of every lookup
+// missing
+func newCredentialCache(ctx context.Context, cfg config.CacheConfig) (*cache.CredentialCache, error) {
+	if cfg.TTL == 0 {
+		slog.Info("Credential cache disabled, credentials are read from Vault for every request")
+		return cache.NewCredentialCacheWithTTL(0, cfg.CleanupInterval.Duration()), nil
+	}
+	if cfg.Backend != "redis" {
+		return cache.NewCredentialCacheWithTTL(cfg.TTL.Duration(), cfg.CleanupInterval.Duration()), nil
+	}
+
+	redisConfig := cache.RedisConfig{
+		Address:  cfg.Redis.Address,
+		Username: cfg.Redis.Username,
+		Password: cfg.Redis.Password,
+		DB:       cfg.Redis.DB,
+		TLS:      cfg.Redis.TLS,
+		Timeout:  cfg.Redis.Timeout.Duration(),
+	}
+	if cfg.Redis.CAFile != "" {
+		rootCAs, err := tlscert.LoadCertPool(cfg.Redis.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the Redis CA file: %v", err)
+		}
+		redisConfig.TLSConfig = &tls.Config{RootCAs: rootCAs}
+	}
+	client := cache.NewRedis(redisConfig)
+	if err := client.Ping(ctx); err != nil {
+		return nil, fmt.Errorf("failed to reach the Redis credential cache at %s: %v", cfg.Redis.Address, err)
+	}
+	slog.Info("Sharing the credential cache through Redis", "address", cfg.Redis.Address)
+	return cache.NewCredentialCacheWithBackend(cache.NewRedisBackend(client, cfg.Redis.Prefix), cfg.TTL.Duration(), cfg.CleanupInterval.Duration()), nil
+}
+
+// cacheTTLRules converts the configured credential cache TTL rules
+func cacheTTLRules(cfg config.CacheConfig) []registry.CacheTTLRule {
+	var rules []registry.CacheTTLRule
+	for _, rule := range cfg.TTLRules {
+		rules = append(rules, registry.CacheTTLRule{Type: rule.Type, Path: rule.Path, TTL: rule.TTL.Duration()})
+	}
+	return rules
+}
+
+// newBlobStore opens the store of the blob cache: the S3 bucket when one is set, with the
+// directory holding downloads in progress, or else the directory itself
+func newBlobStore(cfg config.BlobCacheConfig) (blobcache.Store, error) {
+	if s3 := cfg.S3; s3.Bucket != "" {
+		store, err := blobcache.NewS3(blobcache.S3Config{
+			Bucket:    s3.Bucket,
+			Prefix:    s3.Prefix,
+			Region:    s3.Region,
+			Endpoint:  s3.Endpoint,
+			PathStyle: s3.PathStyle,
+			SSE:       s3.SSE,
+			KMSKeyID:  s3.KMSKeyID,
+		}, cfg.Dir)
+		if err != nil {
+			return nil, err
+		}
+		slog.Info("Caching blobs", "location", store.Location())
+		return store, nil
+	}
+
+	store, err := blobcache.NewDisk(cfg.Dir, int64(cfg.MaxSize))
+	if err != nil {
+		return nil, err
+	}
+	blobs, size := store.Usage()
+	slog.Info("Caching blobs", "location", cfg.Dir, "max_size", cfg.MaxSize, "blobs", blobs, "bytes", size)
+	return store, nil
+}
+
+// newTokenManager creates the token manager for the configured signing key source. Transit
+// signing uses the Vault client's own token (VAULT_TOKEN).
+func newTokenManager(ctx context.Context, cfg *config.Config, vaultClient *vault.Client) (*token.Manager, error) {
+	signing := cfg.Token.Signing
+
+	var source token.KeySource
+	if signing.TransitKey != "" {
+		transitSource, err := token.NewTransitKeySource(ctx, vaultClient, signing.TransitMount, signing.TransitKey)
+		if err != nil {
+			return nil, err
+		}
+		source = transitSource
+		slog.Info("Signing tokens with a Vault Transit key", "key", signing.TransitMount+"/"+signing.TransitKey)
+	} else {
+		pemSource, err := token.NewPEMKeySource(signing.PEMFile)
+		if err != nil {
+			return nil, err
+		}
+		source = pemSource
+		slog.Info("Signing tokens with keys from a file", "file", signing.PEMFile)
+	}
+
+	return token.NewManager(source, cfg.Token.Issuer, signing.Overlap.Duration()), nil
+}
+
+// refreshInterval returns how often expiring registry tokens are checked: often enough that each
+// is seen at least twice within its refresh window
+func refreshInterval(before time.Duration) time.Duration {
+	return max(min(before/2, 30*time.Second), time.Second)
+}
+
+// ociLayouts opens the configured OCI layouts and returns the transport serving them
+func ociLayouts(base http.RoundTripper, configs []config.OCILayoutConfig) (*ocilayout.Transport, error) {
+	layouts := ocilayout.NewTransport(base)
+	for _, layoutConfig := range configs {
+		layout, err := ocilayout.Open(layoutConfig.Path, layoutConfig.Repository)
+		if err != nil {
+			return nil, err
+		}
+		layouts.Add(layoutConfig.Host, layout, layoutConfig.FallbackFor)
+	}
+	return layouts, nil
+}
+
+// sizeLimit formats a size limit for logging
+func sizeLimit(size config.ByteSize) string {
+	if size == 0 {
+		return "unlimited"
+	}
+	return size.String()
+}
+
+// probeTargets parses the proxy-style usernames of the registries probed with credentials
+func probeTargets(probe config.ProbeConfig) ([]auth.RegistryConfig, error) {
+	targets := make([]auth.RegistryConfig, 0, len(probe.Registries))
+	for _, username := range probe.Registries {
+		target, err := auth.ParseUsername(username)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %v", username, err)
+		}
+		targets = append(targets, *target)
+	}
+	return targets, nil
+}
+
+// upstreamPins groups the configured certificate pins by registry host
+func upstreamPins(cfg config.UpstreamConfig) map[string][]string {
+	pins := make(map[string][]string, len(cfg.Pins))
+	for _, pin := range cfg.Pins {
+		pins[pin.Registry] = append(pins[pin.Registry], pin.Hashes...)
+	}
+	return pins
+}
+
+// upstreamClient is the client of upstream requests, with the transports of its chain the server
+// reports on
+type upstreamClient struct {
+	*http.Client
+	metrics *metrics.Transport
+	retries *transport.RetryTransport
+	egress  *transport.HostAllowlist
+}
+
+// newUpstreamClient builds the transport chain of upstream requests from the configuration, for
+// the server and the check subcommand alike. wrap, when set, wraps the connection-level
+// transports, as dev mode does to serve its registry in process.
+func newUpstreamClient(cfg *config.Config, wrap func(http.RoundTripper) http.RoundTripper, logger *slog.Logger) (*upstreamClient, error) {
+	// Concurrent requests to a registry share HTTP/2 connections, unless HTTP/2 is disabled, and
+	// otherwise reuse the idle HTTP/1.1 connections of the pool
+	upstreamTransport := http.DefaultTransport.(*http.Transport).Clone()
+	timeouts, pool := cfg.Upstream.Timeouts, cfg.Upstream.Pool
+	keepAlive := pool.KeepAlive.Duration()
+	if keepAlive == 0 {
+		keepAlive = -1 // net.Dialer disables keep-alive probes on negative values only
+	}
+	upstreamTransport.DialContext = (&net.Dialer{Timeout: timeouts.Dial.Duration(), KeepAlive: keepAlive}).DialContext
+	upstreamTransport.TLSHandshakeTimeout = timeouts.TLSHandshake.Duration()
+	upstreamTransport.ResponseHeaderTimeout = timeouts.ResponseHeader.Duration()
+	upstreamTransport.IdleConnTimeout = timeouts.Idle.Duration()
+	upstreamTransport.MaxIdleConns = pool.MaxIdleConns
+	upstreamTransport.MaxIdleConnsPerHost = pool.MaxIdleConnsPerHost
+	upstreamTransport.MaxConnsPerHost = pool.MaxConnsPerHost
+	if len(cfg.Upstream.Proxies) > 0 {
+		// Hosts without a rule keep the proxy of HTTPS_PROXY, HTTP_PROXY and NO_PROXY
+		proxy, err := transport.NewProxyFunc(upstreamProxies(cfg.Upstream), http.ProxyFromEnvironment)
+		if err != nil {
+			return nil, fmt.Errorf("invalid upstream proxies: %v", err)
+		}
+		upstreamTransport.Proxy = proxy
+		logger.Info("Routing upstream connections through outbound proxies", "rules", len(cfg.Upstream.Proxies))
+	}
+	if !cfg.Upstream.HTTP2 {
+		upstreamTransport.ForceAttemptHTTP2 = false
+		upstreamTransport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	httpClient := &http.Client{Transport: upstreamTransport}
+	if len(cfg.Upstream.Pins) > 0 {
+		pinned, err := transport.NewPinnedTransport(upstreamTransport, upstreamPins(cfg.Upstream))
+		if err != nil {
+			return nil, fmt.Errorf("invalid upstream certificate pins: %v", err)
+		}
+		upstreamTransport = pinned
+		httpClient.Transport = pinned
+		logger.Info("Pinning upstream certificates", "registries", len(cfg.Upstream.Pins))
+	}
+	if pool.PerRegistry {
+		httpClient.Transport = transport.NewHostPool(upstreamTransport)
+		logger.Info("Pooling upstream connections per registry", "max_idle_conns_per_host", pool.MaxIdleConnsPerHost, "max_conns_per_host", pool.MaxConnsPerHost)
+	}
+	if wrap != nil {
+		httpClient.Transport = wrap(httpClient.Transport)
+	}
+
+	if len(cfg.Upstream.OCILayouts) > 0 {
+		layouts, err := ociLayouts(httpClient.Transport, cfg.Upstream.OCILayouts)
+		if err != nil {
+			return nil, err
+		}
+		httpClient.Transport = layouts
+		for _, layout := range cfg.Upstream.OCILayouts {
+			if layout.Host != "" && len(cfg.Upstream.AllowedHosts) > 0 {
+				cfg.Upstream.AllowedHosts = append(cfg.Upstream.AllowedHosts, layout.Host)
+			}
+			if layout.Host != "" {
+				logger.Info("Serving OCI layout", "layout", layout.Path, "registry", layout.Host)
+			}
+			if len(layout.FallbackFor) > 0 {
+				logger.Info("Serving OCI layout when registries cannot be reached", "layout", layout.Path, "registries", layout.FallbackFor)
+			}
+		}
+	}
+
+	// Inside the retries, so each attempt sent upstream is recorded
+	var upstreamMetrics *metrics.Transport
+	if cfg.Metrics.Port != "" {
+		upstreamMetrics = metrics.NewTransport("vdp_upstream_request_duration_seconds", "Time to the response headers of the requests made to upstream registries and their token services, by host, method and status code.")
+		httpClient.Transport = upstreamMetrics.Wrap(httpClient.Transport)
+	}
+
+	var upstreamRetries *transport.RetryTransport
+	if retry := cfg.Upstream.Retry; retry.MaxRetries > 0 {
+		upstreamRetries = transport.NewRetryTransport(httpClient.Transport, transport.RetryPolicy{
+			MaxRetries:     retry.MaxRetries,
+			InitialBackoff: retry.InitialBackoff.Duration(),
+			MaxBackoff:     retry.MaxBackoff.Duration(),
+			Budget:         retry.Budget.Duration(),
+		})
+		httpClient.Transport = upstreamRetries
+		logger.Info("Retrying failed upstream requests", "max_retries", retry.MaxRetries, "budget", retry.Budget.Duration())
+	}
+
+	if rateLimit := cfg.Upstream.RateLimit; rateLimit.RetryBudget > 0 {
+		httpClient.Transport = transport.NewRetryAfterTransport(httpClient.Transport, rateLimit.RetryBudget.Duration(), rateLimit.MaxQueued)
+		logger.Info("Retrying rate-limited upstream requests", "retry_budget", rateLimit.RetryBudget.Duration())
+	}
+
+	var egress *transport.HostAllowlist
+	if len(cfg.Upstream.AllowedHosts) > 0 {
+		var err error
+		egress, err = transport.NewHostAllowlist(cfg.Upstream.AllowedHosts)
+		if err != nil {
+			return nil, fmt.Errorf("invalid upstream allowlist: %v", err)
+		}
+		// Outermost, so the allowlist sees the hosts requested rather than rewritten ones
+		httpClient.Transport = transport.NewEgressTransport(httpClient.Transport, egress)
+		logger.Info("Upstream egress restricted", "allowed_hosts", cfg.Upstream.AllowedHosts)
+	}
+	// Around the allowlist, so the token services of Bearer challenges are restricted too
+	httpClient.Transport = transport.NewTokenTransport(httpClient.Transport)
+
+	return &upstreamClient{Client: httpClient, metrics: upstreamMetrics, retries: upstreamRetries, egress: egress}, nil
+}
+
+// upstreamProxies converts the configured outbound proxies to proxy rules
+func upstreamProxies(cfg config.UpstreamConfig) []transport.ProxyRule {
+	rules := make([]transport.ProxyRule, 0, len(cfg.Proxies))
+	for _, proxy := range cfg.Proxies {
+		rules = append(rules, transport.ProxyRule{Hosts: proxy.Hosts, URL: proxy.URL})
+	}
+	return rules
+}
+
+// vaultLogin returns the auth method the proxy logs in to Vault with for its own token and its
+// mount, or nil when the token comes from VAULT_TOKEN
+func vaultLogin(cfg config.VaultAuthConfig) (api.AuthMethod, string) {
+	switch cfg.Method {
+	case "approle":
+		appRole := cfg.AppRole
+		return &vault.AppRole{Mount: appRole.Mount, RoleID: appRole.RoleID, SecretID: appRole.SecretID, SecretIDFile: appRole.SecretIDFile}, appRole.Mount
+	case "kubernetes":
+		kubernetes := cfg.Kubernetes
+		return &vault.Kubernetes{Mount: kubernetes.Mount, Role: kubernetes.Role, TokenFile: kubernetes.TokenFile}, kubernetes.Mount
+	case "aws":
+		aws := cfg.AWS
+		return &vault.AWSIAM{Mount: aws.Mount, Role: aws.Role, Region: aws.Region, ServerID: aws.ServerID}, aws.Mount
+	case "jwt":
+		jwt := cfg.JWT
+		return &vault.JWT{Mount: jwt.Mount, Role: jwt.Role, TokenFile: jwt.TokenFile}, jwt.Mount
+	}
+	return nil, ""
+}
+
+// startDevMode starts the embedded Vault and registry and prints how to use them
+func startDevMode(fixturePath, port string) (*devmode.Environment, error) {
+	fixture, err := devmode.LoadFixture(fixturePath)
+	if err != nil {
+		return nil, err
+	}
+
+	devEnv, err := devmode.Start(fixture)
+	if err != nil {
+		return nil, err
+	}
+
+	slog.Info("DEV MODE: embedded Vault and registry", "vault_address", devEnv.VaultAddr, "registry", devEnv.RegistryHost)
+	for path := range fixture.Secrets {
+		slog.Info("DEV MODE: try it with: docker login localhost:" + port + " -u 'docker;" + path + ";" + devEnv.RegistryHost + "' -p " + fixture.Token)
+		break
+	}
+	for _, image := range fixture.Registry.Images {
+		slog.Info("DEV MODE: available image", "image", "localhost:"+port+"/"+image)
+	}
+
+	return devEnv, nil
+}
+
+// envOrDefault returns the value of the environment variable or the fallback when unset
+func envOrDefault(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"vault-docker-proxy/pkg/auth"
+	"vault-docker-proxy/pkg/imagepolicy"
+	"vault-docker-proxy/pkg/registry"
+	"vault-docker-proxy/pkg/transport"
+	"vault-docker-proxy/pkg/vault"
+)
+
+const testAdminToken = "admin-token"
+
+// newTestProxy returns a proxy server using vaultAddr, and an upstream registry that fails the
+// test if a request reaches it
+func newTestProxy(t *testing.T, vaultAddr string) (*registry.ProxyServer, string) {
+	t.Helper()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("request reached the upstream registry: %s %s", r.Method, r.URL.Path)
+		http.NotFound(w, r)
+	}))
+	t.Cleanup(upstream.Close)
+
+	vaultClient, err := vault.NewClient(vaultAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return registry.NewProxyServerWithClient(vaultClient, upstream.Client()), strings.TrimPrefix(upstream.URL, "http://")
+}
+
+// serveBoth sends a registry request to the data-plane router and to the registry mirror of the
+// admin listener, built with the same middlewares, and returns both responses
+func serveBoth(t *testing.T, proxyServer *registry.ProxyServer, r func() *http.Request, middlewares ...mux.MiddlewareFunc) (dataPlane, adminMirror *httptest.ResponseRecorder) {
+	t.Helper()
+	authMiddleware := auth.NewMiddleware("http://proxy.test/token", "proxy.test")
+
+	dataPlane = httptest.NewRecorder()
+	setupRoutes(proxyServer, authMiddleware, middlewares...).ServeHTTP(dataPlane, r())
+
+	adminReq := r()
+	adminReq.Header.Set("X-Registry-Authorization", adminReq.Header.Get("Authorization"))
+	adminReq.Header.Set("Authorization", "Bearer "+testAdminToken)
+	adminMirror = httptest.NewRecorder()
+	setupAdminRoutes(proxyServer, nil, authMiddleware, testAdminToken, middlewares...).ServeHTTP(adminMirror, adminReq)
+	return dataPlane, adminMirror
+}
+
+// registryRequest returns a registry request with Basic credentials naming registryHost
+func registryRequest(method, path, registryHost string) func() *http.Request {
+	return func() *http.Request {
+		r := httptest.NewRequest(method, path, nil)
+		username := "docker;secret/registry;" + registryHost
+		r.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(username+":vault-token")))
+		return r
+	}
+}
+
+// assertDenied checks that both listeners denied the request with the given status
+func assertDenied(t *testing.T, status int, responses ...*httptest.ResponseRecorder) {
+	t.Helper()
+	for i, w := range responses {
+		listener := []string{"data plane", "admin mirror"}[i]
+		if w.Code != status {
+			t.Errorf("%s: status = %d, want %d (body %q)", listener, w.Code, status, w.Body.String())
+		}
+	}
+}
+
+func TestAdminMirrorImagePolicy(t *testing.T) {
+	policyFile := filepath.Join(t.TempDir(), "policy.yaml")
+	if err := os.WriteFile(policyFile, []byte("rules:\n  - name: no-latest\n    action: deny\n    tags: [latest]\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	policy, err := imagepolicy.NewReloader(policyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyServer, upstream := newTestProxy(t, "http://127.0.0.1:1")
+	proxyServer.SetImagePolicy(policy)
+
+	dataPlane, adminMirror := serveBoth(t, proxyServer, registryRequest(http.MethodGet, "/v2/library/app/manifests/latest", upstream), proxyServer.ImagePolicyMiddleware)
+	assertDenied(t, http.StatusForbidden, dataPlane, adminMirror)
+	if !strings.Contains(adminMirror.Body.String(), "no-latest") {
+		t.Errorf("admin mirror body = %q, want the denying rule", adminMirror.Body.String())
+	}
+}
+
+func TestAdminMirrorGroupAccess(t *testing.T) {
+	// The token belongs to the dev group, which is only granted the dev/* repositories
+	fakeVault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/v1/auth/token/lookup-self":
+			w.Write([]byte(`{"data":{"id":"vault-token","entity_id":"entity"}}`))
+		case "/v1/identity/entity/id/entity":
+			w.Write([]byte(`{"data":{"group_ids":["group"]}}`))
+		case "/v1/identity/group/id/group":
+			w.Write([]byte(`{"data":{"name":"dev"}}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer fakeVault.Close()
+
+	proxyServer, upstream := newTestProxy(t, fakeVault.URL)
+	host, _, _ := strings.Cut(upstream, ":")
+	if err := proxyServer.SetGroupAccess([]registry.GroupRule{{Group: "dev", Registries: []string{host}, Repositories: []string{"dev/*"}}}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	dataPlane, adminMirror := serveBoth(t, proxyServer, registryRequest(http.MethodGet, "/v2/prod/app/manifests/v1", upstream), proxyServer.GroupAccessMiddleware)
+	assertDenied(t, http.StatusForbidden, dataPlane, adminMirror)
+	if !strings.Contains(adminMirror.Body.String(), "identity groups") {
+		t.Errorf("admin mirror body = %q, want a group access denial", adminMirror.Body.String())
+	}
+}
+
+func TestAdminMirrorAccessPolicy(t *testing.T) {
+	_, office, err := net.ParseCIDR("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyServer, upstream := newTestProxy(t, "http://127.0.0.1:1")
+	policies := []registry.AccessPolicy{{Name: "office-pulls", Registries: []string{"*"}, Environments: []string{"office"}}}
+	if err := proxyServer.SetAccessPolicies(policies, []registry.Environment{{Name: "office", Networks: []*net.IPNet{office}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// httptest requests come from 192.0.2.1, outside the office network
+	dataPlane, adminMirror := serveBoth(t, proxyServer, registryRequest(http.MethodGet, "/v2/library/app/manifests/v1", upstream), proxyServer.AccessPolicyMiddleware)
+	assertDenied(t, http.StatusForbidden, dataPlane, adminMirror)
+	if !strings.Contains(adminMirror.Body.String(), "office-pulls") {
+		t.Errorf("admin mirror body = %q, want the denying policy", adminMirror.Body.String())
+	}
+}
+
+func TestAdminMirrorEgressAllowlist(t *testing.T) {
+	// Denied requests are refused before their credentials are read from Vault
+	fakeVault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("request reached Vault: %s %s", r.Method, r.URL.Path)
+		http.NotFound(w, r)
+	}))
+	defer fakeVault.Close()
+
+	allowlist, err := transport.NewHostAllowlist([]string{"registry.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyServer, upstream := newTestProxy(t, fakeVault.URL)
+	proxyServer.SetEgressAllowlist(allowlist)
+
+	dataPlane, adminMirror := serveBoth(t, proxyServer, registryRequest(http.MethodGet, "/v2/library/app/manifests/v1", upstream), proxyServer.EgressMiddleware)
+	assertDenied(t, http.StatusForbidden, dataPlane, adminMirror)
+	if !strings.Contains(adminMirror.Body.String(), "not in the upstream allowlist") {
+		t.Errorf("admin mirror body = %q, want an egress denial", adminMirror.Body.String())
+	}
+}
+
+func TestAdminMirrorClientCertificate(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "ci"}, NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxyServer, upstream := newTestProxy(t, "http://127.0.0.1:1")
+	if err := proxyServer.SetClientIdentities([]registry.ClientIdentity{{Names: []string{"ci"}, VaultPaths: []string{"secret/ci/*"}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		state  *tls.ConnectionState
+		status int
+	}{
+		{name: "no client certificate", state: &tls.ConnectionState{}, status: http.StatusUnauthorized},
+		{name: "Vault path not granted", state: &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{certificate}}}, status: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := registryRequest(http.MethodGet, "/v2/library/app/manifests/v1", upstream)
+			dataPlane, adminMirror := serveBoth(t, proxyServer, func() *http.Request {
+				r := request()
+				r.TLS = tt.state
+				return r
+			}, proxyServer.ClientCertificateMiddleware)
+			assertDenied(t, tt.status, dataPlane, adminMirror)
+		})
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"vault-docker-proxy/pkg/metrics"
+	"vault-docker-proxy/pkg/registry"
+	"vault-docker-proxy/pkg/transport"
+	"vault-docker-proxy/pkg/vault"
+)
+
+// metricsEndpoint names the endpoint of a data-plane request in request metrics, from a fixed
+// set so that client-chosen paths do not create time series
+func metricsEndpoint(r *http.Request) string {
+	path := r.URL.Path
+	switch {
+	case path == "/v2/" || path == "/v2":
+		return "version"
+	case path == "/v2/_catalog":
+		return "catalog"
+	case strings.HasPrefix(path, "/v2/") && strings.HasSuffix(path, "/tags/list"):
+		return "tags"
+	case strings.HasPrefix(path, "/v2/") && strings.Contains(path, "/manifests/"):
+		return "manifests"
+	case strings.HasPrefix(path, "/v2/") && strings.Contains(path, "/blobs/uploads/"):
+		return "uploads"
+	case strings.HasPrefix(path, "/v2/") && strings.Contains(path, "/blobs/"):
+		return "blobs"
+	case path == registry.TokenPath:
+		return "token"
+	case path == "/healthz":
+		return "healthz"
+	case path == "/.well-known/jwks.json":
+		return "jwks"
+	}
+	for _, extension := range []string{"export", "search", "inspect", "lookup", "token"} {
+		if strings.HasPrefix(path, "/ext/"+extension) {
+			return "ext_" + extension
+		}
+	}
+	return "other"
+}
+
+// proxyMetrics writes the credential resolution and credential cache counters of the proxy
+func proxyMetrics(proxyServer *registry.ProxyServer) metrics.Collector {
+	return metrics.CollectorFunc(func(w *metrics.Writer) {
+		stats := proxyServer.Stats()
+
+		w.Family("vdp_credential_lookups_total", "counter", "Registry credential lookups of client requests, by whether the credential cache had them.")
+		w.Sample("vdp_credential_lookups_total", float64(stats.CacheHits), metrics.Label{Name: "result", Value: "hit"})
+		w.Sample("vdp_credential_lookups_total", float64(stats.CacheMisses), metrics.Label{Name: "result", Value: "miss"})
+		counter(w, "vdp_credential_vault_calls_total", "Vault calls made for registry credentials, including lease renewals and revocations.", stats.VaultCalls)
+		counter(w, "vdp_credential_vault_errors_total", "Failed Vault calls made for registry credentials.", stats.VaultErrors)
+		counter(w, "vdp_credential_vault_reads_shared_total", "Cache misses that joined a Vault read of the same secret already in flight.", stats.VaultReadsShared)
+		counter(w, "vdp_credential_negative_cache_hits_total", "Vault reads skipped because the same read failed recently.", stats.NegativeCacheHits)
+
+		gauge(w, "vdp_credential_cache_entries", "Entries of the credential cache, including expired entries not cleaned up yet.", float64(stats.CredentialCache.Entries))
+		counter(w, "vdp_credential_cache_hits_total", "Credential cache lookups served from memory or the cache backend.", stats.CredentialCache.Hits)
+		counter(w, "vdp_credential_cache_misses_total", "Credential cache lookups that missed.", stats.CredentialCache.Misses)
+		counter(w, "vdp_credential_cache_sets_total", "Credentials stored in the credential cache.", stats.CredentialCache.Sets)
+		counter(w, "vdp_credential_cache_evictions_total", "Credentials that expired or were replaced, deleted or cleared.", stats.CredentialCache.Evictions)
+
+		if backend := stats.CacheBackend; backend != nil {
+			name := "vdp_credential_cache_backend_operations_total"
+			w.Family(name, "counter", "Operations of the credential cache backend, by result.")
+			for _, op := range []struct {
+				result string
+				count  uint64
+			}{{"hit", backend.Hits}, {"miss", backend.Misses}, {"set", backend.Sets}, {"delete", backend.Deletes}, {"error", backend.Errors}} {
+				w.Sample(name, float64(op.count), metrics.Label{Name: "backend", Value: backend.Backend}, metrics.Label{Name: "result", Value: op.result})
+			}
+		}
+	})
+}
+
+// retryMetrics writes the retries of upstream requests, or nothing when retries are disabled
+func retryMetrics(retries *transport.RetryTransport) metrics.Collector {
+	return metrics.CollectorFunc(func(w *metrics.Writer) {
+		if retries == nil {
+			return
+		}
+		stats := retries.Stats()
+
+		name := "vdp_upstream_retries_total"
+		w.Family(name, "counter", "Upstream requests retried, by reason: the status code, or network for network errors.")
+		for _, reason := range sortedKeys(stats.Retries) {
+			w.Sample(name, float64(stats.Retries[reason]), metrics.Label{Name: "reason", Value: reason})
+		}
+		counter(w, "vdp_upstream_retries_exhausted_total", "Upstream requests that still failed when their retries or retry budget ran out.", stats.Exhausted)
+	})
+}
+
+// vaultClientMetrics writes the calls made to Vault by operation and error type, and the status
+// of the proxy's own token
+func vaultClientMetrics(vaultClient *vault.Client) metrics.Collector {
+	return metrics.CollectorFunc(func(w *metrics.Writer) {
+		snapshot := vaultClient.Metrics()
+
+		name := "vdp_vault_request_duration_seconds"
+		w.Family(name, "histogram", "Latency of the calls made to Vault, by operation.")
+		for _, operation := range sortedKeys(snapshot.Operations) {
+			op := snapshot.Operations[operation]
+			label := metrics.Label{Name: "operation", Value: operation}
+			for _, bucket := range op.Latency {
+				bound := math.Inf(1)
+				if d, err := time.ParseDuration(bucket.LE); err == nil {
+					bound = d.Seconds()
+				}
+				w.Sample(name+"_bucket", float64(bucket.Count), label, metrics.Label{Name: "le", Value: formatBound(bound)})
+			}
+			w.Sample(name+"_sum", op.LatencyAvgMS*float64(op.Calls)/1000, label)
+			w.Sample(name+"_count", float64(op.Calls), label)
+		}
+
+		name = "vdp_vault_request_errors_total"
+		w.Family(name, "counter", "Failed calls made to Vault, by error type.")
+		for _, errorType := range sortedKeys(snapshot.ErrorTypes) {
+			w.Sample(name, float64(snapshot.ErrorTypes[errorType]), metrics.Label{Name: "type", Value: errorType})
+		}
+
+		if token := snapshot.Token; token != nil {
+			valid := 0.0
+			if token.Valid {
+				valid = 1
+			}
+			gauge(w, "vdp_vault_token_valid", "Whether the proxy's own Vault token was valid when last looked up.", valid)
+			gauge(w, "vdp_vault_token_ttl_seconds", "Remaining TTL of the proxy's own Vault token when last looked up, 0 when it does not expire.", float64(token.TTLSeconds))
+		}
+	})
+}
+
+// counter writes a counter without labels
+func counter(w *metrics.Writer, name, help string, value uint64) {
+	w.Family(name, "counter", help)
+	w.Sample(name, float64(value))
+}
+
+// gauge writes a gauge without labels
+func gauge(w *metrics.Writer, name, help string, value float64) {
+	w.Family(name, "gauge", help)
+	w.Sample(name, value)
+}
+
+// formatBound formats a histogram bucket bound as a label value
+func formatBound(bound float64) string {
+	if math.IsInf(bound, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(bound, 'g', -1, 64)
+}
+
+// sortedKeys returns the keys of a map in order
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
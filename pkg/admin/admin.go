@@ -0,0 +1,67 @@
+// Package admin provides the authenticated admin listener used for operational endpoints.
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Server hosts admin endpoints behind a shared bearer token
+type Server struct {
+	router *mux.Router
+	token  string
+}
+
+// NewServer creates an admin server requiring the given bearer token on every request
+func NewServer(token string) *Server {
+	s := &Server{
+		router: mux.NewRouter(),
+		token:  token,
+	}
+	s.router.Use(s.requireToken)
+	return s
+}
+
+// Router returns the router used to register admin endpoints
+func (s *Server) Router() *mux.Router {
+	return s.router
+}
+
+// ServeHTTP implements http.Handler
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.router.ServeHTTP(w, r)
+}
+
+// requireToken rejects requests that do not carry the admin bearer token
+func (s *Server) requireToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if s.token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="vault-docker-proxy-admin"`)
+			WriteError(w, "UNAUTHORIZED", "admin token required", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// WriteJSON writes v as an indented JSON response
+func WriteJSON(w http.ResponseWriter, statusCode int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	enc.Encode(v)
+}
+
+// WriteError writes an error response in the same shape as Docker Registry API errors
+func WriteError(w http.ResponseWriter, code, message string, statusCode int) {
+	WriteJSON(w, statusCode, map[string]interface{}{
+		"errors": []map[string]string{{"code": code, "message": message}},
+	})
+}
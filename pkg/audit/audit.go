@@ -0,0 +1,128 @@
+// Package audit keeps an append-only record of every registry credential resolution, for
+// security and compliance review of registry credential usage
+package audit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// Outcomes of a credential resolution
+const (
+	OutcomeCached   = "cached"    // served from the credential cache
+	OutcomeRead     = "read"      // read from Vault
+	OutcomeDenied   = "denied"    // Vault rejected the token or denied it the path
+	OutcomeNotFound = "not_found" // no secret at the path
+	OutcomeError    = "error"     // Vault unreachable or failing, or an unusable secret
+)
+
+// Event is the audit record of a credential resolution
+type Event struct {
+	Time         time.Time `json:"time"`
+	RequestID    string    `json:"request_id,omitempty"`
+	TokenHash    string    `json:"token_hash"` // hex SHA-256 of the Vault token
+	APIKey       string    `json:"api_key,omitempty"`
+	ClientIP     string    `json:"client_ip,omitempty"`
+	RegistryType string    `json:"registry_type"`
+	Registry     string    `json:"registry"`
+	Namespace    string    `json:"namespace,omitempty"`
+	VaultPath    string    `json:"vault_path"`
+	Repository   string    `json:"repository,omitempty"`
+	Outcome      string    `json:"outcome"`
+	Error        string    `json:"error,omitempty"`
+}
+
+// sink receives audit records, one JSON object per record
+type sink interface {
+	write(record []byte) error
+	Close() error
+}
+
+// Log writes audit events to a file, syslog or both. It is safe for concurrent use.
+type Log struct {
+	mu    sync.Mutex
+	sinks []sink
+}
+
+// Open opens the audit log: events are appended to file and sent to syslogAddress when set. The
+// syslog address is "local" for the local daemon, or udp://host:port or tcp://host:port.
+func Open(file, syslogAddress string) (*Log, error) {
+	l := &Log{}
+	if file != "" {
+		f, err := os.OpenFile(file, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open audit log: %v", err)
+		}
+		l.sinks = append(l.sinks, fileSink{f})
+	}
+	if syslogAddress != "" {
+		s, err := dialSyslog(syslogAddress)
+		if err != nil {
+			l.Close()
+			return nil, fmt.Errorf("failed to connect to syslog: %v", err)
+		}
+		l.sinks = append(l.sinks, s)
+	}
+	return l, nil
+}
+
+// Record writes an event. Failures are logged, never returned: auditing does not fail pulls.
+func (l *Log) Record(event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	record, err := json.Marshal(event)
+	if err != nil {
+		slog.Error("Failed to encode audit record", "error", err)
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, s := range l.sinks {
+		if err := s.write(record); err != nil {
+			slog.Error("Failed to write audit record", "error", err)
+		}
+	}
+}
+
+// Close closes the audit log
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var firstErr error
+	for _, s := range l.sinks {
+		if err := s.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	l.sinks = nil
+	return firstErr
+}
+
+// HashToken returns the hex SHA-256 hash of a Vault token, as recorded in events, so the usage of
+// a token can be looked up without the audit log holding it
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// fileSink appends records as JSON lines to a file
+type fileSink struct {
+	file *os.File
+}
+
+func (s fileSink) write(record []byte) error {
+	_, err := s.file.Write(append(record, '\n'))
+	return err
+}
+
+func (s fileSink) Close() error {
+	return s.file.Close()
+}
@@ -0,0 +1,42 @@
+//go:build !windows
+
+package audit
+
+import (
+	"fmt"
+	"log/syslog"
+	"net/url"
+)
+
+// syslogTag is the syslog tag of audit records
+const syslogTag = "vault-docker-proxy"
+
+// syslogSink sends records to syslog with the auth facility
+type syslogSink struct {
+	writer *syslog.Writer
+}
+
+// dialSyslog connects to the local syslog daemon ("local") or to a udp:// or tcp:// address
+func dialSyslog(address string) (sink, error) {
+	network, raddr := "", ""
+	if address != "local" {
+		u, err := url.Parse(address)
+		if err != nil || (u.Scheme != "udp" && u.Scheme != "tcp") || u.Host == "" {
+			return nil, fmt.Errorf("invalid syslog address %q, expected local, udp://host:port or tcp://host:port", address)
+		}
+		network, raddr = u.Scheme, u.Host
+	}
+	writer, err := syslog.Dial(network, raddr, syslog.LOG_INFO|syslog.LOG_AUTH, syslogTag)
+	if err != nil {
+		return nil, err
+	}
+	return syslogSink{writer}, nil
+}
+
+func (s syslogSink) write(record []byte) error {
+	return s.writer.Info(string(record))
+}
+
+func (s syslogSink) Close() error {
+	return s.writer.Close()
+}
@@ -0,0 +1,10 @@
+//go:build windows
+
+package audit
+
+import "errors"
+
+// dialSyslog reports that syslog is not available on Windows
+func dialSyslog(address string) (sink, error) {
+	return nil, errors.New("syslog is not available on Windows, write the audit log to a file instead")
+}
@@ -0,0 +1,46 @@
+package auth
+
+import (
+	"strings"
+	"sync/atomic"
+)
+
+// registryAliases maps registry aliases to registry URLs. It is replaced as a whole so it can be
+// updated while requests are served.
+var registryAliases atomic.Pointer[map[string]string]
+
+// SetRegistryAliases replaces the registry alias table. Clients may then name a registry by one
+// of its aliases wherever a registry URL is expected; aliases are matched case-insensitively.
+func SetRegistryAliases(aliases map[string]string) {
+	table := make(map[string]string, len(aliases))
+	for alias, registryURL := range aliases {
+		table[strings.ToLower(alias)] = registryURL
+	}
+	registryAliases.Store(&table)
+}
+
+// ResolveRegistryAlias returns the registry URL of an alias, or registryURL itself when it is
+// not an alias
+func ResolveRegistryAlias(registryURL string) string {
+	table := registryAliases.Load()
+	if table == nil {
+		return registryURL
+	}
+	if resolved, ok := (*table)[strings.ToLower(registryURL)]; ok {
+		return resolved
+	}
+	return registryURL
+}
+
+// RegistryAliases returns a copy of the registry alias table, keyed by lower-case alias
+func RegistryAliases() map[string]string {
+	table := registryAliases.Load()
+	if table == nil {
+		return map[string]string{}
+	}
+	aliases := make(map[string]string, len(*table))
+	for alias, registryURL := range *table {
+		aliases[alias] = registryURL
+	}
+	return aliases
+}
@@ -0,0 +1,89 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// API keys are presented in the APIKeyHeader header, or as the Basic auth password with any
+// username. Keys carry APIKeyPrefix so they can be told apart from Vault tokens.
+const (
+	APIKeyHeader = "X-API-Key"
+	APIKeyPrefix = "vdpk_"
+)
+
+// Registry actions an API key can be granted
+const (
+	ActionPull   = "pull"
+	ActionPush   = "push"
+	ActionDelete = "delete"
+)
+
+var (
+	ErrAPIKeyInvalid = errors.New("invalid API key")
+)
+
+// APIKey is the registry access granted to an API key
+type APIKey struct {
+	Name        string
+	Registry    RegistryConfig
+	Permissions []string
+}
+
+// Allows reports whether the key grants action
+func (k *APIKey) Allows(action string) bool {
+	for _, permission := range k.Permissions {
+		if permission == action || permission == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// APIKeyResolver looks up the access granted to an API key
+type APIKeyResolver interface {
+	ResolveAPIKey(ctx context.Context, key string) (*APIKey, error)
+}
+
+// HashAPIKey returns the hex SHA-256 of an API key, under which it is stored
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// APIKeyFromRequest returns the API key presented with a request, if any
+func APIKeyFromRequest(r *http.Request) (string, bool) {
+	if key := r.Header.Get(APIKeyHeader); key != "" {
+		return key, true
+	}
+	if _, password, ok := r.BasicAuth(); ok && strings.HasPrefix(password, APIKeyPrefix) {
+		return password, true
+	}
+	return "", false
+}
+
+// RequestAction returns the registry action a request performs. Every request of a blob upload
+// session, including checking and cancelling it, is a push.
+func RequestAction(r *http.Request) string {
+	if strings.Contains(r.URL.Path, "/blobs/uploads/") {
+		return ActionPush
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		return ActionPull
+	case http.MethodDelete:
+		return ActionDelete
+	default:
+		return ActionPush
+	}
+}
+
+// GetAPIKeyFromContext extracts the API key a request was authenticated with
+func GetAPIKeyFromContext(ctx context.Context) (*APIKey, bool) {
+	apiKey, ok := ctx.Value("apikey").(*APIKey)
+	return apiKey, ok
+}
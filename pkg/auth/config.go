@@ -3,31 +3,49 @@ package auth
 import (
 	"errors"
 	"strings"
+	"sync"
 )
 
 var (
-	ErrInvalidUsernameFormat = errors.New("invalid username format, expected: <registry_type>;<vault_path>;<registry_url>")
+	ErrInvalidUsernameFormat = errors.New("invalid username format, expected: <registry_type>;<vault_path>;<registry_url>[;<vault_namespace>]")
 	ErrUnsupportedRegistryType = errors.New("unsupported registry type")
 )
 
 // RegistryConfig represents the parsed configuration from the username field
 type RegistryConfig struct {
-	Type        string // e.g., "docker", "ecr", "gcr"
+	Type        string // e.g., "docker", "ecr", "gcr", "acr", "harbor"
 	VaultPath   string // path in Vault KV store
 	RegistryURL string // actual registry URL
+	Namespace   string // Vault namespace, relative to the proxy's own; empty for the proxy's
 }
 
-// ParseUsername parses the username field format: <registry_type>;<vault_path>;<registry_url>
+// SecretPath identifies the Vault secret of the configuration across namespaces, for caches:
+// the Vault path, prefixed with the namespace and a colon when there is one
+func (c *RegistryConfig) SecretPath() string {
+	if c.Namespace == "" {
+		return c.VaultPath
+	}
+	return c.Namespace + ":" + c.VaultPath
+}
+
+// ParseUsername parses the username field format: <registry_type>;<vault_path>;<registry_url>,
+// optionally followed by ;<vault_namespace>
 // Example: "docker;secret/docker-hub;registry.hub.docker.com"
 func ParseUsername(username string) (*RegistryConfig, error) {
-	parts := strings.SplitN(username, ";", 3)
-	if len(parts) != 3 {
+	parts := strings.SplitN(username, ";", 4)
+	if len(parts) < 3 {
 		return nil, ErrInvalidUsernameFormat
 	}
+	var namespace string
+	if len(parts) == 4 {
+		if namespace = strings.Trim(strings.TrimSpace(parts[3]), "/"); namespace == "" {
+			return nil, ErrInvalidUsernameFormat
+		}
+	}
 
 	registryType := strings.TrimSpace(parts[0])
 	vaultPath := strings.TrimSpace(parts[1])
-	registryURL := strings.TrimSpace(parts[2])
+	registryURL := ResolveRegistryAlias(strings.TrimSpace(parts[2]))
 
 	if registryType == "" || vaultPath == "" || registryURL == "" {
 		return nil, ErrInvalidUsernameFormat
@@ -42,24 +60,28 @@ func ParseUsername(username string) (*RegistryConfig, error) {
 		Type:        registryType,
 		VaultPath:   vaultPath,
 		RegistryURL: registryURL,
+		Namespace:   namespace,
 	}, nil
 }
 
-// isValidRegistryType checks if the registry type is supported
-func isValidRegistryType(registryType string) bool {
-	supportedTypes := map[string]bool{
-		"docker": true,
-		"ecr":    true,
-		"gcr":    true,
-	}
-	return supportedTypes[registryType]
+var (
+	registryTypesMu sync.RWMutex
+	registryTypes   = make(map[string]bool)
+)
+
+// RegisterRegistryType accepts a registry type in usernames. Registry providers register their
+// types; see the provider package.
+func RegisterRegistryType(registryType string) {
+	registryTypesMu.Lock()
+	defer registryTypesMu.Unlock()
+	registryTypes[registryType] = true
 }
 
-// Credentials represents the actual registry credentials retrieved from Vault
-type Credentials struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
-	Email    string `json:"email,omitempty"`
+// isValidRegistryType checks if the registry type is supported
+func isValidRegistryType(registryType string) bool {
+	registryTypesMu.RLock()
+	defer registryTypesMu.RUnlock()
+	return registryTypes[registryType]
 }
 
 // AuthHeader represents authentication information from the request
@@ -3,6 +3,7 @@ package auth
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"strings"
@@ -10,8 +11,17 @@ import (
 
 // Middleware provides authentication middleware for Docker Registry requests
 type Middleware struct {
-	realm   string
-	service string
+	realm          string
+	service        string
+	basic          bool // issue Basic instead of Bearer challenges
+	loginValidator LoginValidator
+	apiKeys        APIKeyResolver
+	tokens         RegistryTokenVerifier
+}
+
+// LoginValidator verifies client credentials during the initial docker login exchange
+type LoginValidator interface {
+	ValidateLogin(ctx context.Context, registryConfig *RegistryConfig, vaultToken string) error
 }
 
 // NewMiddleware creates a new authentication middleware
@@ -22,12 +32,55 @@ func NewMiddleware(realm, service string) *Middleware {
 	}
 }
 
+// NewBasicMiddleware creates an authentication middleware that challenges clients for Basic
+// credentials, so clients send the proxy username and Vault token directly
+func NewBasicMiddleware(realm string) *Middleware {
+	return &Middleware{
+		realm: realm,
+		basic: true,
+	}
+}
+
+// SetLoginValidator enables full credential validation on GET /v2/, so docker login fails
+// immediately on a bad username or Vault token instead of on the first pull
+func (m *Middleware) SetLoginValidator(validator LoginValidator) {
+	m.loginValidator = validator
+}
+
+// SetAPIKeyResolver enables API key authentication through the X-API-Key header or a Basic
+// password carrying the API key prefix
+func (m *Middleware) SetAPIKeyResolver(resolver APIKeyResolver) {
+	m.apiKeys = resolver
+}
+
+// SetRegistryTokenVerifier accepts registry tokens issued by the proxy's own token endpoint as
+// Bearer tokens, instead of passing every Bearer token upstream
+func (m *Middleware) SetRegistryTokenVerifier(verifier RegistryTokenVerifier) {
+	m.tokens = verifier
+}
+
 // DockerRegistryAuth is a middleware that handles Docker Registry authentication
 func (m *Middleware) DockerRegistryAuth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Skip authentication for the /v2/ endpoint (API version check)
+		if m.apiKeys != nil {
+			if key, ok := APIKeyFromRequest(r); ok {
+				m.handleAPIKey(w, r, key, next)
+				return
+			}
+		}
+
+		if m.tokens != nil {
+			if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+				if grant, issued, err := m.tokens.VerifyRegistryToken(r.Context(), token); issued {
+					m.handleRegistryToken(w, r, token, grant, err, next)
+					return
+				}
+			}
+		}
+
+		// The /v2/ endpoint (API version check) doubles as the docker login exchange
 		if r.URL.Path == "/v2/" {
-			next.ServeHTTP(w, r)
+			m.handleLogin(w, r, next)
 			return
 		}
 
@@ -50,6 +103,77 @@ func (m *Middleware) DockerRegistryAuth(next http.Handler) http.Handler {
 	})
 }
 
+// handleLogin validates credentials on the API version check when a login validator is set.
+// Without a validator the endpoint stays unauthenticated.
+func (m *Middleware) handleLogin(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	if m.loginValidator == nil || strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		m.challengeAuth(w, r)
+		return
+	}
+
+	registryConfig, err := ParseUsername(username)
+	if err != nil {
+		m.writeErrorResponse(w, "UNAUTHORIZED", err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if err := m.loginValidator.ValidateLogin(r.Context(), registryConfig, password); err != nil {
+		m.writeErrorResponse(w, "UNAUTHORIZED", err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	next.ServeHTTP(w, r)
+}
+
+// handleAPIKey authenticates a request with an API key and checks that the key grants the
+// requested action
+func (m *Middleware) handleAPIKey(w http.ResponseWriter, r *http.Request, key string, next http.Handler) {
+	apiKey, err := m.apiKeys.ResolveAPIKey(r.Context(), key)
+	if err != nil {
+		if errors.Is(err, ErrAPIKeyInvalid) {
+			m.writeErrorResponse(w, "UNAUTHORIZED", err.Error(), http.StatusUnauthorized)
+			return
+		}
+		m.writeErrorResponse(w, "UNAVAILABLE", err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	// The API version check only needs a valid key
+	if r.URL.Path != "/v2/" {
+		if action := RequestAction(r); !apiKey.Allows(action) {
+			m.writeErrorResponse(w, "DENIED", fmt.Sprintf("API key %s does not grant %s access", apiKey.Name, action), http.StatusForbidden)
+			return
+		}
+	}
+
+	ctx := context.WithValue(r.Context(), "apikey", apiKey)
+	next.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// handleRegistryToken authenticates a request with a registry token issued by the proxy. The
+// token must grant the scope of the request; it then stands in for the Vault token as the
+// password of the username it was issued to, like an access token.
+func (m *Middleware) handleRegistryToken(w http.ResponseWriter, r *http.Request, token string, grant *RegistryToken, err error, next http.Handler) {
+	if err != nil {
+		m.challenge(w, r, "invalid_token", err.Error())
+		return
+	}
+	if resourceType, name, action, ok := RequestResource(r); ok && !grant.Allows(resourceType, name, action) {
+		m.challenge(w, r, "insufficient_scope", fmt.Sprintf("token does not grant %s access to %s %s", action, resourceType, name))
+		return
+	}
+
+	r = r.Clone(r.Context())
+	r.SetBasicAuth(grant.Username, token)
+	m.handleBasicAuth(w, r, next)
+}
+
 // handleBearerAuth processes Bearer token authentication
 func (m *Middleware) handleBearerAuth(w http.ResponseWriter, r *http.Request, next http.Handler) {
 	authHeader := r.Header.Get("Authorization")
@@ -116,12 +240,12 @@ func (m *Middleware) handleBasicAuth(w http.ResponseWriter, r *http.Request, nex
 func (m *Middleware) extractRegistryURL(r *http.Request) string {
 	// Try to get from custom header (if Aqua sets it)
 	if registryURL := r.Header.Get("X-Registry-URL"); registryURL != "" {
-		return registryURL
+		return ResolveRegistryAlias(registryURL)
 	}
 	
 	// Try to get from cookies (if we set it during Basic Auth)
 	if cookie, err := r.Cookie("registry-url"); err == nil {
-		return cookie.Value
+		return ResolveRegistryAlias(cookie.Value)
 	}
 	
 	// Default to Docker Hub registry
@@ -130,80 +254,56 @@ func (m *Middleware) extractRegistryURL(r *http.Request) string {
 
 // challengeAuth returns a 401 Unauthorized response with WWW-Authenticate header
 func (m *Middleware) challengeAuth(w http.ResponseWriter, r *http.Request) {
+	m.challenge(w, r, "", "authentication required")
+}
+
+// challenge returns a 401 Unauthorized response with a WWW-Authenticate header carrying the
+// scope of the request and, for a rejected token, the error code of the token spec
+func (m *Middleware) challenge(w http.ResponseWriter, r *http.Request, errorCode, message string) {
+	if m.basic {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Basic realm="%s"`, m.realm))
+		w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+		m.writeErrorResponse(w, "UNAUTHORIZED", message, http.StatusUnauthorized)
+		return
+	}
+
 	// Extract scope from request path for more specific authentication challenge
 	scope := m.extractScope(r)
 
-	authHeader := fmt.Sprintf(`Bearer realm="%s",service="%s"`, m.realm, m.service)
+	authHeader := fmt.Sprintf(`Bearer realm="%s",service="%s"`, m.realmFor(r), m.service)
 	if scope != "" {
 		authHeader += fmt.Sprintf(`,scope="%s"`, scope)
 	}
+	if errorCode != "" {
+		authHeader += fmt.Sprintf(`,error="%s"`, errorCode)
+	}
 
 	w.Header().Set("WWW-Authenticate", authHeader)
 	w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
 
-	m.writeErrorResponse(w, "UNAUTHORIZED", "authentication required", http.StatusUnauthorized)
+	m.writeErrorResponse(w, "UNAUTHORIZED", message, http.StatusUnauthorized)
 }
 
-// extractScope extracts the scope from the request path for authentication challenge
-func (m *Middleware) extractScope(r *http.Request) string {
-	path := r.URL.Path
-
-	// Extract repository name and action from path
-	if strings.HasPrefix(path, "/v2/") {
-		path = strings.TrimPrefix(path, "/v2/")
-		
-		// Handle catalog request
-		if path == "_catalog" {
-			return "registry:catalog:*"
-		}
-
-		// Handle repository-specific requests
-		if strings.Contains(path, "/") {
-			parts := strings.Split(path, "/")
-			if len(parts) >= 2 {
-				repoName := strings.Join(parts[:len(parts)-1], "/")
-				endpoint := parts[len(parts)-1]
-
-				// Determine action based on endpoint and HTTP method
-				action := m.getActionFromEndpoint(endpoint, r.Method)
-				return fmt.Sprintf("repository:%s:%s", repoName, action)
-			}
-		}
+// realmFor returns the realm advertised to a request. A realm given as a path, such as the
+// proxy's own /token endpoint, is resolved against the host the client reached the proxy on.
+func (m *Middleware) realmFor(r *http.Request) string {
+	if !strings.HasPrefix(m.realm, "/") {
+		return m.realm
 	}
-
-	return ""
-}
-
-// getActionFromEndpoint determines the action based on endpoint and HTTP method
-func (m *Middleware) getActionFromEndpoint(endpoint, method string) string {
-	switch {
-	case endpoint == "tags" || strings.HasPrefix(endpoint, "tags/"):
-		return "pull"
-	case strings.HasPrefix(endpoint, "manifests/"):
-		switch method {
-		case "GET":
-			return "pull"
-		case "PUT":
-			return "push"
-		case "DELETE":
-			return "delete"
-		default:
-			return "pull"
-		}
-	case strings.HasPrefix(endpoint, "blobs/"):
-		switch method {
-		case "GET":
-			return "pull"
-		case "DELETE":
-			return "delete"
-		default:
-			return "pull"
-		}
-	case endpoint == "uploads" || strings.HasPrefix(endpoint, "uploads/"):
-		return "push"
-	default:
-		return "pull"
+	scheme := "http"
+	if r.TLS != nil || strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https") {
+		scheme = "https"
+	}
+	host := r.Host
+	if forwarded := r.Header.Get("X-Forwarded-Host"); forwarded != "" {
+		host = forwarded
 	}
+	return scheme + "://" + host + m.realm
+}
+
+// extractScope extracts the scope from the request path for authentication challenge
+func (m *Middleware) extractScope(r *http.Request) string {
+	return RequestScope(r)
 }
 
 // writeErrorResponse writes a Docker Registry API compliant error response
@@ -220,7 +320,9 @@ func (m *Middleware) writeErrorResponse(w http.ResponseWriter, code, message str
 		},
 	}
 
-	json.NewEncoder(w).Encode(errorResp)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.Encode(errorResp)
 }
 
 // GetAuthFromContext extracts authentication information from request context
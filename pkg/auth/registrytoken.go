@@ -0,0 +1,91 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// Resource types of registry token scopes
+const (
+	ResourceRepository = "repository"
+	ResourceRegistry   = "registry"
+)
+
+// ResourceAccess is an entry of the access claim of a registry token: the actions granted on a
+// resource, such as pull and push on repository library/alpine
+type ResourceAccess struct {
+	Type    string   `json:"type"`
+	Name    string   `json:"name"`
+	Actions []string `json:"actions"`
+}
+
+// RegistryToken is the grant of a registry token issued by the proxy's token endpoint
+type RegistryToken struct {
+	Username string // proxy username the token was issued to
+	Access   []ResourceAccess
+}
+
+// Allows reports whether the token grants action on a resource
+func (t *RegistryToken) Allows(resourceType, name, action string) bool {
+	for _, access := range t.Access {
+		if access.Type != resourceType || access.Name != name {
+			continue
+		}
+		for _, granted := range access.Actions {
+			if granted == action || granted == "*" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// RegistryTokenVerifier verifies the registry tokens clients present as Bearer tokens
+type RegistryTokenVerifier interface {
+	// VerifyRegistryToken returns the grant of a token; ok is false for tokens the proxy did
+	// not issue, which are passed upstream
+	VerifyRegistryToken(ctx context.Context, token string) (grant *RegistryToken, ok bool, err error)
+}
+
+// ParseScope parses a token scope such as repository:library/alpine:pull,push. Repository names
+// may start with a host and port, so the actions follow the last colon.
+func ParseScope(scope string) (ResourceAccess, bool) {
+	resourceType, rest, ok := strings.Cut(scope, ":")
+	i := strings.LastIndex(rest, ":")
+	if !ok || resourceType == "" || i <= 0 {
+		return ResourceAccess{}, false
+	}
+	return ResourceAccess{Type: resourceType, Name: rest[:i], Actions: strings.Split(rest[i+1:], ",")}, true
+}
+
+// RequestResource returns the resource a registry API request acts on and the action it needs:
+// the repository of manifest, blob, upload, tag and referrer paths, or the registry catalog
+func RequestResource(r *http.Request) (resourceType, name, action string, ok bool) {
+	path := strings.TrimPrefix(r.URL.Path, "/v2/")
+	if path == "_catalog" {
+		return ResourceRegistry, "catalog", "*", true
+	}
+
+	end := -1
+	for _, marker := range []string{"/manifests/", "/blobs/", "/tags/", "/referrers/"} {
+		end = max(end, strings.LastIndex(path, marker))
+	}
+	if end <= 0 {
+		return "", "", "", false
+	}
+	return ResourceRepository, path[:end], RequestAction(r), true
+}
+
+// RequestScope returns the token scope a client needs for a request, empty when it needs none.
+// Pushes ask for pull as well, as docker does, since pushes check for existing blobs.
+func RequestScope(r *http.Request) string {
+	resourceType, name, action, ok := RequestResource(r)
+	if !ok {
+		return ""
+	}
+	if action == ActionPush {
+		action = ActionPull + "," + ActionPush
+	}
+	return resourceType + ":" + name + ":" + action
+}
@@ -0,0 +1,210 @@
+package auth
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Secret holds sensitive bytes, such as a registry password or a Vault token, so they can be
+// wiped as soon as they are no longer needed instead of lingering in immutable strings until
+// garbage collection. It is safe for concurrent use; a wiped secret is empty.
+type Secret struct {
+	mu    sync.Mutex
+	value []byte
+}
+
+// NewSecret wraps value, taking ownership of the slice
+func NewSecret(value []byte) *Secret {
+	return &Secret{value: value}
+}
+
+// Clone returns an independent copy that must be wiped separately
+func (s *Secret) Clone() *Secret {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.value == nil {
+		return &Secret{}
+	}
+	return &Secret{value: append([]byte(nil), s.value...)}
+}
+
+// Wipe zeroes the secret
+func (s *Secret) Wipe() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	Wipe(s.value)
+	s.value = nil
+}
+
+// Empty reports whether the secret is empty or has been wiped
+func (s *Secret) Empty() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.value) == 0
+}
+
+// Reveal returns the secret as a string, for APIs that only accept strings. The copy cannot be
+// wiped, so it should not outlive the call it is made for.
+func (s *Secret) Reveal() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return string(s.value)
+}
+
+// String implements fmt.Stringer without revealing the secret
+func (s *Secret) String() string {
+	return "[redacted]"
+}
+
+// Credentials represents the actual registry credentials retrieved from Vault. The password is
+// a Secret: holders wipe their copy once the upstream request has been made.
+type Credentials struct {
+	Username  string    `json:"username"`
+	Email     string    `json:"email,omitempty"`
+	ExpiresAt time.Time `json:"expires_at,omitempty"` // set for short-lived registry tokens
+	Lease     *Lease    `json:"-"`                    // set for dynamic secrets
+	password  *Secret
+	release   func() // run by the first Wipe
+}
+
+// Lease is the Vault lease of a dynamic secret, generated by a secrets engine for each read.
+// Leases are replaced rather than modified when renewed.
+type Lease struct {
+	ID        string
+	Duration  time.Duration
+	Renewable bool
+}
+
+// SetLease records the lease of the secret the credentials were read from, if any. The
+// credentials expire with the lease, unless they expire earlier.
+func (c *Credentials) SetLease(lease *Lease) {
+	if lease == nil {
+		return
+	}
+	c.Lease = lease
+	if expiresAt := time.Now().Add(lease.Duration); lease.Duration > 0 && (c.ExpiresAt.IsZero() || expiresAt.Before(c.ExpiresAt)) {
+		c.ExpiresAt = expiresAt
+	}
+}
+
+// NewCredentials creates credentials, taking ownership of the password slice
+func NewCredentials(username string, password []byte, email string) *Credentials {
+	return &Credentials{
+		Username: username,
+		Email:    email,
+		password: NewSecret(password),
+	}
+}
+
+// BasicCredentialsFromSecret decodes username/password credentials (and an optional email) from
+// the data of a Vault secret
+func BasicCredentialsFromSecret(data map[string]interface{}) (*Credentials, error) {
+	username, ok := data["username"].(string)
+	if !ok {
+		return nil, errors.New("username not found in secret")
+	}
+
+	password, ok := data["password"].(string)
+	if !ok {
+		return nil, errors.New("password not found in secret")
+	}
+
+	// Email is optional
+	email, _ := data["email"].(string)
+
+	// The decoded secret data is a string that cannot be wiped; the credentials hold their own copy
+	return NewCredentials(username, []byte(password), email), nil
+}
+
+// Clone returns a copy with its own password, so the copy and the original can be wiped
+// independently
+func (c *Credentials) Clone() *Credentials {
+	return &Credentials{
+		Username:  c.Username,
+		Email:     c.Email,
+		ExpiresAt: c.ExpiresAt,
+		Lease:     c.Lease,
+		password:  c.password.Clone(),
+	}
+}
+
+// sealedCredentials is the encoding of credentials kept in an external cache
+type sealedCredentials struct {
+	Username  string    `json:"username"`
+	Email     string    `json:"email,omitempty"`
+	ExpiresAt time.Time `json:"expires_at,omitempty"`
+	Password  []byte    `json:"password"`
+}
+
+// MarshalSecret encodes the credentials with their password, for caches that store them
+// encrypted. The lease is left out, as it belongs to the process that read the secret. The
+// caller wipes the result.
+func (c *Credentials) MarshalSecret() ([]byte, error) {
+	c.password.mu.Lock()
+	defer c.password.mu.Unlock()
+	return json.Marshal(sealedCredentials{Username: c.Username, Email: c.Email, ExpiresAt: c.ExpiresAt, Password: c.password.value})
+}
+
+// UnmarshalSecretCredentials decodes credentials encoded by MarshalSecret
+func UnmarshalSecretCredentials(data []byte) (*Credentials, error) {
+	var sealed sealedCredentials
+	if err := json.Unmarshal(data, &sealed); err != nil {
+		return nil, err
+	}
+	credentials := NewCredentials(sealed.Username, sealed.Password, sealed.Email)
+	credentials.ExpiresAt = sealed.ExpiresAt
+	return credentials, nil
+}
+
+// Wipe zeroes the password, and runs the release function of the credentials the first time
+func (c *Credentials) Wipe() {
+	if c == nil {
+		return
+	}
+	if c.password != nil {
+		c.password.Wipe()
+	}
+	if release := c.release; release != nil {
+		c.release = nil
+		release()
+	}
+}
+
+// SetRelease sets a function run when the credentials are wiped, that is once their holder is
+// done with them, such as the revocation of a lease nothing else uses. Clones do not inherit it.
+func (c *Credentials) SetRelease(release func()) {
+	c.release = release
+}
+
+// Wiped reports whether the password has been wiped
+func (c *Credentials) Wiped() bool {
+	return c.password == nil || c.password.Empty()
+}
+
+// SetBasicAuth sets the Authorization header of req to the credentials. The header value is
+// built without intermediate password strings.
+func (c *Credentials) SetBasicAuth(req *http.Request) {
+	c.password.mu.Lock()
+	plain := make([]byte, 0, len(c.Username)+1+len(c.password.value))
+	plain = append(append(append(plain, c.Username...), ':'), c.password.value...)
+	c.password.mu.Unlock()
+
+	encoded := make([]byte, len("Basic ")+base64.StdEncoding.EncodedLen(len(plain)))
+	copy(encoded, "Basic ")
+	base64.StdEncoding.Encode(encoded[len("Basic "):], plain)
+	req.Header.Set("Authorization", string(encoded))
+
+	Wipe(plain)
+	Wipe(encoded)
+}
+
+// Wipe zeroes b, for secrets held in byte slices outside a Secret
+func Wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
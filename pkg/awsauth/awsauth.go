@@ -0,0 +1,147 @@
+// Package awsauth signs AWS API requests with Signature Version 4 and finds the AWS credentials
+// of the environment the proxy runs in, without depending on the AWS SDK.
+package awsauth
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxResponseSize bounds the responses read from AWS APIs
+const maxResponseSize = 1 << 20
+
+// Credentials are AWS access keys, long-lived or temporary
+type Credentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	Expiration      time.Time // zero for long-lived keys
+}
+
+// Call POSTs body to an AWS query or JSON API and returns the response body. The request is
+// signed for service in region unless credentials is nil, as for sts:AssumeRoleWithWebIdentity.
+func Call(ctx context.Context, client *http.Client, url, region, service string, credentials *Credentials, header http.Header, body []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if credentials != nil {
+		Sign(req, body, credentials, region, service, time.Now())
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned HTTP %d: %s", req.URL.Host, resp.StatusCode, errorMessage(respBody))
+	}
+	return respBody, nil
+}
+
+// errorMessage extracts the code and message of an AWS error response, in the XML form of query
+// APIs or the JSON form of JSON APIs
+func errorMessage(body []byte) string {
+	var xmlError struct {
+		Code    string `xml:"Error>Code"`
+		Message string `xml:"Error>Message"`
+	}
+	if xml.Unmarshal(body, &xmlError) == nil && xmlError.Code != "" {
+		return xmlError.Code + ": " + xmlError.Message
+	}
+	var jsonError struct {
+		Type    string `json:"__type"`
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(body, &jsonError) == nil && jsonError.Type != "" {
+		return jsonError.Type + ": " + jsonError.Message
+	}
+	return http.StatusText(http.StatusBadGateway)
+}
+
+// Sign adds a Signature Version 4 Authorization header to req, a request without query
+// parameters, signing its host and every header set on it. The payload hash is taken from an
+// X-Amz-Content-Sha256 header when set, as for S3 requests streaming their body, or computed
+// from body.
+func Sign(req *http.Request, body []byte, credentials *Credentials, region, service string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	if credentials.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", credentials.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		if name = strings.ToLower(name); name != "authorization" && name != "user-agent" {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	payloadHash := req.Header.Get("X-Amz-Content-Sha256")
+	if payloadHash == "" {
+		bodyHash := sha256.Sum256(body)
+		payloadHash = hex.EncodeToString(bodyHash[:])
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		"",
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+credentials.SecretAccessKey), date)
+	for _, part := range []string{region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		credentials.AccessKeyID, scope, signedHeaders, signature))
+}
+
+// hmacSHA256 returns the HMAC-SHA256 of data with key
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
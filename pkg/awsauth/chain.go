@@ -0,0 +1,229 @@
+package awsauth
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Endpoints of the ECS and EKS Pod Identity container credentials and of the EC2 instance
+// metadata service
+const (
+	containerCredentialsHost = "http://169.254.170.2"
+	instanceMetadataURL      = "http://169.254.169.254/latest"
+)
+
+var ErrNoCredentials = errors.New("no AWS credentials found")
+
+// metadataClient reaches the link-local credential endpoints, which answer quickly or not at all
+var metadataClient = &http.Client{Timeout: 2 * time.Second}
+
+// stsClient calls STS for web identity credentials; http.DefaultTransport honours the
+// HTTPS_PROXY variables
+var stsClient = &http.Client{Timeout: 30 * time.Second}
+
+// DefaultCredentials finds the AWS credentials of the environment, in the order of the AWS SDKs:
+// the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY variables, a web identity token file (EKS IAM
+// roles for service accounts), the container credentials endpoint (ECS tasks and EKS Pod
+// Identity) and the instance metadata service (EC2).
+func DefaultCredentials(ctx context.Context) (*Credentials, error) {
+	if accessKeyID := os.Getenv("AWS_ACCESS_KEY_ID"); accessKeyID != "" {
+		return &Credentials{
+			AccessKeyID:     accessKeyID,
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		}, nil
+	}
+	if tokenFile := os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"); tokenFile != "" {
+		return webIdentityCredentials(ctx, tokenFile, os.Getenv("AWS_ROLE_ARN"))
+	}
+	if os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI") != "" || os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI") != "" {
+		return containerCredentials(ctx)
+	}
+	credentials, err := instanceCredentials(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNoCredentials, err)
+	}
+	return credentials, nil
+}
+
+// webIdentityCredentials exchanges a web identity token for the credentials of a role with
+// sts:AssumeRoleWithWebIdentity, which needs no signature
+func webIdentityCredentials(ctx context.Context, tokenFile, roleARN string) (*Credentials, error) {
+	token, err := os.ReadFile(tokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read web identity token: %v", err)
+	}
+	sessionName := os.Getenv("AWS_ROLE_SESSION_NAME")
+	if sessionName == "" {
+		sessionName = "vault-docker-proxy"
+	}
+	form := url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"Version":          {"2011-06-15"},
+		"RoleArn":          {roleARN},
+		"RoleSessionName":  {sessionName},
+		"WebIdentityToken": {strings.TrimSpace(string(token))},
+	}
+	header := http.Header{"Content-Type": {"application/x-www-form-urlencoded; charset=utf-8"}}
+	body, err := Call(ctx, stsClient, STSEndpoint(Region()), "", "", nil, header, []byte(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("cannot assume role %s with web identity: %v", roleARN, err)
+	}
+
+	var response struct {
+		Credentials struct {
+			AccessKeyID     string    `xml:"AccessKeyId"`
+			SecretAccessKey string    `xml:"SecretAccessKey"`
+			SessionToken    string    `xml:"SessionToken"`
+			Expiration      time.Time `xml:"Expiration"`
+		} `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+	}
+	if err := xml.Unmarshal(body, &response); err != nil || response.Credentials.AccessKeyID == "" {
+		return nil, fmt.Errorf("invalid AssumeRoleWithWebIdentity response for %s", roleARN)
+	}
+	return &Credentials{
+		AccessKeyID:     response.Credentials.AccessKeyID,
+		SecretAccessKey: response.Credentials.SecretAccessKey,
+		SessionToken:    response.Credentials.SessionToken,
+		Expiration:      response.Credentials.Expiration,
+	}, nil
+}
+
+// containerCredentials reads the credentials of an ECS task or EKS Pod Identity association
+func containerCredentials(ctx context.Context) (*Credentials, error) {
+	endpoint := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+	if relative := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); relative != "" {
+		endpoint = containerCredentialsHost + relative
+	}
+	authorization := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN")
+	if tokenFile := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"); tokenFile != "" {
+		token, err := os.ReadFile(tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read container authorization token: %v", err)
+		}
+		authorization = strings.TrimSpace(string(token))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	credentials, err := fetchCredentials(req)
+	if err != nil {
+		return nil, fmt.Errorf("container credentials: %v", err)
+	}
+	return credentials, nil
+}
+
+// instanceCredentials reads the credentials of the instance profile from the instance metadata
+// service, using IMDSv2 session tokens
+func instanceCredentials(ctx context.Context) (*Credentials, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, instanceMetadataURL+"/api/token", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Aws-Ec2-Metadata-Token-Ttl-Seconds", "300")
+	token, err := metadataGet(req)
+	if err != nil {
+		return nil, fmt.Errorf("instance metadata: %v", err)
+	}
+
+	credentialsURL := instanceMetadataURL + "/meta-data/iam/security-credentials/"
+	req, err = http.NewRequestWithContext(ctx, http.MethodGet, credentialsURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Aws-Ec2-Metadata-Token", token)
+	roles, err := metadataGet(req)
+	if err != nil {
+		return nil, fmt.Errorf("instance metadata: %v", err)
+	}
+	role, _, _ := strings.Cut(strings.TrimSpace(roles), "\n")
+	if role == "" {
+		return nil, errors.New("instance metadata: the instance has no IAM role")
+	}
+
+	req, err = http.NewRequestWithContext(ctx, http.MethodGet, credentialsURL+url.PathEscape(role), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Aws-Ec2-Metadata-Token", token)
+	credentials, err := fetchCredentials(req)
+	if err != nil {
+		return nil, fmt.Errorf("instance metadata: %v", err)
+	}
+	return credentials, nil
+}
+
+// metadataGet makes a request to a credential endpoint and returns the response body
+func metadataGet(req *http.Request) (string, error) {
+	resp, err := metadataClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s returned HTTP %d", req.URL.Path, resp.StatusCode)
+	}
+	return string(body), nil
+}
+
+// fetchCredentials reads credentials in the JSON form served by the container and instance
+// metadata endpoints
+func fetchCredentials(req *http.Request) (*Credentials, error) {
+	body, err := metadataGet(req)
+	if err != nil {
+		return nil, err
+	}
+	var response struct {
+		AccessKeyID     string    `json:"AccessKeyId"`
+		SecretAccessKey string    `json:"SecretAccessKey"`
+		Token           string    `json:"Token"`
+		Expiration      time.Time `json:"Expiration"`
+	}
+	if err := json.Unmarshal([]byte(body), &response); err != nil || response.AccessKeyID == "" {
+		return nil, errors.New("invalid credentials response")
+	}
+	return &Credentials{
+		AccessKeyID:     response.AccessKeyID,
+		SecretAccessKey: response.SecretAccessKey,
+		SessionToken:    response.Token,
+		Expiration:      response.Expiration,
+	}, nil
+}
+
+// Region returns the region of the environment from AWS_REGION or AWS_DEFAULT_REGION, or empty
+func Region() string {
+	if region := os.Getenv("AWS_REGION"); region != "" {
+		return region
+	}
+	return os.Getenv("AWS_DEFAULT_REGION")
+}
+
+// STSEndpoint returns the regional STS endpoint, or the global one when region is empty
+func STSEndpoint(region string) string {
+	if region == "" {
+		return "https://sts.amazonaws.com/"
+	}
+	domain := "amazonaws.com"
+	if strings.HasPrefix(region, "cn-") {
+		domain = "amazonaws.com.cn"
+	}
+	return "https://sts." + region + "." + domain + "/"
+}
@@ -0,0 +1,103 @@
+// Package blobcache stores registry blobs by digest for the pull-through blob cache, so layers
+// pulled once are served locally afterwards.
+package blobcache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+)
+
+var (
+	ErrInvalidDigest  = errors.New("unsupported blob digest")
+	ErrDigestMismatch = errors.New("blob content does not match its digest")
+	ErrTooLarge       = errors.New("blob is larger than the cache")
+)
+
+// Store keeps blobs by digest
+type Store interface {
+	// Open returns a stored blob and its size; ok is false when the blob is not stored
+	Open(ctx context.Context, digest string) (blob io.ReadSeekCloser, size int64, ok bool)
+	// Create starts storing a blob of the given size, or -1 when unknown
+	Create(ctx context.Context, digest string, size int64) (Writer, error)
+}
+
+// Writer stores a blob as it is downloaded. Nothing is stored until Commit has verified the
+// content against the digest.
+type Writer interface {
+	io.Writer
+	Commit() error
+	Abort()
+}
+
+// pending is a blob being downloaded to a temporary file
+type pending struct {
+	digest string
+	file   *os.File
+	hash   hash.Hash
+	size   int64
+	limit  int64
+}
+
+// newPending starts downloading a blob to a temporary file in dir, accepting up to limit bytes
+func newPending(dir, digest string, size, limit int64) (*pending, error) {
+	if !validDigest(digest) {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidDigest, digest)
+	}
+	if size > limit {
+		return nil, fmt.Errorf("%w: %d bytes", ErrTooLarge, size)
+	}
+	file, err := os.CreateTemp(dir, "blob-")
+	if err != nil {
+		return nil, err
+	}
+	return &pending{digest: digest, file: file, hash: sha256.New(), limit: limit}, nil
+}
+
+func (p *pending) Write(b []byte) (int, error) {
+	if p.size+int64(len(b)) > p.limit {
+		return 0, fmt.Errorf("%w: more than %d bytes", ErrTooLarge, p.limit)
+	}
+	n, err := p.file.Write(b)
+	p.hash.Write(b[:n])
+	p.size += int64(n)
+	return n, err
+}
+
+// verify closes the temporary file and checks its content against the digest
+func (p *pending) verify() error {
+	if err := p.file.Close(); err != nil {
+		return err
+	}
+	if digest := "sha256:" + hex.EncodeToString(p.hash.Sum(nil)); digest != p.digest {
+		return fmt.Errorf("%w: got %s for %s", ErrDigestMismatch, digest, p.digest)
+	}
+	return nil
+}
+
+// Abort discards the partial blob
+func (p *pending) Abort() {
+	p.file.Close()
+	os.Remove(p.file.Name())
+}
+
+// validDigest reports whether a digest is a sha256 digest, the only algorithm stored; the
+// check also keeps digests from naming paths outside the store
+func validDigest(digest string) bool {
+	hexDigest, ok := strings.CutPrefix(digest, "sha256:")
+	if !ok || len(hexDigest) != sha256.Size*2 {
+		return false
+	}
+	for _, c := range hexDigest {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,204 @@
+package blobcache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Disk is a content-addressable blob store in a local directory. Blobs are stored at
+// <dir>/sha256/<first two hex digits>/<hex>; downloads are written to <dir>/tmp and only moved
+// into place once their digest is verified, so incomplete blobs are never served. When the
+// blobs outgrow the maximum size, the least recently used ones are removed.
+type Disk struct {
+	dir     string
+	maxSize int64
+
+	mu    sync.Mutex
+	blobs map[string]*diskBlob // by digest
+	size  int64
+}
+
+// diskBlob is the size and last use of a stored blob
+type diskBlob struct {
+	size     int64
+	lastUsed time.Time
+}
+
+// NewDisk opens the blob store in dir, creating it if needed. Blobs already in the directory
+// are kept, with their modification time as last use; leftover partial downloads are removed.
+func NewDisk(dir string, maxSize int64) (*Disk, error) {
+	d := &Disk{dir: dir, maxSize: maxSize, blobs: make(map[string]*diskBlob)}
+
+	if err := os.RemoveAll(d.tmpDir()); err != nil {
+		return nil, err
+	}
+	for _, path := range []string{d.tmpDir(), filepath.Join(dir, "sha256")} {
+		if err := os.MkdirAll(path, 0o700); err != nil {
+			return nil, err
+		}
+	}
+
+	err := filepath.WalkDir(filepath.Join(dir, "sha256"), func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		digest := "sha256:" + entry.Name()
+		if !validDigest(digest) {
+			return nil
+		}
+		d.blobs[digest] = &diskBlob{size: info.Size(), lastUsed: info.ModTime()}
+		d.size += info.Size()
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to index blob cache %s: %v", dir, err)
+	}
+
+	d.mu.Lock()
+	d.evict("")
+	d.mu.Unlock()
+	return d, nil
+}
+
+// Open returns a stored blob and its size, recording the use
+func (d *Disk) Open(ctx context.Context, digest string) (io.ReadSeekCloser, int64, bool) {
+	if !validDigest(digest) {
+		return nil, 0, false
+	}
+
+	d.mu.Lock()
+	blob, ok := d.blobs[digest]
+	if ok {
+		blob.lastUsed = time.Now()
+	}
+	d.mu.Unlock()
+	if !ok {
+		return nil, 0, false
+	}
+
+	file, err := os.Open(d.path(digest))
+	if err != nil {
+		// Removed behind the cache's back
+		d.remove(digest)
+		return nil, 0, false
+	}
+	// The modification time keeps the last use across restarts
+	now := time.Now()
+	os.Chtimes(d.path(digest), now, now)
+	return file, blob.size, true
+}
+
+// Create starts storing a blob. size is the expected size, or -1 when unknown.
+func (d *Disk) Create(ctx context.Context, digest string, size int64) (Writer, error) {
+	blob, err := newPending(d.tmpDir(), digest, size, d.maxSize)
+	if err != nil {
+		return nil, err
+	}
+	return &diskWriter{pending: blob, disk: d}, nil
+}
+
+// Usage returns the number of stored blobs and their total size
+func (d *Disk) Usage() (int, int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.blobs), d.size
+}
+
+// add records a blob moved into place and evicts others to make room for it
+func (d *Disk) add(digest string, size int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if previous, ok := d.blobs[digest]; ok {
+		d.size -= previous.size
+	}
+	d.blobs[digest] = &diskBlob{size: size, lastUsed: time.Now()}
+	d.size += size
+	d.evict(digest)
+}
+
+// evict removes the least recently used blobs, except keep, until the store fits its maximum
+// size; the caller holds the lock
+func (d *Disk) evict(keep string) {
+	if d.size <= d.maxSize {
+		return
+	}
+
+	digests := make([]string, 0, len(d.blobs))
+	for digest := range d.blobs {
+		if digest != keep {
+			digests = append(digests, digest)
+		}
+	}
+	sort.Slice(digests, func(i, j int) bool { return d.blobs[digests[i]].lastUsed.Before(d.blobs[digests[j]].lastUsed) })
+
+	for _, digest := range digests {
+		if d.size <= d.maxSize {
+			break
+		}
+		if err := os.Remove(d.path(digest)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			slog.Warn("Failed to evict blob from the cache", "digest", digest, "error", err)
+			continue
+		}
+		d.size -= d.blobs[digest].size
+		delete(d.blobs, digest)
+	}
+}
+
+// remove forgets a blob
+func (d *Disk) remove(digest string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if blob, ok := d.blobs[digest]; ok {
+		d.size -= blob.size
+		delete(d.blobs, digest)
+	}
+}
+
+// path returns where a blob is stored
+func (d *Disk) path(digest string) string {
+	hex := strings.TrimPrefix(digest, "sha256:")
+	return filepath.Join(d.dir, "sha256", hex[:2], hex)
+}
+
+// tmpDir returns the directory of partial downloads
+func (d *Disk) tmpDir() string {
+	return filepath.Join(d.dir, "tmp")
+}
+
+// diskWriter moves a verified blob into the store
+type diskWriter struct {
+	*pending
+	disk *Disk
+}
+
+// Commit verifies the blob against its digest and moves it into the store
+func (w *diskWriter) Commit() error {
+	defer os.Remove(w.file.Name())
+	if err := w.verify(); err != nil {
+		return err
+	}
+
+	path := w.disk.path(w.digest)
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	if err := os.Rename(w.file.Name(), path); err != nil {
+		return err
+	}
+	w.disk.add(w.digest, w.size)
+	return nil
+}
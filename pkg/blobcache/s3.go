@@ -0,0 +1,280 @@
+package blobcache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"vault-docker-proxy/pkg/awsauth"
+)
+
+const (
+	// s3CredentialsMargin is how long before they expire temporary credentials are renewed
+	s3CredentialsMargin = 5 * time.Minute
+	// s3UploadTimeout bounds the upload of a verified blob to the bucket
+	s3UploadTimeout = 30 * time.Minute
+	// emptyPayloadHash is the SHA-256 of an empty body, the payload hash of GET and HEAD requests
+	emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// s3Client talks to the bucket; http.DefaultTransport honours the HTTPS_PROXY variables
+var s3Client = &http.Client{}
+
+// S3Config locates the bucket of an S3 store
+type S3Config struct {
+	Bucket    string
+	Prefix    string // prepended to the object keys, e.g. "registry-cache/"
+	Region    string
+	Endpoint  string // S3-compatible endpoint such as MinIO, the AWS endpoint of Region when empty
+	PathStyle bool   // address the bucket in the path rather than the host name
+	SSE       string // server-side encryption: AES256 or aws:kms
+	KMSKeyID  string // key of aws:kms encryption, the bucket's default when empty
+}
+
+// S3 is a blob store in an S3 or S3-compatible bucket, shared by every proxy replica. Blobs are
+// stored as <prefix>sha256/<hex>. Downloads are written to a local temporary directory and
+// uploaded once their digest is verified, signed with the digest as payload hash. The store
+// does not limit its size; a lifecycle rule on the bucket expires old blobs. Requests are signed
+// with the proxy's own AWS credentials (environment variables, web identity, container or
+// instance credentials).
+type S3 struct {
+	config S3Config
+	base   *url.URL
+	tmpDir string
+
+	mu          sync.Mutex
+	credentials *awsauth.Credentials
+}
+
+// NewS3 creates an S3 store. Partial downloads are kept in tmpDir, the system's temporary
+// directory when empty.
+func NewS3(config S3Config, tmpDir string) (*S3, error) {
+	if tmpDir == "" {
+		tmpDir = os.TempDir()
+	}
+	if err := os.MkdirAll(tmpDir, 0o700); err != nil {
+		return nil, err
+	}
+
+	endpoint := config.Endpoint
+	if endpoint == "" {
+		domain := "amazonaws.com"
+		if strings.HasPrefix(config.Region, "cn-") {
+			domain = "amazonaws.com.cn"
+		}
+		endpoint = "https://s3." + config.Region + "." + domain
+	}
+	base, err := url.Parse(strings.TrimSuffix(endpoint, "/"))
+	if err != nil || base.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", endpoint)
+	}
+	if config.PathStyle {
+		base.Path += "/" + config.Bucket
+	} else {
+		base.Host = config.Bucket + "." + base.Host
+	}
+	return &S3{config: config, base: base, tmpDir: tmpDir}, nil
+}
+
+// Location describes the bucket, for logging
+func (s *S3) Location() string {
+	return s.base.String() + "/" + s.config.Prefix
+}
+
+// Open returns a stored blob and its size. The blob is read with ranged GET requests as the
+// reader is positioned, so serving part of a blob only downloads that part.
+func (s *S3) Open(ctx context.Context, digest string) (io.ReadSeekCloser, int64, bool) {
+	if !validDigest(digest) {
+		return nil, 0, false
+	}
+	resp, err := s.do(ctx, http.MethodHead, digest, nil, -1, nil)
+	if err != nil {
+		slog.Warn("Blob cache bucket unavailable", "error", err)
+		return nil, 0, false
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		if resp.StatusCode != http.StatusNotFound {
+			slog.Warn("Blob cache bucket returned an error", "status", resp.StatusCode, "digest", digest)
+		}
+		return nil, 0, false
+	}
+	return &s3Object{store: s, ctx: ctx, digest: digest, size: resp.ContentLength}, resp.ContentLength, true
+}
+
+// Create starts storing a blob. size is the expected size, or -1 when unknown.
+func (s *S3) Create(ctx context.Context, digest string, size int64) (Writer, error) {
+	blob, err := newPending(s.tmpDir, digest, size, math.MaxInt64)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Writer{pending: blob, store: s}, nil
+}
+
+// do sends a signed request for the object of a blob
+func (s *S3) do(ctx context.Context, method, digest string, header http.Header, size int64, body io.Reader) (*http.Response, error) {
+	credentials, err := s.awsCredentials(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	target := *s.base
+	target.Path += "/" + s.config.Prefix + "sha256/" + strings.TrimPrefix(digest, "sha256:")
+	req, err := http.NewRequestWithContext(ctx, method, target.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if req.Header.Get("X-Amz-Content-Sha256") == "" {
+		req.Header.Set("X-Amz-Content-Sha256", emptyPayloadHash)
+	}
+	awsauth.Sign(req, nil, credentials, s.config.Region, "s3", time.Now())
+	return s3Client.Do(req)
+}
+
+// awsCredentials returns the proxy's AWS credentials, renewing temporary ones before they expire
+func (s *S3) awsCredentials(ctx context.Context) (*awsauth.Credentials, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.credentials != nil && (s.credentials.Expiration.IsZero() || time.Until(s.credentials.Expiration) > s3CredentialsMargin) {
+		return s.credentials, nil
+	}
+	credentials, err := awsauth.DefaultCredentials(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.credentials = credentials
+	return credentials, nil
+}
+
+// s3Writer uploads a verified blob to the bucket
+type s3Writer struct {
+	*pending
+	store *S3
+}
+
+// Commit verifies the blob against its digest and uploads it in the background, so the request
+// that downloaded it does not wait for the bucket
+func (w *s3Writer) Commit() error {
+	if err := w.verify(); err != nil {
+		os.Remove(w.file.Name())
+		return err
+	}
+	go func() {
+		defer os.Remove(w.file.Name())
+		if err := w.upload(); err != nil {
+			slog.Error("Failed to upload blob to the cache bucket", "digest", w.digest, "error", err)
+		}
+	}()
+	return nil
+}
+
+// upload puts the verified temporary file in the bucket
+func (w *s3Writer) upload() error {
+	ctx, cancel := context.WithTimeout(context.Background(), s3UploadTimeout)
+	defer cancel()
+
+	file, err := os.Open(w.file.Name())
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	header := http.Header{}
+	header.Set("Content-Type", "application/octet-stream")
+	// The digest is the SHA-256 of the content, so the payload is signed without reading it twice
+	header.Set("X-Amz-Content-Sha256", strings.TrimPrefix(w.digest, "sha256:"))
+	if sse := w.store.config.SSE; sse != "" {
+		header.Set("X-Amz-Server-Side-Encryption", sse)
+		if sse == "aws:kms" && w.store.config.KMSKeyID != "" {
+			header.Set("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id", w.store.config.KMSKeyID)
+		}
+	}
+
+	resp, err := w.store.do(ctx, http.MethodPut, w.digest, header, w.size, file)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("HTTP %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// s3Object reads a stored blob with ranged GET requests
+type s3Object struct {
+	store  *S3
+	ctx    context.Context
+	digest string
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+var errSeekOutOfRange = errors.New("seek out of range")
+
+func (o *s3Object) Read(p []byte) (int, error) {
+	if o.offset >= o.size {
+		return 0, io.EOF
+	}
+	if o.body == nil {
+		header := http.Header{}
+		if o.offset > 0 {
+			header.Set("Range", "bytes="+strconv.FormatInt(o.offset, 10)+"-")
+		}
+		resp, err := o.store.do(o.ctx, http.MethodGet, o.digest, header, -1, nil)
+		if err != nil {
+			return 0, err
+		}
+		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+			resp.Body.Close()
+			return 0, fmt.Errorf("blob cache bucket returned HTTP %d for %s", resp.StatusCode, o.digest)
+		}
+		o.body = resp.Body
+	}
+	n, err := o.body.Read(p)
+	o.offset += int64(n)
+	return n, err
+}
+
+func (o *s3Object) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += o.offset
+	case io.SeekEnd:
+		offset += o.size
+	}
+	if offset < 0 || offset > o.size {
+		return o.offset, errSeekOutOfRange
+	}
+	if offset != o.offset && o.body != nil {
+		o.body.Close()
+		o.body = nil
+	}
+	o.offset = offset
+	return offset, nil
+}
+
+func (o *s3Object) Close() error {
+	if o.body != nil {
+		return o.body.Close()
+	}
+	return nil
+}
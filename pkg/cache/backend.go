@@ -0,0 +1,175 @@
+package cache
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"vault-docker-proxy/pkg/auth"
+)
+
+// backendTimeout bounds the backend calls of a cache operation
+const backendTimeout = 5 * time.Second
+
+var (
+	ErrUnsealable = errors.New("cache entry cannot be decrypted")
+)
+
+// CacheBackend stores credential cache entries: in memory, or outside the process, such as in
+// Redis, so proxy replicas share them. Values are sealed by the credential cache before they
+// reach the backend, and keys are hex hashes that start with a hash of the Vault path, so
+// DeletePrefix purges a path. Implementations must be safe for concurrent use.
+type CacheBackend interface {
+	// Get returns the value stored for key; found is false when there is none
+	Get(ctx context.Context, key string) (value []byte, found bool, err error)
+	// Set stores a value for ttl, or without expiry when ttl is negative
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	// Delete removes keys, returning how many were stored
+	Delete(ctx context.Context, keys ...string) (int, error)
+	// DeletePrefix removes every key starting with prefix, returning how many were stored
+	DeletePrefix(ctx context.Context, prefix string) (int, error)
+	// Stats returns the backend's counters
+	Stats() BackendStats
+}
+
+// LocalBackend is a CacheBackend kept by the process, which the credential cache reads first and
+// which holds every entry, including credentials with a Vault lease: those are never shared, as
+// the process that read them revokes the lease once they leave its cache. The credential cache
+// lists local entries and is told about the ones leaving, so it can revoke their leases.
+type LocalBackend interface {
+	CacheBackend
+	// Entries lists the unexpired entries
+	Entries() []BackendEntry
+	// Len returns the number of entries, including expired entries not removed yet
+	Len() int
+	// OnEvicted sets a function called with the entries that are deleted or expire, but not
+	// with those replaced by Set. It must not call the backend.
+	OnEvicted(f func(key string, value []byte))
+}
+
+// BackendEntry is an entry listed by a LocalBackend; ExpiresAt is zero for no expiry
+type BackendEntry struct {
+	Key       string
+	Value     []byte
+	ExpiresAt time.Time
+}
+
+// BackendStats counts the operations of a cache backend
+type BackendStats struct {
+	Backend string `json:"backend"`
+	Hits    uint64 `json:"hits"`
+	Misses  uint64 `json:"misses"`
+	Sets    uint64 `json:"sets"`
+	Deletes uint64 `json:"deletes"`
+	Errors  uint64 `json:"errors"`
+}
+
+// backendCounters holds the live counters behind BackendStats, for backend implementations
+type backendCounters struct {
+	hits    atomic.Uint64
+	misses  atomic.Uint64
+	sets    atomic.Uint64
+	deletes atomic.Uint64
+	errors  atomic.Uint64
+}
+
+// snapshot returns the counters as BackendStats of the named backend
+func (c *backendCounters) snapshot(backend string) BackendStats {
+	return BackendStats{
+		Backend: backend,
+		Hits:    c.hits.Load(),
+		Misses:  c.misses.Load(),
+		Sets:    c.sets.Load(),
+		Deletes: c.deletes.Load(),
+		Errors:  c.errors.Load(),
+	}
+}
+
+// backendKey returns the backend key of a token and path, grouped by path so a path can be purged
+func backendKey(vaultToken, vaultPath string) string {
+	return backendPathPrefix(vaultPath) + hashHex(vaultToken+":"+vaultPath)
+}
+
+// backendPathPrefix returns the prefix of the backend keys of a Vault path, or of every key
+// when vaultPath is empty
+func backendPathPrefix(vaultPath string) string {
+	if vaultPath == "" {
+		return "creds:"
+	}
+	return "creds:" + hashHex(vaultPath) + ":"
+}
+
+// sealCredentials encrypts credentials for a backend with AES-GCM under a key derived from the
+// Vault token and path, so reading them back takes the token they were cached for. The entry's
+// expiry travels with it; a negative ttl never expires.
+func sealCredentials(vaultToken, vaultPath, key string, credentials *auth.Credentials, ttl time.Duration) ([]byte, error) {
+	encoded, err := credentials.MarshalSecret()
+	if err != nil {
+		return nil, err
+	}
+	defer clear(encoded)
+
+	plain := make([]byte, 8, 8+len(encoded))
+	if ttl > 0 {
+		binary.BigEndian.PutUint64(plain, uint64(time.Now().Add(ttl).UnixNano()))
+	}
+	plain = append(plain, encoded...)
+	defer clear(plain)
+
+	aead := sealingAEAD(vaultToken, vaultPath)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plain, []byte(key)), nil
+}
+
+// openCredentials decrypts credentials sealed by sealCredentials and returns how long they
+// remain cached, negative for no expiry; expired entries are not found
+func openCredentials(vaultToken, vaultPath, key string, sealed []byte) (*auth.Credentials, time.Duration, bool, error) {
+	aead := sealingAEAD(vaultToken, vaultPath)
+	if len(sealed) < aead.NonceSize() {
+		return nil, 0, false, ErrUnsealable
+	}
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(key))
+	if err != nil || len(plain) < 8 {
+		return nil, 0, false, ErrUnsealable
+	}
+	defer clear(plain)
+
+	ttl := time.Duration(-1)
+	if cachedUntil := int64(binary.BigEndian.Uint64(plain)); cachedUntil != 0 {
+		if ttl = time.Until(time.Unix(0, cachedUntil)); ttl <= 0 {
+			return nil, 0, false, nil
+		}
+	}
+	credentials, err := auth.UnmarshalSecretCredentials(plain[8:])
+	if err != nil {
+		return nil, 0, false, ErrUnsealable
+	}
+	return credentials, ttl, true, nil
+}
+
+// sealingAEAD returns the cipher of the entry of a token and path. Its key is an HMAC of the
+// token and path, unrelated to the hash in the entry's key.
+func sealingAEAD(vaultToken, vaultPath string) cipher.AEAD {
+	mac := hmac.New(sha256.New, []byte("vault-docker-proxy credential cache"))
+	mac.Write([]byte(vaultToken + ":" + vaultPath))
+	block, _ := aes.NewCipher(mac.Sum(nil))
+	aead, _ := cipher.NewGCM(block)
+	return aead
+}
+
+// hashHex returns the hex SHA-256 of s
+func hashHex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
@@ -1,89 +1,469 @@
 package cache
 
 import (
-	"crypto/sha256"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
 	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/patrickmn/go-cache"
-
 	"vault-docker-proxy/pkg/auth"
 )
 
 const (
-	DefaultCacheTTL     = 5 * time.Minute
+	DefaultCacheTTL        = 5 * time.Minute
 	DefaultCleanupInterval = 10 * time.Minute
 )
 
-// CredentialCache provides caching for registry credentials
+// localEntry describes the credentials of a local backend entry besides their secret: the Vault
+// path they were read from and their lease, which stay in the clear as they are no secret
+type localEntry struct {
+	VaultPath string      `json:"vault_path"`
+	Lease     *auth.Lease `json:"lease,omitempty"`
+	Shared    bool        `json:"shared,omitempty"` // also stored in the shared backend
+}
+
+// Entry describes a cached credential without exposing the secret or the Vault token
+type Entry struct {
+	VaultPath string    `json:"vault_path"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// CredentialCache provides caching for registry credentials, kept in a local backend and
+// optionally shared with other replicas through a second backend. Credentials in the local
+// backend are encrypted with AES-GCM under a random key of the cache, so passwords are not kept
+// in the clear in memory; callers get decrypted copies they wipe themselves, and the copies
+// passed to the eviction function are wiped once it returns.
 type CredentialCache struct {
-	cache *cache.Cache
+	local  LocalBackend
+	shared CacheBackend // nil when credentials are not shared
+	ttl    time.Duration
+	aead   cipher.AEAD
+	mu     sync.Mutex // serializes replacements so replaced credentials are always evicted
+
+	onEvicted atomic.Pointer[func(*auth.Credentials)]
+
+	hits      atomic.Uint64
+	misses    atomic.Uint64
+	sets      atomic.Uint64
+	evictions atomic.Uint64
+}
+
+// Stats counts the operations of a credential cache
+type Stats struct {
+	Entries   int    `json:"entries"` // including expired entries not cleaned up yet
+	Hits      uint64 `json:"hits"`    // lookups served from memory or the backend
+	Misses    uint64 `json:"misses"`
+	Sets      uint64 `json:"sets"`
+	Evictions uint64 `json:"evictions"` // credentials that expired or were replaced, deleted or cleared
 }
 
 // NewCredentialCache creates a new credential cache with default TTL
 func NewCredentialCache() *CredentialCache {
-	return &CredentialCache{
-		cache: cache.New(DefaultCacheTTL, DefaultCleanupInterval),
-	}
+	return NewCredentialCacheWithTTL(DefaultCacheTTL, DefaultCleanupInterval)
 }
 
-// NewCredentialCacheWithTTL creates a new credential cache with custom TTL
+// NewCredentialCacheWithTTL creates a new credential cache in memory with custom TTL. A zero TTL
+// disables the cache: lookups always miss and nothing is stored.
 func NewCredentialCacheWithTTL(ttl, cleanupInterval time.Duration) *CredentialCache {
-	return &CredentialCache{
-		cache: cache.New(ttl, cleanupInterval),
+	return NewCredentialCacheWithBackends(NewMemoryBackend(cleanupInterval), nil, ttl)
+}
+
+// NewCredentialCacheWithBackend creates a credential cache that also stores credentials in a
+// backend, such as Redis to share them between proxy replicas. Credentials are kept in memory as
+// well and read from the backend on a local miss; credentials holding a Vault lease stay local,
+// as the process that read them revokes the lease when they leave its cache.
+func NewCredentialCacheWithBackend(backend CacheBackend, ttl, cleanupInterval time.Duration) *CredentialCache {
+	return NewCredentialCacheWithBackends(NewMemoryBackend(cleanupInterval), backend, ttl)
+}
+
+// NewCredentialCacheWithBackends creates a credential cache keeping credentials in the local
+// backend, and sharing those without a Vault lease through the shared backend unless it is nil
+func NewCredentialCacheWithBackends(local LocalBackend, shared CacheBackend, ttl time.Duration) *CredentialCache {
+	credentialCache := &CredentialCache{
+		local:  local,
+		shared: shared,
+		ttl:    ttl,
+		aead:   newMemoryAEAD(),
+	}
+	local.OnEvicted(credentialCache.evictedItem)
+	return credentialCache
+}
+
+// newMemoryAEAD returns the cipher of the entries of the local backend, under a random key that
+// never leaves the process
+func newMemoryAEAD() cipher.AEAD {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(fmt.Sprintf("failed to generate the credential cache key: %v", err))
 	}
+	block, _ := aes.NewCipher(key)
+	clear(key)
+	aead, _ := cipher.NewGCM(block)
+	return aead
 }
 
-// generateCacheKey creates a unique cache key from vault token and path
-func (c *CredentialCache) generateCacheKey(vaultToken, vaultPath string) string {
-	// Hash the token and path for security and consistency
-	h := sha256.New()
-	h.Write([]byte(vaultToken + ":" + vaultPath))
-	return fmt.Sprintf("creds:%x", h.Sum(nil))
+// seal encrypts credentials into a local backend value stored under key: the length of the
+// encoded entry, the entry and the sealed secret. The key and entry are authenticated with the
+// secret, so a value cannot be moved to another key or path.
+func (c *CredentialCache) seal(key string, entry localEntry, credentials *auth.Credentials) ([]byte, error) {
+	header, err := json.Marshal(entry)
+	if err != nil {
+		return nil, err
+	}
+	encoded, err := credentials.MarshalSecret()
+	if err != nil {
+		return nil, err
+	}
+	defer clear(encoded)
+
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	value := binary.BigEndian.AppendUint32(nil, uint32(len(header)))
+	value = append(value, header...)
+	value = append(value, nonce...)
+	return c.aead.Seal(value, nonce, encoded, append([]byte(key), header...)), nil
+}
+
+// decodeEntry returns the entry of a local backend value, with its encoded form and the sealed
+// secret
+func decodeEntry(value []byte) (localEntry, []byte, []byte, error) {
+	var entry localEntry
+	if len(value) < 4 || uint64(len(value)-4) < uint64(binary.BigEndian.Uint32(value)) {
+		return entry, nil, nil, ErrUnsealable
+	}
+	header := value[4 : 4+binary.BigEndian.Uint32(value)]
+	if err := json.Unmarshal(header, &entry); err != nil {
+		return entry, nil, nil, ErrUnsealable
+	}
+	return entry, header, value[4+len(header):], nil
+}
+
+// open decrypts the credentials of a local backend value stored under key
+func (c *CredentialCache) open(key string, value []byte) (*auth.Credentials, localEntry, error) {
+	entry, header, sealed, err := decodeEntry(value)
+	if err != nil {
+		return nil, entry, err
+	}
+	nonceSize := c.aead.NonceSize()
+	if len(sealed) < nonceSize {
+		return nil, entry, ErrUnsealable
+	}
+	encoded, err := c.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], append([]byte(key), header...))
+	if err != nil {
+		return nil, entry, ErrUnsealable
+	}
+	defer clear(encoded)
+	credentials, err := auth.UnmarshalSecretCredentials(encoded)
+	if err != nil {
+		return nil, entry, ErrUnsealable
+	}
+	credentials.Lease = entry.Lease
+	return credentials, entry, nil
+}
+
+// OnEvicted sets a function called with credentials leaving the cache, because they expired or
+// were replaced, deleted or cleared, before they are wiped. It must not call the cache.
+func (c *CredentialCache) OnEvicted(f func(credentials *auth.Credentials)) {
+	c.onEvicted.Store(&f)
+}
+
+// evictedItem runs the eviction function on the decrypted credentials of an entry leaving the
+// local backend and wipes them
+func (c *CredentialCache) evictedItem(key string, value []byte) {
+	c.evictions.Add(1)
+	f := c.onEvicted.Load()
+	if f == nil {
+		return
+	}
+	credentials, entry, err := c.open(key, value)
+	if err != nil {
+		slog.Error("Failed to decrypt evicted credentials", "vault_path", entry.VaultPath, "error", err)
+		return
+	}
+	(*f)(credentials)
+	credentials.Wipe()
+}
+
+// TTL returns the default lifetime of cached credentials
+func (c *CredentialCache) TTL() time.Duration {
+	return c.ttl
+}
+
+// Enabled reports whether the cache stores credentials, which it does unless its TTL is zero
+func (c *CredentialCache) Enabled() bool {
+	return c.ttl != 0
 }
 
 // Get retrieves cached credentials if available
 func (c *CredentialCache) Get(vaultToken, vaultPath string) (*auth.Credentials, bool) {
-	key := c.generateCacheKey(vaultToken, vaultPath)
-	
-	if item, found := c.cache.Get(key); found {
-		if creds, ok := item.(*auth.Credentials); ok {
-			return creds, true
+	if !c.Enabled() {
+		c.misses.Add(1)
+		return nil, false
+	}
+	key := backendKey(vaultToken, vaultPath)
+
+	ctx, cancel := context.WithTimeout(context.Background(), backendTimeout)
+	defer cancel()
+	value, found, err := c.local.Get(ctx, key)
+	if err != nil {
+		slog.Warn("Failed to read from the credential cache", "error", err)
+	}
+	if found {
+		if credentials, _, err := c.open(key, value); err == nil {
+			c.hits.Add(1)
+			return credentials, true
 		}
 	}
-	
+
+	if c.shared != nil {
+		if credentials, ttl, found := c.sharedGet(vaultToken, vaultPath); found {
+			if value, err := c.seal(key, localEntry{VaultPath: vaultPath, Shared: true}, credentials); err == nil {
+				c.mu.Lock()
+				c.localSet(key, value, ttl)
+				c.mu.Unlock()
+			}
+			c.hits.Add(1)
+			return credentials, true
+		}
+	}
+
+	c.misses.Add(1)
 	return nil, false
 }
 
-// Set stores credentials in cache with default TTL
+// Set stores a copy of the credentials in cache with default TTL
 func (c *CredentialCache) Set(vaultToken, vaultPath string, credentials *auth.Credentials) {
-	key := c.generateCacheKey(vaultToken, vaultPath)
-	c.cache.Set(key, credentials, cache.DefaultExpiration)
+	c.SetWithTTL(vaultToken, vaultPath, credentials, 0)
 }
 
-// SetWithTTL stores credentials in cache with custom TTL
+// SetWithTTL stores a copy of the credentials in cache with custom TTL, the default TTL when
+// ttl is zero; a negative ttl never expires
 func (c *CredentialCache) SetWithTTL(vaultToken, vaultPath string, credentials *auth.Credentials, ttl time.Duration) {
-	key := c.generateCacheKey(vaultToken, vaultPath)
-	c.cache.Set(key, credentials, ttl)
+	if !c.Enabled() {
+		return
+	}
+	if ttl == 0 {
+		ttl = c.ttl
+	}
+	key := backendKey(vaultToken, vaultPath)
+
+	entry := localEntry{VaultPath: vaultPath, Lease: credentials.Lease, Shared: c.shared != nil && credentials.Lease == nil}
+	value, err := c.seal(key, entry, credentials)
+	if err != nil {
+		slog.Error("Failed to encrypt credentials, not caching them", "vault_path", vaultPath, "error", err)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.localSet(key, value, ttl)
+	c.sets.Add(1)
+	if entry.Shared {
+		c.sharedSet(vaultToken, vaultPath, credentials, ttl)
+	}
+}
+
+// localSet stores a value in the local backend, deleting the one it replaces first so the
+// eviction function runs on the credentials being replaced. The caller holds c.mu.
+func (c *CredentialCache) localSet(key string, value []byte, ttl time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), backendTimeout)
+	defer cancel()
+	_, err := c.local.Delete(ctx, key)
+	if err == nil {
+		err = c.local.Set(ctx, key, value, ttl)
+	}
+	if err != nil {
+		slog.Warn("Failed to write to the credential cache", "error", err)
+	}
+}
+
+// Update replaces cached credentials with a copy of credentials without evicting them, for
+// credentials whose lease was renewed. It returns false when nothing is cached for the token and
+// path anymore.
+func (c *CredentialCache) Update(vaultToken, vaultPath string, credentials *auth.Credentials, ttl time.Duration) bool {
+	if ttl == 0 {
+		ttl = c.ttl
+	}
+	key := backendKey(vaultToken, vaultPath)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), backendTimeout)
+	defer cancel()
+	current, found, err := c.local.Get(ctx, key)
+	if err != nil || !found {
+		return false
+	}
+	entry, _, _, err := decodeEntry(current)
+	if err != nil {
+		return false
+	}
+	entry.Lease = credentials.Lease
+	value, err := c.seal(key, entry, credentials)
+	if err != nil {
+		slog.Error("Failed to encrypt credentials", "vault_path", vaultPath, "error", err)
+		return false
+	}
+	if err := c.local.Set(ctx, key, value, ttl); err != nil {
+		slog.Warn("Failed to write to the credential cache", "error", err)
+		return false
+	}
+	c.sets.Add(1)
+	return true
 }
 
 // Delete removes credentials from cache
 func (c *CredentialCache) Delete(vaultToken, vaultPath string) {
-	key := c.generateCacheKey(vaultToken, vaultPath)
-	c.cache.Delete(key)
+	ctx, cancel := context.WithTimeout(context.Background(), backendTimeout)
+	defer cancel()
+	key := backendKey(vaultToken, vaultPath)
+	if _, err := c.local.Delete(ctx, key); err != nil {
+		slog.Warn("Failed to delete from the credential cache", "error", err)
+	}
+	if c.shared != nil {
+		if _, err := c.shared.Delete(ctx, key); err != nil {
+			slog.Warn("Failed to delete from the credential cache backend", "error", err)
+		}
+	}
 }
 
 // Clear removes all cached credentials
 func (c *CredentialCache) Clear() {
-	c.cache.Flush()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), backendTimeout)
+	defer cancel()
+	// Deleting runs the eviction callback
+	if _, err := c.local.DeletePrefix(ctx, backendPathPrefix("")); err != nil {
+		slog.Warn("Failed to clear the credential cache", "error", err)
+	}
+	if c.shared != nil {
+		c.sharedDeletePath("")
+	}
 }
 
-// Stats returns cache statistics
-func (c *CredentialCache) Stats() (itemCount int, evictedCount int64, hitCount uint64, missCount uint64) {
-	itemCount = c.cache.ItemCount()
-	// Note: go-cache doesn't provide hit/miss/eviction stats by default
-	// These would need to be tracked separately if detailed metrics are needed
-	return itemCount, 0, 0, 0
+// DeletePath removes the credentials cached for a Vault path under every Vault token,
+// returning how many entries were removed
+func (c *CredentialCache) DeletePath(vaultPath string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), backendTimeout)
+	defer cancel()
+	removed := 0
+	for _, backendEntry := range c.local.Entries() {
+		entry, _, _, err := decodeEntry(backendEntry.Value)
+		if err != nil || entry.VaultPath != vaultPath {
+			continue
+		}
+		// Deleting runs the eviction callback
+		n, err := c.local.Delete(ctx, backendEntry.Key)
+		if err != nil {
+			slog.Warn("Failed to delete from the credential cache", "error", err)
+		}
+		// Shared entries are counted in the backend, which also holds those of other replicas
+		if !entry.Shared {
+			removed += n
+		}
+	}
+	if c.shared != nil {
+		removed += c.sharedDeletePath(vaultPath)
+	}
+	return removed
+}
+
+// sharedGet reads credentials from the shared backend, with how long they remain cached. Backend
+// failures are logged and make the lookup miss.
+func (c *CredentialCache) sharedGet(vaultToken, vaultPath string) (*auth.Credentials, time.Duration, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), backendTimeout)
+	defer cancel()
+	key := backendKey(vaultToken, vaultPath)
+	sealed, found, err := c.shared.Get(ctx, key)
+	if err != nil {
+		slog.Warn("Failed to read from the credential cache backend", "error", err)
+		return nil, 0, false
+	}
+	if !found {
+		return nil, 0, false
+	}
+	credentials, ttl, found, err := openCredentials(vaultToken, vaultPath, key, sealed)
+	if err != nil {
+		slog.Warn("Ignoring credentials in the cache backend", "vault_path", vaultPath, "error", err)
+	}
+	return credentials, ttl, found
+}
+
+// sharedSet stores credentials in the shared backend; a negative ttl never expires
+func (c *CredentialCache) sharedSet(vaultToken, vaultPath string, credentials *auth.Credentials, ttl time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), backendTimeout)
+	defer cancel()
+	key := backendKey(vaultToken, vaultPath)
+	sealed, err := sealCredentials(vaultToken, vaultPath, key, credentials, ttl)
+	if err == nil {
+		err = c.shared.Set(ctx, key, sealed, ttl)
+	}
+	if err != nil {
+		slog.Warn("Failed to write to the credential cache backend", "error", err)
+	}
+}
+
+// sharedDeletePath removes the credentials of a Vault path, or all of them when vaultPath is
+// empty, from the shared backend and returns how many were removed
+func (c *CredentialCache) sharedDeletePath(vaultPath string) int {
+	ctx, cancel := context.WithTimeout(context.Background(), backendTimeout)
+	defer cancel()
+	removed, err := c.shared.DeletePrefix(ctx, backendPathPrefix(vaultPath))
+	if err != nil {
+		slog.Warn("Failed to delete from the credential cache backend", "error", err)
+	}
+	return removed
+}
+
+// BackendStats returns the counters of the shared cache backend, if there is one
+func (c *CredentialCache) BackendStats() (BackendStats, bool) {
+	if c.shared == nil {
+		return BackendStats{}, false
+	}
+	return c.shared.Stats(), true
+}
+
+// Entries lists the unexpired cache entries, sorted by Vault path
+func (c *CredentialCache) Entries() []Entry {
+	entries := []Entry{}
+	for _, backendEntry := range c.local.Entries() {
+		entry, _, _, err := decodeEntry(backendEntry.Value)
+		if err != nil {
+			continue
+		}
+		entries = append(entries, Entry{VaultPath: entry.VaultPath, ExpiresAt: backendEntry.ExpiresAt})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].VaultPath != entries[j].VaultPath {
+			return entries[i].VaultPath < entries[j].VaultPath
+		}
+		return entries[i].ExpiresAt.Before(entries[j].ExpiresAt)
+	})
+	return entries
+}
+
+// Stats returns the number of entries and the counters of the cache since it was created
+func (c *CredentialCache) Stats() Stats {
+	return Stats{
+		Entries:   c.local.Len(),
+		Hits:      c.hits.Load(),
+		Misses:    c.misses.Load(),
+		Sets:      c.sets.Load(),
+		Evictions: c.evictions.Load(),
+	}
 }
 
 // CachedCredentialGetter interface for objects that can retrieve and cache credentials
@@ -122,4 +502,4 @@ func (w *CacheWrapper) GetCredentials(vaultToken, vaultPath string) (*auth.Crede
 	w.cache.Set(vaultToken, vaultPath, creds)
 
 	return creds, nil
-}
\ No newline at end of file
+}
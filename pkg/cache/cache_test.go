@@ -0,0 +1,180 @@
+package cache
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"vault-docker-proxy/pkg/auth"
+)
+
+// mapBackend is a CacheBackend in a map, standing in for a shared backend such as Redis
+type mapBackend struct {
+	mu     sync.Mutex
+	values map[string][]byte
+	stats  backendCounters
+}
+
+func newMapBackend() *mapBackend {
+	return &mapBackend{values: map[string][]byte{}}
+}
+
+func (b *mapBackend) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	value, found := b.values[key]
+	return value, found, nil
+}
+
+func (b *mapBackend) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.values[key] = value
+	return nil
+}
+
+func (b *mapBackend) Delete(ctx context.Context, keys ...string) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	removed := 0
+	for _, key := range keys {
+		if _, found := b.values[key]; found {
+			delete(b.values, key)
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+func (b *mapBackend) DeletePrefix(ctx context.Context, prefix string) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	removed := 0
+	for key := range b.values {
+		if strings.HasPrefix(key, prefix) {
+			delete(b.values, key)
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+func (b *mapBackend) Stats() BackendStats {
+	return b.stats.snapshot("map")
+}
+
+func (b *mapBackend) len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.values)
+}
+
+func testCredentials(password string) *auth.Credentials {
+	return auth.NewCredentials("user", []byte(password), "")
+}
+
+// password returns the password of credentials, as sent to registries
+func password(credentials *auth.Credentials) string {
+	r, _ := http.NewRequest(http.MethodGet, "https://registry.test/v2/", nil)
+	credentials.SetBasicAuth(r)
+	_, password, _ := r.BasicAuth()
+	return password
+}
+
+func TestCredentialCacheEvictions(t *testing.T) {
+	c := NewCredentialCacheWithBackends(NewMemoryBackend(time.Minute), nil, time.Minute)
+	var evicted []string
+	c.OnEvicted(func(credentials *auth.Credentials) {
+		evicted = append(evicted, credentials.Username+":"+password(credentials))
+	})
+
+	c.Set("token", "secret/a", testCredentials("first"))
+	c.Set("token", "secret/a", testCredentials("second"))
+	c.Set("other", "secret/a", testCredentials("third"))
+	c.Set("token", "secret/b", testCredentials("fourth"))
+
+	credentials, found := c.Get("token", "secret/a")
+	if !found || password(credentials) != "second" {
+		t.Fatalf("Get = %v, %v, want the replacing credentials", credentials, found)
+	}
+	credentials.Wipe()
+	if len(evicted) != 1 || evicted[0] != "user:first" {
+		t.Fatalf("evicted %v, want the replaced credentials", evicted)
+	}
+
+	if entries := c.Entries(); len(entries) != 3 || entries[0].VaultPath != "secret/a" || entries[2].VaultPath != "secret/b" {
+		t.Fatalf("Entries = %v", entries)
+	}
+	if removed := c.DeletePath("secret/a"); removed != 2 {
+		t.Errorf("DeletePath removed %d entries, want 2", removed)
+	}
+	if _, found := c.Get("other", "secret/a"); found {
+		t.Error("credentials of a deleted path still cached")
+	}
+	c.Clear()
+	if stats := c.Stats(); stats.Entries != 0 || stats.Evictions != 4 {
+		t.Errorf("Stats = %+v, want no entries and 4 evictions", stats)
+	}
+}
+
+func TestCredentialCacheUpdate(t *testing.T) {
+	c := NewCredentialCache()
+	evictions := 0
+	c.OnEvicted(func(*auth.Credentials) { evictions++ })
+
+	if c.Update("token", "secret/a", testCredentials("renewed"), time.Minute) {
+		t.Fatal("Update stored credentials that were not cached")
+	}
+	leased := testCredentials("leased")
+	leased.Lease = &auth.Lease{ID: "lease/1"}
+	c.Set("token", "secret/a", leased)
+	renewed := testCredentials("renewed")
+	renewed.Lease = &auth.Lease{ID: "lease/2"}
+	if !c.Update("token", "secret/a", renewed, time.Minute) {
+		t.Fatal("Update did not replace cached credentials")
+	}
+
+	credentials, found := c.Get("token", "secret/a")
+	if !found || password(credentials) != "renewed" || credentials.Lease == nil || credentials.Lease.ID != "lease/2" {
+		t.Fatalf("Get = %v, %v, want the renewed credentials", credentials, found)
+	}
+	if evictions != 0 {
+		t.Errorf("Update evicted %d credentials", evictions)
+	}
+}
+
+func TestCredentialCacheSharedBackend(t *testing.T) {
+	shared := newMapBackend()
+	first := NewCredentialCacheWithBackend(shared, time.Minute, time.Minute)
+	second := NewCredentialCacheWithBackend(shared, time.Minute, time.Minute)
+
+	first.Set("token", "secret/a", testCredentials("shared"))
+	leased := testCredentials("leased")
+	leased.Lease = &auth.Lease{ID: "lease/1"}
+	first.Set("token", "secret/b", leased)
+	if n := shared.len(); n != 1 {
+		t.Fatalf("shared backend holds %d entries, want 1: leased credentials stay local", n)
+	}
+
+	credentials, found := second.Get("token", "secret/a")
+	if !found || password(credentials) != "shared" {
+		t.Fatalf("Get from another replica = %v, %v", credentials, found)
+	}
+	if _, found := second.Get("other-token", "secret/a"); found {
+		t.Error("shared credentials found under another Vault token")
+	}
+	if _, found := second.Get("token", "secret/b"); found {
+		t.Error("leased credentials found on another replica")
+	}
+
+	// Shared entries are counted once, in the shared backend
+	if removed := second.DeletePath("secret/a"); removed != 1 {
+		t.Errorf("DeletePath removed %d entries, want 1", removed)
+	}
+	if n := shared.len(); n != 0 {
+		t.Errorf("shared backend holds %d entries after DeletePath", n)
+	}
+}
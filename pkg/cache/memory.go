@@ -0,0 +1,105 @@
+package cache
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+// memoryBackend is the LocalBackend keeping entries in the process, in a go-cache whose janitor
+// drops expired entries every cleanup interval
+type memoryBackend struct {
+	cache *cache.Cache
+	stats backendCounters
+}
+
+// NewMemoryBackend creates a backend keeping entries in memory, removing expired entries every
+// cleanupInterval
+func NewMemoryBackend(cleanupInterval time.Duration) LocalBackend {
+	return &memoryBackend{cache: cache.New(cache.NoExpiration, cleanupInterval)}
+}
+
+// Get implements CacheBackend
+func (b *memoryBackend) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	item, found := b.cache.Get(key)
+	value, ok := item.([]byte)
+	if !found || !ok {
+		b.stats.misses.Add(1)
+		return nil, false, nil
+	}
+	b.stats.hits.Add(1)
+	return value, true, nil
+}
+
+// Set implements CacheBackend. Replaced entries are not reported to the eviction function.
+func (b *memoryBackend) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	if ttl < 0 {
+		ttl = cache.NoExpiration
+	}
+	b.cache.Set(key, value, ttl)
+	b.stats.sets.Add(1)
+	return nil
+}
+
+// Delete implements CacheBackend
+func (b *memoryBackend) Delete(ctx context.Context, keys ...string) (int, error) {
+	removed := 0
+	for _, key := range keys {
+		if _, found := b.cache.Get(key); found {
+			removed++
+		}
+		b.cache.Delete(key)
+	}
+	b.stats.deletes.Add(uint64(removed))
+	return removed, nil
+}
+
+// DeletePrefix implements CacheBackend
+func (b *memoryBackend) DeletePrefix(ctx context.Context, prefix string) (int, error) {
+	var keys []string
+	for key := range b.cache.Items() {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return b.Delete(ctx, keys...)
+}
+
+// Stats implements CacheBackend
+func (b *memoryBackend) Stats() BackendStats {
+	return b.stats.snapshot("memory")
+}
+
+// Entries implements LocalBackend
+func (b *memoryBackend) Entries() []BackendEntry {
+	items := b.cache.Items()
+	entries := make([]BackendEntry, 0, len(items))
+	for key, item := range items {
+		value, ok := item.Object.([]byte)
+		if !ok {
+			continue
+		}
+		entry := BackendEntry{Key: key, Value: value}
+		if item.Expiration > 0 {
+			entry.ExpiresAt = time.Unix(0, item.Expiration)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// Len implements LocalBackend
+func (b *memoryBackend) Len() int {
+	return b.cache.ItemCount()
+}
+
+// OnEvicted implements LocalBackend; go-cache runs the function for deleted and expired entries
+func (b *memoryBackend) OnEvicted(f func(key string, value []byte)) {
+	b.cache.OnEvicted(func(key string, item interface{}) {
+		if value, ok := item.([]byte); ok {
+			f(key, value)
+		}
+	})
+}
@@ -0,0 +1,396 @@
+package cache
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// DefaultRedisTimeout bounds each Redis command, so an unreachable server only makes the
+	// cache miss
+	DefaultRedisTimeout = 2 * time.Second
+	// maxIdleRedisConns is how many connections are kept open between commands
+	maxIdleRedisConns = 8
+	// maxRedisReplySize bounds the bulk strings read from the server
+	maxRedisReplySize = 1 << 20
+)
+
+var (
+	ErrRedisProtocol = errors.New("invalid Redis reply")
+)
+
+// RedisError is an error reply of the Redis server
+type RedisError string
+
+// Error implements the error interface
+func (e RedisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// RedisConfig locates and authenticates against a Redis server
+type RedisConfig struct {
+	Address  string // host:port
+	Username string // ACL user, the default user when empty
+	Password string
+	DB       int
+	TLS      bool
+	// TLSConfig sets the CAs and server name of TLS connections, the system CAs and the host
+	// of Address when nil
+	TLSConfig *tls.Config
+	Timeout   time.Duration // per command, DefaultRedisTimeout when zero
+}
+
+// Redis is a minimal client of the Redis protocol (RESP2) with a small connection pool, covering
+// the commands of RedisBackend. It is safe for concurrent use.
+type Redis struct {
+	config RedisConfig
+
+	mu   sync.Mutex
+	idle []*redisConn
+}
+
+// redisConn is a connection to the server with its reply reader
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// NewRedis creates a client; connections are opened when commands are sent
+func NewRedis(config RedisConfig) *Redis {
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultRedisTimeout
+	}
+	return &Redis{config: config}
+}
+
+// Do sends a command and returns its reply: a string for status replies, an int64, a []byte
+// (nil for a missing value) or a []interface{} of those. Error replies are returned as
+// RedisError.
+func (r *Redis) Do(ctx context.Context, args ...string) (interface{}, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.config.Timeout)
+	defer cancel()
+
+	for {
+		conn, pooled, err := r.get(ctx)
+		if err != nil {
+			return nil, err
+		}
+		reply, err := conn.do(ctx, args)
+		var redisErr RedisError
+		if err == nil || errors.As(err, &redisErr) {
+			r.put(conn)
+			return reply, err
+		}
+		// The connection may be out of step with the server
+		conn.conn.Close()
+		// Idle connections closed by the server, because it restarted or timed them out, fail
+		// before the command is answered; it is sent again on another connection
+		if !pooled || !closedConn(err) {
+			return nil, err
+		}
+	}
+}
+
+// closedConn reports whether err is that of a connection the server closed
+func closedConn(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
+
+// Ping checks that the server is reachable and the credentials are accepted
+func (r *Redis) Ping(ctx context.Context) error {
+	_, err := r.Do(ctx, "PING")
+	return err
+}
+
+// Close closes the idle connections
+func (r *Redis) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, conn := range r.idle {
+		conn.conn.Close()
+	}
+	r.idle = nil
+	return nil
+}
+
+// get returns an idle connection, or opens and authenticates a new one; pooled is true for idle
+// connections
+func (r *Redis) get(ctx context.Context) (conn *redisConn, pooled bool, err error) {
+	r.mu.Lock()
+	if n := len(r.idle); n > 0 {
+		conn := r.idle[n-1]
+		r.idle = r.idle[:n-1]
+		r.mu.Unlock()
+		return conn, true, nil
+	}
+	r.mu.Unlock()
+	conn, err = r.dial(ctx)
+	return conn, false, err
+}
+
+// dial opens and authenticates a connection
+func (r *Redis) dial(ctx context.Context) (*redisConn, error) {
+
+	var dialer interface {
+		DialContext(ctx context.Context, network, address string) (net.Conn, error)
+	} = &net.Dialer{}
+	if r.config.TLS {
+		dialer = &tls.Dialer{Config: r.config.TLSConfig}
+	}
+	netConn, err := dialer.DialContext(ctx, "tcp", r.config.Address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to Redis: %w", err)
+	}
+	conn := &redisConn{conn: netConn, reader: bufio.NewReader(netConn)}
+
+	if r.config.Password != "" {
+		args := []string{"AUTH", r.config.Password}
+		if r.config.Username != "" {
+			args = []string{"AUTH", r.config.Username, r.config.Password}
+		}
+		if _, err := conn.do(ctx, args); err != nil {
+			netConn.Close()
+			return nil, fmt.Errorf("failed to authenticate to Redis: %w", err)
+		}
+	}
+	if r.config.DB != 0 {
+		if _, err := conn.do(ctx, []string{"SELECT", strconv.Itoa(r.config.DB)}); err != nil {
+			netConn.Close()
+			return nil, fmt.Errorf("failed to select Redis database %d: %w", r.config.DB, err)
+		}
+	}
+	return conn, nil
+}
+
+// put returns a connection to the pool, closing it when the pool is full
+func (r *Redis) put(conn *redisConn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.idle) >= maxIdleRedisConns {
+		conn.conn.Close()
+		return
+	}
+	r.idle = append(r.idle, conn)
+}
+
+// do writes a command as an array of bulk strings and reads its reply
+func (c *redisConn) do(ctx context.Context, args []string) (interface{}, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		c.conn.SetDeadline(deadline)
+	}
+
+	buf := make([]byte, 0, 64)
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, '\r', '\n')
+	for _, arg := range args {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(arg)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, arg...)
+		buf = append(buf, '\r', '\n')
+	}
+	_, err := c.conn.Write(buf)
+	// The command may carry secrets, such as the AUTH password or an encrypted value
+	clear(buf)
+	if err != nil {
+		return nil, err
+	}
+	return c.readReply()
+}
+
+// readReply reads a RESP2 reply
+func (c *redisConn) readReply() (interface{}, error) {
+	line, err := c.reader.ReadSlice('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, ErrRedisProtocol
+	}
+	kind, value := line[0], string(line[1:len(line)-2])
+
+	switch kind {
+	case '+':
+		return value, nil
+	case '-':
+		return nil, RedisError(value)
+	case ':':
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, ErrRedisProtocol
+		}
+		return n, nil
+	case '$':
+		size, err := strconv.Atoi(value)
+		if err != nil || size > maxRedisReplySize {
+			return nil, ErrRedisProtocol
+		}
+		if size < 0 {
+			return []byte(nil), nil
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(c.reader, data); err != nil {
+			return nil, err
+		}
+		return data[:size], nil
+	case '*':
+		count, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, ErrRedisProtocol
+		}
+		if count < 0 {
+			return []interface{}(nil), nil
+		}
+		items := make([]interface{}, 0, count)
+		for i := 0; i < count; i++ {
+			item, err := c.readReply()
+			// An error element is part of the reply, the rest of which must still be read
+			var redisErr RedisError
+			if errors.As(err, &redisErr) {
+				item = redisErr
+			} else if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		return items, nil
+	}
+	return nil, ErrRedisProtocol
+}
+
+// RedisBackend is a CacheBackend in Redis, shared by every proxy replica pointing at the same
+// server. Keys are prefixed so the server can be shared with other applications.
+type RedisBackend struct {
+	client *Redis
+	prefix string
+	stats  backendCounters
+}
+
+// NewRedisBackend creates a backend storing entries in Redis under keys starting with prefix
+func NewRedisBackend(client *Redis, prefix string) *RedisBackend {
+	return &RedisBackend{client: client, prefix: prefix}
+}
+
+// Get implements CacheBackend
+func (b *RedisBackend) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	reply, err := b.client.Do(ctx, "GET", b.prefix+key)
+	if err != nil {
+		b.stats.errors.Add(1)
+		return nil, false, err
+	}
+	value, _ := reply.([]byte)
+	if value == nil {
+		b.stats.misses.Add(1)
+		return nil, false, nil
+	}
+	b.stats.hits.Add(1)
+	return value, true, nil
+}
+
+// Set implements CacheBackend
+func (b *RedisBackend) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	args := []string{"SET", b.prefix + key, string(value)}
+	if ttl > 0 {
+		args = append(args, "PX", strconv.FormatInt(max(ttl.Milliseconds(), 1), 10))
+	}
+	if _, err := b.client.Do(ctx, args...); err != nil {
+		b.stats.errors.Add(1)
+		return err
+	}
+	b.stats.sets.Add(1)
+	return nil
+}
+
+// Delete implements CacheBackend
+func (b *RedisBackend) Delete(ctx context.Context, keys ...string) (int, error) {
+	if len(keys) == 0 {
+		return 0, nil
+	}
+	args := make([]string, 0, len(keys)+1)
+	args = append(args, "DEL")
+	for _, key := range keys {
+		args = append(args, b.prefix+key)
+	}
+	reply, err := b.client.Do(ctx, args...)
+	if err != nil {
+		b.stats.errors.Add(1)
+		return 0, err
+	}
+	removed, _ := reply.(int64)
+	b.stats.deletes.Add(uint64(removed))
+	return int(removed), nil
+}
+
+// DeletePrefix implements CacheBackend, scanning the keys with SCAN so the server is not
+// blocked as with KEYS
+func (b *RedisBackend) DeletePrefix(ctx context.Context, prefix string) (int, error) {
+	pattern := escapeGlob(b.prefix+prefix) + "*"
+	removed := 0
+	cursor := "0"
+	for {
+		reply, err := b.client.Do(ctx, "SCAN", cursor, "MATCH", pattern, "COUNT", "100")
+		if err != nil {
+			b.stats.errors.Add(1)
+			return removed, err
+		}
+		items, _ := reply.([]interface{})
+		if len(items) != 2 {
+			b.stats.errors.Add(1)
+			return removed, ErrRedisProtocol
+		}
+		next, _ := items[0].([]byte)
+		keys, _ := items[1].([]interface{})
+		if len(keys) > 0 {
+			args := []string{"DEL"}
+			for _, key := range keys {
+				if key, ok := key.([]byte); ok {
+					args = append(args, string(key))
+				}
+			}
+			reply, err := b.client.Do(ctx, args...)
+			if err != nil {
+				b.stats.errors.Add(1)
+				return removed, err
+			}
+			n, _ := reply.(int64)
+			b.stats.deletes.Add(uint64(n))
+			removed += int(n)
+		}
+		if cursor = string(next); cursor == "0" || cursor == "" {
+			return removed, nil
+		}
+	}
+}
+
+// Stats implements CacheBackend
+func (b *RedisBackend) Stats() BackendStats {
+	return b.stats.snapshot("redis")
+}
+
+// Close implements io.Closer
+func (b *RedisBackend) Close() error {
+	return b.client.Close()
+}
+
+// escapeGlob escapes the characters SCAN MATCH patterns treat specially
+func escapeGlob(s string) string {
+	var escaped strings.Builder
+	for _, c := range s {
+		if strings.ContainsRune(`*?[]\`, c) {
+			escaped.WriteByte('\\')
+		}
+		escaped.WriteRune(c)
+	}
+	return escaped.String()
+}
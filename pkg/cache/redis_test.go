@@ -0,0 +1,482 @@
+package cache
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is a Redis server on a local port, speaking enough RESP2 for the commands of
+// RedisBackend. Replies can be overridden to inject errors, and the server can stall or drop
+// its connections.
+type fakeRedis struct {
+	net.Listener
+	password string
+
+	mu       sync.Mutex
+	values   map[string]string
+	conns    []net.Conn
+	commands [][]string
+	stall    bool
+	reply    func(args []string) string // raw reply overriding the store's, unless empty
+}
+
+// newFakeRedis starts a server requiring password, unless it is empty, over TLS when tlsConfig
+// is not nil
+func newFakeRedis(t *testing.T, password string, tlsConfig *tls.Config) *fakeRedis {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	server := &fakeRedis{Listener: listener, password: password, values: map[string]string{}}
+	go server.serve()
+	t.Cleanup(func() {
+		listener.Close()
+		server.dropConns()
+	})
+	return server
+}
+
+func (s *fakeRedis) serve() {
+	for {
+		conn, err := s.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns = append(s.conns, conn)
+		s.mu.Unlock()
+		go s.handle(conn)
+	}
+}
+
+func (s *fakeRedis) handle(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	authenticated := s.password == ""
+	for {
+		args, err := readCommand(reader)
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.commands = append(s.commands, args)
+		stall, override := s.stall, s.reply
+		s.mu.Unlock()
+		if stall {
+			continue
+		}
+
+		var reply string
+		if override != nil {
+			reply = override(args)
+		}
+		switch {
+		case reply != "":
+		case strings.ToUpper(args[0]) == "AUTH":
+			if args[len(args)-1] != s.password {
+				reply = "-WRONGPASS invalid username-password pair\r\n"
+				break
+			}
+			authenticated = true
+			reply = "+OK\r\n"
+		case !authenticated:
+			reply = "-NOAUTH Authentication required.\r\n"
+		default:
+			reply = s.execute(args)
+		}
+		if _, err := io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+// execute runs a command against the store and returns its reply
+func (s *fakeRedis) execute(args []string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		return "+PONG\r\n"
+	case "SELECT":
+		return "+OK\r\n"
+	case "GET":
+		value, found := s.values[args[1]]
+		if !found {
+			return "$-1\r\n"
+		}
+		return bulkString(value)
+	case "SET":
+		s.values[args[1]] = args[2]
+		return "+OK\r\n"
+	case "DEL":
+		removed := 0
+		for _, key := range args[1:] {
+			if _, found := s.values[key]; found {
+				delete(s.values, key)
+				removed++
+			}
+		}
+		return ":" + strconv.Itoa(removed) + "\r\n"
+	case "SCAN":
+		// Every matching key is returned in one batch, except that the first call with a
+		// cursor of 0 returns none and a cursor of 1, to exercise the iteration
+		if args[1] == "0" {
+			return "*2\r\n" + bulkString("1") + "*0\r\n"
+		}
+		var keys []string
+		for key := range s.values {
+			if matched, _ := path.Match(args[3], key); matched {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		reply := "*2\r\n" + bulkString("0") + "*" + strconv.Itoa(len(keys)) + "\r\n"
+		for _, key := range keys {
+			reply += bulkString(key)
+		}
+		return reply
+	}
+	return "-ERR unknown command '" + args[0] + "'\r\n"
+}
+
+// dropConns closes the server side of every connection, as a restarting server would
+func (s *fakeRedis) dropConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
+}
+
+func (s *fakeRedis) setStall(stall bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stall = stall
+}
+
+func (s *fakeRedis) setReply(reply func(args []string) string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reply = reply
+}
+
+// connCount returns the number of connections the server accepted since it last dropped them
+func (s *fakeRedis) connCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+// lastCommand returns the last command the server received
+func (s *fakeRedis) lastCommand() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.commands[len(s.commands)-1]
+}
+
+// readCommand reads a command sent as an array of bulk strings
+func readCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	count, err := strconv.Atoi(strings.TrimSuffix(line[1:], "\r\n"))
+	if line[0] != '*' || err != nil || count < 1 {
+		return nil, ErrRedisProtocol
+	}
+	args := make([]string, count)
+	for i := range args {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSuffix(line[1:], "\r\n"))
+		if line[0] != '$' || err != nil {
+			return nil, ErrRedisProtocol
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		args[i] = string(data[:size])
+	}
+	return args, nil
+}
+
+func bulkString(s string) string {
+	return "$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n"
+}
+
+func newTestRedis(server *fakeRedis, config RedisConfig) *Redis {
+	config.Address = server.Addr().String()
+	if config.Timeout == 0 {
+		config.Timeout = time.Second
+	}
+	return NewRedis(config)
+}
+
+func TestRedisBackend(t *testing.T) {
+	server := newFakeRedis(t, "", nil)
+	backend := NewRedisBackend(newTestRedis(server, RedisConfig{}), "proxy:")
+	ctx := context.Background()
+
+	if _, found, err := backend.Get(ctx, "creds:a:1"); found || err != nil {
+		t.Fatalf("Get of a missing key = %v, %v", found, err)
+	}
+	if err := backend.Set(ctx, "creds:a:1", []byte("sealed\r\n\x00"), 1500*time.Millisecond); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if got := strings.Join(server.lastCommand(), " "); got != "SET proxy:creds:a:1 sealed\r\n\x00 PX 1500" {
+		t.Errorf("Set sent %q", got)
+	}
+	if value, found, err := backend.Get(ctx, "creds:a:1"); !found || err != nil || string(value) != "sealed\r\n\x00" {
+		t.Fatalf("Get = %q, %v, %v", value, found, err)
+	}
+	backend.Set(ctx, "creds:a:2", []byte("sealed"), -1)
+	if got := server.lastCommand(); len(got) != 3 {
+		t.Errorf("Set without expiry sent %q", got)
+	}
+	backend.Set(ctx, "creds:b:1", []byte("sealed"), -1)
+	backend.Set(ctx, "creds:[b]:1", []byte("sealed"), -1)
+
+	if removed, err := backend.DeletePrefix(ctx, "creds:a:"); removed != 2 || err != nil {
+		t.Errorf("DeletePrefix = %d, %v, want 2", removed, err)
+	}
+	if removed, err := backend.DeletePrefix(ctx, "creds:[b]:"); removed != 1 || err != nil {
+		t.Errorf("DeletePrefix of a prefix with glob characters = %d, %v, want 1", removed, err)
+	}
+	if removed, err := backend.Delete(ctx, "creds:b:1", "creds:c:1"); removed != 1 || err != nil {
+		t.Errorf("Delete = %d, %v, want 1", removed, err)
+	}
+
+	stats := backend.Stats()
+	if stats.Hits != 1 || stats.Misses != 1 || stats.Sets != 4 || stats.Deletes != 4 || stats.Errors != 0 {
+		t.Errorf("Stats = %+v", stats)
+	}
+	if n := server.connCount(); n != 1 {
+		t.Errorf("commands used %d connections, want 1", n)
+	}
+}
+
+func TestRedisErrorReplies(t *testing.T) {
+	server := newFakeRedis(t, "", nil)
+	client := newTestRedis(server, RedisConfig{})
+	backend := NewRedisBackend(client, "")
+	ctx := context.Background()
+
+	server.setReply(func(args []string) string {
+		if args[0] == "GET" {
+			return "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"
+		}
+		return ""
+	})
+	_, _, err := backend.Get(ctx, "key")
+	var redisErr RedisError
+	if !errors.As(err, &redisErr) || !strings.HasPrefix(string(redisErr), "WRONGTYPE") {
+		t.Fatalf("Get error = %v, want the error reply", err)
+	}
+	if stats := backend.Stats(); stats.Errors != 1 {
+		t.Errorf("Stats.Errors = %d, want 1", stats.Errors)
+	}
+
+	// Error elements of an array are part of the reply
+	server.setReply(func(args []string) string {
+		return "*3\r\n:1\r\n-ERR element\r\n$2\r\nok\r\n"
+	})
+	reply, err := client.Do(ctx, "EXEC")
+	items, _ := reply.([]interface{})
+	if err != nil || len(items) != 3 || items[1] != RedisError("ERR element") || string(items[2].([]byte)) != "ok" {
+		t.Fatalf("Do = %#v, %v", reply, err)
+	}
+
+	// The connection stays in step with the server after error replies
+	server.setReply(nil)
+	if err := client.Ping(ctx); err != nil {
+		t.Fatalf("Ping after error replies: %v", err)
+	}
+	if n := server.connCount(); n != 1 {
+		t.Errorf("error replies closed the connection: %d connections", n)
+	}
+}
+
+func TestRedisProtocolErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		reply string
+	}{
+		{name: "unknown type", reply: "?1\r\n"},
+		{name: "missing carriage return", reply: "+OK\n"},
+		{name: "invalid integer", reply: ":one\r\n"},
+		{name: "invalid bulk size", reply: "$x\r\n"},
+		{name: "oversized bulk", reply: "$" + strconv.Itoa(maxRedisReplySize+1) + "\r\n"},
+		{name: "invalid array size", reply: "*x\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakeRedis(t, "", nil)
+			client := newTestRedis(server, RedisConfig{})
+			server.setReply(func([]string) string { return tt.reply })
+			if _, err := client.Do(context.Background(), "GET", "key"); !errors.Is(err, ErrRedisProtocol) {
+				t.Fatalf("Do error = %v, want %v", err, ErrRedisProtocol)
+			}
+
+			// The connection is out of step and replaced
+			server.setReply(nil)
+			if err := client.Ping(context.Background()); err != nil {
+				t.Fatalf("Ping after a protocol error: %v", err)
+			}
+			if n := server.connCount(); n != 2 {
+				t.Errorf("%d connections, want 2", n)
+			}
+		})
+	}
+}
+
+func TestRedisTimeout(t *testing.T) {
+	server := newFakeRedis(t, "", nil)
+	client := newTestRedis(server, RedisConfig{Timeout: 100 * time.Millisecond})
+
+	server.setStall(true)
+	start := time.Now()
+	err := client.Ping(context.Background())
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("Ping of a stalled server = %v, want a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Ping took %v", elapsed)
+	}
+
+	// The connection that timed out may still get the late reply, so it is not reused
+	server.setStall(false)
+	if err := client.Ping(context.Background()); err != nil {
+		t.Fatalf("Ping after a timeout: %v", err)
+	}
+	if n := server.connCount(); n != 2 {
+		t.Errorf("%d connections, want 2", n)
+	}
+
+	// Canceled contexts bound commands too
+	server.setStall(true)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := NewRedis(RedisConfig{Address: server.Addr().String(), Timeout: time.Minute}).Ping(ctx); err == nil {
+		t.Fatal("Ping of a stalled server succeeded")
+	}
+}
+
+func TestRedisReconnect(t *testing.T) {
+	server := newFakeRedis(t, "secret", nil)
+	client := newTestRedis(server, RedisConfig{Username: "proxy", Password: "secret", DB: 2})
+	backend := NewRedisBackend(client, "")
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		if err := backend.Set(ctx, "key", []byte("value"), time.Minute); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+		// Idle connections closed by the server are replaced transparently, and new
+		// connections are authenticated again
+		server.dropConns()
+		time.Sleep(10 * time.Millisecond)
+		if value, found, err := backend.Get(ctx, "key"); err != nil || !found || string(value) != "value" {
+			t.Fatalf("Get after the server closed the connection = %q, %v, %v", value, found, err)
+		}
+	}
+	if stats := backend.Stats(); stats.Errors != 0 {
+		t.Errorf("Stats.Errors = %d, want 0", stats.Errors)
+	}
+
+	// A server that is gone fails the command
+	server.Close()
+	server.dropConns()
+	if _, _, err := backend.Get(ctx, "key"); err == nil {
+		t.Fatal("Get succeeded with the server gone")
+	}
+}
+
+func TestRedisAuth(t *testing.T) {
+	server := newFakeRedis(t, "secret", nil)
+
+	err := newTestRedis(server, RedisConfig{Password: "wrong"}).Ping(context.Background())
+	var redisErr RedisError
+	if !errors.As(err, &redisErr) || !strings.HasPrefix(string(redisErr), "WRONGPASS") {
+		t.Fatalf("Ping with a wrong password = %v", err)
+	}
+	err = newTestRedis(server, RedisConfig{}).Ping(context.Background())
+	if !errors.As(err, &redisErr) || !strings.HasPrefix(string(redisErr), "NOAUTH") {
+		t.Fatalf("Ping without a password = %v", err)
+	}
+
+	server.setReply(func(args []string) string {
+		if args[0] == "SELECT" {
+			return "-ERR DB index is out of range\r\n"
+		}
+		return ""
+	})
+	if err := newTestRedis(server, RedisConfig{Password: "secret", DB: 99}).Ping(context.Background()); err == nil || !strings.Contains(err.Error(), "database 99") {
+		t.Fatalf("Ping with an invalid database = %v", err)
+	}
+}
+
+func TestRedisTLS(t *testing.T) {
+	certificate, rootCAs := newTestCertificate(t)
+	server := newFakeRedis(t, "", &tls.Config{Certificates: []tls.Certificate{certificate}})
+
+	if err := newTestRedis(server, RedisConfig{TLS: true}).Ping(context.Background()); err == nil {
+		t.Fatal("Ping succeeded with an untrusted server certificate")
+	}
+	client := newTestRedis(server, RedisConfig{TLS: true, TLSConfig: &tls.Config{RootCAs: rootCAs}})
+	if err := client.Ping(context.Background()); err != nil {
+		t.Fatalf("Ping over TLS: %v", err)
+	}
+}
+
+// newTestCertificate returns a self-signed certificate for 127.0.0.1, and a pool trusting it
+func newTestCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "redis.test"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(parsed)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, rootCAs
+}
@@ -0,0 +1,138 @@
+// Package cachecontrol sets Cache-Control and Expires headers on successful registry responses,
+// so HTTP caches and CDNs in front of the proxy cache immutable content and revalidate mutable
+// content.
+package cachecontrol
+
+import (
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"vault-docker-proxy/pkg/config"
+)
+
+// Policy applies the first matching rule to each response
+type Policy struct {
+	rules []config.CacheControlRule
+	now   func() time.Time
+}
+
+// NewPolicy creates a policy for the given rules
+func NewPolicy(rules []config.CacheControlRule) *Policy {
+	return &Policy{
+		rules: rules,
+		now:   time.Now,
+	}
+}
+
+// Middleware sets the headers of the first rule matching the route, reference kind and content
+// type of successful GET and HEAD responses, replacing those sent by the upstream registry
+func (p *Policy) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		route, reference := routeOf(r.URL.Path)
+		if route == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(&responseWriter{ResponseWriter: w, policy: p, route: route, reference: reference}, r)
+	})
+}
+
+// apply sets the headers of the first matching rule
+func (p *Policy) apply(header http.Header, route, reference string) {
+	contentType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	for _, rule := range p.rules {
+		if !matches(rule, route, reference, contentType) {
+			continue
+		}
+		header.Del("Cache-Control")
+		header.Del("Expires")
+		if rule.CacheControl != "" {
+			header.Set("Cache-Control", rule.CacheControl)
+		}
+		if rule.Expires > 0 {
+			header.Set("Expires", p.now().Add(rule.Expires.Duration()).UTC().Format(http.TimeFormat))
+		}
+		return
+	}
+}
+
+// matches reports whether rule applies to a response
+func matches(rule config.CacheControlRule, route, reference, contentType string) bool {
+	if rule.Route != "" && rule.Route != "*" && rule.Route != route {
+		return false
+	}
+	if rule.Reference != "" && rule.Reference != reference {
+		return false
+	}
+	if rule.ContentType != "" {
+		matched, _ := path.Match(rule.ContentType, contentType)
+		return matched
+	}
+	return true
+}
+
+// routeOf classifies a registry API path as catalog, tags, manifests or blobs, and whether a
+// manifest or blob is addressed by digest or tag
+func routeOf(requestPath string) (route, reference string) {
+	switch {
+	case requestPath == "/v2/_catalog":
+		return "catalog", ""
+	case strings.HasSuffix(requestPath, "/tags/list"):
+		return "tags", ""
+	case strings.Contains(requestPath, "/manifests/"):
+		return "manifests", referenceKind(requestPath)
+	case strings.Contains(requestPath, "/blobs/"):
+		return "blobs", referenceKind(requestPath)
+	default:
+		return "", ""
+	}
+}
+
+// referenceKind reports whether the last path element is a digest or a tag
+func referenceKind(requestPath string) string {
+	if strings.Contains(path.Base(requestPath), ":") {
+		return "digest"
+	}
+	return "tag"
+}
+
+// responseWriter applies the policy when the status code is written
+type responseWriter struct {
+	http.ResponseWriter
+	policy      *Policy
+	route       string
+	reference   string
+	wroteHeader bool
+}
+
+// WriteHeader implements http.ResponseWriter
+func (w *responseWriter) WriteHeader(statusCode int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if statusCode >= 200 && statusCode <= 299 {
+			w.policy.apply(w.Header(), w.route, w.reference)
+		}
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Write implements http.ResponseWriter
+func (w *responseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
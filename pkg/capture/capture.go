@@ -0,0 +1,269 @@
+// Package capture logs full request/response exchanges of selected requests, with credentials
+// redacted, to troubleshoot client specific incompatibilities without packet captures.
+package capture
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"vault-docker-proxy/pkg/admin"
+	"vault-docker-proxy/pkg/logging"
+	"vault-docker-proxy/pkg/recorder"
+)
+
+// Header carries a capture token issued on the admin listener; requests presenting a valid one
+// are captured
+const Header = "X-Debug-Capture"
+
+// DefaultTokenTTL and MaxTokenTTL bound the lifetime of capture tokens
+const (
+	DefaultTokenTTL = 15 * time.Minute
+	MaxTokenTTL     = 24 * time.Hour
+)
+
+// jsonSecret and formSecret match credential and token values in JSON bodies and in form
+// bodies or queries
+var (
+	jsonSecret = regexp.MustCompile(`(?i)("(?:[a-z_]*token|password|[a-z_]*secret)"\s*:\s*)"(?:[^"\\]|\\.)*"`)
+	formSecret = regexp.MustCompile(`(?i)((?:^|&)(?:[a-z_]*token|password|[a-z_]*secret)=)[^&]*`)
+)
+
+// Capturer logs the exchanges of requests carrying a capture token or targeting a repository
+// selected for capture
+type Capturer struct {
+	repositories []*regexp.Regexp // captured for every client
+	maxBodySize  int
+	key          []byte // signs capture tokens, regenerated at every start
+	now          func() time.Time
+}
+
+// NewCapturer creates a capturer that always captures the given repository globs ("*" matches
+// across "/") and logs up to maxBodySize bytes of non-blob bodies
+func NewCapturer(repositories []string, maxBodySize int) (*Capturer, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate capture token key: %v", err)
+	}
+	compiled := make([]*regexp.Regexp, 0, len(repositories))
+	for _, glob := range repositories {
+		pattern := strings.NewReplacer(`\*`, ".*", `\?`, ".").Replace(regexp.QuoteMeta(glob))
+		compiled = append(compiled, regexp.MustCompile("^"+pattern+"$"))
+	}
+	return &Capturer{
+		repositories: compiled,
+		maxBodySize:  maxBodySize,
+		key:          key,
+		now:          time.Now,
+	}, nil
+}
+
+// IssueToken returns a capture token valid for ttl. Tokens do not survive a restart.
+func (c *Capturer) IssueToken(ttl time.Duration) (string, time.Time) {
+	expiresAt := c.now().Add(ttl).Truncate(time.Second)
+	payload := strconv.FormatInt(expiresAt.Unix(), 10)
+	return payload + "." + c.sign(payload), expiresAt
+}
+
+// TokenHandler serves POST /admin/debug/capture on the admin listener: it issues a capture token
+// valid for the ttl query parameter (default DefaultTokenTTL)
+func (c *Capturer) TokenHandler(w http.ResponseWriter, r *http.Request) {
+	ttl := DefaultTokenTTL
+	if value := r.URL.Query().Get("ttl"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 || parsed > MaxTokenTTL {
+			admin.WriteError(w, "BAD_REQUEST", fmt.Sprintf("ttl must be a duration between 1s and %s", MaxTokenTTL), http.StatusBadRequest)
+			return
+		}
+		ttl = parsed
+	}
+
+	token, expiresAt := c.IssueToken(ttl)
+	slog.Info("Issued debug capture token", "expires_at", expiresAt.Format(time.RFC3339))
+	admin.WriteJSON(w, http.StatusOK, map[string]interface{}{
+		"header":     Header,
+		"token":      token,
+		"expires_at": expiresAt,
+	})
+}
+
+// validToken reports whether token was issued by this capturer and has not expired
+func (c *Capturer) validToken(token string) bool {
+	payload, signature, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(c.sign(payload))) {
+		return false
+	}
+	expiry, err := strconv.ParseInt(payload, 10, 64)
+	return err == nil && c.now().Before(time.Unix(expiry, 0))
+}
+
+// sign returns the hex HMAC of a token payload
+func (c *Capturer) sign(payload string) string {
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Middleware logs the exchanges of selected requests passing through next. The capture header
+// is removed before next sees the request.
+func (c *Capturer) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := r.Header.Get(Header)
+		r.Header.Del(Header)
+
+		reason := ""
+		if token != "" && c.validToken(token) {
+			reason = "capture token"
+		} else if repository := repositoryOf(r.URL.Path); repository != "" && c.matchesRepository(repository) {
+			reason = "repository " + repository
+		}
+		if reason == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		captureBodies := c.maxBodySize > 0 && !strings.Contains(r.URL.Path, "/blobs/")
+
+		var requestBody []byte
+		if captureBodies && r.Body != nil && r.Body != http.NoBody {
+			body, err := io.ReadAll(io.LimitReader(r.Body, int64(c.maxBodySize)+1))
+			if err == nil {
+				r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+				requestBody = body
+			}
+		}
+
+		rw := &captureWriter{ResponseWriter: w, status: http.StatusOK, capture: captureBodies, limit: c.maxBodySize + 1}
+		next.ServeHTTP(rw, r)
+
+		var dump strings.Builder
+		fmt.Fprintf(&dump, "> %s %s %s\n", r.Method, redactQuery(r.URL.RequestURI()), r.Proto)
+		writeHeaders(&dump, "> ", r.Header)
+		c.writeBody(&dump, "> ", requestBody)
+		fmt.Fprintf(&dump, "< %d %s\n", rw.status, http.StatusText(rw.status))
+		writeHeaders(&dump, "< ", w.Header())
+		c.writeBody(&dump, "< ", rw.body.Bytes())
+		logging.FromContext(r.Context()).Info("DEBUG capture", "reason", reason, "method", r.Method, "path", r.URL.Path,
+			"remote_addr", r.RemoteAddr, "duration", time.Since(start).Round(time.Millisecond), "exchange", strings.TrimSuffix(dump.String(), "\n"))
+	})
+}
+
+// matchesRepository reports whether a repository is selected for capture
+func (c *Capturer) matchesRepository(repository string) bool {
+	for _, re := range c.repositories {
+		if re.MatchString(repository) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeHeaders writes sorted headers with credentials redacted
+func writeHeaders(dump *strings.Builder, prefix string, headers http.Header) {
+	sanitized := recorder.Sanitize(headers)
+	names := make([]string, 0, len(sanitized))
+	for name := range sanitized {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range sanitized[name] {
+			fmt.Fprintf(dump, "%s%s: %s\n", prefix, name, value)
+		}
+	}
+}
+
+// writeBody writes a body with credentials redacted, truncated to the body size limit
+func (c *Capturer) writeBody(dump *strings.Builder, prefix string, body []byte) {
+	if len(body) == 0 {
+		return
+	}
+	truncated := len(body) > c.maxBodySize
+	if truncated {
+		body = body[:c.maxBodySize]
+	}
+	dump.WriteString(prefix + "\n")
+	for _, line := range strings.Split(strings.TrimSuffix(redactBody(string(body)), "\n"), "\n") {
+		dump.WriteString(prefix + line + "\n")
+	}
+	if truncated {
+		fmt.Fprintf(dump, "%s[truncated at %d bytes]\n", prefix, c.maxBodySize)
+	}
+}
+
+// redactBody replaces credential and token values in JSON and form bodies
+func redactBody(body string) string {
+	body = jsonSecret.ReplaceAllString(body, `$1"[redacted]"`)
+	return formSecret.ReplaceAllString(body, `$1[redacted]`)
+}
+
+// redactQuery replaces credential and token values in the query of a request URI
+func redactQuery(requestURI string) string {
+	uriPath, query, ok := strings.Cut(requestURI, "?")
+	if !ok {
+		return requestURI
+	}
+	return uriPath + "?" + formSecret.ReplaceAllString(query, `$1[redacted]`)
+}
+
+// repositoryOf returns the repository of a registry API path, or "" for other paths
+func repositoryOf(urlPath string) string {
+	rest, ok := strings.CutPrefix(urlPath, "/v2/")
+	if !ok {
+		return ""
+	}
+	for _, marker := range []string{"/manifests/", "/blobs/", "/tags/list"} {
+		if i := strings.LastIndex(rest, marker); i > 0 {
+			return rest[:i]
+		}
+	}
+	return ""
+}
+
+// captureWriter records the status code and a bounded copy of the response body
+type captureWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	capture     bool
+	limit       int
+	body        bytes.Buffer
+}
+
+func (cw *captureWriter) WriteHeader(status int) {
+	if !cw.wroteHeader {
+		cw.status = status
+		cw.wroteHeader = true
+	}
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *captureWriter) Write(p []byte) (int, error) {
+	cw.wroteHeader = true
+	if cw.capture && cw.body.Len() < cw.limit {
+		cw.body.Write(p[:min(len(p), cw.limit-cw.body.Len())])
+	}
+	return cw.ResponseWriter.Write(p)
+}
+
+// Flush implements http.Flusher so streaming responses keep working while capturing
+func (cw *captureWriter) Flush() {
+	http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (cw *captureWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
@@ -0,0 +1,133 @@
+// Package chaos injects configurable faults into proxied requests so client retry behaviour can
+// be validated with the proxy in the path.
+package chaos
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"vault-docker-proxy/pkg/auth"
+	"vault-docker-proxy/pkg/config"
+	"vault-docker-proxy/pkg/logging"
+)
+
+// Injector applies chaos rules to incoming requests
+type Injector struct {
+	rules []config.ChaosRule
+	rand  func() float64
+}
+
+// NewInjector creates an injector for the given rules
+func NewInjector(rules []config.ChaosRule) *Injector {
+	return &Injector{
+		rules: rules,
+		rand:  rand.Float64,
+	}
+}
+
+// Middleware injects faults into matching requests. It must run after the authentication
+// middleware so the target registry can be determined.
+func (i *Injector) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := routeOf(r.URL.Path)
+		registry := registryOf(r)
+
+		for _, rule := range i.rules {
+			if !i.matches(rule, route, registry) || i.rand()*100 >= rule.Percent {
+				continue
+			}
+
+			logging.FromContext(r.Context()).Warn("CHAOS: injecting fault", "action", rule.Action, "method", r.Method, "path", r.URL.Path, "registry", registry)
+			switch rule.Action {
+			case "latency":
+				select {
+				case <-time.After(rule.Latency.Duration()):
+				case <-r.Context().Done():
+					return
+				}
+			case "error":
+				status := rule.Status
+				if status == 0 {
+					status = http.StatusServiceUnavailable
+				}
+				writeError(w, "UNAVAILABLE", "injected fault", status)
+				return
+			case "throttle":
+				w.Header().Set("Retry-After", "1")
+				writeError(w, "TOOMANYREQUESTS", "injected rate limit", http.StatusTooManyRequests)
+				return
+			case "drop":
+				dropConnection(w)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// matches reports whether rule applies to the route and registry
+func (i *Injector) matches(rule config.ChaosRule, route, registry string) bool {
+	if rule.Route != "" && rule.Route != "*" && rule.Route != route {
+		return false
+	}
+	if rule.Registry != "" && rule.Registry != "*" {
+		matched, _ := path.Match(rule.Registry, registry)
+		return matched
+	}
+	return true
+}
+
+// routeOf classifies a registry API path as catalog, tags, manifests or blobs
+func routeOf(requestPath string) string {
+	switch {
+	case requestPath == "/v2/_catalog":
+		return "catalog"
+	case strings.HasSuffix(requestPath, "/tags/list"):
+		return "tags"
+	case strings.Contains(requestPath, "/manifests/"):
+		return "manifests"
+	case strings.Contains(requestPath, "/blobs/"):
+		return "blobs"
+	default:
+		return ""
+	}
+}
+
+// registryOf returns the upstream registry host targeted by the request
+func registryOf(r *http.Request) string {
+	registryURL := ""
+	if bearerAuth, ok := auth.GetBearerAuthFromContext(r.Context()); ok {
+		registryURL = bearerAuth.RegistryURL
+	} else if authHeader, ok := auth.GetAuthFromContext(r.Context()); ok {
+		if registryConfig, err := auth.ParseUsername(authHeader.Username); err == nil {
+			registryURL = registryConfig.RegistryURL
+		}
+	}
+
+	registryURL = strings.TrimPrefix(registryURL, "https://")
+	registryURL = strings.TrimPrefix(registryURL, "http://")
+	return strings.TrimSuffix(registryURL, "/")
+}
+
+// dropConnection closes the underlying connection without writing a response
+func dropConnection(w http.ResponseWriter) {
+	conn, _, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		panic(http.ErrAbortHandler)
+	}
+	conn.Close()
+}
+
+// writeError writes a Docker Registry API compliant error response
+func writeError(w http.ResponseWriter, code, message string, statusCode int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"errors": []map[string]string{{"code": code, "message": message}},
+	})
+}
@@ -0,0 +1,1734 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	DefaultPort            = "8080"
+	DefaultNetwork         = "tcp"
+	DefaultSocketMode      = "0660"
+	DefaultVaultAddr       = "http://localhost:8200"
+	DefaultRealm           = "https://auth.docker.io/token"
+	DefaultService         = "registry.docker.io"
+	DefaultCacheTTL        = 5 * time.Minute
+	DefaultCleanupInterval = 10 * time.Minute
+	DefaultRedisPrefix     = "vdp:"
+	DefaultRedisTimeout    = 2 * time.Second
+	DefaultAPIKeyCacheTTL  = time.Minute
+	DefaultGroupCacheTTL   = time.Minute
+	DefaultExecTimeout     = 10 * time.Second
+	DefaultMaxQueued       = 64
+	DefaultRefreshBefore   = time.Minute
+	DefaultRefreshIdle     = 10 * time.Minute
+	DefaultNegativeTTL     = 10 * time.Second
+	DefaultProbeTimeout    = 5 * time.Second
+
+	DefaultDebugMaxBodySize = 4096
+
+	DefaultLogLevel  = "info"
+	DefaultLogFormat = "text"
+
+	DefaultPprofAddress = "127.0.0.1"
+
+	DefaultReadHeaderTimeout     = 30 * time.Second
+	DefaultIdleTimeout           = 2 * time.Minute
+	DefaultDialTimeout           = 10 * time.Second
+	DefaultTLSHandshakeTimeout   = 10 * time.Second
+	DefaultResponseHeaderTimeout = time.Minute
+	DefaultUpstreamIdleTimeout   = 90 * time.Second
+
+	DefaultMaxIdleConns        = 256
+	DefaultMaxIdleConnsPerHost = 64
+	DefaultKeepAlive           = 30 * time.Second
+
+	DefaultInitialBackoff = 200 * time.Millisecond
+	DefaultMaxBackoff     = 5 * time.Second
+	DefaultRetryBudget    = 30 * time.Second
+
+	DefaultFlushInterval = 100 * time.Millisecond
+
+	DefaultPullStatsFlushInterval = 10 * time.Second
+	DefaultBlobCacheMaxSize       = 10 << 30
+	DefaultManifestCacheMaxSize   = 64 << 20
+	DefaultManifestCacheTagTTL    = 30 * time.Second
+	DefaultNotationCacheTTL       = 5 * time.Minute
+
+	DefaultTokenCheckInterval = time.Minute
+	DefaultVaultAuthMethod    = "token"
+	DefaultAlertErrorRate     = 0.1
+	DefaultAlertWindow        = 5 * time.Minute
+	DefaultAlertMinCalls      = 20
+
+	DefaultServiceAccountTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+	DefaultTokenIssuer       = "vault-docker-proxy"
+	DefaultKeyOverlap        = time.Hour
+	DefaultKeyReloadInterval = time.Minute
+	DefaultAccessTokenTTL    = 5 * time.Minute
+	DefaultRefreshTokenTTL   = 30 * 24 * time.Hour
+)
+
+var (
+	ErrInvalidConfig = errors.New("invalid configuration")
+)
+
+// Config is the effective proxy configuration, built from defaults, an optional YAML file and
+// environment variable overrides (in that order of precedence)
+type Config struct {
+	Listen        ListenConfig        `yaml:"listen"`
+	TLS           TLSConfig           `yaml:"tls"`
+	Admin         AdminConfig         `yaml:"admin"`
+	Metrics       MetricsConfig       `yaml:"metrics"`
+	Pprof         PprofConfig         `yaml:"pprof"`
+	Log           LogConfig           `yaml:"log"`
+	Vault         VaultConfig         `yaml:"vault"`
+	Auth          AuthConfig          `yaml:"auth"`
+	Cache         CacheConfig         `yaml:"cache"`
+	Dev           DevConfig           `yaml:"dev"`
+	DryRun        bool                `yaml:"dry_run"` // explain requests instead of contacting upstream registries
+	Chaos         ChaosConfig         `yaml:"chaos"`
+	Record        RecordConfig        `yaml:"record"`
+	Token         TokenConfig         `yaml:"token"`
+	Access        AccessConfig        `yaml:"access"`
+	Upstream      UpstreamConfig      `yaml:"upstream"`
+	Exec          ExecConfig          `yaml:"exec"`
+	ECR           ECRConfig           `yaml:"ecr"`
+	Controller    ControllerConfig    `yaml:"controller"`
+	CacheControl  CacheControlConfig  `yaml:"cache_control"`
+	Debug         DebugConfig         `yaml:"debug"`
+	SizeLimits    SizeLimitConfig     `yaml:"size_limits"`
+	PullStats     PullStatsConfig     `yaml:"pull_stats"`
+	Audit         AuditConfig         `yaml:"audit"`
+	BlobCache     BlobCacheConfig     `yaml:"blob_cache"`
+	ManifestCache ManifestCacheConfig `yaml:"manifest_cache"`
+	Notation      NotationConfig      `yaml:"notation"`
+	ImagePolicy   ImagePolicyConfig   `yaml:"image_policy"`
+}
+
+// ListenConfig configures the data-plane listener and any additional ones
+type ListenConfig struct {
+	Address    string           `yaml:"address"`     // interface address, all interfaces when empty; socket path for unix
+	Port       string           `yaml:"port"`        // unused for unix
+	Network    string           `yaml:"network"`     // tcp (dual-stack on wildcard addresses), tcp4, tcp6 or unix
+	SocketMode string           `yaml:"socket_mode"` // permissions of unix sockets, in octal
+	Additional []ListenerConfig `yaml:"additional"`
+	HTTP2      bool             `yaml:"http2"` // HTTP/2 on TLS listeners, negotiated with ALPN
+	H2C        bool             `yaml:"h2c"`   // HTTP/2 without TLS on plaintext listeners
+	Timeouts   ServerTimeouts   `yaml:"timeouts"`
+}
+
+// ServerTimeouts bound the connections of the data-plane listeners; zero disables a timeout.
+// Read and Write cover whole request and response bodies, so they cut off large blob pushes and
+// pulls unless generous.
+type ServerTimeouts struct {
+	ReadHeader Duration `yaml:"read_header"` // to read request headers
+	Read       Duration `yaml:"read"`        // to read a request, body included
+	Write      Duration `yaml:"write"`       // to write a response, from the end of the request headers
+	Idle       Duration `yaml:"idle"`        // before closing an idle keep-alive connection
+}
+
+// ListenerConfig configures an additional data-plane listener. Empty address, network and
+// socket mode inherit those of the main listener; TLS uses the certificate of the tls section.
+type ListenerConfig struct {
+	Address    string `yaml:"address"`
+	Port       string `yaml:"port"`
+	Network    string `yaml:"network"`
+	SocketMode string `yaml:"socket_mode"`
+	TLS        bool   `yaml:"tls"`
+}
+
+// applyURL sets the main listener from a URL: unix:///path/to.sock for a unix socket, or
+// tcp://host:port (also tcp4 and tcp6). Other schemes are kept as the network, for Validate to
+// report.
+func (l *ListenConfig) applyURL(listen string) {
+	u, err := url.Parse(listen)
+	if err != nil || u.Scheme == "" {
+		l.Network = listen
+		return
+	}
+	l.Network = u.Scheme
+	if u.Scheme == "unix" {
+		l.Address = u.Host + u.Path
+		return
+	}
+	l.Address, l.Port = u.Hostname(), u.Port()
+}
+
+// ParseSocketMode parses the octal permissions of a unix socket, such as 0660
+func ParseSocketMode(mode string) (os.FileMode, error) {
+	parsed, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || parsed > 0777 {
+		return 0, fmt.Errorf("%q must be octal permissions such as 0660", mode)
+	}
+	return os.FileMode(parsed), nil
+}
+
+// Unix reports whether the listener binds a unix socket, at Address
+func (l ListenerConfig) Unix() bool {
+	return l.Network == "unix"
+}
+
+// Addr returns the host:port the listener binds, or the path of its unix socket
+func (l ListenerConfig) Addr() string {
+	if l.Unix() {
+		return l.Address
+	}
+	return net.JoinHostPort(l.Address, l.Port)
+}
+
+// TLSConfig configures HTTPS on the data-plane listener. The certificate and key files are
+// reloaded when they change.
+type TLSConfig struct {
+	Enabled    bool             `yaml:"enabled"`
+	CertFile   string           `yaml:"cert_file"`
+	KeyFile    string           `yaml:"key_file"`
+	ACME       ACMEConfig       `yaml:"acme"` // instead of cert_file and key_file
+	ClientAuth ClientAuthConfig `yaml:"client_auth"`
+}
+
+// ClientAuthConfig requires client certificates on the TLS listeners (mTLS); it is disabled
+// when CAFile is empty
+type ClientAuthConfig struct {
+	CAFile     string                 `yaml:"ca_file"`    // PEM bundle of the CAs client certificates are verified against
+	Identities []ClientIdentityConfig `yaml:"identities"` // every verified certificate is accepted when empty
+}
+
+// ClientIdentityConfig grants client certificates with a matching name access to Vault paths
+// and registries
+type ClientIdentityConfig struct {
+	Names      []string `yaml:"names"`       // globs matched against the CN and DNS, email and URI SANs
+	VaultPaths []string `yaml:"vault_paths"` // Vault path globs, every path when empty
+	Registries []string `yaml:"registries"`  // registry host globs, every registry when empty
+}
+
+// ACMEConfig configures certificates obtained and renewed automatically from an ACME certificate
+// authority such as Let's Encrypt; it is enabled when Hosts is set
+type ACMEConfig struct {
+	Hosts        []string `yaml:"hosts"`         // hostnames certificates are requested for
+	Email        string   `yaml:"email"`         // contact for expiry and account notices
+	CacheDir     string   `yaml:"cache_dir"`     // keeps the account key and certificates across restarts
+	DirectoryURL string   `yaml:"directory_url"` // Let's Encrypt production when empty
+	HTTPPort     string   `yaml:"http_port"`     // HTTP-01 challenge listener, disabled when empty
+}
+
+// Enabled reports whether certificates are obtained through ACME
+func (a ACMEConfig) Enabled() bool {
+	return len(a.Hosts) > 0
+}
+
+// AdminConfig configures the optional admin listener; it is disabled when Port is empty
+type AdminConfig struct {
+	Address  string `yaml:"address"` // interface address of the admin and gRPC listeners, all interfaces when empty
+	Port     string `yaml:"port"`
+	GRPCPort string `yaml:"grpc_port"` // gRPC control-plane listener, disabled when empty
+	Token    string `yaml:"token"`
+}
+
+// MetricsConfig configures the Prometheus metrics listener, disabled when Port is empty
+type MetricsConfig struct {
+	Address string `yaml:"address"` // interface address, all interfaces when empty
+	Port    string `yaml:"port"`
+}
+
+// PprofConfig configures the pprof profiling listener, disabled when Port is empty
+type PprofConfig struct {
+	Address string `yaml:"address"` // interface address, loopback by default and all interfaces when empty
+	Port    string `yaml:"port"`
+}
+
+// LogConfig configures the proxy's logs
+type LogConfig struct {
+	Level  string `yaml:"level"`  // debug, info, warn or error
+	Format string `yaml:"format"` // text (logfmt) or json
+	Access bool   `yaml:"access"` // log every request served
+}
+
+// VaultConfig configures the Vault client
+type VaultConfig struct {
+	Address            string           `yaml:"address"`
+	Namespace          string           `yaml:"namespace"`            // Vault Enterprise namespace of the proxy, which client namespaces nest under
+	TokenCheckInterval Duration         `yaml:"token_check_interval"` // how often the proxy's own token is looked up, 0 disables
+	Alerts             VaultAlertConfig `yaml:"alerts"`
+	Auth               VaultAuthConfig  `yaml:"auth"`
+	KV                 KVConfig         `yaml:"kv"`
+}
+
+// KVConfig locates the KV secrets engine registry credentials are read from. Vault paths are
+// relative to Mount unless they start with a slash and name their own mount.
+type KVConfig struct {
+	Mount   string `yaml:"mount"`
+	Version string `yaml:"version"` // "1", "2" (the default) or "auto" to detect the version of each mount
+}
+
+// VaultAuthConfig configures how the proxy obtains its own Vault token
+type VaultAuthConfig struct {
+	Method        string           `yaml:"method"`         // token (VAULT_TOKEN, the default), approle, kubernetes, aws or jwt
+	TokenFile     string           `yaml:"token_file"`     // token method: read the token from this file, such as a Vault Agent sink, and reload it when it changes
+	SharedToken   bool             `yaml:"shared_token"`   // requests with an empty password use the proxy's own token
+	WrappedTokens bool             `yaml:"wrapped_tokens"` // accept wrapped:<wrapping_token> passwords, unwrapping them for the Vault token
+	Renew         bool             `yaml:"renew"`          // renew the proxy's own token before it expires (default true)
+	AppRole       AppRoleConfig    `yaml:"approle"`
+	Kubernetes    KubernetesConfig `yaml:"kubernetes"`
+	AWS           AWSAuthConfig    `yaml:"aws"`
+	JWT           JWTAuthConfig    `yaml:"jwt"`
+}
+
+// JWTAuthConfig configures logins with the JWT/OIDC auth method, presenting a workload identity
+// token read from a file
+type JWTAuthConfig struct {
+	Mount     string `yaml:"mount"`
+	Role      string `yaml:"role"`
+	TokenFile string `yaml:"token_file"`
+}
+
+// AWSAuthConfig configures logins with the iam type of the AWS auth method, using the AWS
+// credentials of the environment
+type AWSAuthConfig struct {
+	Mount    string `yaml:"mount"`
+	Role     string `yaml:"role"`      // defaults to the name of the IAM role or user
+	Region   string `yaml:"region"`    // STS region, the global endpoint when empty
+	ServerID string `yaml:"server_id"` // X-Vault-AWS-IAM-Server-ID header value
+}
+
+// KubernetesConfig configures logins with the Kubernetes auth method, using the service account
+// token of the pod
+type KubernetesConfig struct {
+	Mount     string `yaml:"mount"`
+	Role      string `yaml:"role"`
+	TokenFile string `yaml:"token_file"`
+}
+
+// AppRoleConfig configures AppRole logins, of the proxy itself with the approle method and of
+// clients sending approle:<role_id>:<secret_id> as password with ClientLogins
+type AppRoleConfig struct {
+	Mount        string `yaml:"mount"`
+	RoleID       string `yaml:"role_id"`
+	SecretID     string `yaml:"secret_id"`
+	SecretIDFile string `yaml:"secret_id_file"` // read at every login, instead of secret_id
+	ClientLogins bool   `yaml:"client_logins"`
+}
+
+// VaultAlertConfig configures the webhook notified when the share of Vault calls failing because
+// Vault is unavailable breaches a threshold; alerting is disabled when WebhookURL is empty
+type VaultAlertConfig struct {
+	WebhookURL string   `yaml:"webhook_url"`
+	ErrorRate  float64  `yaml:"error_rate"` // between 0 and 1
+	Window     Duration `yaml:"window"`
+	MinCalls   int      `yaml:"min_calls"` // calls needed within the window before alerting
+}
+
+// AuthConfig configures client authentication
+type AuthConfig struct {
+	Realm            string       `yaml:"realm"`
+	Service          string       `yaml:"service"`
+	Challenge        string       `yaml:"challenge"`          // bearer (default) or basic
+	LoginCheck       bool         `yaml:"login_check"`        // validate credentials on GET /v2/ (docker login)
+	LoginCheckSecret bool         `yaml:"login_check_secret"` // also read the Vault secret during login
+	APIKeys          APIKeyConfig `yaml:"api_keys"`
+	TokenServer      bool         `yaml:"token_server"` // serve registry tokens at /token, needs token.signing
+}
+
+// APIKeyConfig configures API keys stored hashed in Vault; they are disabled when Path is empty
+type APIKeyConfig struct {
+	Mount    string   `yaml:"mount"`     // KV v2 mount holding the keys
+	Path     string   `yaml:"path"`      // path under the mount, one secret per key hash
+	CacheTTL Duration `yaml:"cache_ttl"` // how long resolved keys are cached
+}
+
+// Enabled reports whether API key authentication is configured
+func (c APIKeyConfig) Enabled() bool {
+	return c.Path != ""
+}
+
+// CacheConfig configures the credential cache
+type CacheConfig struct {
+	TTL             Duration       `yaml:"ttl"` // 0 disables the cache
+	CleanupInterval Duration       `yaml:"cleanup_interval"`
+	RefreshBefore   Duration       `yaml:"refresh_before"` // renew short-lived registry tokens this long before expiry, 0 disables
+	RefreshIdle     Duration       `yaml:"refresh_idle"`   // stop renewing tokens unused for this long
+	NegativeTTL     Duration       `yaml:"negative_ttl"`   // remember secrets not found or denied this long, 0 disables
+	TTLRules        []CacheTTLRule `yaml:"ttl_rules"`      // first match overrides ttl
+	Backend         string         `yaml:"backend"`        // memory or redis
+	Redis           RedisConfig    `yaml:"redis"`
+}
+
+// CacheTTLRule sets the cache TTL of the credentials of a registry type, Vault path glob or both
+type CacheTTLRule struct {
+	Type string   `yaml:"type"` // registry type, any when empty
+	Path string   `yaml:"path"` // Vault path glob (* matches across /), any when empty
+	TTL  Duration `yaml:"ttl"`  // 0 does not cache matching credentials
+}
+
+// RedisConfig locates the Redis server of the redis cache backend
+type RedisConfig struct {
+	Address  string   `yaml:"address"` // host:port
+	Username string   `yaml:"username"`
+	Password string   `yaml:"password"`
+	DB       int      `yaml:"db"`
+	TLS      bool     `yaml:"tls"`
+	CAFile   string   `yaml:"ca_file"` // PEM bundle of the CAs the server certificate is verified against, the system CAs when empty
+	Prefix   string   `yaml:"prefix"`  // prepended to the keys
+	Timeout  Duration `yaml:"timeout"` // per command
+}
+
+// CacheControlConfig sets Cache-Control and Expires headers on successful registry responses;
+// the first matching rule applies and upstream headers are kept when none matches
+type CacheControlConfig struct {
+	Rules []CacheControlRule `yaml:"rules"`
+}
+
+// CacheControlRule describes the caching headers of a kind of response
+type CacheControlRule struct {
+	Route        string   `yaml:"route"`         // catalog, tags, manifests, blobs or * (default)
+	Reference    string   `yaml:"reference"`     // digest or tag, for manifests and blobs; any when empty
+	ContentType  string   `yaml:"content_type"`  // media type glob, any when empty
+	CacheControl string   `yaml:"cache_control"` // Cache-Control value
+	Expires      Duration `yaml:"expires"`       // also set Expires this far in the future
+}
+
+// DevConfig configures dev mode with embedded Vault and registry
+type DevConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Fixture string `yaml:"fixture"`
+}
+
+// ChaosConfig configures fault injection for resilience testing
+type ChaosConfig struct {
+	Enabled bool        `yaml:"enabled"`
+	Rules   []ChaosRule `yaml:"rules"`
+}
+
+// ChaosRule injects a fault into a percentage of matching requests
+type ChaosRule struct {
+	Route    string   `yaml:"route"`    // catalog, tags, manifests, blobs or * (default)
+	Registry string   `yaml:"registry"` // registry host glob, * (default) matches every registry
+	Percent  float64  `yaml:"percent"`  // share of matching requests affected, 0-100
+	Action   string   `yaml:"action"`   // latency, error, throttle or drop
+	Latency  Duration `yaml:"latency"`  // delay for the latency action
+	Status   int      `yaml:"status"`   // status code for the error action (default 503)
+}
+
+// AccessConfig restricts registry access by Vault identity group membership. It is disabled
+// when no group rules are configured.
+type AccessConfig struct {
+	Groups        []GroupAccessRule    `yaml:"groups"`
+	GroupCacheTTL Duration             `yaml:"group_cache_ttl"` // how long token group memberships are cached
+	Policies      []AccessPolicyConfig `yaml:"policies"`
+	Environments  []EnvironmentConfig  `yaml:"environments"`
+}
+
+// AccessPolicyConfig restricts matching requests to time windows and source environments
+type AccessPolicyConfig struct {
+	Name         string             `yaml:"name"`
+	Registries   []string           `yaml:"registries"`   // registry host globs
+	Repositories []string           `yaml:"repositories"` // repository globs, every repository when empty
+	Actions      []string           `yaml:"actions"`      // pull, push or delete, every action when empty
+	Windows      []TimeWindowConfig `yaml:"windows"`      // allowed time windows, any time when empty
+	Environments []string           `yaml:"environments"` // allowed source environments, any source when empty
+}
+
+// TimeWindowConfig is a daily time range, e.g. a deploy window
+type TimeWindowConfig struct {
+	Days     []string `yaml:"days"`     // mon..sun, every day when empty
+	Start    string   `yaml:"start"`    // HH:MM
+	End      string   `yaml:"end"`      // HH:MM, before start for windows spanning midnight
+	Timezone string   `yaml:"timezone"` // IANA time zone, UTC when empty
+}
+
+// EnvironmentConfig labels requests from the given networks as a source environment
+type EnvironmentConfig struct {
+	Name     string   `yaml:"name"`
+	Networks []string `yaml:"networks"` // CIDRs or single addresses
+}
+
+// GroupAccessRule grants the members of a Vault identity group access to registries and
+// repositories
+type GroupAccessRule struct {
+	Group        string   `yaml:"group"`
+	Registries   []string `yaml:"registries"`   // registry host globs
+	Repositories []string `yaml:"repositories"` // repository globs, every repository when empty
+}
+
+// UpstreamConfig configures connections to upstream registries
+type UpstreamConfig struct {
+	Pins         []CertificatePin  `yaml:"pins"`
+	AllowedHosts []string          `yaml:"allowed_hosts"` // host globs; when set, no other host is dialed
+	RateLimit    RateLimitConfig   `yaml:"rate_limit"`
+	Probe        ProbeConfig       `yaml:"probe"`
+	OCILayouts   []OCILayoutConfig `yaml:"oci_layouts"`
+	// BlobRedirects is follow (default) to stream redirected blobs through the proxy, or client to
+	// return the redirects to clients
+	BlobRedirects string           `yaml:"blob_redirects"`
+	HTTP2         bool             `yaml:"http2"` // negotiate HTTP/2 with upstream registries over TLS
+	Timeouts      UpstreamTimeouts `yaml:"timeouts"`
+	Pool          PoolConfig       `yaml:"pool"`
+	// Proxies route the connections to matching hosts through outbound proxies; other hosts use
+	// HTTPS_PROXY, HTTP_PROXY and NO_PROXY
+	Proxies []ProxyConfig `yaml:"proxies"`
+	Retry   RetryConfig   `yaml:"retry"`
+	// FlushInterval is how often data streamed from registries, such as blobs, is flushed to
+	// clients; 0 leaves it to the server's buffers, a negative value flushes every write
+	FlushInterval Duration `yaml:"flush_interval"`
+}
+
+// RetryConfig retries GET and HEAD requests to upstream registries failing with 502, 503, 504 or a
+// network error
+type RetryConfig struct {
+	MaxRetries     int      `yaml:"max_retries"`     // retries per request, 0 disables
+	InitialBackoff Duration `yaml:"initial_backoff"` // delay before the first retry, doubled for each next one
+	MaxBackoff     Duration `yaml:"max_backoff"`     // upper bound of the delay between retries
+	Budget         Duration `yaml:"budget"`          // time a request may spend retrying, 0 for no limit
+}
+
+// ProxyConfig sends the connections to hosts matching one of its globs through an outbound proxy
+type ProxyConfig struct {
+	Hosts []string `yaml:"hosts"` // host globs, such as "*.dkr.ecr.*.amazonaws.com"
+	URL   string   `yaml:"url"`   // http, https, socks5 or socks5h proxy URL, or direct for no proxy
+}
+
+// PoolConfig sizes the pools of connections to upstream registries, kept open so concurrent pulls
+// reuse connections instead of dialing one per request
+type PoolConfig struct {
+	MaxIdleConns        int      `yaml:"max_idle_conns"`          // idle connections kept across all hosts, 0 for no limit
+	MaxIdleConnsPerHost int      `yaml:"max_idle_conns_per_host"` // idle connections kept per host
+	MaxConnsPerHost     int      `yaml:"max_conns_per_host"`      // connections per host, 0 for no limit
+	KeepAlive           Duration `yaml:"keep_alive"`              // interval of TCP keep-alive probes, 0 disables them
+	// PerRegistry gives each registry host its own pool, so a slow registry holding its
+	// connections cannot exhaust the limits of the others
+	PerRegistry bool `yaml:"per_registry"`
+}
+
+// UpstreamTimeouts bound the connections to upstream registries and their token services, so a
+// hung registry fails requests instead of holding them; zero disables a timeout
+type UpstreamTimeouts struct {
+	Dial           Duration `yaml:"dial"`            // to connect
+	TLSHandshake   Duration `yaml:"tls_handshake"`   // to complete the TLS handshake
+	ResponseHeader Duration `yaml:"response_header"` // from the end of a request to the response headers
+	Idle           Duration `yaml:"idle"`            // before closing an idle keep-alive connection
+}
+
+// OCILayoutConfig serves a directory in OCI image-layout format as a read-only registry
+type OCILayoutConfig struct {
+	Path        string   `yaml:"path"`
+	Host        string   `yaml:"host"`         // registry host served from the directory
+	Repository  string   `yaml:"repository"`   // repository of images named only by a tag, defaults to the directory name
+	FallbackFor []string `yaml:"fallback_for"` // upstream hosts served from the directory when unreachable
+}
+
+// RateLimitConfig configures how upstream 429 responses with Retry-After are handled
+type RateLimitConfig struct {
+	RetryBudget Duration `yaml:"retry_budget"` // retry within this time instead of failing, 0 disables
+	MaxQueued   int      `yaml:"max_queued"`   // requests waiting for a retry at once
+}
+
+// ProbeConfig configures the background health probes of upstream registries
+type ProbeConfig struct {
+	Interval   Duration `yaml:"interval"`   // time between probes, 0 disables
+	Timeout    Duration `yaml:"timeout"`    // how long a probe request may take
+	Registries []string `yaml:"registries"` // proxy-style usernames probed with credentials
+}
+
+// CertificatePin lists the certificate hashes accepted for an upstream registry
+type CertificatePin struct {
+	Registry string   `yaml:"registry"` // registry host name
+	Hashes   []string `yaml:"hashes"`   // sha256/<base64 SPKI hash> or sha256:<hex certificate fingerprint>
+}
+
+// ExecConfig configures the exec registry type, which runs an external helper to turn Vault
+// secret data into registry credentials; the type is disabled when Command is empty
+type ExecConfig struct {
+	Command string   `yaml:"command"` // helper binary, looked up in PATH when not absolute
+	Args    []string `yaml:"args"`
+	Timeout Duration `yaml:"timeout"` // how long the helper may run
+}
+
+// ECRConfig configures the ecr registry type
+type ECRConfig struct {
+	// DefaultCredentials exchanges secrets holding no access keys, or only a role_arn, with the
+	// proxy's own AWS credentials, found like the AWS SDKs do
+	DefaultCredentials bool `yaml:"default_credentials"`
+}
+
+// ControllerConfig configures the Kubernetes controller mode, which watches RegistryConfig
+// resources and applies their registry aliases and group access rules live
+type ControllerConfig struct {
+	Enabled   bool   `yaml:"enabled"`
+	Namespace string `yaml:"namespace"` // namespace watched, the pod's own when empty
+}
+
+// DebugConfig configures debug capture, which logs full exchanges with credentials redacted
+type DebugConfig struct {
+	Repositories []string `yaml:"repositories"`  // repository globs always captured
+	MaxBodySize  int      `yaml:"max_body_size"` // body bytes logged per request or response, 0 logs no bodies
+}
+
+// SizeLimitConfig caps the size of content pulled through the proxy; zero disables a limit
+type SizeLimitConfig struct {
+	MaxBlobSize  ByteSize `yaml:"max_blob_size"`  // size of a single blob
+	MaxImageSize ByteSize `yaml:"max_image_size"` // config and layer sizes listed in an image manifest
+}
+
+// BlobCacheConfig configures the pull-through blob cache; it is disabled when neither Dir nor
+// S3.Bucket is set
+type BlobCacheConfig struct {
+	Dir     string            `yaml:"dir"`      // blob store, or temporary downloads with an S3 bucket
+	MaxSize ByteSize          `yaml:"max_size"` // least recently used blobs are removed beyond it
+	S3      BlobCacheS3Config `yaml:"s3"`
+}
+
+// Enabled reports whether the blob cache is configured
+func (c BlobCacheConfig) Enabled() bool {
+	return c.Dir != "" || c.S3.Bucket != ""
+}
+
+// BlobCacheS3Config stores the blob cache in an S3 or S3-compatible bucket shared by replicas
+type BlobCacheS3Config struct {
+	Bucket    string `yaml:"bucket"`
+	Prefix    string `yaml:"prefix"`
+	Region    string `yaml:"region"`     // defaults to AWS_REGION
+	Endpoint  string `yaml:"endpoint"`   // S3-compatible endpoint such as MinIO
+	PathStyle bool   `yaml:"path_style"` // bucket in the path rather than the host name
+	SSE       string `yaml:"sse"`        // server-side encryption: AES256 or aws:kms
+	KMSKeyID  string `yaml:"kms_key_id"`
+}
+
+// ManifestCacheConfig configures the in-memory manifest cache
+type ManifestCacheConfig struct {
+	Enabled bool     `yaml:"enabled"`
+	MaxSize ByteSize `yaml:"max_size"` // least recently used manifests are removed beyond it
+	TagTTL  Duration `yaml:"tag_ttl"`  // how long a tag resolution is used before it is revalidated
+}
+
+// NotationConfig enables the verification of Notation signatures before manifests are served;
+// it is disabled when TrustPolicy is empty
+type NotationConfig struct {
+	TrustPolicy string   `yaml:"trust_policy"` // trustpolicy.json, as used by the notation CLI
+	TrustStore  string   `yaml:"trust_store"`  // directory of x509/<type>/<name>/ certificates, truststore next to the policy when empty
+	CacheTTL    Duration `yaml:"cache_ttl"`    // how long a verified manifest is served without verifying it again
+}
+
+// ImagePolicyConfig enables the image allow/deny policy; it is disabled when File is empty
+type ImagePolicyConfig struct {
+	File string `yaml:"file"` // YAML policy file, reloaded when it changes
+}
+
+// PullStatsConfig configures persistent pull statistics; they are disabled when File is empty
+type PullStatsConfig struct {
+	File          string   `yaml:"file"`           // bbolt database
+	FlushInterval Duration `yaml:"flush_interval"` // how often recorded pulls are written
+}
+
+// AuditConfig configures the audit log of credential resolutions; it is disabled when neither
+// File nor Syslog is set
+type AuditConfig struct {
+	File   string `yaml:"file"`   // JSON lines file, appended to
+	Syslog string `yaml:"syslog"` // "local", udp://host:port or tcp://host:port
+}
+
+// RecordConfig configures request recording; it is disabled when File is empty
+type RecordConfig struct {
+	File   string `yaml:"file"`
+	Bodies bool   `yaml:"bodies"` // also store bodies of non-blob requests
+}
+
+// TokenConfig configures the keys that sign tokens issued by the proxy
+type TokenConfig struct {
+	Issuer     string             `yaml:"issuer"`
+	AccessTTL  Duration           `yaml:"access_ttl"`  // lifetime of access tokens
+	RefreshTTL Duration           `yaml:"refresh_ttl"` // maximum lifetime of refresh tokens
+	Signing    TokenSigningConfig `yaml:"signing"`
+}
+
+// TokenSigningConfig selects the signing key source; signing is disabled when neither PEMFile
+// nor TransitKey is set
+type TokenSigningConfig struct {
+	PEMFile        string   `yaml:"pem_file"`        // PEM bundle, the first private key signs
+	TransitKey     string   `yaml:"transit_key"`     // Vault Transit key name
+	TransitMount   string   `yaml:"transit_mount"`   // Vault Transit mount path
+	Overlap        Duration `yaml:"overlap"`         // how long retired keys keep verifying tokens
+	ReloadInterval Duration `yaml:"reload_interval"` // how often the key set is refreshed
+}
+
+// Enabled reports whether a signing key source is configured
+func (c TokenSigningConfig) Enabled() bool {
+	return c.PEMFile != "" || c.TransitKey != ""
+}
+
+// Duration is a time.Duration that unmarshals from Go duration strings such as "5m" or "90s"
+type Duration time.Duration
+
+// UnmarshalYAML implements yaml.Unmarshaler
+func (d *Duration) UnmarshalYAML(value *yaml.Node) error {
+	parsed, err := time.ParseDuration(value.Value)
+	if err != nil {
+		// Returning a TypeError lets the decoder keep collecting errors for the rest of the file
+		return &yaml.TypeError{Errors: []string{
+			fmt.Sprintf("line %d: invalid duration %q, expected a value such as \"30s\" or \"5m\"", value.Line, value.Value),
+		}}
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// MarshalYAML implements yaml.Marshaler
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return time.Duration(d).String(), nil
+}
+
+// Duration returns the value as a time.Duration
+func (d Duration) Duration() time.Duration {
+	return time.Duration(d)
+}
+
+// ByteSize is a number of bytes that unmarshals from integers or sizes such as "512MB" or "2GiB"
+type ByteSize int64
+
+// byteUnits are the suffixes accepted by ByteSize, longest first so "MiB" is not read as "B"
+var byteUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+	{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+	{"B", 1},
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler
+func (b *ByteSize) UnmarshalYAML(value *yaml.Node) error {
+	number, multiplier := strings.TrimSpace(value.Value), int64(1)
+	for _, unit := range byteUnits {
+		if trimmed, ok := strings.CutSuffix(number, unit.suffix); ok {
+			number, multiplier = strings.TrimSpace(trimmed), unit.size
+			break
+		}
+	}
+	parsed, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || parsed < 0 || parsed > (1<<63-1)/multiplier {
+		return &yaml.TypeError{Errors: []string{
+			fmt.Sprintf("line %d: invalid size %q, expected a value such as \"512MB\" or \"2GiB\"", value.Line, value.Value),
+		}}
+	}
+	*b = ByteSize(parsed * multiplier)
+	return nil
+}
+
+// MarshalYAML implements yaml.Marshaler
+func (b ByteSize) MarshalYAML() (interface{}, error) {
+	return b.String(), nil
+}
+
+// String formats the size with the largest binary unit dividing it exactly
+func (b ByteSize) String() string {
+	for i := 3; i >= 0; i-- { // binary units, largest first
+		unit := byteUnits[i]
+		if b != 0 && int64(b)%unit.size == 0 {
+			return fmt.Sprintf("%d%s", int64(b)/unit.size, unit.suffix)
+		}
+	}
+	return strconv.FormatInt(int64(b), 10)
+}
+
+// Default returns the configuration used when no file or environment overrides are present
+func Default() *Config {
+	return &Config{
+		Listen: ListenConfig{
+			Port:       DefaultPort,
+			Network:    DefaultNetwork,
+			SocketMode: DefaultSocketMode,
+			HTTP2:      true,
+			Timeouts: ServerTimeouts{
+				ReadHeader: Duration(DefaultReadHeaderTimeout),
+				Idle:       Duration(DefaultIdleTimeout),
+			},
+		},
+		Log:   LogConfig{Level: DefaultLogLevel, Format: DefaultLogFormat, Access: true},
+		Pprof: PprofConfig{Address: DefaultPprofAddress},
+		Vault: VaultConfig{
+			Address:            DefaultVaultAddr,
+			TokenCheckInterval: Duration(DefaultTokenCheckInterval),
+			Alerts: VaultAlertConfig{
+				ErrorRate: DefaultAlertErrorRate,
+				Window:    Duration(DefaultAlertWindow),
+				MinCalls:  DefaultAlertMinCalls,
+			},
+			Auth: VaultAuthConfig{
+				Method:  DefaultVaultAuthMethod,
+				Renew:   true,
+				AppRole: AppRoleConfig{Mount: "approle"},
+				Kubernetes: KubernetesConfig{
+					Mount:     "kubernetes",
+					TokenFile: DefaultServiceAccountTokenFile,
+				},
+				AWS: AWSAuthConfig{Mount: "aws"},
+				JWT: JWTAuthConfig{Mount: "jwt"},
+			},
+			KV: KVConfig{Mount: "secret", Version: "2"},
+		},
+		Auth: AuthConfig{
+			Realm:      DefaultRealm,
+			Service:    DefaultService,
+			Challenge:  "bearer",
+			LoginCheck: true,
+			APIKeys: APIKeyConfig{
+				Mount:    "secret",
+				CacheTTL: Duration(DefaultAPIKeyCacheTTL),
+			},
+		},
+		Cache: CacheConfig{
+			TTL:             Duration(DefaultCacheTTL),
+			CleanupInterval: Duration(DefaultCleanupInterval),
+			RefreshBefore:   Duration(DefaultRefreshBefore),
+			RefreshIdle:     Duration(DefaultRefreshIdle),
+			NegativeTTL:     Duration(DefaultNegativeTTL),
+			Backend:         "memory",
+			Redis: RedisConfig{
+				Prefix:  DefaultRedisPrefix,
+				Timeout: Duration(DefaultRedisTimeout),
+			},
+		},
+		Access: AccessConfig{
+			GroupCacheTTL: Duration(DefaultGroupCacheTTL),
+		},
+		Upstream: UpstreamConfig{
+			RateLimit:     RateLimitConfig{MaxQueued: DefaultMaxQueued},
+			Probe:         ProbeConfig{Timeout: Duration(DefaultProbeTimeout)},
+			BlobRedirects: "follow",
+			HTTP2:         true,
+			Timeouts: UpstreamTimeouts{
+				Dial:           Duration(DefaultDialTimeout),
+				TLSHandshake:   Duration(DefaultTLSHandshakeTimeout),
+				ResponseHeader: Duration(DefaultResponseHeaderTimeout),
+				Idle:           Duration(DefaultUpstreamIdleTimeout),
+			},
+			Pool: PoolConfig{
+				MaxIdleConns:        DefaultMaxIdleConns,
+				MaxIdleConnsPerHost: DefaultMaxIdleConnsPerHost,
+				KeepAlive:           Duration(DefaultKeepAlive),
+			},
+			FlushInterval: Duration(DefaultFlushInterval),
+			Retry: RetryConfig{
+				InitialBackoff: Duration(DefaultInitialBackoff),
+				MaxBackoff:     Duration(DefaultMaxBackoff),
+				Budget:         Duration(DefaultRetryBudget),
+			},
+		},
+		Exec: ExecConfig{
+			Timeout: Duration(DefaultExecTimeout),
+		},
+		Debug: DebugConfig{
+			MaxBodySize: DefaultDebugMaxBodySize,
+		},
+		BlobCache: BlobCacheConfig{
+			MaxSize: ByteSize(DefaultBlobCacheMaxSize),
+		},
+		ManifestCache: ManifestCacheConfig{
+			MaxSize: ByteSize(DefaultManifestCacheMaxSize),
+			TagTTL:  Duration(DefaultManifestCacheTagTTL),
+		},
+		Notation: NotationConfig{
+			CacheTTL: Duration(DefaultNotationCacheTTL),
+		},
+		PullStats: PullStatsConfig{
+			FlushInterval: Duration(DefaultPullStatsFlushInterval),
+		},
+		Token: TokenConfig{
+			Issuer:     DefaultTokenIssuer,
+			AccessTTL:  Duration(DefaultAccessTokenTTL),
+			RefreshTTL: Duration(DefaultRefreshTokenTTL),
+			Signing: TokenSigningConfig{
+				TransitMount:   "transit",
+				Overlap:        Duration(DefaultKeyOverlap),
+				ReloadInterval: Duration(DefaultKeyReloadInterval),
+			},
+		},
+	}
+}
+
+// Listeners returns the data-plane listeners, the main one first, with inherited values set
+func (c *Config) Listeners() []ListenerConfig {
+	listeners := []ListenerConfig{{Address: c.Listen.Address, Port: c.Listen.Port, Network: c.Listen.Network, SocketMode: c.Listen.SocketMode, TLS: c.TLS.Enabled}}
+	for _, listener := range c.Listen.Additional {
+		if listener.Network == "" {
+			listener.Network = c.Listen.Network
+		}
+		// A socket path is no interface address, and the other way round
+		if listener.Address == "" && listener.Unix() == (c.Listen.Network == "unix") {
+			listener.Address = c.Listen.Address
+		}
+		if listener.SocketMode == "" {
+			listener.SocketMode = c.Listen.SocketMode
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners
+}
+
+// validateBind checks a listener network and interface address
+func validateBind(network, address string) error {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	case "unix":
+		if address == "" {
+			return errors.New("address must be the path of the socket for network unix")
+		}
+		return nil
+	default:
+		return fmt.Errorf("network %q must be tcp, tcp4, tcp6 or unix", network)
+	}
+	if address == "" {
+		return nil
+	}
+	ip := net.ParseIP(address)
+	switch {
+	case ip == nil && strings.ContainsAny(address, ":[]/"):
+		return fmt.Errorf("address %q must be an IP address or host name, without port", address)
+	case ip != nil && network == "tcp4" && ip.To4() == nil:
+		return fmt.Errorf("address %s is not an IPv4 address, as required by network tcp4", address)
+	case ip != nil && network == "tcp6" && ip.To4() != nil:
+		return fmt.Errorf("address %s is not an IPv6 address, as required by network tcp6", address)
+	}
+	return nil
+}
+
+// Redacted returns a copy of the configuration with secrets replaced, for display
+func (c *Config) Redacted() *Config {
+	redacted := *c
+	if redacted.Admin.Token != "" {
+		redacted.Admin.Token = "[redacted]"
+	}
+	// Webhook URLs commonly embed their credentials
+	if redacted.Vault.Alerts.WebhookURL != "" {
+		redacted.Vault.Alerts.WebhookURL = "[redacted]"
+	}
+	if redacted.Vault.Auth.AppRole.SecretID != "" {
+		redacted.Vault.Auth.AppRole.SecretID = "[redacted]"
+	}
+	if redacted.Cache.Redis.Password != "" {
+		redacted.Cache.Redis.Password = "[redacted]"
+	}
+	return &redacted
+}
+
+// Load builds the effective configuration from defaults, the YAML file at path (if non-empty)
+// and environment variable overrides
+func Load(path string) (*Config, error) {
+	cfg := Default()
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config file: %v", err)
+		}
+		if err := decode(data, cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	cfg.applyEnv()
+	return cfg, nil
+}
+
+// decode strictly decodes YAML into cfg, rejecting unknown keys
+func decode(data []byte, cfg *Config) error {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil && err != io.EOF {
+		var typeErr *yaml.TypeError
+		if errors.As(err, &typeErr) {
+			return &ValidationErrors{Errors: typeErr.Errors}
+		}
+		return fmt.Errorf("%w: %v", ErrInvalidConfig, err)
+	}
+	return nil
+}
+
+// applyEnv overrides configuration values with the supported environment variables
+func (c *Config) applyEnv() {
+	if port := os.Getenv("PORT"); port != "" {
+		c.Listen.Port = port
+	}
+	if address := os.Getenv("LISTEN_ADDRESS"); address != "" {
+		c.Listen.Address = address
+	}
+	if network := os.Getenv("LISTEN_NETWORK"); network != "" {
+		c.Listen.Network = network
+	}
+	if listen := os.Getenv("LISTEN"); listen != "" {
+		c.Listen.applyURL(listen)
+	}
+	if socketMode := os.Getenv("LISTEN_SOCKET_MODE"); socketMode != "" {
+		c.Listen.SocketMode = socketMode
+	}
+	if vaultAddr := os.Getenv("VAULT_ADDR"); vaultAddr != "" {
+		c.Vault.Address = vaultAddr
+	}
+	if namespace := os.Getenv("VAULT_NAMESPACE"); namespace != "" {
+		c.Vault.Namespace = namespace
+	}
+	if tokenFile := os.Getenv("VAULT_TOKEN_FILE"); tokenFile != "" {
+		c.Vault.Auth.TokenFile = tokenFile
+	}
+	if method := os.Getenv("VAULT_AUTH_METHOD"); method != "" {
+		c.Vault.Auth.Method = method
+	}
+	if roleID := os.Getenv("VAULT_ROLE_ID"); roleID != "" {
+		c.Vault.Auth.AppRole.RoleID = roleID
+	}
+	if secretID := os.Getenv("VAULT_SECRET_ID"); secretID != "" {
+		c.Vault.Auth.AppRole.SecretID = secretID
+	}
+	if secretIDFile := os.Getenv("VAULT_SECRET_ID_FILE"); secretIDFile != "" {
+		c.Vault.Auth.AppRole.SecretIDFile = secretIDFile
+	}
+	if role := os.Getenv("VAULT_KUBERNETES_ROLE"); role != "" {
+		c.Vault.Auth.Kubernetes.Role = role
+	}
+	if role := os.Getenv("VAULT_AWS_ROLE"); role != "" {
+		c.Vault.Auth.AWS.Role = role
+	}
+	if tokenFile := os.Getenv("VAULT_JWT_PATH"); tokenFile != "" {
+		c.Vault.Auth.JWT.TokenFile = tokenFile
+	}
+	if role := os.Getenv("VAULT_JWT_ROLE"); role != "" {
+		c.Vault.Auth.JWT.Role = role
+	}
+	if mount := os.Getenv("VAULT_KV_MOUNT"); mount != "" {
+		c.Vault.KV.Mount = mount
+	}
+	if version := os.Getenv("VAULT_KV_VERSION"); version != "" {
+		c.Vault.KV.Version = version
+	}
+	if renew, err := strconv.ParseBool(os.Getenv("VAULT_TOKEN_RENEW")); err == nil {
+		c.Vault.Auth.Renew = renew
+	}
+	if wrapped, err := strconv.ParseBool(os.Getenv("VAULT_WRAPPED_TOKENS")); err == nil {
+		c.Vault.Auth.WrappedTokens = wrapped
+	}
+	if sharedToken, err := strconv.ParseBool(os.Getenv("VAULT_SHARED_TOKEN")); err == nil {
+		c.Vault.Auth.SharedToken = sharedToken
+	}
+	if adminAddress := os.Getenv("ADMIN_ADDRESS"); adminAddress != "" {
+		c.Admin.Address = adminAddress
+	}
+	if adminPort := os.Getenv("ADMIN_PORT"); adminPort != "" {
+		c.Admin.Port = adminPort
+	}
+	if grpcPort := os.Getenv("ADMIN_GRPC_PORT"); grpcPort != "" {
+		c.Admin.GRPCPort = grpcPort
+	}
+	if metricsPort := os.Getenv("METRICS_PORT"); metricsPort != "" {
+		c.Metrics.Port = metricsPort
+	}
+	if certFile := os.Getenv("TLS_CERT_FILE"); certFile != "" {
+		c.TLS.Enabled = true
+		c.TLS.CertFile = certFile
+	}
+	if keyFile := os.Getenv("TLS_KEY_FILE"); keyFile != "" {
+		c.TLS.Enabled = true
+		c.TLS.KeyFile = keyFile
+	}
+	if acmeHosts := os.Getenv("TLS_ACME_HOSTS"); acmeHosts != "" {
+		c.TLS.Enabled = true
+		c.TLS.ACME.Hosts = nil
+		for _, host := range strings.Split(acmeHosts, ",") {
+			if host = strings.TrimSpace(host); host != "" {
+				c.TLS.ACME.Hosts = append(c.TLS.ACME.Hosts, host)
+			}
+		}
+	}
+	if clientCAFile := os.Getenv("TLS_CLIENT_CA_FILE"); clientCAFile != "" {
+		c.TLS.ClientAuth.CAFile = clientCAFile
+	}
+	if acmeEmail := os.Getenv("TLS_ACME_EMAIL"); acmeEmail != "" {
+		c.TLS.ACME.Email = acmeEmail
+	}
+	if acmeCacheDir := os.Getenv("TLS_ACME_CACHE_DIR"); acmeCacheDir != "" {
+		c.TLS.ACME.CacheDir = acmeCacheDir
+	}
+	if pprofAddress := os.Getenv("PPROF_ADDRESS"); pprofAddress != "" {
+		c.Pprof.Address = pprofAddress
+	}
+	if pprofPort := os.Getenv("PPROF_PORT"); pprofPort != "" {
+		c.Pprof.Port = pprofPort
+	}
+	if level := os.Getenv("LOG_LEVEL"); level != "" {
+		c.Log.Level = level
+	}
+	if format := os.Getenv("LOG_FORMAT"); format != "" {
+		c.Log.Format = format
+	}
+	if h2c, err := strconv.ParseBool(os.Getenv("LISTEN_H2C")); err == nil {
+		c.Listen.H2C = h2c
+	}
+	if perRegistry, err := strconv.ParseBool(os.Getenv("UPSTREAM_POOL_PER_REGISTRY")); err == nil {
+		c.Upstream.Pool.PerRegistry = perRegistry
+	}
+	if maxRetries, err := strconv.Atoi(os.Getenv("UPSTREAM_MAX_RETRIES")); err == nil {
+		c.Upstream.Retry.MaxRetries = maxRetries
+	}
+	if access, err := strconv.ParseBool(os.Getenv("LOG_ACCESS")); err == nil {
+		c.Log.Access = access
+	}
+	if adminToken := os.Getenv("ADMIN_TOKEN"); adminToken != "" {
+		c.Admin.Token = adminToken
+	}
+	if recordFile := os.Getenv("RECORD_FILE"); recordFile != "" {
+		c.Record.File = recordFile
+	}
+	if pullStatsFile := os.Getenv("PULL_STATS_FILE"); pullStatsFile != "" {
+		c.PullStats.File = pullStatsFile
+	}
+	if auditFile := os.Getenv("AUDIT_FILE"); auditFile != "" {
+		c.Audit.File = auditFile
+	}
+	if auditSyslog := os.Getenv("AUDIT_SYSLOG"); auditSyslog != "" {
+		c.Audit.Syslog = auditSyslog
+	}
+	if blobCacheDir := os.Getenv("BLOB_CACHE_DIR"); blobCacheDir != "" {
+		c.BlobCache.Dir = blobCacheDir
+	}
+	if c.BlobCache.S3.Region == "" {
+		// Only a fallback, as the bucket's region does not follow the proxy's
+		c.BlobCache.S3.Region = os.Getenv("AWS_REGION")
+	}
+	if cacheTTL, err := time.ParseDuration(os.Getenv("CACHE_TTL")); err == nil {
+		c.Cache.TTL = Duration(cacheTTL)
+	}
+	if cleanupInterval, err := time.ParseDuration(os.Getenv("CACHE_CLEANUP_INTERVAL")); err == nil {
+		c.Cache.CleanupInterval = Duration(cleanupInterval)
+	}
+	if cacheBackend := os.Getenv("CACHE_BACKEND"); cacheBackend != "" {
+		c.Cache.Backend = cacheBackend
+	}
+	if redisAddr := os.Getenv("REDIS_ADDR"); redisAddr != "" {
+		c.Cache.Redis.Address = redisAddr
+	}
+	if redisPassword := os.Getenv("REDIS_PASSWORD"); redisPassword != "" {
+		c.Cache.Redis.Password = redisPassword
+	}
+	if manifestCache, err := strconv.ParseBool(os.Getenv("MANIFEST_CACHE")); err == nil {
+		c.ManifestCache.Enabled = manifestCache
+	}
+	if trustPolicy := os.Getenv("NOTATION_TRUST_POLICY"); trustPolicy != "" {
+		c.Notation.TrustPolicy = trustPolicy
+	}
+	if trustStore := os.Getenv("NOTATION_TRUST_STORE"); trustStore != "" {
+		c.Notation.TrustStore = trustStore
+	}
+	if imagePolicy := os.Getenv("IMAGE_POLICY_FILE"); imagePolicy != "" {
+		c.ImagePolicy.File = imagePolicy
+	}
+	if defaultCredentials, err := strconv.ParseBool(os.Getenv("ECR_DEFAULT_CREDENTIALS")); err == nil {
+		c.ECR.DefaultCredentials = defaultCredentials
+	}
+	if dryRun, err := strconv.ParseBool(os.Getenv("DRY_RUN")); err == nil {
+		c.DryRun = dryRun
+	}
+}
+
+// ValidationErrors collects every problem found in a configuration
+type ValidationErrors struct {
+	Errors []string
+}
+
+// Error implements the error interface
+func (e *ValidationErrors) Error() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%v:", ErrInvalidConfig)
+	for _, msg := range e.Errors {
+		fmt.Fprintf(&buf, "\n  - %s", msg)
+	}
+	return buf.String()
+}
+
+// Unwrap allows errors.Is(err, ErrInvalidConfig)
+func (e *ValidationErrors) Unwrap() error {
+	return ErrInvalidConfig
+}
+
+// add records a validation problem for the given key
+func (e *ValidationErrors) add(key, format string, args ...interface{}) {
+	e.Errors = append(e.Errors, key+": "+fmt.Sprintf(format, args...))
+}
+
+// Validate checks the configuration for invalid values and conflicting modes
+func (c *Config) Validate() error {
+	errs := &ValidationErrors{}
+
+	if port, err := strconv.Atoi(c.Listen.Port); c.Listen.Network != "unix" && (err != nil || port < 1 || port > 65535) {
+		errs.add("listen.port", "%q is not a valid TCP port (1-65535)", c.Listen.Port)
+	}
+	addrs := make(map[string]string)
+	for i, listener := range c.Listeners() {
+		key := "listen"
+		if i > 0 {
+			key = fmt.Sprintf("listen.additional[%d]", i-1)
+			if port, err := strconv.Atoi(listener.Port); !listener.Unix() && (err != nil || port < 1 || port > 65535) {
+				errs.add(key+".port", "%q is not a valid TCP port (1-65535)", listener.Port)
+			}
+			if listener.TLS && c.TLS.CertFile == "" && !c.TLS.ACME.Enabled() && !c.Dev.Enabled {
+				errs.add(key+".tls", "requires tls.cert_file or tls.acme unless dev mode is enabled")
+			}
+		}
+		if err := validateBind(listener.Network, listener.Address); err != nil {
+			errs.add(key, "%v", err)
+		}
+		if _, err := ParseSocketMode(listener.SocketMode); listener.Unix() && err != nil {
+			errs.add(key+".socket_mode", "%v", err)
+		}
+		if other, ok := addrs[listener.Addr()]; ok {
+			errs.add(key, "binds %s like %s", listener.Addr(), other)
+		}
+		addrs[listener.Addr()] = key
+	}
+	if err := validateBind(DefaultNetwork, c.Admin.Address); err != nil {
+		errs.add("admin.address", "%v", err)
+	}
+
+	if c.TLS.Enabled {
+		if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+			errs.add("tls", "cert_file and key_file must be set together")
+		}
+		if c.TLS.CertFile == "" && !c.TLS.ACME.Enabled() && !c.Dev.Enabled {
+			errs.add("tls.cert_file", "is required unless tls.acme is configured or dev mode is enabled (dev mode generates a self-signed certificate)")
+		}
+	}
+	if c.TLS.ClientAuth.CAFile != "" {
+		tlsListener := false
+		for _, listener := range c.Listeners() {
+			tlsListener = tlsListener || listener.TLS
+		}
+		if !tlsListener {
+			errs.add("tls.client_auth.ca_file", "requires a TLS listener")
+		}
+	} else if len(c.TLS.ClientAuth.Identities) > 0 {
+		errs.add("tls.client_auth.identities", "require tls.client_auth.ca_file")
+	}
+	for i, identity := range c.TLS.ClientAuth.Identities {
+		if len(identity.Names) == 0 {
+			errs.add(fmt.Sprintf("tls.client_auth.identities[%d].names", i), "must not be empty")
+		}
+	}
+	if c.TLS.ACME.Enabled() {
+		if c.TLS.CertFile != "" {
+			errs.add("tls.acme", "cannot be combined with tls.cert_file")
+		}
+		for i, host := range c.TLS.ACME.Hosts {
+			if host == "" || strings.ContainsAny(host, ":/*") {
+				errs.add(fmt.Sprintf("tls.acme.hosts[%d]", i), "%q must be a hostname", host)
+			}
+		}
+		if c.TLS.ACME.CacheDir == "" {
+			errs.add("tls.acme.cache_dir", "is required, so certificates survive restarts without hitting CA rate limits")
+		}
+		if c.TLS.ACME.DirectoryURL != "" {
+			if u, err := url.Parse(c.TLS.ACME.DirectoryURL); err != nil || u.Scheme != "https" || u.Host == "" {
+				errs.add("tls.acme.directory_url", "%q must be an absolute https:// URL", c.TLS.ACME.DirectoryURL)
+			}
+		}
+		if c.TLS.ACME.HTTPPort != "" {
+			if port, err := strconv.Atoi(c.TLS.ACME.HTTPPort); err != nil || port < 1 || port > 65535 {
+				errs.add("tls.acme.http_port", "%q is not a valid TCP port (1-65535)", c.TLS.ACME.HTTPPort)
+			}
+			for _, listener := range c.Listeners() {
+				if listener.Port == c.TLS.ACME.HTTPPort {
+					errs.add("tls.acme.http_port", "must differ from the data-plane listener ports")
+					break
+				}
+			}
+		}
+	}
+
+	if c.Admin.Port != "" {
+		if port, err := strconv.Atoi(c.Admin.Port); err != nil || port < 1 || port > 65535 {
+			errs.add("admin.port", "%q is not a valid TCP port (1-65535)", c.Admin.Port)
+		}
+		if c.Admin.Port == c.Listen.Port {
+			errs.add("admin.port", "must differ from listen.port")
+		}
+		if c.Admin.Token == "" {
+			errs.add("admin.token", "is required when the admin listener is enabled")
+		}
+	}
+
+	if c.Admin.GRPCPort != "" {
+		if port, err := strconv.Atoi(c.Admin.GRPCPort); err != nil || port < 1 || port > 65535 {
+			errs.add("admin.grpc_port", "%q is not a valid TCP port (1-65535)", c.Admin.GRPCPort)
+		}
+		if c.Admin.GRPCPort == c.Listen.Port || c.Admin.GRPCPort == c.Admin.Port {
+			errs.add("admin.grpc_port", "must differ from listen.port and admin.port")
+		}
+		if c.Admin.Token == "" {
+			errs.add("admin.token", "is required when the gRPC control-plane listener is enabled")
+		}
+	}
+
+	switch strings.ToLower(c.Log.Level) {
+	case "debug", "info", "warn", "warning", "error":
+	default:
+		errs.add("log.level", "%q must be debug, info, warn or error", c.Log.Level)
+	}
+	if c.Log.Format != "text" && c.Log.Format != "json" {
+		errs.add("log.format", "%q must be text or json", c.Log.Format)
+	}
+
+	if c.Metrics.Port != "" {
+		if port, err := strconv.Atoi(c.Metrics.Port); err != nil || port < 1 || port > 65535 {
+			errs.add("metrics.port", "%q is not a valid TCP port (1-65535)", c.Metrics.Port)
+		}
+		if c.Metrics.Port == c.Listen.Port || c.Metrics.Port == c.Admin.Port || c.Metrics.Port == c.Admin.GRPCPort {
+			errs.add("metrics.port", "must differ from listen.port, admin.port and admin.grpc_port")
+		}
+	}
+	if c.Pprof.Port != "" {
+		if port, err := strconv.Atoi(c.Pprof.Port); err != nil || port < 1 || port > 65535 {
+			errs.add("pprof.port", "%q is not a valid TCP port (1-65535)", c.Pprof.Port)
+		}
+		if c.Pprof.Port == c.Listen.Port || c.Pprof.Port == c.Admin.Port || c.Pprof.Port == c.Admin.GRPCPort || c.Pprof.Port == c.Metrics.Port {
+			errs.add("pprof.port", "must differ from listen.port, admin.port, admin.grpc_port and metrics.port")
+		}
+	}
+
+	if !c.Dev.Enabled {
+		if u, err := url.Parse(c.Vault.Address); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs.add("vault.address", "%q must be an absolute http:// or https:// URL", c.Vault.Address)
+		}
+	}
+	if c.Vault.TokenCheckInterval < 0 {
+		errs.add("vault.token_check_interval", "must not be negative")
+	}
+	appRole := c.Vault.Auth.AppRole
+	if c.Vault.Auth.TokenFile != "" && c.Vault.Auth.Method != "token" {
+		errs.add("vault.auth.token_file", "is only used by the token method, not %s", c.Vault.Auth.Method)
+	}
+	switch c.Vault.Auth.Method {
+	case "token":
+	case "approle":
+		if appRole.RoleID == "" {
+			errs.add("vault.auth.approle.role_id", "is required by the approle method")
+		}
+		if (appRole.SecretID == "") == (appRole.SecretIDFile == "") {
+			errs.add("vault.auth.approle", "the approle method requires exactly one of secret_id and secret_id_file")
+		}
+	case "kubernetes":
+		if c.Vault.Auth.Kubernetes.Role == "" {
+			errs.add("vault.auth.kubernetes.role", "is required by the kubernetes method")
+		}
+		if strings.Trim(c.Vault.Auth.Kubernetes.Mount, "/") == "" {
+			errs.add("vault.auth.kubernetes.mount", "must not be empty")
+		}
+		if c.Vault.Auth.Kubernetes.TokenFile == "" {
+			errs.add("vault.auth.kubernetes.token_file", "must not be empty")
+		}
+	case "aws":
+		if strings.Trim(c.Vault.Auth.AWS.Mount, "/") == "" {
+			errs.add("vault.auth.aws.mount", "must not be empty")
+		}
+	case "jwt":
+		if c.Vault.Auth.JWT.TokenFile == "" {
+			errs.add("vault.auth.jwt.token_file", "is required by the jwt method")
+		}
+		if strings.Trim(c.Vault.Auth.JWT.Mount, "/") == "" {
+			errs.add("vault.auth.jwt.mount", "must not be empty")
+		}
+	default:
+		errs.add("vault.auth.method", "%q must be token, approle, kubernetes, aws or jwt", c.Vault.Auth.Method)
+	}
+	if (c.Vault.Auth.Method == "approle" || appRole.ClientLogins) && strings.Trim(appRole.Mount, "/") == "" {
+		errs.add("vault.auth.approle.mount", "must not be empty")
+	}
+	if strings.Trim(c.Vault.KV.Mount, "/") == "" {
+		errs.add("vault.kv.mount", "must not be empty")
+	}
+	switch c.Vault.KV.Version {
+	case "1", "2", "auto":
+	default:
+		errs.add("vault.kv.version", "%q must be 1, 2 or auto", c.Vault.KV.Version)
+	}
+	if alerts := c.Vault.Alerts; alerts.WebhookURL != "" {
+		if u, err := url.Parse(alerts.WebhookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs.add("vault.alerts.webhook_url", "%q must be an absolute http:// or https:// URL", alerts.WebhookURL)
+		}
+		if alerts.ErrorRate <= 0 || alerts.ErrorRate > 1 {
+			errs.add("vault.alerts.error_rate", "must be greater than 0 and at most 1")
+		}
+		if alerts.Window <= 0 {
+			errs.add("vault.alerts.window", "must be greater than zero")
+		}
+		if alerts.MinCalls < 1 {
+			errs.add("vault.alerts.min_calls", "must be at least 1")
+		}
+	}
+
+	if c.Auth.Realm == "" {
+		errs.add("auth.realm", "must not be empty")
+	}
+	if c.Auth.Challenge != "bearer" && c.Auth.Challenge != "basic" {
+		errs.add("auth.challenge", "%q must be bearer or basic", c.Auth.Challenge)
+	}
+	if c.Auth.TokenServer {
+		if !c.Token.Signing.Enabled() {
+			errs.add("auth.token_server", "needs token.signing.pem_file or token.signing.transit_key")
+		}
+		if c.Auth.Challenge != "bearer" {
+			errs.add("auth.token_server", "needs auth.challenge bearer")
+		}
+	}
+	if c.Auth.APIKeys.Enabled() {
+		if c.Auth.APIKeys.Mount == "" {
+			errs.add("auth.api_keys.mount", "is required when API keys are enabled")
+		}
+		if c.Auth.APIKeys.CacheTTL <= 0 {
+			errs.add("auth.api_keys.cache_ttl", "must be greater than zero")
+		}
+	}
+	if c.Auth.LoginCheckSecret && !c.Auth.LoginCheck {
+		errs.add("auth.login_check_secret", "requires auth.login_check")
+	}
+
+	if c.Cache.TTL < 0 {
+		errs.add("cache.ttl", "must not be negative")
+	}
+	if c.Cache.CleanupInterval <= 0 {
+		errs.add("cache.cleanup_interval", "must be greater than zero")
+	}
+	switch c.Cache.Backend {
+	case "memory":
+	case "redis":
+		if c.Cache.Redis.Address == "" {
+			errs.add("cache.redis.address", "is required by the redis backend, or REDIS_ADDR")
+		} else if _, _, err := net.SplitHostPort(c.Cache.Redis.Address); err != nil {
+			errs.add("cache.redis.address", "%q must be host:port", c.Cache.Redis.Address)
+		}
+		if c.Cache.Redis.CAFile != "" && !c.Cache.Redis.TLS {
+			errs.add("cache.redis.ca_file", "requires tls")
+		}
+		if c.Cache.Redis.DB < 0 {
+			errs.add("cache.redis.db", "must not be negative")
+		}
+		if c.Cache.Redis.Timeout <= 0 {
+			errs.add("cache.redis.timeout", "must be greater than zero")
+		}
+	default:
+		errs.add("cache.backend", "%q must be memory or redis", c.Cache.Backend)
+	}
+	if c.Cache.RefreshBefore < 0 {
+		errs.add("cache.refresh_before", "must not be negative")
+	}
+	if c.Cache.RefreshBefore > 0 && c.Cache.RefreshIdle <= 0 {
+		errs.add("cache.refresh_idle", "must be greater than zero when cache.refresh_before is set")
+	}
+	if c.Cache.NegativeTTL < 0 {
+		errs.add("cache.negative_ttl", "must not be negative")
+	}
+	for i, rule := range c.Cache.TTLRules {
+		key := fmt.Sprintf("cache.ttl_rules[%d]", i)
+		if rule.Type == "" && rule.Path == "" {
+			errs.add(key, "must set type, path or both")
+		}
+		if rule.TTL < 0 {
+			errs.add(key+".ttl", "must not be negative")
+		}
+	}
+
+	for i, rule := range c.Chaos.Rules {
+		key := fmt.Sprintf("chaos.rules[%d]", i)
+		switch rule.Route {
+		case "", "*", "catalog", "tags", "manifests", "blobs":
+		default:
+			errs.add(key+".route", "%q must be one of catalog, tags, manifests, blobs or *", rule.Route)
+		}
+		switch rule.Action {
+		case "latency":
+			if rule.Latency <= 0 {
+				errs.add(key+".latency", "must be greater than zero for the latency action")
+			}
+		case "error":
+			if rule.Status != 0 && (rule.Status < 400 || rule.Status > 599) {
+				errs.add(key+".status", "%d is not a 4xx or 5xx status code", rule.Status)
+			}
+		case "throttle", "drop":
+		default:
+			errs.add(key+".action", "%q must be one of latency, error, throttle or drop", rule.Action)
+		}
+		if rule.Percent <= 0 || rule.Percent > 100 {
+			errs.add(key+".percent", "must be between 0 and 100")
+		}
+		if _, err := path.Match(rule.Registry, ""); err != nil {
+			errs.add(key+".registry", "invalid glob %q: %v", rule.Registry, err)
+		}
+	}
+
+	for i, rule := range c.CacheControl.Rules {
+		key := fmt.Sprintf("cache_control.rules[%d]", i)
+		switch rule.Route {
+		case "", "*", "catalog", "tags", "manifests", "blobs":
+		default:
+			errs.add(key+".route", "%q must be one of catalog, tags, manifests, blobs or *", rule.Route)
+		}
+		if rule.Reference != "" && rule.Reference != "digest" && rule.Reference != "tag" {
+			errs.add(key+".reference", "%q must be digest or tag", rule.Reference)
+		}
+		if _, err := path.Match(rule.ContentType, ""); err != nil {
+			errs.add(key+".content_type", "invalid glob %q: %v", rule.ContentType, err)
+		}
+		if rule.Expires < 0 {
+			errs.add(key+".expires", "must not be negative")
+		}
+		if rule.CacheControl == "" && rule.Expires == 0 {
+			errs.add(key, "needs cache_control or expires")
+		}
+	}
+
+	if c.Record.Bodies && c.Record.File == "" {
+		errs.add("record.bodies", "is set but record.file is empty")
+	}
+
+	for i, rule := range c.Access.Groups {
+		key := fmt.Sprintf("access.groups[%d]", i)
+		if rule.Group == "" {
+			errs.add(key+".group", "is required")
+		}
+		if len(rule.Registries) == 0 {
+			errs.add(key+".registries", "must list at least one registry (use \"*\" for every registry)")
+		}
+	}
+	if len(c.Access.Groups) > 0 && c.Access.GroupCacheTTL <= 0 {
+		errs.add("access.group_cache_ttl", "must be greater than zero")
+	}
+	for i, policy := range c.Access.Policies {
+		key := fmt.Sprintf("access.policies[%d]", i)
+		if policy.Name == "" {
+			errs.add(key+".name", "is required")
+		}
+		if len(policy.Registries) == 0 {
+			errs.add(key+".registries", "must list at least one registry (use \"*\" for every registry)")
+		}
+		for _, action := range policy.Actions {
+			if action != "pull" && action != "push" && action != "delete" {
+				errs.add(key+".actions", "%q must be pull, push or delete", action)
+			}
+		}
+		if len(policy.Windows) == 0 && len(policy.Environments) == 0 {
+			errs.add(key, "needs windows or environments")
+		}
+	}
+	for i, env := range c.Access.Environments {
+		if env.Name == "" {
+			errs.add(fmt.Sprintf("access.environments[%d].name", i), "is required")
+		}
+	}
+
+	for i, host := range c.Upstream.AllowedHosts {
+		if _, err := path.Match(host, ""); err != nil || host == "" {
+			errs.add(fmt.Sprintf("upstream.allowed_hosts[%d]", i), "%q is not a valid host pattern", host)
+		}
+	}
+	if c.Upstream.BlobRedirects != "follow" && c.Upstream.BlobRedirects != "client" {
+		errs.add("upstream.blob_redirects", "must be follow or client, got %q", c.Upstream.BlobRedirects)
+	}
+	for _, timeout := range []struct {
+		key   string
+		value Duration
+	}{
+		{"listen.timeouts.read_header", c.Listen.Timeouts.ReadHeader},
+		{"listen.timeouts.read", c.Listen.Timeouts.Read},
+		{"listen.timeouts.write", c.Listen.Timeouts.Write},
+		{"listen.timeouts.idle", c.Listen.Timeouts.Idle},
+		{"upstream.timeouts.dial", c.Upstream.Timeouts.Dial},
+		{"upstream.timeouts.tls_handshake", c.Upstream.Timeouts.TLSHandshake},
+		{"upstream.timeouts.response_header", c.Upstream.Timeouts.ResponseHeader},
+		{"upstream.timeouts.idle", c.Upstream.Timeouts.Idle},
+		{"upstream.pool.keep_alive", c.Upstream.Pool.KeepAlive},
+	} {
+		if timeout.value < 0 {
+			errs.add(timeout.key, "must not be negative")
+		}
+	}
+	for _, limit := range []struct {
+		key   string
+		value int
+	}{
+		{"upstream.pool.max_idle_conns", c.Upstream.Pool.MaxIdleConns},
+		{"upstream.pool.max_conns_per_host", c.Upstream.Pool.MaxConnsPerHost},
+	} {
+		if limit.value < 0 {
+			errs.add(limit.key, "must not be negative")
+		}
+	}
+	if c.Upstream.Pool.MaxIdleConnsPerHost < 1 {
+		errs.add("upstream.pool.max_idle_conns_per_host", "must be at least 1")
+	}
+	if retry := c.Upstream.Retry; retry.MaxRetries < 0 {
+		errs.add("upstream.retry.max_retries", "must not be negative")
+	} else if retry.MaxRetries > 0 {
+		if retry.InitialBackoff <= 0 {
+			errs.add("upstream.retry.initial_backoff", "must be positive when retries are enabled")
+		}
+		if retry.MaxBackoff < retry.InitialBackoff {
+			errs.add("upstream.retry.max_backoff", "must not be less than upstream.retry.initial_backoff")
+		}
+		if retry.Budget < 0 {
+			errs.add("upstream.retry.budget", "must not be negative")
+		}
+	}
+	if c.Upstream.RateLimit.RetryBudget < 0 {
+		errs.add("upstream.rate_limit.retry_budget", "must not be negative")
+	}
+	if c.Upstream.RateLimit.RetryBudget > 0 && c.Upstream.RateLimit.MaxQueued < 1 {
+		errs.add("upstream.rate_limit.max_queued", "must be at least 1 when retries are enabled")
+	}
+	for i, layout := range c.Upstream.OCILayouts {
+		key := fmt.Sprintf("upstream.oci_layouts[%d]", i)
+		if layout.Path == "" {
+			errs.add(key+".path", "is required")
+		}
+		if layout.Host == "" && len(layout.FallbackFor) == 0 {
+			errs.add(key, "needs a host, fallback_for hosts or both")
+		}
+		for _, host := range append([]string{layout.Host}, layout.FallbackFor...) {
+			if strings.ContainsAny(host, "/ ") {
+				errs.add(key, "%q must be a host name, with an optional port", host)
+			}
+		}
+	}
+	if c.Upstream.Probe.Interval < 0 {
+		errs.add("upstream.probe.interval", "must not be negative")
+	}
+	if c.Upstream.Probe.Interval > 0 && c.Upstream.Probe.Timeout <= 0 {
+		errs.add("upstream.probe.timeout", "must be greater than zero when probes are enabled")
+	}
+	if c.Upstream.Probe.Interval == 0 && len(c.Upstream.Probe.Registries) > 0 {
+		errs.add("upstream.probe.registries", "is set but upstream.probe.interval is 0")
+	}
+	for i, proxy := range c.Upstream.Proxies {
+		key := fmt.Sprintf("upstream.proxies[%d]", i)
+		if len(proxy.Hosts) == 0 {
+			errs.add(key+".hosts", "must list at least one host")
+		}
+		for j, host := range proxy.Hosts {
+			if _, err := path.Match(host, ""); err != nil || host == "" {
+				errs.add(fmt.Sprintf("%s.hosts[%d]", key, j), "%q is not a valid host pattern", host)
+			}
+		}
+		if proxy.URL == "" {
+			errs.add(key+".url", "is required")
+		} else if proxy.URL != "direct" {
+			if u, err := url.Parse(proxy.URL); err != nil || u.Host == "" {
+				errs.add(key+".url", "is not a valid URL")
+			} else if u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5" && u.Scheme != "socks5h" {
+				errs.add(key+".url", "must use http, https, socks5 or socks5h, got %q", u.Scheme)
+			}
+		}
+	}
+	for i, pin := range c.Upstream.Pins {
+		key := fmt.Sprintf("upstream.pins[%d]", i)
+		if pin.Registry == "" {
+			errs.add(key+".registry", "is required")
+		}
+		if len(pin.Hashes) == 0 {
+			errs.add(key+".hashes", "must list at least one hash")
+		}
+	}
+
+	if c.BlobCache.Dir != "" && c.BlobCache.S3.Bucket == "" && c.BlobCache.MaxSize <= 0 {
+		errs.add("blob_cache.max_size", "must be greater than zero")
+	}
+	if s3 := c.BlobCache.S3; s3.Bucket != "" {
+		if s3.Region == "" {
+			errs.add("blob_cache.s3.region", "must be set, or AWS_REGION")
+		}
+		if s3.Endpoint != "" {
+			if endpoint, err := url.Parse(s3.Endpoint); err != nil || (endpoint.Scheme != "https" && endpoint.Scheme != "http") || endpoint.Host == "" {
+				errs.add("blob_cache.s3.endpoint", "%q must be an http or https URL", s3.Endpoint)
+			}
+		}
+		if s3.SSE != "" && s3.SSE != "AES256" && s3.SSE != "aws:kms" {
+			errs.add("blob_cache.s3.sse", "%q must be AES256 or aws:kms", s3.SSE)
+		}
+		if s3.KMSKeyID != "" && s3.SSE != "aws:kms" {
+			errs.add("blob_cache.s3.kms_key_id", "needs blob_cache.s3.sse aws:kms")
+		}
+	}
+	if c.ManifestCache.Enabled {
+		if c.ManifestCache.MaxSize <= 0 {
+			errs.add("manifest_cache.max_size", "must be greater than zero")
+		}
+		if c.ManifestCache.TagTTL < 0 {
+			errs.add("manifest_cache.tag_ttl", "must not be negative")
+		}
+	}
+	if c.Notation.TrustPolicy == "" && c.Notation.TrustStore != "" {
+		errs.add("notation.trust_store", "is set but notation.trust_policy is not")
+	}
+	if c.Notation.CacheTTL < 0 {
+		errs.add("notation.cache_ttl", "must not be negative")
+	}
+	if c.PullStats.File != "" && c.PullStats.FlushInterval <= 0 {
+		errs.add("pull_stats.flush_interval", "must be positive")
+	}
+	if c.Audit.Syslog != "" && c.Audit.Syslog != "local" {
+		if u, err := url.Parse(c.Audit.Syslog); err != nil || (u.Scheme != "udp" && u.Scheme != "tcp") || u.Port() == "" {
+			errs.add("audit.syslog", "%q must be local, udp://host:port or tcp://host:port", c.Audit.Syslog)
+		}
+	}
+	if c.Debug.MaxBodySize < 0 {
+		errs.add("debug.max_body_size", "must not be negative")
+	}
+
+	if c.Exec.Command != "" && c.Exec.Timeout <= 0 {
+		errs.add("exec.timeout", "must be greater than zero")
+	}
+	if c.Exec.Command == "" && len(c.Exec.Args) > 0 {
+		errs.add("exec.args", "is set but exec.command is empty")
+	}
+
+	if c.Token.Signing.PEMFile != "" && c.Token.Signing.TransitKey != "" {
+		errs.add("token.signing", "pem_file and transit_key are mutually exclusive")
+	}
+	if c.Token.Signing.Enabled() {
+		if c.Token.Issuer == "" {
+			errs.add("token.issuer", "must not be empty")
+		}
+		if c.Token.Signing.TransitKey != "" && c.Token.Signing.TransitMount == "" {
+			errs.add("token.signing.transit_mount", "must not be empty")
+		}
+		if c.Token.AccessTTL <= 0 {
+			errs.add("token.access_ttl", "must be greater than zero")
+		}
+		if c.Token.RefreshTTL <= 0 {
+			errs.add("token.refresh_ttl", "must be greater than zero")
+		}
+		if c.Token.Signing.Overlap < c.Token.AccessTTL {
+			errs.add("token.signing.overlap", "must be at least token.access_ttl so access tokens survive a key rotation")
+		}
+		if c.Token.Signing.Overlap < 0 {
+			errs.add("token.signing.overlap", "must not be negative")
+		}
+		if c.Token.Signing.ReloadInterval <= 0 {
+			errs.add("token.signing.reload_interval", "must be greater than zero")
+		}
+	}
+
+	if c.Dev.Fixture != "" && !c.Dev.Enabled {
+		errs.add("dev.fixture", "is set but dev.enabled is false")
+	}
+
+	if len(errs.Errors) > 0 {
+		return errs
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package controller
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Service account files mounted into every pod
+const (
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+	tokenFile         = serviceAccountDir + "/token"
+	caFile            = serviceAccountDir + "/ca.crt"
+	namespaceFile     = serviceAccountDir + "/namespace"
+)
+
+var ErrNotInCluster = errors.New("not running in a Kubernetes cluster (KUBERNETES_SERVICE_HOST is not set)")
+
+// Client talks to the Kubernetes API server with the pod's service account
+type Client struct {
+	baseURL    string
+	namespace  string
+	httpClient *http.Client
+}
+
+// NewInClusterClient creates a client for the API server of the cluster the proxy runs in.
+// Resources are watched in namespace, or in the pod's own namespace when it is empty.
+func NewInClusterClient(namespace string) (*Client, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, ErrNotInCluster
+	}
+
+	caPEM, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read service account CA: %v", err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+
+	if namespace == "" {
+		data, err := os.ReadFile(namespaceFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read pod namespace: %v", err)
+		}
+		namespace = strings.TrimSpace(string(data))
+	}
+
+	return &Client{
+		baseURL:   "https://" + net.JoinHostPort(host, port),
+		namespace: namespace,
+		httpClient: &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12},
+			},
+		},
+	}, nil
+}
+
+// Namespace returns the namespace the client watches
+func (c *Client) Namespace() string {
+	return c.namespace
+}
+
+// do sends req with the service account token, which is read on every request because
+// projected tokens are rotated
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	token, err := os.ReadFile(tokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read service account token: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Accept", "application/json")
+	return c.httpClient.Do(req)
+}
@@ -0,0 +1,229 @@
+// Package controller watches RegistryConfig custom resources and applies them to the running
+// proxy, so registries can be managed declaratively without restarts.
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+)
+
+// RegistryConfig custom resource coordinates
+const (
+	Group    = "vaultdockerproxy.io"
+	Version  = "v1alpha1"
+	Resource = "registryconfigs"
+)
+
+// Watch retry bounds after a failed list or watch
+const (
+	minBackoff = time.Second
+	maxBackoff = 30 * time.Second
+)
+
+// RegistryConfig is a RegistryConfig custom resource
+type RegistryConfig struct {
+	Metadata ObjectMeta         `json:"metadata"`
+	Spec     RegistryConfigSpec `json:"spec"`
+}
+
+// ObjectMeta holds the resource metadata used by the controller
+type ObjectMeta struct {
+	Name            string `json:"name"`
+	Namespace       string `json:"namespace"`
+	ResourceVersion string `json:"resourceVersion"`
+}
+
+// RegistryConfigSpec declares a registry, the aliases clients may use for it and the Vault
+// identity groups allowed to use it
+type RegistryConfigSpec struct {
+	Registry string          `json:"registry"` // registry host, e.g. registry.example.com
+	Aliases  []string        `json:"aliases"`  // names usable instead of the registry host
+	Groups   []RegistryGroup `json:"groups"`   // group access rules for the registry
+}
+
+// RegistryGroup grants a Vault identity group access to repositories of the registry
+type RegistryGroup struct {
+	Group        string   `json:"group"`
+	Repositories []string `json:"repositories"` // repository globs, every repository when empty
+}
+
+// Validate checks a spec for missing fields
+func (s RegistryConfigSpec) Validate() error {
+	if s.Registry == "" {
+		return fmt.Errorf("spec.registry is required")
+	}
+	for i, group := range s.Groups {
+		if group.Group == "" {
+			return fmt.Errorf("spec.groups[%d].group is required", i)
+		}
+	}
+	return nil
+}
+
+// Controller keeps the proxy in sync with the RegistryConfig resources of a namespace
+type Controller struct {
+	client    *Client
+	apply     func([]RegistryConfig)
+	resources map[string]RegistryConfig
+}
+
+// NewController creates a controller calling apply with every valid resource, sorted by name,
+// after the initial list and after every change
+func NewController(client *Client, apply func([]RegistryConfig)) *Controller {
+	return &Controller{
+		client:    client,
+		apply:     apply,
+		resources: make(map[string]RegistryConfig),
+	}
+}
+
+// Run lists and watches resources until ctx is cancelled, relisting after errors
+func (c *Controller) Run(ctx context.Context) {
+	backoff := minBackoff
+	for ctx.Err() == nil {
+		resourceVersion, err := c.list(ctx)
+		if err == nil {
+			backoff = minBackoff
+			err = c.watch(ctx, resourceVersion)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			slog.Warn("RegistryConfig watch failed, retrying", "namespace", c.client.Namespace(), "retry_in", backoff, "error", err)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return
+			}
+			backoff = min(2*backoff, maxBackoff)
+		}
+	}
+}
+
+// list replaces the known resources with the current ones and returns the list's resource version
+func (c *Controller) list(ctx context.Context) (string, error) {
+	resp, err := c.get(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var list struct {
+		Metadata ObjectMeta       `json:"metadata"`
+		Items    []RegistryConfig `json:"items"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return "", fmt.Errorf("failed to decode RegistryConfig list: %v", err)
+	}
+
+	c.resources = make(map[string]RegistryConfig, len(list.Items))
+	for _, resource := range list.Items {
+		c.resources[resource.Metadata.Name] = resource
+	}
+	c.sync()
+	return list.Metadata.ResourceVersion, nil
+}
+
+// watch applies changes from resourceVersion on until the watch ends. It returns nil when the
+// server closes the watch normally, so the caller relists.
+func (c *Controller) watch(ctx context.Context, resourceVersion string) error {
+	resp, err := c.get(ctx, url.Values{
+		"watch":               {"true"},
+		"resourceVersion":     {resourceVersion},
+		"allowWatchBookmarks": {"true"},
+		"timeoutSeconds":      {"300"},
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var event struct {
+			Type   string          `json:"type"`
+			Object json.RawMessage `json:"object"`
+		}
+		if err := dec.Decode(&event); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("failed to decode watch event: %v", err)
+		}
+
+		switch event.Type {
+		case "ADDED", "MODIFIED", "DELETED":
+			var resource RegistryConfig
+			if err := json.Unmarshal(event.Object, &resource); err != nil {
+				return fmt.Errorf("failed to decode RegistryConfig: %v", err)
+			}
+			if event.Type == "DELETED" {
+				delete(c.resources, resource.Metadata.Name)
+			} else {
+				c.resources[resource.Metadata.Name] = resource
+			}
+			slog.Info("RegistryConfig changed", "resource", resource.Metadata.Namespace+"/"+resource.Metadata.Name, "event", event.Type)
+			c.sync()
+		case "BOOKMARK":
+		case "ERROR":
+			// Typically 410 Gone once the resource version is too old; relisting recovers
+			var status struct {
+				Code    int    `json:"code"`
+				Message string `json:"message"`
+			}
+			json.Unmarshal(event.Object, &status)
+			return fmt.Errorf("watch error %d: %s", status.Code, status.Message)
+		}
+	}
+}
+
+// sync applies the valid resources, sorted by name so later resources win conflicts
+func (c *Controller) sync() {
+	names := make([]string, 0, len(c.resources))
+	for name := range c.resources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	resources := make([]RegistryConfig, 0, len(names))
+	for _, name := range names {
+		resource := c.resources[name]
+		if err := resource.Spec.Validate(); err != nil {
+			slog.Warn("Ignoring invalid RegistryConfig", "resource", resource.Metadata.Namespace+"/"+name, "error", err)
+			continue
+		}
+		resources = append(resources, resource)
+	}
+	c.apply(resources)
+}
+
+// get requests the RegistryConfig collection of the namespace
+func (c *Controller) get(ctx context.Context, query url.Values) (*http.Response, error) {
+	target := fmt.Sprintf("%s/apis/%s/%s/namespaces/%s/%s", c.client.baseURL, Group, Version, url.PathEscape(c.client.namespace), Resource)
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.client.do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+		return nil, fmt.Errorf("API server returned HTTP %d: %s", resp.StatusCode, body)
+	}
+	return resp, nil
+}
@@ -0,0 +1,141 @@
+// Package controlplane serves the gRPC control-plane API used by platform automation to manage
+// proxies without scraping the HTTP admin endpoints.
+package controlplane
+
+import (
+	"context"
+	"crypto/subtle"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"gopkg.in/yaml.v3"
+
+	"vault-docker-proxy/pkg/config"
+	controlplanev1 "vault-docker-proxy/pkg/controlplane/v1"
+	"vault-docker-proxy/pkg/registry"
+)
+
+// Server implements the ControlPlane service for a proxy
+type Server struct {
+	controlplanev1.UnimplementedControlPlaneServer
+	proxy     *registry.ProxyServer
+	config    *config.Config
+	startedAt time.Time
+}
+
+// NewServer creates the control-plane service for proxy, reporting cfg as its configuration
+func NewServer(proxy *registry.ProxyServer, cfg *config.Config) *Server {
+	return &Server{
+		proxy:     proxy,
+		config:    cfg,
+		startedAt: time.Now(),
+	}
+}
+
+// NewGRPCServer creates a gRPC server exposing srv and the standard gRPC health service. Every
+// ControlPlane call requires the admin token; health checks do not, like /healthz.
+func NewGRPCServer(srv *Server, token string) *grpc.Server {
+	authorizer := tokenAuthorizer(token)
+	grpcServer := grpc.NewServer(
+		grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			if err := authorizer(ctx, info.FullMethod); err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			if err := authorizer(ss.Context(), info.FullMethod); err != nil {
+				return err
+			}
+			return handler(srv, ss)
+		}),
+	)
+	controlplanev1.RegisterControlPlaneServer(grpcServer, srv)
+	healthpb.RegisterHealthServer(grpcServer, health.NewServer())
+	return grpcServer
+}
+
+// tokenAuthorizer returns a check that the call carries the admin bearer token
+func tokenAuthorizer(token string) func(ctx context.Context, fullMethod string) error {
+	return func(ctx context.Context, fullMethod string) error {
+		if strings.HasPrefix(fullMethod, "/"+healthpb.Health_ServiceDesc.ServiceName+"/") {
+			return nil
+		}
+		md, _ := metadata.FromIncomingContext(ctx)
+		for _, value := range md.Get("authorization") {
+			presented := strings.TrimPrefix(value, "Bearer ")
+			if token != "" && subtle.ConstantTimeCompare([]byte(presented), []byte(token)) == 1 {
+				return nil
+			}
+		}
+		return status.Error(codes.Unauthenticated, "admin token required")
+	}
+}
+
+// Health implements ControlPlaneServer
+func (s *Server) Health(ctx context.Context, req *controlplanev1.HealthRequest) (*controlplanev1.HealthResponse, error) {
+	return &controlplanev1.HealthResponse{
+		Status:    "SERVING",
+		StartedAt: timestamppb.New(s.startedAt),
+	}, nil
+}
+
+// GetStats implements ControlPlaneServer
+func (s *Server) GetStats(ctx context.Context, req *controlplanev1.GetStatsRequest) (*controlplanev1.GetStatsResponse, error) {
+	stats := s.proxy.Stats()
+	return &controlplanev1.GetStatsResponse{
+		CacheHits:    stats.CacheHits,
+		CacheMisses:  stats.CacheMisses,
+		VaultCalls:   stats.VaultCalls,
+		VaultErrors:  stats.VaultErrors,
+		CacheEntries: uint64(len(s.proxy.Inventory().CredentialCache)),
+	}, nil
+}
+
+// ListRegistries implements ControlPlaneServer
+func (s *Server) ListRegistries(ctx context.Context, req *controlplanev1.ListRegistriesRequest) (*controlplanev1.ListRegistriesResponse, error) {
+	inventory := s.proxy.Inventory()
+	resp := &controlplanev1.ListRegistriesResponse{}
+	for _, usage := range inventory.Registries {
+		resp.Registries = append(resp.Registries, &controlplanev1.RegistryUsage{
+			Registry:   usage.Registry,
+			Types:      usage.Types,
+			VaultPaths: usage.VaultPaths,
+			Requests:   usage.Requests,
+			LastUsed:   timestamppb.New(usage.LastUsed),
+		})
+	}
+	for _, entry := range inventory.CredentialCache {
+		cacheEntry := &controlplanev1.CacheEntry{VaultPath: entry.VaultPath}
+		if !entry.ExpiresAt.IsZero() {
+			cacheEntry.ExpiresAt = timestamppb.New(entry.ExpiresAt)
+		}
+		resp.CredentialCache = append(resp.CredentialCache, cacheEntry)
+	}
+	return resp, nil
+}
+
+// InvalidateCache implements ControlPlaneServer
+func (s *Server) InvalidateCache(ctx context.Context, req *controlplanev1.InvalidateCacheRequest) (*controlplanev1.InvalidateCacheResponse, error) {
+	if req.All == (req.VaultPath != "") {
+		return nil, status.Error(codes.InvalidArgument, "set exactly one of vault_path or all")
+	}
+	removed := s.proxy.InvalidateCredentials(req.VaultPath)
+	return &controlplanev1.InvalidateCacheResponse{Removed: uint64(removed)}, nil
+}
+
+// GetConfig implements ControlPlaneServer
+func (s *Server) GetConfig(ctx context.Context, req *controlplanev1.GetConfigRequest) (*controlplanev1.GetConfigResponse, error) {
+	data, err := yaml.Marshal(s.config.Redacted())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot encode configuration: %v", err)
+	}
+	return &controlplanev1.GetConfigResponse{Yaml: string(data)}, nil
+}
@@ -0,0 +1,746 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.6
+// 	protoc        v5.29.3
+// source: controlplane.proto
+
+package controlplanev1
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type HealthRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *HealthRequest) Reset() {
+	*x = HealthRequest{}
+	mi := &file_controlplane_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *HealthRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*HealthRequest) ProtoMessage() {}
+
+func (x *HealthRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_controlplane_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use HealthRequest.ProtoReflect.Descriptor instead.
+func (*HealthRequest) Descriptor() ([]byte, []int) {
+	return file_controlplane_proto_rawDescGZIP(), []int{0}
+}
+
+type HealthResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Status        string                 `protobuf:"bytes,1,opt,name=status,proto3" json:"status,omitempty"`
+	StartedAt     *timestamppb.Timestamp `protobuf:"bytes,2,opt,name=started_at,json=startedAt,proto3" json:"started_at,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *HealthResponse) Reset() {
+	*x = HealthResponse{}
+	mi := &file_controlplane_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *HealthResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*HealthResponse) ProtoMessage() {}
+
+func (x *HealthResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_controlplane_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use HealthResponse.ProtoReflect.Descriptor instead.
+func (*HealthResponse) Descriptor() ([]byte, []int) {
+	return file_controlplane_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *HealthResponse) GetStatus() string {
+	if x != nil {
+		return x.Status
+	}
+	return ""
+}
+
+func (x *HealthResponse) GetStartedAt() *timestamppb.Timestamp {
+	if x != nil {
+		return x.StartedAt
+	}
+	return nil
+}
+
+type GetStatsRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetStatsRequest) Reset() {
+	*x = GetStatsRequest{}
+	mi := &file_controlplane_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetStatsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetStatsRequest) ProtoMessage() {}
+
+func (x *GetStatsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_controlplane_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetStatsRequest.ProtoReflect.Descriptor instead.
+func (*GetStatsRequest) Descriptor() ([]byte, []int) {
+	return file_controlplane_proto_rawDescGZIP(), []int{2}
+}
+
+type GetStatsResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	CacheHits     uint64                 `protobuf:"varint,1,opt,name=cache_hits,json=cacheHits,proto3" json:"cache_hits,omitempty"`
+	CacheMisses   uint64                 `protobuf:"varint,2,opt,name=cache_misses,json=cacheMisses,proto3" json:"cache_misses,omitempty"`
+	VaultCalls    uint64                 `protobuf:"varint,3,opt,name=vault_calls,json=vaultCalls,proto3" json:"vault_calls,omitempty"`
+	VaultErrors   uint64                 `protobuf:"varint,4,opt,name=vault_errors,json=vaultErrors,proto3" json:"vault_errors,omitempty"`
+	CacheEntries  uint64                 `protobuf:"varint,5,opt,name=cache_entries,json=cacheEntries,proto3" json:"cache_entries,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetStatsResponse) Reset() {
+	*x = GetStatsResponse{}
+	mi := &file_controlplane_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetStatsResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetStatsResponse) ProtoMessage() {}
+
+func (x *GetStatsResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_controlplane_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetStatsResponse.ProtoReflect.Descriptor instead.
+func (*GetStatsResponse) Descriptor() ([]byte, []int) {
+	return file_controlplane_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *GetStatsResponse) GetCacheHits() uint64 {
+	if x != nil {
+		return x.CacheHits
+	}
+	return 0
+}
+
+func (x *GetStatsResponse) GetCacheMisses() uint64 {
+	if x != nil {
+		return x.CacheMisses
+	}
+	return 0
+}
+
+func (x *GetStatsResponse) GetVaultCalls() uint64 {
+	if x != nil {
+		return x.VaultCalls
+	}
+	return 0
+}
+
+func (x *GetStatsResponse) GetVaultErrors() uint64 {
+	if x != nil {
+		return x.VaultErrors
+	}
+	return 0
+}
+
+func (x *GetStatsResponse) GetCacheEntries() uint64 {
+	if x != nil {
+		return x.CacheEntries
+	}
+	return 0
+}
+
+type ListRegistriesRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListRegistriesRequest) Reset() {
+	*x = ListRegistriesRequest{}
+	mi := &file_controlplane_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListRegistriesRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListRegistriesRequest) ProtoMessage() {}
+
+func (x *ListRegistriesRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_controlplane_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListRegistriesRequest.ProtoReflect.Descriptor instead.
+func (*ListRegistriesRequest) Descriptor() ([]byte, []int) {
+	return file_controlplane_proto_rawDescGZIP(), []int{4}
+}
+
+type ListRegistriesResponse struct {
+	state           protoimpl.MessageState `protogen:"open.v1"`
+	Registries      []*RegistryUsage       `protobuf:"bytes,1,rep,name=registries,proto3" json:"registries,omitempty"`
+	CredentialCache []*CacheEntry          `protobuf:"bytes,2,rep,name=credential_cache,json=credentialCache,proto3" json:"credential_cache,omitempty"`
+	unknownFields   protoimpl.UnknownFields
+	sizeCache       protoimpl.SizeCache
+}
+
+func (x *ListRegistriesResponse) Reset() {
+	*x = ListRegistriesResponse{}
+	mi := &file_controlplane_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListRegistriesResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListRegistriesResponse) ProtoMessage() {}
+
+func (x *ListRegistriesResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_controlplane_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListRegistriesResponse.ProtoReflect.Descriptor instead.
+func (*ListRegistriesResponse) Descriptor() ([]byte, []int) {
+	return file_controlplane_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *ListRegistriesResponse) GetRegistries() []*RegistryUsage {
+	if x != nil {
+		return x.Registries
+	}
+	return nil
+}
+
+func (x *ListRegistriesResponse) GetCredentialCache() []*CacheEntry {
+	if x != nil {
+		return x.CredentialCache
+	}
+	return nil
+}
+
+type RegistryUsage struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Registry      string                 `protobuf:"bytes,1,opt,name=registry,proto3" json:"registry,omitempty"`
+	Types         []string               `protobuf:"bytes,2,rep,name=types,proto3" json:"types,omitempty"`
+	VaultPaths    []string               `protobuf:"bytes,3,rep,name=vault_paths,json=vaultPaths,proto3" json:"vault_paths,omitempty"`
+	Requests      uint64                 `protobuf:"varint,4,opt,name=requests,proto3" json:"requests,omitempty"`
+	LastUsed      *timestamppb.Timestamp `protobuf:"bytes,5,opt,name=last_used,json=lastUsed,proto3" json:"last_used,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *RegistryUsage) Reset() {
+	*x = RegistryUsage{}
+	mi := &file_controlplane_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *RegistryUsage) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RegistryUsage) ProtoMessage() {}
+
+func (x *RegistryUsage) ProtoReflect() protoreflect.Message {
+	mi := &file_controlplane_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RegistryUsage.ProtoReflect.Descriptor instead.
+func (*RegistryUsage) Descriptor() ([]byte, []int) {
+	return file_controlplane_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *RegistryUsage) GetRegistry() string {
+	if x != nil {
+		return x.Registry
+	}
+	return ""
+}
+
+func (x *RegistryUsage) GetTypes() []string {
+	if x != nil {
+		return x.Types
+	}
+	return nil
+}
+
+func (x *RegistryUsage) GetVaultPaths() []string {
+	if x != nil {
+		return x.VaultPaths
+	}
+	return nil
+}
+
+func (x *RegistryUsage) GetRequests() uint64 {
+	if x != nil {
+		return x.Requests
+	}
+	return 0
+}
+
+func (x *RegistryUsage) GetLastUsed() *timestamppb.Timestamp {
+	if x != nil {
+		return x.LastUsed
+	}
+	return nil
+}
+
+type CacheEntry struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	VaultPath     string                 `protobuf:"bytes,1,opt,name=vault_path,json=vaultPath,proto3" json:"vault_path,omitempty"`
+	ExpiresAt     *timestamppb.Timestamp `protobuf:"bytes,2,opt,name=expires_at,json=expiresAt,proto3" json:"expires_at,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CacheEntry) Reset() {
+	*x = CacheEntry{}
+	mi := &file_controlplane_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CacheEntry) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CacheEntry) ProtoMessage() {}
+
+func (x *CacheEntry) ProtoReflect() protoreflect.Message {
+	mi := &file_controlplane_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CacheEntry.ProtoReflect.Descriptor instead.
+func (*CacheEntry) Descriptor() ([]byte, []int) {
+	return file_controlplane_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *CacheEntry) GetVaultPath() string {
+	if x != nil {
+		return x.VaultPath
+	}
+	return ""
+}
+
+func (x *CacheEntry) GetExpiresAt() *timestamppb.Timestamp {
+	if x != nil {
+		return x.ExpiresAt
+	}
+	return nil
+}
+
+type InvalidateCacheRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Vault path whose cached credentials are removed, for every Vault token
+	VaultPath string `protobuf:"bytes,1,opt,name=vault_path,json=vaultPath,proto3" json:"vault_path,omitempty"`
+	// Remove every cached credential; vault_path must then be empty
+	All           bool `protobuf:"varint,2,opt,name=all,proto3" json:"all,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *InvalidateCacheRequest) Reset() {
+	*x = InvalidateCacheRequest{}
+	mi := &file_controlplane_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *InvalidateCacheRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*InvalidateCacheRequest) ProtoMessage() {}
+
+func (x *InvalidateCacheRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_controlplane_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use InvalidateCacheRequest.ProtoReflect.Descriptor instead.
+func (*InvalidateCacheRequest) Descriptor() ([]byte, []int) {
+	return file_controlplane_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *InvalidateCacheRequest) GetVaultPath() string {
+	if x != nil {
+		return x.VaultPath
+	}
+	return ""
+}
+
+func (x *InvalidateCacheRequest) GetAll() bool {
+	if x != nil {
+		return x.All
+	}
+	return false
+}
+
+type InvalidateCacheResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Removed       uint64                 `protobuf:"varint,1,opt,name=removed,proto3" json:"removed,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *InvalidateCacheResponse) Reset() {
+	*x = InvalidateCacheResponse{}
+	mi := &file_controlplane_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *InvalidateCacheResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*InvalidateCacheResponse) ProtoMessage() {}
+
+func (x *InvalidateCacheResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_controlplane_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use InvalidateCacheResponse.ProtoReflect.Descriptor instead.
+func (*InvalidateCacheResponse) Descriptor() ([]byte, []int) {
+	return file_controlplane_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *InvalidateCacheResponse) GetRemoved() uint64 {
+	if x != nil {
+		return x.Removed
+	}
+	return 0
+}
+
+type GetConfigRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetConfigRequest) Reset() {
+	*x = GetConfigRequest{}
+	mi := &file_controlplane_proto_msgTypes[10]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetConfigRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetConfigRequest) ProtoMessage() {}
+
+func (x *GetConfigRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_controlplane_proto_msgTypes[10]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetConfigRequest.ProtoReflect.Descriptor instead.
+func (*GetConfigRequest) Descriptor() ([]byte, []int) {
+	return file_controlplane_proto_rawDescGZIP(), []int{10}
+}
+
+type GetConfigResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Yaml          string                 `protobuf:"bytes,1,opt,name=yaml,proto3" json:"yaml,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetConfigResponse) Reset() {
+	*x = GetConfigResponse{}
+	mi := &file_controlplane_proto_msgTypes[11]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetConfigResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetConfigResponse) ProtoMessage() {}
+
+func (x *GetConfigResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_controlplane_proto_msgTypes[11]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetConfigResponse.ProtoReflect.Descriptor instead.
+func (*GetConfigResponse) Descriptor() ([]byte, []int) {
+	return file_controlplane_proto_rawDescGZIP(), []int{11}
+}
+
+func (x *GetConfigResponse) GetYaml() string {
+	if x != nil {
+		return x.Yaml
+	}
+	return ""
+}
+
+var File_controlplane_proto protoreflect.FileDescriptor
+
+const file_controlplane_proto_rawDesc = "" +
+	"\n" +
+	"\x12controlplane.proto\x12 vaultdockerproxy.controlplane.v1\x1a\x1fgoogle/protobuf/timestamp.proto\"\x0f\n" +
+	"\rHealthRequest\"c\n" +
+	"\x0eHealthResponse\x12\x16\n" +
+	"\x06status\x18\x01 \x01(\tR\x06status\x129\n" +
+	"\n" +
+	"started_at\x18\x02 \x01(\v2\x1a.google.protobuf.TimestampR\tstartedAt\"\x11\n" +
+	"\x0fGetStatsRequest\"\xbd\x01\n" +
+	"\x10GetStatsResponse\x12\x1d\n" +
+	"\n" +
+	"cache_hits\x18\x01 \x01(\x04R\tcacheHits\x12!\n" +
+	"\fcache_misses\x18\x02 \x01(\x04R\vcacheMisses\x12\x1f\n" +
+	"\vvault_calls\x18\x03 \x01(\x04R\n" +
+	"vaultCalls\x12!\n" +
+	"\fvault_errors\x18\x04 \x01(\x04R\vvaultErrors\x12#\n" +
+	"\rcache_entries\x18\x05 \x01(\x04R\fcacheEntries\"\x17\n" +
+	"\x15ListRegistriesRequest\"\xc2\x01\n" +
+	"\x16ListRegistriesResponse\x12O\n" +
+	"\n" +
+	"registries\x18\x01 \x03(\v2/.vaultdockerproxy.controlplane.v1.RegistryUsageR\n" +
+	"registries\x12W\n" +
+	"\x10credential_cache\x18\x02 \x03(\v2,.vaultdockerproxy.controlplane.v1.CacheEntryR\x0fcredentialCache\"\xb7\x01\n" +
+	"\rRegistryUsage\x12\x1a\n" +
+	"\bregistry\x18\x01 \x01(\tR\bregistry\x12\x14\n" +
+	"\x05types\x18\x02 \x03(\tR\x05types\x12\x1f\n" +
+	"\vvault_paths\x18\x03 \x03(\tR\n" +
+	"vaultPaths\x12\x1a\n" +
+	"\brequests\x18\x04 \x01(\x04R\brequests\x127\n" +
+	"\tlast_used\x18\x05 \x01(\v2\x1a.google.protobuf.TimestampR\blastUsed\"f\n" +
+	"\n" +
+	"CacheEntry\x12\x1d\n" +
+	"\n" +
+	"vault_path\x18\x01 \x01(\tR\tvaultPath\x129\n" +
+	"\n" +
+	"expires_at\x18\x02 \x01(\v2\x1a.google.protobuf.TimestampR\texpiresAt\"I\n" +
+	"\x16InvalidateCacheRequest\x12\x1d\n" +
+	"\n" +
+	"vault_path\x18\x01 \x01(\tR\tvaultPath\x12\x10\n" +
+	"\x03all\x18\x02 \x01(\bR\x03all\"3\n" +
+	"\x17InvalidateCacheResponse\x12\x18\n" +
+	"\aremoved\x18\x01 \x01(\x04R\aremoved\"\x12\n" +
+	"\x10GetConfigRequest\"'\n" +
+	"\x11GetConfigResponse\x12\x12\n" +
+	"\x04yaml\x18\x01 \x01(\tR\x04yaml2\xf3\x04\n" +
+	"\fControlPlane\x12k\n" +
+	"\x06Health\x12/.vaultdockerproxy.controlplane.v1.HealthRequest\x1a0.vaultdockerproxy.controlplane.v1.HealthResponse\x12q\n" +
+	"\bGetStats\x121.vaultdockerproxy.controlplane.v1.GetStatsRequest\x1a2.vaultdockerproxy.controlplane.v1.GetStatsResponse\x12\x83\x01\n" +
+	"\x0eListRegistries\x127.vaultdockerproxy.controlplane.v1.ListRegistriesRequest\x1a8.vaultdockerproxy.controlplane.v1.ListRegistriesResponse\x12\x86\x01\n" +
+	"\x0fInvalidateCache\x128.vaultdockerproxy.controlplane.v1.InvalidateCacheRequest\x1a9.vaultdockerproxy.controlplane.v1.InvalidateCacheResponse\x12t\n" +
+	"\tGetConfig\x122.vaultdockerproxy.controlplane.v1.GetConfigRequest\x1a3.vaultdockerproxy.controlplane.v1.GetConfigResponseB7Z5vault-docker-proxy/pkg/controlplane/v1;controlplanev1b\x06proto3"
+
+var (
+	file_controlplane_proto_rawDescOnce sync.Once
+	file_controlplane_proto_rawDescData []byte
+)
+
+func file_controlplane_proto_rawDescGZIP() []byte {
+	file_controlplane_proto_rawDescOnce.Do(func() {
+		file_controlplane_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_controlplane_proto_rawDesc), len(file_controlplane_proto_rawDesc)))
+	})
+	return file_controlplane_proto_rawDescData
+}
+
+var file_controlplane_proto_msgTypes = make([]protoimpl.MessageInfo, 12)
+var file_controlplane_proto_goTypes = []any{
+	(*HealthRequest)(nil),           // 0: vaultdockerproxy.controlplane.v1.HealthRequest
+	(*HealthResponse)(nil),          // 1: vaultdockerproxy.controlplane.v1.HealthResponse
+	(*GetStatsRequest)(nil),         // 2: vaultdockerproxy.controlplane.v1.GetStatsRequest
+	(*GetStatsResponse)(nil),        // 3: vaultdockerproxy.controlplane.v1.GetStatsResponse
+	(*ListRegistriesRequest)(nil),   // 4: vaultdockerproxy.controlplane.v1.ListRegistriesRequest
+	(*ListRegistriesResponse)(nil),  // 5: vaultdockerproxy.controlplane.v1.ListRegistriesResponse
+	(*RegistryUsage)(nil),           // 6: vaultdockerproxy.controlplane.v1.RegistryUsage
+	(*CacheEntry)(nil),              // 7: vaultdockerproxy.controlplane.v1.CacheEntry
+	(*InvalidateCacheRequest)(nil),  // 8: vaultdockerproxy.controlplane.v1.InvalidateCacheRequest
+	(*InvalidateCacheResponse)(nil), // 9: vaultdockerproxy.controlplane.v1.InvalidateCacheResponse
+	(*GetConfigRequest)(nil),        // 10: vaultdockerproxy.controlplane.v1.GetConfigRequest
+	(*GetConfigResponse)(nil),       // 11: vaultdockerproxy.controlplane.v1.GetConfigResponse
+	(*timestamppb.Timestamp)(nil),   // 12: google.protobuf.Timestamp
+}
+var file_controlplane_proto_depIdxs = []int32{
+	12, // 0: vaultdockerproxy.controlplane.v1.HealthResponse.started_at:type_name -> google.protobuf.Timestamp
+	6,  // 1: vaultdockerproxy.controlplane.v1.ListRegistriesResponse.registries:type_name -> vaultdockerproxy.controlplane.v1.RegistryUsage
+	7,  // 2: vaultdockerproxy.controlplane.v1.ListRegistriesResponse.credential_cache:type_name -> vaultdockerproxy.controlplane.v1.CacheEntry
+	12, // 3: vaultdockerproxy.controlplane.v1.RegistryUsage.last_used:type_name -> google.protobuf.Timestamp
+	12, // 4: vaultdockerproxy.controlplane.v1.CacheEntry.expires_at:type_name -> google.protobuf.Timestamp
+	0,  // 5: vaultdockerproxy.controlplane.v1.ControlPlane.Health:input_type -> vaultdockerproxy.controlplane.v1.HealthRequest
+	2,  // 6: vaultdockerproxy.controlplane.v1.ControlPlane.GetStats:input_type -> vaultdockerproxy.controlplane.v1.GetStatsRequest
+	4,  // 7: vaultdockerproxy.controlplane.v1.ControlPlane.ListRegistries:input_type -> vaultdockerproxy.controlplane.v1.ListRegistriesRequest
+	8,  // 8: vaultdockerproxy.controlplane.v1.ControlPlane.InvalidateCache:input_type -> vaultdockerproxy.controlplane.v1.InvalidateCacheRequest
+	10, // 9: vaultdockerproxy.controlplane.v1.ControlPlane.GetConfig:input_type -> vaultdockerproxy.controlplane.v1.GetConfigRequest
+	1,  // 10: vaultdockerproxy.controlplane.v1.ControlPlane.Health:output_type -> vaultdockerproxy.controlplane.v1.HealthResponse
+	3,  // 11: vaultdockerproxy.controlplane.v1.ControlPlane.GetStats:output_type -> vaultdockerproxy.controlplane.v1.GetStatsResponse
+	5,  // 12: vaultdockerproxy.controlplane.v1.ControlPlane.ListRegistries:output_type -> vaultdockerproxy.controlplane.v1.ListRegistriesResponse
+	9,  // 13: vaultdockerproxy.controlplane.v1.ControlPlane.InvalidateCache:output_type -> vaultdockerproxy.controlplane.v1.InvalidateCacheResponse
+	11, // 14: vaultdockerproxy.controlplane.v1.ControlPlane.GetConfig:output_type -> vaultdockerproxy.controlplane.v1.GetConfigResponse
+	10, // [10:15] is the sub-list for method output_type
+	5,  // [5:10] is the sub-list for method input_type
+	5,  // [5:5] is the sub-list for extension type_name
+	5,  // [5:5] is the sub-list for extension extendee
+	0,  // [0:5] is the sub-list for field type_name
+}
+
+func init() { file_controlplane_proto_init() }
+func file_controlplane_proto_init() {
+	if File_controlplane_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_controlplane_proto_rawDesc), len(file_controlplane_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   12,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_controlplane_proto_goTypes,
+		DependencyIndexes: file_controlplane_proto_depIdxs,
+		MessageInfos:      file_controlplane_proto_msgTypes,
+	}.Build()
+	File_controlplane_proto = out.File
+	file_controlplane_proto_goTypes = nil
+	file_controlplane_proto_depIdxs = nil
+}
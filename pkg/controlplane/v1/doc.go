@@ -0,0 +1,5 @@
+// Package controlplanev1 contains the generated gRPC control-plane API. Regenerate it after
+// changing controlplane.proto.
+package controlplanev1
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative controlplane.proto
@@ -0,0 +1,87 @@
+// Package devmode provides an embedded fake Vault and registry so the full proxy flow can be
+// tried locally without any external services.
+package devmode
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Environment holds the embedded services started for dev mode
+type Environment struct {
+	Fixture      *Fixture
+	VaultAddr    string
+	RegistryHost string
+
+	vaultListener    net.Listener
+	registryListener net.Listener
+	registryAddr     string
+}
+
+// Start launches the fake Vault and registry on loopback listeners
+func Start(fixture *Fixture) (*Environment, error) {
+	reg, err := newFakeRegistry(fixture)
+	if err != nil {
+		return nil, err
+	}
+
+	vaultListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to start dev Vault: %v", err)
+	}
+
+	registryListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		vaultListener.Close()
+		return nil, fmt.Errorf("failed to start dev registry: %v", err)
+	}
+
+	go http.Serve(vaultListener, newFakeVault(fixture))
+	go http.Serve(registryListener, reg.handler())
+
+	return &Environment{
+		Fixture:          fixture,
+		VaultAddr:        "http://" + vaultListener.Addr().String(),
+		RegistryHost:     fixture.Registry.Host,
+		vaultListener:    vaultListener,
+		registryListener: registryListener,
+		registryAddr:     registryListener.Addr().String(),
+	}, nil
+}
+
+// Transport returns a RoundTripper that routes requests for the dev registry host to the
+// embedded registry and passes everything else through to base
+func (e *Environment) Transport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &devTransport{host: e.RegistryHost, addr: e.registryAddr, base: base}
+}
+
+// Close stops the embedded services
+func (e *Environment) Close() error {
+	e.registryListener.Close()
+	return e.vaultListener.Close()
+}
+
+// devTransport rewrites requests for the virtual registry host to the loopback registry
+type devTransport struct {
+	host string
+	addr string
+	base http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *devTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !strings.EqualFold(req.URL.Hostname(), t.host) {
+		return t.base.RoundTrip(req)
+	}
+
+	req = req.Clone(req.Context())
+	req.URL.Scheme = "http"
+	req.URL.Host = t.addr
+	req.Host = t.addr
+	return t.base.RoundTrip(req)
+}
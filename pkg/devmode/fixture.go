@@ -0,0 +1,66 @@
+package devmode
+
+import (
+	_ "embed"
+	"errors"
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+//go:embed fixture.yaml
+var defaultFixture []byte
+
+var (
+	ErrInvalidFixture = errors.New("invalid dev fixture")
+)
+
+// Fixture describes the data used to seed the embedded Vault and registry
+type Fixture struct {
+	Token    string                       `yaml:"token"`
+	Secrets  map[string]map[string]string `yaml:"secrets"`
+	Groups   []string                     `yaml:"groups"`  // Vault identity groups of the token's entity
+	AppRole  *AppRoleFixture              `yaml:"approle"` // AppRole credentials logging in with the token
+	Registry RegistryFixture              `yaml:"registry"`
+}
+
+// AppRoleFixture describes AppRole credentials accepted by the embedded Vault at auth/approle
+type AppRoleFixture struct {
+	RoleID   string `yaml:"role_id"`
+	SecretID string `yaml:"secret_id"`
+}
+
+// RegistryFixture describes the embedded registry and the images it serves
+type RegistryFixture struct {
+	Host     string   `yaml:"host"`
+	Username string   `yaml:"username"`
+	Password string   `yaml:"password"`
+	Images   []string `yaml:"images"`
+}
+
+// LoadFixture reads a YAML fixture from path, or the built-in default fixture when path is empty
+func LoadFixture(path string) (*Fixture, error) {
+	data := defaultFixture
+	if path != "" {
+		fileData, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read dev fixture: %v", err)
+		}
+		data = fileData
+	}
+
+	var fixture Fixture
+	if err := yaml.Unmarshal(data, &fixture); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidFixture, err)
+	}
+
+	if fixture.Token == "" {
+		return nil, fmt.Errorf("%w: token is required", ErrInvalidFixture)
+	}
+	if fixture.Registry.Host == "" {
+		return nil, fmt.Errorf("%w: registry.host is required", ErrInvalidFixture)
+	}
+
+	return &fixture, nil
+}
@@ -0,0 +1,399 @@
+package devmode
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// maxUploadSize bounds blobs and manifests pushed to the dev registry
+const maxUploadSize = 64 * 1024 * 1024
+
+const (
+	manifestMediaType = "application/vnd.docker.distribution.manifest.v2+json"
+	configMediaType   = "application/vnd.docker.container.image.v1+json"
+	layerMediaType    = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+)
+
+// fakeRegistry is a minimal in-memory Docker Registry v2 implementation serving generated images
+type fakeRegistry struct {
+	mu         sync.RWMutex
+	username   string
+	password   string
+	blobs      map[string][]byte
+	manifests  map[string]map[string]string // repository -> reference (tag or digest) -> manifest digest
+	mediaTypes map[string]string            // manifest digest -> media type of pushed manifests
+	uploads    map[string]*bytes.Buffer     // upload id -> data received so far
+}
+
+// newFakeRegistry creates a registry serving a small generated image for every fixture image
+func newFakeRegistry(fixture *Fixture) (*fakeRegistry, error) {
+	reg := &fakeRegistry{
+		username:   fixture.Registry.Username,
+		password:   fixture.Registry.Password,
+		blobs:      make(map[string][]byte),
+		manifests:  make(map[string]map[string]string),
+		mediaTypes: make(map[string]string),
+		uploads:    make(map[string]*bytes.Buffer),
+	}
+
+	for _, image := range fixture.Registry.Images {
+		repo, tag := image, "latest"
+		if i := strings.LastIndex(image, ":"); i != -1 {
+			repo, tag = image[:i], image[i+1:]
+		}
+		if err := reg.seedImage(repo, tag); err != nil {
+			return nil, fmt.Errorf("failed to seed image %s: %v", image, err)
+		}
+	}
+
+	return reg, nil
+}
+
+// seedImage generates a single-layer image containing a greeting file and stores it under repo:tag
+func (reg *fakeRegistry) seedImage(repo, tag string) error {
+	var layerTar bytes.Buffer
+	tw := tar.NewWriter(&layerTar)
+	content := []byte(fmt.Sprintf("Hello from %s:%s served by vault-docker-proxy dev mode\n", repo, tag))
+	if err := tw.WriteHeader(&tar.Header{Name: "hello.txt", Mode: 0644, Size: int64(len(content)), ModTime: time.Unix(0, 0)}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(content); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	var layer bytes.Buffer
+	gw := gzip.NewWriter(&layer)
+	if _, err := gw.Write(layerTar.Bytes()); err != nil {
+		return err
+	}
+	if err := gw.Close(); err != nil {
+		return err
+	}
+
+	config, err := json.Marshal(map[string]interface{}{
+		"architecture": runtime.GOARCH,
+		"os":           "linux",
+		"created":      time.Unix(0, 0).UTC().Format(time.RFC3339),
+		"config": map[string]interface{}{
+			"Cmd":    []string{"/hello.txt"},
+			"Labels": map[string]string{"org.opencontainers.image.source": "vault-docker-proxy-dev"},
+		},
+		"rootfs": map[string]interface{}{
+			"type":     "layers",
+			"diff_ids": []string{digestOf(layerTar.Bytes())},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	manifest, err := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     manifestMediaType,
+		"config": map[string]interface{}{
+			"mediaType": configMediaType,
+			"size":      len(config),
+			"digest":    digestOf(config),
+		},
+		"layers": []map[string]interface{}{
+			{
+				"mediaType": layerMediaType,
+				"size":      layer.Len(),
+				"digest":    digestOf(layer.Bytes()),
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	reg.blobs[digestOf(layer.Bytes())] = layer.Bytes()
+	reg.blobs[digestOf(config)] = config
+	reg.blobs[digestOf(manifest)] = manifest
+
+	if reg.manifests[repo] == nil {
+		reg.manifests[repo] = make(map[string]string)
+	}
+	reg.manifests[repo][tag] = digestOf(manifest)
+	reg.manifests[repo][digestOf(manifest)] = digestOf(manifest)
+
+	return nil
+}
+
+// handler returns the HTTP handler for the registry API
+func (reg *fakeRegistry) handler() http.Handler {
+	r := mux.NewRouter()
+	r.Use(reg.basicAuth)
+
+	r.HandleFunc("/v2/", reg.apiVersionCheck).Methods("GET", "HEAD")
+	r.HandleFunc("/v2/_catalog", reg.catalog).Methods("GET")
+	r.HandleFunc("/v2/{name:.*}/tags/list", reg.tags).Methods("GET")
+	r.HandleFunc("/v2/{name:.*}/manifests/{reference}", reg.manifest).Methods("GET", "HEAD")
+	r.HandleFunc("/v2/{name:.*}/blobs/{digest}", reg.blob).Methods("GET", "HEAD")
+
+	// Push support, used by the image copy endpoint
+	r.HandleFunc("/v2/{name:.*}/manifests/{reference}", reg.putManifest).Methods("PUT")
+	r.HandleFunc("/v2/{name:.*}/blobs/uploads/", reg.startUpload).Methods("POST")
+	r.HandleFunc("/v2/{name:.*}/blobs/uploads/{id}", reg.patchUpload).Methods("PATCH")
+	r.HandleFunc("/v2/{name:.*}/blobs/uploads/{id}", reg.finishUpload).Methods("PUT")
+
+	return r
+}
+
+// basicAuth requires the fixture registry credentials on every request
+func (reg *fakeRegistry) basicAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		if !ok ||
+			subtle.ConstantTimeCompare([]byte(username), []byte(reg.username)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(password), []byte(reg.password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="dev-registry"`)
+			reg.writeError(w, "UNAUTHORIZED", "authentication required", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (reg *fakeRegistry) apiVersionCheck(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+	w.WriteHeader(http.StatusOK)
+}
+
+func (reg *fakeRegistry) catalog(w http.ResponseWriter, r *http.Request) {
+	reg.mu.RLock()
+	repos := make([]string, 0, len(reg.manifests))
+	for repo := range reg.manifests {
+		repos = append(repos, repo)
+	}
+	reg.mu.RUnlock()
+	sort.Strings(repos)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"repositories": repos})
+}
+
+func (reg *fakeRegistry) tags(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	reg.mu.RLock()
+	refs, ok := reg.manifests[name]
+	tags := make([]string, 0, len(refs))
+	for ref := range refs {
+		if !strings.HasPrefix(ref, "sha256:") {
+			tags = append(tags, ref)
+		}
+	}
+	reg.mu.RUnlock()
+
+	if !ok {
+		reg.writeError(w, "NAME_UNKNOWN", "repository name not known to registry", http.StatusNotFound)
+		return
+	}
+	sort.Strings(tags)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"name": name, "tags": tags})
+}
+
+func (reg *fakeRegistry) manifest(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	reg.mu.RLock()
+	digest := reg.manifests[vars["name"]][vars["reference"]]
+	content := reg.blobs[digest]
+	mediaType := reg.mediaTypes[digest]
+	reg.mu.RUnlock()
+
+	if digest == "" {
+		reg.writeError(w, "MANIFEST_UNKNOWN", "manifest unknown", http.StatusNotFound)
+		return
+	}
+	if mediaType == "" {
+		mediaType = manifestMediaType
+	}
+
+	reg.writeContent(w, r, mediaType, digest, content)
+}
+
+func (reg *fakeRegistry) putManifest(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	content, err := io.ReadAll(io.LimitReader(r.Body, maxUploadSize))
+	if err != nil {
+		reg.writeError(w, "MANIFEST_INVALID", err.Error(), http.StatusBadRequest)
+		return
+	}
+	digest := digestOf(content)
+	if strings.HasPrefix(vars["reference"], "sha256:") && vars["reference"] != digest {
+		reg.writeError(w, "DIGEST_INVALID", "manifest digest does not match reference", http.StatusBadRequest)
+		return
+	}
+
+	reg.mu.Lock()
+	reg.blobs[digest] = content
+	reg.mediaTypes[digest] = r.Header.Get("Content-Type")
+	if reg.manifests[vars["name"]] == nil {
+		reg.manifests[vars["name"]] = make(map[string]string)
+	}
+	reg.manifests[vars["name"]][vars["reference"]] = digest
+	reg.manifests[vars["name"]][digest] = digest
+	reg.mu.Unlock()
+
+	w.Header().Set("Location", fmt.Sprintf("/v2/%s/manifests/%s", vars["name"], digest))
+	w.Header().Set("Docker-Content-Digest", digest)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (reg *fakeRegistry) blob(w http.ResponseWriter, r *http.Request) {
+	digest := mux.Vars(r)["digest"]
+
+	reg.mu.RLock()
+	content, ok := reg.blobs[digest]
+	reg.mu.RUnlock()
+
+	if !ok {
+		reg.writeError(w, "BLOB_UNKNOWN", "blob unknown to registry", http.StatusNotFound)
+		return
+	}
+
+	reg.writeContent(w, r, "application/octet-stream", digest, content)
+}
+
+// startUpload begins a blob upload, or mounts an existing blob when asked to. Blobs are shared by
+// all repositories, so any known blob can be mounted.
+func (reg *fakeRegistry) startUpload(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	if digest := r.URL.Query().Get("mount"); digest != "" {
+		reg.mu.RLock()
+		_, ok := reg.blobs[digest]
+		reg.mu.RUnlock()
+		if ok {
+			w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/%s", name, digest))
+			w.Header().Set("Docker-Content-Digest", digest)
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+	}
+
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		reg.writeError(w, "UNKNOWN", err.Error(), http.StatusInternalServerError)
+		return
+	}
+	id := hex.EncodeToString(idBytes)
+
+	reg.mu.Lock()
+	reg.uploads[id] = &bytes.Buffer{}
+	reg.mu.Unlock()
+
+	w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/%s", name, id))
+	w.Header().Set("Docker-Upload-UUID", id)
+	w.Header().Set("Range", "0-0")
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// patchUpload appends a chunk to an upload in progress
+func (reg *fakeRegistry) patchUpload(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	size, err := reg.appendUpload(vars["id"], r)
+	if err != nil {
+		reg.writeError(w, "BLOB_UPLOAD_UNKNOWN", err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/%s", vars["name"], vars["id"]))
+	w.Header().Set("Docker-Upload-UUID", vars["id"])
+	w.Header().Set("Range", fmt.Sprintf("0-%d", size-1))
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// finishUpload appends the final chunk, verifies the digest and stores the blob
+func (reg *fakeRegistry) finishUpload(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	if _, err := reg.appendUpload(vars["id"], r); err != nil {
+		reg.writeError(w, "BLOB_UPLOAD_UNKNOWN", err.Error(), http.StatusNotFound)
+		return
+	}
+
+	reg.mu.Lock()
+	content := reg.uploads[vars["id"]].Bytes()
+	delete(reg.uploads, vars["id"])
+	digest := r.URL.Query().Get("digest")
+	if digest != digestOf(content) {
+		reg.mu.Unlock()
+		reg.writeError(w, "DIGEST_INVALID", "provided digest did not match uploaded content", http.StatusBadRequest)
+		return
+	}
+	reg.blobs[digest] = content
+	reg.mu.Unlock()
+
+	w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/%s", vars["name"], digest))
+	w.Header().Set("Docker-Content-Digest", digest)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// appendUpload adds the request body to an upload and returns the upload size
+func (reg *fakeRegistry) appendUpload(id string, r *http.Request) (int, error) {
+	chunk, err := io.ReadAll(io.LimitReader(r.Body, maxUploadSize))
+	if err != nil {
+		return 0, err
+	}
+
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	upload, ok := reg.uploads[id]
+	if !ok {
+		return 0, fmt.Errorf("blob upload unknown to registry")
+	}
+	upload.Write(chunk)
+	return upload.Len(), nil
+}
+
+// writeContent writes a content-addressed response, omitting the body for HEAD requests
+func (reg *fakeRegistry) writeContent(w http.ResponseWriter, r *http.Request, contentType, digest string, content []byte) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Docker-Content-Digest", digest)
+	w.Header().Set("Etag", `"`+digest+`"`)
+	// Range and If-Range requests get partial content, like registries answer resumed downloads
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+}
+
+// writeError writes a Docker Registry API compliant error response
+func (reg *fakeRegistry) writeError(w http.ResponseWriter, code, message string, statusCode int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"errors": []map[string]string{{"code": code, "message": message}},
+	})
+}
+
+// digestOf returns the sha256 content digest of data
+func digestOf(data []byte) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+}
@@ -0,0 +1,152 @@
+package devmode
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fakeVault is an in-memory stand-in for the subset of the Vault HTTP API used by the proxy
+type fakeVault struct {
+	mu      sync.RWMutex
+	token   string
+	secrets map[string]map[string]string
+	groups  []string
+	appRole *AppRoleFixture
+	created time.Time
+}
+
+// newFakeVault creates a fake Vault seeded with the fixture secrets
+func newFakeVault(fixture *Fixture) *fakeVault {
+	secrets := make(map[string]map[string]string, len(fixture.Secrets))
+	for path, data := range fixture.Secrets {
+		secrets[strings.Trim(path, "/")] = data
+	}
+
+	return &fakeVault{
+		token:   fixture.Token,
+		secrets: secrets,
+		groups:  fixture.Groups,
+		appRole: fixture.AppRole,
+		created: time.Now().UTC(),
+	}
+}
+
+// ServeHTTP implements the AppRole login, token lookup, identity and KV v2 read endpoints
+func (v *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/v1/auth/approle/login" && (r.Method == http.MethodPut || r.Method == http.MethodPost) {
+		v.appRoleLogin(w, r)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Vault-Token")), []byte(v.token)) != 1 {
+		v.writeErrors(w, http.StatusForbidden, "permission denied")
+		return
+	}
+
+	switch {
+	case r.URL.Path == "/v1/auth/token/lookup-self":
+		v.writeData(w, map[string]interface{}{
+			"id":           v.token,
+			"display_name": "dev",
+			"policies":     []string{"root"},
+			"ttl":          0,
+			"entity_id":    v.entityID(),
+		})
+	case r.URL.Path == "/v1/identity/entity/id/dev-entity" && len(v.groups) > 0:
+		groupIDs := make([]string, 0, len(v.groups))
+		for _, group := range v.groups {
+			groupIDs = append(groupIDs, "group-"+group)
+		}
+		v.writeData(w, map[string]interface{}{
+			"id":                  "dev-entity",
+			"name":                "dev",
+			"group_ids":           groupIDs,
+			"inherited_group_ids": []string{},
+		})
+	case strings.HasPrefix(r.URL.Path, "/v1/identity/group/id/group-"):
+		name := strings.TrimPrefix(r.URL.Path, "/v1/identity/group/id/group-")
+		for _, group := range v.groups {
+			if group == name {
+				v.writeData(w, map[string]interface{}{"id": "group-" + name, "name": name})
+				return
+			}
+		}
+		v.writeErrors(w, http.StatusNotFound)
+	case strings.HasPrefix(r.URL.Path, "/v1/secret/data/") && r.Method == http.MethodGet:
+		path := strings.TrimPrefix(r.URL.Path, "/v1/secret/data/")
+
+		v.mu.RLock()
+		data, ok := v.secrets[path]
+		v.mu.RUnlock()
+		if !ok {
+			v.writeErrors(w, http.StatusNotFound)
+			return
+		}
+
+		v.writeData(w, map[string]interface{}{
+			"data": data,
+			"metadata": map[string]interface{}{
+				"created_time":  v.created.Format(time.RFC3339Nano),
+				"deletion_time": "",
+				"destroyed":     false,
+				"version":       1,
+			},
+		})
+	default:
+		v.writeErrors(w, http.StatusNotFound)
+	}
+}
+
+// appRoleLogin issues the fixture token for the fixture AppRole credentials, valid for an hour
+func (v *fakeVault) appRoleLogin(w http.ResponseWriter, r *http.Request) {
+	var login struct {
+		RoleID   string `json:"role_id"`
+		SecretID string `json:"secret_id"`
+	}
+	json.NewDecoder(r.Body).Decode(&login)
+	if v.appRole == nil || login.RoleID != v.appRole.RoleID ||
+		subtle.ConstantTimeCompare([]byte(login.SecretID), []byte(v.appRole.SecretID)) != 1 {
+		v.writeErrors(w, http.StatusBadRequest, "invalid role or secret ID")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"request_id": "dev",
+		"auth": map[string]interface{}{
+			"client_token":   v.token,
+			"policies":       []string{"root"},
+			"lease_duration": 3600,
+			"renewable":      true,
+		},
+	})
+}
+
+// entityID returns the identity entity of the token, which only exists when groups are configured
+func (v *fakeVault) entityID() string {
+	if len(v.groups) == 0 {
+		return ""
+	}
+	return "dev-entity"
+}
+
+// writeData writes a Vault style response envelope
+func (v *fakeVault) writeData(w http.ResponseWriter, data map[string]interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"request_id": "dev",
+		"data":       data,
+	})
+}
+
+// writeErrors writes a Vault style error response
+func (v *fakeVault) writeErrors(w http.ResponseWriter, statusCode int, errs ...string) {
+	if errs == nil {
+		errs = []string{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(map[string]interface{}{"errors": errs})
+}
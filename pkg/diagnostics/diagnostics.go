@@ -0,0 +1,164 @@
+// Package diagnostics builds support bundles with the state of a running proxy, so support
+// requests do not require back-and-forth log collection.
+package diagnostics
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"runtime/pprof"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultErrorLogSize is the number of recent error log entries kept for bundles
+const DefaultErrorLogSize = 200
+
+// maxEntrySize caps the size of an error log entry
+const maxEntrySize = 4096
+
+// errorPattern matches log entries reporting failures
+var errorPattern = regexp.MustCompile(`(?i)fail|error|unhealthy|denied|rejected|cannot|unable|panic|timeout`)
+
+// File is a file of a diagnostics bundle, produced when the bundle is requested
+type File struct {
+	Name  string
+	Write func(w io.Writer) error
+}
+
+// JSONFile returns a bundle file holding the indented JSON of the value returned by v
+func JSONFile(name string, v func() interface{}) File {
+	return File{Name: name, Write: func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v())
+	}}
+}
+
+// ErrorLog keeps the most recent log entries reporting failures. It is an io.Writer meant to
+// receive the standard logger output; each write is one entry.
+type ErrorLog struct {
+	mu      sync.Mutex
+	entries []string
+	next    int
+	full    bool
+}
+
+// NewErrorLog creates an error log keeping the last size entries
+func NewErrorLog(size int) *ErrorLog {
+	return &ErrorLog{entries: make([]string, size)}
+}
+
+// Write implements io.Writer
+func (l *ErrorLog) Write(p []byte) (int, error) {
+	// Debug captures quote bodies that may mention errors without being failures
+	if !errorPattern.Match(p) || bytes.Contains(p, []byte("DEBUG capture")) {
+		return len(p), nil
+	}
+	entry := strings.TrimSuffix(string(p[:min(len(p), maxEntrySize)]), "\n")
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries[l.next] = entry
+	l.next = (l.next + 1) % len(l.entries)
+	l.full = l.full || l.next == 0
+	return len(p), nil
+}
+
+// Entries returns the kept entries, oldest first
+func (l *ErrorLog) Entries() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.full {
+		return append([]string(nil), l.entries[:l.next]...)
+	}
+	return append(append([]string(nil), l.entries[l.next:]...), l.entries[:l.next]...)
+}
+
+// File returns the bundle file listing the kept entries
+func (l *ErrorLog) File() File {
+	return File{Name: "errors.log", Write: func(w io.Writer) error {
+		for _, entry := range l.Entries() {
+			if _, err := fmt.Fprintln(w, entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	}}
+}
+
+// VersionFile returns the bundle file describing the build and runtime
+func VersionFile() File {
+	return JSONFile("version.json", func() interface{} {
+		version := map[string]string{
+			"go_version": runtime.Version(),
+			"os":         runtime.GOOS,
+			"arch":       runtime.GOARCH,
+			"cpus":       fmt.Sprint(runtime.NumCPU()),
+			"goroutines": fmt.Sprint(runtime.NumGoroutine()),
+		}
+		if info, ok := debug.ReadBuildInfo(); ok {
+			version["module"] = info.Main.Path
+			version["version"] = info.Main.Version
+			for _, setting := range info.Settings {
+				switch setting.Key {
+				case "vcs.revision", "vcs.time", "vcs.modified":
+					version[setting.Key] = setting.Value
+				}
+			}
+		}
+		return version
+	})
+}
+
+// GoroutinesFile returns the bundle file holding the stacks of all goroutines
+func GoroutinesFile() File {
+	return File{Name: "goroutines.txt", Write: func(w io.Writer) error {
+		return pprof.Lookup("goroutine").WriteTo(w, 2)
+	}}
+}
+
+// Handler serves the files as a gzipped tar bundle. A file that fails to be produced is replaced
+// by a .error file explaining why, so one broken component does not prevent the bundle.
+func Handler(files []File) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now().UTC().Truncate(time.Second)
+		name := "vault-docker-proxy-diagnostics-" + now.Format("20060102T150405Z")
+
+		w.Header().Set("Content-Type", "application/gzip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.tar.gz"`, name))
+
+		gz := gzip.NewWriter(w)
+		tw := tar.NewWriter(gz)
+		for _, file := range files {
+			var buf bytes.Buffer
+			fileName := file.Name
+			if err := file.Write(&buf); err != nil {
+				buf.Reset()
+				fmt.Fprintf(&buf, "failed to produce %s: %v\n", file.Name, err)
+				fileName += ".error"
+			}
+			header := &tar.Header{Name: name + "/" + fileName, Mode: 0644, Size: int64(buf.Len()), ModTime: now}
+			if err := tw.WriteHeader(header); err != nil {
+				slog.Error("Failed to write diagnostics bundle", "error", err)
+				return
+			}
+			if _, err := tw.Write(buf.Bytes()); err != nil {
+				slog.Error("Failed to write diagnostics bundle", "error", err)
+				return
+			}
+		}
+		tw.Close()
+		gz.Close()
+		slog.Info("Served diagnostics bundle", "remote_addr", r.RemoteAddr)
+	}
+}
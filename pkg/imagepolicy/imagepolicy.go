@@ -0,0 +1,182 @@
+// Package imagepolicy decides which images may be pulled through the proxy, from allow and deny
+// rules on registries, repositories and tags kept in a policy file
+package imagepolicy
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Rule actions, and the default actions of a policy
+const (
+	ActionAllow = "allow"
+	ActionDeny  = "deny"
+)
+
+// regexPrefix marks a pattern as a regular expression rather than a glob
+const regexPrefix = "regex:"
+
+// File is the policy file
+type File struct {
+	Default string `yaml:"default"` // action for images no rule matches, allow when empty
+	Rules   []Rule `yaml:"rules"`
+}
+
+// Rule allows or denies the images whose registry, repository and tag match its patterns. Patterns
+// are globs, where * also matches / and dots, or anchored regular expressions prefixed with
+// regex:. An empty list matches everything.
+type Rule struct {
+	Name         string   `yaml:"name"`
+	Action       string   `yaml:"action"`       // allow or deny
+	Registries   []string `yaml:"registries"`   // registry hosts
+	Repositories []string `yaml:"repositories"` // repository names
+	Tags         []string `yaml:"tags"`         // tags of manifest pulls
+}
+
+// Policy is a compiled policy file. Allow rules are exceptions to deny rules: an image matching
+// an allow rule is allowed whatever deny rules it matches.
+type Policy struct {
+	defaultAllow bool
+	rules        []compiledRule
+}
+
+// compiledRule is a Rule with its patterns compiled
+type compiledRule struct {
+	name         string
+	allow        bool
+	registries   []*regexp.Regexp
+	repositories []*regexp.Regexp
+	tags         []*regexp.Regexp
+}
+
+// Decision is the outcome of a policy for an image
+type Decision struct {
+	Allowed bool
+	Rule    string // the rule deciding, empty when the default action did
+}
+
+// Load reads and compiles a policy file
+func Load(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image policy: %v", err)
+	}
+	var file File
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid image policy %s: %v", path, err)
+	}
+	policy, err := Compile(file)
+	if err != nil {
+		return nil, fmt.Errorf("invalid image policy %s: %v", path, err)
+	}
+	return policy, nil
+}
+
+// Compile validates a policy file and compiles its patterns
+func Compile(file File) (*Policy, error) {
+	policy := &Policy{defaultAllow: file.Default != ActionDeny}
+	if file.Default != "" && file.Default != ActionAllow && file.Default != ActionDeny {
+		return nil, fmt.Errorf("unknown default action %q, expected allow or deny", file.Default)
+	}
+
+	names := make(map[string]bool, len(file.Rules))
+	for i, rule := range file.Rules {
+		if rule.Name == "" {
+			return nil, fmt.Errorf("rules[%d] has no name", i)
+		}
+		if names[rule.Name] {
+			return nil, fmt.Errorf("rule %s is defined twice", rule.Name)
+		}
+		names[rule.Name] = true
+		if rule.Action != ActionAllow && rule.Action != ActionDeny {
+			return nil, fmt.Errorf("rule %s: unknown action %q, expected allow or deny", rule.Name, rule.Action)
+		}
+
+		compiled := compiledRule{name: rule.Name, allow: rule.Action == ActionAllow}
+		var err error
+		if compiled.registries, err = compilePatterns(rule.Registries); err != nil {
+			return nil, fmt.Errorf("rule %s: invalid registry %v", rule.Name, err)
+		}
+		if compiled.repositories, err = compilePatterns(rule.Repositories); err != nil {
+			return nil, fmt.Errorf("rule %s: invalid repository %v", rule.Name, err)
+		}
+		if compiled.tags, err = compilePatterns(rule.Tags); err != nil {
+			return nil, fmt.Errorf("rule %s: invalid tag %v", rule.Name, err)
+		}
+		policy.rules = append(policy.rules, compiled)
+	}
+	return policy, nil
+}
+
+// compilePatterns compiles globs and regex: patterns into anchored regexps
+func compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	var compiled []*regexp.Regexp
+	for _, pattern := range patterns {
+		if pattern == "" {
+			return nil, errors.New(`"": patterns cannot be empty`)
+		}
+		expr, ok := strings.CutPrefix(pattern, regexPrefix)
+		if !ok {
+			expr = strings.NewReplacer(`\*`, ".*", `\?`, ".").Replace(regexp.QuoteMeta(pattern))
+		}
+		re, err := regexp.Compile("^(?:" + expr + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("%q: %v", pattern, err)
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+// Rules returns the number of rules of the policy
+func (p *Policy) Rules() int {
+	return len(p.rules)
+}
+
+// Evaluate decides whether an image may be pulled. tag is empty for requests naming no tag: pulls
+// by digest, of blobs and of tag lists, which clients make for images they resolved by tag.
+// These are only checked against registries and repositories: deny rules with tags do not apply
+// to them, and allow rules apply whatever their tags.
+func (p *Policy) Evaluate(registry, repository, tag string) Decision {
+	denied := ""
+	for _, rule := range p.rules {
+		if !matches(rule.registries, registry) || !matches(rule.repositories, repository) {
+			continue
+		}
+		if tag == "" {
+			if !rule.allow && len(rule.tags) > 0 {
+				continue
+			}
+		} else if !matches(rule.tags, tag) {
+			continue
+		}
+		if rule.allow {
+			return Decision{Allowed: true, Rule: rule.name}
+		}
+		if denied == "" {
+			denied = rule.name
+		}
+	}
+	if denied != "" {
+		return Decision{Allowed: false, Rule: denied}
+	}
+	return Decision{Allowed: p.defaultAllow}
+}
+
+// matches reports whether value matches one of patterns, or patterns is empty
+func matches(patterns []*regexp.Regexp, value string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, re := range patterns {
+		if re.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,117 @@
+package imagepolicy
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"vault-docker-proxy/pkg/admin"
+	"vault-docker-proxy/pkg/logging"
+)
+
+// pollInterval is how often the policy file is checked for changes
+const pollInterval = 10 * time.Second
+
+// Reloader holds the policy of a policy file, and loads it again whenever the file changes or
+// on request. It is safe for concurrent use.
+type Reloader struct {
+	path string
+
+	mu      sync.Mutex
+	policy  *Policy
+	modTime time.Time
+}
+
+// NewReloader loads the policy file at path
+func NewReloader(path string) (*Reloader, error) {
+	r := &Reloader{path: path}
+	if _, err := r.reload(false); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Policy returns the current policy
+func (r *Reloader) Policy() *Policy {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.policy
+}
+
+// Run reloads the policy whenever its file changes, until ctx is cancelled. A file that fails to
+// load leaves the current policy in place, so a mistake never opens or closes every pull.
+func (r *Reloader) Run(ctx context.Context) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	var lastErr string
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		reloaded, err := r.reload(false)
+		if err != nil {
+			// Logged once until the file loads again
+			if err.Error() != lastErr {
+				slog.Warn("Failed to reload the image policy, keeping the current one", "error", err)
+			}
+			lastErr = err.Error()
+			continue
+		}
+		lastErr = ""
+		if reloaded {
+			slog.Info("Reloaded the image policy", "file", r.path, "rules", r.Policy().Rules())
+		}
+	}
+}
+
+// Reload loads the policy file again, even if it did not change
+func (r *Reloader) Reload() error {
+	_, err := r.reload(true)
+	return err
+}
+
+// reload loads the policy file if it changed since it was last loaded, or unconditionally when
+// force is set, and reports whether it did
+func (r *Reloader) reload(force bool) (bool, error) {
+	info, err := os.Stat(r.path)
+	if err != nil {
+		return false, fmt.Errorf("failed to read image policy: %v", err)
+	}
+
+	r.mu.Lock()
+	unchanged := r.policy != nil && info.ModTime().Equal(r.modTime)
+	r.mu.Unlock()
+	if unchanged && !force {
+		return false, nil
+	}
+
+	policy, err := Load(r.path)
+	if err != nil {
+		return false, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.policy = policy
+	r.modTime = info.ModTime()
+	return true, nil
+}
+
+// ReloadHandler reloads the policy file for the admin listener
+func (r *Reloader) ReloadHandler(w http.ResponseWriter, req *http.Request) {
+	if err := r.Reload(); err != nil {
+		logging.FromContext(req.Context()).Error("Image policy reload failed", "error", err)
+		admin.WriteError(w, "RELOAD_FAILED", err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	slog.Info("Reloaded the image policy", "file", r.path, "rules", r.Policy().Rules())
+	admin.WriteJSON(w, http.StatusOK, map[string]any{"file": r.path, "rules": r.Policy().Rules()})
+}
@@ -0,0 +1,72 @@
+package logging
+
+import (
+	"net"
+	"net/http"
+	"time"
+)
+
+// AccessLog logs every request once it is served: its method, path, status, response size,
+// duration and client IP, with the fields of the request. It runs inside Middleware, so entries
+// carry the request ID and the registry and Vault path added while serving the request.
+func AccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		aw := &accessWriter{ResponseWriter: w}
+		defer func() {
+			FromContext(r.Context()).Info("Request",
+				"method", r.Method,
+				"path", r.URL.Path,
+				"status", aw.statusCode(),
+				"bytes", aw.bytes,
+				"duration", time.Since(start),
+				"client_ip", clientIP(r))
+		}()
+		next.ServeHTTP(aw, r)
+	})
+}
+
+// accessWriter records the status code and size of a response
+type accessWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (aw *accessWriter) WriteHeader(status int) {
+	if aw.status == 0 {
+		aw.status = status
+	}
+	aw.ResponseWriter.WriteHeader(status)
+}
+
+func (aw *accessWriter) Write(b []byte) (int, error) {
+	if aw.status == 0 {
+		aw.status = http.StatusOK
+	}
+	n, err := aw.ResponseWriter.Write(b)
+	aw.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap returns the underlying ResponseWriter, for http.ResponseController
+func (aw *accessWriter) Unwrap() http.ResponseWriter {
+	return aw.ResponseWriter
+}
+
+// statusCode returns the status code written, 200 when the handler wrote nothing
+func (aw *accessWriter) statusCode() int {
+	if aw.status == 0 {
+		return http.StatusOK
+	}
+	return aw.status
+}
+
+// clientIP returns the address of the client connection
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,201 @@
+// Package logging configures the proxy's structured, leveled logs and carries the fields of a
+// request, such as its ID, registry and Vault path, to every log entry made while serving it
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+
+	// RequestIDHeader carries the ID of a request, set by clients or load balancers to correlate
+	// their logs with the proxy's and returned in every response
+	RequestIDHeader = "X-Request-Id"
+
+	// maxRequestIDLength caps the length of request IDs taken from clients
+	maxRequestIDLength = 128
+)
+
+// ParseLevel parses a log level: debug, info, warn or error
+func ParseLevel(level string) (slog.Level, error) {
+	switch strings.ToLower(level) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info", "":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q, expected debug, info, warn or error", level)
+}
+
+// NewHandler creates a handler writing entries of at least level to w, as logfmt text or JSON,
+// with secrets masked
+func NewHandler(w io.Writer, level, format string) (slog.Handler, error) {
+	lvl, err := ParseLevel(level)
+	if err != nil {
+		return nil, err
+	}
+	options := &slog.HandlerOptions{Level: lvl}
+	switch format {
+	case FormatText, "":
+		return &redactHandler{handler: slog.NewTextHandler(w, options)}, nil
+	case FormatJSON:
+		return &redactHandler{handler: slog.NewJSONHandler(w, options)}, nil
+	}
+	return nil, fmt.Errorf("unknown log format %q, expected text or json", format)
+}
+
+// Setup makes a logger writing to w the default. Output of the standard log package goes
+// through it as well, at the info level.
+func Setup(w io.Writer, level, format string) error {
+	handler, err := NewHandler(w, level, format)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// requestFields are the fields logged with every entry of a request. They are added while the
+// request is served, as its registry and Vault path are only known after authentication. Secrets
+// of the request are masked in those entries.
+type requestFields struct {
+	mu      sync.Mutex
+	attrs   []any
+	secrets []string
+}
+
+type contextKey struct{}
+
+// Middleware gives every request an ID, taken from its X-Request-Id header when set, returned in
+// the X-Request-Id response header and logged as request_id by the loggers of FromContext. The
+// header is set on the request too, so requests forwarded upstream carry the same ID. The
+// credentials of the request are masked in the entries of those loggers.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		r.Header.Set(RequestIDHeader, id)
+		w.Header().Set(RequestIDHeader, id)
+		ctx := NewContext(r.Context(), "request_id", id)
+		addRequestSecrets(ctx, r)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// NewContext returns a context whose loggers log the given fields, as key-value pairs, in
+// addition to those of ctx
+func NewContext(ctx context.Context, args ...any) context.Context {
+	fields := &requestFields{}
+	if parent, ok := ctx.Value(contextKey{}).(*requestFields); ok {
+		fields.attrs = parent.snapshot()
+		fields.secrets = parent.secretsSnapshot()
+	}
+	fields.set(args)
+	return context.WithValue(ctx, contextKey{}, fields)
+}
+
+// AddFields adds fields, as key-value pairs, to the entries logged for the rest of the request
+// of ctx, replacing fields of the same keys. It does nothing outside a request context.
+func AddFields(ctx context.Context, args ...any) {
+	if fields, ok := ctx.Value(contextKey{}).(*requestFields); ok {
+		fields.mu.Lock()
+		fields.set(args)
+		fields.mu.Unlock()
+	}
+}
+
+// FromContext returns the default logger with the fields of the request of ctx, masking its
+// secrets
+func FromContext(ctx context.Context) *slog.Logger {
+	fields, ok := ctx.Value(contextKey{}).(*requestFields)
+	if !ok {
+		return slog.Default()
+	}
+	logger := slog.Default()
+	if secrets := fields.secretsSnapshot(); len(secrets) > 0 {
+		logger = slog.New(&redactHandler{handler: logger.Handler(), secrets: secrets})
+	}
+	return logger.With(fields.snapshot()...)
+}
+
+// RequestID returns the ID of the request of ctx, empty outside a request context
+func RequestID(ctx context.Context) string {
+	fields, ok := ctx.Value(contextKey{}).(*requestFields)
+	if !ok {
+		return ""
+	}
+	attrs := fields.snapshot()
+	for i := 0; i+1 < len(attrs); i += 2 {
+		if attrs[i] == "request_id" {
+			id, _ := attrs[i+1].(string)
+			return id
+		}
+	}
+	return ""
+}
+
+// set sets fields given as key-value pairs; the caller holds f.mu unless f is not shared yet
+func (f *requestFields) set(args []any) {
+	for i := 0; i+1 < len(args); i += 2 {
+		replaced := false
+		for j := 0; j+1 < len(f.attrs); j += 2 {
+			if f.attrs[j] == args[i] {
+				f.attrs[j+1] = args[i+1]
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			f.attrs = append(f.attrs, args[i], args[i+1])
+		}
+	}
+}
+
+func (f *requestFields) snapshot() []any {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]any(nil), f.attrs...)
+}
+
+func (f *requestFields) secretsSnapshot() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.secrets...)
+}
+
+// newRequestID generates a random request ID
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// validRequestID reports whether a request ID taken from a client can be logged as is: not
+// empty, short and printable ASCII, so it cannot forge log entries
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
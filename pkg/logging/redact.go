@@ -0,0 +1,201 @@
+package logging
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Redacted replaces secrets in log entries and error messages
+const Redacted = "[redacted]"
+
+// minSecretLength is the length below which secrets registered for a request are not searched
+// for, as they would match innocent text
+const minSecretLength = 8
+
+// secretPatterns match secrets in any text, with the replacement keeping what identifies them
+var secretPatterns = []struct {
+	pattern     *regexp.Regexp
+	replacement string
+}{
+	// Vault service, batch and recovery tokens, in their current and legacy formats
+	{regexp.MustCompile(`\bhv[sbr]\.[A-Za-z0-9_-]{20,}`), Redacted},
+	{regexp.MustCompile(`\b[sbr]\.[A-Za-z0-9]{24}\b`), Redacted},
+	// JWTs, such as registry, OIDC and Kubernetes service account tokens
+	{regexp.MustCompile(`\beyJ[A-Za-z0-9_-]*\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`), Redacted},
+	// Passwords in URLs
+	{regexp.MustCompile(`(?i)(\b[a-z][a-z0-9+.-]*://[^/\s:@]*:)[^/\s@]+@`), "${1}" + Redacted + "@"},
+	// Credential values in JSON, forms, queries and key=value text
+	{regexp.MustCompile(`(?i)("(?:[a-z_]*token|password|[a-z_]*secret|secret_id)"\s*:\s*)"(?:[^"\\]|\\.)*"`), `$1"` + Redacted + `"`},
+	{regexp.MustCompile(`(?i)\b((?:[a-z_]*token|password|passwd|[a-z_]*secret|secret_id)=)[^\s&,;"']+`), "${1}" + Redacted},
+	// Authentication headers quoted in messages
+	{regexp.MustCompile(`(?i)\b((?:x-vault-token|x-api-key|x-registry-authorization|cookie):\s*)\S+`), "${1}" + Redacted},
+}
+
+// authorizationCredentials matches the credentials of Basic and Bearer authorization values
+var authorizationCredentials = regexp.MustCompile(`(?i)\b(basic|bearer)(\s+)([A-Za-z0-9._~+/-]+=*)`)
+
+// Redact masks Vault tokens, Bearer and Basic credentials, passwords in URLs and credential
+// values in JSON or key=value text. Proxied error messages go through it before they are
+// returned to clients, and every log entry before it is written.
+func Redact(s string) string {
+	for _, p := range secretPatterns {
+		s = p.pattern.ReplaceAllString(s, p.replacement)
+	}
+	return authorizationCredentials.ReplaceAllStringFunc(s, func(match string) string {
+		parts := authorizationCredentials.FindStringSubmatch(match)
+		if !looksLikeCredentials(parts[3]) {
+			return match // prose such as "Basic credentials"
+		}
+		return parts[1] + parts[2] + Redacted
+	})
+}
+
+// looksLikeCredentials tells encoded credentials from words following "Basic" or "Bearer"
+func looksLikeCredentials(value string) bool {
+	if len(value) < minSecretLength {
+		return false
+	}
+	for i := 0; i < len(value); i++ {
+		if value[i] < 'a' || value[i] > 'z' {
+			return true
+		}
+	}
+	return false
+}
+
+// AddSecrets registers secrets of the request of ctx, such as the Vault token it authenticates
+// with or the Authorization value sent upstream, so the loggers of FromContext mask them in every
+// entry made for the rest of the request. It does nothing outside a request context.
+func AddSecrets(ctx context.Context, secrets ...string) {
+	fields, ok := ctx.Value(contextKey{}).(*requestFields)
+	if !ok {
+		return
+	}
+	fields.mu.Lock()
+	defer fields.mu.Unlock()
+	for _, secret := range secrets {
+		if len(secret) >= minSecretLength && !contains(fields.secrets, secret) {
+			fields.secrets = append(fields.secrets, secret)
+		}
+	}
+}
+
+// AddAuthorizationSecrets registers the secrets of an Authorization header value: the whole
+// value, its credentials and, for Basic credentials, the password
+func AddAuthorizationSecrets(ctx context.Context, authorization string) {
+	if authorization == "" {
+		return
+	}
+	secrets := []string{authorization}
+	if scheme, credentials, ok := strings.Cut(authorization, " "); ok && credentials != "" {
+		secrets = append(secrets, credentials)
+		if strings.EqualFold(scheme, "basic") {
+			if decoded, err := base64.StdEncoding.DecodeString(credentials); err == nil {
+				if _, password, ok := strings.Cut(string(decoded), ":"); ok {
+					secrets = append(secrets, password)
+				}
+			}
+		}
+	}
+	AddSecrets(ctx, secrets...)
+}
+
+// addRequestSecrets registers the credentials a client authenticates with
+func addRequestSecrets(ctx context.Context, r *http.Request) {
+	AddAuthorizationSecrets(ctx, r.Header.Get("Authorization"))
+	AddAuthorizationSecrets(ctx, r.Header.Get("X-Registry-Authorization"))
+	AddSecrets(ctx, r.Header.Get("X-Vault-Token"), r.Header.Get("X-API-Key"))
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// redactHandler masks secrets in the message and attributes of entries before passing them on:
+// values of attributes named after credentials, secrets known to the request being logged and
+// anything Redact recognizes
+type redactHandler struct {
+	handler slog.Handler
+	secrets []string
+}
+
+func (h *redactHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.handler.Enabled(ctx, level)
+}
+
+func (h *redactHandler) Handle(ctx context.Context, record slog.Record) error {
+	redacted := slog.NewRecord(record.Time, record.Level, h.redact(record.Message), record.PC)
+	record.Attrs(func(attr slog.Attr) bool {
+		redacted.AddAttrs(h.redactAttr(attr))
+		return true
+	})
+	return h.handler.Handle(ctx, redacted)
+}
+
+func (h *redactHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, len(attrs))
+	for i, attr := range attrs {
+		redacted[i] = h.redactAttr(attr)
+	}
+	return &redactHandler{handler: h.handler.WithAttrs(redacted), secrets: h.secrets}
+}
+
+func (h *redactHandler) WithGroup(name string) slog.Handler {
+	return &redactHandler{handler: h.handler.WithGroup(name), secrets: h.secrets}
+}
+
+// redact masks the secrets of the request, then those Redact recognizes
+func (h *redactHandler) redact(s string) string {
+	for _, secret := range h.secrets {
+		s = strings.ReplaceAll(s, secret, Redacted)
+	}
+	return Redact(s)
+}
+
+func (h *redactHandler) redactAttr(attr slog.Attr) slog.Attr {
+	attr.Value = attr.Value.Resolve()
+	if sensitiveKey(attr.Key) {
+		return slog.String(attr.Key, Redacted)
+	}
+	switch attr.Value.Kind() {
+	case slog.KindString:
+		attr.Value = slog.StringValue(h.redact(attr.Value.String()))
+	case slog.KindGroup:
+		group := attr.Value.Group()
+		redacted := make([]slog.Attr, len(group))
+		for i, member := range group {
+			redacted[i] = h.redactAttr(member)
+		}
+		attr.Value = slog.GroupValue(redacted...)
+	case slog.KindAny:
+		// Errors and other values are formatted as text; they are only replaced by their
+		// redacted text when it differs, so structured values keep their encoding
+		text := fmt.Sprint(attr.Value.Any())
+		if redacted := h.redact(text); redacted != text {
+			attr.Value = slog.StringValue(redacted)
+		}
+	}
+	return attr
+}
+
+// sensitiveKey reports whether an attribute holds a credential by its name, such as token,
+// vault_token, password or authorization
+func sensitiveKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, name := range []string{"token", "password", "secret", "secret_id", "authorization"} {
+		if key == name || strings.HasSuffix(key, "_"+name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,114 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Requests records the requests served by a handler: their number, status code and latency
+// per endpoint and method
+type Requests struct {
+	histogram *Histogram
+	endpoint  func(r *http.Request) string
+}
+
+// NewRequests creates request metrics named name. endpoint names the endpoint of a request; it
+// must only return a few distinct values, as each becomes a time series.
+func NewRequests(name, help string, endpoint func(r *http.Request) string) *Requests {
+	return &Requests{
+		histogram: NewHistogram(name, help, DefaultBuckets, "endpoint", "method", "code"),
+		endpoint:  endpoint,
+	}
+}
+
+// Middleware records the requests served by next
+func (m *Requests) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		defer func() {
+			m.histogram.Observe(time.Since(start).Seconds(), m.endpoint(r), r.Method, strconv.Itoa(sw.statusCode()))
+		}()
+		next.ServeHTTP(sw, r)
+	})
+}
+
+// Collect implements Collector
+func (m *Requests) Collect(w *Writer) {
+	m.histogram.Collect(w)
+}
+
+// statusWriter records the status code of a response
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	if sw.status == 0 {
+		sw.status = status
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	return sw.ResponseWriter.Write(b)
+}
+
+// Unwrap returns the underlying ResponseWriter, for http.ResponseController
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// statusCode returns the status code written, 200 when the handler wrote nothing
+func (sw *statusWriter) statusCode() int {
+	if sw.status == 0 {
+		return http.StatusOK
+	}
+	return sw.status
+}
+
+// Transport records the requests made through an http.RoundTripper: their number, status code
+// and latency per host and method. Requests failing without a response have the code "error".
+type Transport struct {
+	histogram *Histogram
+}
+
+// NewTransport creates transport metrics named name
+func NewTransport(name, help string) *Transport {
+	return &Transport{histogram: NewHistogram(name, help, DefaultBuckets, "host", "method", "code")}
+}
+
+// Wrap returns base recording its requests; a nil base is http.DefaultTransport
+func (m *Transport) Wrap(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		start := time.Now()
+		resp, err := base.RoundTrip(req)
+		code := "error"
+		if err == nil {
+			code = strconv.Itoa(resp.StatusCode)
+		}
+		m.histogram.Observe(time.Since(start).Seconds(), req.URL.Host, req.Method, code)
+		return resp, err
+	})
+}
+
+// Collect implements Collector
+func (m *Transport) Collect(w *Writer) {
+	m.histogram.Collect(w)
+}
+
+// roundTripperFunc is a function implementing http.RoundTripper
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+// RoundTrip implements http.RoundTripper
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
@@ -0,0 +1,177 @@
+// Package metrics exposes the proxy's metrics in the Prometheus text exposition format
+package metrics
+
+import (
+	"bufio"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ContentType is the media type of the Prometheus text exposition format
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefaultBuckets are the upper bounds, in seconds, of latency histograms
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// Label is a metric label
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Collector writes metric families when the metrics are scraped
+type Collector interface {
+	Collect(w *Writer)
+}
+
+// CollectorFunc is a function implementing Collector
+type CollectorFunc func(w *Writer)
+
+// Collect implements Collector
+func (f CollectorFunc) Collect(w *Writer) {
+	f(w)
+}
+
+// Writer writes metric families in the text exposition format. A family is announced with
+// Family and followed by its samples.
+type Writer struct {
+	w *bufio.Writer
+}
+
+// Family writes the help and type of a metric family: counter, gauge or histogram
+func (w *Writer) Family(name, kind, help string) {
+	w.w.WriteString("# HELP " + name + " " + escapeHelp(help) + "\n")
+	w.w.WriteString("# TYPE " + name + " " + kind + "\n")
+}
+
+// Sample writes a sample of the current family
+func (w *Writer) Sample(name string, value float64, labels ...Label) {
+	w.w.WriteString(name)
+	if len(labels) > 0 {
+		w.w.WriteByte('{')
+		for i, label := range labels {
+			if i > 0 {
+				w.w.WriteByte(',')
+			}
+			w.w.WriteString(label.Name + `="` + escapeLabel(label.Value) + `"`)
+		}
+		w.w.WriteByte('}')
+	}
+	w.w.WriteByte(' ')
+	w.w.WriteString(formatValue(value))
+	w.w.WriteByte('\n')
+}
+
+// Handler serves the metrics of collectors, in order
+func Handler(collectors ...Collector) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", ContentType)
+		w := &Writer{w: bufio.NewWriter(rw)}
+		for _, collector := range collectors {
+			collector.Collect(w)
+		}
+		w.w.Flush()
+	})
+}
+
+// Histogram counts observations, such as request latencies, in buckets per set of label values.
+// It is safe for concurrent use.
+type Histogram struct {
+	name       string
+	help       string
+	labelNames []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	series map[string]*histogramSeries // by label values joined with NUL
+}
+
+// histogramSeries is the state of a histogram for one set of label values
+type histogramSeries struct {
+	labelValues []string
+	counts      []uint64 // one per bucket, plus one for larger observations
+	sum         float64
+}
+
+// NewHistogram creates a histogram with the given bucket upper bounds and label names
+func NewHistogram(name, help string, buckets []float64, labelNames ...string) *Histogram {
+	return &Histogram{
+		name:       name,
+		help:       help,
+		labelNames: labelNames,
+		buckets:    buckets,
+		series:     make(map[string]*histogramSeries),
+	}
+}
+
+// Observe records a value with label values given in the order of the label names
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\x00")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	series, ok := h.series[key]
+	if !ok {
+		series = &histogramSeries{labelValues: labelValues, counts: make([]uint64, len(h.buckets)+1)}
+		h.series[key] = series
+	}
+	series.counts[sort.SearchFloat64s(h.buckets, value)]++
+	series.sum += value
+}
+
+// Collect implements Collector
+func (h *Histogram) Collect(w *Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	w.Family(h.name, "histogram", h.help)
+	for _, key := range keys {
+		series := h.series[key]
+		labels := make([]Label, len(h.labelNames), len(h.labelNames)+1)
+		for i, name := range h.labelNames {
+			labels[i] = Label{Name: name, Value: series.labelValues[i]}
+		}
+		var cumulative uint64
+		for i, count := range series.counts {
+			cumulative += count
+			bound := math.Inf(1)
+			if i < len(h.buckets) {
+				bound = h.buckets[i]
+			}
+			w.Sample(h.name+"_bucket", float64(cumulative), append(labels, Label{Name: "le", Value: formatValue(bound)})...)
+		}
+		w.Sample(h.name+"_sum", series.sum, labels...)
+		w.Sample(h.name+"_count", float64(cumulative), labels...)
+	}
+}
+
+// formatValue formats a sample value or bucket bound
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// escapeLabel escapes a label value
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// escapeHelp escapes a help text
+func escapeHelp(help string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+}
@@ -0,0 +1,279 @@
+// Package notation verifies Notation (Notary Project) signatures of images against trust
+// policies and trust stores laid out as the notation CLI keeps them
+package notation
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Verification levels of a trust policy
+const (
+	LevelStrict     = "strict"
+	LevelPermissive = "permissive"
+	LevelAudit      = "audit"
+	LevelSkip       = "skip"
+)
+
+// Actions taken when a validation fails
+const (
+	ActionEnforce = "enforce"
+	ActionLog     = "log"
+	ActionSkip    = "skip"
+)
+
+// Validations performed on a signature, which a trust policy can override
+const (
+	ValidationIntegrity          = "integrity"
+	ValidationAuthenticity       = "authenticity"
+	ValidationAuthenticTimestamp = "authenticTimestamp"
+	ValidationExpiry             = "expiry"
+	ValidationRevocation         = "revocation"
+)
+
+// levelActions are the actions of each verification level, by validation
+var levelActions = map[string]map[string]string{
+	LevelStrict: {
+		ValidationIntegrity: ActionEnforce, ValidationAuthenticity: ActionEnforce,
+		ValidationAuthenticTimestamp: ActionEnforce, ValidationExpiry: ActionEnforce,
+		ValidationRevocation: ActionEnforce,
+	},
+	LevelPermissive: {
+		ValidationIntegrity: ActionEnforce, ValidationAuthenticity: ActionEnforce,
+		ValidationAuthenticTimestamp: ActionLog, ValidationExpiry: ActionLog,
+		ValidationRevocation: ActionLog,
+	},
+	LevelAudit: {
+		ValidationIntegrity: ActionEnforce, ValidationAuthenticity: ActionLog,
+		ValidationAuthenticTimestamp: ActionLog, ValidationExpiry: ActionLog,
+		ValidationRevocation: ActionLog,
+	},
+	LevelSkip: {
+		ValidationIntegrity: ActionSkip, ValidationAuthenticity: ActionSkip,
+		ValidationAuthenticTimestamp: ActionSkip, ValidationExpiry: ActionSkip,
+		ValidationRevocation: ActionSkip,
+	},
+}
+
+// trustStoreTypes are the trust store types of trust policies, as directories of the trust store
+var trustStoreTypes = []string{"ca", "signingAuthority"}
+
+// TrustPolicyDocument is a Notation trustpolicy.json document
+type TrustPolicyDocument struct {
+	Version       string        `json:"version"`
+	TrustPolicies []TrustPolicy `json:"trustPolicies"`
+}
+
+// TrustPolicy decides how the signatures of the repositories in its registry scopes are verified
+type TrustPolicy struct {
+	Name                  string                `json:"name"`
+	RegistryScopes        []string              `json:"registryScopes"` // registry/repository, or * for every repository
+	SignatureVerification SignatureVerification `json:"signatureVerification"`
+	TrustStores           []string              `json:"trustStores"`       // <type>:<name>, such as ca:acme
+	TrustedIdentities     []string              `json:"trustedIdentities"` // x509.subject: <DN>, or *
+}
+
+// SignatureVerification is the verification level of a trust policy and its overrides
+type SignatureVerification struct {
+	Level    string            `json:"level"`
+	Override map[string]string `json:"override,omitempty"` // action by validation
+}
+
+// Action returns the action taken when the given validation fails
+func (p *TrustPolicy) Action(validation string) string {
+	if action, ok := p.SignatureVerification.Override[validation]; ok {
+		return action
+	}
+	return levelActions[p.SignatureVerification.Level][validation]
+}
+
+// LoadTrustPolicy reads a trustpolicy.json document and the trust stores it names from
+// trustStoreDir, laid out as x509/<type>/<name>/*.pem or *.crt
+func LoadTrustPolicy(policyFile, trustStoreDir string) (*Verifier, error) {
+	data, err := os.ReadFile(policyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read trust policy: %v", err)
+	}
+	var doc TrustPolicyDocument
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("invalid trust policy %s: %v", policyFile, err)
+	}
+
+	stores := make(map[string][]*x509.Certificate)
+	for _, policy := range doc.TrustPolicies {
+		for _, store := range policy.TrustStores {
+			if _, ok := stores[store]; ok {
+				continue
+			}
+			storeType, name, _ := strings.Cut(store, ":")
+			certificates, err := loadCertificates(filepath.Join(trustStoreDir, "x509", storeType, name))
+			if err != nil {
+				return nil, fmt.Errorf("trust policy %q: trust store %s: %v", policy.Name, store, err)
+			}
+			stores[store] = certificates
+		}
+	}
+	return NewVerifier(doc, stores)
+}
+
+// loadCertificates reads the PEM certificates of the files in a trust store directory
+func loadCertificates(dir string) ([]*x509.Certificate, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var certificates []*x509.Certificate
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+			if block.Type != "CERTIFICATE" {
+				continue
+			}
+			certificate, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", entry.Name(), err)
+			}
+			certificates = append(certificates, certificate)
+		}
+	}
+	if len(certificates) == 0 {
+		return nil, errors.New("no certificates found")
+	}
+	return certificates, nil
+}
+
+// validate checks a trust policy document as the notation CLI does
+func (doc *TrustPolicyDocument) validate() error {
+	if doc.Version != "1.0" {
+		return fmt.Errorf("unsupported trust policy version %q, expected 1.0", doc.Version)
+	}
+	if len(doc.TrustPolicies) == 0 {
+		return errors.New("no trust policies")
+	}
+	names := make(map[string]bool)
+	scopes := make(map[string]string)
+	for _, policy := range doc.TrustPolicies {
+		if policy.Name == "" {
+			return errors.New("a trust policy has no name")
+		}
+		if names[policy.Name] {
+			return fmt.Errorf("trust policy %q is defined twice", policy.Name)
+		}
+		names[policy.Name] = true
+
+		if len(policy.RegistryScopes) == 0 {
+			return fmt.Errorf("trust policy %q has no registry scopes", policy.Name)
+		}
+		for _, scope := range policy.RegistryScopes {
+			if scope == "*" && len(policy.RegistryScopes) > 1 {
+				return fmt.Errorf("trust policy %q: the * scope cannot be combined with other scopes", policy.Name)
+			}
+			if scope != "*" && (strings.ContainsAny(scope, "*?[") || !strings.Contains(scope, "/")) {
+				return fmt.Errorf("trust policy %q: registry scope %q must be registry/repository or *", policy.Name, scope)
+			}
+			if other, ok := scopes[scope]; ok {
+				return fmt.Errorf("registry scope %q is in trust policies %q and %q", scope, other, policy.Name)
+			}
+			scopes[scope] = policy.Name
+		}
+
+		level := policy.SignatureVerification.Level
+		if _, ok := levelActions[level]; !ok {
+			return fmt.Errorf("trust policy %q: unknown verification level %q, expected strict, permissive, audit or skip", policy.Name, level)
+		}
+		for validation, action := range policy.SignatureVerification.Override {
+			if _, ok := levelActions[LevelStrict][validation]; !ok {
+				return fmt.Errorf("trust policy %q: unknown validation %q in override", policy.Name, validation)
+			}
+			if action != ActionEnforce && action != ActionLog && action != ActionSkip {
+				return fmt.Errorf("trust policy %q: unknown action %q for %s, expected enforce, log or skip", policy.Name, action, validation)
+			}
+			if validation == ValidationIntegrity || level == LevelSkip {
+				return fmt.Errorf("trust policy %q: %s cannot be overridden", policy.Name, validation)
+			}
+		}
+
+		if level == LevelSkip {
+			if len(policy.TrustStores) > 0 || len(policy.TrustedIdentities) > 0 {
+				return fmt.Errorf("trust policy %q: skip policies take no trust stores or trusted identities", policy.Name)
+			}
+			continue
+		}
+		if len(policy.TrustStores) == 0 {
+			return fmt.Errorf("trust policy %q has no trust stores", policy.Name)
+		}
+		for _, store := range policy.TrustStores {
+			storeType, name, ok := strings.Cut(store, ":")
+			if !ok || name == "" || !validStoreType(storeType) || strings.ContainsAny(name, `/\`) || name == ".." {
+				return fmt.Errorf("trust policy %q: trust store %q must be ca:<name> or signingAuthority:<name>", policy.Name, store)
+			}
+		}
+		if len(policy.TrustedIdentities) == 0 {
+			return fmt.Errorf("trust policy %q has no trusted identities", policy.Name)
+		}
+		for _, identity := range policy.TrustedIdentities {
+			if identity == "*" {
+				if len(policy.TrustedIdentities) > 1 {
+					return fmt.Errorf("trust policy %q: the * identity cannot be combined with other identities", policy.Name)
+				}
+				continue
+			}
+			if _, err := parseIdentity(identity); err != nil {
+				return fmt.Errorf("trust policy %q: %v", policy.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// validStoreType reports whether a trust store type is supported
+func validStoreType(storeType string) bool {
+	for _, known := range trustStoreTypes {
+		if storeType == known {
+			return true
+		}
+	}
+	return false
+}
+
+// identityAttributes are the distinguished name attributes a trusted identity may name
+var identityAttributes = map[string]bool{"C": true, "ST": true, "L": true, "O": true, "OU": true, "CN": true}
+
+// parseIdentity parses a trusted identity such as "x509.subject: C=US, O=Acme, CN=release" into
+// its attributes
+func parseIdentity(identity string) (map[string]string, error) {
+	dn, ok := strings.CutPrefix(identity, "x509.subject:")
+	if !ok {
+		return nil, fmt.Errorf("trusted identity %q must be x509.subject: <distinguished name> or *", identity)
+	}
+	attributes := make(map[string]string)
+	for _, part := range strings.Split(dn, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		name = strings.ToUpper(strings.TrimSpace(name))
+		if !ok || !identityAttributes[name] || value == "" {
+			return nil, fmt.Errorf("trusted identity %q: invalid attribute %q, expected C, ST, L, O, OU or CN", identity, strings.TrimSpace(part))
+		}
+		if _, ok := attributes[name]; ok {
+			return nil, fmt.Errorf("trusted identity %q names %s twice", identity, name)
+		}
+		attributes[name] = strings.TrimSpace(value)
+	}
+	for _, required := range []string{"C", "ST", "O"} {
+		if _, ok := attributes[required]; !ok {
+			return nil, fmt.Errorf("trusted identity %q must name at least C, ST and O", identity)
+		}
+	}
+	return attributes, nil
+}
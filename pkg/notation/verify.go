@@ -0,0 +1,384 @@
+package notation
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// Media types of Notation signatures
+const (
+	ArtifactTypeSignature = "application/vnd.cncf.notary.signature"
+	MediaTypeJWSEnvelope  = "application/jose+json"
+	MediaTypeCOSEEnvelope = "application/cose"
+	MediaTypePayload      = "application/vnd.cncf.notary.payload.v1+json"
+)
+
+// Signing schemes of Notation signatures
+const (
+	schemeX509                 = "notary.x509"
+	schemeX509SigningAuthority = "notary.x509.signingAuthority"
+)
+
+var (
+	// ErrNoPolicy reports a repository no trust policy applies to
+	ErrNoPolicy = errors.New("no trust policy applies")
+	// ErrUnsupportedEnvelope reports a signature envelope that cannot be verified, such as COSE
+	ErrUnsupportedEnvelope = errors.New("unsupported signature envelope")
+)
+
+// Target describes the manifest a signature must be for
+type Target struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+}
+
+// Verifier checks signatures against the trust policies of a trust policy document
+type Verifier struct {
+	policies []compiledTrustPolicy
+	now      func() time.Time
+}
+
+// compiledTrustPolicy is a trust policy with its trust stores and identities resolved
+type compiledTrustPolicy struct {
+	TrustPolicy
+	roots      *x509.CertPool
+	identities []map[string]string // nil for any identity
+}
+
+// NewVerifier validates doc and creates a verifier using the certificates of each trust store,
+// by <type>:<name>
+func NewVerifier(doc TrustPolicyDocument, stores map[string][]*x509.Certificate) (*Verifier, error) {
+	if err := doc.validate(); err != nil {
+		return nil, err
+	}
+	verifier := &Verifier{now: time.Now}
+	for _, policy := range doc.TrustPolicies {
+		compiled := compiledTrustPolicy{TrustPolicy: policy, roots: x509.NewCertPool()}
+		for _, store := range policy.TrustStores {
+			certificates, ok := stores[store]
+			if !ok {
+				return nil, fmt.Errorf("trust policy %q: trust store %s not found", policy.Name, store)
+			}
+			for _, certificate := range certificates {
+				compiled.roots.AddCert(certificate)
+			}
+		}
+		for _, identity := range policy.TrustedIdentities {
+			if identity == "*" {
+				compiled.identities = nil
+				break
+			}
+			attributes, _ := parseIdentity(identity)
+			compiled.identities = append(compiled.identities, attributes)
+		}
+		verifier.policies = append(verifier.policies, compiled)
+	}
+	return verifier, nil
+}
+
+// PolicyFor returns the trust policy of a repository, given as registry/repository: the policy
+// naming it, or else the policy with the * scope
+func (v *Verifier) PolicyFor(repository string) (*TrustPolicy, error) {
+	var global *TrustPolicy
+	for i := range v.policies {
+		for _, scope := range v.policies[i].RegistryScopes {
+			switch scope {
+			case repository:
+				return &v.policies[i].TrustPolicy, nil
+			case "*":
+				global = &v.policies[i].TrustPolicy
+			}
+		}
+	}
+	if global == nil {
+		return nil, fmt.Errorf("%w to %s", ErrNoPolicy, repository)
+	}
+	return global, nil
+}
+
+// Result is the outcome of verifying a signature
+type Result struct {
+	Signer string // subject of the signing certificate, once known
+	// Logged are the failures of validations whose action is log, to be reported but not enforced
+	Logged []error
+}
+
+// Verify checks a signature envelope for target under policy. It returns an error when a
+// validation whose action is enforce fails; failures of validations to log are in the result.
+func (v *Verifier) Verify(policy *TrustPolicy, envelopeType string, envelope []byte, target Target) (*Result, error) {
+	result := &Result{}
+	if policy.SignatureVerification.Level == LevelSkip {
+		return result, nil
+	}
+	compiled := v.compiled(policy)
+	if envelopeType != MediaTypeJWSEnvelope {
+		return nil, fmt.Errorf("%w %s, only JWS signatures can be verified", ErrUnsupportedEnvelope, envelopeType)
+	}
+
+	// Integrity: the envelope is well formed, signed by its certificate and for the target
+	signature, err := parseJWS(envelope)
+	if err != nil {
+		return nil, fmt.Errorf("integrity: %v", err)
+	}
+	leaf := signature.chain[0]
+	result.Signer = leaf.Subject.String()
+	if err := signature.verify(leaf); err != nil {
+		return nil, fmt.Errorf("integrity: %v", err)
+	}
+	if signature.payload.TargetArtifact.Digest != target.Digest || signature.payload.TargetArtifact.Size != target.Size {
+		return nil, fmt.Errorf("integrity: signature is for %s, not %s", signature.payload.TargetArtifact.Digest, target.Digest)
+	}
+
+	// The other validations fail the signature or are logged, as the policy says
+	check := func(validation string, err error) error {
+		if err == nil {
+			return nil
+		}
+		switch policy.Action(validation) {
+		case ActionEnforce:
+			return fmt.Errorf("%s: %v", validation, err)
+		case ActionLog:
+			result.Logged = append(result.Logged, fmt.Errorf("%s: %v", validation, err))
+		}
+		return nil
+	}
+
+	// Authenticity: the certificate chains to the trust store at signing time, with a trusted
+	// subject
+	if err := check(ValidationAuthenticity, compiled.authenticate(signature)); err != nil {
+		return nil, err
+	}
+
+	// Authentic timestamp: without a timestamp countersignature, the chain must still be valid
+	now := v.now()
+	var timestampErr error
+	for _, certificate := range signature.chain {
+		if now.Before(certificate.NotBefore) || now.After(certificate.NotAfter) {
+			timestampErr = fmt.Errorf("certificate %q is not valid at %s", certificate.Subject.CommonName, now.UTC().Format(time.RFC3339))
+			break
+		}
+	}
+	if err := check(ValidationAuthenticTimestamp, timestampErr); err != nil {
+		return nil, err
+	}
+
+	// Expiry
+	var expiryErr error
+	if !signature.expiry.IsZero() && now.After(signature.expiry) {
+		expiryErr = fmt.Errorf("signature expired at %s", signature.expiry.UTC().Format(time.RFC3339))
+	}
+	if err := check(ValidationExpiry, expiryErr); err != nil {
+		return nil, err
+	}
+
+	// Revocation is not checked: OCSP and CRL endpoints are usually out of reach of the proxy
+	return result, nil
+}
+
+// compiled returns the compiled form of a policy returned by PolicyFor
+func (v *Verifier) compiled(policy *TrustPolicy) *compiledTrustPolicy {
+	for i := range v.policies {
+		if &v.policies[i].TrustPolicy == policy {
+			return &v.policies[i]
+		}
+	}
+	return &compiledTrustPolicy{TrustPolicy: *policy, roots: x509.NewCertPool()}
+}
+
+// authenticate checks that the signing certificate chains to the policy's trust stores at
+// signing time and that its subject is trusted
+func (p *compiledTrustPolicy) authenticate(signature *jwsSignature) error {
+	intermediates := x509.NewCertPool()
+	for _, certificate := range signature.chain[1:] {
+		intermediates.AddCert(certificate)
+	}
+	_, err := signature.chain[0].Verify(x509.VerifyOptions{
+		Roots:         p.roots,
+		Intermediates: intermediates,
+		CurrentTime:   signature.signingTime,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	})
+	if err != nil {
+		return fmt.Errorf("signing certificate is not trusted: %v", err)
+	}
+	if p.identities == nil {
+		return nil
+	}
+	for _, identity := range p.identities {
+		if subjectMatches(signature.chain[0].Subject, identity) {
+			return nil
+		}
+	}
+	return fmt.Errorf("signer %q is not a trusted identity", signature.chain[0].Subject.String())
+}
+
+// subjectMatches reports whether a certificate subject has every attribute of an identity
+func subjectMatches(subject pkix.Name, identity map[string]string) bool {
+	values := map[string][]string{
+		"C": subject.Country, "ST": subject.Province, "L": subject.Locality,
+		"O": subject.Organization, "OU": subject.OrganizationalUnit, "CN": {subject.CommonName},
+	}
+	for name, want := range identity {
+		found := false
+		for _, value := range values[name] {
+			if value == want {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// jwsSignature is a parsed Notation JWS envelope
+type jwsSignature struct {
+	algorithm    string
+	signingInput string // protected header and payload, as signed
+	signature    []byte
+	chain        []*x509.Certificate // signing certificate first
+	signingTime  time.Time
+	expiry       time.Time // zero when the signature does not expire
+	payload      struct {
+		TargetArtifact Target `json:"targetArtifact"`
+	}
+}
+
+// parseJWS parses a Notation envelope in JWS JSON serialization
+func parseJWS(envelope []byte) (*jwsSignature, error) {
+	var raw struct {
+		Payload   string `json:"payload"`
+		Protected string `json:"protected"`
+		Header    struct {
+			X5C []string `json:"x5c"`
+		} `json:"header"`
+		Signature string `json:"signature"`
+	}
+	if err := json.Unmarshal(envelope, &raw); err != nil {
+		return nil, fmt.Errorf("invalid JWS envelope: %v", err)
+	}
+
+	protectedJSON, err := base64.RawURLEncoding.DecodeString(raw.Protected)
+	if err != nil {
+		return nil, errors.New("invalid JWS protected header encoding")
+	}
+	var protected struct {
+		Algorithm     string   `json:"alg"`
+		ContentType   string   `json:"cty"`
+		Critical      []string `json:"crit"`
+		SigningScheme string   `json:"io.cncf.notary.signingScheme"`
+		SigningTime   string   `json:"io.cncf.notary.signingTime"`
+		// Signing authorities attest the signing time themselves
+		AuthenticSigningTime string `json:"io.cncf.notary.authenticSigningTime"`
+		Expiry               string `json:"io.cncf.notary.expiry"`
+	}
+	if err := json.Unmarshal(protectedJSON, &protected); err != nil {
+		return nil, fmt.Errorf("invalid JWS protected header: %v", err)
+	}
+	if protected.ContentType != MediaTypePayload {
+		return nil, fmt.Errorf("unexpected payload content type %q", protected.ContentType)
+	}
+	if protected.SigningScheme != schemeX509 && protected.SigningScheme != schemeX509SigningAuthority {
+		return nil, fmt.Errorf("unsupported signing scheme %q", protected.SigningScheme)
+	}
+	for _, critical := range protected.Critical {
+		switch critical {
+		case "io.cncf.notary.signingScheme", "io.cncf.notary.expiry", "io.cncf.notary.authenticSigningTime":
+		default:
+			return nil, fmt.Errorf("unsupported critical header %q", critical)
+		}
+	}
+
+	signature := &jwsSignature{algorithm: protected.Algorithm, signingInput: raw.Protected + "." + raw.Payload}
+	signingTime := protected.SigningTime
+	if protected.SigningScheme == schemeX509SigningAuthority {
+		signingTime = protected.AuthenticSigningTime
+	}
+	if signature.signingTime, err = time.Parse(time.RFC3339, signingTime); err != nil {
+		return nil, fmt.Errorf("invalid signing time %q", signingTime)
+	}
+	if protected.Expiry != "" {
+		if signature.expiry, err = time.Parse(time.RFC3339, protected.Expiry); err != nil {
+			return nil, fmt.Errorf("invalid expiry %q", protected.Expiry)
+		}
+	}
+	if signature.signature, err = base64.RawURLEncoding.DecodeString(raw.Signature); err != nil {
+		return nil, errors.New("invalid JWS signature encoding")
+	}
+
+	if len(raw.Header.X5C) == 0 {
+		return nil, errors.New("envelope has no certificate chain")
+	}
+	for _, encoded := range raw.Header.X5C {
+		der, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, errors.New("invalid certificate encoding in the certificate chain")
+		}
+		certificate, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, fmt.Errorf("invalid certificate in the certificate chain: %v", err)
+		}
+		signature.chain = append(signature.chain, certificate)
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(raw.Payload)
+	if err != nil {
+		return nil, errors.New("invalid JWS payload encoding")
+	}
+	if err := json.Unmarshal(payload, &signature.payload); err != nil {
+		return nil, fmt.Errorf("invalid signature payload: %v", err)
+	}
+	return signature, nil
+}
+
+// jwsHashes are the hashes of the JWS algorithms Notation signs with
+var jwsHashes = map[string]crypto.Hash{
+	"PS256": crypto.SHA256, "PS384": crypto.SHA384, "PS512": crypto.SHA512,
+	"ES256": crypto.SHA256, "ES384": crypto.SHA384, "ES512": crypto.SHA512,
+}
+
+// verify checks the signature with the public key of the signing certificate
+func (s *jwsSignature) verify(leaf *x509.Certificate) error {
+	hash, ok := jwsHashes[s.algorithm]
+	if !ok {
+		return fmt.Errorf("unsupported signature algorithm %q", s.algorithm)
+	}
+	h := hash.New()
+	h.Write([]byte(s.signingInput))
+	digest := h.Sum(nil)
+
+	switch key := leaf.PublicKey.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(s.algorithm, "PS") {
+			return fmt.Errorf("algorithm %s does not match the RSA signing key", s.algorithm)
+		}
+		if err := rsa.VerifyPSS(key, hash, digest, s.signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}); err != nil {
+			return errors.New("signature does not match the envelope")
+		}
+	case *ecdsa.PublicKey:
+		if !strings.HasPrefix(s.algorithm, "ES") || len(s.signature)%2 != 0 {
+			return fmt.Errorf("algorithm %s does not match the ECDSA signing key", s.algorithm)
+		}
+		half := len(s.signature) / 2
+		r, sv := new(big.Int).SetBytes(s.signature[:half]), new(big.Int).SetBytes(s.signature[half:])
+		if !ecdsa.Verify(key, digest, r, sv) {
+			return errors.New("signature does not match the envelope")
+		}
+	default:
+		return fmt.Errorf("unsupported signing key type %T", leaf.PublicKey)
+	}
+	return nil
+}
@@ -0,0 +1,260 @@
+// Package ocilayout serves directories in OCI image-layout format through the registry v2 API,
+// so pre-seeded offline bundles can be pulled through the proxy like any upstream registry.
+package ocilayout
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Annotations naming the images of a layout index. containerd exports carry the full reference
+// in the second one and only the tag in the first.
+const (
+	refNameAnnotation   = "org.opencontainers.image.ref.name"
+	imageNameAnnotation = "io.containerd.image.name"
+)
+
+// Media types of manifests that do not carry one
+const (
+	mediaTypeOCIManifest = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeOCIIndex    = "application/vnd.oci.image.index.v1+json"
+)
+
+var (
+	ErrNotLayout = errors.New("not an OCI image layout")
+
+	// digestPattern keeps requested digests from escaping the blobs directory
+	digestPattern = regexp.MustCompile(`^(sha256:[a-f0-9]{64}|sha512:[a-f0-9]{128})$`)
+)
+
+// descriptor references content of the layout
+type descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// Layout is a read-only view of an OCI image layout directory. The index is read again when
+// index.json changes, so bundles can be updated in place.
+type Layout struct {
+	dir        string
+	repository string // repository of images whose name is only a tag
+
+	mu      sync.Mutex
+	modTime time.Time
+	images  map[string]map[string]descriptor // repository -> tag -> manifest
+}
+
+// Open opens the layout in dir. Images named only by a tag belong to repository, or to a
+// repository named after the directory when it is empty.
+func Open(dir, repository string) (*Layout, error) {
+	data, err := os.ReadFile(filepath.Join(dir, "oci-layout"))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrNotLayout, dir, err)
+	}
+	var marker struct {
+		Version string `json:"imageLayoutVersion"`
+	}
+	if err := json.Unmarshal(data, &marker); err != nil || marker.Version == "" {
+		return nil, fmt.Errorf("%w: %s: invalid oci-layout file", ErrNotLayout, dir)
+	}
+
+	if repository == "" {
+		repository = strings.ToLower(filepath.Base(filepath.Clean(dir)))
+	}
+	layout := &Layout{dir: dir, repository: repository}
+	if _, err := layout.index(); err != nil {
+		return nil, err
+	}
+	return layout, nil
+}
+
+// Dir returns the layout directory
+func (l *Layout) Dir() string {
+	return l.dir
+}
+
+// index returns the images of the layout, reading index.json again when it changed
+func (l *Layout) index() (map[string]map[string]descriptor, error) {
+	path := filepath.Join(l.dir, "index.json")
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrNotLayout, l.dir, err)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.images != nil && info.ModTime().Equal(l.modTime) {
+		return l.images, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	var index struct {
+		Manifests []descriptor `json:"manifests"`
+	}
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %v", path, err)
+	}
+
+	images := make(map[string]map[string]descriptor)
+	for _, desc := range index.Manifests {
+		name := desc.Annotations[imageNameAnnotation]
+		if name == "" {
+			name = desc.Annotations[refNameAnnotation]
+		}
+		if name == "" {
+			continue // only reachable by digest
+		}
+		repository, tag := l.parseName(name)
+		if images[repository] == nil {
+			images[repository] = make(map[string]descriptor)
+		}
+		images[repository][tag] = desc
+	}
+	l.images, l.modTime = images, info.ModTime()
+	return images, nil
+}
+
+// parseName splits an image name such as "3.20", "library/alpine:3.20" or
+// "docker.io/library/alpine:3.20" into repository and tag, dropping any registry host
+func (l *Layout) parseName(name string) (string, string) {
+	name, _, _ = strings.Cut(name, "@")
+	repository, tag := name, "latest"
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		repository, tag = name[:i], name[i+1:]
+	}
+	if !strings.Contains(name, "/") && !strings.Contains(name, ":") {
+		return l.repository, name
+	}
+	if host, rest, ok := strings.Cut(repository, "/"); ok && (strings.ContainsAny(host, ".:") || host == "localhost") {
+		repository = rest
+	}
+	if repository == "" {
+		repository = l.repository
+	}
+	return repository, tag
+}
+
+// Repositories returns the repositories of the layout
+func (l *Layout) Repositories() ([]string, error) {
+	images, err := l.index()
+	if err != nil {
+		return nil, err
+	}
+	repositories := make([]string, 0, len(images))
+	for repository := range images {
+		repositories = append(repositories, repository)
+	}
+	sort.Strings(repositories)
+	return repositories, nil
+}
+
+// tags returns the tags of a repository, or false when the layout does not hold it
+func (l *Layout) tags(repository string) ([]string, bool, error) {
+	images, err := l.index()
+	if err != nil {
+		return nil, false, err
+	}
+	refs, ok := images[repository]
+	if !ok {
+		return nil, false, nil
+	}
+	tags := make([]string, 0, len(refs))
+	for tag := range refs {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return tags, true, nil
+}
+
+// manifest returns the manifest of a repository by tag or digest, or false when the layout does
+// not hold it. Manifests by digest are served from any repository of the layout, as the platform
+// manifests of an index are not listed in index.json.
+func (l *Layout) manifest(repository, reference string) ([]byte, string, string, bool, error) {
+	images, err := l.index()
+	if err != nil {
+		return nil, "", "", false, err
+	}
+	if _, ok := images[repository]; !ok {
+		return nil, "", "", false, nil
+	}
+
+	digest, mediaType := reference, ""
+	if !digestPattern.MatchString(reference) {
+		desc, ok := images[repository][reference]
+		if !ok {
+			return nil, "", "", false, nil
+		}
+		digest, mediaType = desc.Digest, desc.MediaType
+	}
+	if !digestPattern.MatchString(digest) {
+		return nil, "", "", false, fmt.Errorf("invalid digest %q in %s", digest, l.dir)
+	}
+
+	content, err := os.ReadFile(l.blobPath(digest))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, "", "", false, nil
+	}
+	if err != nil {
+		return nil, "", "", false, err
+	}
+	if mediaType == "" {
+		mediaType = manifestMediaType(content)
+	}
+	return content, mediaType, digest, true, nil
+}
+
+// manifestMediaType reads the media type of a manifest, inferring it when the manifest does not
+// carry one
+func manifestMediaType(content []byte) string {
+	var manifest struct {
+		MediaType string            `json:"mediaType"`
+		Manifests []json.RawMessage `json:"manifests"`
+	}
+	json.Unmarshal(content, &manifest)
+	switch {
+	case manifest.MediaType != "":
+		return manifest.MediaType
+	case manifest.Manifests != nil:
+		return mediaTypeOCIIndex
+	}
+	return mediaTypeOCIManifest
+}
+
+// blob opens a blob, or returns false when the layout does not hold it
+func (l *Layout) blob(digest string) (*os.File, int64, bool, error) {
+	if !digestPattern.MatchString(digest) {
+		return nil, 0, false, nil
+	}
+	f, err := os.Open(l.blobPath(digest))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, 0, false, nil
+	}
+	if err != nil {
+		return nil, 0, false, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, false, err
+	}
+	return f, info.Size(), true, nil
+}
+
+// blobPath returns the path of a validated digest
+func (l *Layout) blobPath(digest string) string {
+	algorithm, hex, _ := strings.Cut(digest, ":")
+	return filepath.Join(l.dir, "blobs", algorithm, hex)
+}
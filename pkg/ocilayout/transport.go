@@ -0,0 +1,268 @@
+package ocilayout
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"vault-docker-proxy/pkg/logging"
+)
+
+// Transport serves registry requests from OCI layouts. Requests for the host of a layout are
+// answered from it without any network access; requests for a host a layout is the fallback of
+// go upstream first and are answered from the layout when the registry cannot be reached or
+// fails with a 5xx, provided the layout holds the content.
+type Transport struct {
+	base      http.RoundTripper
+	hosts     map[string][]*Layout
+	fallbacks map[string][]*Layout
+}
+
+// NewTransport creates a transport passing requests not served from layouts to base
+func NewTransport(base http.RoundTripper) *Transport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &Transport{
+		base:      base,
+		hosts:     make(map[string][]*Layout),
+		fallbacks: make(map[string][]*Layout),
+	}
+}
+
+// Add serves layout as registry host, and as the fallback of the fallbackFor hosts. Layouts
+// added for the same host are searched in order.
+func (t *Transport) Add(host string, layout *Layout, fallbackFor []string) {
+	if host != "" {
+		host = strings.ToLower(host)
+		t.hosts[host] = append(t.hosts[host], layout)
+	}
+	for _, fallback := range fallbackFor {
+		fallback = strings.ToLower(fallback)
+		t.fallbacks[fallback] = append(t.fallbacks[fallback], layout)
+	}
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := strings.ToLower(req.URL.Host)
+	if layouts, ok := t.hosts[host]; ok {
+		if resp := serve(req, layouts); resp != nil {
+			return resp, nil
+		}
+		return notFound(req), nil
+	}
+
+	layouts, ok := t.fallbacks[host]
+	if !ok {
+		return t.base.RoundTrip(req)
+	}
+	resp, err := t.base.RoundTrip(req)
+	if req.Context().Err() != nil || (err == nil && resp.StatusCode < 500) {
+		return resp, err
+	}
+	fallback := serve(req, layouts)
+	if fallback == nil {
+		return resp, err
+	}
+	if err == nil {
+		resp.Body.Close()
+		logging.FromContext(req.Context()).Warn("Upstream registry failed, serving from OCI layout", "host", host, "status", resp.StatusCode, "path", req.URL.Path)
+	} else {
+		logging.FromContext(req.Context()).Warn("Upstream registry unreachable, serving from OCI layout", "host", host, "path", req.URL.Path, "error", err)
+	}
+	return fallback, nil
+}
+
+// serve answers a registry request from the first layout holding the content, or returns nil
+func serve(req *http.Request, layouts []*Layout) *http.Response {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return nil
+	}
+	path := strings.TrimPrefix(req.URL.Path, "/v2")
+
+	switch {
+	case path == "/":
+		return response(req, http.StatusOK, nil, nil, 0)
+	case path == "/_catalog":
+		repositories := []string{}
+		for _, layout := range layouts {
+			names, err := layout.Repositories()
+			if err != nil {
+				slog.Error("Failed to read OCI layout", "layout", layout.Dir(), "error", err)
+				continue
+			}
+			repositories = append(repositories, names...)
+		}
+		return jsonResponse(req, map[string]interface{}{"repositories": repositories})
+	case strings.HasSuffix(path, "/tags/list"):
+		repository := strings.Trim(strings.TrimSuffix(path, "/tags/list"), "/")
+		for _, layout := range layouts {
+			tags, ok, err := layout.tags(repository)
+			if err != nil {
+				slog.Error("Failed to read OCI layout", "layout", layout.Dir(), "error", err)
+			}
+			if ok {
+				return jsonResponse(req, map[string]interface{}{"name": repository, "tags": tags})
+			}
+		}
+	case strings.Contains(path, "/manifests/"):
+		i := strings.LastIndex(path, "/manifests/")
+		repository, reference := strings.Trim(path[:i], "/"), path[i+len("/manifests/"):]
+		for _, layout := range layouts {
+			content, mediaType, digest, ok, err := layout.manifest(repository, reference)
+			if err != nil {
+				slog.Error("Failed to read OCI layout", "layout", layout.Dir(), "error", err)
+			}
+			if ok {
+				header := http.Header{"Content-Type": {mediaType}, "Docker-Content-Digest": {digest}}
+				return response(req, http.StatusOK, header, bytes.NewReader(content), int64(len(content)))
+			}
+		}
+	case strings.Contains(path, "/blobs/"):
+		digest := path[strings.LastIndex(path, "/blobs/")+len("/blobs/"):]
+		for _, layout := range layouts {
+			f, size, ok, err := layout.blob(digest)
+			if err != nil {
+				slog.Error("Failed to read OCI layout", "layout", layout.Dir(), "error", err)
+			}
+			if ok {
+				return blobResponse(req, digest, f, size)
+			}
+		}
+	}
+	return nil
+}
+
+// blobResponse answers a blob request, with the requested part of the blob for Range requests
+// resuming a download. If-Range must name the blob's ETag, the digest; requests with several
+// ranges or one that cannot be parsed get the whole blob, as HTTP allows.
+func blobResponse(req *http.Request, digest string, f *os.File, size int64) *http.Response {
+	etag := `"` + digest + `"`
+	header := http.Header{
+		"Content-Type":          {"application/octet-stream"},
+		"Docker-Content-Digest": {digest},
+		"Etag":                  {etag},
+		"Accept-Ranges":         {"bytes"},
+	}
+	rangeHeader := req.Header.Get("Range")
+	if ifRange := req.Header.Get("If-Range"); rangeHeader == "" || (ifRange != "" && ifRange != etag) {
+		return response(req, http.StatusOK, header, f, size)
+	}
+	start, end, ok := parseRange(rangeHeader, size)
+	if !ok {
+		return response(req, http.StatusOK, header, f, size)
+	}
+	if start >= size {
+		f.Close()
+		header.Set("Content-Range", "bytes */"+strconv.FormatInt(size, 10))
+		return response(req, http.StatusRequestedRangeNotSatisfiable, header, nil, 0)
+	}
+	if _, err := f.Seek(start, io.SeekStart); err != nil {
+		return response(req, http.StatusOK, header, f, size)
+	}
+	header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, size))
+	body := struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(f, end-start+1), f}
+	return response(req, http.StatusPartialContent, header, body, end-start+1)
+}
+
+// parseRange parses a Range header naming a single byte range of content of the given size into
+// its first and last byte. A start past the end is returned as is, for a 416 response.
+func parseRange(value string, size int64) (int64, int64, bool) {
+	spec, ok := strings.CutPrefix(value, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return 0, 0, false
+	}
+	first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return 0, 0, false
+	}
+	if first == "" {
+		// The last bytes of the content
+		suffix, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || suffix <= 0 {
+			return 0, 0, false
+		}
+		return max(size-suffix, 0), size - 1, true
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, false
+	}
+	end := size - 1
+	if last != "" {
+		if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+			return 0, 0, false
+		}
+		end = min(end, size-1)
+	}
+	return start, end, true
+}
+
+// notFound answers a request for content no layout of the host holds, or one that would write
+func notFound(req *http.Request) *http.Response {
+	code := "NAME_UNKNOWN"
+	status, message := http.StatusNotFound, "not found in OCI layout"
+	switch path := req.URL.Path; {
+	case req.Method != http.MethodGet && req.Method != http.MethodHead:
+		code, status, message = "UNSUPPORTED", http.StatusMethodNotAllowed, "OCI layouts are read-only"
+	case strings.Contains(path, "/manifests/"):
+		code = "MANIFEST_UNKNOWN"
+	case strings.Contains(path, "/blobs/"):
+		code = "BLOB_UNKNOWN"
+	}
+	body, _ := json.Marshal(map[string]interface{}{
+		"errors": []map[string]string{{"code": code, "message": message}},
+	})
+	header := http.Header{"Content-Type": {"application/json"}}
+	return response(req, status, header, bytes.NewReader(body), int64(len(body)))
+}
+
+// jsonResponse answers a request with a JSON document
+func jsonResponse(req *http.Request, v interface{}) *http.Response {
+	body, _ := json.Marshal(v)
+	header := http.Header{"Content-Type": {"application/json"}}
+	return response(req, http.StatusOK, header, bytes.NewReader(body), int64(len(body)))
+}
+
+// response builds a response as received from a registry; HEAD responses keep the length of the
+// content but no body
+func response(req *http.Request, status int, header http.Header, body io.Reader, size int64) *http.Response {
+	if header == nil {
+		header = make(http.Header)
+	}
+	header.Set("Docker-Distribution-API-Version", "registry/2.0")
+	header.Set("Content-Length", strconv.FormatInt(size, 10))
+
+	var readCloser io.ReadCloser = http.NoBody
+	if closer, ok := body.(io.ReadCloser); ok {
+		readCloser = closer
+	} else if body != nil {
+		readCloser = io.NopCloser(body)
+	}
+	if req.Method == http.MethodHead {
+		readCloser.Close()
+		readCloser = http.NoBody
+	}
+
+	return &http.Response{
+		Status:        strconv.Itoa(status) + " " + http.StatusText(status),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          readCloser,
+		ContentLength: size,
+		Request:       req,
+	}
+}
@@ -0,0 +1,158 @@
+package ocilayout
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// newTestLayout creates a layout holding a single blob and returns a transport serving it as
+// registry.test, along with the blob digest
+func newTestLayout(t *testing.T, blob []byte) (*Transport, string) {
+	t.Helper()
+	dir := t.TempDir()
+	sum := sha256.Sum256(blob)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+
+	files := map[string][]byte{
+		"oci-layout": []byte(`{"imageLayoutVersion":"1.0.0"}`),
+		"index.json": []byte(`{"schemaVersion":2,"manifests":[]}`),
+		filepath.Join("blobs", "sha256", digest[7:]): blob,
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, content, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	layout, err := Open(dir, "app")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	transport := NewTransport(nil)
+	transport.Add("registry.test", layout, nil)
+	return transport, digest
+}
+
+func TestTransportBlobRange(t *testing.T) {
+	blob := []byte("0123456789")
+	transport, digest := newTestLayout(t, blob)
+	etag := `"` + digest + `"`
+
+	tests := []struct {
+		name         string
+		header       map[string]string
+		status       int
+		body         string
+		contentRange string
+	}{
+		{name: "whole blob", status: http.StatusOK, body: "0123456789"},
+		{name: "open range", header: map[string]string{"Range": "bytes=4-"}, status: http.StatusPartialContent, body: "456789", contentRange: "bytes 4-9/10"},
+		{name: "closed range", header: map[string]string{"Range": "bytes=2-4"}, status: http.StatusPartialContent, body: "234", contentRange: "bytes 2-4/10"},
+		{name: "range past the end", header: map[string]string{"Range": "bytes=8-20"}, status: http.StatusPartialContent, body: "89", contentRange: "bytes 8-9/10"},
+		{name: "suffix range", header: map[string]string{"Range": "bytes=-3"}, status: http.StatusPartialContent, body: "789", contentRange: "bytes 7-9/10"},
+		{name: "matching If-Range", header: map[string]string{"Range": "bytes=4-", "If-Range": etag}, status: http.StatusPartialContent, body: "456789", contentRange: "bytes 4-9/10"},
+		{name: "stale If-Range", header: map[string]string{"Range": "bytes=4-", "If-Range": `"sha256:stale"`}, status: http.StatusOK, body: "0123456789"},
+		{name: "several ranges", header: map[string]string{"Range": "bytes=0-1,4-5"}, status: http.StatusOK, body: "0123456789"},
+		{name: "invalid range", header: map[string]string{"Range": "bytes=5-2"}, status: http.StatusOK, body: "0123456789"},
+		{name: "unsatisfiable range", header: map[string]string{"Range": "bytes=10-"}, status: http.StatusRequestedRangeNotSatisfiable, contentRange: "bytes */10"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, "https://registry.test/v2/app/blobs/"+digest, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, value := range tt.header {
+				req.Header.Set(name, value)
+			}
+
+			resp, err := transport.RoundTrip(req)
+			if err != nil {
+				t.Fatalf("RoundTrip: %v", err)
+			}
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatalf("reading body: %v", err)
+			}
+
+			if resp.StatusCode != tt.status {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			if string(body) != tt.body {
+				t.Errorf("body = %q, want %q", body, tt.body)
+			}
+			if got := resp.Header.Get("Content-Range"); got != tt.contentRange {
+				t.Errorf("Content-Range = %q, want %q", got, tt.contentRange)
+			}
+			if got := resp.Header.Get("Content-Length"); got != strconv.Itoa(len(tt.body)) {
+				t.Errorf("Content-Length = %q, want %d", got, len(tt.body))
+			}
+			if got := resp.Header.Get("Etag"); tt.status != http.StatusRequestedRangeNotSatisfiable && got != etag {
+				t.Errorf("Etag = %q, want %q", got, etag)
+			}
+		})
+	}
+}
+
+func TestTransportBlobRangeHead(t *testing.T) {
+	transport, digest := newTestLayout(t, []byte("0123456789"))
+
+	req, err := http.NewRequest(http.MethodHead, "https://registry.test/v2/app/blobs/"+digest, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Range", "bytes=6-")
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusPartialContent)
+	}
+	if got := resp.Header.Get("Content-Length"); got != "4" {
+		t.Errorf("Content-Length = %q, want 4", got)
+	}
+	if body, _ := io.ReadAll(resp.Body); len(body) != 0 {
+		t.Errorf("HEAD response has a body of %d bytes", len(body))
+	}
+}
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		value      string
+		start, end int64
+		ok         bool
+	}{
+		{value: "bytes=0-", start: 0, end: 99, ok: true},
+		{value: "bytes=10-19", start: 10, end: 19, ok: true},
+		{value: "bytes=90-200", start: 90, end: 99, ok: true},
+		{value: "bytes=-10", start: 90, end: 99, ok: true},
+		{value: "bytes=-200", start: 0, end: 99, ok: true},
+		{value: "bytes=150-", start: 150, end: 99, ok: true},
+		{value: "bytes=0-1,5-6"},
+		{value: "bytes=19-10"},
+		{value: "bytes=-0"},
+		{value: "bytes=a-b"},
+		{value: "bytes=5"},
+		{value: "items=0-1"},
+	}
+	for _, tt := range tests {
+		start, end, ok := parseRange(tt.value, 100)
+		if ok != tt.ok || (ok && (start != tt.start || end != tt.end)) {
+			t.Errorf("parseRange(%q) = %d, %d, %v, want %d, %d, %v", tt.value, start, end, ok, tt.start, tt.end, tt.ok)
+		}
+	}
+}
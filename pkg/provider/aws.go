@@ -0,0 +1,151 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"vault-docker-proxy/pkg/awsauth"
+)
+
+// roleSessionDuration is requested for assumed roles, the default maximum session duration of a
+// role, so the exchange works whatever the role allows
+const roleSessionDuration = time.Hour
+
+var ErrExchangeFailed = errors.New("registry credential exchange failed")
+
+// awsClient calls the AWS APIs; http.DefaultTransport honours the HTTPS_PROXY variables
+var awsClient = &http.Client{Timeout: 30 * time.Second}
+
+// awsEndpoint locates the regional endpoints of the partition of a registry
+type awsEndpoint struct {
+	region string
+	domain string // amazonaws.com, or amazonaws.com.cn in the China regions
+}
+
+// url returns the endpoint of an AWS service in the region
+func (e awsEndpoint) url(service string) string {
+	return "https://" + service + "." + e.region + "." + e.domain + "/"
+}
+
+// ecrEndpoint reads the region and partition from an ECR registry host of the form
+// <account>.dkr.ecr.<region>.amazonaws.com, unless region overrides it
+func ecrEndpoint(registryURL, region string) (awsEndpoint, error) {
+	host := strings.TrimPrefix(strings.TrimPrefix(registryURL, "https://"), "http://")
+	host, _, _ = strings.Cut(host, "/")
+	labels := strings.Split(strings.ToLower(host), ".")
+
+	endpoint := awsEndpoint{region: region, domain: "amazonaws.com"}
+	for i := 0; i+2 < len(labels); i++ {
+		if labels[i] == "dkr" && strings.HasPrefix(labels[i+1], "ecr") {
+			if endpoint.region == "" {
+				endpoint.region = labels[i+2]
+			}
+			if i+3 < len(labels) {
+				endpoint.domain = strings.Join(labels[i+3:], ".")
+			}
+			break
+		}
+	}
+	if endpoint.region == "" {
+		return awsEndpoint{}, fmt.Errorf("%w: %s is not an ECR registry host, set the region field", ErrInvalidSecret, host)
+	}
+	return endpoint, nil
+}
+
+// awsCredentialsFromSecret reads the aws_access_key_id, aws_secret_access_key and optional
+// aws_session_token fields of a secret, returning false when the secret holds no access keys
+func awsCredentialsFromSecret(secret map[string]interface{}) (*awsauth.Credentials, bool, error) {
+	accessKeyID, hasID := stringField(secret, "aws_access_key_id")
+	secretAccessKey, hasSecret := stringField(secret, "aws_secret_access_key")
+	switch {
+	case !hasID && !hasSecret:
+		return nil, false, nil
+	case !hasID || !hasSecret:
+		return nil, false, fmt.Errorf("%w: aws_access_key_id and aws_secret_access_key must be set together", ErrInvalidSecret)
+	}
+	sessionToken, _ := stringField(secret, "aws_session_token")
+	return &awsauth.Credentials{
+		AccessKeyID:     accessKeyID,
+		SecretAccessKey: secretAccessKey,
+		SessionToken:    sessionToken,
+	}, true, nil
+}
+
+// assumeRole exchanges credentials for the temporary credentials of a role with sts:AssumeRole
+func assumeRole(ctx context.Context, endpoint awsEndpoint, credentials *awsauth.Credentials, roleARN, externalID, sessionName string) (*awsauth.Credentials, error) {
+	form := url.Values{
+		"Action":          {"AssumeRole"},
+		"Version":         {"2011-06-15"},
+		"RoleArn":         {roleARN},
+		"RoleSessionName": {sessionName},
+		"DurationSeconds": {strconv.Itoa(int(roleSessionDuration.Seconds()))},
+	}
+	if externalID != "" {
+		form.Set("ExternalId", externalID)
+	}
+	header := http.Header{"Content-Type": {"application/x-www-form-urlencoded; charset=utf-8"}}
+	body, err := callAWS(ctx, endpoint, "sts", credentials, header, []byte(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("%w: cannot assume role %s: %v", ErrExchangeFailed, roleARN, err)
+	}
+
+	var response struct {
+		Credentials struct {
+			AccessKeyID     string    `xml:"AccessKeyId"`
+			SecretAccessKey string    `xml:"SecretAccessKey"`
+			SessionToken    string    `xml:"SessionToken"`
+			Expiration      time.Time `xml:"Expiration"`
+		} `xml:"AssumeRoleResult>Credentials"`
+	}
+	if err := xml.Unmarshal(body, &response); err != nil || response.Credentials.AccessKeyID == "" {
+		return nil, fmt.Errorf("%w: invalid AssumeRole response for %s", ErrExchangeFailed, roleARN)
+	}
+	return &awsauth.Credentials{
+		AccessKeyID:     response.Credentials.AccessKeyID,
+		SecretAccessKey: response.Credentials.SecretAccessKey,
+		SessionToken:    response.Credentials.SessionToken,
+		Expiration:      response.Credentials.Expiration,
+	}, nil
+}
+
+// getAuthorizationToken calls ecr:GetAuthorizationToken, returning the token (base64 of
+// "AWS:<password>") and its expiry
+func getAuthorizationToken(ctx context.Context, endpoint awsEndpoint, credentials *awsauth.Credentials) (string, time.Time, error) {
+	header := http.Header{
+		"Content-Type": {"application/x-amz-json-1.1"},
+		"X-Amz-Target": {"AmazonEC2ContainerRegistry_V20150921.GetAuthorizationToken"},
+	}
+	body, err := callAWS(ctx, endpoint, "api.ecr", credentials, header, []byte("{}"))
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("%w: GetAuthorizationToken: %v", ErrExchangeFailed, err)
+	}
+
+	var response struct {
+		AuthorizationData []struct {
+			AuthorizationToken string  `json:"authorizationToken"`
+			ExpiresAt          float64 `json:"expiresAt"` // seconds since the epoch
+		} `json:"authorizationData"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil || len(response.AuthorizationData) == 0 {
+		return "", time.Time{}, fmt.Errorf("%w: invalid GetAuthorizationToken response", ErrExchangeFailed)
+	}
+	data := response.AuthorizationData[0]
+	seconds, fraction := math.Modf(data.ExpiresAt)
+	return data.AuthorizationToken, time.Unix(int64(seconds), int64(fraction*1e9)), nil
+}
+
+// callAWS POSTs body to an AWS API of the endpoint region and returns the response body. host is
+// the service prefix of the endpoint; the signing name is its last label.
+func callAWS(ctx context.Context, endpoint awsEndpoint, host string, credentials *awsauth.Credentials, header http.Header, body []byte) ([]byte, error) {
+	service := host[strings.LastIndex(host, ".")+1:]
+	return awsauth.Call(ctx, awsClient, endpoint.url(host), endpoint.region, service, credentials, header, body)
+}
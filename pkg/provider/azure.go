@@ -0,0 +1,170 @@
+package provider
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+
+	"vault-docker-proxy/pkg/auth"
+)
+
+const (
+	// azureAuthorityHost is the Microsoft Entra ID endpoint of the public cloud, overridden by the
+	// authority_host field for sovereign clouds
+	azureAuthorityHost = "https://login.microsoftonline.com"
+	// azureTokenScope is requested for the Entra ID token exchanged for an ACR refresh token
+	azureTokenScope = "https://management.azure.com/.default"
+	// acrTokenUser is the username ACR expects with a refresh token as password
+	acrTokenUser = "00000000-0000-0000-0000-000000000000"
+	// acrTokenMargin is how long before their expiry ACR refresh tokens stop being reused
+	acrTokenMargin = 5 * time.Minute
+)
+
+// azureClient calls Entra ID and the ACR token exchange; http.DefaultTransport honours the
+// HTTPS_PROXY variables
+var azureClient = &http.Client{Timeout: 30 * time.Second}
+
+// acrTokens caches ACR refresh tokens by registry host and service principal, so secrets and
+// Vault tokens sharing a service principal share its tokens instead of exchanging their own
+var acrTokens = cache.New(cache.NoExpiration, 10*time.Minute)
+
+// acrExchange obtains an ACR refresh token for a service principal: an Entra ID token from the
+// client credentials grant is exchanged at the registry's /oauth2/exchange endpoint. Tokens are
+// reused until shortly before they expire.
+func acrExchange(ctx context.Context, registryURL, tenantID, clientID, clientSecret, authorityHost string) (*auth.Credentials, error) {
+	baseURL := DefaultBaseURL(registryURL)
+	parsed, err := url.Parse(baseURL)
+	if err != nil || parsed.Host == "" {
+		return nil, fmt.Errorf("%w: invalid registry URL %q", ErrInvalidSecret, registryURL)
+	}
+	host := parsed.Host
+
+	sum := sha256.Sum256([]byte(host + "\x00" + tenantID + "\x00" + clientID + "\x00" + clientSecret))
+	key := hex.EncodeToString(sum[:])
+	if cached, found := acrTokens.Get(key); found {
+		return cached.(*auth.Credentials).Clone(), nil
+	}
+
+	accessToken, accessExpiry, err := azureClientCredentials(ctx, authorityHost, tenantID, clientID, clientSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type":   {"access_token"},
+		"service":      {host},
+		"tenant":       {tenantID},
+		"access_token": {accessToken},
+	}
+	var response struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := postForm(ctx, baseURL+"/oauth2/exchange", form, &response); err != nil {
+		return nil, fmt.Errorf("%w: ACR token exchange at %s for %s: %v", ErrExchangeFailed, host, clientID, err)
+	}
+	if response.RefreshToken == "" {
+		return nil, fmt.Errorf("%w: ACR token exchange at %s returned no refresh token", ErrExchangeFailed, host)
+	}
+
+	credentials := auth.NewCredentials(acrTokenUser, []byte(response.RefreshToken), "")
+	credentials.ExpiresAt = jwtExpiry(response.RefreshToken)
+	if credentials.ExpiresAt.IsZero() {
+		credentials.ExpiresAt = accessExpiry
+	}
+	if ttl := time.Until(credentials.ExpiresAt) - acrTokenMargin; ttl > 0 {
+		acrTokens.Set(key, credentials.Clone(), ttl)
+	}
+	return credentials, nil
+}
+
+// azureClientCredentials obtains an Entra ID access token for a service principal with the
+// client credentials grant
+func azureClientCredentials(ctx context.Context, authorityHost, tenantID, clientID, clientSecret string) (string, time.Time, error) {
+	if authorityHost == "" {
+		authorityHost = azureAuthorityHost
+	}
+	if !strings.HasPrefix(authorityHost, "https://") {
+		return "", time.Time{}, fmt.Errorf("%w: authority_host %q is not an https URL", ErrInvalidSecret, authorityHost)
+	}
+	tokenURL := strings.TrimSuffix(authorityHost, "/") + "/" + url.PathEscape(tenantID) + "/oauth2/v2.0/token"
+
+	form := url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {clientID},
+		"client_secret": {clientSecret},
+		"scope":         {azureTokenScope},
+	}
+	var response struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := postForm(ctx, tokenURL, form, &response); err != nil {
+		return "", time.Time{}, fmt.Errorf("%w: Entra ID token request for %s: %v", ErrExchangeFailed, clientID, err)
+	}
+	if response.AccessToken == "" {
+		return "", time.Time{}, fmt.Errorf("%w: Entra ID returned no access token for %s", ErrExchangeFailed, clientID)
+	}
+	return response.AccessToken, time.Now().Add(time.Duration(response.ExpiresIn) * time.Second), nil
+}
+
+// postForm POSTs an OAuth2 form and decodes the JSON response into v, reporting the OAuth2 error
+// of unsuccessful responses
+func postForm(ctx context.Context, endpoint string, form url.Values, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := azureClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var oauthErr struct {
+			Error            string `json:"error"`
+			ErrorDescription string `json:"error_description"`
+		}
+		_ = json.Unmarshal(body, &oauthErr)
+		description, _, _ := strings.Cut(oauthErr.ErrorDescription, "\r\n") // Entra ID appends trace IDs
+		return fmt.Errorf("HTTP %d %s %s", resp.StatusCode, oauthErr.Error, description)
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("invalid response: %v", err)
+	}
+	return nil
+}
+
+// jwtExpiry returns the exp claim of a JWT without verifying it, or the zero time
+func jwtExpiry(token string) time.Time {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if json.Unmarshal(payload, &claims) != nil || claims.Exp == 0 {
+		return time.Time{}
+	}
+	return time.Unix(claims.Exp, 0)
+}
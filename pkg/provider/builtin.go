@@ -0,0 +1,169 @@
+package provider
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"vault-docker-proxy/pkg/auth"
+	"vault-docker-proxy/pkg/awsauth"
+)
+
+func init() {
+	Register(Basic{Type: "docker"})
+	Register(Basic{Type: "harbor"})
+	Register(ecr{Basic{Type: "ecr"}})
+	Register(gcr{Basic{Type: "gcr"}})
+	Register(acr{Basic{Type: "acr"}})
+}
+
+// ecr is AWS Elastic Container Registry. Besides username/password, the secret may hold the
+// authorization_token returned by ecr:GetAuthorizationToken (base64 of "AWS:<password>") and
+// its expires_at, or AWS access keys the proxy exchanges for such a token itself. With a
+// role_arn, the keys are first exchanged for the credentials of that role with sts:AssumeRole,
+// so one set of keys can serve registries in many accounts. The keys may also be the proxy's
+// own, see SetECRDefaultCredentials.
+type ecr struct {
+	Basic
+}
+
+// Credentials implements Provider
+func (e ecr) Credentials(ctx context.Context, registryConfig *auth.RegistryConfig, secret map[string]interface{}) (*auth.Credentials, error) {
+	if token, ok := stringField(secret, "authorization_token"); ok {
+		username, password, err := decodeECRToken(token)
+		if err != nil {
+			return nil, err
+		}
+		return tokenCredentials(username, password, secret)
+	}
+
+	keys, ok, err := awsCredentialsFromSecret(secret)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		_, hasRole := stringField(secret, "role_arn")
+		_, hasUsername := stringField(secret, "username")
+		switch {
+		case ecrDefaultCredentials.Load() && (hasRole || !hasUsername):
+			if keys, err = awsauth.DefaultCredentials(ctx); err != nil {
+				return nil, fmt.Errorf("%w: no AWS credentials of the proxy: %v", ErrExchangeFailed, err)
+			}
+		case hasRole:
+			return nil, fmt.Errorf("%w: role_arn requires aws_access_key_id and aws_secret_access_key, or ecr.default_credentials", ErrInvalidSecret)
+		default:
+			return e.Basic.Credentials(ctx, registryConfig, secret)
+		}
+	}
+	return e.exchange(ctx, registryConfig, secret, keys)
+}
+
+// ecrDefaultCredentials makes ecr secrets without access keys use the proxy's own AWS
+// credentials
+var ecrDefaultCredentials atomic.Bool
+
+// SetECRDefaultCredentials makes ecr secrets holding no access keys, or only a role_arn to
+// assume, use the proxy's own AWS credentials: environment variables, web identity, container
+// or instance credentials. Any client able to read such a secret then gets a token of the
+// proxy's AWS identity or of the role the secret names.
+func SetECRDefaultCredentials(enabled bool) {
+	ecrDefaultCredentials.Store(enabled)
+}
+
+// exchange obtains an authorization token with AWS access keys, assuming the role_arn of the
+// secret first when set. The credentials expire with the token, or with the role session when
+// it ends first.
+func (e ecr) exchange(ctx context.Context, registryConfig *auth.RegistryConfig, secret map[string]interface{}, keys *awsauth.Credentials) (*auth.Credentials, error) {
+	region, _ := stringField(secret, "region")
+	endpoint, err := ecrEndpoint(registryConfig.RegistryURL, region)
+	if err != nil {
+		return nil, err
+	}
+
+	if roleARN, ok := stringField(secret, "role_arn"); ok {
+		if !strings.HasPrefix(roleARN, "arn:") {
+			return nil, fmt.Errorf("%w: role_arn %q is not an ARN", ErrInvalidSecret, roleARN)
+		}
+		externalID, _ := stringField(secret, "external_id")
+		sessionName, ok := stringField(secret, "role_session_name")
+		if !ok {
+			sessionName = "vault-docker-proxy"
+		}
+		if keys, err = assumeRole(ctx, endpoint, keys, roleARN, externalID, sessionName); err != nil {
+			return nil, err
+		}
+	}
+
+	token, expiresAt, err := getAuthorizationToken(ctx, endpoint, keys)
+	if err != nil {
+		return nil, err
+	}
+	username, password, err := decodeECRToken(token)
+	if err != nil {
+		return nil, fmt.Errorf("%w: GetAuthorizationToken returned a malformed token", ErrExchangeFailed)
+	}
+	credentials := auth.NewCredentials(username, []byte(password), "")
+	credentials.ExpiresAt = expiresAt
+	if !keys.Expiration.IsZero() && keys.Expiration.Before(expiresAt) {
+		credentials.ExpiresAt = keys.Expiration
+	}
+	return credentials, nil
+}
+
+// decodeECRToken splits an ECR authorization token into username and password
+func decodeECRToken(token string) (string, string, error) {
+	decoded, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		return "", "", fmt.Errorf("%w: authorization_token is not base64: %v", ErrInvalidSecret, err)
+	}
+	username, password, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return "", "", fmt.Errorf("%w: authorization_token is not of the form <user>:<password>", ErrInvalidSecret)
+	}
+	return username, password, nil
+}
+
+// gcr is Google Container Registry and Artifact Registry. Besides username/password, the secret
+// may hold a service account json_key, exchanged for an OAuth2 access token so the key itself
+// never goes upstream, or an OAuth2 access_token and its expires_at.
+type gcr struct {
+	Basic
+}
+
+// Credentials implements Provider
+func (g gcr) Credentials(ctx context.Context, registryConfig *auth.RegistryConfig, secret map[string]interface{}) (*auth.Credentials, error) {
+	if key, ok := stringField(secret, "json_key"); ok {
+		return exchangeServiceAccountKey(ctx, key)
+	}
+	if token, ok := stringField(secret, "access_token"); ok {
+		return tokenCredentials("oauth2accesstoken", token, secret)
+	}
+	return g.Basic.Credentials(ctx, registryConfig, secret)
+}
+
+// acr is Azure Container Registry. Besides username/password (admin user or token), the secret
+// may hold a service principal's client_id and client_secret, used over Basic auth or, with its
+// tenant_id, exchanged for an ACR refresh token, or an ACR refresh_token and its expires_at.
+type acr struct {
+	Basic
+}
+
+// Credentials implements Provider
+func (a acr) Credentials(ctx context.Context, registryConfig *auth.RegistryConfig, secret map[string]interface{}) (*auth.Credentials, error) {
+	clientID, hasID := stringField(secret, "client_id")
+	clientSecret, hasSecret := stringField(secret, "client_secret")
+	if hasID && hasSecret {
+		if tenantID, ok := stringField(secret, "tenant_id"); ok {
+			authorityHost, _ := stringField(secret, "authority_host")
+			return acrExchange(ctx, registryConfig.RegistryURL, tenantID, clientID, clientSecret, authorityHost)
+		}
+		return auth.NewCredentials(clientID, []byte(clientSecret), ""), nil
+	}
+	if token, ok := stringField(secret, "refresh_token"); ok {
+		// ACR accepts refresh tokens as the password of this fixed user
+		return tokenCredentials(acrTokenUser, token, secret)
+	}
+	return a.Basic.Credentials(ctx, registryConfig, secret)
+}
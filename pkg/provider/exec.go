@@ -0,0 +1,120 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"vault-docker-proxy/pkg/auth"
+)
+
+// ExecType is the registry type served by the exec provider
+const ExecType = "exec"
+
+// maxHelperOutput bounds the output read from an exec helper
+const maxHelperOutput = 64 * 1024
+
+var ErrHelperFailed = errors.New("credential helper failed")
+
+// Exec produces registry credentials by running an external helper, for registries and token
+// brokers without a built-in provider. The helper reads an ExecRequest as JSON on stdin and
+// writes an ExecResponse as JSON on stdout; a non-zero exit status fails the request, with the
+// first line of stderr as the reason.
+type Exec struct {
+	Basic
+	command string
+	args    []string
+	timeout time.Duration
+}
+
+// ExecRequest is written to the helper's stdin
+type ExecRequest struct {
+	RegistryURL string                 `json:"registry_url"`
+	VaultPath   string                 `json:"vault_path"`
+	Secret      map[string]interface{} `json:"secret"` // data of the Vault secret
+}
+
+// ExecResponse is read from the helper's stdout
+type ExecResponse struct {
+	Username  string    `json:"username"`
+	Password  string    `json:"password"`
+	Email     string    `json:"email,omitempty"`
+	ExpiresAt time.Time `json:"expires_at,omitempty"` // RFC 3339, for short-lived tokens
+}
+
+// NewExec creates the exec provider running command with args, killing it after timeout
+func NewExec(command string, args []string, timeout time.Duration) *Exec {
+	return &Exec{
+		Basic:   Basic{Type: ExecType},
+		command: command,
+		args:    args,
+		timeout: timeout,
+	}
+}
+
+// Credentials implements Provider by running the helper
+func (e *Exec) Credentials(ctx context.Context, registryConfig *auth.RegistryConfig, secret map[string]interface{}) (*auth.Credentials, error) {
+	input, err := json.Marshal(ExecRequest{
+		RegistryURL: registryConfig.RegistryURL,
+		VaultPath:   registryConfig.VaultPath,
+		Secret:      secret,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: cannot encode request: %v", ErrHelperFailed, err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, e.timeout)
+	defer cancel()
+
+	var stdout, stderr limitedBuffer
+	cmd := exec.CommandContext(ctx, e.command, e.args...)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	auth.Wipe(input)
+	defer auth.Wipe(stdout.Bytes())
+
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, fmt.Errorf("%w: %s timed out after %s", ErrHelperFailed, e.command, e.timeout)
+	}
+	if err != nil {
+		reason, _, _ := strings.Cut(strings.TrimSpace(stderr.String()), "\n")
+		if reason == "" {
+			reason = err.Error()
+		}
+		return nil, fmt.Errorf("%w: %s: %s", ErrHelperFailed, e.command, reason)
+	}
+
+	var response ExecResponse
+	if err := json.Unmarshal(stdout.Bytes(), &response); err != nil {
+		return nil, fmt.Errorf("%w: %s wrote invalid JSON: %v", ErrHelperFailed, e.command, err)
+	}
+	if response.Username == "" || response.Password == "" {
+		return nil, fmt.Errorf("%w: %s returned no username or password", ErrHelperFailed, e.command)
+	}
+	credentials := auth.NewCredentials(response.Username, []byte(response.Password), response.Email)
+	credentials.ExpiresAt = response.ExpiresAt
+	return credentials, nil
+}
+
+// limitedBuffer is a bytes.Buffer that silently drops writes beyond maxHelperOutput
+type limitedBuffer struct {
+	bytes.Buffer
+}
+
+// Write implements io.Writer
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := maxHelperOutput - b.Len(); room < len(p) {
+		if room > 0 {
+			b.Buffer.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
@@ -0,0 +1,167 @@
+package provider
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"vault-docker-proxy/pkg/auth"
+)
+
+const (
+	// googleTokenURL is the OAuth2 token endpoint of service account keys without a token_uri
+	googleTokenURL = "https://oauth2.googleapis.com/token"
+	// googleTokenScope is requested for the access tokens; the service account's IAM roles
+	// restrict what they can reach
+	googleTokenScope = "https://www.googleapis.com/auth/cloud-platform"
+	// googleAssertionLifetime is the lifetime of the signed assertion, the maximum Google accepts
+	googleAssertionLifetime = time.Hour
+)
+
+// gcpClient calls the Google OAuth2 endpoint; http.DefaultTransport honours the HTTPS_PROXY
+// variables
+var gcpClient = &http.Client{Timeout: 30 * time.Second}
+
+// serviceAccountKey holds the fields of a Google service account JSON key used to sign the
+// token request
+type serviceAccountKey struct {
+	Type         string `json:"type"`
+	ClientEmail  string `json:"client_email"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	TokenURI     string `json:"token_uri"`
+}
+
+// parseServiceAccountKey parses a service account JSON key and its RSA private key
+func parseServiceAccountKey(data string) (*serviceAccountKey, *rsa.PrivateKey, error) {
+	var key serviceAccountKey
+	if err := json.Unmarshal([]byte(data), &key); err != nil {
+		return nil, nil, fmt.Errorf("%w: json_key is not JSON: %v", ErrInvalidSecret, err)
+	}
+	if key.Type != "service_account" || key.ClientEmail == "" {
+		return nil, nil, fmt.Errorf("%w: json_key is not a service account key", ErrInvalidSecret)
+	}
+	if key.TokenURI == "" {
+		key.TokenURI = googleTokenURL
+	}
+	if !strings.HasPrefix(key.TokenURI, "https://") {
+		return nil, nil, fmt.Errorf("%w: json_key token_uri %q is not an https URL", ErrInvalidSecret, key.TokenURI)
+	}
+
+	block, _ := pem.Decode([]byte(key.PrivateKey))
+	if block == nil {
+		return nil, nil, fmt.Errorf("%w: json_key private_key is not PEM", ErrInvalidSecret)
+	}
+	var (
+		parsed interface{}
+		err    error
+	)
+	if block.Type == "RSA PRIVATE KEY" {
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	} else {
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: json_key private_key: %v", ErrInvalidSecret, err)
+	}
+	privateKey, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: json_key private_key is not an RSA key", ErrInvalidSecret)
+	}
+	return &key, privateKey, nil
+}
+
+// exchangeServiceAccountKey exchanges a service account JSON key for an OAuth2 access token with
+// the JWT bearer grant, returning credentials for the oauth2accesstoken user that expire with the
+// token
+func exchangeServiceAccountKey(ctx context.Context, data string) (*auth.Credentials, error) {
+	key, privateKey, err := parseServiceAccountKey(data)
+	if err != nil {
+		return nil, err
+	}
+	assertion, err := signAssertion(key, privateKey, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("%w: cannot sign the token request of %s: %v", ErrExchangeFailed, key.ClientEmail, err)
+	}
+
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, key.TokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrExchangeFailed, err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := gcpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: token request of %s: %v", ErrExchangeFailed, key.ClientEmail, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("%w: token request of %s: %v", ErrExchangeFailed, key.ClientEmail, err)
+	}
+
+	var response struct {
+		AccessToken      string `json:"access_token"`
+		ExpiresIn        int64  `json:"expires_in"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, fmt.Errorf("%w: invalid token response for %s (HTTP %d)", ErrExchangeFailed, key.ClientEmail, resp.StatusCode)
+	}
+	if resp.StatusCode != http.StatusOK || response.AccessToken == "" {
+		return nil, fmt.Errorf("%w: token request of %s: HTTP %d %s %s", ErrExchangeFailed, key.ClientEmail, resp.StatusCode, response.Error, response.ErrorDescription)
+	}
+
+	credentials := auth.NewCredentials("oauth2accesstoken", []byte(response.AccessToken), "")
+	if response.ExpiresIn > 0 {
+		credentials.ExpiresAt = time.Now().Add(time.Duration(response.ExpiresIn) * time.Second)
+	}
+	return credentials, nil
+}
+
+// signAssertion creates the RS256 JWT a service account presents to the token endpoint
+func signAssertion(key *serviceAccountKey, privateKey *rsa.PrivateKey, now time.Time) (string, error) {
+	header := map[string]string{"alg": "RS256", "typ": "JWT"}
+	if key.PrivateKeyID != "" {
+		header["kid"] = key.PrivateKeyID
+	}
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":   key.ClientEmail,
+		"scope": googleTokenScope,
+		"aud":   key.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(googleAssertionLifetime).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	encode := base64.RawURLEncoding.EncodeToString
+	signingInput := encode(headerJSON) + "." + encode(claims)
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, privateKey, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signingInput + "." + encode(signature), nil
+}
@@ -0,0 +1,146 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"vault-docker-proxy/pkg/auth"
+)
+
+var (
+	ErrUnknownProvider = errors.New("unknown registry type")
+	ErrInvalidSecret   = errors.New("invalid registry secret")
+)
+
+// Provider implements a registry type: how the Vault secret of a registry becomes credentials,
+// how the upstream URL is built and how upstream requests are authenticated
+type Provider interface {
+	// Name returns the registry type used in proxy usernames, e.g. "docker"
+	Name() string
+	// Credentials converts the data of the registry's Vault secret into registry credentials
+	Credentials(ctx context.Context, registryConfig *auth.RegistryConfig, secret map[string]interface{}) (*auth.Credentials, error)
+	// BaseURL returns the upstream base URL, without the /v2 suffix, for a registry URL
+	BaseURL(registryURL string) string
+	// Authorize sets the upstream authentication of req from credentials
+	Authorize(req *http.Request, credentials *auth.Credentials)
+}
+
+var (
+	mu        sync.RWMutex
+	providers = make(map[string]Provider)
+)
+
+// Register makes a provider available under its name and accepts the name as a registry type in
+// proxy usernames. It panics if the name is empty or already registered.
+func Register(p Provider) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	name := p.Name()
+	if name == "" {
+		panic("provider: Register with empty name")
+	}
+	if _, exists := providers[name]; exists {
+		panic("provider: Register called twice for " + name)
+	}
+	providers[name] = p
+	auth.RegisterRegistryType(name)
+}
+
+// Lookup returns the provider of a registry type
+func Lookup(name string) (Provider, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	p, ok := providers[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownProvider, name)
+	}
+	return p, nil
+}
+
+// Names returns the registered registry types, sorted
+func Names() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	names := make([]string, 0, len(providers))
+	for name := range providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Basic is a provider for registries using username/password credentials over Basic auth. Other
+// providers embed it and override what differs.
+type Basic struct {
+	Type string
+}
+
+// Name implements Provider
+func (b Basic) Name() string {
+	return b.Type
+}
+
+// Credentials implements Provider, reading the username, password and optional email fields
+func (b Basic) Credentials(ctx context.Context, registryConfig *auth.RegistryConfig, secret map[string]interface{}) (*auth.Credentials, error) {
+	return auth.BasicCredentialsFromSecret(secret)
+}
+
+// BaseURL implements Provider, adding the https scheme to hosts given without one
+func (b Basic) BaseURL(registryURL string) string {
+	return DefaultBaseURL(registryURL)
+}
+
+// Authorize implements Provider with Basic auth
+func (b Basic) Authorize(req *http.Request, credentials *auth.Credentials) {
+	credentials.SetBasicAuth(req)
+}
+
+// DefaultBaseURL adds the https scheme to registry hosts given without one and drops the
+// trailing slash
+func DefaultBaseURL(registryURL string) string {
+	if !strings.HasPrefix(registryURL, "http://") && !strings.HasPrefix(registryURL, "https://") {
+		registryURL = "https://" + registryURL
+	}
+	return strings.TrimSuffix(registryURL, "/")
+}
+
+// secretExpiry returns the optional expires_at field of a secret, an RFC 3339 timestamp marking
+// the end of a short-lived registry token
+func secretExpiry(secret map[string]interface{}) (time.Time, error) {
+	value, ok := stringField(secret, "expires_at")
+	if !ok {
+		return time.Time{}, nil
+	}
+	expiresAt, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%w: expires_at is not an RFC 3339 timestamp: %v", ErrInvalidSecret, err)
+	}
+	return expiresAt, nil
+}
+
+// tokenCredentials creates credentials for a short-lived registry token, taking its expiry from
+// the secret
+func tokenCredentials(username, token string, secret map[string]interface{}) (*auth.Credentials, error) {
+	expiresAt, err := secretExpiry(secret)
+	if err != nil {
+		return nil, err
+	}
+	credentials := auth.NewCredentials(username, []byte(token), "")
+	credentials.ExpiresAt = expiresAt
+	return credentials, nil
+}
+
+// stringField returns a non-empty string field of a secret
+func stringField(secret map[string]interface{}, name string) (string, bool) {
+	value, ok := secret[name].(string)
+	return value, ok && value != ""
+}
@@ -0,0 +1,325 @@
+// Package pullstats keeps persistent pull statistics per repository and tag in an embedded bbolt
+// database, so unused images and hot dependencies can be identified across restarts.
+package pullstats
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"vault-docker-proxy/pkg/admin"
+)
+
+// Bucket layout: repositories/<registry>/<repository> holds the summary of the repository, its
+// clients (client -> unix time of the last pull) and a tags bucket holding the same per tag
+var (
+	repositoriesBucket = []byte("repositories")
+	clientsBucket      = []byte("clients")
+	tagsBucket         = []byte("tags")
+	summaryKey         = []byte("summary")
+)
+
+// Pull is a manifest served to a client
+type Pull struct {
+	Registry   string
+	Repository string
+	Reference  string // tag or digest
+	Client     string
+	Index      bool // the manifest is an index, the client pulls a platform manifest next
+	Time       time.Time
+}
+
+// Stats are the pull counters of a repository or tag
+type Stats struct {
+	Pulls         uint64    `json:"pulls"`
+	UniqueClients uint64    `json:"unique_clients"`
+	FirstPulled   time.Time `json:"first_pulled"`
+	LastPulled    time.Time `json:"last_pulled"`
+}
+
+// RepositoryStats are the pull statistics of a repository, named registry/repository
+type RepositoryStats struct {
+	Repository string `json:"repository"`
+	Stats
+	Tags []TagStats `json:"tags,omitempty"`
+}
+
+// TagStats are the pull statistics of a tag
+type TagStats struct {
+	Tag string `json:"tag"`
+	Stats
+}
+
+// Store records pulls in memory and writes them to the database every flush interval, so pulls
+// never wait for a disk sync
+type Store struct {
+	db *bolt.DB
+
+	mu      sync.Mutex
+	pending map[pendingKey]*pendingStats
+}
+
+// pendingKey identifies the counters of a repository (empty tag) or of a tag
+type pendingKey struct {
+	repository string
+	tag        string
+}
+
+// pendingStats are the pulls recorded since the last flush
+type pendingStats struct {
+	pulls   uint64
+	first   time.Time
+	last    time.Time
+	clients map[string]time.Time
+}
+
+// Open opens or creates the database at path
+func Open(path string) (*Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open pull statistics database %s: %v", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(repositoriesBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize pull statistics database %s: %v", path, err)
+	}
+	return &Store{db: db, pending: make(map[pendingKey]*pendingStats)}, nil
+}
+
+// Record counts a pull. Only image manifests count as pulls of their repository, whatever
+// reference they were pulled by, so a multi-platform pull (index, then platform manifest) counts
+// once; manifests pulled by tag, indexes included, count as pulls of the tag.
+func (s *Store) Record(pull Pull) {
+	repository := pull.Registry + "/" + pull.Repository
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.add(pendingKey{repository: repository}, pull, !pull.Index)
+	if !strings.Contains(pull.Reference, ":") {
+		s.add(pendingKey{repository: repository, tag: pull.Reference}, pull, true)
+	}
+}
+
+// add records a pull in the pending counters of key, counting it when count is set
+func (s *Store) add(key pendingKey, pull Pull, count bool) {
+	stats, ok := s.pending[key]
+	if !ok {
+		stats = &pendingStats{first: pull.Time, clients: make(map[string]time.Time)}
+		s.pending[key] = stats
+	}
+	if count {
+		stats.pulls++
+	}
+	stats.last = pull.Time
+	stats.clients[pull.Client] = pull.Time
+}
+
+// Run flushes recorded pulls every interval until ctx is cancelled
+func (s *Store) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.Flush(); err != nil {
+				slog.Error("Failed to write pull statistics", "error", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Flush writes the pulls recorded since the last flush to the database
+func (s *Store) Flush() error {
+	s.mu.Lock()
+	pending := s.pending
+	s.pending = make(map[pendingKey]*pendingStats)
+	s.mu.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for key, stats := range pending {
+			bucket, err := tx.Bucket(repositoriesBucket).CreateBucketIfNotExists([]byte(key.repository))
+			if err != nil {
+				return err
+			}
+			if key.tag != "" {
+				tags, err := bucket.CreateBucketIfNotExists(tagsBucket)
+				if err != nil {
+					return err
+				}
+				if bucket, err = tags.CreateBucketIfNotExists([]byte(key.tag)); err != nil {
+					return err
+				}
+			}
+			if err := merge(bucket, stats); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// merge adds pending counters to the summary and clients of a repository or tag bucket
+func merge(bucket *bolt.Bucket, pending *pendingStats) error {
+	var stats Stats
+	if data := bucket.Get(summaryKey); data != nil {
+		if err := json.Unmarshal(data, &stats); err != nil {
+			return err
+		}
+	}
+	clients, err := bucket.CreateBucketIfNotExists(clientsBucket)
+	if err != nil {
+		return err
+	}
+	for client, last := range pending.clients {
+		if clients.Get([]byte(client)) == nil {
+			stats.UniqueClients++
+		}
+		value := make([]byte, 8)
+		binary.BigEndian.PutUint64(value, uint64(last.Unix()))
+		if err := clients.Put([]byte(client), value); err != nil {
+			return err
+		}
+	}
+
+	stats.Pulls += pending.pulls
+	if stats.FirstPulled.IsZero() {
+		stats.FirstPulled = pending.first
+	}
+	stats.LastPulled = pending.last
+	data, err := json.Marshal(stats)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(summaryKey, data)
+}
+
+// Repositories returns the statistics of every repository pulled, optionally with their tags
+func (s *Store) Repositories(withTags bool) ([]RepositoryStats, error) {
+	if err := s.Flush(); err != nil {
+		return nil, err
+	}
+
+	var repositories []RepositoryStats
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(repositoriesBucket).ForEachBucket(func(name []byte) error {
+			bucket := tx.Bucket(repositoriesBucket).Bucket(name)
+			repository := RepositoryStats{Repository: string(name)}
+			if err := summary(bucket, &repository.Stats); err != nil {
+				return err
+			}
+			if tags := bucket.Bucket(tagsBucket); tags != nil && withTags {
+				err := tags.ForEachBucket(func(tag []byte) error {
+					tagStats := TagStats{Tag: string(tag)}
+					if err := summary(tags.Bucket(tag), &tagStats.Stats); err != nil {
+						return err
+					}
+					repository.Tags = append(repository.Tags, tagStats)
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+				sort.Slice(repository.Tags, func(i, j int) bool {
+					return repository.Tags[i].LastPulled.After(repository.Tags[j].LastPulled)
+				})
+			}
+			repositories = append(repositories, repository)
+			return nil
+		})
+	})
+	return repositories, err
+}
+
+// summary decodes the summary of a repository or tag bucket
+func summary(bucket *bolt.Bucket, stats *Stats) error {
+	return json.Unmarshal(bucket.Get(summaryKey), stats)
+}
+
+// Close writes pending pulls and closes the database
+func (s *Store) Close() error {
+	if err := s.Flush(); err != nil {
+		slog.Error("Failed to write pull statistics", "error", err)
+	}
+	return s.db.Close()
+}
+
+// Handler serves GET /admin/pulls on the admin listener. Query parameters: unused_since (a
+// duration) keeps repositories not pulled within it, sort orders by repository (default), pulls
+// (most pulled first) or last_pulled (least recently pulled first), limit caps the number of
+// repositories and tags=true includes the statistics of their tags.
+func (s *Store) Handler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var unusedSince time.Duration
+	if value := query.Get("unused_since"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			admin.WriteError(w, "BAD_REQUEST", "unused_since must be a positive duration such as 720h", http.StatusBadRequest)
+			return
+		}
+		unusedSince = parsed
+	}
+	limit := 0
+	if value := query.Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			admin.WriteError(w, "BAD_REQUEST", "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+	var less func(a, b RepositoryStats) bool
+	switch query.Get("sort") {
+	case "", "repository":
+		less = func(a, b RepositoryStats) bool { return a.Repository < b.Repository }
+	case "pulls":
+		less = func(a, b RepositoryStats) bool { return a.Pulls > b.Pulls }
+	case "last_pulled":
+		less = func(a, b RepositoryStats) bool { return a.LastPulled.Before(b.LastPulled) }
+	default:
+		admin.WriteError(w, "BAD_REQUEST", "sort must be repository, pulls or last_pulled", http.StatusBadRequest)
+		return
+	}
+
+	repositories, err := s.Repositories(query.Get("tags") == "true")
+	if err != nil {
+		admin.WriteError(w, "UNKNOWN", err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if unusedSince > 0 {
+		cutoff := time.Now().Add(-unusedSince)
+		unused := repositories[:0]
+		for _, repository := range repositories {
+			if repository.LastPulled.Before(cutoff) {
+				unused = append(unused, repository)
+			}
+		}
+		repositories = unused
+	}
+	sort.SliceStable(repositories, func(i, j int) bool { return less(repositories[i], repositories[j]) })
+	if limit > 0 && len(repositories) > limit {
+		repositories = repositories[:limit]
+	}
+	if repositories == nil {
+		repositories = []RepositoryStats{}
+	}
+	admin.WriteJSON(w, http.StatusOK, map[string]interface{}{"repositories": repositories})
+}
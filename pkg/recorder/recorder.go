@@ -0,0 +1,207 @@
+// Package recorder captures sanitized request/response exchanges to disk so client specific
+// problems can be replayed offline.
+package recorder
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultMaxBodySize caps the number of body bytes stored per request or response
+const DefaultMaxBodySize = 64 * 1024
+
+// sensitiveHeaders are replaced by a redaction marker in recordings
+var sensitiveHeaders = map[string]bool{
+	"Authorization":            true,
+	"Proxy-Authorization":      true,
+	"X-Registry-Authorization": true,
+	"X-Vault-Token":            true,
+	"X-Api-Key":                true,
+	"Cookie":                   true,
+	"Set-Cookie":               true,
+}
+
+// Record is a single captured exchange
+type Record struct {
+	Time            time.Time   `json:"time"`
+	Method          string      `json:"method"`
+	Path            string      `json:"path"`
+	RawQuery        string      `json:"raw_query,omitempty"`
+	RequestHeaders  http.Header `json:"request_headers"`
+	RequestBody     []byte      `json:"request_body,omitempty"`
+	Status          int         `json:"status"`
+	ResponseHeaders http.Header `json:"response_headers"`
+	ResponseBody    []byte      `json:"response_body,omitempty"`
+	DurationMs      int64       `json:"duration_ms"`
+}
+
+// Recorder appends records as JSON lines to a file
+type Recorder struct {
+	mu          sync.Mutex
+	file        *os.File
+	enc         *json.Encoder
+	bodies      bool
+	maxBodySize int
+}
+
+// NewRecorder opens (or creates) the recording file. When bodies is true, request and response
+// bodies of non-blob requests are stored up to DefaultMaxBodySize bytes.
+func NewRecorder(path string, bodies bool) (*Recorder, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open recording file: %v", err)
+	}
+
+	return &Recorder{
+		file:        file,
+		enc:         json.NewEncoder(file),
+		bodies:      bodies,
+		maxBodySize: DefaultMaxBodySize,
+	}, nil
+}
+
+// Close closes the recording file
+func (rec *Recorder) Close() error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return rec.file.Close()
+}
+
+// Middleware records every request passing through next
+func (rec *Recorder) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		captureBodies := rec.bodies && !strings.Contains(r.URL.Path, "/blobs/")
+
+		record := &Record{
+			Time:           start.UTC(),
+			Method:         r.Method,
+			Path:           r.URL.Path,
+			RawQuery:       r.URL.RawQuery,
+			RequestHeaders: Sanitize(r.Header),
+		}
+
+		if captureBodies && r.Body != nil {
+			body, err := io.ReadAll(io.LimitReader(r.Body, int64(rec.maxBodySize)+1))
+			if err == nil {
+				r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+				if len(body) > rec.maxBodySize {
+					body = body[:rec.maxBodySize]
+				}
+				record.RequestBody = body
+			}
+		}
+
+		rw := &recordingWriter{ResponseWriter: w, status: http.StatusOK, capture: captureBodies, limit: rec.maxBodySize}
+		next.ServeHTTP(rw, r)
+
+		record.Status = rw.status
+		record.ResponseHeaders = Sanitize(w.Header())
+		record.ResponseBody = rw.body.Bytes()
+		record.DurationMs = time.Since(start).Milliseconds()
+
+		rec.write(record)
+	})
+}
+
+// write appends a record to the file
+func (rec *Recorder) write(record *Record) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if err := rec.enc.Encode(record); err != nil {
+		slog.Error("Failed to write recording", "error", err)
+	}
+}
+
+// Sanitize returns a copy of headers with credentials redacted. The authorization scheme is kept
+// so replays know which kind of credentials to substitute.
+func Sanitize(headers http.Header) http.Header {
+	sanitized := make(http.Header, len(headers))
+	for name, values := range headers {
+		if !sensitiveHeaders[http.CanonicalHeaderKey(name)] {
+			sanitized[name] = append([]string(nil), values...)
+			continue
+		}
+		for _, value := range values {
+			scheme := ""
+			if i := strings.IndexByte(value, ' '); i != -1 {
+				scheme = value[:i+1]
+			}
+			sanitized[name] = append(sanitized[name], scheme+"[redacted]")
+		}
+	}
+	return sanitized
+}
+
+// ReadRecords loads all records from a recording file
+func ReadRecords(path string) ([]*Record, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open recording file: %v", err)
+	}
+	defer file.Close()
+
+	var records []*Record
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 1024*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var record Record
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, fmt.Errorf("invalid record on line %d: %v", line, err)
+		}
+		records = append(records, &record)
+	}
+	return records, scanner.Err()
+}
+
+// recordingWriter captures the status code and a bounded copy of the response body
+type recordingWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	capture     bool
+	limit       int
+	body        bytes.Buffer
+}
+
+func (rw *recordingWriter) WriteHeader(status int) {
+	if !rw.wroteHeader {
+		rw.status = status
+		rw.wroteHeader = true
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *recordingWriter) Write(p []byte) (int, error) {
+	rw.wroteHeader = true
+	if rw.capture && rw.body.Len() < rw.limit {
+		remaining := rw.limit - rw.body.Len()
+		if len(p) < remaining {
+			remaining = len(p)
+		}
+		rw.body.Write(p[:remaining])
+	}
+	return rw.ResponseWriter.Write(p)
+}
+
+// Flush implements http.Flusher so streaming responses keep working while recording
+func (rw *recordingWriter) Flush() {
+	http.NewResponseController(rw.ResponseWriter).Flush()
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (rw *recordingWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
@@ -0,0 +1,72 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+
+	"vault-docker-proxy/pkg/audit"
+	"vault-docker-proxy/pkg/auth"
+	"vault-docker-proxy/pkg/logging"
+	"vault-docker-proxy/pkg/vault"
+)
+
+// SetAuditLog records every credential resolution in the audit log
+func (p *ProxyServer) SetAuditLog(auditLog *audit.Log) {
+	p.audit = auditLog
+}
+
+// auditRequest is what audit events tell about the client request a credential resolution
+// serves
+type auditRequest struct {
+	clientIP   string
+	repository string
+}
+
+type auditRequestKey struct{}
+
+// withAuditRequest returns the context of r carrying the client IP and repository recorded in
+// audit events
+func withAuditRequest(r *http.Request) context.Context {
+	clientIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		clientIP = r.RemoteAddr
+	}
+	return context.WithValue(r.Context(), auditRequestKey{}, auditRequest{clientIP: clientIP, repository: repositoryOf(r)})
+}
+
+// auditResolution records the outcome of a credential resolution; err is the resolution error
+// when outcome is empty
+func (p *ProxyServer) auditResolution(ctx context.Context, registryConfig *auth.RegistryConfig, vaultToken, outcome string, err error) {
+	if p.audit == nil {
+		return
+	}
+	event := audit.Event{
+		RequestID:    logging.RequestID(ctx),
+		TokenHash:    audit.HashToken(vaultToken),
+		RegistryType: registryConfig.Type,
+		Registry:     registryConfig.RegistryURL,
+		Namespace:    registryConfig.Namespace,
+		VaultPath:    registryConfig.VaultPath,
+		Outcome:      outcome,
+	}
+	if apiKey, ok := auth.GetAPIKeyFromContext(ctx); ok {
+		event.APIKey = apiKey.Name
+	}
+	if request, ok := ctx.Value(auditRequestKey{}).(auditRequest); ok {
+		event.ClientIP, event.Repository = request.clientIP, request.repository
+	}
+	if err != nil {
+		event.Error = err.Error()
+		switch {
+		case errors.Is(err, vault.ErrPermissionDenied), errors.Is(err, vault.ErrInvalidToken):
+			event.Outcome = audit.OutcomeDenied
+		case errors.Is(err, vault.ErrSecretNotFound):
+			event.Outcome = audit.OutcomeNotFound
+		default:
+			event.Outcome = audit.OutcomeError
+		}
+	}
+	p.audit.Record(event)
+}
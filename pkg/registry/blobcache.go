@@ -0,0 +1,153 @@
+package registry
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+
+	"vault-docker-proxy/pkg/auth"
+	"vault-docker-proxy/pkg/blobcache"
+	"vault-docker-proxy/pkg/logging"
+)
+
+// blobGrantTTL is how long a blob access confirmed by the upstream registry lets the same
+// registry credentials get the blob from the cache without asking the registry again
+const blobGrantTTL = time.Hour
+
+// blobCache is the pull-through blob cache. Blobs are stored once by digest, but only served
+// to requests whose registry credentials the upstream registry allowed to pull the blob from
+// the repository, so knowing a digest is never enough to get a private layer.
+type blobCache struct {
+	store  blobcache.Store
+	grants *cache.Cache
+}
+
+// SetBlobCache enables the pull-through blob cache: blobs pulled with credentials from Vault are
+// stored as they are streamed to the client, and later pulls of the same blob are served from
+// the store
+func (p *ProxyServer) SetBlobCache(store blobcache.Store) {
+	p.blobs = &blobCache{store: store, grants: cache.New(blobGrantTTL, 10*time.Minute)}
+}
+
+// proxyBlob serves a blob GET or HEAD from the blob cache, filling the cache on a miss
+func (p *ProxyServer) proxyBlob(w http.ResponseWriter, r *http.Request, credentials *auth.Credentials, registryConfig *auth.RegistryConfig, path string) error {
+	i := strings.LastIndex(path, "/blobs/")
+	repo, digest := strings.TrimPrefix(path[:i], "/"), path[i+len("/blobs/"):]
+	registryURL := providerFor(registryConfig).BaseURL(registryConfig.RegistryURL)
+	grant := strings.Join([]string{registryURL, registryConfig.Namespace, registryConfig.SecretPath(), repo, digest}, "|")
+
+	if file, size, ok := p.blobs.store.Open(r.Context(), digest); ok {
+		defer file.Close()
+		if _, granted := p.blobs.grants.Get(grant); granted || p.confirmAccess(r, credentials, registryConfig, path) {
+			p.blobs.grants.SetDefault(grant, true)
+			logging.FromContext(r.Context()).Debug("Serving blob from the cache", "digest", digest)
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+			w.Header().Set("Docker-Content-Digest", digest)
+			w.Header().Set("Etag", `"`+digest+`"`)
+			w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+			http.ServeContent(w, r, "", time.Time{}, file)
+			return nil
+		}
+	}
+
+	cw := &blobCacheWriter{ResponseWriter: w, ctx: r.Context(), store: p.blobs.store, digest: digest}
+	// Only complete 200 responses are stored: resumed downloads get 206 Partial Content, which
+	// cannot be verified against the digest, unless If-Range no longer matches
+	cw.cacheable = r.Method == http.MethodGet
+	if err := p.proxyRequest(cw, r, credentials, registryConfig, path); err != nil {
+		cw.abort()
+		return err
+	}
+	if cw.commit() {
+		p.blobs.grants.SetDefault(grant, true)
+	}
+	return nil
+}
+
+// confirmAccess asks the upstream registry whether the credentials can pull a cached blob or
+// manifest
+func (p *ProxyServer) confirmAccess(r *http.Request, credentials *auth.Credentials, registryConfig *auth.RegistryConfig, path string) bool {
+	resp, err := p.fetch(r.Context(), newUpstream(registryConfig, credentials), http.MethodHead, path, nil)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return true
+}
+
+// blobCacheWriter stores a blob in the cache while it is streamed to the client
+type blobCacheWriter struct {
+	http.ResponseWriter
+	ctx         context.Context
+	store       blobcache.Store
+	digest      string
+	cacheable   bool
+	wroteHeader bool
+	blob        blobcache.Writer
+}
+
+func (cw *blobCacheWriter) WriteHeader(status int) {
+	if !cw.wroteHeader {
+		cw.wroteHeader = true
+		// Encoded content would not match the digest
+		if cw.cacheable && status == http.StatusOK && cw.Header().Get("Content-Encoding") == "" {
+			size, err := strconv.ParseInt(cw.Header().Get("Content-Length"), 10, 64)
+			if err != nil {
+				size = -1
+			}
+			if blob, err := cw.store.Create(cw.ctx, cw.digest, size); err == nil {
+				cw.blob = blob
+			} else {
+				logging.FromContext(cw.ctx).Warn("Not caching blob", "digest", cw.digest, "error", err)
+			}
+		}
+	}
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *blobCacheWriter) Write(b []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	n, err := cw.ResponseWriter.Write(b)
+	if cw.blob != nil {
+		if _, cacheErr := cw.blob.Write(b[:n]); cacheErr != nil {
+			logging.FromContext(cw.ctx).Warn("Not caching blob", "digest", cw.digest, "error", cacheErr)
+			cw.abort()
+		}
+	}
+	return n, err
+}
+
+// Unwrap returns the underlying ResponseWriter, for http.ResponseController
+func (cw *blobCacheWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// commit stores the blob once it was sent in full, reporting whether it was stored
+func (cw *blobCacheWriter) commit() bool {
+	if cw.blob == nil {
+		return false
+	}
+	blob := cw.blob
+	cw.blob = nil
+	if err := blob.Commit(); err != nil {
+		logging.FromContext(cw.ctx).Warn("Not caching blob", "digest", cw.digest, "error", err)
+		return false
+	}
+	logging.FromContext(cw.ctx).Info("Cached blob", "digest", cw.digest)
+	return true
+}
+
+// abort discards a partially stored blob
+func (cw *blobCacheWriter) abort() {
+	if cw.blob != nil {
+		cw.blob.Abort()
+		cw.blob = nil
+	}
+}
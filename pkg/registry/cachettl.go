@@ -0,0 +1,63 @@
+package registry
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+
+	"vault-docker-proxy/pkg/auth"
+	"vault-docker-proxy/pkg/provider"
+)
+
+// CacheTTLRule overrides the credential cache TTL of the credentials of a registry type, a Vault
+// path or both
+type CacheTTLRule struct {
+	Type string        // registry type, any when empty
+	Path string        // Vault path glob, any when empty
+	TTL  time.Duration // 0 does not cache matching credentials
+}
+
+// compiledTTLRule is a CacheTTLRule with its path glob compiled
+type compiledTTLRule struct {
+	registryType string
+	path         *regexp.Regexp
+	ttl          time.Duration
+}
+
+// SetCredentialTTLs sets the rules choosing how long credentials are cached, first match wins.
+// Credentials matching no rule are cached for the cache's TTL.
+func (p *ProxyServer) SetCredentialTTLs(rules []CacheTTLRule) error {
+	var compiled []compiledTTLRule
+	for i, rule := range rules {
+		if rule.Type != "" {
+			if _, err := provider.Lookup(rule.Type); err != nil {
+				return fmt.Errorf("rule %d: %v", i, err)
+			}
+		}
+		ttlRule := compiledTTLRule{registryType: rule.Type, ttl: rule.TTL}
+		if rule.Path != "" {
+			re, err := compileGlob(rule.Path)
+			if err != nil {
+				return fmt.Errorf("rule %d: invalid path %q: %v", i, rule.Path, err)
+			}
+			ttlRule.path = re
+		}
+		compiled = append(compiled, ttlRule)
+	}
+	p.ttlRules = compiled
+	return nil
+}
+
+// credentialTTL returns how long the credentials of a registry configuration are cached
+func (p *ProxyServer) credentialTTL(registryConfig *auth.RegistryConfig) time.Duration {
+	for _, rule := range p.ttlRules {
+		if rule.registryType != "" && rule.registryType != registryConfig.Type {
+			continue
+		}
+		if rule.path != nil && !rule.path.MatchString(registryConfig.VaultPath) {
+			continue
+		}
+		return rule.ttl
+	}
+	return p.cache.TTL()
+}
@@ -0,0 +1,136 @@
+package registry
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"vault-docker-proxy/pkg/auth"
+	"vault-docker-proxy/pkg/logging"
+)
+
+// ClientIdentity grants client certificates with a matching name access to Vault paths and
+// registries
+type ClientIdentity struct {
+	Names      []string // globs matched against the certificate's CN and DNS, email and URI SANs
+	VaultPaths []string // Vault path globs, every path when empty
+	Registries []string // registry host globs, every registry when empty
+}
+
+// compiledClientIdentity is a ClientIdentity with its globs compiled
+type compiledClientIdentity struct {
+	names      []*regexp.Regexp
+	vaultPaths []*regexp.Regexp
+	registries []*regexp.Regexp
+}
+
+// SetClientIdentities requires a verified client certificate on requests received over TLS, and
+// restricts each certificate to the Vault paths and registries of the identities its names
+// match. Without identities any verified certificate is accepted.
+func (p *ProxyServer) SetClientIdentities(identities []ClientIdentity) error {
+	compiled := make([]compiledClientIdentity, 0, len(identities))
+	for i, identity := range identities {
+		var c compiledClientIdentity
+		for _, globs := range []struct {
+			field    string
+			globs    []string
+			compiled *[]*regexp.Regexp
+		}{
+			{"name", identity.Names, &c.names},
+			{"vault path", identity.VaultPaths, &c.vaultPaths},
+			{"registry", identity.Registries, &c.registries},
+		} {
+			for _, glob := range globs.globs {
+				re, err := compileGlob(glob)
+				if err != nil {
+					return fmt.Errorf("identity %d: invalid %s %q: %v", i, globs.field, glob, err)
+				}
+				*globs.compiled = append(*globs.compiled, re)
+			}
+		}
+		compiled = append(compiled, c)
+	}
+	p.clientIdentities = compiled
+	return nil
+}
+
+// ClientCertificateMiddleware rejects requests received over TLS without a verified client
+// certificate, or whose certificate identity is not granted the Vault path and registry of the
+// request. It must run after authentication. Requests received on plaintext listeners are not
+// affected.
+func (p *ProxyServer) ClientCertificateMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+			writeErrorResponse(w, "UNAUTHORIZED", "a client certificate is required", http.StatusUnauthorized)
+			return
+		}
+		certificate := r.TLS.VerifiedChains[0][0]
+		logging.AddFields(r.Context(), "client_cert", certificate.Subject.CommonName)
+		if len(p.clientIdentities) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		vaultPath, host := requestVaultPath(r), requestRegistry(r)
+		for _, identity := range p.clientIdentities {
+			if identity.matches(certificate) && identity.allows(vaultPath, host) {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		logging.FromContext(r.Context()).Warn("Client certificate denied", "names", certificateNames(certificate), "registry", host, "vault_path", vaultPath)
+		writeErrorResponse(w, "DENIED", fmt.Sprintf("client certificate %q is not granted access to this Vault path and registry", certificate.Subject.CommonName), http.StatusForbidden)
+	})
+}
+
+// matches reports whether one of the certificate's names matches the identity
+func (c *compiledClientIdentity) matches(certificate *x509.Certificate) bool {
+	for _, name := range certificateNames(certificate) {
+		if matchesAny(c.names, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// allows reports whether the identity grants the Vault path and registry host. Bearer requests
+// use no Vault path and are only checked against the registries.
+func (c *compiledClientIdentity) allows(vaultPath, registryHost string) bool {
+	if len(c.vaultPaths) > 0 && vaultPath != "" && !matchesAny(c.vaultPaths, vaultPath) {
+		return false
+	}
+	return len(c.registries) == 0 || matchesAny(c.registries, registryHost)
+}
+
+// certificateNames returns the common name and the DNS, email and URI subject alternative names
+// of a certificate
+func certificateNames(certificate *x509.Certificate) []string {
+	var names []string
+	if certificate.Subject.CommonName != "" {
+		names = append(names, certificate.Subject.CommonName)
+	}
+	names = append(names, certificate.DNSNames...)
+	names = append(names, certificate.EmailAddresses...)
+	for _, uri := range certificate.URIs {
+		names = append(names, uri.String())
+	}
+	return names
+}
+
+// requestVaultPath returns the Vault path of an authenticated request, empty for Bearer requests
+func requestVaultPath(r *http.Request) string {
+	if apiKey, ok := auth.GetAPIKeyFromContext(r.Context()); ok {
+		return apiKey.Registry.VaultPath
+	}
+	if authHeader, ok := auth.GetAuthFromContext(r.Context()); ok {
+		if registryConfig, err := auth.ParseUsername(authHeader.Username); err == nil {
+			return registryConfig.VaultPath
+		}
+	}
+	return ""
+}
@@ -0,0 +1,256 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"vault-docker-proxy/pkg/admin"
+	"vault-docker-proxy/pkg/logging"
+)
+
+// maxCopyRequestSize bounds the JSON body accepted by the copy endpoint
+const maxCopyRequestSize = 64 * 1024
+
+// CopyEndpoint identifies one side of an image copy
+type CopyEndpoint struct {
+	Username string `json:"username"` // <registry_type>;<vault_path>;<registry_url>
+	Token    string `json:"token"`    // Vault token used to read the registry credentials
+	Image    string `json:"image"`    // repository[:tag|@digest]
+}
+
+// CopyRequest is the body of POST /admin/copy
+type CopyRequest struct {
+	Source      CopyEndpoint `json:"source"`
+	Destination CopyEndpoint `json:"destination"`
+}
+
+// CopyResult summarizes a completed image copy
+type CopyResult struct {
+	Source        string `json:"source"`
+	Destination   string `json:"destination"`
+	Digest        string `json:"digest"`
+	Manifests     int    `json:"manifests"`
+	BlobsCopied   int    `json:"blobs_copied"`
+	BlobsMounted  int    `json:"blobs_mounted"`
+	BlobsExisting int    `json:"blobs_existing"`
+	BytesCopied   int64  `json:"bytes_copied"`
+}
+
+// imageCopy holds the state of a single copy operation
+type imageCopy struct {
+	proxy   *ProxyServer
+	src     *upstream
+	dst     *upstream
+	srcRepo string
+	dstRepo string
+	result  *CopyResult
+}
+
+// CopyImage handles POST /admin/copy - copy an image, including every platform of a
+// multi-platform image, from one upstream registry to another. Manifests are pushed unchanged so
+// digests are preserved. Blobs and child manifests already present at the destination are
+// skipped, so a failed copy can simply be retried.
+func (p *ProxyServer) CopyImage(w http.ResponseWriter, r *http.Request) {
+	var req CopyRequest
+	decoder := json.NewDecoder(io.LimitReader(r.Body, maxCopyRequestSize))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		writeErrorResponse(w, "BAD_REQUEST", fmt.Sprintf("invalid copy request: %v", err), http.StatusBadRequest)
+		return
+	}
+	for name, endpoint := range map[string]CopyEndpoint{"source": req.Source, "destination": req.Destination} {
+		if endpoint.Username == "" || endpoint.Token == "" || endpoint.Image == "" {
+			writeErrorResponse(w, "BAD_REQUEST", fmt.Sprintf("%s requires username, token and image", name), http.StatusBadRequest)
+			return
+		}
+	}
+
+	srcRepo, srcRef := parseImageReference(req.Source.Image)
+	dstRepo, dstRef := parseImageReference(req.Destination.Image)
+	if !strings.ContainsAny(strings.TrimPrefix(req.Destination.Image, dstRepo), ":@") {
+		// No tag or digest given for the destination, keep the source reference
+		dstRef = srcRef
+	}
+
+	src, err := p.upstreamFor(r.Context(), req.Source.Username, req.Source.Token)
+	if err != nil {
+		writeErrorResponse(w, "UNAUTHORIZED", fmt.Sprintf("source: %v", err), http.StatusUnauthorized)
+		return
+	}
+	defer src.release()
+	dst, err := p.upstreamFor(r.Context(), req.Destination.Username, req.Destination.Token)
+	if err != nil {
+		writeErrorResponse(w, "UNAUTHORIZED", fmt.Sprintf("destination: %v", err), http.StatusUnauthorized)
+		return
+	}
+	defer dst.release()
+
+	root, err := p.fetchManifest(r.Context(), src, srcRepo, srcRef)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if strings.HasPrefix(dstRef, "sha256:") && dstRef != root.Descriptor.Digest {
+		writeErrorResponse(w, "DIGEST_INVALID", fmt.Sprintf("source digest %s does not match destination reference %s", root.Descriptor.Digest, dstRef), http.StatusBadRequest)
+		return
+	}
+
+	c := &imageCopy{
+		proxy:   p,
+		src:     src,
+		dst:     dst,
+		srcRepo: srcRepo,
+		dstRepo: dstRepo,
+		result: &CopyResult{
+			Source:      fmt.Sprintf("%s/%s:%s", src.registryConfig.RegistryURL, srcRepo, srcRef),
+			Destination: fmt.Sprintf("%s/%s:%s", dst.registryConfig.RegistryURL, dstRepo, dstRef),
+			Digest:      root.Descriptor.Digest,
+		},
+	}
+
+	logging.FromContext(r.Context()).Info("Copying image", "source", c.result.Source, "destination", c.result.Destination, "digest", root.Descriptor.Digest)
+	if err := c.copyManifest(r.Context(), root, dstRef); err != nil {
+		logging.FromContext(r.Context()).Error("Image copy failed", "source", c.result.Source, "destination", c.result.Destination, "error", err)
+		writeError(w, err)
+		return
+	}
+	logging.FromContext(r.Context()).Info("Copied image", "source", c.result.Source, "destination", c.result.Destination,
+		"blobs_copied", c.result.BlobsCopied, "blobs_mounted", c.result.BlobsMounted, "blobs_existing", c.result.BlobsExisting, "bytes", c.result.BytesCopied)
+
+	admin.WriteJSON(w, http.StatusOK, c.result)
+}
+
+// copyManifest copies everything a manifest references and then pushes the manifest itself
+func (c *imageCopy) copyManifest(ctx context.Context, m *fetchedManifest, reference string) error {
+	if strings.HasPrefix(reference, "sha256:") {
+		exists, err := c.exists(ctx, fmt.Sprintf("/%s/manifests/%s", c.dstRepo, reference), http.Header{"Accept": {manifestAccept}})
+		if err != nil {
+			return err
+		}
+		if exists {
+			return nil
+		}
+	}
+
+	if m.IsIndex() {
+		for _, child := range m.Manifests {
+			childManifest, err := c.proxy.fetchManifest(ctx, c.src, c.srcRepo, child.Digest)
+			if err != nil {
+				return err
+			}
+			if err := c.copyManifest(ctx, childManifest, child.Digest); err != nil {
+				return err
+			}
+		}
+	} else {
+		for _, desc := range append([]Descriptor{m.Config}, m.Layers...) {
+			if err := c.copyBlob(ctx, desc); err != nil {
+				return err
+			}
+		}
+	}
+
+	header := http.Header{"Content-Type": {m.Descriptor.MediaType}}
+	resp, err := c.proxy.send(ctx, c.dst, http.MethodPut, fmt.Sprintf("%s/v2/%s/manifests/%s", c.dst.registryURL, c.dstRepo, reference),
+		header, bytes.NewReader(m.Raw), int64(len(m.Raw)))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	c.result.Manifests++
+	return nil
+}
+
+// copyBlob copies a blob unless the destination already has it, preferring a cross-repository
+// mount when both sides are the same registry
+func (c *imageCopy) copyBlob(ctx context.Context, desc Descriptor) error {
+	exists, err := c.exists(ctx, fmt.Sprintf("/%s/blobs/%s", c.dstRepo, desc.Digest), nil)
+	if err != nil {
+		return err
+	}
+	if exists {
+		c.result.BlobsExisting++
+		return nil
+	}
+
+	uploadURL := fmt.Sprintf("%s/v2/%s/blobs/uploads/", c.dst.registryURL, c.dstRepo)
+	if c.src.registryURL == c.dst.registryURL && c.srcRepo != c.dstRepo {
+		uploadURL += "?" + url.Values{"mount": {desc.Digest}, "from": {c.srcRepo}}.Encode()
+	}
+	resp, err := c.proxy.send(ctx, c.dst, http.MethodPost, uploadURL, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusCreated {
+		c.result.BlobsMounted++
+		return nil
+	}
+
+	location, err := c.uploadLocation(resp, desc.Digest)
+	if err != nil {
+		return err
+	}
+
+	blob, err := c.proxy.fetch(ctx, c.src, http.MethodGet, fmt.Sprintf("/%s/blobs/%s", c.srcRepo, desc.Digest), nil)
+	if err != nil {
+		return err
+	}
+	defer blob.Body.Close()
+
+	header := http.Header{"Content-Type": {"application/octet-stream"}}
+	resp, err = c.proxy.send(ctx, c.dst, http.MethodPut, location, header, io.LimitReader(blob.Body, desc.Size), desc.Size)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	c.result.BlobsCopied++
+	c.result.BytesCopied += desc.Size
+	return nil
+}
+
+// exists reports whether a HEAD request for targetPath succeeds on the destination
+func (c *imageCopy) exists(ctx context.Context, targetPath string, header http.Header) (bool, error) {
+	resp, err := c.proxy.fetch(ctx, c.dst, http.MethodHead, targetPath, header)
+	if err != nil {
+		var upstreamErr *UpstreamError
+		if errors.As(err, &upstreamErr) && upstreamErr.StatusCode == http.StatusNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	resp.Body.Close()
+	return true, nil
+}
+
+// uploadLocation resolves the upload URL returned by the destination and adds the digest
+// parameter completing a monolithic upload
+func (c *imageCopy) uploadLocation(resp *http.Response, digest string) (string, error) {
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return "", fmt.Errorf("destination registry did not return an upload location")
+	}
+
+	base, err := url.Parse(c.dst.registryURL + "/")
+	if err != nil {
+		return "", err
+	}
+	uploadURL, err := base.Parse(location)
+	if err != nil {
+		return "", fmt.Errorf("invalid upload location %q: %v", location, err)
+	}
+
+	query := uploadURL.Query()
+	query.Set("digest", digest)
+	uploadURL.RawQuery = query.Encode()
+	return uploadURL.String(), nil
+}
@@ -0,0 +1,89 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"vault-docker-proxy/pkg/auth"
+)
+
+// DryRunHeader requests a dry run for a single request when sent to the admin listener
+const DryRunHeader = "X-Dry-Run"
+
+type dryRunKey struct{}
+
+// WithDryRun marks the context so the proxy explains the request instead of forwarding it
+func WithDryRun(ctx context.Context) context.Context {
+	return context.WithValue(ctx, dryRunKey{}, true)
+}
+
+// DryRunMiddleware enables dry run for requests carrying a truthy X-Dry-Run header. It is meant
+// for the admin listener only, so data-plane clients cannot toggle it.
+func DryRunMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if enabled, _ := strconv.ParseBool(r.Header.Get(DryRunHeader)); enabled {
+			r = r.WithContext(WithDryRun(r.Context()))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// DryRunExplanation describes what the proxy would have done with a request
+type DryRunExplanation struct {
+	DryRun           bool              `json:"dry_run"`
+	AuthMode         string            `json:"auth_mode"`
+	RegistryType     string            `json:"registry_type,omitempty"`
+	VaultPath        string            `json:"vault_path,omitempty"`
+	RegistryURL      string            `json:"registry_url"`
+	UpstreamMethod   string            `json:"upstream_method"`
+	UpstreamURL      string            `json:"upstream_url"`
+	UpstreamAuth     string            `json:"upstream_auth"`
+	ForwardedHeaders map[string]string `json:"forwarded_headers"`
+}
+
+// SetDryRun makes every request a dry run, regardless of headers
+func (p *ProxyServer) SetDryRun(enabled bool) {
+	p.dryRun = enabled
+}
+
+// isDryRun reports whether the request should be explained rather than forwarded
+func (p *ProxyServer) isDryRun(r *http.Request) bool {
+	enabled, _ := r.Context().Value(dryRunKey{}).(bool)
+	return p.dryRun || enabled
+}
+
+// writeDryRun writes the explanation of a prepared upstream request instead of sending it
+func (p *ProxyServer) writeDryRun(w http.ResponseWriter, proxyReq *http.Request, registryConfig *auth.RegistryConfig, registryURL string, credentials *auth.Credentials) {
+	explanation := DryRunExplanation{
+		DryRun:           true,
+		AuthMode:         "bearer",
+		RegistryURL:      registryURL,
+		UpstreamMethod:   proxyReq.Method,
+		UpstreamURL:      proxyReq.URL.String(),
+		UpstreamAuth:     "client bearer token forwarded as-is",
+		ForwardedHeaders: make(map[string]string),
+	}
+
+	if registryConfig != nil {
+		explanation.AuthMode = "basic"
+		explanation.RegistryType = registryConfig.Type
+		explanation.VaultPath = registryConfig.VaultPath
+		explanation.UpstreamAuth = "basic auth as registry user " + strconv.Quote(credentials.Username) + " from Vault"
+	}
+
+	for name := range proxyReq.Header {
+		value := proxyReq.Header.Get(name)
+		if name == "Authorization" {
+			value = "[redacted]"
+		}
+		explanation.ForwardedHeaders[name] = value
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(explanation)
+}
@@ -0,0 +1,33 @@
+package registry
+
+import (
+	"net/http"
+
+	"vault-docker-proxy/pkg/logging"
+	"vault-docker-proxy/pkg/transport"
+)
+
+// SetEgressAllowlist restricts the registries clients may target. The upstream transport enforces
+// the same allowlist on every connection; checking it here rejects requests before any Vault or
+// upstream call.
+func (p *ProxyServer) SetEgressAllowlist(allowlist *transport.HostAllowlist) {
+	p.egress = allowlist
+}
+
+// EgressMiddleware rejects requests whose username or Bearer registry points to a host outside
+// the allowlist. It must run after authentication.
+func (p *ProxyServer) EgressMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := requestRegistry(r)
+		if p.egress == nil || host == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if err := p.egress.Check(host); err != nil {
+			logging.FromContext(r.Context()).Warn("Upstream egress denied", "method", r.Method, "path", r.URL.Path, "error", err)
+			writeErrorResponse(w, "DENIED", err.Error(), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,173 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+
+	"vault-docker-proxy/pkg/auth"
+	"vault-docker-proxy/pkg/logging"
+	"vault-docker-proxy/pkg/transport"
+)
+
+// errResponseStarted marks failures that happen once the upstream response is being copied to
+// the client: the status line is already sent, so no error response can follow
+var errResponseStarted = errors.New("response already started")
+
+// writeError translates an internal failure into a registry error response, so clients see a
+// spec-compliant error code and status instead of an opaque 500
+func writeError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errSizeLimit) {
+		return // reported by SizeLimitMiddleware
+	}
+	if errors.Is(err, errResponseStarted) {
+		slog.Warn("Cannot report error, response already started", "error", err)
+		return
+	}
+
+	// Registry errors of the upstream response are more precise than anything derived from them,
+	// except a 401 that would read as a rejection of the client's own credentials
+	var upstreamErr *UpstreamError
+	if errors.As(err, &upstreamErr) && len(upstreamErr.Errors) > 0 && upstreamErr.StatusCode != http.StatusUnauthorized {
+		writeErrorDetails(w, upstreamErr.Errors, upstreamErr.StatusCode)
+		return
+	}
+
+	code, statusCode := errorCode(err)
+	writeErrorResponse(w, code, err.Error(), statusCode)
+}
+
+// writeCredentialsRejected reports an upstream 401 to a request made with credentials from
+// Vault. The upstream challenge is dropped, as answering it would not change the credentials,
+// and the cached credentials of the Vault path are removed so the next request reads them again,
+// unless the registry asked for a Bearer token the request could not be retried with; the token
+// is then ready for the next request. Token services rejecting the credentials answer without
+// a Bearer challenge.
+func (p *ProxyServer) writeCredentialsRejected(w http.ResponseWriter, resp *http.Response, registryConfig *auth.RegistryConfig, registryURL, authorization string) {
+	challenge := resp.Header.Get("WWW-Authenticate")
+	if !strings.HasPrefix(strings.ToLower(challenge), "bearer") {
+		if removed := p.cache.DeletePath(registryConfig.SecretPath()); removed > 0 {
+			slog.Info("Removed cached credentials rejected upstream", "vault_path", registryConfig.SecretPath(), "registry", registryURL, "removed", removed)
+		}
+	}
+
+	message := fmt.Sprintf("upstream registry %s rejected the credentials stored in Vault at %s", registryHost(registryURL), registryConfig.VaultPath)
+	if errs := upstreamErrors(resp, authorization); len(errs) > 0 {
+		message += ": " + errorMessages(errs)
+	}
+	slog.Warn(message)
+
+	w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+	writeErrorResponse(w, "UNAUTHORIZED", message, http.StatusUnauthorized)
+}
+
+// writeErrorDetails writes a registry error response with several errors, with any secret they
+// quote masked
+func writeErrorDetails(w http.ResponseWriter, errs []ErrorDetail, statusCode int) {
+	redacted := make([]ErrorDetail, len(errs))
+	for i, e := range errs {
+		redacted[i] = ErrorDetail{Code: e.Code, Message: logging.Redact(e.Message), Detail: logging.Redact(e.Detail)}
+	}
+	errs = redacted
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(ErrorResponse{Errors: errs})
+}
+
+// upstreamErrors reads the registry errors of an upstream error response, redacting any echo of
+// the Authorization value sent upstream. Bodies that are not registry errors yield nothing.
+func upstreamErrors(resp *http.Response, authorization string) []ErrorDetail {
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxRedactedBodySize))
+	if err != nil {
+		return nil
+	}
+	if authorization != "" {
+		for _, secret := range authorizationSecrets(authorization) {
+			body = bytes.ReplaceAll(body, []byte(secret), []byte("[redacted]"))
+		}
+	}
+
+	// The detail of upstream errors may be any JSON value and is not kept
+	var errorResp struct {
+		Errors []struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if json.Unmarshal(body, &errorResp) != nil {
+		return nil
+	}
+	var errs []ErrorDetail
+	for _, detail := range errorResp.Errors {
+		if detail.Code != "" {
+			errs = append(errs, ErrorDetail{Code: detail.Code, Message: detail.Message})
+		}
+	}
+	return errs
+}
+
+// errorMessages joins the messages of registry errors
+func errorMessages(errs []ErrorDetail) string {
+	messages := make([]string, 0, len(errs))
+	for _, detail := range errs {
+		message := detail.Message
+		if message == "" {
+			message = strings.ToLower(strings.ReplaceAll(detail.Code, "_", " "))
+		}
+		messages = append(messages, message)
+	}
+	return strings.Join(messages, "; ")
+}
+
+// errorCode maps a failure to a registry error code and HTTP status. Upstream registry errors
+// keep their status, with the code of the resource that was requested; other failures happen
+// while talking to the upstream registry and are reported as a bad gateway.
+func errorCode(err error) (string, int) {
+	var upstreamErr *UpstreamError
+	if errors.As(err, &upstreamErr) {
+		return upstreamErrorCode(upstreamErr), upstreamErr.StatusCode
+	}
+
+	var netErr net.Error
+	switch {
+	case errors.Is(err, transport.ErrEgressDenied):
+		return "DENIED", http.StatusForbidden
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "UNAVAILABLE", http.StatusGatewayTimeout
+	case errors.Is(err, transport.ErrPinMismatch), errors.As(err, &netErr):
+		return "UNAVAILABLE", http.StatusBadGateway
+	}
+	return "UNKNOWN", http.StatusBadGateway
+}
+
+// upstreamErrorCode returns the registry error code of an upstream error response
+func upstreamErrorCode(err *UpstreamError) string {
+	switch err.StatusCode {
+	case http.StatusUnauthorized:
+		return "UNAUTHORIZED"
+	case http.StatusForbidden:
+		return "DENIED"
+	case http.StatusTooManyRequests:
+		return "TOOMANYREQUESTS"
+	case http.StatusNotFound:
+		switch {
+		case strings.Contains(err.Path, "/manifests/"):
+			return "MANIFEST_UNKNOWN"
+		case strings.Contains(err.Path, "/blobs/"):
+			return "BLOB_UNKNOWN"
+		default:
+			return "NAME_UNKNOWN"
+		}
+	}
+	if err.StatusCode >= 500 {
+		return "UNAVAILABLE"
+	}
+	return "UNKNOWN"
+}
@@ -0,0 +1,222 @@
+package registry
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"vault-docker-proxy/pkg/logging"
+)
+
+// DefaultExportPlatform is exported by format=docker when the image has several platforms
+const DefaultExportPlatform = "linux/amd64"
+
+// ExportImage handles GET /ext/export/{name}:{ref} - stream a complete image as a tarball.
+// Query parameters: format=oci (default) or format=docker for a docker save/load compatible
+// tarball, and platform=os/arch to export a single platform of a multi-platform image.
+func (p *ProxyServer) ExportImage(w http.ResponseWriter, r *http.Request) {
+	repo, reference := parseImageReference(mux.Vars(r)["image"])
+	platform := r.URL.Query().Get("platform")
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "oci"
+	}
+	if format != "oci" && format != "docker" {
+		writeErrorResponse(w, "UNSUPPORTED", fmt.Sprintf("unsupported export format %q", format), http.StatusBadRequest)
+		return
+	}
+
+	up, err := p.resolveUpstream(r)
+	if err != nil {
+		writeErrorResponse(w, "UNAUTHORIZED", err.Error(), http.StatusUnauthorized)
+		return
+	}
+	defer up.release()
+
+	root, err := p.fetchManifest(r.Context(), up, repo, reference)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if root.IsIndex() && platform == "" && format == "docker" {
+		// docker load only understands single-platform images
+		platform = DefaultExportPlatform
+	}
+	if root.IsIndex() && platform != "" {
+		desc, err := selectPlatform(&root.Manifest, platform)
+		if err != nil {
+			writeErrorResponse(w, "MANIFEST_UNKNOWN", err.Error(), http.StatusNotFound)
+			return
+		}
+		if root, err = p.fetchManifest(r.Context(), up, repo, desc.Digest); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+
+	logging.FromContext(r.Context()).Info("Exporting image", "reference", reference, "format", format, "digest", root.Descriptor.Digest)
+
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, exportFilename(repo, reference, format)))
+	w.Header().Set("Docker-Content-Digest", root.Descriptor.Digest)
+	w.WriteHeader(http.StatusOK)
+
+	tw := tar.NewWriter(w)
+	err = p.writeOCILayout(r.Context(), tw, up, repo, reference, root)
+	if err == nil && format == "docker" {
+		err = writeDockerManifest(tw, repo, reference, root)
+	}
+	if err != nil {
+		// The status line is already sent, so abort the connection to make the truncation visible
+		logging.FromContext(r.Context()).Error("Image export failed mid-stream", "reference", reference, "error", err)
+		panic(http.ErrAbortHandler)
+	}
+	if err := tw.Close(); err != nil {
+		logging.FromContext(r.Context()).Error("Failed to finish export tarball", "error", err)
+	}
+}
+
+// writeOCILayout writes an OCI image layout containing root and everything it references
+func (p *ProxyServer) writeOCILayout(ctx context.Context, tw *tar.Writer, up *upstream, repo, reference string, root *fetchedManifest) error {
+	if err := writeTarFile(tw, "oci-layout", []byte(`{"imageLayoutVersion":"1.0.0"}`)); err != nil {
+		return err
+	}
+
+	written := make(map[string]bool)
+	if err := p.writeManifestTree(ctx, tw, up, repo, root, written); err != nil {
+		return err
+	}
+
+	rootDesc := root.Descriptor
+	if !strings.HasPrefix(reference, "sha256:") {
+		rootDesc.Annotations = map[string]string{"org.opencontainers.image.ref.name": reference}
+	}
+	index, err := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     MediaTypeOCIIndex,
+		"manifests":     []Descriptor{rootDesc},
+	})
+	if err != nil {
+		return err
+	}
+	return writeTarFile(tw, "index.json", index)
+}
+
+// writeDockerManifest adds the manifest.json used by docker load. The layer and config paths
+// point into the OCI layout blobs, as in tarballs produced by recent docker save versions.
+func writeDockerManifest(tw *tar.Writer, repo, reference string, image *fetchedManifest) error {
+	entry := map[string]interface{}{
+		"Config": blobPath(image.Config.Digest),
+	}
+	if !strings.HasPrefix(reference, "sha256:") {
+		entry["RepoTags"] = []string{repo + ":" + reference}
+	}
+
+	layers := make([]string, 0, len(image.Layers))
+	for _, layer := range image.Layers {
+		layers = append(layers, blobPath(layer.Digest))
+	}
+	entry["Layers"] = layers
+
+	manifest, err := json.Marshal([]interface{}{entry})
+	if err != nil {
+		return err
+	}
+	return writeTarFile(tw, "manifest.json", manifest)
+}
+
+// writeManifestTree writes a manifest and, recursively, its child manifests, config and layers
+func (p *ProxyServer) writeManifestTree(ctx context.Context, tw *tar.Writer, up *upstream, repo string, fetched *fetchedManifest, written map[string]bool) error {
+	if !written[fetched.Descriptor.Digest] {
+		if err := writeTarFile(tw, blobPath(fetched.Descriptor.Digest), fetched.Raw); err != nil {
+			return err
+		}
+		written[fetched.Descriptor.Digest] = true
+	}
+
+	if fetched.IsIndex() {
+		for _, child := range fetched.Manifests {
+			childManifest, err := p.fetchManifest(ctx, up, repo, child.Digest)
+			if err != nil {
+				return err
+			}
+			if err := p.writeManifestTree(ctx, tw, up, repo, childManifest, written); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, desc := range append([]Descriptor{fetched.Config}, fetched.Layers...) {
+		if written[desc.Digest] {
+			continue
+		}
+		if err := p.writeBlob(ctx, tw, up, repo, desc, blobPath(desc.Digest)); err != nil {
+			return err
+		}
+		written[desc.Digest] = true
+	}
+	return nil
+}
+
+// writeBlob streams a blob from the upstream registry into the tarball, verifying its digest
+func (p *ProxyServer) writeBlob(ctx context.Context, tw *tar.Writer, up *upstream, repo string, desc Descriptor, name string) error {
+	resp, err := p.fetch(ctx, up, http.MethodGet, fmt.Sprintf("/%s/blobs/%s", repo, desc.Digest), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: desc.Size, ModTime: time.Unix(0, 0)}); err != nil {
+		return err
+	}
+
+	hasher := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tw, hasher), io.LimitReader(resp.Body, desc.Size))
+	if err != nil {
+		return fmt.Errorf("failed to copy blob %s: %v", desc.Digest, err)
+	}
+	if n != desc.Size {
+		return fmt.Errorf("blob %s is %d bytes, manifest says %d", desc.Digest, n, desc.Size)
+	}
+	if digest := "sha256:" + hex.EncodeToString(hasher.Sum(nil)); digest != desc.Digest {
+		return fmt.Errorf("blob digest mismatch: expected %s, got %s", desc.Digest, digest)
+	}
+
+	return nil
+}
+
+// writeTarFile writes a regular file with fixed metadata so exports are reproducible
+func writeTarFile(tw *tar.Writer, name string, content []byte) error {
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), ModTime: time.Unix(0, 0)}); err != nil {
+		return err
+	}
+	_, err := tw.Write(content)
+	return err
+}
+
+// blobPath returns the OCI layout path for a digest
+func blobPath(digest string) string {
+	algorithm, encoded, _ := strings.Cut(digest, ":")
+	return path.Join("blobs", algorithm, encoded)
+}
+
+// exportFilename builds a download file name for an exported image
+func exportFilename(repo, reference, format string) string {
+	reference = strings.TrimPrefix(reference, "sha256:")
+	if len(reference) > 12 {
+		reference = reference[:12]
+	}
+	return fmt.Sprintf("%s-%s.%s.tar", path.Base(repo), reference, format)
+}
@@ -0,0 +1,186 @@
+package registry
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/patrickmn/go-cache"
+
+	"vault-docker-proxy/pkg/auth"
+	"vault-docker-proxy/pkg/logging"
+	"vault-docker-proxy/pkg/vault"
+)
+
+// GroupRule grants the members of a Vault identity group access to registries and repositories
+type GroupRule struct {
+	Group        string
+	Registries   []string // registry host globs
+	Repositories []string // repository globs, every repository when empty
+}
+
+// groupAccess holds the compiled group rules and the cached group memberships of Vault tokens
+type groupAccess struct {
+	rules  []compiledGroupRule
+	groups *cache.Cache
+}
+
+// compiledGroupRule is a GroupRule with its globs compiled
+type compiledGroupRule struct {
+	group        string
+	registries   []*regexp.Regexp
+	repositories []*regexp.Regexp
+}
+
+// SetGroupAccess restricts requests made with Vault tokens to the registries and repositories
+// granted to the token's identity groups. Group memberships are cached for ttl. It may be called
+// again while requests are served to replace the rules; nil rules disable group access.
+func (p *ProxyServer) SetGroupAccess(rules []GroupRule, ttl time.Duration) error {
+	if rules == nil {
+		p.groupAccess.Store(nil)
+		return nil
+	}
+
+	access := &groupAccess{groups: cache.New(ttl, 2*ttl)}
+	for _, rule := range rules {
+		compiled := compiledGroupRule{group: rule.Group}
+		for _, glob := range rule.Registries {
+			re, err := compileGlob(glob)
+			if err != nil {
+				return fmt.Errorf("group %s: invalid registry %q: %v", rule.Group, glob, err)
+			}
+			compiled.registries = append(compiled.registries, re)
+		}
+		for _, glob := range rule.Repositories {
+			re, err := compileGlob(glob)
+			if err != nil {
+				return fmt.Errorf("group %s: invalid repository %q: %v", rule.Group, glob, err)
+			}
+			compiled.repositories = append(compiled.repositories, re)
+		}
+		access.rules = append(access.rules, compiled)
+	}
+	p.groupAccess.Store(access)
+	return nil
+}
+
+// GroupAccessMiddleware rejects requests whose Vault token is not in a group granting the target
+// registry and repository. It must run after authentication. API key and Bearer requests carry
+// no Vault token of the caller and are not affected.
+func (p *ProxyServer) GroupAccessMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		access := p.groupAccess.Load()
+		authHeader, ok := auth.GetAuthFromContext(r.Context())
+		if access == nil || !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		registryConfig, err := auth.ParseUsername(authHeader.Username)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		vaultToken, err := p.resolveVaultToken(r.Context(), registryConfig, authHeader.Password)
+		if err != nil {
+			writeErrorResponse(w, "UNAUTHORIZED", err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		groups, err := p.tokenGroups(r, access, registryConfig, vaultToken)
+		if err != nil {
+			if errors.Is(err, vault.ErrInvalidToken) {
+				writeErrorResponse(w, "UNAUTHORIZED", err.Error(), http.StatusUnauthorized)
+				return
+			}
+			writeErrorResponse(w, "UNAVAILABLE", err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
+		host := registryHost(registryConfig.RegistryURL)
+		repository := repositoryOf(r)
+		if !access.allows(groups, host, repository) {
+			target := host
+			if repository != "" {
+				target += "/" + repository
+			}
+			logging.FromContext(r.Context()).Warn("Group access denied", "target", target, "groups", groups)
+			writeErrorResponse(w, "DENIED", fmt.Sprintf("access to %s is not granted to the Vault identity groups of this token", target), http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// tokenGroups returns the identity group names of a Vault token in the namespace of the registry
+// configuration, using the membership cache
+func (p *ProxyServer) tokenGroups(r *http.Request, access *groupAccess, registryConfig *auth.RegistryConfig, vaultToken string) ([]string, error) {
+	key := fmt.Sprintf("%x", sha256.Sum256([]byte(registryConfig.Namespace+":"+vaultToken)))
+	if groups, found := access.groups.Get(key); found {
+		return groups.([]string), nil
+	}
+
+	groups, err := p.vaultClient.TokenGroups(vault.WithNamespace(r.Context(), registryConfig.Namespace), vaultToken)
+	if err != nil {
+		return nil, err
+	}
+	access.groups.SetDefault(key, groups)
+	return groups, nil
+}
+
+// allows reports whether any of groups grants access to the registry and repository. An empty
+// repository (catalog and search requests) only needs access to the registry.
+func (a *groupAccess) allows(groups []string, registryHost, repository string) bool {
+	for _, rule := range a.rules {
+		if !containsString(groups, rule.group) || !matchesAny(rule.registries, registryHost) {
+			continue
+		}
+		if repository == "" || len(rule.repositories) == 0 || matchesAny(rule.repositories, repository) {
+			return true
+		}
+	}
+	return false
+}
+
+// repositoryOf returns the repository targeted by a registry or extension request
+func repositoryOf(r *http.Request) string {
+	vars := mux.Vars(r)
+	if name, ok := vars["name"]; ok {
+		return name
+	}
+	if image, ok := vars["image"]; ok {
+		repo, _ := parseImageReference(image)
+		return repo
+	}
+	return ""
+}
+
+// compileGlob compiles a glob in the syntax used by search filters into an anchored regexp
+func compileGlob(glob string) (*regexp.Regexp, error) {
+	return regexp.Compile("^" + globToRegexp(glob) + "$")
+}
+
+// matchesAny reports whether value matches one of patterns
+func matchesAny(patterns []*regexp.Regexp, value string) bool {
+	for _, re := range patterns {
+		if re.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// containsString reports whether values contains s
+func containsString(values []string, s string) bool {
+	for _, value := range values {
+		if value == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,180 @@
+package registry
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"vault-docker-proxy/pkg/auth"
+	"vault-docker-proxy/pkg/logging"
+)
+
+// sensitiveRequestHeaders carry client authentication material and are never forwarded upstream
+var sensitiveRequestHeaders = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"Cookie",
+	auth.APIKeyHeader,
+	"X-Registry-Authorization",
+	"X-Vault-Token",
+}
+
+// hopByHopHeaders only apply to a single connection and are not forwarded in either direction
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Proxy-Authenticate",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// maxRedactedBodySize bounds the upstream error bodies scanned for echoed credentials
+const maxRedactedBodySize = 64 * 1024
+
+// copyRequestHeaders copies client headers to an upstream request, dropping authentication
+// material and hop-by-hop headers. The caller sets the upstream Authorization itself.
+func copyRequestHeaders(dst, src http.Header) {
+	for name, values := range src {
+		if isSensitiveHeader(name) || isHopByHop(name, src) {
+			continue
+		}
+		dst[name] = values
+	}
+}
+
+// copyResponseHeaders copies upstream response headers to the client, dropping hop-by-hop
+// headers, cookies set by the upstream, the upstream's request ID (the proxy's own is returned)
+// and any header echoing the Authorization value sent upstream
+func copyResponseHeaders(dst, src http.Header, authorization string) {
+	for name, values := range src {
+		if isHopByHop(name, src) || http.CanonicalHeaderKey(name) == "Set-Cookie" || http.CanonicalHeaderKey(name) == logging.RequestIDHeader {
+			continue
+		}
+		if authorization != "" && containsSecret(values, authorization) {
+			continue
+		}
+		dst[name] = values
+	}
+}
+
+// writeUpstreamBody streams an upstream response body to the client. Error bodies are small, so
+// they are buffered and any echo of the Authorization value sent upstream is redacted.
+func (p *ProxyServer) writeUpstreamBody(w http.ResponseWriter, resp *http.Response, authorization string) error {
+	if authorization == "" || resp.StatusCode < 400 {
+		return p.streamBody(w, resp.StatusCode, resp.Body)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxRedactedBodySize))
+	if err != nil {
+		return err
+	}
+	for _, secret := range authorizationSecrets(authorization) {
+		body = bytes.ReplaceAll(body, []byte(secret), []byte("[redacted]"))
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(resp.StatusCode)
+	_, err = w.Write(body)
+	return err
+}
+
+// authorizationSecrets returns the forms in which an Authorization value may be echoed: the
+// whole value and its credentials part
+func authorizationSecrets(authorization string) []string {
+	secrets := []string{authorization}
+	if _, credentials, ok := strings.Cut(authorization, " "); ok && credentials != "" {
+		secrets = append(secrets, credentials)
+	}
+	return secrets
+}
+
+// containsSecret reports whether any header value contains the Authorization value or its
+// credentials part
+func containsSecret(values []string, authorization string) bool {
+	for _, value := range values {
+		for _, secret := range authorizationSecrets(authorization) {
+			if strings.Contains(value, secret) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isSensitiveHeader reports whether a request header carries client authentication material
+func isSensitiveHeader(name string) bool {
+	for _, sensitive := range sensitiveRequestHeaders {
+		if strings.EqualFold(name, sensitive) {
+			return true
+		}
+	}
+	return false
+}
+
+// isHopByHop reports whether a header is hop-by-hop, including headers listed in Connection
+func isHopByHop(name string, header http.Header) bool {
+	for _, hop := range hopByHopHeaders {
+		if strings.EqualFold(name, hop) {
+			return true
+		}
+	}
+	for _, value := range header.Values("Connection") {
+		for _, listed := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(listed), name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// linkTargetPattern matches the target URLs of an RFC 8288 Link header
+var linkTargetPattern = regexp.MustCompile(`<([^>]*)>`)
+
+// rewriteLinks points the Link header targets on the registry's own host, such as the next page
+// of a catalog or tag list, at the proxy, keeping their n and last parameters
+func rewriteLinks(header http.Header, registryURL string) {
+	links := header.Values("Link")
+	if len(links) == 0 {
+		return
+	}
+	rewritten := make([]string, len(links))
+	for i, link := range links {
+		rewritten[i] = linkTargetPattern.ReplaceAllStringFunc(link, func(target string) string {
+			return "<" + proxyLocation(target[1:len(target)-1], registryURL) + ">"
+		})
+	}
+	header["Link"] = rewritten
+}
+
+// proxyLocation rewrites an upstream Location under the registry's /v2 API into the same path and
+// query on the proxy, as a path relative to the proxy's own host. Locations elsewhere, such as a
+// storage backend on another host, are returned unchanged and reached by the client directly.
+func proxyLocation(location, registryURL string) string {
+	base, err := url.Parse(registryURL + "/v2/")
+	if err != nil {
+		return location
+	}
+	target, err := base.Parse(location)
+	// The scheme is not compared: registries behind TLS-terminating load balancers often return
+	// http:// locations on their own host
+	if err != nil || !strings.EqualFold(target.Host, base.Host) {
+		return location
+	}
+	apiPath := strings.TrimSuffix(base.EscapedPath(), "/")
+	if !strings.HasPrefix(target.EscapedPath(), apiPath+"/") {
+		return location
+	}
+
+	rewritten := "/v2" + strings.TrimPrefix(target.EscapedPath(), apiPath)
+	if target.RawQuery != "" {
+		rewritten += "?" + target.RawQuery
+	}
+	return rewritten
+}
@@ -0,0 +1,64 @@
+package registry
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"vault-docker-proxy/pkg/auth"
+	"vault-docker-proxy/pkg/imagepolicy"
+	"vault-docker-proxy/pkg/logging"
+)
+
+// SetImagePolicy makes pulls of images denied by the image policy fail with a DENIED error. The
+// policy is read from the reloader on every request, so reloads apply right away.
+func (p *ProxyServer) SetImagePolicy(policy *imagepolicy.Reloader) {
+	p.imagePolicy = policy
+}
+
+// ImagePolicyMiddleware rejects pulls of images the image policy denies. It must run after
+// authentication.
+func (p *ProxyServer) ImagePolicyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := requestRegistry(r)
+		repository := repositoryOf(r)
+		if p.imagePolicy == nil || host == "" || repository == "" || auth.RequestAction(r) != auth.ActionPull {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		tag := requestTag(r)
+		decision := p.imagePolicy.Policy().Evaluate(host, repository, tag)
+		if !decision.Allowed {
+			image := host + "/" + repository
+			if tag != "" {
+				image += ":" + tag
+			}
+			message := fmt.Sprintf("image %s is denied by image policy rule %s", image, decision.Rule)
+			if decision.Rule == "" {
+				message = fmt.Sprintf("image %s is not allowed by the image policy", image)
+			}
+			logging.FromContext(r.Context()).Warn("Image policy denied", "method", r.Method, "path", r.URL.Path, "image", image, "rule", decision.Rule)
+			writeErrorResponse(w, "DENIED", message, http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requestTag returns the tag a request names, empty for digests and requests without a
+// reference such as blob pulls
+func requestTag(r *http.Request) string {
+	vars := mux.Vars(r)
+	reference := vars["reference"]
+	if image, ok := vars["image"]; ok {
+		_, reference = parseImageReference(image)
+	}
+	if strings.Contains(reference, ":") {
+		return ""
+	}
+	return reference
+}
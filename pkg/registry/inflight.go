@@ -0,0 +1,129 @@
+package registry
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"sync"
+
+	"vault-docker-proxy/pkg/auth"
+	"vault-docker-proxy/pkg/logging"
+)
+
+// vaultReads collapses concurrent Vault reads of the same secret with the same token, so a burst
+// of cache misses (cold start, rollout) results in a single read shared by every caller. The zero
+// value is ready to use.
+type vaultReads struct {
+	mu    sync.Mutex
+	calls map[string]*vaultRead
+}
+
+// vaultRead is a Vault read in flight. The credentials read are shared: each caller takes its own
+// copy and the last one wipes the original.
+type vaultRead struct {
+	done        chan struct{}
+	credentials *auth.Credentials
+	err         error
+	callers     int // callers that have not taken their copy yet
+
+	// The lease of credentials that were not cached is revoked once every caller wiped its copy
+	revokeLease func()
+	leaseUsers  int
+}
+
+// readCredentialsShared reads credentials from Vault and caches them, joining a read of the same
+// secret already in flight instead of issuing another one. The caller owns the returned copy and
+// must wipe it: the lease of credentials that could not be cached is revoked once every caller
+// has.
+func (p *ProxyServer) readCredentialsShared(ctx context.Context, registryConfig *auth.RegistryConfig, vaultToken string) (*auth.Credentials, error) {
+	key := vaultReadKey(vaultToken, registryConfig)
+	if err, found := p.recentFailure(key, registryConfig); found {
+		return nil, err
+	}
+
+	p.vaultReads.mu.Lock()
+	if p.vaultReads.calls == nil {
+		p.vaultReads.calls = make(map[string]*vaultRead)
+	}
+	if call, ok := p.vaultReads.calls[key]; ok {
+		call.callers++
+		p.vaultReads.mu.Unlock()
+		p.counters.vaultReadsShared.Add(1)
+		logging.FromContext(ctx).Debug("Joining Vault read in flight")
+		select {
+		case <-call.done:
+			return p.vaultReads.take(call)
+		case <-ctx.Done():
+			// The copy is not needed anymore but must still be taken so the original is wiped, and
+			// wiped so an uncached lease is revoked
+			go func() {
+				credentials, _ := p.vaultReads.take(call)
+				credentials.Wipe()
+			}()
+			return nil, ctx.Err()
+		}
+	}
+	call := &vaultRead{done: make(chan struct{}), callers: 1}
+	p.vaultReads.calls[key] = call
+	p.vaultReads.mu.Unlock()
+
+	// The read is shared, so it must not fail because the request that started it went away
+	p.counters.vaultCalls.Add(1)
+	call.credentials, call.err = p.readCredentials(context.WithoutCancel(ctx), registryConfig, vaultToken)
+	if call.err != nil {
+		p.counters.vaultErrors.Add(1)
+		p.rememberFailure(key, registryConfig, call.err)
+	} else if lease := call.credentials.Lease; !p.cacheCredentials(vaultToken, registryConfig, call.credentials) && lease != nil {
+		call.revokeLease = func() {
+			p.revokeUncachedLease(&auth.Credentials{Lease: lease}, registryConfig, vaultToken)
+		}
+	}
+
+	p.vaultReads.mu.Lock()
+	delete(p.vaultReads.calls, key)
+	// No caller joins anymore, so every user of the lease is known
+	call.leaseUsers = call.callers
+	p.vaultReads.mu.Unlock()
+	close(call.done)
+
+	return p.vaultReads.take(call)
+}
+
+// take returns a copy of the credentials of a completed read, wiping the shared original once
+// every caller has taken its copy
+func (v *vaultReads) take(call *vaultRead) (*auth.Credentials, error) {
+	<-call.done
+	if call.err != nil {
+		return nil, call.err
+	}
+
+	credentials := call.credentials.Clone()
+	if call.revokeLease != nil {
+		credentials.SetRelease(func() { v.releaseLease(call) })
+	}
+	v.mu.Lock()
+	call.callers--
+	last := call.callers == 0
+	v.mu.Unlock()
+	if last {
+		call.credentials.Wipe()
+	}
+	return credentials, nil
+}
+
+// releaseLease records that a caller is done with the credentials of an uncached read, revoking
+// their lease after the last one
+func (v *vaultReads) releaseLease(call *vaultRead) {
+	v.mu.Lock()
+	call.leaseUsers--
+	last := call.leaseUsers == 0
+	v.mu.Unlock()
+	if last {
+		call.revokeLease()
+	}
+}
+
+// vaultReadKey identifies a Vault read by token, secret path and how the secret is decoded
+func vaultReadKey(vaultToken string, registryConfig *auth.RegistryConfig) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(vaultToken+":"+registryConfig.SecretPath()+":"+registryConfig.Type+":"+registryConfig.RegistryURL)))
+}
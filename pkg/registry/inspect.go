@@ -0,0 +1,157 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"vault-docker-proxy/pkg/admin"
+)
+
+// maxConfigSize bounds image config blobs read into memory
+const maxConfigSize = 4 * 1024 * 1024
+
+// ImageInspection is the summary returned by GET /ext/inspect
+type ImageInspection struct {
+	Name      string               `json:"name"`
+	Reference string               `json:"reference"`
+	Digest    string               `json:"digest"`
+	MediaType string               `json:"media_type"`
+	Platforms []PlatformInspection `json:"platforms"`
+}
+
+// PlatformInspection summarizes a single-platform image manifest and its config
+type PlatformInspection struct {
+	Platform  string            `json:"platform"`
+	Digest    string            `json:"digest"`
+	Created   *time.Time        `json:"created,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Layers    []LayerInspection `json:"layers"`
+	TotalSize int64             `json:"total_size"`
+}
+
+// LayerInspection describes one layer of an image
+type LayerInspection struct {
+	Digest    string `json:"digest"`
+	MediaType string `json:"media_type"`
+	Size      int64  `json:"size"`
+}
+
+// imageConfig holds the image config fields reported by the inspection endpoint
+type imageConfig struct {
+	Created      *time.Time `json:"created"`
+	Architecture string     `json:"architecture"`
+	OS           string     `json:"os"`
+	Variant      string     `json:"variant"`
+	Config       struct {
+		Labels map[string]string `json:"Labels"`
+	} `json:"config"`
+}
+
+// InspectImage handles GET /ext/inspect/{name}:{ref} - summarize an image as JSON, including
+// every platform of a multi-platform image. Sizes are compressed sizes as stored in the registry.
+func (p *ProxyServer) InspectImage(w http.ResponseWriter, r *http.Request) {
+	repo, reference := parseImageReference(mux.Vars(r)["image"])
+
+	up, err := p.resolveUpstream(r)
+	if err != nil {
+		writeErrorResponse(w, "UNAUTHORIZED", err.Error(), http.StatusUnauthorized)
+		return
+	}
+	defer up.release()
+
+	root, err := p.fetchManifest(r.Context(), up, repo, reference)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	inspection := ImageInspection{
+		Name:      repo,
+		Reference: reference,
+		Digest:    root.Descriptor.Digest,
+		MediaType: root.Descriptor.MediaType,
+		Platforms: []PlatformInspection{},
+	}
+
+	if !root.IsIndex() {
+		platform, err := p.inspectManifest(r.Context(), up, repo, root)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		inspection.Platforms = append(inspection.Platforms, *platform)
+		admin.WriteJSON(w, http.StatusOK, inspection)
+		return
+	}
+
+	for _, desc := range root.Manifests {
+		if desc.Platform != nil && desc.Platform.OS == "unknown" {
+			// Attestation manifests attached by BuildKit are not runnable platforms
+			continue
+		}
+		child, err := p.fetchManifest(r.Context(), up, repo, desc.Digest)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		platform, err := p.inspectManifest(r.Context(), up, repo, child)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if desc.Platform != nil {
+			platform.Platform = desc.Platform.String()
+		}
+		inspection.Platforms = append(inspection.Platforms, *platform)
+	}
+
+	admin.WriteJSON(w, http.StatusOK, inspection)
+}
+
+// inspectManifest summarizes a single-platform manifest, reading its config blob
+func (p *ProxyServer) inspectManifest(ctx context.Context, up *upstream, repo string, m *fetchedManifest) (*PlatformInspection, error) {
+	config, err := p.fetchImageConfig(ctx, up, repo, m.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	platform := Platform{OS: config.OS, Architecture: config.Architecture, Variant: config.Variant}
+	inspection := &PlatformInspection{
+		Platform:  platform.String(),
+		Digest:    m.Descriptor.Digest,
+		Created:   config.Created,
+		Labels:    config.Config.Labels,
+		Layers:    make([]LayerInspection, 0, len(m.Layers)),
+		TotalSize: m.Config.Size,
+	}
+	for _, layer := range m.Layers {
+		inspection.Layers = append(inspection.Layers, LayerInspection{Digest: layer.Digest, MediaType: layer.MediaType, Size: layer.Size})
+		inspection.TotalSize += layer.Size
+	}
+	return inspection, nil
+}
+
+// fetchImageConfig retrieves and decodes an image config blob
+func (p *ProxyServer) fetchImageConfig(ctx context.Context, up *upstream, repo string, desc Descriptor) (*imageConfig, error) {
+	if desc.Size > maxConfigSize {
+		return nil, fmt.Errorf("image config %s exceeds %d bytes", desc.Digest, maxConfigSize)
+	}
+
+	resp, err := p.fetch(ctx, up, http.MethodGet, fmt.Sprintf("/%s/blobs/%s", repo, desc.Digest), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var config imageConfig
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxConfigSize)).Decode(&config); err != nil {
+		return nil, fmt.Errorf("failed to decode image config %s: %v", desc.Digest, err)
+	}
+	return &config, nil
+}
@@ -0,0 +1,147 @@
+package registry
+
+import (
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"vault-docker-proxy/pkg/admin"
+	"vault-docker-proxy/pkg/auth"
+	"vault-docker-proxy/pkg/cache"
+)
+
+// RegistryUsage describes an upstream registry that clients have reached through the proxy.
+// Registries are not configured up front, they are named by the client usernames.
+type RegistryUsage struct {
+	Registry   string    `json:"registry"`
+	Types      []string  `json:"types"`
+	VaultPaths []string  `json:"vault_paths"`
+	Requests   uint64    `json:"requests"`
+	LastUsed   time.Time `json:"last_used"`
+}
+
+// Inventory is the body returned by GET /admin/inventory
+type Inventory struct {
+	Registries      []RegistryUsage   `json:"registries"`
+	Aliases         map[string]string `json:"aliases"`
+	UploadSessions  []UploadSession   `json:"upload_sessions"`
+	CredentialCache []cache.Entry     `json:"credential_cache"`
+}
+
+// registryTracker records which upstream registries are in use
+type registryTracker struct {
+	mu         sync.Mutex
+	registries map[string]*registryUsage
+}
+
+// registryUsage is the mutable state behind RegistryUsage
+type registryUsage struct {
+	types      map[string]bool
+	vaultPaths map[string]bool
+	requests   uint64
+	lastUsed   time.Time
+}
+
+// record notes a request to registryURL. registryType and vaultPath are empty for Bearer requests.
+func (t *registryTracker) record(registryURL, registryType, vaultPath string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.registries == nil {
+		t.registries = make(map[string]*registryUsage)
+	}
+	usage, ok := t.registries[registryURL]
+	if !ok {
+		usage = &registryUsage{types: make(map[string]bool), vaultPaths: make(map[string]bool)}
+		t.registries[registryURL] = usage
+	}
+	if registryType != "" {
+		usage.types[registryType] = true
+	}
+	if vaultPath != "" {
+		usage.vaultPaths[vaultPath] = true
+	}
+	usage.requests++
+	usage.lastUsed = time.Now()
+}
+
+// snapshot returns the tracked registries sorted by URL
+func (t *registryTracker) snapshot() []RegistryUsage {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	registries := make([]RegistryUsage, 0, len(t.registries))
+	for registryURL, usage := range t.registries {
+		registries = append(registries, RegistryUsage{
+			Registry:   registryURL,
+			Types:      sortedKeys(usage.types),
+			VaultPaths: sortedKeys(usage.vaultPaths),
+			Requests:   usage.requests,
+			LastUsed:   usage.lastUsed,
+		})
+	}
+	sort.Slice(registries, func(i, j int) bool { return registries[i].Registry < registries[j].Registry })
+	return registries
+}
+
+// InventoryHandler serves GET /admin/inventory: the upstream registries used since startup, the
+// configured registry aliases, the blob uploads in progress and the credential cache entries
+// (Vault paths and expiry only, never credentials or tokens)
+func (p *ProxyServer) InventoryHandler(w http.ResponseWriter, r *http.Request) {
+	admin.WriteJSON(w, http.StatusOK, p.Inventory())
+}
+
+// Inventory returns the upstream registries used since startup, the registry aliases, the blob
+// uploads in progress and the credential cache entries
+func (p *ProxyServer) Inventory() Inventory {
+	return Inventory{
+		Registries:      p.registries.snapshot(),
+		Aliases:         auth.RegistryAliases(),
+		UploadSessions:  p.uploads.snapshot(),
+		CredentialCache: p.cache.Entries(),
+	}
+}
+
+// InvalidateCredentials removes the cached credentials of a Vault path, given as
+// <namespace>:<vault_path> for clients in a namespace, or every cached credential when vaultPath
+// is empty, and returns how many entries were removed. Failed reads of the path are forgotten too.
+func (p *ProxyServer) InvalidateCredentials(vaultPath string) int {
+	p.forgetFailures(vaultPath)
+	if vaultPath == "" {
+		removed := len(p.cache.Entries())
+		p.cache.Clear()
+		return removed
+	}
+	return p.cache.DeletePath(vaultPath)
+}
+
+// InvalidateCacheHandler serves DELETE /admin/cache: ?path=<vault_path> removes the cached
+// credentials of a Vault path, and ?all=true every cached credential
+func (p *ProxyServer) InvalidateCacheHandler(w http.ResponseWriter, r *http.Request) {
+	vaultPath := r.URL.Query().Get("path")
+	all, _ := strconv.ParseBool(r.URL.Query().Get("all"))
+	if all == (vaultPath != "") {
+		admin.WriteError(w, "BAD_REQUEST", "set exactly one of path or all=true", http.StatusBadRequest)
+		return
+	}
+	removed := p.InvalidateCredentials(vaultPath)
+	if all {
+		slog.Info("Cleared the credential cache from the admin API", "removed", removed)
+	} else {
+		slog.Info("Invalidated cached credentials from the admin API", "vault_path", vaultPath, "removed", removed)
+	}
+	admin.WriteJSON(w, http.StatusOK, map[string]int{"removed": removed})
+}
+
+// sortedKeys returns the keys of a set in order
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
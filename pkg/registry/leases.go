@@ -0,0 +1,121 @@
+package registry
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"vault-docker-proxy/pkg/auth"
+	"vault-docker-proxy/pkg/vault"
+)
+
+// leaseRevokeTimeout bounds the revocation of a lease in the background
+const leaseRevokeTimeout = 10 * time.Second
+
+// leaseOwner is what renewing or revoking a lease takes: the Vault token that created it, kept
+// as a Secret and wiped once the lease is revoked, and its namespace
+type leaseOwner struct {
+	vaultToken *auth.Secret
+	namespace  string
+}
+
+// leaseTracker keeps the owners of the leases of cached dynamic credentials, so the leases are
+// revoked when the credentials leave the cache instead of outliving them in the secrets engine
+type leaseTracker struct {
+	mu     sync.Mutex
+	owners map[string]leaseOwner // by lease ID
+}
+
+// track records the owner of a lease
+func (t *leaseTracker) track(leaseID, vaultToken, namespace string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.owners == nil {
+		t.owners = make(map[string]leaseOwner)
+	}
+	if _, ok := t.owners[leaseID]; !ok {
+		t.owners[leaseID] = leaseOwner{vaultToken: auth.NewSecret([]byte(vaultToken)), namespace: namespace}
+	}
+}
+
+// release stops tracking a lease and returns its owner
+func (t *leaseTracker) release(leaseID string) (leaseOwner, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	owner, ok := t.owners[leaseID]
+	delete(t.owners, leaseID)
+	return owner, ok
+}
+
+// releaseLease revokes the lease of dynamic credentials leaving the credential cache. It is the
+// eviction function of the cache.
+func (p *ProxyServer) releaseLease(credentials *auth.Credentials) {
+	if credentials.Lease == nil {
+		return
+	}
+	if owner, ok := p.leases.release(credentials.Lease.ID); ok {
+		go p.revokeLease(credentials.Lease.ID, owner)
+	}
+}
+
+// revokeUncachedLease revokes the lease of dynamic credentials read for a single use
+func (p *ProxyServer) revokeUncachedLease(credentials *auth.Credentials, registryConfig *auth.RegistryConfig, vaultToken string) {
+	if credentials.Lease == nil {
+		return
+	}
+	go p.revokeLease(credentials.Lease.ID, leaseOwner{vaultToken: auth.NewSecret([]byte(vaultToken)), namespace: registryConfig.Namespace})
+}
+
+// revokeLease revokes a lease with the token of its owner
+func (p *ProxyServer) revokeLease(leaseID string, owner leaseOwner) {
+	defer owner.vaultToken.Wipe()
+	ctx, cancel := context.WithTimeout(vault.WithNamespace(context.Background(), owner.namespace), leaseRevokeTimeout)
+	defer cancel()
+
+	p.counters.vaultCalls.Add(1)
+	if err := p.vaultClient.RevokeLease(ctx, owner.vaultToken.Reveal(), leaseID); err != nil {
+		p.counters.vaultErrors.Add(1)
+		slog.Error("Failed to revoke lease", "lease_id", leaseID, "error", err)
+		return
+	}
+	slog.Info("Revoked lease", "lease_id", leaseID)
+}
+
+// renewLease renews the lease of cached dynamic credentials instead of reading them again,
+// reporting whether it did. Leases that cannot be renewed, or only for less than the refresh
+// margin because they reach their max TTL, are replaced by a new read.
+func (p *ProxyServer) renewLease(ctx context.Context, registryConfig *auth.RegistryConfig, vaultToken string) bool {
+	credentials, found := p.cache.Get(vaultToken, registryConfig.SecretPath())
+	if !found {
+		return false
+	}
+	defer credentials.Wipe()
+	if credentials.Lease == nil || !credentials.Lease.Renewable {
+		return false
+	}
+
+	p.counters.vaultCalls.Add(1)
+	lease, err := p.vaultClient.RenewLease(vault.WithNamespace(ctx, registryConfig.Namespace), vaultToken, credentials.Lease)
+	if err != nil {
+		p.counters.vaultErrors.Add(1)
+		slog.Warn("Failed to renew lease, reading it again", "lease_id", credentials.Lease.ID, "vault_path", registryConfig.VaultPath, "error", err)
+		return false
+	}
+	if lease.Duration <= p.refresher.before {
+		return false
+	}
+
+	credentials.Lease = lease
+	credentials.ExpiresAt = time.Now().Add(lease.Duration)
+	ttl := lease.Duration
+	if cacheTTL := p.credentialTTL(registryConfig); cacheTTL > 0 && cacheTTL < ttl {
+		ttl = cacheTTL
+	}
+	if !p.cache.Update(vaultToken, registryConfig.SecretPath(), credentials, ttl) {
+		return false
+	}
+	p.refresher.track(vaultToken, registryConfig, time.Now().Add(ttl))
+	slog.Info("Renewed lease", "lease_id", lease.ID, "vault_path", registryConfig.VaultPath, "expires_at", credentials.ExpiresAt.Format(time.RFC3339))
+	return true
+}
@@ -0,0 +1,25 @@
+package registry
+
+import (
+	"context"
+	"net/http"
+
+	"vault-docker-proxy/pkg/auth"
+	"vault-docker-proxy/pkg/logging"
+)
+
+// LoggingMiddleware logs the repository targeted by a registry or extension request with every
+// entry of the request
+func LoggingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if repo := repositoryOf(r); repo != "" {
+			logging.AddFields(r.Context(), "repo", repo)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// logRegistry logs the registry and Vault path of a request with its remaining entries
+func logRegistry(ctx context.Context, registryConfig *auth.RegistryConfig) {
+	logging.AddFields(ctx, "registry", registryConfig.RegistryURL, "vault_path", registryConfig.VaultPath)
+}
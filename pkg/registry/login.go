@@ -0,0 +1,56 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"vault-docker-proxy/pkg/audit"
+	"vault-docker-proxy/pkg/auth"
+	"vault-docker-proxy/pkg/logging"
+	"vault-docker-proxy/pkg/vault"
+)
+
+// SetLoginSecretCheck makes login validation also read the Vault secret, not just the token
+func (p *ProxyServer) SetLoginSecretCheck(enabled bool) {
+	p.loginSecretCheck = enabled
+}
+
+// ValidateLogin implements auth.LoginValidator. It verifies the Vault token with a self lookup
+// and, when enabled, that the token can read the configured secret. Successfully read
+// credentials are cached so the first pull does not hit Vault again.
+func (p *ProxyServer) ValidateLogin(ctx context.Context, registryConfig *auth.RegistryConfig, vaultToken string) error {
+	logRegistry(ctx, registryConfig)
+	vaultToken, err := p.resolveVaultToken(ctx, registryConfig, vaultToken)
+	if err != nil {
+		logging.FromContext(ctx).Warn("Login rejected", "error", err)
+		return err
+	}
+
+	if err := p.vaultClient.LookupToken(vault.WithNamespace(ctx, registryConfig.Namespace), vaultToken); err != nil {
+		logging.FromContext(ctx).Warn("Login rejected", "error", err)
+		if errors.Is(err, vault.ErrInvalidToken) {
+			return fmt.Errorf("Vault token was rejected by Vault (expired, revoked or malformed)")
+		}
+		return fmt.Errorf("Vault is unreachable, cannot validate token")
+	}
+
+	if !p.loginSecretCheck {
+		return nil
+	}
+	if cached, found := p.cache.Get(vaultToken, registryConfig.SecretPath()); found {
+		cached.Wipe()
+		return nil
+	}
+
+	credentials, err := p.readCredentialsShared(ctx, registryConfig, vaultToken)
+	if err != nil {
+		logging.FromContext(ctx).Warn("Login rejected, cannot read the Vault path", "error", err)
+		p.auditResolution(ctx, registryConfig, vaultToken, "", err)
+		return fmt.Errorf("Vault token cannot read registry credentials at %q (missing secret, permission denied or missing fields for registry type %s)", registryConfig.VaultPath, registryConfig.Type)
+	}
+
+	p.auditResolution(ctx, registryConfig, vaultToken, audit.OutcomeRead, nil)
+	credentials.Wipe()
+	return nil
+}
@@ -0,0 +1,91 @@
+package registry
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+
+	"vault-docker-proxy/pkg/admin"
+)
+
+// lookupConcurrency is the number of tags resolved in parallel by a reverse lookup
+const lookupConcurrency = 8
+
+// TagLookup is the body returned by GET /ext/lookup
+type TagLookup struct {
+	Name   string   `json:"name"`
+	Digest string   `json:"digest"`
+	Tags   []string `json:"tags"`
+}
+
+// LookupDigestTags handles GET /ext/lookup/{name}@{digest} - list the tags of a repository that
+// currently point at a manifest digest. Tag resolutions are cached with the other repository
+// metadata, so repeated lookups only resolve tags that are new or expired.
+func (p *ProxyServer) LookupDigestTags(w http.ResponseWriter, r *http.Request) {
+	repo, digest := parseImageReference(mux.Vars(r)["image"])
+	if !strings.HasPrefix(digest, "sha256:") {
+		writeErrorResponse(w, "BAD_REQUEST", "expected {name}@{digest}", http.StatusBadRequest)
+		return
+	}
+
+	up, err := p.resolveUpstream(r)
+	if err != nil {
+		writeErrorResponse(w, "UNAUTHORIZED", err.Error(), http.StatusUnauthorized)
+		return
+	}
+	defer up.release()
+
+	tags, err := p.listTags(r.Context(), up, repo)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		matches  = []string{}
+		firstErr error
+		next     = make(chan string)
+	)
+	for i := 0; i < lookupConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for tag := range next {
+				resolved, err := p.resolveTagDigest(r.Context(), up, repo, tag)
+
+				mu.Lock()
+				var upstreamErr *UpstreamError
+				switch {
+				case errors.As(err, &upstreamErr) && upstreamErr.StatusCode == http.StatusNotFound:
+					// Tag deleted since the listing was fetched
+				case err != nil:
+					if firstErr == nil {
+						firstErr = err
+					}
+				case resolved.Digest == digest:
+					matches = append(matches, tag)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, tag := range tags.Items {
+		next <- tag
+	}
+	close(next)
+	wg.Wait()
+
+	if firstErr != nil {
+		writeError(w, firstErr)
+		return
+	}
+
+	sort.Strings(matches)
+	admin.WriteJSON(w, http.StatusOK, TagLookup{Name: repo, Digest: digest, Tags: matches})
+}
@@ -0,0 +1,140 @@
+package registry
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Manifest media types understood by the extension endpoints
+const (
+	MediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	MediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	MediaTypeOCIManifest        = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeOCIIndex           = "application/vnd.oci.image.index.v1+json"
+)
+
+// manifestAccept is sent on manifest requests made by the proxy itself
+var manifestAccept = strings.Join([]string{
+	MediaTypeDockerManifest,
+	MediaTypeDockerManifestList,
+	MediaTypeOCIManifest,
+	MediaTypeOCIIndex,
+}, ", ")
+
+// maxManifestSize bounds manifest bodies read into memory
+const maxManifestSize = 4 * 1024 * 1024
+
+// Descriptor references content by digest, as used in manifests and indexes
+type Descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Platform    *Platform         `json:"platform,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// Platform describes the platform of a manifest in an index
+type Platform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// String formats the platform as os/arch[/variant]
+func (p *Platform) String() string {
+	s := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+	return s
+}
+
+// Manifest is the union of image manifests and indexes (manifest lists)
+type Manifest struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType,omitempty"`
+	Config        Descriptor   `json:"config"`
+	Layers        []Descriptor `json:"layers,omitempty"`
+	Manifests     []Descriptor `json:"manifests,omitempty"`
+}
+
+// IsIndex reports whether the manifest is an index or manifest list
+func (m *Manifest) IsIndex() bool {
+	return len(m.Manifests) > 0 || m.MediaType == MediaTypeOCIIndex || m.MediaType == MediaTypeDockerManifestList
+}
+
+// fetchedManifest is a manifest together with its raw bytes and content descriptor
+type fetchedManifest struct {
+	Manifest
+	Raw        []byte
+	Descriptor Descriptor
+}
+
+// fetchManifest retrieves and decodes a manifest by tag or digest
+func (p *ProxyServer) fetchManifest(ctx context.Context, up *upstream, repo, reference string) (*fetchedManifest, error) {
+	resp, err := p.fetch(ctx, up, http.MethodGet, fmt.Sprintf("/%s/manifests/%s", repo, reference), http.Header{"Accept": {manifestAccept}})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, maxManifestSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %v", err)
+	}
+	if len(raw) > maxManifestSize {
+		return nil, fmt.Errorf("manifest exceeds %d bytes", maxManifestSize)
+	}
+
+	fetched := &fetchedManifest{Raw: raw}
+	if err := json.Unmarshal(raw, &fetched.Manifest); err != nil {
+		return nil, fmt.Errorf("failed to decode manifest: %v", err)
+	}
+
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(raw))
+	if strings.HasPrefix(reference, "sha256:") && reference != digest {
+		return nil, fmt.Errorf("manifest digest mismatch: expected %s, got %s", reference, digest)
+	}
+
+	mediaType := fetched.MediaType
+	if mediaType == "" {
+		mediaType = strings.TrimSpace(strings.Split(resp.Header.Get("Content-Type"), ";")[0])
+	}
+	fetched.Descriptor = Descriptor{MediaType: mediaType, Digest: digest, Size: int64(len(raw))}
+
+	if !strings.HasPrefix(reference, "sha256:") {
+		p.rememberTagDigest(up, repo, reference, digest)
+	}
+
+	return fetched, nil
+}
+
+// selectPlatform returns the descriptor in an index matching platform (os/arch[/variant])
+func selectPlatform(index *Manifest, platform string) (*Descriptor, error) {
+	for i := range index.Manifests {
+		desc := &index.Manifests[i]
+		if desc.Platform == nil {
+			continue
+		}
+		if desc.Platform.String() == platform || (desc.Platform.Variant != "" && desc.Platform.OS+"/"+desc.Platform.Architecture == platform) {
+			return desc, nil
+		}
+	}
+	return nil, fmt.Errorf("no manifest for platform %s", platform)
+}
+
+// parseImageReference splits name:tag or name@digest, defaulting the tag to latest
+func parseImageReference(image string) (string, string) {
+	if i := strings.Index(image, "@"); i != -1 {
+		return image[:i], image[i+1:]
+	}
+	if i := strings.LastIndex(image, ":"); i != -1 && !strings.Contains(image[i:], "/") {
+		return image[:i], image[i+1:]
+	}
+	return image, "latest"
+}
@@ -0,0 +1,312 @@
+package registry
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"fmt"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+
+	"vault-docker-proxy/pkg/auth"
+	"vault-docker-proxy/pkg/logging"
+)
+
+const (
+	// manifestGrantTTL is how long a manifest access confirmed by the upstream registry lets the
+	// same registry credentials get the manifest from the cache without asking the registry again
+	manifestGrantTTL = time.Hour
+	// manifestTagRetention is how long an expired tag resolution is kept to be revalidated, rather
+	// than the tag being fetched again in full
+	manifestTagRetention = 24 * time.Hour
+)
+
+// manifestCache is the manifest cache. Manifests are immutable, so a manifest fetched by digest
+// is kept until it is the least recently used one and the cache outgrows its maximum size. Tags
+// are resolved to digests per registry credentials and Accept header; a resolution is used for
+// tagTTL, then revalidated with a HEAD request, so a tag that did not move is not fetched again.
+type manifestCache struct {
+	tagTTL  time.Duration
+	maxSize int64
+	tags    *cache.Cache // by view, tag and Accept header
+	grants  *cache.Cache
+
+	mu        sync.Mutex
+	manifests map[string]*list.Element // of *cachedManifest, by digest
+	lru       *list.List               // most recently used first
+	size      int64
+}
+
+// cachedManifest is a stored manifest
+type cachedManifest struct {
+	digest    string
+	mediaType string
+	raw       []byte
+}
+
+// cachedTag is a tag resolution, used without revalidation until validUntil
+type cachedTag struct {
+	digest     string
+	validUntil time.Time
+}
+
+// SetManifestCache enables the manifest cache: manifests pulled with credentials from Vault are
+// kept in memory, up to maxSize bytes, and tag resolutions are trusted for tagTTL before being
+// revalidated with the upstream registry
+func (p *ProxyServer) SetManifestCache(maxSize int64, tagTTL time.Duration) {
+	p.manifests = &manifestCache{
+		tagTTL:    tagTTL,
+		maxSize:   maxSize,
+		tags:      cache.New(manifestTagRetention, 10*time.Minute),
+		grants:    cache.New(manifestGrantTTL, 10*time.Minute),
+		manifests: make(map[string]*list.Element),
+		lru:       list.New(),
+	}
+}
+
+// get returns a stored manifest, recording the use
+func (c *manifestCache) get(digest string) (*cachedManifest, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.manifests[digest]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(element)
+	return element.Value.(*cachedManifest), true
+}
+
+// add stores a manifest, removing the least recently used ones beyond the maximum size
+func (c *manifestCache) add(manifest *cachedManifest) {
+	if int64(len(manifest.raw)) > c.maxSize {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.manifests[manifest.digest]; ok {
+		c.lru.MoveToFront(element)
+		return
+	}
+	c.manifests[manifest.digest] = c.lru.PushFront(manifest)
+	c.size += int64(len(manifest.raw))
+	for c.size > c.maxSize {
+		oldest := c.lru.Remove(c.lru.Back()).(*cachedManifest)
+		delete(c.manifests, oldest.digest)
+		c.size -= int64(len(oldest.raw))
+	}
+}
+
+// forgetTag drops every resolution of a tag seen through a view, after a push moved it
+func (c *manifestCache) forgetTag(view, tag string) {
+	prefix := view + "|tag:" + tag + "|"
+	for key := range c.tags.Items() {
+		if strings.HasPrefix(key, prefix) {
+			c.tags.Delete(key)
+		}
+	}
+}
+
+// pushed stores a manifest pushed through a view and drops the resolutions of the tag it was
+// pushed to, so the next pull of the tag sees it
+func (c *manifestCache) pushed(view, reference string, manifest *cachedManifest) {
+	c.add(manifest)
+	c.grants.SetDefault(view+"|"+manifest.digest, true)
+	if !isDigest(reference) {
+		c.forgetTag(view, reference)
+	}
+}
+
+// manifestView identifies a repository as seen through registry credentials. Tag resolutions
+// and grants are never shared between views, as other credentials may not see the repository.
+func manifestView(registryConfig *auth.RegistryConfig, repo string) string {
+	registryURL := providerFor(registryConfig).BaseURL(registryConfig.RegistryURL)
+	return strings.Join([]string{registryURL, registryConfig.Namespace, registryConfig.SecretPath(), repo}, "|")
+}
+
+// proxyManifest serves a manifest GET or HEAD from the manifest cache, filling the cache on a miss
+func (p *ProxyServer) proxyManifest(w http.ResponseWriter, r *http.Request, credentials *auth.Credentials, registryConfig *auth.RegistryConfig, path string) error {
+	i := strings.LastIndex(path, "/manifests/")
+	repo, reference := strings.TrimPrefix(path[:i], "/"), path[i+len("/manifests/"):]
+	view := manifestView(registryConfig, repo)
+	tagKey := view + "|tag:" + reference + "|" + acceptKey(r)
+
+	digest, revalidate := reference, false
+	if !isDigest(reference) {
+		digest = ""
+		if item, found := p.manifests.tags.Get(tagKey); found {
+			tag := item.(*cachedTag)
+			digest, revalidate = tag.digest, time.Now().After(tag.validUntil)
+		}
+	}
+
+	if digest != "" {
+		if manifest, ok := p.manifests.get(digest); ok && accepts(r, manifest.mediaType) {
+			grant := view + "|" + manifest.digest
+			_, granted := p.manifests.grants.Get(grant)
+			switch {
+			case revalidate:
+				// The registry is asked where the tag points now, which also confirms the access
+				digest = p.revalidateTag(r, credentials, registryConfig, path)
+				if digest == "" {
+					break
+				}
+				p.manifests.tags.SetDefault(tagKey, &cachedTag{digest: digest, validUntil: time.Now().Add(p.manifests.tagTTL)})
+				p.manifests.grants.SetDefault(view+"|"+digest, true)
+				if digest != manifest.digest {
+					if manifest, ok = p.manifests.get(digest); !ok || !accepts(r, manifest.mediaType) {
+						break
+					}
+				}
+				p.serveManifest(w, r, manifest, registryConfig, repo)
+				return nil
+			case granted || !isDigest(reference) || p.confirmAccess(r, credentials, registryConfig, path):
+				// A tag resolution was made with the same credentials, so it is a grant itself
+				p.manifests.grants.SetDefault(grant, true)
+				p.serveManifest(w, r, manifest, registryConfig, repo)
+				return nil
+			}
+		}
+	}
+
+	mw := &manifestCacheWriter{ResponseWriter: w, method: r.Method}
+	if err := p.proxyRequest(mw, r, credentials, registryConfig, path); err != nil {
+		return err
+	}
+	if mw.status != http.StatusOK {
+		return nil
+	}
+
+	upstreamDigest := mw.Header().Get("Docker-Content-Digest")
+	if r.Method == http.MethodGet && !mw.overflow && mw.Header().Get("Content-Encoding") == "" {
+		manifest := &cachedManifest{digest: fmt.Sprintf("sha256:%x", sha256.Sum256(mw.body.Bytes())), raw: bytes.Clone(mw.body.Bytes())}
+		manifest.mediaType, _, _ = mime.ParseMediaType(mw.Header().Get("Content-Type"))
+		if (upstreamDigest != "" && upstreamDigest != manifest.digest) || (isDigest(reference) && reference != manifest.digest) {
+			logging.FromContext(r.Context()).Warn("Not caching manifest, content does not match its digest", "reference", reference, "digest", manifest.digest)
+			return nil
+		}
+		p.manifests.add(manifest)
+		upstreamDigest = manifest.digest
+	}
+	if !isDigest(upstreamDigest) {
+		return nil
+	}
+	p.manifests.grants.SetDefault(view+"|"+upstreamDigest, true)
+	if !isDigest(reference) {
+		p.manifests.tags.SetDefault(tagKey, &cachedTag{digest: upstreamDigest, validUntil: time.Now().Add(p.manifests.tagTTL)})
+	}
+	return nil
+}
+
+// revalidateTag asks the upstream registry which manifest a tag points at, with the client's
+// Accept header; it returns an empty digest when the registry does not say
+func (p *ProxyServer) revalidateTag(r *http.Request, credentials *auth.Credentials, registryConfig *auth.RegistryConfig, path string) string {
+	header := http.Header{}
+	if accept := r.Header.Values("Accept"); len(accept) > 0 {
+		header["Accept"] = accept
+	}
+	resp, err := p.fetch(r.Context(), newUpstream(registryConfig, credentials), http.MethodHead, path, header)
+	if err != nil {
+		return ""
+	}
+	resp.Body.Close()
+	if digest := resp.Header.Get("Docker-Content-Digest"); isDigest(digest) {
+		return digest
+	}
+	// Some registries only report the digest as the ETag
+	if digest := strings.Trim(resp.Header.Get("Etag"), `"`); isDigest(digest) {
+		return digest
+	}
+	return ""
+}
+
+// serveManifest writes a cached manifest
+func (p *ProxyServer) serveManifest(w http.ResponseWriter, r *http.Request, manifest *cachedManifest, registryConfig *auth.RegistryConfig, repo string) {
+	logging.FromContext(r.Context()).Debug("Serving manifest from the cache", "digest", manifest.digest)
+	if manifest.mediaType != "" {
+		w.Header().Set("Content-Type", manifest.mediaType)
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(manifest.raw)))
+	w.Header().Set("Docker-Content-Digest", manifest.digest)
+	w.Header().Set("Etag", `"`+manifest.digest+`"`)
+	w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(manifest.raw))
+}
+
+// isDigest reports whether a manifest reference is a sha256 digest rather than a tag
+func isDigest(reference string) bool {
+	return strings.HasPrefix(reference, "sha256:") && len(reference) == len("sha256:")+sha256.Size*2
+}
+
+// acceptKey normalizes the media types a request accepts, as registries answer a tag with a
+// different manifest depending on them
+func acceptKey(r *http.Request) string {
+	var mediaTypes []string
+	for _, value := range r.Header.Values("Accept") {
+		for _, mediaRange := range strings.Split(value, ",") {
+			if mediaType, _, err := mime.ParseMediaType(mediaRange); err == nil {
+				mediaTypes = append(mediaTypes, mediaType)
+			}
+		}
+	}
+	sort.Strings(mediaTypes)
+	return strings.Join(mediaTypes, ",")
+}
+
+// accepts reports whether a request accepts a manifest media type; requests without an Accept
+// header take any
+func accepts(r *http.Request, mediaType string) bool {
+	key := acceptKey(r)
+	if key == "" {
+		return true
+	}
+	for _, accepted := range strings.Split(key, ",") {
+		if accepted == mediaType || accepted == "*/*" {
+			return true
+		}
+	}
+	return false
+}
+
+// manifestCacheWriter keeps a copy of a manifest while it is streamed to the client
+type manifestCacheWriter struct {
+	http.ResponseWriter
+	method   string
+	status   int
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (mw *manifestCacheWriter) WriteHeader(status int) {
+	if mw.status == 0 {
+		mw.status = status
+	}
+	mw.ResponseWriter.WriteHeader(status)
+}
+
+func (mw *manifestCacheWriter) Write(b []byte) (int, error) {
+	if mw.status == 0 {
+		mw.WriteHeader(http.StatusOK)
+	}
+	n, err := mw.ResponseWriter.Write(b)
+	if mw.status == http.StatusOK && mw.method == http.MethodGet && !mw.overflow {
+		if mw.body.Len()+n > maxManifestSize {
+			mw.overflow = true
+			mw.body = bytes.Buffer{}
+		} else {
+			mw.body.Write(b[:n])
+		}
+	}
+	return n, err
+}
+
+// Unwrap returns the underlying ResponseWriter, for http.ResponseController
+func (mw *manifestCacheWriter) Unwrap() http.ResponseWriter {
+	return mw.ResponseWriter
+}
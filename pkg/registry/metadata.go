@@ -0,0 +1,176 @@
+package registry
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+const (
+	// DefaultMetadataTTL is how long catalog and tag listings are reused before refetching
+	DefaultMetadataTTL = time.Minute
+	// maxListPages bounds the number of pages followed when listing a catalog or tags
+	maxListPages = 1000
+)
+
+// linkNextPattern extracts the next page URL from an RFC 5988 Link header
+var linkNextPattern = regexp.MustCompile(`<([^>]+)>\s*;\s*rel="?next"?`)
+
+// metadataListing is a cached repository list (Repository unset) or tag list
+type metadataListing struct {
+	Registry   string
+	Repository string
+	Items      []string
+	FetchedAt  time.Time
+}
+
+// tagDigest is a cached tag to manifest digest resolution
+type tagDigest struct {
+	Registry   string
+	Repository string
+	Tag        string
+	Digest     string
+	ResolvedAt time.Time
+}
+
+// metadataCache caches repository and tag listings per upstream registry and credential
+type metadataCache struct {
+	cache *cache.Cache
+}
+
+// newMetadataCache creates a metadata cache with the given TTL
+func newMetadataCache(ttl time.Duration) *metadataCache {
+	return &metadataCache{cache: cache.New(ttl, 2*ttl)}
+}
+
+// metadataKey identifies the view of a registry seen through an upstream's credentials.
+// Different credentials may see different repositories, so listings are never shared.
+func (up *upstream) metadataKey() string {
+	if up.registryConfig != nil {
+		return up.registryURL + "|" + up.registryConfig.SecretPath()
+	}
+	return fmt.Sprintf("%s|bearer:%x", up.registryURL, sha256.Sum256([]byte(up.bearerToken)))
+}
+
+// listRepositories returns every repository in the upstream catalog
+func (p *ProxyServer) listRepositories(ctx context.Context, up *upstream) (*metadataListing, error) {
+	return p.cachedListing(ctx, up, "", "/_catalog", "repositories")
+}
+
+// listTags returns every tag of a repository
+func (p *ProxyServer) listTags(ctx context.Context, up *upstream, repo string) (*metadataListing, error) {
+	return p.cachedListing(ctx, up, repo, fmt.Sprintf("/%s/tags/list", repo), "tags")
+}
+
+// cachedListing returns a listing from the metadata cache, fetching all pages on a miss
+func (p *ProxyServer) cachedListing(ctx context.Context, up *upstream, repo, targetPath, field string) (*metadataListing, error) {
+	key := up.metadataKey() + "|catalog"
+	if repo != "" {
+		key = up.metadataKey() + "|tags:" + repo
+	}
+	if item, found := p.metadata.cache.Get(key); found {
+		return item.(*metadataListing), nil
+	}
+
+	items, err := p.fetchListing(ctx, up, targetPath, field)
+	if err != nil {
+		return nil, err
+	}
+
+	listing := &metadataListing{Registry: up.registryURL, Repository: repo, Items: items, FetchedAt: time.Now()}
+	p.metadata.cache.Set(key, listing, cache.DefaultExpiration)
+	return listing, nil
+}
+
+// fetchListing reads a paginated catalog or tags list, following Link headers
+func (p *ProxyServer) fetchListing(ctx context.Context, up *upstream, targetPath, field string) ([]string, error) {
+	base, err := url.Parse(up.registryURL + "/")
+	if err != nil {
+		return nil, err
+	}
+
+	var items []string
+	next := up.registryURL + "/v2" + targetPath
+	for page := 0; next != "" && page < maxListPages; page++ {
+		resp, err := p.send(ctx, up, http.MethodGet, next, nil, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		var body map[string]json.RawMessage
+		err = json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode %s: %v", targetPath, err)
+		}
+
+		var pageItems []string
+		if raw, ok := body[field]; ok && string(raw) != "null" {
+			if err := json.Unmarshal(raw, &pageItems); err != nil {
+				return nil, fmt.Errorf("failed to decode %s: %v", targetPath, err)
+			}
+		}
+		items = append(items, pageItems...)
+
+		next = ""
+		if match := linkNextPattern.FindStringSubmatch(resp.Header.Get("Link")); match != nil {
+			nextURL, err := base.Parse(match[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid Link header %q: %v", resp.Header.Get("Link"), err)
+			}
+			next = nextURL.String()
+		}
+	}
+
+	return items, nil
+}
+
+// tagDigestKey identifies a cached tag resolution
+func tagDigestKey(up *upstream, repo, tag string) string {
+	return up.metadataKey() + "|tag:" + repo + ":" + tag
+}
+
+// rememberTagDigest records the digest a tag was seen pointing at
+func (p *ProxyServer) rememberTagDigest(up *upstream, repo, tag, digest string) {
+	p.metadata.cache.Set(tagDigestKey(up, repo, tag), newTagDigest(up, repo, tag, digest), cache.DefaultExpiration)
+}
+
+// newTagDigest creates a tag resolution observed now
+func newTagDigest(up *upstream, repo, tag, digest string) *tagDigest {
+	return &tagDigest{Registry: up.registryURL, Repository: repo, Tag: tag, Digest: digest, ResolvedAt: time.Now()}
+}
+
+// resolveTagDigest returns the manifest digest a tag points at, from the cache or with a HEAD
+// request to the upstream
+func (p *ProxyServer) resolveTagDigest(ctx context.Context, up *upstream, repo, tag string) (*tagDigest, error) {
+	if item, found := p.metadata.cache.Get(tagDigestKey(up, repo, tag)); found {
+		return item.(*tagDigest), nil
+	}
+
+	resp, err := p.fetch(ctx, up, http.MethodHead, fmt.Sprintf("/%s/manifests/%s", repo, tag), http.Header{"Accept": {manifestAccept}})
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		// Not every registry reports the digest on HEAD, fall back to hashing the manifest
+		manifest, err := p.fetchManifest(ctx, up, repo, tag)
+		if err != nil {
+			return nil, err
+		}
+		digest = manifest.Descriptor.Digest
+	}
+
+	resolved := newTagDigest(up, repo, tag, digest)
+	p.metadata.cache.Set(tagDigestKey(up, repo, tag), resolved, cache.DefaultExpiration)
+	return resolved, nil
+}
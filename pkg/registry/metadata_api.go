@@ -0,0 +1,218 @@
+package registry
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"vault-docker-proxy/pkg/admin"
+)
+
+// Page sizes of the metadata API
+const (
+	DefaultMetadataPageSize = 100
+	MaxMetadataPageSize     = 1000
+)
+
+// MetadataRepository is a repository known from a cached catalog or tag listing
+type MetadataRepository struct {
+	Registry  string    `json:"registry"`
+	Name      string    `json:"name"`
+	Tags      int       `json:"tags"` // number of cached tags, 0 when the tags were not listed yet
+	FetchedAt time.Time `json:"fetched_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// MetadataTag is a cached tag, with the digest it points at when it has been resolved
+type MetadataTag struct {
+	Registry   string     `json:"registry"`
+	Repository string     `json:"repository"`
+	Tag        string     `json:"tag"`
+	Digest     string     `json:"digest,omitempty"`
+	FetchedAt  time.Time  `json:"fetched_at"`
+	ResolvedAt *time.Time `json:"resolved_at,omitempty"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+}
+
+// MetadataPage is a page of metadata API results. Next is the URL of the following page.
+type MetadataPage struct {
+	Items interface{} `json:"items"`
+	Next  string      `json:"next,omitempty"`
+}
+
+// MetadataRepositories handles GET /admin/metadata/repositories - list the repositories in the
+// metadata cache without contacting any upstream. Query parameters: registry to restrict the
+// results to one registry, and n and last for pagination as in the registry catalog API.
+func (p *ProxyServer) MetadataRepositories(w http.ResponseWriter, r *http.Request) {
+	registryFilter := metadataRegistryFilter(r)
+
+	repositories := make(map[string]*MetadataRepository)
+	entry := func(registry, name string, fetchedAt, expiresAt time.Time) *MetadataRepository {
+		key := registry + "/" + name
+		repo, ok := repositories[key]
+		if !ok {
+			repo = &MetadataRepository{Registry: registry, Name: name}
+			repositories[key] = repo
+		}
+		// Report the freshest view when several credentials listed the same repository
+		if fetchedAt.After(repo.FetchedAt) {
+			repo.FetchedAt, repo.ExpiresAt = fetchedAt, expiresAt
+		}
+		return repo
+	}
+
+	for _, item := range p.metadata.cache.Items() {
+		listing, ok := item.Object.(*metadataListing)
+		if !ok || (registryFilter != "" && listing.Registry != registryFilter) {
+			continue
+		}
+		expiresAt := time.Unix(0, item.Expiration)
+		if listing.Repository == "" {
+			for _, name := range listing.Items {
+				entry(listing.Registry, name, listing.FetchedAt, expiresAt)
+			}
+			continue
+		}
+		repo := entry(listing.Registry, listing.Repository, listing.FetchedAt, expiresAt)
+		if len(listing.Items) > repo.Tags {
+			repo.Tags = len(listing.Items)
+		}
+	}
+
+	keys := make([]string, 0, len(repositories))
+	for key := range repositories {
+		keys = append(keys, key)
+	}
+	page, next, err := paginateKeys(r, keys)
+	if err != nil {
+		writeErrorResponse(w, "PAGINATION_NUMBER_INVALID", err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	items := make([]*MetadataRepository, 0, len(page))
+	for _, key := range page {
+		items = append(items, repositories[key])
+	}
+	writeMetadataPage(w, items, next)
+}
+
+// MetadataTags handles GET /admin/metadata/tags - list cached tags and their resolved digests
+// without contacting any upstream. Query parameters: registry, repository, and n and last for
+// pagination.
+func (p *ProxyServer) MetadataTags(w http.ResponseWriter, r *http.Request) {
+	registryFilter := metadataRegistryFilter(r)
+	repositoryFilter := r.URL.Query().Get("repository")
+
+	tags := make(map[string]*MetadataTag)
+	entry := func(registry, repository, tag string) *MetadataTag {
+		key := registry + "/" + repository + ":" + tag
+		t, ok := tags[key]
+		if !ok {
+			t = &MetadataTag{Registry: registry, Repository: repository, Tag: tag}
+			tags[key] = t
+		}
+		return t
+	}
+	matches := func(registry, repository string) bool {
+		return (registryFilter == "" || registry == registryFilter) && (repositoryFilter == "" || repository == repositoryFilter)
+	}
+
+	items := p.metadata.cache.Items()
+	for _, item := range items {
+		listing, ok := item.Object.(*metadataListing)
+		if !ok || listing.Repository == "" || !matches(listing.Registry, listing.Repository) {
+			continue
+		}
+		for _, name := range listing.Items {
+			t := entry(listing.Registry, listing.Repository, name)
+			if listing.FetchedAt.After(t.FetchedAt) {
+				t.FetchedAt, t.ExpiresAt = listing.FetchedAt, time.Unix(0, item.Expiration)
+			}
+		}
+	}
+	for _, item := range items {
+		resolved, ok := item.Object.(*tagDigest)
+		if !ok || !matches(resolved.Registry, resolved.Repository) {
+			continue
+		}
+		t := entry(resolved.Registry, resolved.Repository, resolved.Tag)
+		if t.ResolvedAt == nil || resolved.ResolvedAt.After(*t.ResolvedAt) {
+			resolvedAt := resolved.ResolvedAt
+			t.Digest, t.ResolvedAt = resolved.Digest, &resolvedAt
+		}
+		if t.FetchedAt.IsZero() {
+			// Only seen through a manifest fetch, not in a tag listing
+			t.FetchedAt, t.ExpiresAt = resolved.ResolvedAt, time.Unix(0, item.Expiration)
+		}
+	}
+
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	page, next, err := paginateKeys(r, keys)
+	if err != nil {
+		writeErrorResponse(w, "PAGINATION_NUMBER_INVALID", err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result := make([]*MetadataTag, 0, len(page))
+	for _, key := range page {
+		result = append(result, tags[key])
+	}
+	writeMetadataPage(w, result, next)
+}
+
+// metadataRegistryFilter returns the normalized registry query parameter
+func metadataRegistryFilter(r *http.Request) string {
+	if registry := r.URL.Query().Get("registry"); registry != "" {
+		return registryBaseURL(registry)
+	}
+	return ""
+}
+
+// paginateKeys sorts keys and returns the page selected by the n and last query parameters,
+// along with the URL of the next page when there is one
+func paginateKeys(r *http.Request, keys []string) ([]string, string, error) {
+	query := r.URL.Query()
+
+	n := DefaultMetadataPageSize
+	if value := query.Get("n"); value != "" {
+		var err error
+		if n, err = strconv.Atoi(value); err != nil || n < 1 || n > MaxMetadataPageSize {
+			return nil, "", fmt.Errorf("n must be between 1 and %d", MaxMetadataPageSize)
+		}
+	}
+
+	sort.Strings(keys)
+	start := 0
+	if last := query.Get("last"); last != "" {
+		start = sort.SearchStrings(keys, last)
+		if start < len(keys) && keys[start] == last {
+			start++
+		}
+	}
+	if start >= len(keys) {
+		return nil, "", nil
+	}
+
+	end := start + n
+	if end >= len(keys) {
+		return keys[start:], "", nil
+	}
+
+	query.Set("n", strconv.Itoa(n))
+	query.Set("last", keys[end-1])
+	return keys[start:end], r.URL.Path + "?" + query.Encode(), nil
+}
+
+// writeMetadataPage writes a page of results, advertising the next page in a Link header as the
+// registry API does
+func writeMetadataPage(w http.ResponseWriter, items interface{}, next string) {
+	if next != "" {
+		w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, next))
+	}
+	admin.WriteJSON(w, http.StatusOK, MetadataPage{Items: items, Next: next})
+}
@@ -0,0 +1,73 @@
+package registry
+
+import (
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+
+	"vault-docker-proxy/pkg/auth"
+	"vault-docker-proxy/pkg/vault"
+)
+
+// failedReads remembers Vault reads that failed because the secret does not exist or the Vault
+// token may not read it, so clients retrying with a broken configuration do not read Vault on
+// every attempt. Other failures, such as Vault being unreachable, are not remembered.
+type failedReads struct {
+	reads *cache.Cache // of *failedRead, by Vault read key
+}
+
+// failedRead is a remembered failure with the secret path it was read from
+type failedRead struct {
+	err        error
+	secretPath string
+}
+
+// SetNegativeCache remembers failed Vault reads for ttl; zero disables it
+func (p *ProxyServer) SetNegativeCache(ttl time.Duration) {
+	if ttl <= 0 {
+		p.failedReads = nil
+		return
+	}
+	p.failedReads = &failedReads{reads: cache.New(ttl, max(ttl, time.Minute))}
+}
+
+// recentFailure returns the error of a Vault read with the same key that failed recently
+func (p *ProxyServer) recentFailure(key string, registryConfig *auth.RegistryConfig) (error, bool) {
+	if p.failedReads == nil {
+		return nil, false
+	}
+	item, found := p.failedReads.reads.Get(key)
+	if !found {
+		return nil, false
+	}
+	p.counters.negativeCacheHits.Add(1)
+	slog.Debug("Vault read failed recently, not reading it again yet", "vault_path", registryConfig.VaultPath)
+	return item.(*failedRead).err, true
+}
+
+// rememberFailure remembers the error of a Vault read if it is not expected to go away on retry
+func (p *ProxyServer) rememberFailure(key string, registryConfig *auth.RegistryConfig, err error) {
+	if p.failedReads == nil || !(errors.Is(err, vault.ErrSecretNotFound) || errors.Is(err, vault.ErrPermissionDenied)) {
+		return
+	}
+	p.failedReads.reads.SetDefault(key, &failedRead{err: err, secretPath: registryConfig.SecretPath()})
+}
+
+// forgetFailures forgets the failed reads of a secret path, or all of them when secretPath is
+// empty, so a secret fixed in Vault is read again right away
+func (p *ProxyServer) forgetFailures(secretPath string) {
+	if p.failedReads == nil {
+		return
+	}
+	if secretPath == "" {
+		p.failedReads.reads.Flush()
+		return
+	}
+	for key, item := range p.failedReads.reads.Items() {
+		if item.Object.(*failedRead).secretPath == secretPath {
+			p.failedReads.reads.Delete(key)
+		}
+	}
+}
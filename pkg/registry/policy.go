@@ -0,0 +1,315 @@
+package registry
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"vault-docker-proxy/pkg/auth"
+	"vault-docker-proxy/pkg/logging"
+)
+
+// AccessPolicy restricts requests to matching registries, repositories and actions to the given
+// time windows and source environments
+type AccessPolicy struct {
+	Name         string
+	Registries   []string     // registry host globs
+	Repositories []string     // repository globs, every repository when empty
+	Actions      []string     // pull, push or delete, every action when empty
+	Windows      []TimeWindow // allowed time windows, any time when empty
+	Environments []string     // allowed source environments, any source when empty
+}
+
+// TimeWindow is a daily time range on some days of the week. End may be before Start for
+// windows spanning midnight, which then belong to the day they start on.
+type TimeWindow struct {
+	Days     []time.Weekday // every day when empty
+	Start    time.Duration  // offset from midnight
+	End      time.Duration  // offset from midnight
+	Location *time.Location
+}
+
+// Environment labels requests coming from a set of networks
+type Environment struct {
+	Name     string
+	Networks []*net.IPNet
+}
+
+// accessPolicies holds the compiled access policies and environments
+type accessPolicies struct {
+	policies     []compiledPolicy
+	environments []Environment
+	now          func() time.Time
+}
+
+// compiledPolicy is an AccessPolicy with its globs compiled
+type compiledPolicy struct {
+	AccessPolicy
+	registries   []*regexp.Regexp
+	repositories []*regexp.Regexp
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// ParseTimeWindow builds a time window from day names (mon..sun), HH:MM start and end times and
+// an IANA time zone name (UTC when empty)
+func ParseTimeWindow(days []string, start, end, timezone string) (TimeWindow, error) {
+	window := TimeWindow{Location: time.UTC}
+	for _, day := range days {
+		weekday, ok := weekdays[strings.ToLower(day)]
+		if !ok {
+			return window, fmt.Errorf("unknown day %q, expected mon, tue, wed, thu, fri, sat or sun", day)
+		}
+		window.Days = append(window.Days, weekday)
+	}
+
+	var err error
+	if window.Start, err = parseClock(start); err != nil {
+		return window, fmt.Errorf("start: %v", err)
+	}
+	if window.End, err = parseClock(end); err != nil {
+		return window, fmt.Errorf("end: %v", err)
+	}
+	if window.Start == window.End {
+		return window, fmt.Errorf("start and end are both %s", start)
+	}
+
+	if timezone != "" {
+		if window.Location, err = time.LoadLocation(timezone); err != nil {
+			return window, fmt.Errorf("timezone: %v", err)
+		}
+	}
+	return window, nil
+}
+
+// parseClock parses an HH:MM time of day into an offset from midnight
+func parseClock(clock string) (time.Duration, error) {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", clock)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// ParseEnvironment builds an environment from CIDR networks; plain IP addresses match only
+// themselves
+func ParseEnvironment(name string, networks []string) (Environment, error) {
+	env := Environment{Name: name}
+	for _, network := range networks {
+		if !strings.Contains(network, "/") {
+			if ip := net.ParseIP(network); ip != nil && ip.To4() != nil {
+				network += "/32"
+			} else {
+				network += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(network)
+		if err != nil {
+			return env, fmt.Errorf("invalid network %q", network)
+		}
+		env.Networks = append(env.Networks, ipNet)
+	}
+	return env, nil
+}
+
+// Contains reports whether t falls within the window
+func (w TimeWindow) Contains(t time.Time) bool {
+	t = t.In(w.Location)
+	offset := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	day := t.Weekday()
+
+	inRange := offset >= w.Start && offset < w.End
+	if w.End < w.Start {
+		// Spans midnight: the early hours belong to the previous day's window
+		inRange = offset >= w.Start || offset < w.End
+		if offset < w.End {
+			day = (day + 6) % 7
+		}
+	}
+	if !inRange {
+		return false
+	}
+
+	if len(w.Days) == 0 {
+		return true
+	}
+	for _, allowed := range w.Days {
+		if allowed == day {
+			return true
+		}
+	}
+	return false
+}
+
+// SetAccessPolicies enables time-window and source-environment policies. They are evaluated in
+// addition to group access: a request must satisfy every policy matching it.
+func (p *ProxyServer) SetAccessPolicies(policies []AccessPolicy, environments []Environment) error {
+	known := make(map[string]bool, len(environments))
+	for _, env := range environments {
+		known[env.Name] = true
+	}
+
+	compiled := &accessPolicies{environments: environments, now: time.Now}
+	for _, policy := range policies {
+		c := compiledPolicy{AccessPolicy: policy}
+		for _, glob := range policy.Registries {
+			re, err := compileGlob(glob)
+			if err != nil {
+				return fmt.Errorf("policy %s: invalid registry %q: %v", policy.Name, glob, err)
+			}
+			c.registries = append(c.registries, re)
+		}
+		for _, glob := range policy.Repositories {
+			re, err := compileGlob(glob)
+			if err != nil {
+				return fmt.Errorf("policy %s: invalid repository %q: %v", policy.Name, glob, err)
+			}
+			c.repositories = append(c.repositories, re)
+		}
+		for _, env := range policy.Environments {
+			if !known[env] {
+				return fmt.Errorf("policy %s: unknown environment %q", policy.Name, env)
+			}
+		}
+		compiled.policies = append(compiled.policies, c)
+	}
+
+	p.policies = compiled
+	return nil
+}
+
+// AccessPolicyMiddleware rejects requests that match an access policy outside its time windows
+// or from outside its environments. It must run after authentication.
+func (p *ProxyServer) AccessPolicyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := requestRegistry(r)
+		if p.policies == nil || host == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		repository := repositoryOf(r)
+		action := auth.RequestAction(r)
+		if err := p.policies.check(host, repository, action, sourceIP(r)); err != nil {
+			logging.FromContext(r.Context()).Warn("Access policy denied", "method", r.Method, "path", r.URL.Path, "error", err)
+			writeErrorResponse(w, "DENIED", err.Error(), http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// check evaluates every policy matching the request
+func (a *accessPolicies) check(registryHost, repository, action string, ip net.IP) error {
+	now := a.now()
+	var labels []string
+	for _, policy := range a.policies {
+		if !policy.matches(registryHost, repository, action) {
+			continue
+		}
+
+		if len(policy.Windows) > 0 && !policy.inWindow(now) {
+			return fmt.Errorf("%s access is outside the time windows of policy %s", action, policy.Name)
+		}
+		if len(policy.Environments) > 0 {
+			if labels == nil {
+				labels = a.environmentsOf(ip)
+			}
+			if !containsAny(policy.Environments, labels) {
+				return fmt.Errorf("%s access is not allowed from this source by policy %s", action, policy.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// environmentsOf returns the names of the environments containing ip
+func (a *accessPolicies) environmentsOf(ip net.IP) []string {
+	labels := []string{}
+	if ip == nil {
+		return labels
+	}
+	for _, env := range a.environments {
+		for _, network := range env.Networks {
+			if network.Contains(ip) {
+				labels = append(labels, env.Name)
+				break
+			}
+		}
+	}
+	return labels
+}
+
+// matches reports whether the policy applies to the registry, repository and action. Catalog and
+// search requests have no repository and only match policies covering the whole registry.
+func (c *compiledPolicy) matches(registryHost, repository, action string) bool {
+	if !matchesAny(c.registries, registryHost) {
+		return false
+	}
+	if len(c.Actions) > 0 && !containsString(c.Actions, action) {
+		return false
+	}
+	if len(c.repositories) == 0 {
+		return true
+	}
+	return repository != "" && matchesAny(c.repositories, repository)
+}
+
+// inWindow reports whether t falls within one of the policy's time windows
+func (c *compiledPolicy) inWindow(t time.Time) bool {
+	for _, window := range c.Windows {
+		if window.Contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestRegistry returns the upstream registry host of an authenticated request
+func requestRegistry(r *http.Request) string {
+	registryURL := ""
+	if apiKey, ok := auth.GetAPIKeyFromContext(r.Context()); ok {
+		registryURL = apiKey.Registry.RegistryURL
+	} else if bearerAuth, ok := auth.GetBearerAuthFromContext(r.Context()); ok {
+		registryURL = bearerAuth.RegistryURL
+	} else if authHeader, ok := auth.GetAuthFromContext(r.Context()); ok {
+		if registryConfig, err := auth.ParseUsername(authHeader.Username); err == nil {
+			registryURL = registryConfig.RegistryURL
+		}
+	}
+	if registryURL == "" {
+		return ""
+	}
+	return registryHost(registryURL)
+}
+
+// registryHost returns a registry URL without its scheme and trailing slash
+func registryHost(registryURL string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(registryBaseURL(registryURL), "https://"), "http://")
+}
+
+// sourceIP returns the address of the client connection
+func sourceIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// containsAny reports whether values and candidates share an element
+func containsAny(values, candidates []string) bool {
+	for _, candidate := range candidates {
+		if containsString(values, candidate) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,222 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"vault-docker-proxy/pkg/admin"
+	"vault-docker-proxy/pkg/auth"
+)
+
+// UpstreamHealth is the last probe result of an upstream registry
+type UpstreamHealth struct {
+	Registry            string       `json:"registry"`
+	Healthy             bool         `json:"healthy"`
+	Anonymous           ProbeResult  `json:"anonymous"`               // GET /v2/ without credentials
+	Authenticated       *ProbeResult `json:"authenticated,omitempty"` // GET /v2/ with the credentials of a configured target
+	CheckedAt           time.Time    `json:"checked_at"`
+	LastHealthy         time.Time    `json:"last_healthy"`
+	ConsecutiveFailures int          `json:"consecutive_failures"`
+}
+
+// ProbeResult is the outcome of a single probe request
+type ProbeResult struct {
+	OK        bool    `json:"ok"`
+	Status    int     `json:"status,omitempty"`
+	LatencyMS float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// UpstreamStatus is the body returned by GET /admin/status
+type UpstreamStatus struct {
+	Upstreams []UpstreamHealth `json:"upstreams"`
+}
+
+// upstreamProber periodically checks the /v2/ endpoint of upstream registries
+type upstreamProber struct {
+	targets []auth.RegistryConfig
+	timeout time.Duration
+
+	mu      sync.Mutex
+	results map[string]*UpstreamHealth
+}
+
+// SetUpstreamProbe enables probing of upstream registries. Targets are probed with and without
+// credentials, the credentials being read with the proxy's own Vault token; registries reached by
+// clients are probed without credentials. Each probe request may take up to timeout. Run
+// RunUpstreamProbe to perform the probes.
+func (p *ProxyServer) SetUpstreamProbe(targets []auth.RegistryConfig, timeout time.Duration) {
+	p.prober = &upstreamProber{
+		targets: targets,
+		timeout: timeout,
+		results: make(map[string]*UpstreamHealth),
+	}
+}
+
+// RunUpstreamProbe probes the upstream registries every interval until ctx is cancelled
+func (p *ProxyServer) RunUpstreamProbe(ctx context.Context, interval time.Duration) {
+	p.probeUpstreams(ctx)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.probeUpstreams(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// probeUpstreams probes every configured and tracked registry concurrently
+func (p *ProxyServer) probeUpstreams(ctx context.Context) {
+	targets := make(map[string]*auth.RegistryConfig)
+	for _, usage := range p.registries.snapshot() {
+		targets[usage.Registry] = nil
+	}
+	for i := range p.prober.targets {
+		target := &p.prober.targets[i]
+		targets[providerFor(target).BaseURL(target.RegistryURL)] = target
+	}
+
+	var wg sync.WaitGroup
+	for registryURL, target := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.probeUpstream(ctx, registryURL, target)
+		}()
+	}
+	wg.Wait()
+}
+
+// probeUpstream probes a registry and records the result. target is nil for registries only
+// probed without credentials.
+func (p *ProxyServer) probeUpstream(ctx context.Context, registryURL string, target *auth.RegistryConfig) {
+	health := UpstreamHealth{Registry: registryURL, CheckedAt: time.Now()}
+
+	// Any registry API response, including 401, shows the registry is up
+	health.Anonymous = p.probe(ctx, &upstream{registryURL: registryURL}, func(status int) bool {
+		return status == http.StatusOK || status == http.StatusUnauthorized
+	})
+	health.Healthy = health.Anonymous.OK
+
+	if target != nil {
+		result := p.probeAuthenticated(ctx, registryURL, target)
+		health.Authenticated = &result
+		health.Healthy = health.Healthy && result.OK
+	}
+
+	p.prober.record(health)
+}
+
+// probeAuthenticated probes a registry with the credentials of a configured target
+func (p *ProxyServer) probeAuthenticated(ctx context.Context, registryURL string, target *auth.RegistryConfig) ProbeResult {
+	vaultToken := p.vaultClient.Token()
+	credentials, err := p.readCredentials(ctx, target, vaultToken)
+	if err != nil {
+		return ProbeResult{Error: fmt.Sprintf("failed to retrieve credentials from Vault: %v", err)}
+	}
+	defer p.revokeUncachedLease(credentials, target, vaultToken)
+	up := newUpstream(target, credentials)
+	defer up.release()
+
+	return p.probe(ctx, up, func(status int) bool {
+		return status >= 200 && status <= 299
+	})
+}
+
+// probe sends GET /v2/ to an upstream and measures the response time
+func (p *ProxyServer) probe(ctx context.Context, up *upstream, ok func(status int) bool) ProbeResult {
+	ctx, cancel := context.WithTimeout(ctx, p.prober.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, up.registryURL+"/v2/", nil)
+	if err != nil {
+		return ProbeResult{Error: err.Error()}
+	}
+	if up.credentials != nil {
+		up.provider.Authorize(req, up.credentials)
+	}
+
+	start := time.Now()
+	resp, err := p.httpClient.Do(req)
+	latency := float64(time.Since(start).Microseconds()) / 1000
+	if err != nil {
+		return ProbeResult{LatencyMS: latency, Error: err.Error()}
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	resp.Body.Close()
+
+	result := ProbeResult{OK: ok(resp.StatusCode), Status: resp.StatusCode, LatencyMS: latency}
+	if !result.OK {
+		result.Error = fmt.Sprintf("unexpected HTTP %d", resp.StatusCode)
+	}
+	return result
+}
+
+// record stores a probe result, logging changes of health
+func (pr *upstreamProber) record(health UpstreamHealth) {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	previous, seen := pr.results[health.Registry]
+	if seen {
+		health.LastHealthy = previous.LastHealthy
+		health.ConsecutiveFailures = previous.ConsecutiveFailures
+	}
+	if health.Healthy {
+		health.LastHealthy = health.CheckedAt
+		health.ConsecutiveFailures = 0
+	} else {
+		health.ConsecutiveFailures++
+	}
+
+	if !health.Healthy && (!seen || previous.Healthy) {
+		slog.Warn("Upstream registry is unhealthy", "registry", health.Registry, "problem", health.problem())
+	} else if health.Healthy && seen && !previous.Healthy {
+		slog.Info("Upstream registry is healthy again", "registry", health.Registry)
+	}
+	pr.results[health.Registry] = &health
+}
+
+// problem describes why a probe failed
+func (h *UpstreamHealth) problem() string {
+	if !h.Anonymous.OK {
+		return h.Anonymous.Error
+	}
+	if h.Authenticated != nil && !h.Authenticated.OK {
+		return "with credentials: " + h.Authenticated.Error
+	}
+	return ""
+}
+
+// UpstreamStatus returns the last probe results sorted by registry, or nothing when probing is
+// disabled
+func (p *ProxyServer) UpstreamStatus() UpstreamStatus {
+	status := UpstreamStatus{Upstreams: []UpstreamHealth{}}
+	if p.prober == nil {
+		return status
+	}
+
+	p.prober.mu.Lock()
+	defer p.prober.mu.Unlock()
+	for _, health := range p.prober.results {
+		status.Upstreams = append(status.Upstreams, *health)
+	}
+	sort.Slice(status.Upstreams, func(i, j int) bool { return status.Upstreams[i].Registry < status.Upstreams[j].Registry })
+	return status
+}
+
+// StatusHandler serves GET /admin/status: the availability and latency of the upstream
+// registries as last seen by the prober
+func (p *ProxyServer) StatusHandler(w http.ResponseWriter, r *http.Request) {
+	admin.WriteJSON(w, http.StatusOK, p.UpstreamStatus())
+}
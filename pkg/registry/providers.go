@@ -0,0 +1,40 @@
+package registry
+
+import (
+	"context"
+
+	"vault-docker-proxy/pkg/auth"
+	"vault-docker-proxy/pkg/provider"
+	"vault-docker-proxy/pkg/vault"
+)
+
+// readCredentials reads the Vault secret of a registry with the given token and converts it
+// into credentials with the provider of the registry type
+func (p *ProxyServer) readCredentials(ctx context.Context, registryConfig *auth.RegistryConfig, vaultToken string) (*auth.Credentials, error) {
+	registryProvider, err := provider.Lookup(registryConfig.Type)
+	if err != nil {
+		return nil, err
+	}
+
+	secret, lease, err := p.vaultClient.ReadSecretWithToken(vault.WithNamespace(ctx, registryConfig.Namespace), vaultToken, registryConfig.VaultPath)
+	if err != nil {
+		return nil, err
+	}
+	credentials, err := registryProvider.Credentials(ctx, registryConfig, secret)
+	if err != nil {
+		p.revokeUncachedLease(&auth.Credentials{Lease: lease}, registryConfig, vaultToken)
+		return nil, err
+	}
+	credentials.SetLease(lease)
+	return credentials, nil
+}
+
+// providerFor returns the provider of a registry type, falling back to plain Basic auth so that
+// callers holding an already validated configuration always get one
+func providerFor(registryConfig *auth.RegistryConfig) provider.Provider {
+	registryProvider, err := provider.Lookup(registryConfig.Type)
+	if err != nil {
+		return provider.Basic{Type: registryConfig.Type}
+	}
+	return registryProvider
+}
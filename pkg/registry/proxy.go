@@ -4,33 +4,83 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"io"
-	"log"
 	"net/http"
 	"strings"
+	"sync/atomic"
+	"time"
 
+	"vault-docker-proxy/pkg/audit"
 	"vault-docker-proxy/pkg/auth"
 	"vault-docker-proxy/pkg/cache"
+	"vault-docker-proxy/pkg/imagepolicy"
+	"vault-docker-proxy/pkg/logging"
+	"vault-docker-proxy/pkg/pullstats"
+	"vault-docker-proxy/pkg/transport"
 	"vault-docker-proxy/pkg/vault"
 )
 
 // ProxyServer handles Docker Registry v2 API requests and forwards them to the actual registry
 type ProxyServer struct {
-	vaultClient *vault.Client
-	cache       *cache.CredentialCache
-	httpClient  *http.Client
+	vaultClient      *vault.Client
+	cache            *cache.CredentialCache
+	httpClient       *http.Client
+	dryRun           bool
+	counters         proxyCounters
+	metadata         *metadataCache
+	registries       registryTracker
+	uploads          uploadTracker
+	tokens           *tokenService
+	audit            *audit.Log
+	blobs            *blobCache
+	manifests        *manifestCache
+	signatures       *signatureVerification
+	groupAccess      atomic.Pointer[groupAccess]
+	policies         *accessPolicies
+	imagePolicy      *imagepolicy.Reloader
+	clientIdentities []compiledClientIdentity
+	egress           *transport.HostAllowlist
+	refresher        *credentialRefresher
+	vaultReads       vaultReads
+	failedReads      *failedReads
+	ttlRules         []compiledTTLRule
+	leases           leaseTracker
+	prober           *upstreamProber
+	sizeLimits       SizeLimits
+	pullStats        *pullstats.Store
+	appRoles         *vault.AppRoleLogins
+	wrapped          *vault.WrappedTokens
+
+	loginSecretCheck    bool
+	sharedToken         bool
+	clientBlobRedirects bool
+	flushInterval       time.Duration
 }
 
 // NewProxyServer creates a new registry proxy server
 func NewProxyServer(vaultClient *vault.Client) *ProxyServer {
-	return &ProxyServer{
+	return NewProxyServerWithClient(vaultClient, &http.Client{})
+}
+
+// NewProxyServerWithClient creates a new registry proxy server using a custom upstream HTTP client
+func NewProxyServerWithClient(vaultClient *vault.Client, httpClient *http.Client) *ProxyServer {
+	p := &ProxyServer{
 		vaultClient: vaultClient,
-		cache:       cache.NewCredentialCache(),
-		httpClient:  &http.Client{},
+		httpClient:  httpClient,
+		metadata:    newMetadataCache(DefaultMetadataTTL),
 	}
+	p.SetFlushInterval(DefaultFlushInterval)
+	p.SetCredentialCache(cache.NewCredentialCache())
+	return p
+}
+
+// SetCredentialCache replaces the credential cache used by the proxy server
+func (p *ProxyServer) SetCredentialCache(credentialCache *cache.CredentialCache) {
+	// Leases of dynamic credentials end with their cache entries
+	credentialCache.OnEvicted(p.releaseLease)
+	p.cache = credentialCache
 }
 
-// APIVersionCheck handles GET /v2/ - Docker Registry API version check
+// APIVersionCheck handles GET and HEAD /v2/ - Docker Registry API version check
 func (p *ProxyServer) APIVersionCheck(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
 	w.WriteHeader(http.StatusOK)
@@ -38,40 +88,42 @@ func (p *ProxyServer) APIVersionCheck(w http.ResponseWriter, r *http.Request) {
 
 // GetCatalog handles GET /v2/_catalog - retrieve repository catalog
 func (p *ProxyServer) GetCatalog(w http.ResponseWriter, r *http.Request) {
-	log.Printf("GetCatalog request from %s", r.RemoteAddr)
-	
+	logging.FromContext(r.Context()).Debug("Catalog request", "remote_addr", r.RemoteAddr)
+
 	// Check if this is a Bearer token request
 	if bearerAuth, ok := auth.GetBearerAuthFromContext(r.Context()); ok {
-		log.Printf("Using Bearer token for catalog request to registry: %s", bearerAuth.RegistryURL)
+		logging.AddFields(r.Context(), "registry", bearerAuth.RegistryURL)
+		logging.FromContext(r.Context()).Debug("Using Bearer token for catalog request")
 		err := p.proxyBearerRequest(w, r, bearerAuth, "/_catalog")
 		if err != nil {
-			log.Printf("Failed to proxy Bearer catalog request: %v", err)
-			http.Error(w, fmt.Sprintf("failed to proxy request: %v", err), http.StatusInternalServerError)
+			logging.FromContext(r.Context()).Error("Failed to proxy Bearer catalog request", "error", err)
+			writeError(w, err)
 			return
 		}
-		log.Printf("Successfully proxied Bearer catalog request")
+		logging.FromContext(r.Context()).Debug("Proxied Bearer catalog request")
 		return
 	}
 
 	// Handle Basic Auth (existing flow)
 	credentials, registryConfig, err := p.authenticateAndGetCredentials(r)
 	if err != nil {
-		log.Printf("Authentication failed for catalog request: %v", err)
-		http.Error(w, err.Error(), http.StatusUnauthorized)
+		logging.FromContext(r.Context()).Warn("Authentication failed for catalog request", "error", err)
+		writeErrorResponse(w, "UNAUTHORIZED", err.Error(), http.StatusUnauthorized)
 		return
 	}
+	defer credentials.Wipe()
+
+	logging.FromContext(r.Context()).Debug("Proxying catalog request")
 
-	log.Printf("Proxying catalog request to registry: %s", registryConfig.RegistryURL)
-	
 	// Forward request to actual registry
 	err = p.proxyRequest(w, r, credentials, registryConfig, "/_catalog")
 	if err != nil {
-		log.Printf("Failed to proxy catalog request: %v", err)
-		http.Error(w, fmt.Sprintf("failed to proxy request: %v", err), http.StatusInternalServerError)
+		logging.FromContext(r.Context()).Error("Failed to proxy catalog request", "error", err)
+		writeError(w, err)
 		return
 	}
-	
-	log.Printf("Successfully proxied catalog request")
+
+	logging.FromContext(r.Context()).Debug("Proxied catalog request")
 }
 
 // GetTags handles GET /v2/{name}/tags/list - fetch tags for a repository
@@ -82,139 +134,202 @@ func (p *ProxyServer) GetTags(w http.ResponseWriter, r *http.Request) {
 	repoPath = strings.TrimSuffix(repoPath, "/tags/list")
 	targetPath := fmt.Sprintf("/%s/tags/list", repoPath)
 
+	// Filtering and semver ordering are proxy extensions, dry runs still explain the upstream call
+	if hasTagExtensions(r) && !p.isDryRun(r) {
+		p.serveFilteredTags(w, r, repoPath)
+		return
+	}
+
 	// Check if this is a Bearer token request
 	if bearerAuth, ok := auth.GetBearerAuthFromContext(r.Context()); ok {
-		log.Printf("Using Bearer token for tags request to registry: %s, repo: %s", bearerAuth.RegistryURL, repoPath)
+		logging.AddFields(r.Context(), "registry", bearerAuth.RegistryURL)
+		logging.FromContext(r.Context()).Debug("Using Bearer token for tags request")
 		err := p.proxyBearerRequest(w, r, bearerAuth, targetPath)
 		if err != nil {
-			log.Printf("Failed to proxy Bearer tags request: %v", err)
-			http.Error(w, fmt.Sprintf("failed to proxy request: %v", err), http.StatusInternalServerError)
+			logging.FromContext(r.Context()).Error("Failed to proxy Bearer tags request", "error", err)
+			writeError(w, err)
 			return
 		}
-		log.Printf("Successfully proxied Bearer tags request for repo: %s", repoPath)
+		logging.FromContext(r.Context()).Debug("Proxied Bearer tags request")
 		return
 	}
 
 	// Handle Basic Auth (existing flow)
 	credentials, registryConfig, err := p.authenticateAndGetCredentials(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusUnauthorized)
+		writeErrorResponse(w, "UNAUTHORIZED", err.Error(), http.StatusUnauthorized)
 		return
 	}
+	defer credentials.Wipe()
 
 	err = p.proxyRequest(w, r, credentials, registryConfig, targetPath)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("failed to proxy request: %v", err), http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
 }
 
-// GetManifest handles GET /v2/{name}/manifests/{reference} - retrieve manifest
+// GetManifest handles GET /v2/{name}/manifests/{reference} - retrieve manifest. HEAD requests
+// are forwarded as such, returning the digest, type and length without the body. With the
+// manifest cache enabled, manifests pulled with credentials from Vault go through the cache.
+// With signature verification enabled, manifests are only served once their signatures pass
+// the trust policy.
 func (p *ProxyServer) GetManifest(w http.ResponseWriter, r *http.Request) {
 	// Check if this is a Bearer token request
 	if bearerAuth, ok := auth.GetBearerAuthFromContext(r.Context()); ok {
 		path := strings.TrimPrefix(r.URL.Path, "/v2")
-		log.Printf("Using Bearer token for manifest request to registry: %s, path: %s", bearerAuth.RegistryURL, path)
-		err := p.proxyBearerRequest(w, r, bearerAuth, path)
+		logging.AddFields(r.Context(), "registry", bearerAuth.RegistryURL)
+		logging.FromContext(r.Context()).Debug("Using Bearer token for manifest request", "path", path)
+		up := &upstream{registryURL: registryBaseURL(bearerAuth.RegistryURL), bearerToken: bearerAuth.Token}
+		err := p.serveVerifiedManifest(w, r, up, path, func(w http.ResponseWriter, r *http.Request) error {
+			return p.proxyBearerRequest(w, r, bearerAuth, path)
+		})
 		if err != nil {
-			log.Printf("Failed to proxy Bearer manifest request: %v", err)
-			http.Error(w, fmt.Sprintf("failed to proxy request: %v", err), http.StatusInternalServerError)
+			logging.FromContext(r.Context()).Error("Failed to proxy Bearer manifest request", "error", err)
+			writeError(w, err)
 			return
 		}
-		log.Printf("Successfully proxied Bearer manifest request for path: %s", path)
+		logging.FromContext(r.Context()).Debug("Proxied Bearer manifest request", "path", path)
 		return
 	}
 
 	// Handle Basic Auth (existing flow)
 	credentials, registryConfig, err := p.authenticateAndGetCredentials(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusUnauthorized)
+		writeErrorResponse(w, "UNAUTHORIZED", err.Error(), http.StatusUnauthorized)
 		return
 	}
+	defer credentials.Wipe()
 
 	// Extract path from original request
 	path := strings.TrimPrefix(r.URL.Path, "/v2")
-	err = p.proxyRequest(w, r, credentials, registryConfig, path)
+	err = p.serveVerifiedManifest(w, r, newUpstream(registryConfig, credentials), path, func(w http.ResponseWriter, r *http.Request) error {
+		if p.manifests != nil && !p.isDryRun(r) {
+			return p.proxyManifest(w, r, credentials, registryConfig, path)
+		}
+		return p.proxyRequest(w, r, credentials, registryConfig, path)
+	})
 	if err != nil {
-		http.Error(w, fmt.Sprintf("failed to proxy request: %v", err), http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
 }
 
-// GetBlob handles GET /v2/{name}/blobs/{digest} - retrieve blob
+// GetBlob handles GET /v2/{name}/blobs/{digest} - retrieve blob. HEAD requests are forwarded
+// as such, so clients can check for a blob without downloading it. With the blob cache enabled,
+// blobs pulled with credentials from Vault go through the cache.
 func (p *ProxyServer) GetBlob(w http.ResponseWriter, r *http.Request) {
 	// Check if this is a Bearer token request
 	if bearerAuth, ok := auth.GetBearerAuthFromContext(r.Context()); ok {
 		path := strings.TrimPrefix(r.URL.Path, "/v2")
-		log.Printf("Using Bearer token for blob request to registry: %s, path: %s", bearerAuth.RegistryURL, path)
+		logging.AddFields(r.Context(), "registry", bearerAuth.RegistryURL)
+		logging.FromContext(r.Context()).Debug("Using Bearer token for blob request", "path", path)
 		err := p.proxyBearerRequest(w, r, bearerAuth, path)
 		if err != nil {
-			log.Printf("Failed to proxy Bearer blob request: %v", err)
-			http.Error(w, fmt.Sprintf("failed to proxy request: %v", err), http.StatusInternalServerError)
+			logging.FromContext(r.Context()).Error("Failed to proxy Bearer blob request", "error", err)
+			writeError(w, err)
 			return
 		}
-		log.Printf("Successfully proxied Bearer blob request for path: %s", path)
+		logging.FromContext(r.Context()).Debug("Proxied Bearer blob request", "path", path)
 		return
 	}
 
 	// Handle Basic Auth (existing flow)
 	credentials, registryConfig, err := p.authenticateAndGetCredentials(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusUnauthorized)
+		writeErrorResponse(w, "UNAUTHORIZED", err.Error(), http.StatusUnauthorized)
 		return
 	}
+	defer credentials.Wipe()
 
 	// Extract path from original request
 	path := strings.TrimPrefix(r.URL.Path, "/v2")
-	err = p.proxyRequest(w, r, credentials, registryConfig, path)
+	if p.blobs != nil && !p.isDryRun(r) {
+		err = p.proxyBlob(w, r, credentials, registryConfig, path)
+	} else {
+		err = p.proxyRequest(w, r, credentials, registryConfig, path)
+	}
 	if err != nil {
-		http.Error(w, fmt.Sprintf("failed to proxy request: %v", err), http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
 }
 
 // authenticateAndGetCredentials extracts auth info and retrieves credentials from Vault
 func (p *ProxyServer) authenticateAndGetCredentials(r *http.Request) (*auth.Credentials, *auth.RegistryConfig, error) {
+	// API keys map to a registry and are served with the proxy's own Vault token
+	if apiKey, ok := auth.GetAPIKeyFromContext(r.Context()); ok {
+		registryConfig := apiKey.Registry
+		logRegistry(r.Context(), &registryConfig)
+		logging.AddFields(r.Context(), "api_key", apiKey.Name)
+		logging.FromContext(r.Context()).Debug("Authenticating API key")
+		credentials, err := p.credentialsFor(withAuditRequest(r), &registryConfig, p.vaultClient.Token())
+		if err != nil {
+			return nil, nil, err
+		}
+		return credentials, &registryConfig, nil
+	}
+
 	// Extract Basic Auth from request
 	username, password, ok := r.BasicAuth()
 	if !ok {
-		log.Printf("Request missing basic authentication from %s", r.RemoteAddr)
+		logging.FromContext(r.Context()).Debug("Request missing basic authentication", "remote_addr", r.RemoteAddr)
 		return nil, nil, fmt.Errorf("basic authentication required")
 	}
 
 	// Parse username to get registry configuration
 	registryConfig, err := auth.ParseUsername(username)
 	if err != nil {
-		log.Printf("Invalid username format: %s, error: %v", username, err)
+		logging.FromContext(r.Context()).Warn("Invalid username format", "username", username, "error", err)
 		return nil, nil, fmt.Errorf("invalid username format: %v", err)
 	}
 
-	log.Printf("Authenticating for registry: %s, vault path: %s", registryConfig.RegistryURL, registryConfig.VaultPath)
+	logRegistry(r.Context(), registryConfig)
+	logging.FromContext(r.Context()).Debug("Authenticating")
+
+	vaultToken, err := p.resolveVaultToken(r.Context(), registryConfig, password)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	credentials, err := p.credentialsFor(context.WithoutCancel(withAuditRequest(r)), registryConfig, vaultToken)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return credentials, registryConfig, nil
+}
 
-	// Set Vault token from password field
-	p.vaultClient.SetToken(password)
+// credentialsFor returns the registry credentials stored at the configured Vault path, using the
+// credential cache when possible
+func (p *ProxyServer) credentialsFor(ctx context.Context, registryConfig *auth.RegistryConfig, vaultToken string) (*auth.Credentials, error) {
+	p.registries.record(providerFor(registryConfig).BaseURL(registryConfig.RegistryURL), registryConfig.Type, registryConfig.VaultPath)
+	logRegistry(ctx, registryConfig)
 
 	// Check cache first
-	if credentials, found := p.cache.Get(password, registryConfig.VaultPath); found {
-		log.Printf("Using cached credentials for path: %s", registryConfig.VaultPath)
-		return credentials, registryConfig, nil
+	if credentials, found := p.cache.Get(vaultToken, registryConfig.SecretPath()); found {
+		logging.FromContext(ctx).Debug("Using cached credentials")
+		p.auditResolution(ctx, registryConfig, vaultToken, audit.OutcomeCached, nil)
+		p.counters.cacheHits.Add(1)
+		p.refresher.touch(vaultToken, registryConfig.SecretPath())
+		return credentials, nil
 	}
+	p.counters.cacheMisses.Add(1)
 
-	log.Printf("Retrieving credentials from Vault for path: %s", registryConfig.VaultPath)
+	logging.FromContext(ctx).Debug("Retrieving credentials from Vault")
 
-	// Get credentials from Vault
-	credentials, err := p.vaultClient.GetCredentials(context.Background(), registryConfig.VaultPath)
+	// Get credentials from Vault, sharing a read already in flight; they are cached by the read
+	credentials, err := p.readCredentialsShared(ctx, registryConfig, vaultToken)
 	if err != nil {
-		log.Printf("Failed to retrieve credentials from Vault for path %s: %v", registryConfig.VaultPath, err)
-		return nil, nil, fmt.Errorf("failed to retrieve credentials from Vault: %v", err)
+		logging.FromContext(ctx).Error("Failed to retrieve credentials from Vault", "error", err)
+		p.auditResolution(ctx, registryConfig, vaultToken, "", err)
+		return nil, fmt.Errorf("failed to retrieve credentials from Vault: %v", err)
 	}
 
-	log.Printf("Successfully retrieved credentials from Vault for path: %s", registryConfig.VaultPath)
-
-	// Cache the credentials
-	p.cache.Set(password, registryConfig.VaultPath, credentials)
+	logging.FromContext(ctx).Info("Retrieved credentials from Vault")
+	p.auditResolution(ctx, registryConfig, vaultToken, audit.OutcomeRead, nil)
 
-	return credentials, registryConfig, nil
+	return credentials, nil
 }
 
 // proxyBearerRequest forwards Bearer token requests directly to the registry
@@ -237,31 +352,39 @@ func (p *ProxyServer) proxyBearerRequest(w http.ResponseWriter, r *http.Request,
 	if err != nil {
 		return fmt.Errorf("failed to create proxy request: %v", err)
 	}
+	// Forward the length of pushed content, rather than sending it chunked, and how to read it again
+	proxyReq.ContentLength = r.ContentLength
+	proxyReq.GetBody = r.GetBody
+	proxyReq = p.withRedirectMode(proxyReq, r)
+
+	p.registries.record(registryBaseURL(registryURL), "", "")
+
+	// Copy headers, then forward the client's own Bearer token
+	copyRequestHeaders(proxyReq.Header, r.Header)
+	proxyReq.Header.Set("Authorization", "Bearer "+bearerAuth.Token)
+	logging.AddAuthorizationSecrets(r.Context(), proxyReq.Header.Get("Authorization"))
 
-	// Copy headers (including the original Authorization Bearer token)
-	for name, values := range r.Header {
-		proxyReq.Header[name] = values
+	if p.isDryRun(r) {
+		p.writeDryRun(w, proxyReq, nil, registryURL, nil)
+		return nil
 	}
 
 	// Forward request
 	resp, err := p.httpClient.Do(proxyReq)
 	if err != nil {
-		return fmt.Errorf("failed to forward request: %v", err)
+		return fmt.Errorf("failed to forward request: %w", err)
 	}
 	defer resp.Body.Close()
 
 	// Copy response headers
-	for name, values := range resp.Header {
-		w.Header()[name] = values
-	}
-
-	// Set status code
-	w.WriteHeader(resp.StatusCode)
+	copyResponseHeaders(w.Header(), resp.Header, "")
+	rewriteLinks(w.Header(), registryURL)
+	rewriteRedirect(w.Header(), resp.StatusCode, registryURL)
 
-	// Copy response body
-	_, err = io.Copy(w, resp.Body)
+	// Stream the response body as it arrives
+	err = p.streamBody(w, resp.StatusCode, resp.Body)
 	if err != nil {
-		return fmt.Errorf("failed to copy response body: %v", err)
+		return fmt.Errorf("%w: failed to copy response body: %w", errResponseStarted, err)
 	}
 
 	return nil
@@ -270,10 +393,8 @@ func (p *ProxyServer) proxyBearerRequest(w http.ResponseWriter, r *http.Request,
 // proxyRequest forwards the request to the actual Docker registry
 func (p *ProxyServer) proxyRequest(w http.ResponseWriter, r *http.Request, credentials *auth.Credentials, registryConfig *auth.RegistryConfig, targetPath string) error {
 	// Build target URL
-	registryURL := registryConfig.RegistryURL
-	if !strings.HasPrefix(registryURL, "http://") && !strings.HasPrefix(registryURL, "https://") {
-		registryURL = "https://" + registryURL
-	}
+	registryProvider := providerFor(registryConfig)
+	registryURL := registryProvider.BaseURL(registryConfig.RegistryURL)
 
 	targetURL := fmt.Sprintf("%s/v2%s", registryURL, targetPath)
 
@@ -287,36 +408,44 @@ func (p *ProxyServer) proxyRequest(w http.ResponseWriter, r *http.Request, crede
 	if err != nil {
 		return fmt.Errorf("failed to create proxy request: %v", err)
 	}
+	// Forward the length of pushed content, rather than sending it chunked, and how to read it again
+	proxyReq.ContentLength = r.ContentLength
+	proxyReq.GetBody = r.GetBody
+	proxyReq = p.withRedirectMode(proxyReq, r)
 
-	// Copy headers (excluding Authorization which we'll replace)
-	for name, values := range r.Header {
-		if name != "Authorization" {
-			proxyReq.Header[name] = values
-		}
-	}
+	// Copy headers, never forwarding the client's authentication material
+	copyRequestHeaders(proxyReq.Header, r.Header)
 
 	// Set authentication with actual registry credentials
-	proxyReq.SetBasicAuth(credentials.Username, credentials.Password)
+	registryProvider.Authorize(proxyReq, credentials)
+	logging.AddAuthorizationSecrets(r.Context(), proxyReq.Header.Get("Authorization"))
+
+	if p.isDryRun(r) {
+		p.writeDryRun(w, proxyReq, registryConfig, registryURL, credentials)
+		return nil
+	}
 
 	// Forward request
 	resp, err := p.httpClient.Do(proxyReq)
 	if err != nil {
-		return fmt.Errorf("failed to forward request: %v", err)
+		return fmt.Errorf("failed to forward request: %w", err)
 	}
 	defer resp.Body.Close()
 
-	// Copy response headers
-	for name, values := range resp.Header {
-		w.Header()[name] = values
+	// The credentials come from Vault, so the client cannot answer an upstream challenge
+	authorization := proxyReq.Header.Get("Authorization")
+	if resp.StatusCode == http.StatusUnauthorized {
+		p.writeCredentialsRejected(w, resp, registryConfig, registryURL, authorization)
+		return nil
 	}
 
-	// Set status code
-	w.WriteHeader(resp.StatusCode)
-
-	// Copy response body
-	_, err = io.Copy(w, resp.Body)
+	// Copy response headers and body, redacting any echo of the registry credentials
+	copyResponseHeaders(w.Header(), resp.Header, authorization)
+	rewriteLinks(w.Header(), registryURL)
+	rewriteRedirect(w.Header(), resp.StatusCode, registryURL)
+	err = p.writeUpstreamBody(w, resp, authorization)
 	if err != nil {
-		return fmt.Errorf("failed to copy response body: %v", err)
+		return fmt.Errorf("%w: failed to copy response body: %w", errResponseStarted, err)
 	}
 
 	return nil
@@ -343,10 +472,10 @@ func writeErrorResponse(w http.ResponseWriter, code string, message string, stat
 		Errors: []ErrorDetail{
 			{
 				Code:    code,
-				Message: message,
+				Message: logging.Redact(message),
 			},
 		},
 	}
 
 	json.NewEncoder(w).Encode(errorResp)
-}
\ No newline at end of file
+}
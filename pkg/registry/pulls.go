@@ -0,0 +1,79 @@
+package registry
+
+import (
+	"mime"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"vault-docker-proxy/pkg/pullstats"
+)
+
+// SetPullStats enables recording the manifests served by PullStatsMiddleware in store
+func (p *ProxyServer) SetPullStats(store *pullstats.Store) {
+	p.pullStats = store
+}
+
+// PullStatsMiddleware records successful manifest pulls with the client address. It must run
+// after authentication, which tells the upstream registry. Dry runs are not pulls.
+func (p *ProxyServer) PullStatsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reference := mux.Vars(r)["reference"]
+		if r.Method != http.MethodGet || reference == "" || p.pullStats == nil || p.isDryRun(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r)
+		host := requestRegistry(r)
+		if sw.status != http.StatusOK || host == "" {
+			return
+		}
+
+		client := r.RemoteAddr
+		if ip := sourceIP(r); ip != nil {
+			client = ip.String()
+		}
+		mediaType, _, _ := mime.ParseMediaType(w.Header().Get("Content-Type"))
+		p.pullStats.Record(pullstats.Pull{
+			Registry:   host,
+			Repository: repositoryOf(r),
+			Reference:  reference,
+			Client:     client,
+			Index:      mediaType == MediaTypeOCIIndex || mediaType == MediaTypeDockerManifestList,
+			Time:       time.Now(),
+		})
+	})
+}
+
+// statusWriter records the status code of a response
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	if !sw.wroteHeader {
+		sw.status = status
+		sw.wroteHeader = true
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusWriter) Write(p []byte) (int, error) {
+	sw.wroteHeader = true
+	return sw.ResponseWriter.Write(p)
+}
+
+// Flush implements http.Flusher
+func (sw *statusWriter) Flush() {
+	http.NewResponseController(sw.ResponseWriter).Flush()
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
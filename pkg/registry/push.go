@@ -0,0 +1,144 @@
+package registry
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strings"
+
+	"vault-docker-proxy/pkg/auth"
+	"vault-docker-proxy/pkg/logging"
+)
+
+// PutManifest handles PUT /v2/{name}/manifests/{reference} - push a manifest. The manifest is
+// buffered so it can be checked against a digest reference and sent upstream with its media type
+// and length, and successful responses always carry its Docker-Content-Digest.
+func (p *ProxyServer) PutManifest(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/v2")
+	i := strings.LastIndex(path, "/manifests/")
+	repo, reference := strings.TrimPrefix(path[:i], "/"), path[i+len("/manifests/"):]
+
+	raw, err := io.ReadAll(io.LimitReader(r.Body, maxManifestSize+1))
+	if err != nil {
+		writeErrorResponse(w, "MANIFEST_INVALID", fmt.Sprintf("failed to read manifest: %v", err), http.StatusBadRequest)
+		return
+	}
+	if len(raw) > maxManifestSize {
+		writeErrorResponse(w, "SIZE_INVALID", fmt.Sprintf("manifest exceeds %d bytes", maxManifestSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var manifest Manifest
+	if err := json.Unmarshal(raw, &manifest); err != nil {
+		writeErrorResponse(w, "MANIFEST_INVALID", fmt.Sprintf("failed to decode manifest: %v", err), http.StatusBadRequest)
+		return
+	}
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(raw))
+	if strings.HasPrefix(reference, "sha256:") && reference != digest {
+		writeErrorResponse(w, "DIGEST_INVALID", fmt.Sprintf("manifest digest %s does not match reference %s", digest, reference), http.StatusBadRequest)
+		return
+	}
+
+	// Registries store the Content-Type as the media type of the manifest, which must match the
+	// mediaType it declares; tools sending a generic Content-Type would store it otherwise
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch {
+	case manifest.MediaType != "":
+		if contentType != manifest.MediaType {
+			r.Header.Set("Content-Type", manifest.MediaType)
+		}
+	case contentType == "":
+		writeErrorResponse(w, "MANIFEST_INVALID", "manifest has no mediaType and the request no Content-Type", http.StatusBadRequest)
+		return
+	}
+	r.Body = io.NopCloser(bytes.NewReader(raw))
+	r.ContentLength = int64(len(raw))
+	r.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(raw)), nil }
+	mw := &manifestPushWriter{ResponseWriter: w, digest: digest}
+
+	var up *upstream
+	if bearerAuth, ok := auth.GetBearerAuthFromContext(r.Context()); ok {
+		logging.AddFields(r.Context(), "registry", bearerAuth.RegistryURL)
+		logging.FromContext(r.Context()).Debug("Using Bearer token for manifest push", "path", path)
+		if err := p.proxyBearerRequest(mw, r, bearerAuth, path); err != nil {
+			logging.FromContext(r.Context()).Error("Failed to proxy Bearer manifest push", "error", err)
+			writeError(mw, err)
+			return
+		}
+		up = &upstream{registryURL: registryBaseURL(bearerAuth.RegistryURL), bearerToken: bearerAuth.Token}
+	} else {
+		credentials, registryConfig, err := p.authenticateAndGetCredentials(r)
+		if err != nil {
+			writeErrorResponse(w, "UNAUTHORIZED", err.Error(), http.StatusUnauthorized)
+			return
+		}
+		defer credentials.Wipe()
+
+		if err := p.proxyRequest(mw, r, credentials, registryConfig, path); err != nil {
+			writeError(mw, err)
+			return
+		}
+		up = newUpstream(registryConfig, credentials)
+	}
+
+	if !mw.pushed() || p.isDryRun(r) {
+		return
+	}
+	logging.FromContext(r.Context()).Info("Pushed manifest", "digest", digest, "reference", reference)
+	if !strings.HasPrefix(reference, "sha256:") {
+		// The tag now points at the pushed manifest, whatever was resolved before
+		p.rememberTagDigest(up, repo, reference, digest)
+	}
+	if p.manifests != nil && up.registryConfig != nil {
+		mediaType := manifest.MediaType
+		if mediaType == "" {
+			mediaType = contentType
+		}
+		p.manifests.pushed(manifestView(up.registryConfig, repo), reference, &cachedManifest{digest: digest, mediaType: mediaType, raw: raw})
+	}
+}
+
+// manifestPushWriter adds the Docker-Content-Digest of a pushed manifest to the successful
+// responses of registries that leave it out
+type manifestPushWriter struct {
+	http.ResponseWriter
+	digest string
+	status int
+}
+
+func (mw *manifestPushWriter) WriteHeader(status int) {
+	if mw.status == 0 {
+		mw.status = status
+		if mw.pushed() {
+			switch upstreamDigest := mw.Header().Get("Docker-Content-Digest"); {
+			case upstreamDigest == "":
+				mw.Header().Set("Docker-Content-Digest", mw.digest)
+			case upstreamDigest != mw.digest:
+				slog.Warn("Upstream registry reports another digest for a pushed manifest", "upstream_digest", upstreamDigest, "digest", mw.digest)
+			}
+		}
+	}
+	mw.ResponseWriter.WriteHeader(status)
+}
+
+func (mw *manifestPushWriter) Write(b []byte) (int, error) {
+	if mw.status == 0 {
+		mw.WriteHeader(http.StatusOK)
+	}
+	return mw.ResponseWriter.Write(b)
+}
+
+// Unwrap returns the underlying ResponseWriter, for http.ResponseController
+func (mw *manifestPushWriter) Unwrap() http.ResponseWriter {
+	return mw.ResponseWriter
+}
+
+// pushed reports whether the upstream accepted the manifest
+func (mw *manifestPushWriter) pushed() bool {
+	return mw.status >= 200 && mw.status < 300
+}
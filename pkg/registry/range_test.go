@@ -0,0 +1,262 @@
+package registry
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"vault-docker-proxy/pkg/auth"
+	"vault-docker-proxy/pkg/blobcache"
+)
+
+var testBlob = []byte("the content of a layer, served in parts to resumed downloads")
+
+// testUpstream is a registry serving one blob, answering Range and If-Range requests like
+// registries and their storage do
+type testUpstream struct {
+	*httptest.Server
+	digest string
+
+	mu       sync.Mutex
+	requests []*http.Request
+}
+
+func newTestUpstream(t *testing.T) *testUpstream {
+	t.Helper()
+	sum := sha256.Sum256(testBlob)
+	upstream := &testUpstream{digest: "sha256:" + hex.EncodeToString(sum[:])}
+	upstream.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream.mu.Lock()
+		upstream.requests = append(upstream.requests, r)
+		upstream.mu.Unlock()
+
+		if r.URL.Path != "/v2/library/app/blobs/"+upstream.digest {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Docker-Content-Digest", upstream.digest)
+		w.Header().Set("Etag", upstream.etag())
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(testBlob))
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream
+}
+
+func (u *testUpstream) etag() string {
+	return `"` + u.digest + `"`
+}
+
+// gets returns the number of GET requests the upstream received
+func (u *testUpstream) gets() int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	gets := 0
+	for _, r := range u.requests {
+		if r.Method == http.MethodGet {
+			gets++
+		}
+	}
+	return gets
+}
+
+// lastRequest returns the last request the upstream received
+func (u *testUpstream) lastRequest() *http.Request {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.requests[len(u.requests)-1]
+}
+
+// blobRequest returns a GET of the upstream blob through the proxy, with the given headers
+func (u *testUpstream) blobRequest(header map[string]string) (*http.Request, string) {
+	path := "/library/app/blobs/" + u.digest
+	r := httptest.NewRequest(http.MethodGet, "/v2"+path, nil)
+	for name, value := range header {
+		r.Header.Set(name, value)
+	}
+	return r, path
+}
+
+// registryConfig returns the configuration of requests to the upstream
+func (u *testUpstream) registryConfig() *auth.RegistryConfig {
+	return &auth.RegistryConfig{RegistryURL: u.URL, VaultPath: "registry/test"}
+}
+
+func testCredentials() *auth.Credentials {
+	return auth.NewCredentials("user", []byte("password"), "")
+}
+
+func TestProxyRequestRange(t *testing.T) {
+	upstream := newTestUpstream(t)
+	p := NewProxyServerWithClient(nil, upstream.Client())
+	size := len(testBlob)
+
+	tests := []struct {
+		name         string
+		header       map[string]string
+		status       int
+		body         []byte
+		contentRange string
+	}{
+		{
+			name:         "single range",
+			header:       map[string]string{"Range": "bytes=10-"},
+			status:       http.StatusPartialContent,
+			body:         testBlob[10:],
+			contentRange: "bytes 10-" + strconv.Itoa(size-1) + "/" + strconv.Itoa(size),
+		},
+		{
+			name:         "matching If-Range",
+			header:       map[string]string{"Range": "bytes=0-9", "If-Range": upstream.etag()},
+			status:       http.StatusPartialContent,
+			body:         testBlob[:10],
+			contentRange: "bytes 0-9/" + strconv.Itoa(size),
+		},
+		{
+			name:   "stale If-Range",
+			header: map[string]string{"Range": "bytes=10-", "If-Range": `"sha256:stale"`},
+			status: http.StatusOK,
+			body:   testBlob,
+		},
+		{
+			name:         "unsatisfiable range",
+			header:       map[string]string{"Range": "bytes=" + strconv.Itoa(size) + "-"},
+			status:       http.StatusRequestedRangeNotSatisfiable,
+			contentRange: "bytes */" + strconv.Itoa(size),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, path := upstream.blobRequest(tt.header)
+			w := httptest.NewRecorder()
+			if err := p.proxyRequest(w, r, testCredentials(), upstream.registryConfig(), path); err != nil {
+				t.Fatalf("proxyRequest: %v", err)
+			}
+
+			for name, value := range tt.header {
+				if got := upstream.lastRequest().Header.Get(name); got != value {
+					t.Errorf("upstream %s = %q, want %q", name, got, value)
+				}
+			}
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+			if got := w.Header().Get("Content-Range"); got != tt.contentRange {
+				t.Errorf("Content-Range = %q, want %q", got, tt.contentRange)
+			}
+			if tt.status == http.StatusRequestedRangeNotSatisfiable {
+				return
+			}
+			if !bytes.Equal(w.Body.Bytes(), tt.body) {
+				t.Errorf("body = %q, want %q", w.Body.Bytes(), tt.body)
+			}
+			if got := w.Header().Get("Accept-Ranges"); got != "bytes" {
+				t.Errorf("Accept-Ranges = %q, want bytes", got)
+			}
+			if got := w.Header().Get("Etag"); got != upstream.etag() {
+				t.Errorf("Etag = %q, want %q", got, upstream.etag())
+			}
+		})
+	}
+}
+
+func TestProxyBlobRange(t *testing.T) {
+	upstream := newTestUpstream(t)
+	p := NewProxyServerWithClient(nil, upstream.Client())
+	store, err := blobcache.NewDisk(t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.SetBlobCache(store)
+
+	get := func(header map[string]string) *httptest.ResponseRecorder {
+		t.Helper()
+		r, path := upstream.blobRequest(header)
+		w := httptest.NewRecorder()
+		if err := p.proxyBlob(w, r, testCredentials(), upstream.registryConfig(), path); err != nil {
+			t.Fatalf("proxyBlob: %v", err)
+		}
+		return w
+	}
+
+	// A partial response is passed through but not stored
+	w := get(map[string]string{"Range": "bytes=10-"})
+	if w.Code != http.StatusPartialContent || !bytes.Equal(w.Body.Bytes(), testBlob[10:]) {
+		t.Fatalf("range miss: status %d, body %q", w.Code, w.Body.Bytes())
+	}
+	if count, _ := store.Usage(); count != 0 {
+		t.Fatalf("partial response stored in the blob cache: %d blobs", count)
+	}
+
+	// A stale If-Range gets the whole blob, which is stored
+	w = get(map[string]string{"Range": "bytes=10-", "If-Range": `"sha256:stale"`})
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), testBlob) {
+		t.Fatalf("stale If-Range: status %d, body %q", w.Code, w.Body.Bytes())
+	}
+	if count, _ := store.Usage(); count != 1 {
+		t.Fatalf("whole blob not stored in the blob cache: %d blobs", count)
+	}
+
+	// Range requests for the cached blob are answered from the cache
+	gets := upstream.gets()
+	tests := []struct {
+		name         string
+		header       map[string]string
+		status       int
+		body         []byte
+		contentRange string
+	}{
+		{
+			name:         "single range",
+			header:       map[string]string{"Range": "bytes=5-14"},
+			status:       http.StatusPartialContent,
+			body:         testBlob[5:15],
+			contentRange: "bytes 5-14/" + strconv.Itoa(len(testBlob)),
+		},
+		{
+			name:         "matching If-Range",
+			header:       map[string]string{"Range": "bytes=20-", "If-Range": upstream.etag()},
+			status:       http.StatusPartialContent,
+			body:         testBlob[20:],
+			contentRange: "bytes 20-" + strconv.Itoa(len(testBlob)-1) + "/" + strconv.Itoa(len(testBlob)),
+		},
+		{
+			name:   "stale If-Range",
+			header: map[string]string{"Range": "bytes=20-", "If-Range": `"sha256:stale"`},
+			status: http.StatusOK,
+			body:   testBlob,
+		},
+		{
+			name:         "unsatisfiable range",
+			header:       map[string]string{"Range": "bytes=" + strconv.Itoa(len(testBlob)) + "-"},
+			status:       http.StatusRequestedRangeNotSatisfiable,
+			contentRange: "bytes */" + strconv.Itoa(len(testBlob)),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := get(tt.header)
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+			if got := w.Header().Get("Content-Range"); got != tt.contentRange {
+				t.Errorf("Content-Range = %q, want %q", got, tt.contentRange)
+			}
+			if tt.status != http.StatusRequestedRangeNotSatisfiable && !bytes.Equal(w.Body.Bytes(), tt.body) {
+				t.Errorf("body = %q, want %q", w.Body.Bytes(), tt.body)
+			}
+			if tt.status == http.StatusPartialContent && w.Header().Get("Content-Length") != strconv.Itoa(len(tt.body)) {
+				t.Errorf("Content-Length = %q, want %d", w.Header().Get("Content-Length"), len(tt.body))
+			}
+		})
+	}
+	if got := upstream.gets(); got != gets {
+		t.Errorf("cached blob fetched upstream %d more times", got-gets)
+	}
+}
@@ -0,0 +1,62 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// maxRedirects is how many redirects the upstream client follows, as net/http does by default
+const maxRedirects = 10
+
+// clientRedirectKey marks upstream requests whose redirects go back to the client
+type clientRedirectKey struct{}
+
+// SetClientBlobRedirects makes the proxy return upstream blob redirects, such as to presigned
+// object storage URLs, to the client instead of following them and streaming the blob itself.
+// Clients then download blobs from the storage directly, which saves the proxy's bandwidth but
+// reveals the storage URLs and needs clients that can reach them. Blobs fetched by the proxy for
+// its own endpoints, such as image copies and exports, still follow redirects.
+func (p *ProxyServer) SetClientBlobRedirects(enabled bool) {
+	if !enabled {
+		return
+	}
+	next := p.httpClient.CheckRedirect
+	p.httpClient.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if passed, _ := via[0].Context().Value(clientRedirectKey{}).(bool); passed {
+			return http.ErrUseLastResponse
+		}
+		if next != nil {
+			return next(req, via)
+		}
+		if len(via) >= maxRedirects {
+			return errors.New("stopped after 10 redirects")
+		}
+		return nil
+	}
+	p.clientBlobRedirects = true
+}
+
+// withRedirectMode marks an upstream request proxying a client's blob download, so its redirects
+// go back to the client when SetClientBlobRedirects is enabled
+func (p *ProxyServer) withRedirectMode(proxyReq, r *http.Request) *http.Request {
+	if !p.clientBlobRedirects || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+		return proxyReq
+	}
+	if !strings.Contains(r.URL.Path, "/blobs/") || strings.Contains(r.URL.Path, "/blobs/uploads/") {
+		return proxyReq
+	}
+	return proxyReq.WithContext(context.WithValue(proxyReq.Context(), clientRedirectKey{}, true))
+}
+
+// rewriteRedirect points the Location of an upstream redirect on the registry's own host at the
+// proxy; redirects to other hosts, such as object storage, are passed on unchanged
+func rewriteRedirect(header http.Header, statusCode int, registryURL string) {
+	if statusCode < 300 || statusCode > 399 {
+		return
+	}
+	if location := header.Get("Location"); location != "" {
+		header.Set("Location", proxyLocation(location, registryURL))
+	}
+}
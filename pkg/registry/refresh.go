@@ -0,0 +1,182 @@
+package registry
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"vault-docker-proxy/pkg/auth"
+)
+
+// credentialRefresher renews short-lived registry tokens of actively used registries before their
+// cache entries expire, so requests never wait for a token exchange or use an expired token
+type credentialRefresher struct {
+	mu      sync.Mutex
+	entries map[string]*refreshEntry
+	before  time.Duration // refresh this long before the cache entry expires
+	idle    time.Duration // stop refreshing entries unused for this long
+}
+
+// refreshEntry is a cached short-lived credential and what is needed to read it again. The
+// Vault token is kept as a Secret and wiped when the entry is dropped.
+type refreshEntry struct {
+	registryConfig auth.RegistryConfig
+	vaultToken     *auth.Secret
+	cachedUntil    time.Time
+	lastUsed       time.Time
+}
+
+// SetCredentialRefresh enables proactive refresh of short-lived registry tokens (credentials
+// with an expiry, such as ECR authorization tokens): they are read again from Vault before
+// before their cache entry expires, as long as they were used within idle. Run
+// RunCredentialRefresh to perform the refreshes.
+func (p *ProxyServer) SetCredentialRefresh(before, idle time.Duration) {
+	p.refresher = &credentialRefresher{
+		entries: make(map[string]*refreshEntry),
+		before:  before,
+		idle:    idle,
+	}
+}
+
+// RunCredentialRefresh refreshes expiring credentials every interval until ctx is cancelled
+func (p *ProxyServer) RunCredentialRefresh(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.refreshCredentials(ctx)
+		case <-ctx.Done():
+			p.refresher.clear()
+			return
+		}
+	}
+}
+
+// cacheCredentials caches credentials read from Vault, reporting whether it did. Short-lived
+// credentials are cached no longer than they are valid and are tracked for proactive refresh.
+// Nothing is cached when the cache is disabled, the credentials' TTL rule is 0 or they already
+// expired; the caller then revokes the lease of dynamic secrets once done with them, so each
+// read does not leave a lease behind in Vault.
+func (p *ProxyServer) cacheCredentials(vaultToken string, registryConfig *auth.RegistryConfig, credentials *auth.Credentials) bool {
+	ttl := p.credentialTTL(registryConfig)
+	if !p.cache.Enabled() || ttl == 0 {
+		return false
+	}
+	if !credentials.ExpiresAt.IsZero() {
+		remaining := time.Until(credentials.ExpiresAt)
+		if remaining <= 0 {
+			slog.Warn("Not caching expired registry token", "vault_path", registryConfig.VaultPath)
+			return false
+		}
+		if ttl <= 0 || remaining < ttl {
+			ttl = remaining
+		}
+		if p.refresher != nil && ttl > 0 {
+			p.refresher.track(vaultToken, registryConfig, time.Now().Add(ttl))
+		}
+	}
+	if credentials.Lease != nil {
+		p.leases.track(credentials.Lease.ID, vaultToken, registryConfig.Namespace)
+	}
+	p.cache.SetWithTTL(vaultToken, registryConfig.SecretPath(), credentials, ttl)
+	return true
+}
+
+// refreshCredentials reads again the tracked credentials whose cache entries expire soon
+func (p *ProxyServer) refreshCredentials(ctx context.Context) {
+	for _, entry := range p.refresher.due(time.Now()) {
+		p.refreshEntry(ctx, entry)
+		entry.vaultToken.Wipe()
+	}
+}
+
+// refreshEntry renews or reads again the credentials of one due entry
+func (p *ProxyServer) refreshEntry(ctx context.Context, entry refreshEntry) {
+	registryConfig := entry.registryConfig
+	vaultToken := entry.vaultToken.Reveal()
+	if p.renewLease(ctx, &registryConfig, vaultToken) {
+		return
+	}
+
+	p.counters.vaultCalls.Add(1)
+	credentials, err := p.readCredentials(ctx, &registryConfig, vaultToken)
+	if err != nil {
+		p.counters.vaultErrors.Add(1)
+		slog.Error("Failed to refresh registry token", "vault_path", registryConfig.VaultPath, "error", err)
+		return
+	}
+	slog.Info("Refreshed registry token", "vault_path", registryConfig.VaultPath, "expires_at", credentials.ExpiresAt.Format(time.RFC3339))
+	if !p.cacheCredentials(vaultToken, &registryConfig, credentials) {
+		p.revokeUncachedLease(credentials, &registryConfig, vaultToken)
+	}
+	credentials.Wipe()
+}
+
+// refreshKey identifies a tracked credential like the cache does: by Vault token and path
+func refreshKey(vaultToken, vaultPath string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(vaultToken+":"+vaultPath)))
+}
+
+// track records a cached short-lived credential, or updates its cache expiry
+func (r *credentialRefresher) track(vaultToken string, registryConfig *auth.RegistryConfig, cachedUntil time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := refreshKey(vaultToken, registryConfig.SecretPath())
+	if entry, ok := r.entries[key]; ok {
+		entry.cachedUntil = cachedUntil
+		return
+	}
+	r.entries[key] = &refreshEntry{
+		registryConfig: *registryConfig,
+		vaultToken:     auth.NewSecret([]byte(vaultToken)),
+		cachedUntil:    cachedUntil,
+		lastUsed:       time.Now(),
+	}
+}
+
+// touch marks a tracked credential as used
+func (r *credentialRefresher) touch(vaultToken, vaultPath string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if entry, ok := r.entries[refreshKey(vaultToken, vaultPath)]; ok {
+		entry.lastUsed = time.Now()
+	}
+}
+
+// due returns copies of the entries to refresh now, whose Vault tokens the caller wipes, dropping
+// idle and expired ones
+func (r *credentialRefresher) due(now time.Time) []refreshEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var due []refreshEntry
+	for key, entry := range r.entries {
+		if now.Sub(entry.lastUsed) > r.idle || now.After(entry.cachedUntil) {
+			entry.vaultToken.Wipe()
+			delete(r.entries, key)
+			continue
+		}
+		if entry.cachedUntil.Sub(now) <= r.before {
+			due = append(due, refreshEntry{registryConfig: entry.registryConfig, vaultToken: entry.vaultToken.Clone()})
+		}
+	}
+	return due
+}
+
+// clear drops every entry
+func (r *credentialRefresher) clear() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for key, entry := range r.entries {
+		entry.vaultToken.Wipe()
+		delete(r.entries, key)
+	}
+}
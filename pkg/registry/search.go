@@ -0,0 +1,151 @@
+package registry
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"vault-docker-proxy/pkg/admin"
+)
+
+// DefaultSearchLimit is the number of repositories returned by a search unless n is given
+const DefaultSearchLimit = 100
+
+// SearchResult is a repository matched by a search, with its matching tags when requested
+type SearchResult struct {
+	Name string   `json:"name"`
+	Tags []string `json:"tags,omitempty"`
+}
+
+// SearchResponse is the body returned by GET /ext/search
+type SearchResponse struct {
+	Registry  string         `json:"registry"`
+	Results   []SearchResult `json:"results"`
+	Truncated bool           `json:"truncated"`
+	FetchedAt time.Time      `json:"fetched_at"`
+}
+
+// Search handles GET /ext/search - search the repositories of the upstream catalog.
+// Query parameters: q (substring, or glob when it contains *, ? or [), regex (regular expression
+// instead of q), tags=true to include tags, tag (glob or substring filtering the tags) and n
+// (maximum number of repositories).
+func (p *ProxyServer) Search(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	repoFilter, err := compileFilter(query.Get("q"), query.Get("regex"))
+	if err != nil {
+		writeErrorResponse(w, "BAD_REQUEST", err.Error(), http.StatusBadRequest)
+		return
+	}
+	tagFilter, err := compileFilter(query.Get("tag"), "")
+	if err != nil {
+		writeErrorResponse(w, "BAD_REQUEST", err.Error(), http.StatusBadRequest)
+		return
+	}
+	withTags := query.Get("tags") == "true" || query.Get("tag") != ""
+
+	limit := DefaultSearchLimit
+	if n := query.Get("n"); n != "" {
+		if limit, err = strconv.Atoi(n); err != nil || limit < 1 {
+			writeErrorResponse(w, "BAD_REQUEST", "n must be a positive integer", http.StatusBadRequest)
+			return
+		}
+	}
+
+	up, err := p.resolveUpstream(r)
+	if err != nil {
+		writeErrorResponse(w, "UNAUTHORIZED", err.Error(), http.StatusUnauthorized)
+		return
+	}
+	defer up.release()
+
+	catalog, err := p.listRepositories(r.Context(), up)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	response := SearchResponse{Registry: up.registryURL, Results: []SearchResult{}, FetchedAt: catalog.FetchedAt}
+	for _, repo := range catalog.Items {
+		if !repoFilter.MatchString(repo) {
+			continue
+		}
+		if len(response.Results) == limit {
+			response.Truncated = true
+			break
+		}
+
+		result := SearchResult{Name: repo}
+		if withTags {
+			tags, err := p.listTags(r.Context(), up, repo)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			for _, tag := range tags.Items {
+				if tagFilter.MatchString(tag) {
+					result.Tags = append(result.Tags, tag)
+				}
+			}
+			if len(result.Tags) == 0 && query.Get("tag") != "" {
+				continue
+			}
+		}
+		response.Results = append(response.Results, result)
+	}
+
+	admin.WriteJSON(w, http.StatusOK, response)
+}
+
+// compileFilter builds a matcher from a regular expression or, when regex is empty, from a glob
+// pattern or case-insensitive substring. An empty filter matches everything.
+func compileFilter(pattern, regex string) (*regexp.Regexp, error) {
+	if regex != "" {
+		re, err := regexp.Compile(regex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex: %v", err)
+		}
+		return re, nil
+	}
+
+	if !strings.ContainsAny(pattern, "*?[") {
+		return regexp.MustCompile("(?i)" + regexp.QuoteMeta(pattern)), nil
+	}
+
+	re, err := regexp.Compile("^" + globToRegexp(pattern) + "$")
+	if err != nil {
+		return nil, fmt.Errorf("invalid glob %q: %v", pattern, err)
+	}
+	return re, nil
+}
+
+// globToRegexp translates a glob where * and ? also match slashes and [...] is a character class
+func globToRegexp(glob string) string {
+	var b strings.Builder
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		case '[':
+			end := strings.IndexByte(glob[i:], ']')
+			if end == -1 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return b.String()
+}
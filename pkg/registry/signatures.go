@@ -0,0 +1,268 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+
+	"vault-docker-proxy/pkg/logging"
+	"vault-docker-proxy/pkg/notation"
+)
+
+// maxSignatures bounds the signatures tried for a manifest
+const maxSignatures = 10
+
+// maxEnvelopeSize bounds the signature envelopes read into memory
+const maxEnvelopeSize = 1024 * 1024
+
+// errManifestTooLarge stops the copy of a manifest too large to hold for verification
+var errManifestTooLarge = errors.New("manifest too large to verify")
+
+// signatureVerification verifies the Notation signatures of pulled manifests
+type signatureVerification struct {
+	verifier *notation.Verifier
+	verified *cache.Cache // registry/repository@digest of manifests verified recently
+}
+
+// SetSignatureVerification makes manifest pulls verify the Notation signatures of the manifest
+// against the trust policy of its repository before the manifest is served. Manifests whose
+// signatures fail the policy are refused with a DENIED error. A verified manifest, and the
+// manifests of a verified index, are not verified again for ttl.
+func (p *ProxyServer) SetSignatureVerification(verifier *notation.Verifier, ttl time.Duration) {
+	p.signatures = &signatureVerification{verifier: verifier, verified: cache.New(ttl, 10*time.Minute)}
+}
+
+// serveVerifiedManifest serves a manifest GET with serve, holding the manifest back until its
+// signature is verified. HEAD requests only reveal the digest and are served as they are. The
+// whole manifest is needed to verify it, so Range and If-Range are not forwarded.
+func (p *ProxyServer) serveVerifiedManifest(w http.ResponseWriter, r *http.Request, up *upstream, path string, serve func(w http.ResponseWriter, r *http.Request) error) error {
+	if p.signatures == nil || r.Method != http.MethodGet || p.isDryRun(r) {
+		return serve(w, r)
+	}
+
+	if r.Header.Get("Range") != "" || r.Header.Get("If-Range") != "" {
+		r = r.Clone(r.Context())
+		r.Header.Del("Range")
+		r.Header.Del("If-Range")
+	}
+	hw := &heldManifestWriter{ResponseWriter: w}
+	err := serve(hw, r)
+	if !hw.holding {
+		return err
+	}
+	// Nothing was sent yet, so failures are still reported to the client
+	i := strings.LastIndex(path, "/manifests/")
+	repo := strings.TrimPrefix(path[:i], "/")
+	switch {
+	case hw.tooLarge:
+		err = fmt.Errorf("manifest is larger than %d bytes", maxManifestSize)
+	case hw.status == http.StatusPartialContent:
+		// Registries ignoring the missing Range header cannot be trusted with the rest either
+		err = errors.New("partial manifest responses cannot be verified")
+	case err != nil:
+		clearContentHeaders(w.Header())
+		code, status := errorCode(err)
+		writeErrorResponse(w, code, err.Error(), status)
+		return nil
+	default:
+		err = p.verifyManifest(r.Context(), up, repo, hw.Header().Get("Content-Type"), hw.body.Bytes())
+	}
+	if err != nil {
+		logging.FromContext(r.Context()).Warn("Signature verification denied a manifest", "repository", repo, "reason", err)
+		clearContentHeaders(w.Header())
+		writeErrorResponse(w, "DENIED", "signature verification failed: "+err.Error(), http.StatusForbidden)
+		return nil
+	}
+	w.WriteHeader(hw.status)
+	_, err = w.Write(hw.body.Bytes())
+	return err
+}
+
+// clearContentHeaders removes the headers of a held upstream response replaced by an error
+func clearContentHeaders(header http.Header) {
+	for _, name := range []string{"Content-Length", "Content-Encoding", "Docker-Content-Digest", "Etag", "Last-Modified", "Cache-Control", "Expires"} {
+		header.Del(name)
+	}
+}
+
+// verifyManifest checks the Notation signatures of a manifest against the trust policy of its
+// repository, returning why the manifest must not be served
+func (p *ProxyServer) verifyManifest(ctx context.Context, up *upstream, repo, mediaType string, raw []byte) error {
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(raw))
+	scope := registryHost(up.registryURL) + "/" + repo
+	key := scope + "@" + digest
+	if _, ok := p.signatures.verified.Get(key); ok {
+		return nil
+	}
+
+	policy, err := p.signatures.verifier.PolicyFor(scope)
+	if err != nil {
+		return err
+	}
+	if policy.SignatureVerification.Level == notation.LevelSkip {
+		return nil
+	}
+
+	target := notation.Target{MediaType: mediaType, Digest: digest, Size: int64(len(raw))}
+	signatures, err := p.notationSignatures(ctx, up, repo, digest)
+	if err != nil {
+		return err
+	}
+	err = errors.New("no Notation signature found")
+	for _, signature := range signatures {
+		var result *notation.Result
+		if result, err = p.verifyEnvelope(ctx, up, repo, policy, signature, target); err != nil {
+			continue
+		}
+		for _, logged := range result.Logged {
+			logging.FromContext(ctx).Warn("Signature verification failure ignored by the trust policy", "repository", scope, "digest", digest, "trust_policy", policy.Name, "reason", logged)
+		}
+		logging.FromContext(ctx).Info("Verified Notation signature", "repository", scope, "digest", digest, "trust_policy", policy.Name, "signer", result.Signer)
+		p.markVerified(scope, digest, raw)
+		return nil
+	}
+	if len(signatures) == 0 && policy.Action(notation.ValidationAuthenticity) != notation.ActionEnforce {
+		// Audit policies report unsigned manifests without refusing them
+		logging.FromContext(ctx).Warn("Manifest has no Notation signature", "repository", scope, "digest", digest, "trust_policy", policy.Name)
+		return nil
+	}
+	return err
+}
+
+// markVerified remembers a verified manifest and, for an index, the manifests it lists, which
+// clients pull next by digest and which are signed through the index
+func (p *ProxyServer) markVerified(scope, digest string, raw []byte) {
+	p.signatures.verified.SetDefault(scope+"@"+digest, true)
+	var manifest Manifest
+	if json.Unmarshal(raw, &manifest) != nil || !manifest.IsIndex() {
+		return
+	}
+	for _, child := range manifest.Manifests {
+		p.signatures.verified.SetDefault(scope+"@"+child.Digest, true)
+	}
+}
+
+// verifyEnvelope fetches the envelope of a signature manifest and verifies it
+func (p *ProxyServer) verifyEnvelope(ctx context.Context, up *upstream, repo string, policy *notation.TrustPolicy, signature string, target notation.Target) (*notation.Result, error) {
+	signatureManifest, err := p.fetchManifest(ctx, up, repo, signature)
+	if err != nil {
+		return nil, err
+	}
+	if len(signatureManifest.Layers) != 1 {
+		return nil, fmt.Errorf("signature %s has %d layers, expected 1", signature, len(signatureManifest.Layers))
+	}
+	layer := signatureManifest.Layers[0]
+	if layer.Size > maxEnvelopeSize {
+		return nil, fmt.Errorf("signature envelope of %d bytes is too large", layer.Size)
+	}
+
+	resp, err := p.fetch(ctx, up, http.MethodGet, fmt.Sprintf("/%s/blobs/%s", repo, layer.Digest), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	envelope, err := io.ReadAll(io.LimitReader(resp.Body, maxEnvelopeSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signature envelope: %v", err)
+	}
+	if digest := fmt.Sprintf("sha256:%x", sha256.Sum256(envelope)); digest != layer.Digest {
+		return nil, fmt.Errorf("signature envelope digest %s does not match %s", digest, layer.Digest)
+	}
+	return p.signatures.verifier.Verify(policy, layer.MediaType, envelope, target)
+}
+
+// notationSignatures lists the digests of the Notation signatures of a manifest with the
+// referrers API, or the referrers tag schema on registries without it
+func (p *ProxyServer) notationSignatures(ctx context.Context, up *upstream, repo, digest string) ([]string, error) {
+	header := http.Header{"Accept": {MediaTypeOCIIndex}}
+	resp, err := p.fetch(ctx, up, http.MethodGet, fmt.Sprintf("/%s/referrers/%s?artifactType=%s", repo, digest, url.QueryEscape(notation.ArtifactTypeSignature)), header)
+	var upstreamErr *UpstreamError
+	if errors.As(err, &upstreamErr) && (upstreamErr.StatusCode == http.StatusNotFound || upstreamErr.StatusCode == http.StatusMethodNotAllowed || upstreamErr.StatusCode == http.StatusBadRequest) {
+		tag := strings.Replace(digest, ":", "-", 1)
+		resp, err = p.fetch(ctx, up, http.MethodGet, fmt.Sprintf("/%s/manifests/%s", repo, tag), header)
+		if errors.As(err, &upstreamErr) && upstreamErr.StatusCode == http.StatusNotFound {
+			return nil, nil
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list signatures: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var index struct {
+		Manifests []struct {
+			Digest       string `json:"digest"`
+			ArtifactType string `json:"artifactType"`
+		} `json:"manifests"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxManifestSize)).Decode(&index); err != nil {
+		return nil, fmt.Errorf("failed to decode signature list: %v", err)
+	}
+	var signatures []string
+	for _, referrer := range index.Manifests {
+		if referrer.ArtifactType == notation.ArtifactTypeSignature && len(signatures) < maxSignatures {
+			signatures = append(signatures, referrer.Digest)
+		}
+	}
+	return signatures, nil
+}
+
+// heldManifestWriter holds back a successful (2xx) manifest response until its signature is
+// verified
+type heldManifestWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+	holding     bool
+	tooLarge    bool // the manifest outgrew maxManifestSize and was dropped
+	status      int
+	body        bytes.Buffer
+}
+
+func (hw *heldManifestWriter) WriteHeader(status int) {
+	if hw.wroteHeader {
+		return
+	}
+	hw.wroteHeader = true
+	if status < 200 || status > 299 {
+		hw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	hw.holding, hw.status = true, status
+}
+
+func (hw *heldManifestWriter) Write(p []byte) (int, error) {
+	if !hw.wroteHeader {
+		hw.WriteHeader(http.StatusOK)
+	}
+	if !hw.holding {
+		return hw.ResponseWriter.Write(p)
+	}
+	if hw.tooLarge || hw.body.Len()+len(p) > maxManifestSize {
+		hw.tooLarge = true
+		hw.body.Reset()
+		return 0, errManifestTooLarge
+	}
+	return hw.body.Write(p)
+}
+
+// Flush implements http.Flusher; held manifests are sent once verified
+func (hw *heldManifestWriter) Flush() {
+	if !hw.holding {
+		http.NewResponseController(hw.ResponseWriter).Flush()
+	}
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (hw *heldManifestWriter) Unwrap() http.ResponseWriter {
+	return hw.ResponseWriter
+}
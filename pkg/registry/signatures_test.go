@@ -0,0 +1,107 @@
+package registry
+
+import (
+	"bytes"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"vault-docker-proxy/pkg/auth"
+	"vault-docker-proxy/pkg/notation"
+)
+
+var testManifest = []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","config":{"mediaType":"application/vnd.oci.image.config.v1+json","digest":"sha256:0000000000000000000000000000000000000000000000000000000000000000","size":2},"layers":[]}`)
+
+// newManifestUpstream returns a registry serving an unsigned manifest as library/app:latest.
+// status, when set, replaces the status of the manifest response.
+func newManifestUpstream(t *testing.T, status int) (*httptest.Server, *[]*http.Request) {
+	t.Helper()
+	var requests []*http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r)
+		if r.URL.Path != "/v2/library/app/manifests/latest" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", MediaTypeOCIManifest)
+		if status != 0 {
+			w.WriteHeader(status)
+			w.Write(testManifest)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(testManifest))
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+// newStrictProxy returns a proxy server verifying every manifest with a strict trust policy
+func newStrictProxy(t *testing.T, client *http.Client) *ProxyServer {
+	t.Helper()
+	verifier, err := notation.NewVerifier(notation.TrustPolicyDocument{
+		Version: "1.0",
+		TrustPolicies: []notation.TrustPolicy{{
+			Name:                  "strict",
+			RegistryScopes:        []string{"*"},
+			SignatureVerification: notation.SignatureVerification{Level: notation.LevelStrict},
+			TrustStores:           []string{"ca:test"},
+			TrustedIdentities:     []string{"*"},
+		}},
+	}, map[string][]*x509.Certificate{"ca:test": nil})
+	if err != nil {
+		t.Fatalf("NewVerifier: %v", err)
+	}
+	p := NewProxyServerWithClient(nil, client)
+	p.SetSignatureVerification(verifier, time.Minute)
+	return p
+}
+
+func TestSignatureVerificationPartialContent(t *testing.T) {
+	tests := []struct {
+		name           string
+		upstreamStatus int
+		header         map[string]string
+	}{
+		{name: "plain GET"},
+		{name: "Range request", header: map[string]string{"Range": "bytes=0-"}},
+		{name: "If-Range request", header: map[string]string{"Range": "bytes=0-", "If-Range": `"etag"`}},
+		{name: "upstream answering 206", upstreamStatus: http.StatusPartialContent},
+		{name: "upstream answering 203", upstreamStatus: http.StatusNonAuthoritativeInfo},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, requests := newManifestUpstream(t, tt.upstreamStatus)
+			p := newStrictProxy(t, server.Client())
+
+			path := "/library/app/manifests/latest"
+			r := httptest.NewRequest(http.MethodGet, "/v2"+path, nil)
+			for name, value := range tt.header {
+				r.Header.Set(name, value)
+			}
+			registryConfig := &auth.RegistryConfig{RegistryURL: server.URL, VaultPath: "registry/test"}
+			credentials := testCredentials()
+			w := httptest.NewRecorder()
+			err := p.serveVerifiedManifest(w, r, newUpstream(registryConfig, credentials), path, func(w http.ResponseWriter, r *http.Request) error {
+				return p.proxyRequest(w, r, credentials, registryConfig, path)
+			})
+			if err != nil {
+				t.Fatalf("serveVerifiedManifest: %v", err)
+			}
+
+			if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "DENIED") {
+				t.Errorf("unsigned manifest served: status %d, body %q", w.Code, w.Body.String())
+			}
+			for _, upstreamReq := range *requests {
+				if upstreamReq.Header.Get("Range") != "" || upstreamReq.Header.Get("If-Range") != "" {
+					t.Errorf("Range forwarded upstream: %s %s", upstreamReq.Method, upstreamReq.URL.Path)
+				}
+			}
+			if r.Header.Get("Range") != tt.header["Range"] {
+				t.Errorf("client request modified: Range = %q", r.Header.Get("Range"))
+			}
+		})
+	}
+}
@@ -0,0 +1,230 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"vault-docker-proxy/pkg/logging"
+)
+
+// errSizeLimit stops the copy of a response that grew past a size limit
+var errSizeLimit = errors.New("response exceeds the size limit")
+
+// SizeLimits caps the size of content pulled through the proxy; zero disables a limit
+type SizeLimits struct {
+	MaxBlobSize  int64 // size of a single blob
+	MaxImageSize int64 // config and layer sizes listed in an image manifest
+}
+
+// SetSizeLimits enables the size limits enforced by SizeLimitMiddleware
+func (p *ProxyServer) SetSizeLimits(limits SizeLimits) {
+	p.sizeLimits = limits
+}
+
+// SizeLimitMiddleware rejects pulls of oversized content with a DENIED error. Blobs are checked
+// against their Content-Length, or cut off once they grow past the limit when it is unknown.
+// Image manifests are held back until their layer sizes are checked, so clients never start
+// pulling an image that would be rejected; indexes pass, as each platform manifest is checked
+// when pulled. Manifests are requested whole, without Range and If-Range, so they can be checked.
+func (p *ProxyServer) SizeLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		lw := &sizeLimitWriter{ResponseWriter: w, ctx: r.Context(), limits: p.sizeLimits, path: r.URL.Path}
+		switch {
+		case strings.Contains(r.URL.Path, "/blobs/") && p.sizeLimits.MaxBlobSize > 0:
+			lw.blob = true
+		case strings.Contains(r.URL.Path, "/manifests/") && r.Method == http.MethodGet:
+			lw.manifest = true
+			if r.Header.Get("Range") != "" || r.Header.Get("If-Range") != "" {
+				r = r.Clone(r.Context())
+				r.Header.Del("Range")
+				r.Header.Del("If-Range")
+			}
+		default:
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		next.ServeHTTP(lw, r)
+		if lw.holding {
+			lw.release()
+		}
+		if lw.exceeded {
+			// The status line is already sent; abort so the client does not take a truncated blob
+			// for a complete one
+			panic(http.ErrAbortHandler)
+		}
+	})
+}
+
+// sizeLimitWriter enforces the size limits on a blob or manifest response
+type sizeLimitWriter struct {
+	http.ResponseWriter
+	ctx         context.Context
+	limits      SizeLimits
+	path        string
+	blob        bool
+	manifest    bool
+	wroteHeader bool
+	rejected    bool // the response was replaced by a policy error
+	holding     bool // the manifest is buffered until checked
+	exceeded    bool // a blob of unknown size grew past the limit
+	status      int
+	written     int64
+	body        bytes.Buffer
+}
+
+func (lw *sizeLimitWriter) WriteHeader(status int) {
+	if lw.wroteHeader {
+		return
+	}
+	lw.wroteHeader = true
+	if status == http.StatusPartialContent && lw.blob {
+		// A resumed download is checked against the size of the whole blob
+		if size, ok := contentRangeSize(lw.Header().Get("Content-Range")); ok && size > lw.limits.MaxBlobSize {
+			lw.reject(fmt.Sprintf("blob of %d bytes exceeds the maximum blob size of %d bytes", size, lw.limits.MaxBlobSize))
+			return
+		}
+		lw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if status == http.StatusPartialContent && lw.manifest {
+		// Sent by registries ignoring the missing Range header; a part of a manifest cannot be checked
+		lw.reject("partial manifest responses cannot be checked against the size limits")
+		return
+	}
+	if status != http.StatusOK {
+		lw.blob, lw.manifest = false, false
+		lw.ResponseWriter.WriteHeader(status)
+		return
+	}
+
+	switch {
+	case lw.blob:
+		size, err := strconv.ParseInt(lw.Header().Get("Content-Length"), 10, 64)
+		if err == nil && size > lw.limits.MaxBlobSize {
+			lw.reject(fmt.Sprintf("blob of %d bytes exceeds the maximum blob size of %d bytes", size, lw.limits.MaxBlobSize))
+			return
+		}
+	case lw.manifest && isImageManifest(lw.Header().Get("Content-Type")):
+		lw.holding, lw.status = true, status
+		return
+	}
+	lw.manifest = false
+	lw.ResponseWriter.WriteHeader(status)
+}
+
+func (lw *sizeLimitWriter) Write(p []byte) (int, error) {
+	if !lw.wroteHeader {
+		lw.WriteHeader(http.StatusOK)
+	}
+	switch {
+	case lw.rejected, lw.exceeded:
+		return 0, errSizeLimit
+	case lw.holding:
+		if lw.body.Len()+len(p) <= maxManifestSize {
+			return lw.body.Write(p)
+		}
+		// Too large to be an image manifest worth checking, send it as is
+		lw.holding = false
+		lw.ResponseWriter.WriteHeader(lw.status)
+		if _, err := lw.ResponseWriter.Write(lw.body.Bytes()); err != nil {
+			return 0, err
+		}
+	case lw.blob:
+		lw.written += int64(len(p))
+		if lw.written > lw.limits.MaxBlobSize {
+			lw.exceeded = true
+			logging.FromContext(lw.ctx).Warn("Size limit cut off a blob at the maximum blob size", "path", lw.path, "max_blob_size", lw.limits.MaxBlobSize)
+			return 0, errSizeLimit
+		}
+	}
+	return lw.ResponseWriter.Write(p)
+}
+
+// release checks a held manifest and sends it, or a policy error when the image is too large
+func (lw *sizeLimitWriter) release() {
+	lw.holding = false
+	if err := lw.checkManifest(lw.body.Bytes()); err != nil {
+		lw.reject(err.Error())
+		return
+	}
+	lw.ResponseWriter.WriteHeader(lw.status)
+	lw.ResponseWriter.Write(lw.body.Bytes())
+}
+
+// checkManifest checks the blob sizes listed in an image manifest against the limits.
+// Manifests that cannot be decoded are left for the client to reject.
+func (lw *sizeLimitWriter) checkManifest(raw []byte) error {
+	var manifest Manifest
+	if json.Unmarshal(raw, &manifest) != nil || manifest.IsIndex() {
+		return nil
+	}
+
+	total := manifest.Config.Size
+	for _, layer := range manifest.Layers {
+		if lw.limits.MaxBlobSize > 0 && layer.Size > lw.limits.MaxBlobSize {
+			return fmt.Errorf("layer %s of %d bytes exceeds the maximum blob size of %d bytes", layer.Digest, layer.Size, lw.limits.MaxBlobSize)
+		}
+		total += layer.Size
+	}
+	if lw.limits.MaxImageSize > 0 && total > lw.limits.MaxImageSize {
+		return fmt.Errorf("image of %d bytes exceeds the maximum image size of %d bytes", total, lw.limits.MaxImageSize)
+	}
+	return nil
+}
+
+// reject replaces the response with a DENIED policy error
+func (lw *sizeLimitWriter) reject(message string) {
+	lw.rejected, lw.holding = true, false
+	logging.FromContext(lw.ctx).Warn("Size limit denied", "path", lw.path, "reason", message)
+
+	header := lw.Header()
+	for _, name := range []string{"Content-Length", "Content-Encoding", "Content-Range", "Docker-Content-Digest", "Etag", "Last-Modified", "Cache-Control", "Expires"} {
+		header.Del(name)
+	}
+	writeErrorResponse(lw.ResponseWriter, "DENIED", message, http.StatusForbidden)
+}
+
+// Flush implements http.Flusher for streamed blobs; held manifests are sent once checked
+func (lw *sizeLimitWriter) Flush() {
+	if lw.holding || lw.rejected {
+		return
+	}
+	// The writers it wraps, such as the access log, may only expose Unwrap
+	http.NewResponseController(lw.ResponseWriter).Flush()
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (lw *sizeLimitWriter) Unwrap() http.ResponseWriter {
+	return lw.ResponseWriter
+}
+
+// contentRangeSize returns the complete length in a Content-Range header, such as 1000 in
+// "bytes 500-999/1000", when it is known
+func contentRangeSize(value string) (int64, bool) {
+	_, total, ok := strings.Cut(value, "/")
+	if !ok {
+		return 0, false
+	}
+	size, err := strconv.ParseInt(total, 10, 64)
+	return size, err == nil
+}
+
+// isImageManifest reports whether a content type is that of an image manifest, as opposed to an
+// index. Schema 1 manifests do not list layer sizes and are not checked.
+func isImageManifest(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return mediaType == MediaTypeDockerManifest || mediaType == MediaTypeOCIManifest
+}
@@ -0,0 +1,84 @@
+package registry
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"vault-docker-proxy/pkg/auth"
+)
+
+// largeImageManifest lists a layer of 1000 bytes
+var largeImageManifest = []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","config":{"mediaType":"application/vnd.oci.image.config.v1+json","digest":"sha256:0000000000000000000000000000000000000000000000000000000000000000","size":10},"layers":[{"mediaType":"application/vnd.oci.image.layer.v1.tar+gzip","digest":"sha256:1111111111111111111111111111111111111111111111111111111111111111","size":1000}]}`)
+
+func TestSizeLimitManifestRange(t *testing.T) {
+	tests := []struct {
+		name           string
+		limits         SizeLimits
+		upstreamStatus int
+		header         map[string]string
+		status         int
+	}{
+		{name: "within the limit", limits: SizeLimits{MaxImageSize: 2000}, status: http.StatusOK},
+		{name: "plain GET", limits: SizeLimits{MaxImageSize: 500}, status: http.StatusForbidden},
+		{name: "Range request", limits: SizeLimits{MaxImageSize: 500}, header: map[string]string{"Range": "bytes=0-"}, status: http.StatusForbidden},
+		{name: "If-Range request", limits: SizeLimits{MaxImageSize: 500}, header: map[string]string{"Range": "bytes=0-10", "If-Range": `"etag"`}, status: http.StatusForbidden},
+		{name: "Range within the limit", limits: SizeLimits{MaxImageSize: 2000}, header: map[string]string{"Range": "bytes=0-10"}, status: http.StatusOK},
+		{name: "upstream answering 206", limits: SizeLimits{MaxImageSize: 2000}, upstreamStatus: http.StatusPartialContent, status: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ranges []string
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				ranges = append(ranges, r.Header.Get("Range")+r.Header.Get("If-Range"))
+				w.Header().Set("Content-Type", MediaTypeOCIManifest)
+				if tt.upstreamStatus != 0 {
+					w.Header().Set("Content-Range", "bytes 0-9/"+strconv.Itoa(len(largeImageManifest)))
+					w.WriteHeader(tt.upstreamStatus)
+					w.Write(largeImageManifest[:10])
+					return
+				}
+				http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(largeImageManifest))
+			}))
+			defer upstream.Close()
+
+			p := NewProxyServerWithClient(nil, upstream.Client())
+			p.SetSizeLimits(tt.limits)
+			path := "/library/app/manifests/latest"
+			registryConfig := &auth.RegistryConfig{RegistryURL: upstream.URL, VaultPath: "registry/test"}
+			handler := p.SizeLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				// Rejected responses stop the copy of the upstream body
+				if err := p.proxyRequest(w, r, testCredentials(), registryConfig, path); err != nil && !errors.Is(err, errSizeLimit) {
+					t.Errorf("proxyRequest: %v", err)
+				}
+			}))
+
+			r := httptest.NewRequest(http.MethodGet, "/v2"+path, nil)
+			for name, value := range tt.header {
+				r.Header.Set(name, value)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+			if tt.status == http.StatusForbidden && !strings.Contains(w.Body.String(), "DENIED") {
+				t.Errorf("body = %q, want a DENIED error", w.Body.String())
+			}
+			if tt.status == http.StatusOK && !bytes.Equal(w.Body.Bytes(), largeImageManifest) {
+				t.Errorf("body = %q, want the whole manifest", w.Body.String())
+			}
+			for _, forwarded := range ranges {
+				if forwarded != "" {
+					t.Errorf("Range forwarded upstream: %q", forwarded)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package registry
+
+import (
+	"net/http"
+	"sync/atomic"
+
+	"vault-docker-proxy/pkg/admin"
+	"vault-docker-proxy/pkg/cache"
+)
+
+// ProxyStats is a snapshot of the proxy's credential resolution counters
+type ProxyStats struct {
+	CacheHits   uint64 `json:"cache_hits"`
+	CacheMisses uint64 `json:"cache_misses"`
+	VaultCalls  uint64 `json:"vault_calls"`
+	VaultErrors uint64 `json:"vault_errors"`
+	// VaultReadsShared counts cache misses served by joining a Vault read already in flight
+	VaultReadsShared uint64 `json:"vault_reads_shared"`
+	// NegativeCacheHits counts Vault reads not made because the same read failed recently
+	NegativeCacheHits uint64 `json:"negative_cache_hits"`
+	// CredentialCache counts the operations of the credential cache itself, which also include the
+	// lookups of lease renewals and login checks
+	CredentialCache cache.Stats `json:"credential_cache"`
+	// CacheBackend counts the operations of the credential cache backend, if there is one
+	CacheBackend *cache.BackendStats `json:"cache_backend,omitempty"`
+}
+
+// proxyCounters holds the live counters behind ProxyStats
+type proxyCounters struct {
+	cacheHits   atomic.Uint64
+	cacheMisses atomic.Uint64
+	vaultCalls  atomic.Uint64
+	vaultErrors atomic.Uint64
+
+	vaultReadsShared  atomic.Uint64
+	negativeCacheHits atomic.Uint64
+}
+
+// Stats returns a snapshot of the proxy counters
+func (p *ProxyServer) Stats() ProxyStats {
+	stats := ProxyStats{
+		CacheHits:   p.counters.cacheHits.Load(),
+		CacheMisses: p.counters.cacheMisses.Load(),
+		VaultCalls:  p.counters.vaultCalls.Load(),
+		VaultErrors: p.counters.vaultErrors.Load(),
+
+		VaultReadsShared:  p.counters.vaultReadsShared.Load(),
+		NegativeCacheHits: p.counters.negativeCacheHits.Load(),
+		CredentialCache:   p.cache.Stats(),
+	}
+	if backendStats, ok := p.cache.BackendStats(); ok {
+		stats.CacheBackend = &backendStats
+	}
+	return stats
+}
+
+// StatsHandler serves the proxy counters as JSON on the admin listener
+func (p *ProxyServer) StatsHandler(w http.ResponseWriter, r *http.Request) {
+	admin.WriteJSON(w, http.StatusOK, p.Stats())
+}
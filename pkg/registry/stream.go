@@ -0,0 +1,104 @@
+package registry
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DefaultFlushInterval is how long data written to a client may sit in the server's buffers
+const DefaultFlushInterval = 100 * time.Millisecond
+
+// streamBufferSize is the size of the buffer upstream bodies are copied through
+const streamBufferSize = 32 * 1024
+
+// streamBuffers are reused between copies, as every pull copies several bodies
+var streamBuffers = sync.Pool{New: func() any { return new([streamBufferSize]byte) }}
+
+// SetFlushInterval sets how often response data streamed from upstream registries is flushed
+// to the client, so large blobs reach clients as they arrive and progress bars move. Zero leaves
+// flushing to the server, which sends data as its buffers fill; negative intervals flush after
+// every write.
+func (p *ProxyServer) SetFlushInterval(interval time.Duration) {
+	p.flushInterval = interval
+}
+
+// streamBody sends the response status and copies an upstream body to the client, flushing the
+// headers right away and the data every flush interval
+func (p *ProxyServer) streamBody(w http.ResponseWriter, status int, body io.Reader) error {
+	w.WriteHeader(status)
+	if p.flushInterval == 0 {
+		_, err := copyBuffered(w, body)
+		return err
+	}
+	// Errors mean the writer cannot flush, such as a response recorder
+	flusher := http.NewResponseController(w)
+	flusher.Flush()
+
+	dst := &flushingWriter{w: w, flusher: flusher, interval: p.flushInterval}
+	defer dst.stop()
+	_, err := copyBuffered(dst, body)
+	return err
+}
+
+// copyBuffered copies src to dst through a pooled buffer
+func copyBuffered(dst io.Writer, src io.Reader) (int64, error) {
+	buf := streamBuffers.Get().(*[streamBufferSize]byte)
+	defer streamBuffers.Put(buf)
+	return io.CopyBuffer(dst, src, buf[:])
+}
+
+// flushingWriter flushes the data written to it at most interval after it was written, so a
+// slow upstream does not leave part of a blob in the server's buffers
+type flushingWriter struct {
+	w        io.Writer
+	flusher  *http.ResponseController
+	interval time.Duration
+
+	mu      sync.Mutex // the timer flushes concurrently with writes
+	timer   *time.Timer
+	pending bool // a flush is scheduled
+	stopped bool
+}
+
+func (fw *flushingWriter) Write(p []byte) (int, error) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	n, err := fw.w.Write(p)
+	if fw.interval < 0 {
+		fw.flusher.Flush()
+		return n, err
+	}
+	if !fw.pending {
+		fw.pending = true
+		if fw.timer == nil {
+			fw.timer = time.AfterFunc(fw.interval, fw.delayedFlush)
+		} else {
+			fw.timer.Reset(fw.interval)
+		}
+	}
+	return n, err
+}
+
+// delayedFlush flushes the data written since the last flush
+func (fw *flushingWriter) delayedFlush() {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	if !fw.pending || fw.stopped {
+		return
+	}
+	fw.pending = false
+	fw.flusher.Flush()
+}
+
+// stop cancels the scheduled flush once the copy is over; the server flushes the rest when the
+// handler returns
+func (fw *flushingWriter) stop() {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	fw.stopped = true
+	if fw.timer != nil {
+		fw.timer.Stop()
+	}
+}
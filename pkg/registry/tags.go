@@ -0,0 +1,160 @@
+package registry
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"vault-docker-proxy/pkg/admin"
+)
+
+// Query parameters on tags/list handled by the proxy rather than the upstream registry
+const (
+	TagFilterParam = "filter"
+	TagLastNParam  = "last-n"
+)
+
+// hasTagExtensions reports whether a tags/list request uses proxy extension parameters
+func hasTagExtensions(r *http.Request) bool {
+	query := r.URL.Query()
+	return query.Has(TagFilterParam) || query.Has(TagLastNParam)
+}
+
+// serveFilteredTags answers a tags/list request using the extension parameters: filter (glob or
+// substring) selects tags, and last-n returns the n highest tags in semantic version order.
+// Filtered results are always sorted by semantic version.
+func (p *ProxyServer) serveFilteredTags(w http.ResponseWriter, r *http.Request, repo string) {
+	query := r.URL.Query()
+
+	filter, err := compileFilter(query.Get(TagFilterParam), "")
+	if err != nil {
+		writeErrorResponse(w, "BAD_REQUEST", err.Error(), http.StatusBadRequest)
+		return
+	}
+	lastN := 0
+	if value := query.Get(TagLastNParam); value != "" {
+		if lastN, err = strconv.Atoi(value); err != nil || lastN < 1 {
+			writeErrorResponse(w, "BAD_REQUEST", fmt.Sprintf("%s must be a positive integer", TagLastNParam), http.StatusBadRequest)
+			return
+		}
+	}
+
+	up, err := p.resolveUpstream(r)
+	if err != nil {
+		writeErrorResponse(w, "UNAUTHORIZED", err.Error(), http.StatusUnauthorized)
+		return
+	}
+	defer up.release()
+
+	listing, err := p.listTags(r.Context(), up, repo)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	tags := []string{}
+	for _, tag := range listing.Items {
+		if filter.MatchString(tag) {
+			tags = append(tags, tag)
+		}
+	}
+	sort.SliceStable(tags, func(i, j int) bool { return compareVersions(tags[i], tags[j]) < 0 })
+	if lastN > 0 && len(tags) > lastN {
+		tags = tags[len(tags)-lastN:]
+	}
+
+	admin.WriteJSON(w, http.StatusOK, map[string]interface{}{"name": repo, "tags": tags})
+}
+
+// semver is a parsed semantic version; tags that are not versions have ok unset
+type semver struct {
+	ok         bool
+	numbers    [3]int
+	prerelease string
+}
+
+// parseSemver parses tags such as 1.2.3, v1.2, 1.2.3-rc.1 and 1.2.3+build
+func parseSemver(tag string) semver {
+	version := strings.TrimPrefix(tag, "v")
+	version, _, _ = strings.Cut(version, "+")
+	version, prerelease, _ := strings.Cut(version, "-")
+
+	parts := strings.Split(version, ".")
+	if len(parts) > 3 {
+		return semver{}
+	}
+	v := semver{ok: true, prerelease: prerelease}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return semver{}
+		}
+		v.numbers[i] = n
+	}
+	return v
+}
+
+// compareVersions orders tags by semantic version. Tags that are not versions sort before all
+// versions, in lexical order; pre-releases sort before the corresponding release.
+func compareVersions(a, b string) int {
+	va, vb := parseSemver(a), parseSemver(b)
+	if !va.ok || !vb.ok {
+		if va.ok != vb.ok {
+			if va.ok {
+				return 1
+			}
+			return -1
+		}
+		return strings.Compare(a, b)
+	}
+
+	for i := range va.numbers {
+		if va.numbers[i] != vb.numbers[i] {
+			if va.numbers[i] < vb.numbers[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	if va.prerelease != vb.prerelease {
+		if va.prerelease == "" {
+			return 1
+		}
+		if vb.prerelease == "" {
+			return -1
+		}
+		if c := comparePrerelease(va.prerelease, vb.prerelease); c != 0 {
+			return c
+		}
+	}
+	return strings.Compare(a, b)
+}
+
+// comparePrerelease compares dot-separated pre-release identifiers, numerically where possible
+func comparePrerelease(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		an, aErr := strconv.Atoi(as[i])
+		bn, bErr := strconv.Atoi(bs[i])
+		switch {
+		case aErr == nil && bErr == nil:
+			if an != bn {
+				if an < bn {
+					return -1
+				}
+				return 1
+			}
+		case aErr == nil:
+			return -1
+		case bErr == nil:
+			return 1
+		default:
+			if c := strings.Compare(as[i], bs[i]); c != 0 {
+				return c
+			}
+		}
+	}
+	return len(as) - len(bs)
+}
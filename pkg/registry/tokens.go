@@ -0,0 +1,227 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"vault-docker-proxy/pkg/admin"
+	"vault-docker-proxy/pkg/auth"
+	"vault-docker-proxy/pkg/logging"
+	"vault-docker-proxy/pkg/token"
+	"vault-docker-proxy/pkg/vault"
+)
+
+// tokenService holds the state needed to issue refresh and access tokens
+type tokenService struct {
+	manager    *token.Manager
+	store      *token.RefreshStore
+	accessTTL  time.Duration
+	refreshTTL time.Duration
+	service    string // service of the token server, empty when it is disabled
+}
+
+// SetTokenService enables refresh and access tokens. Access tokens can then be used instead of
+// a Vault token as the password of proxy requests.
+func (p *ProxyServer) SetTokenService(manager *token.Manager, store *token.RefreshStore, accessTTL, refreshTTL time.Duration) {
+	p.tokens = &tokenService{manager: manager, store: store, accessTTL: accessTTL, refreshTTL: refreshTTL}
+}
+
+// IssueRefreshToken handles POST /ext/token/refresh - exchange the proxy username and a Vault
+// token for a long-lived refresh token. Optional form values: ttl (at most the configured refresh
+// TTL) and description.
+func (p *ProxyServer) IssueRefreshToken(w http.ResponseWriter, r *http.Request) {
+	if p.tokens == nil {
+		writeErrorResponse(w, "UNSUPPORTED", "token signing is not configured", http.StatusNotFound)
+		return
+	}
+
+	username, vaultToken, ok := r.BasicAuth()
+	if !ok {
+		writeErrorResponse(w, "UNAUTHORIZED", "basic authentication with a Vault token is required", http.StatusUnauthorized)
+		return
+	}
+	registryConfig, err := auth.ParseUsername(username)
+	if err != nil {
+		writeErrorResponse(w, "UNAUTHORIZED", err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if vaultToken == "" || isAccessToken(vaultToken) || vault.IsAppRolePassword(vaultToken) || vault.IsWrappedPassword(vaultToken) {
+		writeErrorResponse(w, "UNAUTHORIZED", "refresh tokens can only be issued for a Vault token", http.StatusUnauthorized)
+		return
+	}
+
+	ttl := p.tokens.refreshTTL
+	if value := r.FormValue("ttl"); value != "" {
+		requested, err := time.ParseDuration(value)
+		if err != nil || requested <= 0 || requested > p.tokens.refreshTTL {
+			writeErrorResponse(w, "BAD_REQUEST", fmt.Sprintf("ttl must be a positive duration of at most %s", p.tokens.refreshTTL), http.StatusBadRequest)
+			return
+		}
+		ttl = requested
+	}
+
+	// Make sure the Vault token can actually read the credentials before handing out a session
+	credentials, err := p.credentialsFor(withAuditRequest(r), registryConfig, vaultToken)
+	if err != nil {
+		writeErrorResponse(w, "UNAUTHORIZED", err.Error(), http.StatusUnauthorized)
+		return
+	}
+	credentials.Wipe()
+
+	refreshToken, session, err := p.tokens.store.Create(*registryConfig, vaultToken, r.FormValue("description"), ttl)
+	if err != nil {
+		writeErrorResponse(w, "UNKNOWN", "failed to create refresh token", http.StatusInternalServerError)
+		return
+	}
+
+	logging.FromContext(r.Context()).Info("Issued refresh token", "token_id", session.ID, "expires_at", session.ExpiresAt.Format(time.RFC3339))
+	admin.WriteJSON(w, http.StatusCreated, map[string]interface{}{
+		"id":            session.ID,
+		"refresh_token": refreshToken,
+		"expires_at":    session.ExpiresAt,
+	})
+}
+
+// ExchangeRefreshToken handles POST /ext/token/access - exchange a refresh token, given as the
+// refresh_token form value or as a Bearer token, for a short-lived access token
+func (p *ProxyServer) ExchangeRefreshToken(w http.ResponseWriter, r *http.Request) {
+	if p.tokens == nil {
+		writeErrorResponse(w, "UNSUPPORTED", "token signing is not configured", http.StatusNotFound)
+		return
+	}
+
+	refreshToken := r.PostFormValue("refresh_token")
+	if refreshToken == "" {
+		refreshToken = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+
+	session, err := p.tokens.store.Use(refreshToken)
+	if err != nil {
+		writeErrorResponse(w, "UNAUTHORIZED", err.Error(), http.StatusUnauthorized)
+		return
+	}
+	logRegistry(r.Context(), &session.Registry)
+	if err := p.vaultClient.LookupToken(vault.WithNamespace(r.Context(), session.Registry.Namespace), session.VaultToken()); err != nil {
+		logging.FromContext(r.Context()).Warn("Refresh token refused", "token_id", session.ID, "error", err)
+		writeErrorResponse(w, "UNAUTHORIZED", "the Vault token behind this refresh token is no longer valid", http.StatusUnauthorized)
+		return
+	}
+
+	expiresAt := time.Now().Add(p.tokens.accessTTL)
+	accessToken, err := p.tokens.manager.Issue(r.Context(), map[string]interface{}{
+		"sub":        session.ID,
+		"typ":        "access",
+		"registry":   session.Registry.RegistryURL,
+		"vault_path": session.Registry.VaultPath,
+		"exp":        expiresAt.Unix(),
+	})
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Failed to issue access token", "error", err)
+		writeErrorResponse(w, "UNAVAILABLE", "failed to issue access token", http.StatusServiceUnavailable)
+		return
+	}
+
+	admin.WriteJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": accessToken,
+		"expires_in":   int(p.tokens.accessTTL.Seconds()),
+		"expires_at":   expiresAt,
+	})
+}
+
+// ListRefreshTokens handles GET /admin/token/refresh on the admin listener
+func (p *ProxyServer) ListRefreshTokens(w http.ResponseWriter, r *http.Request) {
+	if p.tokens == nil {
+		admin.WriteJSON(w, http.StatusOK, []token.SessionInfo{})
+		return
+	}
+	admin.WriteJSON(w, http.StatusOK, p.tokens.store.List())
+}
+
+// RevokeRefreshToken handles DELETE /admin/token/refresh/{id} on the admin listener. Access
+// tokens issued from the refresh token stop working immediately.
+func (p *ProxyServer) RevokeRefreshToken(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if p.tokens == nil || !p.tokens.store.Revoke(id) {
+		admin.WriteError(w, "NOT_FOUND", fmt.Sprintf("no refresh token with id %s", id), http.StatusNotFound)
+		return
+	}
+	logging.FromContext(r.Context()).Info("Revoked refresh token", "token_id", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// SetAppRoleLogins accepts AppRole credentials (approle:<role_id>:<secret_id>) as password,
+// logging in with them for a Vault token
+func (p *ProxyServer) SetAppRoleLogins(logins *vault.AppRoleLogins) {
+	p.appRoles = logins
+}
+
+// SetWrappedTokens accepts response-wrapping tokens (wrapped:<wrapping_token>) as password,
+// unwrapping them for the Vault token they wrap
+func (p *ProxyServer) SetWrappedTokens(wrapped *vault.WrappedTokens) {
+	p.wrapped = wrapped
+}
+
+// SetSharedToken makes requests with an empty password use the proxy's own Vault token, for
+// deployments where the proxy logs in to Vault on behalf of its clients
+func (p *ProxyServer) SetSharedToken(enabled bool) {
+	p.sharedToken = enabled
+}
+
+// resolveVaultToken returns the Vault token for a request password, which is either a Vault
+// token, AppRole credentials or a wrapping token when enabled, an access token issued by the
+// proxy for the same registry and Vault path, or empty for the proxy's own token when shared
+func (p *ProxyServer) resolveVaultToken(ctx context.Context, registryConfig *auth.RegistryConfig, password string) (string, error) {
+	if password == "" && p.sharedToken {
+		if token := p.vaultClient.Token(); token != "" {
+			return token, nil
+		}
+		return "", fmt.Errorf("%w: the proxy has no Vault token to share", vault.ErrInvalidToken)
+	}
+	if p.appRoles != nil && vault.IsAppRolePassword(password) {
+		return p.appRoles.Token(vault.WithNamespace(ctx, registryConfig.Namespace), password)
+	}
+	if p.wrapped != nil && vault.IsWrappedPassword(password) {
+		return p.wrapped.Token(vault.WithNamespace(ctx, registryConfig.Namespace), password)
+	}
+	if p.tokens == nil || !isAccessToken(password) {
+		return password, nil
+	}
+
+	claims, err := p.tokens.manager.Verify(ctx, password)
+	if err != nil {
+		if errors.Is(err, token.ErrTokenExpired) {
+			return "", fmt.Errorf("access token expired, exchange the refresh token for a new one")
+		}
+		return "", fmt.Errorf("access token rejected: %v", err)
+	}
+	if claims["typ"] != "access" {
+		return "", fmt.Errorf("access token rejected: not an access token")
+	}
+
+	sessionID, _ := claims["sub"].(string)
+	session, ok := p.tokens.store.Get(sessionID)
+	if !ok {
+		return "", fmt.Errorf("access token rejected: refresh token revoked or expired")
+	}
+	if session.Registry.SecretPath() != registryConfig.SecretPath() || session.Registry.RegistryURL != registryConfig.RegistryURL {
+		return "", fmt.Errorf("access token was issued for registry %s and vault path %s", session.Registry.RegistryURL, session.Registry.SecretPath())
+	}
+
+	vaultToken := session.VaultToken()
+	if vaultToken == "" {
+		// Revoked between the lookup and now
+		return "", fmt.Errorf("access token rejected: refresh token revoked or expired")
+	}
+	return vaultToken, nil
+}
+
+// isAccessToken reports whether a password looks like a JWT rather than a Vault token
+func isAccessToken(password string) bool {
+	return strings.HasPrefix(password, "eyJ") && strings.Count(password, ".") == 2
+}
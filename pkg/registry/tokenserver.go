@@ -0,0 +1,174 @@
+package registry
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"vault-docker-proxy/pkg/admin"
+	"vault-docker-proxy/pkg/auth"
+	"vault-docker-proxy/pkg/logging"
+)
+
+// TokenPath is where the proxy serves registry tokens when the token server is enabled
+const TokenPath = "/token"
+
+// SetTokenServer serves registry tokens for service at TokenPath and accepts them from clients,
+// making the proxy its own Docker token authorization server. It needs the token service set
+// with SetTokenService.
+func (p *ProxyServer) SetTokenServer(service string) {
+	p.tokens.service = service
+}
+
+// ServeToken handles GET /token - the token endpoint of the Docker token authentication flow.
+// The client authenticates with the proxy username and a Vault token (or any password accepted
+// by proxy requests), and receives a short-lived signed token granting the requested scopes on
+// the registry named in the username. The Vault token must be able to read the registry
+// credentials; it stays with the proxy for the lifetime of the token.
+func (p *ProxyServer) ServeToken(w http.ResponseWriter, r *http.Request) {
+	if p.tokens == nil || p.tokens.service == "" {
+		writeErrorResponse(w, "UNSUPPORTED", "the token server is not enabled", http.StatusNotFound)
+		return
+	}
+
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Basic realm="%s"`, p.tokens.service))
+		writeErrorResponse(w, "UNAUTHORIZED", "basic authentication with the proxy username and a Vault token is required", http.StatusUnauthorized)
+		return
+	}
+	query := r.URL.Query()
+	if service := query.Get("service"); service != "" && service != p.tokens.service {
+		writeErrorResponse(w, "DENIED", fmt.Sprintf("tokens are issued for service %s, not %s", p.tokens.service, service), http.StatusBadRequest)
+		return
+	}
+	registryConfig, err := auth.ParseUsername(username)
+	if err != nil {
+		writeErrorResponse(w, "UNAUTHORIZED", err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	vaultToken, err := p.resolveVaultToken(r.Context(), registryConfig, password)
+	if err != nil {
+		writeErrorResponse(w, "UNAUTHORIZED", err.Error(), http.StatusUnauthorized)
+		return
+	}
+	// Only hand out tokens to clients whose Vault token can read the registry credentials
+	credentials, err := p.credentialsFor(withAuditRequest(r), registryConfig, vaultToken)
+	if err != nil {
+		writeErrorResponse(w, "UNAUTHORIZED", err.Error(), http.StatusUnauthorized)
+		return
+	}
+	credentials.Wipe()
+
+	access := grantedAccess(query["scope"])
+	// The session keeps the Vault token for the requests made with the token
+	_, session, err := p.tokens.store.Create(*registryConfig, vaultToken, "token endpoint", p.tokens.accessTTL)
+	if err != nil {
+		writeErrorResponse(w, "UNKNOWN", "failed to create token session", http.StatusInternalServerError)
+		return
+	}
+
+	issuedAt := time.Now()
+	registryToken, err := p.tokens.manager.Issue(r.Context(), map[string]interface{}{
+		"sub":        session.ID,
+		"typ":        "access",
+		"aud":        p.tokens.service,
+		"username":   username,
+		"registry":   registryConfig.RegistryURL,
+		"vault_path": registryConfig.VaultPath,
+		"access":     access,
+		"exp":        session.ExpiresAt.Unix(),
+	})
+	if err != nil {
+		p.tokens.store.Revoke(session.ID)
+		logging.FromContext(r.Context()).Error("Failed to issue registry token", "error", err)
+		writeErrorResponse(w, "UNAVAILABLE", "failed to issue registry token", http.StatusServiceUnavailable)
+		return
+	}
+
+	logging.FromContext(r.Context()).Info("Issued registry token", "token_id", session.ID, "scope", query["scope"])
+	admin.WriteJSON(w, http.StatusOK, map[string]interface{}{
+		"token":        registryToken,
+		"access_token": registryToken,
+		"expires_in":   int(p.tokens.accessTTL.Seconds()),
+		"issued_at":    issuedAt.UTC().Format(time.RFC3339),
+	})
+}
+
+// VerifyRegistryToken verifies a Bearer token issued by ServeToken, so the authentication
+// middleware can serve the request with the username and Vault token it was issued for.
+// Tokens of other issuers, such as upstream registry tokens, are not the proxy's.
+func (p *ProxyServer) VerifyRegistryToken(ctx context.Context, registryToken string) (*auth.RegistryToken, bool, error) {
+	if p.tokens == nil || p.tokens.service == "" || !isAccessToken(registryToken) || tokenIssuer(registryToken) != p.tokens.manager.Issuer() {
+		return nil, false, nil
+	}
+
+	claims, err := p.tokens.manager.Verify(ctx, registryToken)
+	if err != nil {
+		return nil, true, err
+	}
+	if claims["aud"] != p.tokens.service {
+		return nil, true, fmt.Errorf("token was not issued for service %s", p.tokens.service)
+	}
+	username, _ := claims["username"].(string)
+	if username == "" {
+		return nil, true, fmt.Errorf("not a registry token")
+	}
+
+	grant := &auth.RegistryToken{Username: username}
+	if raw, err := json.Marshal(claims["access"]); err == nil {
+		json.Unmarshal(raw, &grant.Access)
+	}
+	return grant, true, nil
+}
+
+// grantedAccess returns the access granted for the requested scopes: pull, push and delete on
+// repositories, and the registry catalog. Vault decides whether the client may use the
+// registry at all; which repositories it may use is up to the registry credentials.
+func grantedAccess(scopes []string) []auth.ResourceAccess {
+	access := []auth.ResourceAccess{}
+	for _, value := range scopes {
+		// Some clients send several scopes in one parameter
+		for _, scope := range strings.Fields(value) {
+			requested, ok := auth.ParseScope(scope)
+			if !ok {
+				continue
+			}
+			granted := auth.ResourceAccess{Type: requested.Type, Name: requested.Name, Actions: []string{}}
+			for _, action := range requested.Actions {
+				switch {
+				case requested.Type == auth.ResourceRepository && (action == auth.ActionPull || action == auth.ActionPush || action == auth.ActionDelete):
+					granted.Actions = append(granted.Actions, action)
+				case requested.Type == auth.ResourceRegistry && requested.Name == "catalog" && action == "*":
+					granted.Actions = append(granted.Actions, action)
+				}
+			}
+			if len(granted.Actions) > 0 {
+				access = append(access, granted)
+			}
+		}
+	}
+	return access
+}
+
+// tokenIssuer returns the unverified iss claim of a JWT, to tell the proxy's tokens apart
+func tokenIssuer(jwt string) string {
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		return ""
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return ""
+	}
+	var claims struct {
+		Issuer string `json:"iss"`
+	}
+	json.Unmarshal(payload, &claims)
+	return claims.Issuer
+}
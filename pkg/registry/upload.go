@@ -0,0 +1,219 @@
+package registry
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"vault-docker-proxy/pkg/auth"
+	"vault-docker-proxy/pkg/logging"
+)
+
+// BlobUpload handles the blob upload endpoints: POST /v2/{name}/blobs/uploads/ starts an upload
+// (or completes a monolithic upload or cross-repository mount), PATCH /v2/{name}/blobs/uploads/{uuid}
+// sends a chunk, PUT completes the upload with its digest, GET reports its progress and DELETE
+// cancels it. Bodies are streamed upstream. The upload session URLs the registry returns are
+// rewritten to point back through the proxy, so every request of the session carries the
+// registry credentials.
+func (p *ProxyServer) BlobUpload(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/v2")
+
+	if bearerAuth, ok := auth.GetBearerAuthFromContext(r.Context()); ok {
+		lw := p.uploadWriter(w, r, registryBaseURL(bearerAuth.RegistryURL), "")
+		if err := p.proxyBearerRequest(lw, r, bearerAuth, path); err != nil {
+			logging.FromContext(r.Context()).Error("Failed to proxy Bearer upload request", "method", r.Method, "path", path, "error", err)
+			writeError(lw, err)
+		}
+		return
+	}
+
+	credentials, registryConfig, err := p.authenticateAndGetCredentials(r)
+	if err != nil {
+		writeErrorResponse(w, "UNAUTHORIZED", err.Error(), http.StatusUnauthorized)
+		return
+	}
+	defer credentials.Wipe()
+
+	lw := p.uploadWriter(w, r, providerFor(registryConfig).BaseURL(registryConfig.RegistryURL), registryConfig.VaultPath)
+	if err := p.proxyRequest(lw, r, credentials, registryConfig, path); err != nil {
+		logging.FromContext(r.Context()).Error("Failed to proxy upload request", "method", r.Method, "path", path, "error", err)
+		writeError(lw, err)
+	}
+}
+
+// uploadWriter returns the writer of an upload response from registryURL
+func (p *ProxyServer) uploadWriter(w http.ResponseWriter, r *http.Request, registryURL, vaultPath string) *uploadLocationWriter {
+	return &uploadLocationWriter{
+		ResponseWriter: w,
+		registryURL:    registryURL,
+		uploads:        &p.uploads,
+		session: UploadSession{
+			Registry:   registryURL,
+			Repository: mux.Vars(r)["name"],
+			VaultPath:  vaultPath,
+		},
+		requestID: mux.Vars(r)["uuid"],
+	}
+}
+
+// uploadLocationWriter rewrites the Location of upload responses to a path on the proxy, and
+// tracks the upload session the response belongs to
+type uploadLocationWriter struct {
+	http.ResponseWriter
+	registryURL string
+	wroteHeader bool
+	uploads     *uploadTracker
+	session     UploadSession
+	requestID   string // upload ID of the request, empty when starting an upload
+}
+
+func (lw *uploadLocationWriter) WriteHeader(status int) {
+	if !lw.wroteHeader {
+		lw.wroteHeader = true
+		location := lw.Header().Get("Location")
+		if location != "" {
+			location = proxyLocation(location, lw.registryURL)
+			lw.Header().Set("Location", location)
+		}
+		lw.trackSession(status, location)
+	}
+	lw.ResponseWriter.WriteHeader(status)
+}
+
+// trackSession records the upload session of a response: 202 Accepted continues a session at its
+// Location, while completed, cancelled and unknown uploads end it
+func (lw *uploadLocationWriter) trackSession(status int, location string) {
+	if lw.uploads == nil {
+		return
+	}
+	switch {
+	case status == http.StatusAccepted:
+		id := uploadID(location)
+		if id == "" {
+			return
+		}
+		lw.session.ID = id
+		lw.session.Received = uploadedBytes(lw.Header().Get("Range"))
+		lw.uploads.record(lw.session, lw.requestID)
+	case lw.requestID != "" && (status == http.StatusCreated || status == http.StatusNoContent || status == http.StatusNotFound):
+		lw.uploads.end(lw.session.Registry, lw.requestID)
+	}
+}
+
+func (lw *uploadLocationWriter) Write(b []byte) (int, error) {
+	if !lw.wroteHeader {
+		lw.WriteHeader(http.StatusOK)
+	}
+	return lw.ResponseWriter.Write(b)
+}
+
+// Unwrap returns the underlying ResponseWriter, for http.ResponseController
+func (lw *uploadLocationWriter) Unwrap() http.ResponseWriter {
+	return lw.ResponseWriter
+}
+
+// uploadSessionIdleTimeout is how long an upload session is reported without activity. Clients
+// rarely cancel the uploads they give up on, and registries purge them eventually.
+const uploadSessionIdleTimeout = time.Hour
+
+// UploadSession describes a blob upload in progress through the proxy
+type UploadSession struct {
+	Registry     string    `json:"registry"`
+	Repository   string    `json:"repository"`
+	ID           string    `json:"id"`
+	VaultPath    string    `json:"vault_path,omitempty"` // empty for Bearer requests
+	Received     int64     `json:"received_bytes"`       // as last reported by the registry
+	StartedAt    time.Time `json:"started_at"`
+	LastActivity time.Time `json:"last_activity"`
+}
+
+// uploadTracker records the blob upload sessions in progress, keyed by registry and upload ID
+type uploadTracker struct {
+	mu       sync.Mutex
+	sessions map[string]*UploadSession
+}
+
+// record notes activity on an upload session. previousID is the upload ID the request was made
+// for, empty when it started the session; registries may hand out a new ID as the upload goes on.
+func (t *uploadTracker) record(session UploadSession, previousID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.sessions == nil {
+		t.sessions = make(map[string]*UploadSession)
+	}
+	now := time.Now()
+	session.StartedAt = now
+	session.LastActivity = now
+	if previousID != "" {
+		if existing, ok := t.sessions[uploadKey(session.Registry, previousID)]; ok {
+			session.StartedAt = existing.StartedAt
+			delete(t.sessions, uploadKey(session.Registry, previousID))
+		}
+	}
+	t.sessions[uploadKey(session.Registry, session.ID)] = &session
+}
+
+// end forgets an upload session
+func (t *uploadTracker) end(registryURL, id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.sessions, uploadKey(registryURL, id))
+}
+
+// uploadKey returns the key of an upload session
+func uploadKey(registryURL, id string) string {
+	return registryURL + "\x00" + id
+}
+
+// snapshot returns the upload sessions active within the idle timeout, oldest first, and forgets
+// the others
+func (t *uploadTracker) snapshot() []UploadSession {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	sessions := make([]UploadSession, 0, len(t.sessions))
+	for key, session := range t.sessions {
+		if time.Since(session.LastActivity) > uploadSessionIdleTimeout {
+			delete(t.sessions, key)
+			continue
+		}
+		sessions = append(sessions, *session)
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].StartedAt.Before(sessions[j].StartedAt) })
+	return sessions
+}
+
+// uploadID returns the upload ID at the end of an upload Location, or an empty string if the
+// Location does not name one
+func uploadID(location string) string {
+	target, err := url.Parse(location)
+	if err != nil {
+		return ""
+	}
+	_, id, ok := strings.Cut(target.Path, "/blobs/uploads/")
+	if !ok || id == "" || strings.Contains(id, "/") {
+		return ""
+	}
+	return id
+}
+
+// uploadedBytes returns the number of bytes an upload Range header (0-<offset>) reports.
+// Registries report an empty upload as 0-0, like an upload of one byte.
+func uploadedBytes(rangeHeader string) int64 {
+	_, end, ok := strings.Cut(rangeHeader, "-")
+	if !ok {
+		return 0
+	}
+	offset, err := strconv.ParseInt(end, 10, 64)
+	if err != nil || offset <= 0 {
+		return 0
+	}
+	return offset + 1
+}
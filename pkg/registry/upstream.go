@@ -0,0 +1,144 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"vault-docker-proxy/pkg/auth"
+	"vault-docker-proxy/pkg/logging"
+	"vault-docker-proxy/pkg/provider"
+)
+
+// upstream describes how to reach and authenticate against the registry targeted by a request.
+// It is used by the extension endpoints that make their own upstream calls.
+type upstream struct {
+	registryURL    string
+	registryConfig *auth.RegistryConfig // nil for Bearer requests
+	provider       provider.Provider    // registry type of Basic mode requests
+	credentials    *auth.Credentials    // Basic mode credentials from Vault
+	bearerToken    string               // Bearer mode token forwarded as-is
+}
+
+// resolveUpstream determines the target registry and credentials for a request
+func (p *ProxyServer) resolveUpstream(r *http.Request) (*upstream, error) {
+	if bearerAuth, ok := auth.GetBearerAuthFromContext(r.Context()); ok {
+		return &upstream{
+			registryURL: registryBaseURL(bearerAuth.RegistryURL),
+			bearerToken: bearerAuth.Token,
+		}, nil
+	}
+
+	credentials, registryConfig, err := p.authenticateAndGetCredentials(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return newUpstream(registryConfig, credentials), nil
+}
+
+// upstreamFor resolves an upstream from a proxy-style username and Vault token, for callers
+// that are not handling a registry request themselves
+func (p *ProxyServer) upstreamFor(ctx context.Context, username, vaultToken string) (*upstream, error) {
+	registryConfig, err := auth.ParseUsername(username)
+	if err != nil {
+		return nil, fmt.Errorf("invalid username format: %v", err)
+	}
+
+	vaultToken, err = p.resolveVaultToken(ctx, registryConfig, vaultToken)
+	if err != nil {
+		return nil, err
+	}
+
+	credentials, err := p.credentialsFor(ctx, registryConfig, vaultToken)
+	if err != nil {
+		return nil, err
+	}
+
+	return newUpstream(registryConfig, credentials), nil
+}
+
+// newUpstream describes a Basic mode upstream, using the provider of the registry type
+func newUpstream(registryConfig *auth.RegistryConfig, credentials *auth.Credentials) *upstream {
+	registryProvider := providerFor(registryConfig)
+	return &upstream{
+		registryURL:    registryProvider.BaseURL(registryConfig.RegistryURL),
+		registryConfig: registryConfig,
+		provider:       registryProvider,
+		credentials:    credentials,
+	}
+}
+
+// release wipes the upstream's registry credentials once the handler using it is done
+func (up *upstream) release() {
+	up.credentials.Wipe()
+}
+
+// fetch performs a request against the upstream registry. targetPath is relative to /v2.
+// Non-2xx responses are returned as errors after the body has been drained.
+func (p *ProxyServer) fetch(ctx context.Context, up *upstream, method, targetPath string, header http.Header) (*http.Response, error) {
+	return p.send(ctx, up, method, up.registryURL+"/v2"+targetPath, header, nil, 0)
+}
+
+// send performs a request with an optional body against an absolute upstream URL, such as the
+// upload locations returned by the registry
+func (p *ProxyServer) send(ctx context.Context, up *upstream, method, targetURL string, header http.Header, body io.Reader, size int64) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, targetURL, body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create upstream request: %v", err)
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if id := logging.RequestID(ctx); id != "" {
+		req.Header.Set(logging.RequestIDHeader, id)
+	}
+
+	if up.credentials != nil {
+		up.provider.Authorize(req, up.credentials)
+	} else if up.bearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+up.bearerToken)
+	}
+	logging.AddAuthorizationSecrets(ctx, req.Header.Get("Authorization"))
+
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach upstream registry: %w", err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		errs := upstreamErrors(resp, req.Header.Get("Authorization"))
+		resp.Body.Close()
+		return nil, &UpstreamError{StatusCode: resp.StatusCode, Method: method, Path: strings.TrimPrefix(req.URL.Path, "/v2"), Errors: errs}
+	}
+
+	return resp, nil
+}
+
+// UpstreamError reports a non-successful response from the upstream registry
+type UpstreamError struct {
+	StatusCode int
+	Method     string
+	Path       string
+	Errors     []ErrorDetail // registry API errors of the response body, if any
+}
+
+// Error implements the error interface
+func (e *UpstreamError) Error() string {
+	message := fmt.Sprintf("upstream registry returned HTTP %d for %s /v2%s", e.StatusCode, e.Method, e.Path)
+	if len(e.Errors) > 0 {
+		message += ": " + errorMessages(e.Errors)
+	}
+	return message
+}
+
+// registryBaseURL adds the https scheme to registry hosts given without one
+func registryBaseURL(registryURL string) string {
+	return provider.DefaultBaseURL(registryURL)
+}
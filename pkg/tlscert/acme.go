@@ -0,0 +1,23 @@
+package tlscert
+
+import (
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// NewACMEManager creates a manager that obtains certificates for hosts from the ACME certificate
+// authority at directoryURL, Let's Encrypt when empty, and renews them before they expire. The
+// account key and certificates are kept in cacheDir. Configuring it accepts the terms of service
+// of the certificate authority.
+func NewACMEManager(hosts []string, email, cacheDir, directoryURL string) *autocert.Manager {
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(hosts...),
+		Cache:      autocert.DirCache(cacheDir),
+		Email:      email,
+	}
+	if directoryURL != "" {
+		manager.Client = &acme.Client{DirectoryURL: directoryURL}
+	}
+	return manager
+}
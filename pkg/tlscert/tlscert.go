@@ -0,0 +1,136 @@
+// Package tlscert serves the proxy's TLS certificate from PEM files, reloading it when the files
+// are replaced so certificates can be rotated without restarting the proxy
+package tlscert
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// pollInterval is how often the certificate and key files are checked for changes
+const pollInterval = 10 * time.Second
+
+// Reloader holds a certificate loaded from a certificate and a key file, and loads it again
+// whenever either file changes. It is safe for concurrent use.
+type Reloader struct {
+	certFile string
+	keyFile  string
+
+	mu          sync.Mutex
+	certificate *tls.Certificate
+	certModTime time.Time
+	keyModTime  time.Time
+}
+
+// NewReloader loads the certificate chain of certFile and the private key of keyFile
+func NewReloader(certFile, keyFile string) (*Reloader, error) {
+	r := &Reloader{certFile: certFile, keyFile: keyFile}
+	if _, err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate returns the current certificate, for tls.Config
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.certificate, nil
+}
+
+// Run reloads the certificate whenever its files change, until ctx is cancelled. Files that fail
+// to load, such as a certificate replaced before its key, leave the current certificate in place
+// and are tried again at the next check.
+func (r *Reloader) Run(ctx context.Context) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	var lastErr string
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		reloaded, err := r.reload()
+		if err != nil {
+			// Logged once until the files load again
+			if err.Error() != lastErr {
+				slog.Warn("Failed to reload the TLS certificate, keeping the current one", "error", err)
+			}
+			lastErr = err.Error()
+			continue
+		}
+		lastErr = ""
+		if reloaded {
+			slog.Info("Reloaded the TLS certificate", "file", r.certFile, "expires_at", r.expiresAt().Format(time.RFC3339))
+		}
+	}
+}
+
+// reload loads the certificate if either file changed since it was last loaded, and reports
+// whether it did
+func (r *Reloader) reload() (bool, error) {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return false, fmt.Errorf("failed to read TLS certificate: %v", err)
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return false, fmt.Errorf("failed to read TLS key: %v", err)
+	}
+
+	r.mu.Lock()
+	unchanged := r.certificate != nil && certInfo.ModTime().Equal(r.certModTime) && keyInfo.ModTime().Equal(r.keyModTime)
+	r.mu.Unlock()
+	if unchanged {
+		return false, nil
+	}
+
+	certificate, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return false, fmt.Errorf("invalid TLS certificate %s or key %s: %v", r.certFile, r.keyFile, err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.certificate = &certificate
+	r.certModTime = certInfo.ModTime()
+	r.keyModTime = keyInfo.ModTime()
+	return true, nil
+}
+
+// expiresAt returns the expiry of the current certificate, zero if it cannot be parsed
+func (r *Reloader) expiresAt() time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	leaf := r.certificate.Leaf
+	if leaf == nil {
+		var err error
+		if leaf, err = x509.ParseCertificate(r.certificate.Certificate[0]); err != nil {
+			return time.Time{}
+		}
+	}
+	return leaf.NotAfter
+}
+
+// LoadCertPool loads the PEM certificates of file into a pool, such as the CAs client
+// certificates are verified against
+func LoadCertPool(file string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA bundle: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no PEM certificate found in CA bundle %s", file)
+	}
+	return pool, nil
+}
@@ -0,0 +1,313 @@
+// Package token manages the keys used to sign tokens issued by the proxy and the JSON Web
+// Tokens themselves.
+package token
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"sync"
+	"time"
+)
+
+// JWS algorithms supported for signing
+const (
+	AlgorithmES256 = "ES256"
+	AlgorithmRS256 = "RS256"
+	AlgorithmEdDSA = "EdDSA"
+)
+
+var (
+	ErrNoSigningKey       = errors.New("no signing key available")
+	ErrUnsupportedKeyType = errors.New("unsupported key type, expected ECDSA P-256, RSA or Ed25519")
+)
+
+// PublicKey is a verification key published in the JWKS
+type PublicKey struct {
+	ID        string
+	Algorithm string
+	Key       crypto.PublicKey
+}
+
+// KeySource provides the active signing key and the public keys that verify issued tokens
+type KeySource interface {
+	// ActiveKey returns the public half of the key that signs new tokens
+	ActiveKey(ctx context.Context) (PublicKey, error)
+	// Sign signs the JWS signing input with the private half of key
+	Sign(ctx context.Context, key PublicKey, signingInput []byte) ([]byte, error)
+	// PublicKeys returns every key that tokens may currently be signed with
+	PublicKeys(ctx context.Context) ([]PublicKey, error)
+	// Rotate makes a new key active
+	Rotate(ctx context.Context) error
+}
+
+// NewPublicKey determines the algorithm of a public key and derives its key ID from the SHA-256
+// hash of its SubjectPublicKeyInfo
+func NewPublicKey(key crypto.PublicKey) (PublicKey, error) {
+	algorithm, err := algorithmFor(key)
+	if err != nil {
+		return PublicKey{}, err
+	}
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return PublicKey{}, err
+	}
+	sum := sha256.Sum256(der)
+	return PublicKey{ID: base64.RawURLEncoding.EncodeToString(sum[:12]), Algorithm: algorithm, Key: key}, nil
+}
+
+// algorithmFor returns the JWS algorithm used with a public key
+func algorithmFor(key crypto.PublicKey) (string, error) {
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		if k.Curve != elliptic.P256() {
+			return "", ErrUnsupportedKeyType
+		}
+		return AlgorithmES256, nil
+	case *rsa.PublicKey:
+		return AlgorithmRS256, nil
+	case ed25519.PublicKey:
+		return AlgorithmEdDSA, nil
+	}
+	return "", ErrUnsupportedKeyType
+}
+
+// JWK returns the key in JSON Web Key form
+func (k PublicKey) JWK() map[string]string {
+	jwk := map[string]string{"kid": k.ID, "alg": k.Algorithm, "use": "sig"}
+	encode := base64.RawURLEncoding.EncodeToString
+	switch key := k.Key.(type) {
+	case *ecdsa.PublicKey:
+		jwk["kty"], jwk["crv"] = "EC", "P-256"
+		jwk["x"] = encode(key.X.FillBytes(make([]byte, 32)))
+		jwk["y"] = encode(key.Y.FillBytes(make([]byte, 32)))
+	case *rsa.PublicKey:
+		jwk["kty"] = "RSA"
+		jwk["n"] = encode(key.N.Bytes())
+		jwk["e"] = encode(big.NewInt(int64(key.E)).Bytes())
+	case ed25519.PublicKey:
+		jwk["kty"], jwk["crv"] = "OKP", "Ed25519"
+		jwk["x"] = encode(key)
+	}
+	return jwk
+}
+
+// verify checks a JWS signature made with the key
+func (k PublicKey) verify(signingInput, signature []byte) bool {
+	digest := sha256.Sum256(signingInput)
+	switch key := k.Key.(type) {
+	case *ecdsa.PublicKey:
+		if len(signature) != 64 {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(key, digest[:], r, s)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) == nil
+	case ed25519.PublicKey:
+		return ed25519.Verify(key, signingInput, signature)
+	}
+	return false
+}
+
+// signWith creates a JWS signature with a local private key
+func signWith(signer crypto.Signer, signingInput []byte) ([]byte, error) {
+	digest := sha256.Sum256(signingInput)
+	switch key := signer.(type) {
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			return nil, err
+		}
+		signature := make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+		return signature, nil
+	case *rsa.PrivateKey:
+		return rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	case ed25519.PrivateKey:
+		return ed25519.Sign(key, signingInput), nil
+	}
+	return nil, ErrUnsupportedKeyType
+}
+
+// PEMKeySource loads keys from a PEM bundle. The first private key in the bundle signs new
+// tokens; further private keys and PUBLIC KEY blocks are only published for verification, which
+// lets operators stage the next key or keep the previous one during a rotation. The bundle is
+// re-read whenever its modification time changes.
+type PEMKeySource struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	active  PublicKey
+	signer  crypto.Signer
+	keys    []PublicKey
+}
+
+// NewPEMKeySource loads the key bundle at path
+func NewPEMKeySource(path string) (*PEMKeySource, error) {
+	s := &PEMKeySource{path: path}
+	if err := s.reload(true); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// ActiveKey implements KeySource
+func (s *PEMKeySource) ActiveKey(ctx context.Context) (PublicKey, error) {
+	s.reload(false)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.active, nil
+}
+
+// Sign implements KeySource
+func (s *PEMKeySource) Sign(ctx context.Context, key PublicKey, signingInput []byte) ([]byte, error) {
+	s.mu.Lock()
+	signer, active := s.signer, s.active
+	s.mu.Unlock()
+	if key.ID != active.ID {
+		return nil, fmt.Errorf("%w: key %s is no longer active", ErrNoSigningKey, key.ID)
+	}
+	return signWith(signer, signingInput)
+}
+
+// PublicKeys implements KeySource
+func (s *PEMKeySource) PublicKeys(ctx context.Context) ([]PublicKey, error) {
+	s.reload(false)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]PublicKey(nil), s.keys...), nil
+}
+
+// Rotate implements KeySource. New keys cannot be generated for a bundle, so rotating re-reads
+// it after the operator has put the new signing key first.
+func (s *PEMKeySource) Rotate(ctx context.Context) error {
+	return s.reload(true)
+}
+
+// reload re-reads the bundle if it changed, or unconditionally when force is set. A bundle that
+// fails to load leaves the current keys in place.
+func (s *PEMKeySource) reload(force bool) error {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return fmt.Errorf("failed to read key bundle: %v", err)
+	}
+
+	s.mu.Lock()
+	unchanged := info.ModTime().Equal(s.modTime)
+	s.mu.Unlock()
+	if unchanged && !force {
+		return nil
+	}
+
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return fmt.Errorf("failed to read key bundle: %v", err)
+	}
+	signer, keys, err := parsePEMBundle(data)
+	if err != nil {
+		return fmt.Errorf("invalid key bundle %s: %v", s.path, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.modTime = info.ModTime()
+	s.signer = signer
+	s.active = keys[0]
+	s.keys = keys
+	return nil
+}
+
+// parsePEMBundle returns the first private key and the public keys of every key in the bundle,
+// starting with the signing key
+func parsePEMBundle(data []byte) (crypto.Signer, []PublicKey, error) {
+	var (
+		signer crypto.Signer
+		keys   []PublicKey
+	)
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		var (
+			public crypto.PublicKey
+			err    error
+		)
+		switch block.Type {
+		case "PUBLIC KEY":
+			public, err = x509.ParsePKIXPublicKey(block.Bytes)
+		case "PRIVATE KEY", "EC PRIVATE KEY", "RSA PRIVATE KEY":
+			var private crypto.Signer
+			private, err = parsePrivateKey(block)
+			if err == nil {
+				public = private.Public()
+				if signer == nil {
+					signer = private
+					// Keep the signing key first
+					key, err := NewPublicKey(public)
+					if err != nil {
+						return nil, nil, err
+					}
+					keys = append([]PublicKey{key}, keys...)
+					continue
+				}
+			}
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to parse %s: %v", block.Type, err)
+		}
+
+		key, err := NewPublicKey(public)
+		if err != nil {
+			return nil, nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	if signer == nil {
+		return nil, nil, ErrNoSigningKey
+	}
+	return signer, keys, nil
+}
+
+// parsePrivateKey parses PKCS#8, SEC 1 and PKCS#1 private keys
+func parsePrivateKey(block *pem.Block) (crypto.Signer, error) {
+	var (
+		key interface{}
+		err error
+	)
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, ErrUnsupportedKeyType
+	}
+	if _, err := algorithmFor(signer.Public()); err != nil {
+		return nil, err
+	}
+	return signer, nil
+}
@@ -0,0 +1,266 @@
+package token
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"vault-docker-proxy/pkg/admin"
+	"vault-docker-proxy/pkg/logging"
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	ErrTokenExpired = errors.New("token expired")
+)
+
+// Manager issues and verifies JSON Web Tokens signed by a KeySource. Keys that disappear from
+// the source, for example after a rotation, stay published and accepted for the overlap period
+// so tokens issued before the rotation remain valid until they expire.
+type Manager struct {
+	source  KeySource
+	issuer  string
+	overlap time.Duration
+
+	mu      sync.Mutex
+	current map[string]PublicKey
+	retired map[string]retiredKey
+}
+
+// retiredKey is a key no longer reported by the source, accepted until the given time
+type retiredKey struct {
+	key   PublicKey
+	until time.Time
+}
+
+// NewManager creates a token manager. Tokens carry issuer in their iss claim.
+func NewManager(source KeySource, issuer string, overlap time.Duration) *Manager {
+	return &Manager{
+		source:  source,
+		issuer:  issuer,
+		overlap: overlap,
+		current: make(map[string]PublicKey),
+		retired: make(map[string]retiredKey),
+	}
+}
+
+// Issuer returns the iss claim of issued tokens
+func (m *Manager) Issuer() string {
+	return m.issuer
+}
+
+// Issue signs claims as a JWT. The iss and iat claims are set when missing.
+func (m *Manager) Issue(ctx context.Context, claims map[string]interface{}) (string, error) {
+	key, err := m.source.ActiveKey(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	payload := make(map[string]interface{}, len(claims)+2)
+	payload["iss"] = m.issuer
+	payload["iat"] = time.Now().Unix()
+	for name, value := range claims {
+		payload[name] = value
+	}
+
+	header, err := json.Marshal(map[string]string{"typ": "JWT", "alg": key.Algorithm, "kid": key.ID})
+	if err != nil {
+		return "", err
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+
+	encode := base64.RawURLEncoding.EncodeToString
+	signingInput := encode(header) + "." + encode(body)
+	signature, err := m.source.Sign(ctx, key, []byte(signingInput))
+	if err != nil {
+		return "", fmt.Errorf("failed to sign token: %v", err)
+	}
+	return signingInput + "." + encode(signature), nil
+}
+
+// Verify checks a JWT's signature, issuer, expiry and not-before time and returns its claims
+func (m *Manager) Verify(ctx context.Context, token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: malformed JWT", ErrInvalidToken)
+	}
+
+	var header struct {
+		Algorithm string `json:"alg"`
+		KeyID     string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed signature", ErrInvalidToken)
+	}
+
+	key, ok, err := m.lookupKey(ctx, header.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	if !ok || key.Algorithm != header.Algorithm || !key.verify([]byte(parts[0]+"."+parts[1]), signature) {
+		return nil, fmt.Errorf("%w: signature verification failed", ErrInvalidToken)
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if claims["iss"] != m.issuer {
+		return nil, fmt.Errorf("%w: unexpected issuer", ErrInvalidToken)
+	}
+	now := float64(time.Now().Unix())
+	if exp, ok := claims["exp"].(float64); ok && now >= exp {
+		return nil, ErrTokenExpired
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now < nbf {
+		return nil, fmt.Errorf("%w: token not valid yet", ErrInvalidToken)
+	}
+
+	return claims, nil
+}
+
+// Keys returns the keys that verify tokens: those reported by the source plus retired keys
+// still within the overlap period
+func (m *Manager) Keys(ctx context.Context) ([]PublicKey, error) {
+	keys, err := m.source.PublicKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	current := make(map[string]PublicKey, len(keys))
+	for _, key := range keys {
+		current[key.ID] = key
+		delete(m.retired, key.ID)
+	}
+	for id, key := range m.current {
+		if _, ok := current[id]; !ok {
+			slog.Info("Signing key retired", "key_id", id, "accepted_until", now.Add(m.overlap).Format(time.RFC3339))
+			m.retired[id] = retiredKey{key: key, until: now.Add(m.overlap)}
+		}
+	}
+	m.current = current
+
+	for id, retired := range m.retired {
+		if now.After(retired.until) {
+			delete(m.retired, id)
+			continue
+		}
+		keys = append(keys, retired.key)
+	}
+	return keys, nil
+}
+
+// Rotate makes the source activate a new signing key
+func (m *Manager) Rotate(ctx context.Context) error {
+	// Record the current keys first so the previous signing key is retired with an overlap
+	if _, err := m.Keys(ctx); err != nil {
+		return err
+	}
+	if err := m.source.Rotate(ctx); err != nil {
+		return err
+	}
+
+	active, err := m.source.ActiveKey(ctx)
+	if err != nil {
+		return err
+	}
+	slog.Info("Rotated signing keys", "active_key_id", active.ID)
+	_, err = m.Keys(ctx)
+	return err
+}
+
+// Run refreshes the key set every interval until ctx is done, so keys removed from the source
+// are retired at the time they disappear
+func (m *Manager) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := m.Keys(ctx); err != nil {
+				slog.Error("Failed to refresh signing keys", "error", err)
+			}
+		}
+	}
+}
+
+// JWKSHandler serves the verification keys as a JSON Web Key Set
+func (m *Manager) JWKSHandler(w http.ResponseWriter, r *http.Request) {
+	keys, err := m.Keys(r.Context())
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Failed to load signing keys", "error", err)
+		admin.WriteError(w, "UNAVAILABLE", "signing keys are unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	jwks := make([]map[string]string, 0, len(keys))
+	for _, key := range keys {
+		jwks = append(jwks, key.JWK())
+	}
+	w.Header().Set("Cache-Control", "public, max-age=60")
+	admin.WriteJSON(w, http.StatusOK, map[string]interface{}{"keys": jwks})
+}
+
+// RotateHandler serves POST /admin/token/rotate on the admin listener
+func (m *Manager) RotateHandler(w http.ResponseWriter, r *http.Request) {
+	if err := m.Rotate(r.Context()); err != nil {
+		logging.FromContext(r.Context()).Error("Signing key rotation failed", "error", err)
+		admin.WriteError(w, "ROTATION_FAILED", err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	active, err := m.source.ActiveKey(r.Context())
+	if err != nil {
+		admin.WriteError(w, "ROTATION_FAILED", err.Error(), http.StatusInternalServerError)
+		return
+	}
+	admin.WriteJSON(w, http.StatusOK, map[string]string{"active_key": active.ID})
+}
+
+// lookupKey finds a verification key by ID
+func (m *Manager) lookupKey(ctx context.Context, id string) (PublicKey, bool, error) {
+	keys, err := m.Keys(ctx)
+	if err != nil {
+		return PublicKey{}, false, err
+	}
+	for _, key := range keys {
+		if key.ID == id {
+			return key, true, nil
+		}
+	}
+	return PublicKey{}, false, nil
+}
+
+// decodeSegment decodes a base64url JSON segment of a JWT
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return fmt.Errorf("%w: malformed segment", ErrInvalidToken)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("%w: malformed segment", ErrInvalidToken)
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+package token
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"vault-docker-proxy/pkg/auth"
+)
+
+// RefreshTokenPrefix marks refresh tokens so they are easy to recognize in secret scanners
+const RefreshTokenPrefix = "vdprt_"
+
+var (
+	ErrRefreshTokenInvalid = errors.New("refresh token is invalid, expired or revoked")
+)
+
+// Session is the state behind a refresh token. The proxy keeps the Vault token the session was
+// created with so holders of the refresh token never need it; it is wiped when the session is
+// revoked or expires.
+type Session struct {
+	ID          string
+	Registry    auth.RegistryConfig
+	Description string
+	CreatedAt   time.Time
+	ExpiresAt   time.Time
+	LastUsed    time.Time
+
+	vaultToken *auth.Secret
+}
+
+// VaultToken returns the Vault token of the session, empty once the session has ended. The string
+// cannot be wiped; only the copy held by the session is, when it ends.
+func (s *Session) VaultToken() string {
+	return s.vaultToken.Reveal()
+}
+
+// SessionInfo describes a session without its secrets
+type SessionInfo struct {
+	ID          string     `json:"id"`
+	Registry    string     `json:"registry"`
+	VaultPath   string     `json:"vault_path"`
+	Namespace   string     `json:"namespace,omitempty"`
+	Description string     `json:"description,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	ExpiresAt   time.Time  `json:"expires_at"`
+	LastUsed    *time.Time `json:"last_used,omitempty"`
+}
+
+// RefreshStore keeps refresh token sessions in memory, indexed by the SHA-256 hash of the
+// refresh token so the tokens themselves are never stored
+type RefreshStore struct {
+	mu     sync.Mutex
+	byHash map[string]*Session
+	byID   map[string]string // session ID -> token hash
+}
+
+// NewRefreshStore creates an empty refresh token store
+func NewRefreshStore() *RefreshStore {
+	return &RefreshStore{
+		byHash: make(map[string]*Session),
+		byID:   make(map[string]string),
+	}
+}
+
+// Create starts a session valid for ttl and returns its refresh token
+func (s *RefreshStore) Create(registry auth.RegistryConfig, vaultToken, description string, ttl time.Duration) (string, *Session, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", nil, err
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", nil, err
+	}
+
+	refreshToken := RefreshTokenPrefix + base64.RawURLEncoding.EncodeToString(secret)
+	now := time.Now()
+	session := &Session{
+		ID:          hex.EncodeToString(id),
+		Registry:    registry,
+		Description: description,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(ttl),
+		vaultToken:  auth.NewSecret([]byte(vaultToken)),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweep(now)
+	hash := hashToken(refreshToken)
+	s.byHash[hash] = session
+	s.byID[session.ID] = hash
+	return refreshToken, session, nil
+}
+
+// Use returns the session of a refresh token and records its use
+func (s *RefreshStore) Use(refreshToken string) (*Session, error) {
+	if !strings.HasPrefix(refreshToken, RefreshTokenPrefix) {
+		return nil, ErrRefreshTokenInvalid
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.byHash[hashToken(refreshToken)]
+	if !ok || time.Now().After(session.ExpiresAt) {
+		return nil, ErrRefreshTokenInvalid
+	}
+	session.LastUsed = time.Now()
+	copied := *session
+	return &copied, nil
+}
+
+// Get returns an active session by ID
+func (s *RefreshStore) Get(id string) (*Session, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.byHash[s.byID[id]]
+	if !ok || time.Now().After(session.ExpiresAt) {
+		return nil, false
+	}
+	copied := *session
+	return &copied, true
+}
+
+// Revoke ends a session, invalidating its refresh token and every access token issued from it
+func (s *RefreshStore) Revoke(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hash, ok := s.byID[id]
+	if !ok {
+		return false
+	}
+	s.byHash[hash].vaultToken.Wipe()
+	delete(s.byHash, hash)
+	delete(s.byID, id)
+	return true
+}
+
+// List returns the active sessions, oldest first
+func (s *RefreshStore) List() []SessionInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweep(time.Now())
+
+	sessions := make([]SessionInfo, 0, len(s.byHash))
+	for _, session := range s.byHash {
+		info := SessionInfo{
+			ID:          session.ID,
+			Registry:    session.Registry.RegistryURL,
+			VaultPath:   session.Registry.VaultPath,
+			Namespace:   session.Registry.Namespace,
+			Description: session.Description,
+			CreatedAt:   session.CreatedAt,
+			ExpiresAt:   session.ExpiresAt,
+		}
+		if !session.LastUsed.IsZero() {
+			lastUsed := session.LastUsed
+			info.LastUsed = &lastUsed
+		}
+		sessions = append(sessions, info)
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].CreatedAt.Before(sessions[j].CreatedAt) })
+	return sessions
+}
+
+// sweep drops expired sessions; the caller holds the lock
+func (s *RefreshStore) sweep(now time.Time) {
+	for hash, session := range s.byHash {
+		if now.After(session.ExpiresAt) {
+			session.vaultToken.Wipe()
+			delete(s.byHash, hash)
+			delete(s.byID, session.ID)
+		}
+	}
+}
+
+// hashToken returns the hex SHA-256 hash of a token
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,159 @@
+package token
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"vault-docker-proxy/pkg/vault"
+)
+
+// transitKeyCacheTTL is how long the Transit key metadata is reused before it is read again
+const transitKeyCacheTTL = 30 * time.Second
+
+// TransitKeySource signs tokens with a Vault Transit key, so the private key never leaves Vault.
+// The latest key version signs; every version Vault still reports is published for verification.
+// Key IDs have the form <key name>-v<version>.
+type TransitKeySource struct {
+	client *vault.Client
+	mount  string
+	name   string
+
+	mu     sync.Mutex
+	key    *vault.TransitKey
+	keys   map[int]PublicKey
+	readAt time.Time
+}
+
+// NewTransitKeySource creates a key source for the Transit key name mounted at mount. The Vault
+// client must carry a token allowed to read, sign with and rotate the key.
+func NewTransitKeySource(ctx context.Context, client *vault.Client, mount, name string) (*TransitKeySource, error) {
+	s := &TransitKeySource{client: client, mount: mount, name: name}
+	if _, err := s.transitKey(ctx, true); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// ActiveKey implements KeySource
+func (s *TransitKeySource) ActiveKey(ctx context.Context) (PublicKey, error) {
+	if _, err := s.transitKey(ctx, false); err != nil {
+		return PublicKey{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key, ok := s.keys[s.key.LatestVersion]
+	if !ok {
+		return PublicKey{}, fmt.Errorf("%w: transit key %s has no public key for version %d", ErrNoSigningKey, s.name, s.key.LatestVersion)
+	}
+	return key, nil
+}
+
+// Sign implements KeySource
+func (s *TransitKeySource) Sign(ctx context.Context, key PublicKey, signingInput []byte) ([]byte, error) {
+	transitKey, err := s.transitKey(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	version := -1
+	for v, k := range s.keys {
+		if k.ID == key.ID {
+			version = v
+		}
+	}
+	s.mu.Unlock()
+	if version == -1 {
+		return nil, fmt.Errorf("%w: unknown transit key %s", ErrNoSigningKey, key.ID)
+	}
+
+	return s.client.TransitSign(ctx, s.mount, transitKey, version, signingInput)
+}
+
+// PublicKeys implements KeySource
+func (s *TransitKeySource) PublicKeys(ctx context.Context) ([]PublicKey, error) {
+	if _, err := s.transitKey(ctx, false); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	versions := make([]int, 0, len(s.keys))
+	for version := range s.keys {
+		versions = append(versions, version)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(versions)))
+
+	keys := make([]PublicKey, 0, len(versions))
+	for _, version := range versions {
+		keys = append(keys, s.keys[version])
+	}
+	return keys, nil
+}
+
+// Rotate implements KeySource by creating a new version of the Transit key
+func (s *TransitKeySource) Rotate(ctx context.Context) error {
+	if err := s.client.RotateTransitKey(ctx, s.mount, s.name); err != nil {
+		return err
+	}
+	_, err := s.transitKey(ctx, true)
+	return err
+}
+
+// transitKey returns the Transit key metadata, reading it from Vault when stale or forced
+func (s *TransitKeySource) transitKey(ctx context.Context, force bool) (*vault.TransitKey, error) {
+	s.mu.Lock()
+	if s.key != nil && !force && time.Since(s.readAt) < transitKeyCacheTTL {
+		defer s.mu.Unlock()
+		return s.key, nil
+	}
+	s.mu.Unlock()
+
+	transitKey, err := s.client.ReadTransitKey(ctx, s.mount, s.name)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[int]PublicKey, len(transitKey.PublicKeys))
+	for version, encoded := range transitKey.PublicKeys {
+		public, err := parseTransitPublicKey(transitKey.Type, encoded)
+		if err != nil {
+			return nil, fmt.Errorf("transit key %s version %d: %v", s.name, version, err)
+		}
+		algorithm, err := algorithmFor(public)
+		if err != nil {
+			return nil, err
+		}
+		keys[version] = PublicKey{ID: fmt.Sprintf("%s-v%d", s.name, version), Algorithm: algorithm, Key: public}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.key, s.keys, s.readAt = transitKey, keys, time.Now()
+	return transitKey, nil
+}
+
+// parseTransitPublicKey decodes a public key as returned by the Transit keys endpoint
+func parseTransitPublicKey(keyType, encoded string) (crypto.PublicKey, error) {
+	if keyType == "ed25519" {
+		raw, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(raw) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid ed25519 public key")
+		}
+		return ed25519.PublicKey(raw), nil
+	}
+
+	block, _ := pem.Decode([]byte(encoded))
+	if block == nil {
+		return nil, fmt.Errorf("invalid PEM public key")
+	}
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
@@ -0,0 +1,314 @@
+package transport
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"vault-docker-proxy/pkg/logging"
+)
+
+const (
+	// defaultTokenLifetime is how long a token without expires_in is valid, per the token spec
+	defaultTokenLifetime = 60 * time.Second
+	// tokenExpiryMargin is how long before it expires a token is no longer sent
+	tokenExpiryMargin = 10 * time.Second
+	// tokenRetention is how long the challenge of an expired token is remembered, so a new
+	// token can be requested before the next request
+	tokenRetention = time.Hour
+	// maxTokenResponseSize limits how much of a token response is read
+	maxTokenResponseSize = 1 << 20
+)
+
+// ErrTokenExchange is returned when a registry's token service could not issue a token
+var ErrTokenExchange = errors.New("registry token exchange failed")
+
+// NewTokenTransport wraps base so that registries answering Basic credentials with a Bearer
+// challenge, like Docker Hub, GHCR and Quay, get the token they ask for: the credentials are
+// exchanged at the challenge's realm for a token of its service and scope, and the request is
+// retried with the token when its body can be sent again. Tokens are reused for their lifetime
+// per credentials, registry host, repository and pull or push access, so later requests,
+// including uploads whose bodies cannot be replayed, carry them up front. Requests without
+// Basic credentials, such as those carrying a client's own Bearer token, are passed through.
+func NewTokenTransport(base http.RoundTripper) http.RoundTripper {
+	return &tokenTransport{
+		base:   base,
+		tokens: make(map[string]*registryToken),
+		now:    time.Now,
+	}
+}
+
+type tokenTransport struct {
+	base http.RoundTripper
+
+	mu     sync.Mutex
+	tokens map[string]*registryToken
+
+	now func() time.Time
+}
+
+// bearerChallenge holds the parameters of a WWW-Authenticate Bearer challenge
+type bearerChallenge struct {
+	realm   string
+	service string
+	scope   string
+}
+
+// registryToken is a token issued for a challenge
+type registryToken struct {
+	challenge bearerChallenge
+	token     string
+	expiresAt time.Time
+}
+
+func (t *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	basic := req.Header.Get("Authorization")
+	if !strings.HasPrefix(basic, "Basic ") {
+		return t.base.RoundTrip(req)
+	}
+	key := tokenKey(req, basic)
+
+	var resp *http.Response
+	var err error
+	if token, ok := t.cachedToken(req, key, basic); ok {
+		resp, err = t.base.RoundTrip(withAuthorization(req, "Bearer "+token))
+		if err != nil || resp.StatusCode != http.StatusUnauthorized {
+			return resp, err
+		}
+		// The token was revoked or does not cover the request, get one for the new challenge
+		t.forget(key)
+	} else {
+		resp, err = t.base.RoundTrip(req)
+		if err != nil || resp.StatusCode != http.StatusUnauthorized {
+			return resp, err
+		}
+	}
+
+	challenge, ok := parseBearerChallenge(resp.Header.Get("WWW-Authenticate"))
+	if !ok {
+		return resp, nil
+	}
+	entry, rejected, err := t.fetchToken(req, basic, challenge)
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	if rejected != nil {
+		// The token service turned the credentials down, report its answer instead of the challenge
+		resp.Body.Close()
+		return rejected, nil
+	}
+	t.store(key, entry)
+
+	if !replayable(req) {
+		// The token is used from the next request on
+		return resp, nil
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, maxDrainSize))
+	resp.Body.Close()
+	retry := withAuthorization(req, "Bearer "+entry.token)
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		retry.Body = body
+	}
+	return t.base.RoundTrip(retry)
+}
+
+// cachedToken returns a valid token for the key, requesting a new one up front when an earlier
+// token expired and its challenge is known
+func (t *tokenTransport) cachedToken(req *http.Request, key, basic string) (string, bool) {
+	t.mu.Lock()
+	entry, ok := t.tokens[key]
+	t.mu.Unlock()
+	if !ok {
+		return "", false
+	}
+	if t.now().Before(entry.expiresAt) {
+		return entry.token, true
+	}
+
+	renewed, rejected, err := t.fetchToken(req, basic, entry.challenge)
+	if err != nil || rejected != nil {
+		if rejected != nil {
+			rejected.Body.Close()
+		}
+		// Start over with the credentials, the registry challenges again if it still wants a token
+		t.forget(key)
+		return "", false
+	}
+	t.store(key, renewed)
+	return renewed.token, true
+}
+
+// fetchToken exchanges the Basic credentials at the realm of a challenge. A response rejecting
+// the credentials is returned as is, for the caller to pass on.
+func (t *tokenTransport) fetchToken(req *http.Request, basic string, challenge bearerChallenge) (*registryToken, *http.Response, error) {
+	realm, err := url.Parse(challenge.realm)
+	if err != nil || realm.Host == "" {
+		return nil, nil, fmt.Errorf("%w: invalid realm %q", ErrTokenExchange, challenge.realm)
+	}
+	// Credentials sent to a registry over TLS are never exchanged over plain HTTP
+	if realm.Scheme != "https" && realm.Scheme != req.URL.Scheme {
+		return nil, nil, fmt.Errorf("%w: realm %s is not served over https", ErrTokenExchange, challenge.realm)
+	}
+	query := realm.Query()
+	if challenge.service != "" {
+		query.Set("service", challenge.service)
+	}
+	if challenge.scope != "" {
+		query.Set("scope", challenge.scope)
+	}
+	realm.RawQuery = query.Encode()
+
+	tokenReq, err := http.NewRequestWithContext(req.Context(), http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrTokenExchange, err)
+	}
+	tokenReq.Header.Set("Authorization", basic)
+	tokenReq.Header.Set("Accept", "application/json")
+	if userAgent := req.Header.Get("User-Agent"); userAgent != "" {
+		tokenReq.Header.Set("User-Agent", userAgent)
+	}
+
+	resp, err := t.base.RoundTrip(tokenReq)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrTokenExchange, err)
+	}
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		logging.FromContext(req.Context()).Warn("Token service rejected the credentials", "token_service", realm.Host, "host", req.URL.Host, "scope", challenge.scope)
+		return nil, resp, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("%w: token service %s returned %s", ErrTokenExchange, realm.Host, resp.Status)
+	}
+
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxTokenResponseSize)).Decode(&body); err != nil {
+		return nil, nil, fmt.Errorf("%w: failed to decode token response from %s: %v", ErrTokenExchange, realm.Host, err)
+	}
+	token := body.Token
+	if token == "" {
+		token = body.AccessToken
+	}
+	if token == "" {
+		return nil, nil, fmt.Errorf("%w: token service %s returned no token", ErrTokenExchange, realm.Host)
+	}
+
+	lifetime := defaultTokenLifetime
+	if body.ExpiresIn > 0 {
+		lifetime = time.Duration(body.ExpiresIn) * time.Second
+	}
+	return &registryToken{
+		challenge: challenge,
+		token:     token,
+		expiresAt: t.now().Add(max(lifetime-tokenExpiryMargin, 0)),
+	}, nil, nil
+}
+
+// store keeps a token for the key and drops entries whose tokens expired long ago
+func (t *tokenTransport) store(key string, entry *registryToken) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.tokens[key] = entry
+	cutoff := t.now().Add(-tokenRetention)
+	for k, e := range t.tokens {
+		if e.expiresAt.Before(cutoff) {
+			delete(t.tokens, k)
+		}
+	}
+}
+
+// forget drops the token of the key
+func (t *tokenTransport) forget(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.tokens, key)
+}
+
+// tokenKey identifies the tokens of a set of credentials for the registry host, repository and
+// kind of access of a request
+func tokenKey(req *http.Request, authorization string) string {
+	sum := sha256.Sum256([]byte(authorization))
+	access := "push"
+	if req.Method == http.MethodGet || req.Method == http.MethodHead {
+		access = "pull"
+	}
+	return strings.Join([]string{hex.EncodeToString(sum[:]), strings.ToLower(req.URL.Host), repository(req.URL.Path), access}, "|")
+}
+
+// repository returns the repository name of a registry API path, or the path itself for
+// endpoints outside a repository such as /v2/ and /v2/_catalog
+func repository(path string) string {
+	if i := strings.Index(path, "/v2/"); i >= 0 {
+		path = path[i+len("/v2/"):]
+	}
+	for _, marker := range []string{"/manifests/", "/blobs/", "/tags/", "/referrers/"} {
+		if i := strings.LastIndex(path, marker); i >= 0 {
+			return path[:i]
+		}
+	}
+	return path
+}
+
+// withAuthorization returns a copy of the request with another Authorization header
+func withAuthorization(req *http.Request, authorization string) *http.Request {
+	out := req.Clone(req.Context())
+	out.Header.Set("Authorization", authorization)
+	return out
+}
+
+// parseBearerChallenge parses a WWW-Authenticate Bearer challenge such as
+// Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/alpine:pull"
+func parseBearerChallenge(header string) (bearerChallenge, bool) {
+	scheme, params, _ := strings.Cut(strings.TrimSpace(header), " ")
+	if !strings.EqualFold(scheme, "Bearer") {
+		return bearerChallenge{}, false
+	}
+
+	values := make(map[string]string)
+	params = strings.TrimSpace(params)
+	for params != "" {
+		name, rest, ok := strings.Cut(params, "=")
+		if !ok {
+			break
+		}
+		name = strings.ToLower(strings.TrimSpace(name))
+		rest = strings.TrimSpace(rest)
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			// Quoted values may hold commas, such as the actions of a scope
+			end := strings.IndexByte(rest[1:], '"')
+			if end < 0 {
+				break
+			}
+			value, rest = rest[1:end+1], rest[end+2:]
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+			value = strings.TrimSpace(value)
+		}
+		values[name] = value
+		params = strings.TrimLeft(rest, ", ")
+	}
+
+	if values["realm"] == "" {
+		return bearerChallenge{}, false
+	}
+	return bearerChallenge{realm: values["realm"], service: values["service"], scope: values["scope"]}, true
+}
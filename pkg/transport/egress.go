@@ -0,0 +1,76 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+)
+
+var (
+	ErrEgressDenied = errors.New("egress denied")
+)
+
+// HostAllowlist matches upstream host names against glob patterns such as
+// "registry.example.com" or "*.dkr.ecr.*.amazonaws.com"
+type HostAllowlist struct {
+	patterns []string
+}
+
+// NewHostAllowlist creates an allowlist, validating the patterns
+func NewHostAllowlist(patterns []string) (*HostAllowlist, error) {
+	allowlist := &HostAllowlist{}
+	for _, pattern := range patterns {
+		pattern = normalizeHost(pattern)
+		if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+			return nil, fmt.Errorf("invalid host pattern %q", pattern)
+		}
+		allowlist.patterns = append(allowlist.patterns, pattern)
+	}
+	return allowlist, nil
+}
+
+// Allows reports whether host, with or without scheme and port, matches the allowlist
+func (a *HostAllowlist) Allows(host string) bool {
+	host = normalizeHost(host)
+	for _, pattern := range a.patterns {
+		if matched, _ := path.Match(pattern, host); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Check returns ErrEgressDenied when host is not allowed
+func (a *HostAllowlist) Check(host string) error {
+	if !a.Allows(host) {
+		return fmt.Errorf("%w: %s is not in the upstream allowlist", ErrEgressDenied, normalizeHost(host))
+	}
+	return nil
+}
+
+// NewEgressTransport wraps base so that requests, including redirects, to hosts outside the
+// allowlist fail without being dialed
+func NewEgressTransport(base http.RoundTripper, allowlist *HostAllowlist) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &egressTransport{base: base, allowlist: allowlist}
+}
+
+// egressTransport enforces a host allowlist on outbound requests
+type egressTransport struct {
+	base      http.RoundTripper
+	allowlist *HostAllowlist
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *egressTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.allowlist.Check(req.URL.Hostname()); err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	return t.base.RoundTrip(req)
+}
@@ -0,0 +1,121 @@
+// Package transport builds the HTTP transports used for upstream registry connections.
+package transport
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+var (
+	ErrInvalidPin  = errors.New("invalid certificate pin")
+	ErrPinMismatch = errors.New("certificate pinning failed")
+)
+
+// Pin is an expected hash of a certificate in an upstream's chain
+type Pin struct {
+	SPKI bool   // hash of the SubjectPublicKeyInfo instead of the whole certificate
+	Hash []byte // SHA-256 digest
+}
+
+// ParsePin parses "sha256/<base64>" SPKI pins, as used by HPKP and curl --pinnedpubkey, and
+// "sha256:<hex>" certificate fingerprints, optionally colon separated as printed by openssl
+func ParsePin(pin string) (Pin, error) {
+	var (
+		parsed Pin
+		err    error
+	)
+	switch {
+	case strings.HasPrefix(pin, "sha256/"):
+		parsed.SPKI = true
+		parsed.Hash, err = base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, "sha256/"))
+	case strings.HasPrefix(strings.ToLower(pin), "sha256:"):
+		parsed.Hash, err = hex.DecodeString(strings.ReplaceAll(pin[len("sha256:"):], ":", ""))
+	default:
+		return parsed, fmt.Errorf("%w %q: expected sha256/<base64 SPKI hash> or sha256:<hex certificate fingerprint>", ErrInvalidPin, pin)
+	}
+	if err != nil || len(parsed.Hash) != sha256.Size {
+		return parsed, fmt.Errorf("%w %q: not a SHA-256 hash", ErrInvalidPin, pin)
+	}
+	return parsed, nil
+}
+
+// Matches reports whether the certificate matches the pin
+func (p Pin) Matches(cert *x509.Certificate) bool {
+	var sum [sha256.Size]byte
+	if p.SPKI {
+		sum = sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	} else {
+		sum = sha256.Sum256(cert.Raw)
+	}
+	return bytes.Equal(sum[:], p.Hash)
+}
+
+// NewPinnedTransport returns a copy of base whose TLS connections to pinned hosts fail closed
+// unless a certificate in a verified chain matches one of the host's pins. Pins are keyed
+// by registry host name; other hosts are only subject to normal certificate verification.
+func NewPinnedTransport(base *http.Transport, pins map[string][]string) (*http.Transport, error) {
+	parsed := make(map[string][]Pin, len(pins))
+	for host, hostPins := range pins {
+		host = normalizeHost(host)
+		for _, pin := range hostPins {
+			p, err := ParsePin(pin)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", host, err)
+			}
+			parsed[host] = append(parsed[host], p)
+		}
+	}
+
+	transport := base.Clone()
+	if transport.TLSClientConfig == nil {
+		transport.TLSClientConfig = &tls.Config{}
+	}
+	verify := transport.TLSClientConfig.VerifyConnection
+	transport.TLSClientConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+		if verify != nil {
+			if err := verify(cs); err != nil {
+				return err
+			}
+		}
+		return verifyPins(parsed[normalizeHost(cs.ServerName)], cs)
+	}
+	return transport, nil
+}
+
+// verifyPins checks the verified chains of a connection against the pins of its host. The
+// certificates the server presented are not trusted on their own: any server can append a
+// pinned certificate, which is public, to an unrelated chain.
+func verifyPins(pins []Pin, cs tls.ConnectionState) error {
+	if len(pins) == 0 {
+		return nil
+	}
+	for _, chain := range cs.VerifiedChains {
+		for _, cert := range chain {
+			for _, pin := range pins {
+				if pin.Matches(cert) {
+					return nil
+				}
+			}
+		}
+	}
+	return fmt.Errorf("%w for %s: no verified certificate chain matches the configured pins", ErrPinMismatch, cs.ServerName)
+}
+
+// normalizeHost lower-cases a host name and strips any scheme and port
+func normalizeHost(host string) string {
+	host = strings.TrimPrefix(strings.TrimPrefix(host, "https://"), "http://")
+	host = strings.TrimSuffix(host, "/")
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
@@ -0,0 +1,49 @@
+package transport
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// NewHostPool returns a RoundTripper giving each upstream host its own clone of base, so the
+// connection limits of base apply per host and a slow registry holding its connections cannot
+// exhaust the pool of the others. Hosts include the token services and blob storage registries
+// redirect to.
+func NewHostPool(base *http.Transport) http.RoundTripper {
+	return &hostPool{base: base, transports: make(map[string]*http.Transport)}
+}
+
+// hostPool is the http.RoundTripper returned by NewHostPool
+type hostPool struct {
+	base *http.Transport
+
+	mu         sync.Mutex
+	transports map[string]*http.Transport
+}
+
+func (p *hostPool) RoundTrip(req *http.Request) (*http.Response, error) {
+	return p.transport(req.URL.Host).RoundTrip(req)
+}
+
+// transport returns the transport of host, creating it on first use
+func (p *hostPool) transport(host string) *http.Transport {
+	host = strings.ToLower(host)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	transport, ok := p.transports[host]
+	if !ok {
+		transport = p.base.Clone()
+		p.transports[host] = transport
+	}
+	return transport
+}
+
+// CloseIdleConnections closes the idle connections of every host, for http.Client
+func (p *hostPool) CloseIdleConnections() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, transport := range p.transports {
+		transport.CloseIdleConnections()
+	}
+}
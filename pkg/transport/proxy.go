@@ -0,0 +1,71 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// DirectProxy is the proxy URL of rules whose hosts are connected to without a proxy
+const DirectProxy = "direct"
+
+// ProxyRule sends the requests to hosts matching one of its patterns through an outbound proxy
+type ProxyRule struct {
+	Hosts []string // host globs, such as "*.dkr.ecr.*.amazonaws.com"
+	URL   string   // http, https, socks5 or socks5h proxy URL, or DirectProxy
+}
+
+// NewProxyFunc returns a proxy function for http.Transport choosing the proxy of the first rule
+// matching the host of a request. Requests to other hosts use fallback, such as
+// http.ProxyFromEnvironment; a nil fallback connects to them directly.
+func NewProxyFunc(rules []ProxyRule, fallback func(*http.Request) (*url.URL, error)) (func(*http.Request) (*url.URL, error), error) {
+	type compiledRule struct {
+		hosts *HostAllowlist
+		proxy *url.URL // nil for DirectProxy
+	}
+	compiled := make([]compiledRule, 0, len(rules))
+	for i, rule := range rules {
+		hosts, err := NewHostAllowlist(rule.Hosts)
+		if err != nil {
+			return nil, fmt.Errorf("proxy %d: %v", i, err)
+		}
+		var proxy *url.URL
+		if rule.URL != DirectProxy {
+			if proxy, err = ParseProxyURL(rule.URL); err != nil {
+				return nil, fmt.Errorf("proxy %d: %v", i, err)
+			}
+		}
+		compiled = append(compiled, compiledRule{hosts: hosts, proxy: proxy})
+	}
+
+	return func(req *http.Request) (*url.URL, error) {
+		for _, rule := range compiled {
+			if rule.hosts.Allows(req.URL.Host) {
+				return rule.proxy, nil
+			}
+		}
+		if fallback == nil {
+			return nil, nil
+		}
+		return fallback(req)
+	}, nil
+}
+
+// ParseProxyURL parses the URL of an outbound proxy, which may carry credentials
+func ParseProxyURL(rawURL string) (*url.URL, error) {
+	proxy, err := url.Parse(rawURL)
+	if err != nil {
+		// The error quotes the URL, credentials included
+		return nil, errors.New("invalid proxy URL")
+	}
+	switch proxy.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q, expected http, https, socks5 or socks5h", proxy.Scheme)
+	}
+	if proxy.Host == "" {
+		return nil, fmt.Errorf("proxy URL %s has no host", proxy.Redacted())
+	}
+	return proxy, nil
+}
@@ -0,0 +1,155 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"vault-docker-proxy/pkg/logging"
+)
+
+// RetryPolicy configures the retries of idempotent upstream requests failing transiently
+type RetryPolicy struct {
+	MaxRetries     int           // retries after the first attempt
+	InitialBackoff time.Duration // delay before the first retry, doubled for each one after it
+	MaxBackoff     time.Duration // upper bound of the delay between retries
+	Budget         time.Duration // time a request may spend including retries, 0 for no limit
+}
+
+// RetryStats counts the retries of a retry transport
+type RetryStats struct {
+	Retries   map[string]uint64 // by reason: the status code, or network
+	Exhausted uint64            // requests that still failed when retries or budget ran out
+}
+
+// RetryTransport retries GET and HEAD requests failing with 502, 503, 504 or a network error,
+// with jittered exponential backoff, as long as the retries fit in the request's budget
+type RetryTransport struct {
+	base   http.RoundTripper
+	policy RetryPolicy
+
+	mu        sync.Mutex
+	retries   map[string]uint64
+	exhausted uint64
+
+	now   func() time.Time
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+// NewRetryTransport wraps base with retries; a nil base is http.DefaultTransport
+func NewRetryTransport(base http.RoundTripper, policy RetryPolicy) *RetryTransport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &RetryTransport{
+		base:    base,
+		policy:  policy,
+		retries: make(map[string]uint64),
+		now:     time.Now,
+		sleep:   sleepContext,
+	}
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *RetryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return t.base.RoundTrip(req)
+	}
+	start := t.now()
+
+	for attempt := 0; ; attempt++ {
+		resp, err := t.base.RoundTrip(req)
+		reason, retry := retryReason(resp, err)
+		if !retry || req.Context().Err() != nil {
+			return resp, err
+		}
+
+		delay := t.backoff(attempt)
+		if attempt >= t.policy.MaxRetries || (t.policy.Budget > 0 && t.now().Add(delay).Sub(start) > t.policy.Budget) {
+			t.mu.Lock()
+			t.exhausted++
+			t.mu.Unlock()
+			return resp, err
+		}
+
+		if resp != nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, maxDrainSize))
+			resp.Body.Close()
+		}
+		t.mu.Lock()
+		t.retries[reason]++
+		t.mu.Unlock()
+		logger := logging.FromContext(req.Context()).With("host", req.URL.Host, "method", req.Method, "path", req.URL.Path, "attempt", attempt+1, "retry_in", delay.Round(time.Millisecond))
+		if err != nil {
+			logger.Warn("Upstream request failed, retrying", "error", err)
+		} else {
+			logger.Warn("Upstream registry is unavailable, retrying", "status", resp.StatusCode)
+		}
+		if err := t.sleep(req.Context(), delay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// backoff returns the delay before the retry following attempt, between half and all of the
+// exponential backoff so concurrent requests do not retry in lockstep
+func (t *RetryTransport) backoff(attempt int) time.Duration {
+	backoff := t.policy.InitialBackoff
+	for i := 0; i < attempt && backoff < t.policy.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	backoff = min(backoff, t.policy.MaxBackoff)
+	if backoff <= 0 {
+		return 0
+	}
+	return backoff/2 + rand.N(backoff/2+1)
+}
+
+// Stats returns the retry counters
+func (t *RetryTransport) Stats() RetryStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	stats := RetryStats{Retries: make(map[string]uint64, len(t.retries)), Exhausted: t.exhausted}
+	for reason, count := range t.retries {
+		stats.Retries[reason] = count
+	}
+	return stats
+}
+
+// retryReason reports whether the outcome of a request is transient, and why
+func retryReason(resp *http.Response, err error) (string, bool) {
+	if err != nil {
+		// Refusals of the egress allowlist and failed certificate checks fail again
+		var netErr net.Error
+		if errors.Is(err, ErrEgressDenied) || errors.Is(err, ErrPinMismatch) {
+			return "", false
+		}
+		if errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return "network", true
+		}
+		return "", false
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return strconv.Itoa(resp.StatusCode), true
+	}
+	return "", false
+}
+
+// sleepContext waits for d or until ctx is done
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,153 @@
+package transport
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"vault-docker-proxy/pkg/logging"
+)
+
+// maxDrainSize bounds the 429 response bodies read before retrying, so connections can be reused
+const maxDrainSize = 64 * 1024
+
+// NewRetryAfterTransport wraps base so that upstream 429 responses carrying Retry-After are
+// retried after the advertised delay instead of being returned, as long as the request
+// completes within budget. While a host is rate limited, other requests to it wait for the
+// same delay instead of adding to the burst. At most maxQueued requests wait at once; beyond
+// that, and for requests whose body cannot be replayed, the 429 is returned as is.
+func NewRetryAfterTransport(base http.RoundTripper, budget time.Duration, maxQueued int) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &retryAfterTransport{
+		base:         base,
+		budget:       budget,
+		queue:        make(chan struct{}, maxQueued),
+		blockedUntil: make(map[string]time.Time),
+		now:          time.Now,
+	}
+}
+
+// retryAfterTransport is the http.RoundTripper returned by NewRetryAfterTransport
+type retryAfterTransport struct {
+	base   http.RoundTripper
+	budget time.Duration
+	queue  chan struct{} // one slot per waiting request
+
+	mu           sync.Mutex
+	blockedUntil map[string]time.Time // rate-limited hosts and when they accept requests again
+
+	now func() time.Time
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *retryAfterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	deadline := t.now().Add(t.budget)
+	host := req.URL.Host
+
+	if until := t.blocked(host); !until.IsZero() && until.Before(deadline) {
+		if err := t.wait(req, until); err != nil {
+			return nil, err
+		}
+	}
+
+	// Retries send clones, as a RoundTripper must not modify the caller's request
+	attempt := req
+	for {
+		resp, err := t.base.RoundTrip(attempt)
+		if err != nil || resp.StatusCode != http.StatusTooManyRequests {
+			return resp, err
+		}
+
+		delay, ok := retryAfter(resp.Header.Get("Retry-After"), t.now())
+		if !ok {
+			return resp, nil
+		}
+		until := t.now().Add(delay)
+		t.block(host, until)
+		if until.After(deadline) || !replayable(req) {
+			return resp, nil
+		}
+
+		io.Copy(io.Discard, io.LimitReader(resp.Body, maxDrainSize))
+		resp.Body.Close()
+		logging.FromContext(req.Context()).Warn("Upstream registry rate limited a request, retrying", "host", host, "method", req.Method, "path", req.URL.Path, "retry_in", delay.Round(time.Millisecond))
+		if err := t.wait(req, until); err != nil {
+			return nil, err
+		}
+		attempt = req.Clone(req.Context())
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			attempt.Body = body
+		}
+	}
+}
+
+// wait blocks until the given time in one of the queue slots. When every slot is taken the
+// request is sent right away and the upstream decides.
+func (t *retryAfterTransport) wait(req *http.Request, until time.Time) error {
+	select {
+	case t.queue <- struct{}{}:
+		defer func() { <-t.queue }()
+	default:
+		return nil
+	}
+
+	timer := time.NewTimer(until.Sub(t.now()))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-req.Context().Done():
+		return req.Context().Err()
+	}
+}
+
+// blocked returns when a rate-limited host accepts requests again, or the zero time
+func (t *retryAfterTransport) blocked(host string) time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	until, ok := t.blockedUntil[host]
+	if ok && !until.After(t.now()) {
+		delete(t.blockedUntil, host)
+		return time.Time{}
+	}
+	return until
+}
+
+// block records that host is rate limited until the given time
+func (t *retryAfterTransport) block(host string, until time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if until.After(t.blockedUntil[host]) {
+		t.blockedUntil[host] = until
+	}
+}
+
+// retryAfter parses a Retry-After value in seconds or as an HTTP date
+func retryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(date.Sub(now), 0), true
+	}
+	return 0, false
+}
+
+// replayable reports whether a request can be sent again
+func replayable(req *http.Request) bool {
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
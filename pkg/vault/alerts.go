@@ -0,0 +1,156 @@
+package vault
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// webhookTimeout bounds the delivery of an alert
+const webhookTimeout = 10 * time.Second
+
+// ErrorRateAlert posts to a webhook when the share of Vault calls failing because Vault is
+// unreachable, overloaded or failing breaches a threshold over a sliding window, and again once
+// the rate is back under it. Permission denied and missing secrets tell nothing about the health
+// of Vault and do not count.
+type ErrorRateAlert struct {
+	client     *Client
+	webhookURL string
+	threshold  float64 // error rate, between 0 and 1
+	window     time.Duration
+	minCalls   uint64 // calls needed within the window before alerting
+	httpClient *http.Client
+
+	samples []alertSample
+	firing  bool
+}
+
+// alertSample is a snapshot of the cumulative call counters
+type alertSample struct {
+	time       time.Time
+	calls      uint64
+	errors     uint64
+	errorTypes map[string]uint64
+}
+
+// AlertPayload is the JSON body posted to the webhook
+type AlertPayload struct {
+	Alert        string            `json:"alert"`
+	Status       string            `json:"status"` // firing or resolved
+	Message      string            `json:"message"`
+	VaultAddress string            `json:"vault_address"`
+	ErrorRate    float64           `json:"error_rate"`
+	Threshold    float64           `json:"threshold"`
+	Window       string            `json:"window"`
+	Calls        uint64            `json:"calls"`
+	Errors       uint64            `json:"errors"`
+	ErrorTypes   map[string]uint64 `json:"error_types"`
+	Time         time.Time         `json:"time"`
+}
+
+// NewErrorRateAlert creates an alert on the Vault error rate of client
+func NewErrorRateAlert(client *Client, webhookURL string, threshold float64, window time.Duration, minCalls uint64) *ErrorRateAlert {
+	return &ErrorRateAlert{
+		client:     client,
+		webhookURL: webhookURL,
+		threshold:  threshold,
+		window:     window,
+		minCalls:   minCalls,
+		httpClient: &http.Client{Timeout: webhookTimeout},
+	}
+}
+
+// Run evaluates the error rate every interval until ctx is cancelled
+func (a *ErrorRateAlert) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			a.evaluate(ctx, time.Now())
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// evaluate computes the error rate over the window and notifies the webhook of state changes
+func (a *ErrorRateAlert) evaluate(ctx context.Context, now time.Time) {
+	m := a.client.Metrics()
+	current := alertSample{time: now, calls: m.Calls, errors: m.UnavailableErrors(), errorTypes: m.ErrorTypes}
+
+	// Keep the newest sample at least a window old as the baseline
+	a.samples = append(a.samples, current)
+	for len(a.samples) > 1 && !a.samples[1].time.After(now.Add(-a.window)) {
+		a.samples = a.samples[1:]
+	}
+	baseline := a.samples[0]
+
+	calls := current.calls - baseline.calls
+	errors := current.errors - baseline.errors
+	rate := 0.0
+	if calls > 0 {
+		rate = float64(errors) / float64(calls)
+	}
+
+	breached := calls >= a.minCalls && calls > 0 && rate >= a.threshold
+	if breached == a.firing {
+		return
+	}
+	a.firing = breached
+
+	payload := AlertPayload{
+		Alert:        "vault_error_rate",
+		Status:       "resolved",
+		VaultAddress: a.client.config.Address,
+		ErrorRate:    rate,
+		Threshold:    a.threshold,
+		Window:       a.window.String(),
+		Calls:        calls,
+		Errors:       errors,
+		ErrorTypes:   make(map[string]uint64),
+		Time:         now.UTC(),
+	}
+	for errorType, count := range current.errorTypes {
+		if delta := count - baseline.errorTypes[errorType]; delta > 0 {
+			payload.ErrorTypes[errorType] = delta
+		}
+	}
+	payload.Message = fmt.Sprintf("Vault error rate is %.1f%% (%d of %d calls) over the last %s", rate*100, errors, calls, a.window)
+	if breached {
+		payload.Status = "firing"
+		payload.Message += fmt.Sprintf(", above the %.1f%% threshold", a.threshold*100)
+	}
+
+	slog.Warn("Vault error rate alert", "status", payload.Status, "message", payload.Message)
+	if err := a.notify(ctx, payload); err != nil {
+		slog.Error("Failed to deliver Vault error rate alert", "error", err)
+	}
+}
+
+// notify posts an alert to the webhook
+func (a *ErrorRateAlert) notify(ctx context.Context, payload AlertPayload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned HTTP %d", resp.StatusCode)
+	}
+	return nil
+}
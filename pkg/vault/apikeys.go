@@ -0,0 +1,108 @@
+package vault
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/patrickmn/go-cache"
+
+	"vault-docker-proxy/pkg/auth"
+)
+
+// APIKeyStore resolves API keys stored in the KV v2 engine. Each key is stored under its
+// SHA-256 hash, so Vault never holds the key itself:
+//
+//	<mount>/<path>/<sha256 hex of key>
+//	  registry:    <registry_type>;<vault_path>;<registry_url>
+//	  permissions: pull,push,delete (or *)
+//	  name:        optional label used in logs and errors
+//
+// Secrets are read with the client's own token, which also reads the registry credentials for
+// requests authenticated with an API key.
+type APIKeyStore struct {
+	client *Client
+	mount  string
+	path   string
+	cache  *cache.Cache
+}
+
+// NewAPIKeyStore creates an API key store. Resolved keys are cached for ttl, so revoking a key
+// in Vault takes effect within ttl.
+func NewAPIKeyStore(client *Client, mount, keyPath string, ttl time.Duration) *APIKeyStore {
+	return &APIKeyStore{
+		client: client,
+		mount:  mount,
+		path:   keyPath,
+		cache:  cache.New(ttl, 2*ttl),
+	}
+}
+
+// ResolveAPIKey implements auth.APIKeyResolver
+func (s *APIKeyStore) ResolveAPIKey(ctx context.Context, key string) (*auth.APIKey, error) {
+	hash := auth.HashAPIKey(key)
+	if cached, found := s.cache.Get(hash); found {
+		return cached.(*auth.APIKey), nil
+	}
+
+	secret, err := s.client.client.KVv2(s.mount).Get(ctx, path.Join(s.path, hash))
+	if err != nil {
+		if errors.Is(err, api.ErrSecretNotFound) {
+			return nil, auth.ErrAPIKeyInvalid
+		}
+		return nil, fmt.Errorf("%w: %v", ErrVaultConnection, err)
+	}
+	if secret == nil || secret.Data == nil {
+		return nil, auth.ErrAPIKeyInvalid
+	}
+
+	apiKey, err := parseAPIKey(hash, secret.Data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", auth.ErrAPIKeyInvalid, err)
+	}
+
+	s.cache.SetDefault(hash, apiKey)
+	return apiKey, nil
+}
+
+// parseAPIKey decodes the registry access stored for an API key
+func parseAPIKey(hash string, data map[string]interface{}) (*auth.APIKey, error) {
+	username, _ := data["registry"].(string)
+	registryConfig, err := auth.ParseUsername(username)
+	if err != nil {
+		return nil, fmt.Errorf("registry: %v", err)
+	}
+
+	apiKey := &auth.APIKey{
+		Name:     hash[:12],
+		Registry: *registryConfig,
+	}
+	if name, ok := data["name"].(string); ok && name != "" {
+		apiKey.Name = name
+	}
+
+	switch permissions := data["permissions"].(type) {
+	case string:
+		for _, permission := range strings.Split(permissions, ",") {
+			if permission = strings.TrimSpace(permission); permission != "" {
+				apiKey.Permissions = append(apiKey.Permissions, permission)
+			}
+		}
+	case []interface{}:
+		for _, permission := range permissions {
+			if s, ok := permission.(string); ok {
+				apiKey.Permissions = append(apiKey.Permissions, s)
+			}
+		}
+	}
+	if len(apiKey.Permissions) == 0 {
+		// Keys default to read-only access
+		apiKey.Permissions = []string{auth.ActionPull}
+	}
+
+	return apiKey, nil
+}
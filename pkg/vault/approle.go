@@ -0,0 +1,138 @@
+package vault
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/patrickmn/go-cache"
+)
+
+// AppRolePrefix marks a Basic auth password carrying AppRole credentials instead of a Vault
+// token: approle:<role_id>:<secret_id>
+const AppRolePrefix = "approle:"
+
+// maxAppRoleTokenReuse bounds how long a token obtained with the AppRole credentials of a client
+// is reused
+const maxAppRoleTokenReuse = time.Hour
+
+var ErrLoginFailed = errors.New("Vault login failed")
+
+// AppRole logs in with the AppRole auth method mounted at Mount. It implements api.AuthMethod.
+type AppRole struct {
+	Mount        string
+	RoleID       string
+	SecretID     string
+	SecretIDFile string // read at every login, so a rotated secret ID is picked up
+}
+
+// Login implements api.AuthMethod
+func (a *AppRole) Login(ctx context.Context, client *api.Client) (*api.Secret, error) {
+	secretID := a.SecretID
+	if a.SecretIDFile != "" {
+		data, err := os.ReadFile(a.SecretIDFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read secret ID: %v", err)
+		}
+		secretID = strings.TrimSpace(string(data))
+	}
+	return client.Logical().WriteWithContext(ctx, "auth/"+strings.Trim(a.Mount, "/")+"/login", map[string]interface{}{
+		"role_id":   a.RoleID,
+		"secret_id": secretID,
+	})
+}
+
+// Login logs the client in with method and uses the resulting token as its own, in place of
+// VAULT_TOKEN. It returns the lease of the token.
+func (c *Client) Login(ctx context.Context, method api.AuthMethod) (TokenLease, error) {
+	client, err := c.withToken(ctx, "")
+	if err != nil {
+		return TokenLease{}, err
+	}
+	secret, err := method.Login(ctx, client)
+	if err != nil {
+		return TokenLease{}, fmt.Errorf("%w: %v", ErrLoginFailed, err)
+	}
+	if secret == nil || secret.Auth == nil || secret.Auth.ClientToken == "" {
+		return TokenLease{}, fmt.Errorf("%w: no token in the login response", ErrLoginFailed)
+	}
+	c.SetToken(secret.Auth.ClientToken)
+	return leaseOf(secret.Auth), nil
+}
+
+// AppRoleLogins turns the AppRole credentials clients send as password into Vault tokens.
+// Tokens are reused until two thirds of their TTL have passed, so secret IDs with a limited
+// number of uses are not spent on every request.
+type AppRoleLogins struct {
+	client *Client
+	mount  string
+	cache  *cache.Cache
+
+	mu sync.Mutex // serializes logins, so concurrent first requests share one
+}
+
+// NewAppRoleLogins creates logins with the AppRole auth method mounted at mount
+func NewAppRoleLogins(client *Client, mount string) *AppRoleLogins {
+	return &AppRoleLogins{
+		client: client,
+		mount:  mount,
+		cache:  cache.New(cache.NoExpiration, 10*time.Minute),
+	}
+}
+
+// IsAppRolePassword reports whether a password carries AppRole credentials
+func IsAppRolePassword(password string) bool {
+	return strings.HasPrefix(password, AppRolePrefix)
+}
+
+// Token returns a Vault token for a password of the form approle:<role_id>:<secret_id>
+func (l *AppRoleLogins) Token(ctx context.Context, password string) (string, error) {
+	roleID, secretID, ok := strings.Cut(strings.TrimPrefix(password, AppRolePrefix), ":")
+	if !ok || roleID == "" || secretID == "" {
+		return "", fmt.Errorf("%w: AppRole password must be of the form %s<role_id>:<secret_id>", ErrInvalidToken, AppRolePrefix)
+	}
+
+	// Logins in different namespaces are different tokens
+	sum := sha256.Sum256([]byte(l.client.namespaceOf(ctx) + "\x00" + password))
+	key := hex.EncodeToString(sum[:])
+	if token, found := l.cache.Get(key); found {
+		return token.(string), nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if token, found := l.cache.Get(key); found {
+		return token.(string), nil
+	}
+
+	client, err := l.client.withToken(ctx, "")
+	if err != nil {
+		return "", err
+	}
+	method := &AppRole{Mount: l.mount, RoleID: roleID, SecretID: secretID}
+	secret, err := method.Login(ctx, client)
+	if err != nil {
+		var respErr *api.ResponseError
+		if errors.As(err, &respErr) && respErr.StatusCode < 500 {
+			return "", fmt.Errorf("%w: AppRole login rejected: %s", ErrInvalidToken, strings.Join(respErr.Errors, "; "))
+		}
+		return "", fmt.Errorf("%w: %v", ErrVaultConnection, err)
+	}
+	if secret == nil || secret.Auth == nil || secret.Auth.ClientToken == "" {
+		return "", fmt.Errorf("%w: no token in the AppRole login response", ErrLoginFailed)
+	}
+
+	ttl := maxAppRoleTokenReuse
+	if lease := time.Duration(secret.Auth.LeaseDuration) * time.Second; lease > 0 {
+		ttl = min(lease*2/3, ttl)
+	}
+	l.cache.Set(key, secret.Auth.ClientToken, ttl)
+	return secret.Auth.ClientToken, nil
+}
@@ -0,0 +1,67 @@
+package vault
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+
+	"vault-docker-proxy/pkg/awsauth"
+)
+
+// getCallerIdentityBody is the sts:GetCallerIdentity request Vault replays to identify the proxy
+const getCallerIdentityBody = "Action=GetCallerIdentity&Version=2011-06-15"
+
+// AWSIAM logs in with the iam type of the AWS auth method mounted at Mount: the proxy signs an
+// sts:GetCallerIdentity request with the AWS credentials of its environment (instance profile,
+// task role or IAM role for service accounts) and Vault replays it to learn the proxy's IAM
+// identity. It implements api.AuthMethod.
+type AWSIAM struct {
+	Mount    string
+	Role     string // Vault role, the name of the IAM role or user when empty
+	Region   string // STS region, the global endpoint when empty
+	ServerID string // X-Vault-AWS-IAM-Server-ID value, when the auth method requires one
+}
+
+// Login implements api.AuthMethod
+func (a *AWSIAM) Login(ctx context.Context, client *api.Client) (*api.Secret, error) {
+	credentials, err := awsauth.DefaultCredentials(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	region := a.Region
+	if region == "" {
+		region = "us-east-1" // signing region of the global endpoint
+	}
+	body := []byte(getCallerIdentityBody)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, awsauth.STSEndpoint(a.Region), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	if a.ServerID != "" {
+		req.Header.Set("X-Vault-AWS-IAM-Server-ID", a.ServerID)
+	}
+	awsauth.Sign(req, body, credentials, region, "sts", time.Now())
+
+	headers, err := json.Marshal(req.Header)
+	if err != nil {
+		return nil, err
+	}
+	data := map[string]interface{}{
+		"iam_http_request_method": req.Method,
+		"iam_request_url":         base64.StdEncoding.EncodeToString([]byte(req.URL.String())),
+		"iam_request_headers":     base64.StdEncoding.EncodeToString(headers),
+		"iam_request_body":        base64.StdEncoding.EncodeToString(body),
+	}
+	if a.Role != "" {
+		data["role"] = a.Role
+	}
+	return client.Logical().WriteWithContext(ctx, "auth/"+strings.Trim(a.Mount, "/")+"/login", data)
+}
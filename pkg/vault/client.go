@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net/http"
 
 	"github.com/hashicorp/vault/api"
 
@@ -11,15 +12,19 @@ import (
 )
 
 var (
-	ErrVaultConnection = errors.New("failed to connect to Vault")
-	ErrInvalidToken    = errors.New("invalid Vault token")
-	ErrSecretNotFound  = errors.New("secret not found in Vault")
+	ErrVaultConnection  = errors.New("failed to connect to Vault")
+	ErrInvalidToken     = errors.New("invalid Vault token")
+	ErrSecretNotFound   = errors.New("secret not found in Vault")
+	ErrPermissionDenied = errors.New("permission denied by Vault")
 )
 
 // Client wraps the HashiCorp Vault API client
 type Client struct {
-	client *api.Client
-	config *Config
+	client    *api.Client
+	config    *Config
+	metrics   *metrics
+	kv        kvMounts
+	namespace string
 }
 
 // Config holds Vault client configuration
@@ -38,11 +43,17 @@ func NewClient(vaultAddr string) (*Client, error) {
 		return nil, fmt.Errorf("%w: %v", ErrVaultConnection, err)
 	}
 
+	// Wrapped after the API client is configured, which expects the default transport
+	m := &metrics{errorTypes: make(map[string]uint64), operations: make(map[string]*operationMetrics)}
+	config.HttpClient.Transport = &metricsTransport{base: config.HttpClient.Transport, metrics: m}
+
 	return &Client{
 		client: client,
 		config: &Config{
 			Address: vaultAddr,
 		},
+		metrics:   m,
+		namespace: client.Namespace(), // VAULT_NAMESPACE
 	}, nil
 }
 
@@ -52,43 +63,103 @@ func (c *Client) SetToken(token string) {
 	c.config.Token = token
 }
 
+// Token returns the client's own token
+func (c *Client) Token() string {
+	return c.client.Token()
+}
+
 // GetCredentials retrieves registry credentials from Vault KV store
 func (c *Client) GetCredentials(ctx context.Context, vaultPath string) (*auth.Credentials, error) {
-	// Use KV v2 secrets engine
-	secret, err := c.client.KVv2("secret").Get(ctx, vaultPath)
+	return c.readCredentials(ctx, c.inNamespace(ctx), vaultPath)
+}
+
+// GetCredentialsWithToken retrieves registry credentials using the given token instead of the
+// client's current token, so concurrent callers with different tokens do not interfere
+func (c *Client) GetCredentialsWithToken(ctx context.Context, token, vaultPath string) (*auth.Credentials, error) {
+	client, err := c.withToken(ctx, token)
 	if err != nil {
-		return nil, fmt.Errorf("%w: %v", ErrSecretNotFound, err)
+		return nil, err
 	}
+	return c.readCredentials(ctx, client, vaultPath)
+}
 
-	if secret == nil || secret.Data == nil {
-		return nil, ErrSecretNotFound
+// GetSecret reads the data of a secret using the client's own token
+func (c *Client) GetSecret(ctx context.Context, vaultPath string) (map[string]interface{}, error) {
+	data, _, err := c.readSecret(ctx, c.inNamespace(ctx), vaultPath)
+	return data, err
+}
+
+// GetSecretWithToken reads the data of a secret using the given token. Registry providers turn
+// the data into credentials.
+func (c *Client) GetSecretWithToken(ctx context.Context, token, vaultPath string) (map[string]interface{}, error) {
+	data, _, err := c.ReadSecretWithToken(ctx, token, vaultPath)
+	return data, err
+}
+
+// ReadSecretWithToken reads the data of a secret using the given token, with its lease when it
+// is a dynamic secret. The caller renews or revokes the lease.
+func (c *Client) ReadSecretWithToken(ctx context.Context, token, vaultPath string) (map[string]interface{}, *auth.Lease, error) {
+	client, err := c.withToken(ctx, token)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.readSecret(ctx, client, vaultPath)
+}
+
+// readCredentials reads and decodes username/password registry credentials from the KV store
+func (c *Client) readCredentials(ctx context.Context, client *api.Client, vaultPath string) (*auth.Credentials, error) {
+	data, lease, err := c.readSecret(ctx, client, vaultPath)
+	if err != nil {
+		return nil, err
+	}
+	credentials, err := auth.BasicCredentialsFromSecret(data)
+	if err != nil {
+		return nil, err
 	}
+	credentials.SetLease(lease)
+	return credentials, nil
+}
 
-	// Extract credentials from secret data
-	data := secret.Data
-	username, ok := data["username"].(string)
-	if !ok {
-		return nil, errors.New("username not found in secret")
+// readSecret reads the data of a secret from the KV store, with the KV version of its mount.
+// Secrets of other engines, such as dynamic registry credentials, are read as they are and
+// returned with their lease.
+func (c *Client) readSecret(ctx context.Context, client *api.Client, vaultPath string) (map[string]interface{}, *auth.Lease, error) {
+	mount, path := c.kv.resolve(ctx, client, vaultPath)
+	if mount.logical {
+		return readLeasedSecret(ctx, client, mount.path+"/"+path)
 	}
 
-	password, ok := data["password"].(string)
-	if !ok {
-		return nil, errors.New("password not found in secret")
+	var secret *api.KVSecret
+	var err error
+	if mount.version == KVv1 {
+		secret, err = client.KVv1(mount.path).Get(ctx, path)
+	} else {
+		secret, err = client.KVv2(mount.path).Get(ctx, path)
+	}
+	if err != nil {
+		return nil, nil, readError(err)
 	}
 
-	// Email is optional
-	email := ""
-	if emailValue, exists := data["email"]; exists {
-		if emailStr, ok := emailValue.(string); ok {
-			email = emailStr
-		}
+	if secret == nil || secret.Data == nil {
+		return nil, nil, ErrSecretNotFound
 	}
+	return secret.Data, nil, nil
+}
 
-	return &auth.Credentials{
-		Username: username,
-		Password: password,
-		Email:    email,
-	}, nil
+// readError classifies the error of a secret read: ErrSecretNotFound and ErrPermissionDenied
+// are answers of Vault that do not change until the secret or the token's policies do, while
+// ErrVaultConnection may go away on retry
+func readError(err error) error {
+	var respErr *api.ResponseError
+	switch {
+	case errors.Is(err, api.ErrSecretNotFound):
+		return fmt.Errorf("%w: %v", ErrSecretNotFound, err)
+	case errors.As(err, &respErr) && respErr.StatusCode == http.StatusNotFound:
+		return fmt.Errorf("%w: %v", ErrSecretNotFound, err)
+	case errors.As(err, &respErr) && respErr.StatusCode == http.StatusForbidden:
+		return fmt.Errorf("%w: %v", ErrPermissionDenied, err)
+	}
+	return fmt.Errorf("%w: %v", ErrVaultConnection, err)
 }
 
 // ValidateToken checks if the current token is valid
@@ -111,8 +182,108 @@ func (c *Client) ValidateToken(ctx context.Context) error {
 	return nil
 }
 
+// LookupToken checks that the given token is valid without changing the client's token
+func (c *Client) LookupToken(ctx context.Context, token string) error {
+	if token == "" {
+		return ErrInvalidToken
+	}
+
+	client, err := c.withToken(ctx, token)
+	if err != nil {
+		return err
+	}
+
+	tokenInfo, err := client.Auth().Token().LookupSelfWithContext(ctx)
+	if err != nil {
+		var respErr *api.ResponseError
+		if errors.As(err, &respErr) && respErr.StatusCode < 500 {
+			return fmt.Errorf("%w: %v", ErrInvalidToken, err)
+		}
+		return fmt.Errorf("%w: %v", ErrVaultConnection, err)
+	}
+	if tokenInfo == nil {
+		return ErrInvalidToken
+	}
+
+	return nil
+}
+
+// withToken returns a copy of the underlying API client authenticated with token, in the
+// namespace of ctx
+func (c *Client) withToken(ctx context.Context, token string) (*api.Client, error) {
+	client, err := c.client.Clone()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrVaultConnection, err)
+	}
+	client.SetToken(token)
+	// Clones read VAULT_NAMESPACE, not the namespace of the original
+	if namespace := c.namespaceOf(ctx); namespace != "" {
+		client.SetNamespace(namespace)
+	} else {
+		client.ClearNamespace()
+	}
+	return client, nil
+}
+
 // Close cleans up the Vault client resources
 func (c *Client) Close() error {
 	// HashiCorp Vault client doesn't require explicit cleanup
 	return nil
-}
\ No newline at end of file
+}
+
+// TokenGroups returns the names of the identity groups, direct and inherited, of the entity
+// behind token. Tokens without an entity (such as root tokens) belong to no group. The entity
+// and groups are read with the client's own token, which needs read access to identity/.
+func (c *Client) TokenGroups(ctx context.Context, token string) ([]string, error) {
+	client, err := c.withToken(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	tokenInfo, err := client.Auth().Token().LookupSelfWithContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	if tokenInfo == nil || tokenInfo.Data == nil {
+		return nil, ErrInvalidToken
+	}
+	entityID, _ := tokenInfo.Data["entity_id"].(string)
+	if entityID == "" {
+		return nil, nil
+	}
+
+	identity := c.inNamespace(ctx).Logical()
+	entity, err := identity.ReadWithContext(ctx, "identity/entity/id/"+entityID)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to read identity entity: %v", ErrVaultConnection, err)
+	}
+	if entity == nil || entity.Data == nil {
+		return nil, nil
+	}
+
+	var groups []string
+	seen := make(map[string]bool)
+	for _, field := range []string{"group_ids", "inherited_group_ids"} {
+		ids, _ := entity.Data[field].([]interface{})
+		for _, id := range ids {
+			groupID, _ := id.(string)
+			if groupID == "" || seen[groupID] {
+				continue
+			}
+			seen[groupID] = true
+
+			group, err := identity.ReadWithContext(ctx, "identity/group/id/"+groupID)
+			if err != nil {
+				return nil, fmt.Errorf("%w: failed to read identity group: %v", ErrVaultConnection, err)
+			}
+			if group == nil || group.Data == nil {
+				continue
+			}
+			if name, ok := group.Data["name"].(string); ok {
+				groups = append(groups, name)
+			}
+		}
+	}
+
+	return groups, nil
+}
@@ -0,0 +1,50 @@
+package vault
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// Kubernetes logs in with the Kubernetes auth method mounted at Mount, presenting the service
+// account token of the pod. It implements api.AuthMethod.
+type Kubernetes struct {
+	Mount     string
+	Role      string
+	TokenFile string // read at every login, as projected tokens are rotated by the kubelet
+}
+
+// Login implements api.AuthMethod
+func (k *Kubernetes) Login(ctx context.Context, client *api.Client) (*api.Secret, error) {
+	return jwtLogin(ctx, client, k.Mount, k.Role, k.TokenFile)
+}
+
+// JWT logs in with the JWT/OIDC auth method mounted at Mount, presenting a workload identity
+// token such as a projected service account token or a CI job token. It implements
+// api.AuthMethod.
+type JWT struct {
+	Mount     string
+	Role      string
+	TokenFile string // read at every login, so refreshed tokens are picked up
+}
+
+// Login implements api.AuthMethod
+func (j *JWT) Login(ctx context.Context, client *api.Client) (*api.Secret, error) {
+	return jwtLogin(ctx, client, j.Mount, j.Role, j.TokenFile)
+}
+
+// jwtLogin logs in with the token in tokenFile to an auth method taking a role and a jwt, as the
+// Kubernetes and JWT methods do
+func jwtLogin(ctx context.Context, client *api.Client, mount, role, tokenFile string) (*api.Secret, error) {
+	jwt, err := os.ReadFile(tokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read token: %v", err)
+	}
+	return client.Logical().WriteWithContext(ctx, "auth/"+strings.Trim(mount, "/")+"/login", map[string]interface{}{
+		"role": role,
+		"jwt":  strings.TrimSpace(string(jwt)),
+	})
+}
@@ -0,0 +1,138 @@
+package vault
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// KV secrets engine versions; KVAuto detects the version of a mount on first use
+const (
+	KVAuto = -1
+	KVv1   = 1
+	KVv2   = 2
+)
+
+// DefaultKVMount is the mount registry secrets are read from when paths do not name one
+const DefaultKVMount = "secret"
+
+// kvMount is a secrets engine mount and its KV version
+type kvMount struct {
+	path    string // without slashes
+	version int
+	logical bool // not a KV engine: secrets are read as they are, with their lease
+}
+
+// kvMounts locates the mounts registry secrets are read from. Paths are relative to the
+// configured mount, unless they start with a slash and name their mount. Detected versions are
+// kept for the life of the client, per namespace.
+type kvMounts struct {
+	mount   string
+	version int
+
+	mu       sync.RWMutex
+	detected map[string][]kvMount // by namespace
+}
+
+// SetKV sets the mount relative secret paths are read from and its version, KVAuto to detect it
+func (c *Client) SetKV(mount string, version int) {
+	c.kv.mu.Lock()
+	defer c.kv.mu.Unlock()
+	c.kv.mount = strings.Trim(mount, "/")
+	c.kv.version = version
+	c.kv.detected = nil
+}
+
+// resolve returns the mount, version and mount relative path of a secret path. Versions are
+// detected with the sys/internal/ui/mounts preflight the vault CLI uses, which any token with
+// access to the path may call; when it fails, the version falls back to the configured one, or
+// KV v2.
+func (m *kvMounts) resolve(ctx context.Context, client *api.Client, vaultPath string) (kvMount, string) {
+	m.mu.RLock()
+	configured := kvMount{path: m.mount, version: m.version}
+	m.mu.RUnlock()
+	if configured.path == "" {
+		configured.path = DefaultKVMount
+	}
+	if configured.version == 0 {
+		configured.version = KVv2
+	}
+
+	// Relative paths need no detection when the version is configured
+	relative := !strings.HasPrefix(vaultPath, "/")
+	if relative {
+		if configured.version != KVAuto {
+			return configured, vaultPath
+		}
+		vaultPath = configured.path + "/" + vaultPath
+	}
+	vaultPath = strings.Trim(vaultPath, "/")
+
+	namespace := client.Namespace()
+	if mount, ok := m.lookup(namespace, vaultPath); ok {
+		return mount, strings.TrimPrefix(vaultPath[len(mount.path):], "/")
+	}
+
+	mount, err := preflight(ctx, client, vaultPath)
+	if err != nil {
+		// Without the preflight the mount is the configured one, or the first segment of the path
+		mount.path = configured.path
+		if !relative {
+			mount.path, _, _ = strings.Cut(vaultPath, "/")
+		}
+		mount.version = configured.version
+		if mount.version == KVAuto {
+			mount.version = KVv2
+		}
+		return mount, strings.TrimPrefix(vaultPath[len(mount.path):], "/")
+	}
+
+	m.mu.Lock()
+	if m.detected == nil {
+		m.detected = make(map[string][]kvMount)
+	}
+	m.detected[namespace] = append(m.detected[namespace], mount)
+	m.mu.Unlock()
+	return mount, strings.TrimPrefix(vaultPath[len(mount.path):], "/")
+}
+
+// lookup returns the longest mount detected in namespace containing vaultPath
+func (m *kvMounts) lookup(namespace, vaultPath string) (kvMount, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var found kvMount
+	for _, mount := range m.detected[namespace] {
+		if (vaultPath == mount.path || strings.HasPrefix(vaultPath, mount.path+"/")) && len(mount.path) > len(found.path) {
+			found = mount
+		}
+	}
+	return found, found.path != ""
+}
+
+// preflight asks Vault for the mount of a path and its KV version
+func preflight(ctx context.Context, client *api.Client, vaultPath string) (kvMount, error) {
+	secret, err := client.Logical().ReadWithContext(ctx, "sys/internal/ui/mounts/"+vaultPath)
+	if err != nil {
+		return kvMount{}, err
+	}
+	if secret == nil || secret.Data == nil {
+		return kvMount{}, fmt.Errorf("no mount found for %s", vaultPath)
+	}
+
+	path, _ := secret.Data["path"].(string)
+	mount := kvMount{path: strings.Trim(path, "/"), version: KVv1}
+	if mount.path == "" || !strings.HasPrefix(vaultPath+"/", mount.path+"/") {
+		return kvMount{}, fmt.Errorf("no mount found for %s", vaultPath)
+	}
+	if options, ok := secret.Data["options"].(map[string]interface{}); ok && options["version"] == "2" {
+		mount.version = KVv2
+	}
+	if engine, _ := secret.Data["type"].(string); engine != "" && engine != "kv" && engine != "generic" {
+		mount.logical = true
+	}
+	return mount, nil
+}
@@ -0,0 +1,65 @@
+package vault
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+
+	"vault-docker-proxy/pkg/auth"
+)
+
+var ErrLeaseRenewal = errors.New("Vault lease renewal failed")
+
+// readLeasedSecret reads a secret of an engine other than KV, such as credentials generated for
+// each read, returning its lease when it has one
+func readLeasedSecret(ctx context.Context, client *api.Client, vaultPath string) (map[string]interface{}, *auth.Lease, error) {
+	secret, err := client.Logical().ReadWithContext(ctx, vaultPath)
+	if err != nil {
+		return nil, nil, readError(err)
+	}
+	if secret == nil || secret.Data == nil {
+		return nil, nil, ErrSecretNotFound
+	}
+	if secret.LeaseID == "" {
+		return secret.Data, nil, nil
+	}
+	return secret.Data, &auth.Lease{
+		ID:        secret.LeaseID,
+		Duration:  time.Duration(secret.LeaseDuration) * time.Second,
+		Renewable: secret.Renewable,
+	}, nil
+}
+
+// RenewLease extends a lease by its original duration, using the token that created it. The
+// returned lease may be shorter once the lease approaches its max TTL.
+func (c *Client) RenewLease(ctx context.Context, token string, lease *auth.Lease) (*auth.Lease, error) {
+	client, err := c.withToken(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := client.Sys().RenewWithContext(ctx, lease.ID, int(lease.Duration.Seconds()))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrLeaseRenewal, err)
+	}
+	if secret == nil {
+		return nil, fmt.Errorf("%w: no lease in the renewal response", ErrLeaseRenewal)
+	}
+	return &auth.Lease{
+		ID:        lease.ID,
+		Duration:  time.Duration(secret.LeaseDuration) * time.Second,
+		Renewable: secret.Renewable,
+	}, nil
+}
+
+// RevokeLease revokes a lease, using the token that created it, so the secrets engine deletes
+// the credentials behind it
+func (c *Client) RevokeLease(ctx context.Context, token, leaseID string) error {
+	client, err := c.withToken(ctx, token)
+	if err != nil {
+		return err
+	}
+	return client.Sys().RevokeWithContext(ctx, leaseID)
+}
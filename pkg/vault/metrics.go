@@ -0,0 +1,289 @@
+package vault
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the upper bounds of the call latency histogram
+var latencyBuckets = []time.Duration{
+	5 * time.Millisecond, 10 * time.Millisecond, 25 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 250 * time.Millisecond, 500 * time.Millisecond, time.Second,
+	2500 * time.Millisecond, 5 * time.Second,
+}
+
+// Error types of failed Vault calls. Unavailability errors tell about the health of Vault itself;
+// the others are caused by the token or path used.
+const (
+	ErrorTypeConnection       = "connection"
+	ErrorTypeTimeout          = "timeout"
+	ErrorTypeServer           = "server_error"
+	ErrorTypeRateLimited      = "rate_limited"
+	ErrorTypePermissionDenied = "permission_denied"
+	ErrorTypeNotFound         = "not_found"
+	ErrorTypeBadRequest       = "bad_request"
+)
+
+// Metrics is a snapshot of the Vault client metrics
+type Metrics struct {
+	Calls      uint64                      `json:"calls"`
+	Errors     uint64                      `json:"errors"`
+	ErrorTypes map[string]uint64           `json:"error_types"`
+	Operations map[string]OperationMetrics `json:"operations"`
+	Token      *TokenStatus                `json:"token,omitempty"`
+}
+
+// OperationMetrics are the call counts and latencies of one kind of Vault call
+type OperationMetrics struct {
+	Calls        uint64          `json:"calls"`
+	Errors       uint64          `json:"errors"`
+	LatencyAvgMS float64         `json:"latency_avg_ms"`
+	LatencyMaxMS float64         `json:"latency_max_ms"`
+	Latency      []LatencyBucket `json:"latency_histogram"`
+}
+
+// LatencyBucket counts the calls that took at most LE, cumulatively like a Prometheus histogram
+type LatencyBucket struct {
+	LE    string `json:"le"`
+	Count uint64 `json:"count"`
+}
+
+// TokenStatus describes the client's own token as last looked up by the token monitor
+type TokenStatus struct {
+	CheckedAt  time.Time  `json:"checked_at"`
+	Valid      bool       `json:"valid"`
+	TTLSeconds int64      `json:"ttl_seconds"` // 0 for tokens that do not expire
+	ExpireTime *time.Time `json:"expire_time,omitempty"`
+	Renewable  bool       `json:"renewable"`
+	Error      string     `json:"error,omitempty"`
+}
+
+// UnavailableErrors returns the number of failed calls caused by Vault being unreachable,
+// overloaded or failing
+func (m Metrics) UnavailableErrors() uint64 {
+	return m.ErrorTypes[ErrorTypeConnection] + m.ErrorTypes[ErrorTypeTimeout] +
+		m.ErrorTypes[ErrorTypeServer] + m.ErrorTypes[ErrorTypeRateLimited]
+}
+
+// metrics records every call made by the Vault API client
+type metrics struct {
+	mu         sync.Mutex
+	calls      uint64
+	errors     uint64
+	errorTypes map[string]uint64
+	operations map[string]*operationMetrics
+	token      *TokenStatus
+}
+
+// operationMetrics is the mutable state behind OperationMetrics
+type operationMetrics struct {
+	calls   uint64
+	errors  uint64
+	total   time.Duration
+	max     time.Duration
+	buckets []uint64 // one per latency bucket, plus one for slower calls
+}
+
+// record adds a call to the metrics; errorType is empty for successful calls
+func (m *metrics) record(operation string, latency time.Duration, errorType string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	op, ok := m.operations[operation]
+	if !ok {
+		op = &operationMetrics{buckets: make([]uint64, len(latencyBuckets)+1)}
+		m.operations[operation] = op
+	}
+	op.calls++
+	op.total += latency
+	op.max = max(op.max, latency)
+	op.buckets[sort.Search(len(latencyBuckets), func(i int) bool { return latency <= latencyBuckets[i] })]++
+	m.calls++
+
+	if errorType != "" {
+		op.errors++
+		m.errors++
+		m.errorTypes[errorType]++
+	}
+}
+
+// snapshot returns a copy of the metrics
+func (m *metrics) snapshot() Metrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	snapshot := Metrics{
+		Calls:      m.calls,
+		Errors:     m.errors,
+		ErrorTypes: make(map[string]uint64, len(m.errorTypes)),
+		Operations: make(map[string]OperationMetrics, len(m.operations)),
+	}
+	for errorType, count := range m.errorTypes {
+		snapshot.ErrorTypes[errorType] = count
+	}
+	for name, op := range m.operations {
+		histogram := make([]LatencyBucket, 0, len(op.buckets))
+		var cumulative uint64
+		for i, count := range op.buckets {
+			cumulative += count
+			bound := "+Inf"
+			if i < len(latencyBuckets) {
+				bound = latencyBuckets[i].String()
+			}
+			histogram = append(histogram, LatencyBucket{LE: bound, Count: cumulative})
+		}
+		snapshot.Operations[name] = OperationMetrics{
+			Calls:        op.calls,
+			Errors:       op.errors,
+			LatencyAvgMS: milliseconds(op.total) / float64(max(op.calls, 1)),
+			LatencyMaxMS: milliseconds(op.max),
+			Latency:      histogram,
+		}
+	}
+	if m.token != nil {
+		token := *m.token
+		snapshot.Token = &token
+	}
+	return snapshot
+}
+
+// metricsTransport records the operation, latency and outcome of Vault API requests. Clones of
+// the API client share the transport, so calls made with other tokens are recorded as well.
+type metricsTransport struct {
+	base    http.RoundTripper
+	metrics *metrics
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	latency := time.Since(start)
+
+	errorType := ""
+	switch {
+	case err != nil && (errors.Is(err, context.DeadlineExceeded) || isTimeout(err)):
+		errorType = ErrorTypeTimeout
+	case err != nil:
+		errorType = ErrorTypeConnection
+	default:
+		errorType = statusErrorType(resp.StatusCode)
+	}
+	t.metrics.record(operationOf(req), latency, errorType)
+	return resp, err
+}
+
+// statusErrorType classifies a Vault response status, or returns "" for successes
+func statusErrorType(status int) string {
+	switch {
+	case status < 400:
+		return ""
+	case status == http.StatusForbidden || status == http.StatusUnauthorized:
+		return ErrorTypePermissionDenied
+	case status == http.StatusNotFound:
+		return ErrorTypeNotFound
+	case status == http.StatusTooManyRequests:
+		return ErrorTypeRateLimited
+	case status >= 500:
+		return ErrorTypeServer
+	}
+	return ErrorTypeBadRequest
+}
+
+// isTimeout reports whether a transport error is a timeout
+func isTimeout(err error) bool {
+	var timeout interface{ Timeout() bool }
+	return errors.As(err, &timeout) && timeout.Timeout()
+}
+
+// operationOf names the kind of Vault call made by a request, without the secret path
+func operationOf(req *http.Request) string {
+	path := strings.TrimPrefix(req.URL.Path, "/v1/")
+	switch {
+	case strings.HasPrefix(path, "auth/token/"):
+		return "token_" + strings.ReplaceAll(strings.TrimPrefix(path, "auth/token/"), "-", "_")
+	case strings.HasPrefix(path, "auth/"):
+		return "auth_login"
+	case strings.HasPrefix(path, "sys/leases/"):
+		return "lease_" + strings.TrimPrefix(path, "sys/leases/")
+	case strings.HasPrefix(path, "sys/internal/ui/mounts/"):
+		return "kv_preflight"
+	case strings.HasPrefix(path, "identity/"):
+		return "identity_read"
+	case strings.Contains(path, "/sign/"):
+		return "transit_sign"
+	case strings.Contains(path, "/keys/"):
+		return "transit_key"
+	case req.Method == http.MethodGet && !strings.HasPrefix(path, "sys/"):
+		return "kv_read" // KV v2 reads under data/, and KV v1 reads
+	}
+	return "other_" + strings.ToLower(req.Method)
+}
+
+// milliseconds converts a duration to fractional milliseconds
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// Metrics returns a snapshot of the calls made to Vault and of the client's own token
+func (c *Client) Metrics() Metrics {
+	return c.metrics.snapshot()
+}
+
+// RunTokenMonitor looks up the client's own token every interval until ctx is cancelled,
+// recording its remaining TTL and logging when it is invalid or expires within twice interval
+func (c *Client) RunTokenMonitor(ctx context.Context, interval time.Duration) {
+	c.checkToken(ctx, interval)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.checkToken(ctx, interval)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// checkToken looks up the client's own token and records its status
+func (c *Client) checkToken(ctx context.Context, interval time.Duration) {
+	status := &TokenStatus{CheckedAt: time.Now()}
+	defer func() {
+		c.metrics.mu.Lock()
+		c.metrics.token = status
+		c.metrics.mu.Unlock()
+	}()
+
+	tokenInfo, err := c.client.Auth().Token().LookupSelfWithContext(ctx)
+	if err != nil || tokenInfo == nil {
+		if err == nil {
+			err = ErrInvalidToken
+		}
+		status.Error = err.Error()
+		slog.Error("Vault token lookup failed", "error", err)
+		return
+	}
+	status.Valid = true
+
+	ttl, err := tokenInfo.TokenTTL()
+	if err == nil {
+		status.TTLSeconds = int64(ttl.Seconds())
+		if ttl > 0 {
+			expireTime := status.CheckedAt.Add(ttl).Truncate(time.Second)
+			status.ExpireTime = &expireTime
+		}
+	}
+	status.Renewable, _ = tokenInfo.TokenIsRenewable()
+
+	if ttl > 0 && ttl < 2*interval {
+		slog.Warn("Vault token expires soon", "expires_in", ttl.Round(time.Second))
+	}
+}
@@ -0,0 +1,51 @@
+package vault
+
+import (
+	"context"
+	"strings"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// namespaceKey is the context key of the namespace of a request
+type namespaceKey struct{}
+
+// WithNamespace returns a context whose Vault calls are made in namespace, relative to the
+// client's own namespace. Namespaces are a Vault Enterprise feature.
+func WithNamespace(ctx context.Context, namespace string) context.Context {
+	if namespace = strings.Trim(namespace, "/"); namespace == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, namespaceKey{}, namespace)
+}
+
+// SetNamespace sets the namespace of the client's Vault calls, sent as the X-Vault-Namespace
+// header. Namespaces of requests nest under it.
+func (c *Client) SetNamespace(namespace string) {
+	c.namespace = strings.Trim(namespace, "/")
+	if c.namespace == "" {
+		c.client.ClearNamespace()
+		return
+	}
+	c.client.SetNamespace(c.namespace)
+}
+
+// namespaceOf returns the namespace of the Vault calls made with ctx
+func (c *Client) namespaceOf(ctx context.Context) string {
+	namespace, _ := ctx.Value(namespaceKey{}).(string)
+	switch {
+	case namespace == "":
+		return c.namespace
+	case c.namespace == "":
+		return namespace
+	}
+	return c.namespace + "/" + namespace
+}
+
+// inNamespace returns the underlying API client, with its own token, in the namespace of ctx
+func (c *Client) inNamespace(ctx context.Context) *api.Client {
+	if _, ok := ctx.Value(namespaceKey{}).(string); !ok {
+		return c.client
+	}
+	return c.client.WithNamespace(c.namespaceOf(ctx))
+}
@@ -0,0 +1,133 @@
+package vault
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// renewRetryInterval bounds the wait between failed renewals or logins of the proxy's own token
+const renewRetryInterval = 30 * time.Second
+
+var ErrRenewFailed = errors.New("Vault token renewal failed")
+
+// errNotExtendable reports a token that can neither be renewed nor replaced by a login
+var errNotExtendable = errors.New("Vault token cannot be renewed")
+
+// TokenLease is the lifetime of a Vault token when it was obtained, renewed or looked up
+type TokenLease struct {
+	TTL       time.Duration // zero for tokens that do not expire
+	Renewable bool
+}
+
+// leaseOf returns the lease of a token from a login or renewal response
+func leaseOf(secretAuth *api.SecretAuth) TokenLease {
+	return TokenLease{
+		TTL:       time.Duration(secretAuth.LeaseDuration) * time.Second,
+		Renewable: secretAuth.Renewable,
+	}
+}
+
+// LookupLease looks up the lease of the client's own token, such as one set from VAULT_TOKEN
+func (c *Client) LookupLease(ctx context.Context) (TokenLease, error) {
+	tokenInfo, err := c.client.Auth().Token().LookupSelfWithContext(ctx)
+	if err != nil {
+		return TokenLease{}, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	if tokenInfo == nil {
+		return TokenLease{}, ErrInvalidToken
+	}
+	ttl, err := tokenInfo.TokenTTL()
+	if err != nil {
+		return TokenLease{}, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	renewable, _ := tokenInfo.TokenIsRenewable()
+	return TokenLease{TTL: ttl, Renewable: renewable}, nil
+}
+
+// RunTokenRenewal keeps the client's own token valid until ctx is cancelled, so requests served
+// with it do not fail mid-pull. Once two thirds of its TTL have passed the token is renewed; when
+// method is set, a token that is not renewable or has reached its max TTL is replaced by logging
+// in again. Failures are retried with jittered backoff while the token is still valid. lease is
+// that of the current token, from Login or LookupLease.
+func (c *Client) RunTokenRenewal(ctx context.Context, method api.AuthMethod, lease TokenLease) {
+	if lease.TTL <= 0 {
+		return
+	}
+	increment := lease.TTL // requested at each renewal, the TTL the token was issued with
+	expiresAt := time.Now().Add(lease.TTL)
+	wait := lease.TTL * 2 / 3
+	for failures := 0; ; {
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return
+		}
+
+		next, loggedIn, err := c.extendToken(ctx, method, lease, increment)
+		if errors.Is(err, errNotExtendable) {
+			slog.Warn("Vault token cannot be renewed any further", "expires_in", time.Until(expiresAt).Round(time.Second))
+			return
+		}
+		if err != nil {
+			remaining := time.Until(expiresAt)
+			slog.Error("Failed to extend the Vault token", "error", err, "expires_in", remaining.Round(time.Second))
+			wait = retryDelay(failures, remaining)
+			failures++
+			continue
+		}
+		failures = 0
+		if next.TTL <= 0 {
+			return
+		}
+		if loggedIn {
+			increment = next.TTL
+		}
+		lease, expiresAt, wait = next, time.Now().Add(next.TTL), next.TTL*2/3
+	}
+}
+
+// extendToken renews the client's own token, or logs in again with method when the token is not
+// renewable, its renewal is refused or it has reached its max TTL. It reports whether the token
+// was replaced by a login.
+func (c *Client) extendToken(ctx context.Context, method api.AuthMethod, lease TokenLease, increment time.Duration) (TokenLease, bool, error) {
+	if lease.Renewable {
+		secret, err := c.client.Auth().Token().RenewSelfWithContext(ctx, int(increment.Seconds()))
+		var respErr *api.ResponseError
+		switch {
+		case err == nil && (secret == nil || secret.Auth == nil):
+			return TokenLease{}, false, fmt.Errorf("%w: no lease in the renewal response", ErrRenewFailed)
+		case err == nil:
+			renewed := leaseOf(secret.Auth)
+			if renewed.TTL >= increment {
+				return renewed, false, nil
+			}
+			// Capped by the max TTL: the next renewal cannot extend it further
+			if method == nil {
+				slog.Info("Vault token renewed up to its max TTL", "expires_in", renewed.TTL.Round(time.Second))
+				renewed.Renewable = false
+				return renewed, false, nil
+			}
+		case method == nil || !errors.As(err, &respErr) || respErr.StatusCode >= 500:
+			return TokenLease{}, false, fmt.Errorf("%w: %v", ErrRenewFailed, err)
+		}
+	}
+	if method == nil {
+		return TokenLease{}, false, errNotExtendable
+	}
+	next, err := c.Login(ctx, method)
+	return next, err == nil, err
+}
+
+// retryDelay returns the wait before a retry, exponential from one second up to
+// renewRetryInterval and at most half the remaining token lifetime, so several attempts fit
+// before the token expires. Jitter spreads the retries of replicas sharing a Vault.
+func retryDelay(failures int, remaining time.Duration) time.Duration {
+	delay := min(time.Second<<min(failures, 5), renewRetryInterval, max(remaining/2, time.Second))
+	return delay/2 + rand.N(delay/2+1)
+}
@@ -0,0 +1,62 @@
+package vault
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// tokenFilePollInterval is how often a token file is checked for a new token
+const tokenFilePollInterval = 5 * time.Second
+
+// LoadTokenFile sets the client's own token from a file, such as the sink file Vault Agent
+// auto-auth writes its token to
+func (c *Client) LoadTokenFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("%w: failed to read token file: %v", ErrInvalidToken, err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return fmt.Errorf("%w: token file %s is empty", ErrInvalidToken, path)
+	}
+	if token != c.Token() {
+		c.SetToken(token)
+	}
+	return nil
+}
+
+// RunTokenFile reloads the client's own token from a file whenever it changes, until ctx is
+// cancelled. The writer of the file, Vault Agent, renews and replaces the token, so the proxy
+// does not. A missing or empty file keeps the current token.
+func (c *Client) RunTokenFile(ctx context.Context, path string) {
+	ticker := time.NewTicker(tokenFilePollInterval)
+	defer ticker.Stop()
+
+	var lastErr string
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		previous := c.Token()
+		err := c.LoadTokenFile(path)
+		switch {
+		case err != nil:
+			// Logged once until the file is readable again
+			if err.Error() != lastErr {
+				slog.Warn("Failed to reload the Vault token file, keeping the current token", "error", err)
+			}
+			lastErr = err.Error()
+			continue
+		case c.Token() != previous:
+			slog.Info("Reloaded the Vault token", "file", path)
+		}
+		lastErr = ""
+	}
+}
@@ -0,0 +1,117 @@
+package vault
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrTransitKeyNotFound = errors.New("transit key not found in Vault")
+)
+
+// TransitKey describes an asymmetric Vault Transit key and the public keys of its versions
+type TransitKey struct {
+	Name          string
+	Type          string         // e.g. ecdsa-p256, rsa-2048, ed25519
+	LatestVersion int            // version used for new signatures
+	PublicKeys    map[int]string // version -> PEM public key (base64 raw key for ed25519)
+}
+
+// ReadTransitKey reads an asymmetric Transit key using the client's own token
+func (c *Client) ReadTransitKey(ctx context.Context, mount, name string) (*TransitKey, error) {
+	secret, err := c.client.Logical().ReadWithContext(ctx, fmt.Sprintf("%s/keys/%s", mount, name))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrVaultConnection, err)
+	}
+	if secret == nil || secret.Data == nil {
+		return nil, ErrTransitKeyNotFound
+	}
+
+	key := &TransitKey{Name: name, PublicKeys: make(map[int]string)}
+	key.Type, _ = secret.Data["type"].(string)
+	if key.LatestVersion, err = intValue(secret.Data["latest_version"]); err != nil {
+		return nil, fmt.Errorf("invalid latest_version for transit key %s: %v", name, err)
+	}
+
+	versions, _ := secret.Data["keys"].(map[string]interface{})
+	for version, value := range versions {
+		n, err := strconv.Atoi(version)
+		if err != nil {
+			continue
+		}
+		if info, ok := value.(map[string]interface{}); ok {
+			if publicKey, ok := info["public_key"].(string); ok && publicKey != "" {
+				key.PublicKeys[n] = publicKey
+			}
+		}
+	}
+	if len(key.PublicKeys) == 0 {
+		return nil, fmt.Errorf("transit key %s has no public keys, an asymmetric key type is required", name)
+	}
+
+	return key, nil
+}
+
+// TransitSign signs input with a version of a Transit key and returns the raw signature.
+// ECDSA signatures are requested in JWS (r||s) form and RSA signatures use PKCS#1 v1.5.
+func (c *Client) TransitSign(ctx context.Context, mount string, key *TransitKey, version int, input []byte) ([]byte, error) {
+	path := fmt.Sprintf("%s/sign/%s/sha2-256", mount, key.Name)
+	data := map[string]interface{}{
+		"input":       base64.StdEncoding.EncodeToString(input),
+		"key_version": version,
+	}
+	encoding := base64.StdEncoding
+	switch {
+	case strings.HasPrefix(key.Type, "ecdsa"):
+		data["marshaling_algorithm"] = "jws"
+		encoding = base64.RawURLEncoding
+	case strings.HasPrefix(key.Type, "rsa"):
+		data["signature_algorithm"] = "pkcs1v15"
+	case key.Type == "ed25519":
+		// Ed25519 signs the message itself, not a digest
+		path = fmt.Sprintf("%s/sign/%s", mount, key.Name)
+	}
+
+	secret, err := c.client.Logical().WriteWithContext(ctx, path, data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrVaultConnection, err)
+	}
+	if secret == nil || secret.Data == nil {
+		return nil, fmt.Errorf("transit sign returned no data")
+	}
+
+	signature, _ := secret.Data["signature"].(string)
+	// Signatures are formatted as vault:v<version>:<signature>
+	parts := strings.SplitN(signature, ":", 3)
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("unexpected transit signature format")
+	}
+	return encoding.DecodeString(parts[2])
+}
+
+// RotateTransitKey creates a new version of a Transit key
+func (c *Client) RotateTransitKey(ctx context.Context, mount, name string) error {
+	if _, err := c.client.Logical().WriteWithContext(ctx, fmt.Sprintf("%s/keys/%s/rotate", mount, name), nil); err != nil {
+		return fmt.Errorf("%w: %v", ErrVaultConnection, err)
+	}
+	return nil
+}
+
+// intValue converts a number decoded from a Vault response
+func intValue(value interface{}) (int, error) {
+	switch v := value.(type) {
+	case json.Number:
+		n, err := v.Int64()
+		return int(n), err
+	case float64:
+		return int(v), nil
+	case int:
+		return v, nil
+	}
+	return 0, fmt.Errorf("unexpected value %v", value)
+}
@@ -0,0 +1,97 @@
+package vault
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/patrickmn/go-cache"
+)
+
+// WrappedPrefix marks a Basic auth password carrying a response-wrapping token instead of a
+// Vault token: wrapped:<wrapping_token>
+const WrappedPrefix = "wrapped:"
+
+// maxWrappedTokenReuse bounds how long the token unwrapped from a wrapping token is reused
+const maxWrappedTokenReuse = 24 * time.Hour
+
+// WrappedTokens turns the single-use wrapping tokens clients send as password into the Vault
+// tokens they wrap. A wrapping token can only be unwrapped once while clients send their
+// password with every request, so the unwrapped token is kept for its TTL.
+type WrappedTokens struct {
+	client *Client
+	cache  *cache.Cache
+
+	mu sync.Mutex // serializes unwraps, so concurrent first requests share one
+}
+
+// NewWrappedTokens creates an unwrapper of wrapping tokens
+func NewWrappedTokens(client *Client) *WrappedTokens {
+	return &WrappedTokens{
+		client: client,
+		cache:  cache.New(cache.NoExpiration, 10*time.Minute),
+	}
+}
+
+// IsWrappedPassword reports whether a password carries a wrapping token
+func IsWrappedPassword(password string) bool {
+	return strings.HasPrefix(password, WrappedPrefix)
+}
+
+// Token returns the Vault token wrapped by a password of the form wrapped:<wrapping_token>. The
+// wrapped response is either a token creation or login response, or a secret with a token field.
+func (w *WrappedTokens) Token(ctx context.Context, password string) (string, error) {
+	wrappingToken := strings.TrimPrefix(password, WrappedPrefix)
+	if wrappingToken == "" {
+		return "", fmt.Errorf("%w: wrapped password must be of the form %s<wrapping_token>", ErrInvalidToken, WrappedPrefix)
+	}
+
+	// Wrapping tokens are scoped to a namespace
+	sum := sha256.Sum256([]byte(w.client.namespaceOf(ctx) + "\x00" + wrappingToken))
+	key := hex.EncodeToString(sum[:])
+	if token, found := w.cache.Get(key); found {
+		return token.(string), nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if token, found := w.cache.Get(key); found {
+		return token.(string), nil
+	}
+
+	client, err := w.client.withToken(ctx, "")
+	if err != nil {
+		return "", err
+	}
+	secret, err := client.Logical().UnwrapWithContext(ctx, wrappingToken)
+	if err != nil {
+		var respErr *api.ResponseError
+		if errors.As(err, &respErr) && respErr.StatusCode < 500 {
+			return "", fmt.Errorf("%w: wrapping token rejected (already unwrapped, expired or invalid): %s", ErrInvalidToken, strings.Join(respErr.Errors, "; "))
+		}
+		return "", fmt.Errorf("%w: %v", ErrVaultConnection, err)
+	}
+
+	var token string
+	ttl := maxWrappedTokenReuse
+	switch {
+	case secret != nil && secret.Auth != nil && secret.Auth.ClientToken != "":
+		token = secret.Auth.ClientToken
+		if lease := time.Duration(secret.Auth.LeaseDuration) * time.Second; lease > 0 {
+			ttl = min(lease, ttl)
+		}
+	case secret != nil && secret.Data != nil:
+		token, _ = secret.Data["token"].(string)
+	}
+	if token == "" {
+		return "", fmt.Errorf("%w: the wrapped response holds no Vault token", ErrInvalidToken)
+	}
+	w.cache.Set(key, token, ttl)
+	return token, nil
+}
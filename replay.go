@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"vault-docker-proxy/pkg/recorder"
+)
+
+// runReplay implements the "replay" subcommand, which re-issues recorded requests against a
+// test proxy and compares the response statuses with the recording
+func runReplay(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	file := fs.String("file", "", "recording file written by the proxy recorder")
+	target := fs.String("target", "http://localhost:8080", "base URL of the proxy to replay against")
+	username := fs.String("username", "", "proxy-style username substituted for redacted Basic credentials")
+	token := fs.String("token", os.Getenv("VAULT_TOKEN"), "Vault token substituted for redacted Basic credentials (defaults to $VAULT_TOKEN)")
+	bearer := fs.String("bearer", "", "token substituted for redacted Bearer credentials")
+	delay := fs.Duration("delay", 0, "pause between requests")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *file == "" {
+		fmt.Fprintln(os.Stderr, "replay: -file is required")
+		fs.Usage()
+		return 2
+	}
+
+	records, err := recorder.ReadRecords(*file)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "replay: %v\n", err)
+		return 1
+	}
+
+	client := &http.Client{
+		// Surface redirects exactly as the proxy returned them
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	mismatches := 0
+	for i, record := range records {
+		status, err := replayRecord(client, strings.TrimSuffix(*target, "/"), record, *username, *token, *bearer)
+
+		result := "OK"
+		switch {
+		case err != nil:
+			result = "ERROR " + err.Error()
+			mismatches++
+		case status != record.Status:
+			result = "MISMATCH"
+			mismatches++
+		}
+		fmt.Printf("%4d %-6s %-60s recorded=%d replayed=%d %s\n", i+1, record.Method, record.Path, record.Status, status, result)
+
+		if *delay > 0 {
+			time.Sleep(*delay)
+		}
+	}
+
+	fmt.Printf("Replayed %d request(s), %d mismatch(es)\n", len(records), mismatches)
+	if mismatches > 0 {
+		return 1
+	}
+	return 0
+}
+
+// replayRecord re-issues a single recorded request and returns the response status
+func replayRecord(client *http.Client, target string, record *recorder.Record, username, token, bearer string) (int, error) {
+	url := target + record.Path
+	if record.RawQuery != "" {
+		url += "?" + record.RawQuery
+	}
+
+	req, err := http.NewRequest(record.Method, url, bytes.NewReader(record.RequestBody))
+	if err != nil {
+		return 0, err
+	}
+
+	for name, values := range record.RequestHeaders {
+		if name == "Authorization" || name == "Content-Length" {
+			continue
+		}
+		req.Header[name] = values
+	}
+
+	// Recordings only keep the authorization scheme, so substitute live credentials
+	switch authValue := record.RequestHeaders.Get("Authorization"); {
+	case strings.HasPrefix(authValue, "Basic ") && username != "":
+		req.SetBasicAuth(username, token)
+	case strings.HasPrefix(authValue, "Bearer ") && bearer != "":
+		req.Header.Set("Authorization", "Bearer "+bearer)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,14 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// runService reports that service management is only available on Windows
+func runService(args []string) int {
+	fmt.Fprintln(os.Stderr, "service: Windows service support is only available on Windows; use systemd or a container runtime elsewhere")
+	return 2
+}
@@ -0,0 +1,206 @@
+//go:build windows
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+const (
+	DefaultServiceName        = "vault-docker-proxy"
+	DefaultServiceDisplayName = "Vault Docker Registry Proxy"
+)
+
+// runService implements the "service" subcommand: install, uninstall, start, stop and run
+// (the entry point used by the Windows service control manager)
+func runService(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: vault-docker-proxy service <install|uninstall|start|stop|run> [-name NAME] [-- server flags]")
+		return 2
+	}
+
+	fs := flag.NewFlagSet("service "+args[0], flag.ContinueOnError)
+	name := fs.String("name", DefaultServiceName, "Windows service name")
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+	// Remaining arguments are passed to the proxy server, e.g. -config C:\vdp\config.yaml
+	serverArgs := fs.Args()
+
+	var err error
+	switch args[0] {
+	case "install":
+		err = installService(*name, serverArgs)
+	case "uninstall":
+		err = uninstallService(*name)
+	case "start":
+		err = controlService(*name, func(s *mgr.Service) error { return s.Start() })
+	case "stop":
+		err = controlService(*name, func(s *mgr.Service) error {
+			_, err := s.Control(svc.Stop)
+			return err
+		})
+	case "run":
+		err = svc.Run(*name, &proxyService{name: *name, args: serverArgs})
+	default:
+		err = fmt.Errorf("unknown service command %q", args[0])
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "service %s: %v\n", args[0], err)
+		return 1
+	}
+	return 0
+}
+
+// installService registers the proxy with the service control manager and the event log
+func installService(name string, serverArgs []string) error {
+	exePath, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	exePath, err = filepath.Abs(exePath)
+	if err != nil {
+		return err
+	}
+
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	if s, err := m.OpenService(name); err == nil {
+		s.Close()
+		return fmt.Errorf("service %s already exists", name)
+	}
+
+	args := append([]string{"service", "run", "-name", name}, serverArgs...)
+	s, err := m.CreateService(name, exePath, mgr.Config{
+		DisplayName: DefaultServiceDisplayName,
+		Description: "Docker Registry v2 proxy using credentials from HashiCorp Vault",
+		StartType:   mgr.StartAutomatic,
+	}, args...)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	if err := eventlog.InstallAsEventCreate(name, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+		s.Delete()
+		return fmt.Errorf("failed to register event source: %v", err)
+	}
+
+	fmt.Printf("Installed service %s (%s %v)\n", name, exePath, args)
+	return nil
+}
+
+// uninstallService removes the service and its event log source
+func uninstallService(name string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(name)
+	if err != nil {
+		return fmt.Errorf("service %s is not installed", name)
+	}
+	defer s.Close()
+
+	if err := s.Delete(); err != nil {
+		return err
+	}
+	eventlog.Remove(name)
+
+	fmt.Printf("Uninstalled service %s\n", name)
+	return nil
+}
+
+// controlService opens the named service and applies fn to it
+func controlService(name string, fn func(*mgr.Service) error) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(name)
+	if err != nil {
+		return fmt.Errorf("service %s is not installed", name)
+	}
+	defer s.Close()
+
+	return fn(s)
+}
+
+// proxyService adapts runServer to the Windows service control manager
+type proxyService struct {
+	name string
+	args []string
+}
+
+// Execute implements svc.Handler
+func (p *proxyService) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	if elog, err := eventlog.Open(p.name); err == nil {
+		defer elog.Close()
+		log.SetOutput(&eventLogWriter{elog: elog})
+	}
+
+	status <- svc.Status{State: svc.StartPending}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- runServer(ctx, p.args)
+	}()
+
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+
+	for {
+		select {
+		case err := <-errCh:
+			if err != nil {
+				slog.Error("Proxy stopped", "error", err)
+				return true, 1
+			}
+			return false, 0
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				cancel()
+				select {
+				case <-errCh:
+				case <-time.After(ShutdownTimeout):
+				}
+				return false, 0
+			}
+		}
+	}
+}
+
+// eventLogWriter sends standard log output to the Windows event log
+type eventLogWriter struct {
+	elog *eventlog.Log
+}
+
+func (w *eventLogWriter) Write(p []byte) (int, error) {
+	return len(p), w.elog.Info(1, string(p))
+}
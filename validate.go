@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+
+	"vault-docker-proxy/pkg/config"
+	"vault-docker-proxy/pkg/devmode"
+	"vault-docker-proxy/pkg/imagepolicy"
+	"vault-docker-proxy/pkg/registry"
+	"vault-docker-proxy/pkg/token"
+	"vault-docker-proxy/pkg/transport"
+)
+
+// runValidateConfig implements the "validate-config" subcommand, which loads the configuration
+// exactly as the server would and reports every problem found
+func runValidateConfig(args []string) int {
+	fs := flag.NewFlagSet("validate-config", flag.ContinueOnError)
+	configPath := fs.String("config", os.Getenv("CONFIG_FILE"), "path to the YAML configuration file")
+	skipListen := fs.Bool("skip-listen-check", false, "do not try to bind the configured listeners")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *configPath == "" && fs.NArg() > 0 {
+		*configPath = fs.Arg(0)
+	}
+
+	problems := validateConfig(*configPath, *skipListen)
+	if len(problems) == 0 {
+		fmt.Println("Configuration OK")
+		return 0
+	}
+
+	fmt.Fprintf(os.Stderr, "Configuration %s has %d problem(s):\n", *configPath, len(problems))
+	for _, problem := range problems {
+		fmt.Fprintf(os.Stderr, "  - %s\n", problem)
+	}
+	return 1
+}
+
+// validateConfig returns a list of human readable problems with the configuration
+func validateConfig(path string, skipListen bool) []string {
+	cfg, err := config.Load(path)
+	if err != nil {
+		return validationMessages(err)
+	}
+
+	problems := validationMessages(cfg.Validate())
+
+	if cfg.Dev.Enabled {
+		if _, err := devmode.LoadFixture(cfg.Dev.Fixture); err != nil {
+			problems = append(problems, fmt.Sprintf("dev.fixture: %v", err))
+		}
+	}
+
+	if cfg.Token.Signing.PEMFile != "" {
+		if _, err := token.NewPEMKeySource(cfg.Token.Signing.PEMFile); err != nil {
+			problems = append(problems, fmt.Sprintf("token.signing.pem_file: %v", err))
+		}
+	}
+
+	if len(cfg.Access.Policies) > 0 {
+		policies, environments, err := accessPolicies(cfg.Access)
+		if err == nil {
+			err = registry.NewProxyServer(nil).SetAccessPolicies(policies, environments)
+		}
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("access.policies: %v", err))
+		}
+	}
+
+	if cfg.ImagePolicy.File != "" {
+		if _, err := imagepolicy.Load(cfg.ImagePolicy.File); err != nil {
+			problems = append(problems, fmt.Sprintf("image_policy.file: %v", err))
+		}
+	}
+
+	if len(cfg.Upstream.Pins) > 0 {
+		if _, err := transport.NewPinnedTransport(&http.Transport{}, upstreamPins(cfg.Upstream)); err != nil {
+			problems = append(problems, fmt.Sprintf("upstream.pins: %v", err))
+		}
+	}
+
+	if _, err := ociLayouts(nil, cfg.Upstream.OCILayouts); err != nil {
+		problems = append(problems, fmt.Sprintf("upstream.oci_layouts: %v", err))
+	}
+
+	if _, err := probeTargets(cfg.Upstream.Probe); err != nil {
+		problems = append(problems, fmt.Sprintf("upstream.probe.registries: %v", err))
+	}
+
+	if cfg.Exec.Command != "" {
+		if _, err := exec.LookPath(cfg.Exec.Command); err != nil {
+			problems = append(problems, fmt.Sprintf("exec.command: %v", err))
+		}
+	}
+
+	if !skipListen && len(problems) == 0 {
+		var binds []listenCheck
+		for i, listener := range cfg.Listeners() {
+			key := "listen"
+			if i > 0 {
+				key = fmt.Sprintf("listen.additional[%d]", i-1)
+			}
+			binds = append(binds, listenCheck{key, listener.Network, listener.Addr()})
+		}
+		if cfg.Admin.Port != "" {
+			binds = append(binds, listenCheck{"admin.port", "tcp", net.JoinHostPort(cfg.Admin.Address, cfg.Admin.Port)})
+		}
+		if cfg.Admin.GRPCPort != "" {
+			binds = append(binds, listenCheck{"admin.grpc_port", "tcp", net.JoinHostPort(cfg.Admin.Address, cfg.Admin.GRPCPort)})
+		}
+		for _, bind := range binds {
+			listener, err := net.Listen(bind.network, bind.addr)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("%s: cannot listen on %s: %v", bind.key, bind.addr, err))
+				continue
+			}
+			listener.Close()
+		}
+	}
+
+	return problems
+}
+
+// listenCheck is an address the validate command tries to bind
+type listenCheck struct {
+	key, network, addr string
+}
+
+// validationMessages flattens a configuration error into individual messages
+func validationMessages(err error) []string {
+	if err == nil {
+		return nil
+	}
+
+	var validationErrs *config.ValidationErrors
+	if errors.As(err, &validationErrs) {
+		return validationErrs.Errors
+	}
+	return []string{err.Error()}
+}